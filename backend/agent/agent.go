@@ -0,0 +1,218 @@
+// Package agent implements the local agent: a sidecar that receives spans,
+// metrics and error events from SDKs on the same host, over a Unix socket
+// or localhost UDP, and forwards them to a central collector in compressed
+// batches, retrying while the collector is unreachable. Applications hand
+// their data off locally and don't buffer it through network failures.
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Config configures the agent
+type Config struct {
+	// Collector is the base URL of the central collector
+	Collector string
+	// Token authenticates the agent to the collector when it requires auth
+	Token string
+	// Tenant is the tenant of data received without one
+	Tenant string
+	// Socket is the path of the Unix socket serving the SDK ingestion API,
+	// and UDPAddr the address receiving datagrams. Empty disables either.
+	Socket  string
+	UDPAddr string
+	// BatchSize and FlushInterval bound how long data waits to be sent
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	// A batch that fails is retried MaxRetries times, then put back to be
+	// sent with the next flush while the queue has room
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// QueueSize bounds the spans, metrics and error events each held while
+	// the collector is unreachable. Data beyond it is dropped.
+	QueueSize int
+	// Compress gzips batches sent to the collector
+	Compress bool
+}
+
+// Stats reports the agent counters of one kind of data
+type Stats struct {
+	Received  int64 `json:"received"`
+	Forwarded int64 `json:"forwarded"`
+	// Rejected counts items the collector refused, which are not retried
+	Rejected int64 `json:"rejected"`
+	// Dropped counts items discarded because the queue was full
+	Dropped int64 `json:"dropped"`
+	Retries int64 `json:"retries"`
+	Queued  int   `json:"queued"`
+}
+
+// Agent receives data from local SDKs and forwards it to a collector
+type Agent struct {
+	config  Config
+	client  *http.Client
+	spans   *queue[models.Span]
+	metrics *queue[models.Metric]
+	errors  *queue[models.ErrorEvent]
+
+	server   *http.Server
+	listener net.Listener
+	udp      net.PacketConn
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// unreachable is set while sends get no response from the collector,
+	// so outages are logged once rather than per batch
+	unreachable bool
+}
+
+// New creates an agent. Start begins receiving and forwarding.
+func New(config Config) *Agent {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 500 * time.Millisecond
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100 * config.BatchSize
+	}
+
+	a := &Agent{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	a.spans = newQueue(a, "spans", "/api/v1/spans",
+		func(s *models.Span) *string { return &s.TenantID },
+		func(spans []models.Span) any { return models.SpanBatch{Spans: spans} })
+	a.metrics = newQueue(a, "metrics", "/api/v1/metrics",
+		func(m *models.Metric) *string { return &m.TenantID },
+		func(metrics []models.Metric) any { return models.MetricBatch{Metrics: metrics} })
+	a.errors = newQueue(a, "errors", "/api/v1/errors",
+		func(e *models.ErrorEvent) *string { return &e.TenantID },
+		func(events []models.ErrorEvent) any { return models.ErrorEventBatch{Errors: events} })
+	return a
+}
+
+// Start listens on the configured socket and UDP address and starts
+// forwarding
+func (a *Agent) Start() error {
+	if a.config.Socket == "" && a.config.UDPAddr == "" {
+		return errors.New("no socket or UDP address to listen on")
+	}
+
+	if a.config.Socket != "" {
+		// A socket left behind by an agent that didn't shut down cleanly
+		// would fail the listen
+		if info, err := os.Stat(a.config.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(a.config.Socket)
+		}
+		listener, err := net.Listen("unix", a.config.Socket)
+		if err != nil {
+			return err
+		}
+		a.listener = listener
+		a.server = &http.Server{Handler: a.routes(), ReadTimeout: 30 * time.Second}
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			if err := a.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Printf("Agent: socket server failed: %v", err)
+			}
+		}()
+	}
+
+	if a.config.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", a.config.UDPAddr)
+		if err != nil {
+			if a.listener != nil {
+				a.listener.Close()
+			}
+			return err
+		}
+		// Exporters flush several datagrams at once, more than the
+		// default buffer holds while they're read
+		if udp, ok := conn.(*net.UDPConn); ok {
+			udp.SetReadBuffer(udpReadBuffer)
+		}
+		a.udp = conn
+		a.wg.Add(1)
+		go a.readDatagrams()
+	}
+
+	a.spans.start()
+	a.metrics.start()
+	a.errors.start()
+	return nil
+}
+
+// Stats returns the counters of each kind of data
+func (a *Agent) Stats() map[string]Stats {
+	return map[string]Stats{
+		a.spans.kind:   a.spans.snapshot(),
+		a.metrics.kind: a.metrics.snapshot(),
+		a.errors.kind:  a.errors.snapshot(),
+	}
+}
+
+// Shutdown stops receiving, then sends the queued data until ctx is done
+func (a *Agent) Shutdown(ctx context.Context) error {
+	if a.server != nil {
+		a.server.Shutdown(ctx)
+	}
+	if a.udp != nil {
+		a.udp.Close()
+	}
+	a.wg.Wait()
+
+	var errs []error
+	for _, stop := range []func(context.Context) error{a.spans.stop, a.metrics.stop, a.errors.stop} {
+		if err := stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setReachable logs when the collector stops or starts responding
+func (a *Agent) setReachable(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case err != nil && !a.unreachable:
+		log.Printf("Agent: collector unreachable, queueing data: %v", err)
+	case err == nil && a.unreachable:
+		log.Printf("Agent: collector reachable again")
+	}
+	a.unreachable = err != nil
+}
+
+// String describes the agent's listeners and collector, for logs
+func (a *Agent) String() string {
+	var listeners []string
+	if a.config.Socket != "" {
+		listeners = append(listeners, "socket "+a.config.Socket)
+	}
+	if a.config.UDPAddr != "" {
+		listeners = append(listeners, "UDP "+a.config.UDPAddr)
+	}
+	return fmt.Sprintf("%s, forwarding to %s", strings.Join(listeners, " and "), a.config.Collector)
+}
@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// queue buffers one kind of data and sends it to the collector in batches,
+// one tenant per request so the tenant can travel in the request header
+type queue[T any] struct {
+	agent *Agent
+	kind  string
+	path  string
+	// tenant returns the tenant field of an item, and wrap the request
+	// body of a batch
+	tenant func(*T) *string
+	wrap   func([]T) any
+
+	mu    sync.Mutex
+	items []T
+	// sending counts the items taken from the queue and not yet sent or
+	// put back
+	sending int
+	stats   Stats
+
+	// full signals that a batch is ready before the flush interval
+	full     chan struct{}
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+func newQueue[T any](a *Agent, kind, path string, tenant func(*T) *string, wrap func([]T) any) *queue[T] {
+	return &queue[T]{
+		agent:    a,
+		kind:     kind,
+		path:     path,
+		tenant:   tenant,
+		wrap:     wrap,
+		full:     make(chan struct{}, 1),
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// add queues received items, assigning tenant to those without one.
+// Items beyond the queue size are dropped rather than blocking the SDK.
+func (q *queue[T]) add(tenant string, items []T) {
+	if tenant == "" {
+		tenant = q.agent.config.Tenant
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.Received += int64(len(items))
+	for _, item := range items {
+		if len(q.items) >= q.agent.config.QueueSize {
+			q.stats.Dropped++
+			continue
+		}
+		if t := q.tenant(&item); *t == "" {
+			*t = tenant
+		}
+		q.items = append(q.items, item)
+	}
+	if len(q.items) >= q.agent.config.BatchSize {
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *queue[T]) snapshot() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Queued = len(q.items) + q.sending
+	return stats
+}
+
+func (q *queue[T]) start() {
+	go q.run()
+}
+
+// stop sends the queued items, giving up when ctx is done
+func (q *queue[T]) stop(ctx context.Context) error {
+	close(q.stopping)
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w with %d queued", q.kind, ctx.Err(), q.snapshot().Queued)
+	}
+	if queued := q.snapshot().Queued; queued > 0 {
+		return fmt.Errorf("%s: %d not sent", q.kind, queued)
+	}
+	return nil
+}
+
+func (q *queue[T]) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.agent.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.full:
+		case <-q.stopping:
+			q.flush()
+			return
+		}
+		q.flush()
+	}
+}
+
+// flush sends queued items until the queue is empty or a batch fails,
+// which leaves the rest for the next flush
+func (q *queue[T]) flush() {
+	for {
+		batch := q.take()
+		if len(batch) == 0 {
+			return
+		}
+		failed := q.sendBatch(batch)
+		q.requeue(failed)
+		if len(failed) > 0 {
+			return
+		}
+	}
+}
+
+// take removes up to a batch of items from the queue
+func (q *queue[T]) take() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := min(len(q.items), q.agent.config.BatchSize)
+	batch := make([]T, n)
+	copy(batch, q.items)
+	q.items = q.items[:copy(q.items, q.items[n:])]
+	q.sending = n
+	return batch
+}
+
+// requeue puts items that couldn't be sent back at the front of the
+// queue, dropping those it no longer has room for, and ends the send
+func (q *queue[T]) requeue(items []T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sending = 0
+	room := max(q.agent.config.QueueSize-len(q.items), 0)
+	if len(items) > room {
+		q.stats.Dropped += int64(len(items) - room)
+		items = items[:room]
+	}
+	q.items = append(items, q.items...)
+}
+
+// sendBatch sends a batch, one request per tenant, and returns the items
+// of requests that failed but may succeed later
+func (q *queue[T]) sendBatch(batch []T) []T {
+	byTenant := make(map[string][]T)
+	var tenants []string
+	for _, item := range batch {
+		tenant := *q.tenant(&item)
+		if _, ok := byTenant[tenant]; !ok {
+			tenants = append(tenants, tenant)
+		}
+		byTenant[tenant] = append(byTenant[tenant], item)
+	}
+
+	var failed []T
+	for _, tenant := range tenants {
+		items := byTenant[tenant]
+		retryable, err := q.sendWithRetry(tenant, items)
+		switch {
+		case err == nil:
+		case retryable:
+			failed = append(failed, items...)
+		default:
+			log.Printf("Agent: collector rejected %d %s: %v", len(items), q.kind, err)
+			q.mu.Lock()
+			q.stats.Rejected += int64(len(items))
+			q.mu.Unlock()
+		}
+	}
+	return failed
+}
+
+// sendWithRetry sends one tenant's items, backing off between attempts.
+// Once stopping, it makes a single attempt so shutdown isn't held up.
+func (q *queue[T]) sendWithRetry(tenant string, items []T) (bool, error) {
+	data, err := json.Marshal(q.wrap(items))
+	if err != nil {
+		return false, err
+	}
+	if q.agent.config.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return false, err
+		}
+		data = buf.Bytes()
+	}
+
+	// Retries carry the same key, so that the collector doesn't store a
+	// batch twice when only its response was lost
+	key := rand.Text()
+	backoff := q.agent.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		rejected, retryable, err := q.send(tenant, key, data)
+		if err == nil {
+			rejected = min(rejected, len(items))
+			if rejected > 0 {
+				log.Printf("Agent: collector rejected %d of %d %s", rejected, len(items), q.kind)
+			}
+			q.mu.Lock()
+			q.stats.Forwarded += int64(len(items) - rejected)
+			q.stats.Rejected += int64(rejected)
+			q.mu.Unlock()
+			return false, nil
+		}
+		if !retryable || attempt >= q.agent.config.MaxRetries {
+			return retryable, err
+		}
+
+		q.mu.Lock()
+		q.stats.Retries++
+		q.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-q.stopping:
+			return true, err
+		}
+		backoff *= 2
+	}
+}
+
+// send posts one request, returning how many items an accepted request
+// had rejected, or whether a failed one is worth retrying
+func (q *queue[T]) send(tenant, key string, body []byte) (int, bool, error) {
+	config := q.agent.config
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(config.Collector, "/")+q.path, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(models.IdempotencyHeader, key)
+	if config.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if tenant != "" {
+		req.Header.Set(models.TenantHeader, tenant)
+	}
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+
+	resp, err := q.agent.client.Do(req)
+	q.agent.setReachable(err)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		// Span batches report the spans rejected; other responses, and
+		// those of older collectors, leave it zero
+		var result models.IngestResult
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result)
+		return result.Rejected, false, nil
+	}
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return 0, retryable, fmt.Errorf("collector returned status %d", resp.StatusCode)
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+	"github.com/omnitrace/omnitrace/internal/msgpack"
+)
+
+const (
+	// maxBodyBytes limits the decoded size of a request to the socket
+	maxBodyBytes = 10 << 20
+	// MaxDatagramSize is the largest UDP payload, and so the largest batch
+	// an SDK can send in one datagram
+	MaxDatagramSize = 65507
+	// udpReadBuffer is the socket buffer requested for datagrams, which
+	// the OS may cap
+	udpReadBuffer = 4 << 20
+)
+
+// datagram is the payload of a UDP datagram: a span, metric or error
+// batch, in the JSON of the ingestion API
+type datagram struct {
+	Spans   []models.Span       `json:"spans"`
+	Metrics []models.Metric     `json:"metrics"`
+	Errors  []models.ErrorEvent `json:"errors"`
+}
+
+// routes serves the SDK ingestion API on the socket, and the agent's
+// counters at /api/v1/agent
+func (a *Agent) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/spans", func(w http.ResponseWriter, r *http.Request) {
+		var batch models.SpanBatch
+		if decodeBody(w, r, &batch) {
+			a.spans.add(r.Header.Get(models.TenantHeader), batch.Spans)
+			accepted(w)
+		}
+	})
+	mux.HandleFunc("POST /api/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var batch models.MetricBatch
+		if decodeBody(w, r, &batch) {
+			a.metrics.add(r.Header.Get(models.TenantHeader), batch.Metrics)
+			accepted(w)
+		}
+	})
+	mux.HandleFunc("POST /api/v1/errors", func(w http.ResponseWriter, r *http.Request) {
+		var batch models.ErrorEventBatch
+		if decodeBody(w, r, &batch) {
+			a.errors.add(r.Header.Get(models.TenantHeader), batch.Errors)
+			accepted(w)
+		}
+	})
+	mux.HandleFunc("GET /api/v1/agent", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.Stats())
+	})
+	return mux
+}
+
+// decodeBody decodes a JSON or MessagePack request body, gzipped or not,
+// replying with an error if it can't
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	body := io.Reader(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return false
+		}
+		defer zr.Close()
+		body = io.LimitReader(zr, maxBodyBytes)
+	default:
+		http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	decode := json.NewDecoder(body).Decode
+	if msgpack.IsContentType(r.Header.Get("Content-Type")) {
+		decode = func(v any) error {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			return msgpack.Unmarshal(data, v)
+		}
+	}
+	if err := decode(v); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		}
+		return false
+	}
+	return true
+}
+
+func accepted(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"accepted"}`))
+}
+
+// readDatagrams queues the batches received over UDP until the connection
+// is closed. Datagrams can't carry headers, so their items are assigned
+// the agent's tenant unless they name their own.
+func (a *Agent) readDatagrams() {
+	defer a.wg.Done()
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, _, err := a.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Agent: UDP read failed: %v", err)
+			}
+			return
+		}
+		var d datagram
+		if err := json.Unmarshal(buf[:n], &d); err != nil {
+			log.Printf("Agent: ignoring invalid datagram: %v", err)
+			continue
+		}
+		if len(d.Spans) > 0 {
+			a.spans.add("", d.Spans)
+		}
+		if len(d.Metrics) > 0 {
+			a.metrics.add("", d.Metrics)
+		}
+		if len(d.Errors) > 0 {
+			a.errors.add("", d.Errors)
+		}
+	}
+}
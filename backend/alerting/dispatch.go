@@ -0,0 +1,100 @@
+package alerting
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// DefaultRepeatInterval is how often a group that keeps firing is notified
+// again
+const DefaultRepeatInterval = 4 * time.Hour
+
+// DefaultGroupBy groups notifications by rule
+var DefaultGroupBy = []string{"alertname"}
+
+// groupState remembers what a group's last notification said
+type groupState struct {
+	firing   string // Keys of the firing alerts last notified
+	lastSent time.Time
+}
+
+// dispatcher groups the alerts to notify of and drops notifications that
+// would repeat the last one of their group before the repeat interval
+type dispatcher struct {
+	groupBy        []string
+	repeatInterval time.Duration
+	groups         map[string]*groupState
+}
+
+func newDispatcher(groupBy []string, repeatInterval time.Duration) *dispatcher {
+	return &dispatcher{groupBy: groupBy, repeatInterval: repeatInterval, groups: make(map[string]*groupState)}
+}
+
+// dispatch returns the groups to notify of from an evaluation's firing
+// and newly resolved alerts. A group is notified when its set of firing
+// alerts changes, when one of its alerts resolves, and every repeat
+// interval while it keeps firing.
+func (d *dispatcher) dispatch(alerts []models.Alert, now time.Time) []models.AlertGroup {
+	byKey := make(map[string]*models.AlertGroup)
+	var keys []string
+	for _, alert := range alerts {
+		labels := make(map[string]string, len(d.groupBy))
+		for _, name := range d.groupBy {
+			if v, ok := alert.Labels[name]; ok {
+				labels[name] = v
+			}
+		}
+		key := alert.Tenant + "\x00" + labelsKey(labels)
+		group, ok := byKey[key]
+		if !ok {
+			group = &models.AlertGroup{Tenant: alert.Tenant, Labels: labels, Status: models.AlertStateResolved}
+			byKey[key] = group
+			keys = append(keys, key)
+		}
+		group.Alerts = append(group.Alerts, alert)
+	}
+
+	var notify []models.AlertGroup
+	for _, key := range keys {
+		group := byKey[key]
+		var firing []string
+		resolved := false
+		for _, alert := range group.Alerts {
+			if alert.State == models.AlertStateFiring {
+				firing = append(firing, alert.Rule+"\x00"+labelsKey(alert.Labels))
+			} else {
+				resolved = true
+			}
+		}
+		sort.Strings(firing)
+		firingKey := strings.Join(firing, "\x01")
+		if len(firing) > 0 {
+			group.Status = models.AlertStateFiring
+		}
+
+		state, seen := d.groups[key]
+		if !seen {
+			state = &groupState{}
+			d.groups[key] = state
+		}
+		changed := !seen || firingKey != state.firing
+		if !changed && !resolved && now.Sub(state.lastSent) < d.repeatInterval {
+			continue
+		}
+		state.firing = firingKey
+		state.lastSent = now
+		sortAlerts(group.Alerts)
+		notify = append(notify, *group)
+	}
+
+	// Groups without firing alerts have said their last
+	for key := range d.groups {
+		if group, ok := byKey[key]; !ok || group.Status == models.AlertStateResolved {
+			delete(d.groups, key)
+		}
+	}
+	return notify
+}
@@ -0,0 +1,405 @@
+// Package alerting evaluates alert rules over stored metrics, span
+// statistics and SLOs on a schedule, tracks the state of their alerts, and sends
+// notifications of firing and resolved alerts. Notifications are grouped
+// by labels and repeated only at an interval while nothing changes, and
+// silences mute the alerts they match.
+package alerting
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/promql"
+	"github.com/omnitrace/omnitrace/backend/slo"
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Default evaluation settings
+const (
+	DefaultInterval = time.Minute
+	// DefaultResolvedRetention is how long resolved alerts stay listed
+	DefaultResolvedRetention = 15 * time.Minute
+	// metricLookback is how far back a metric query without a range looks
+	// for samples, as in Prometheus
+	metricLookback = 5 * time.Minute
+)
+
+// Config configures the engine
+type Config struct {
+	// Interval is how often rules are evaluated
+	Interval time.Duration
+	// ResolvedRetention is how long resolved alerts stay listed
+	ResolvedRetention time.Duration
+	// Notifier, if set, is notified of firing and resolved alerts
+	Notifier Notifier
+	// GroupBy are the labels whose values group notifications
+	GroupBy []string
+	// RepeatInterval is how often a group that keeps firing is notified
+	// again
+	RepeatInterval time.Duration
+	// Silences mute the notifications of the alerts they match
+	Silences *Silences
+	// SLOs serve the statistics of SLO rules
+	SLOs *slo.Tracker
+}
+
+// ruleState is a rule and the state of its alerts
+type ruleState struct {
+	rule           models.AlertRule
+	query          *promql.Query // Of metric rules
+	alerts         map[string]*models.Alert
+	health         string
+	lastError      string
+	lastEvaluation time.Time
+	evaluationTime time.Duration
+}
+
+// sample is one value a rule's condition is checked against
+type sample struct {
+	labels map[string]string
+	value  float64
+}
+
+// Engine evaluates alert rules against the tenant stores
+type Engine struct {
+	stores *storage.TenantStores
+	config Config
+
+	mu         sync.RWMutex
+	rules      []*ruleState
+	dispatcher *dispatcher
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates an engine for validated rules and starts evaluating them
+func New(stores *storage.TenantStores, rules []models.AlertRule, config Config) *Engine {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.ResolvedRetention <= 0 {
+		config.ResolvedRetention = DefaultResolvedRetention
+	}
+	if config.GroupBy == nil {
+		config.GroupBy = DefaultGroupBy
+	}
+	if config.RepeatInterval <= 0 {
+		config.RepeatInterval = DefaultRepeatInterval
+	}
+	if config.Silences == nil {
+		config.Silences, _ = NewSilences("")
+	}
+
+	e := &Engine{
+		stores:     stores,
+		config:     config,
+		dispatcher: newDispatcher(config.GroupBy, config.RepeatInterval),
+		stopCh:     make(chan struct{}),
+	}
+	for _, rule := range rules {
+		state := &ruleState{rule: rule, alerts: make(map[string]*models.Alert), health: "unknown"}
+		if rule.Query != "" {
+			state.query, _ = promql.Parse(rule.Query)
+		}
+		e.rules = append(e.rules, state)
+	}
+
+	e.wg.Add(1)
+	go e.loop()
+	return e
+}
+
+func (e *Engine) loop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+
+	e.Evaluate(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			e.Evaluate(time.Now())
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+// Close stops evaluating rules
+func (e *Engine) Close() {
+	close(e.stopCh)
+	e.wg.Wait()
+}
+
+// Silences returns the engine's silences
+func (e *Engine) Silences() *Silences {
+	return e.config.Silences
+}
+
+// Evaluate evaluates every rule at a time and notifies of the groups of
+// firing and newly resolved alerts that aren't silenced
+func (e *Engine) Evaluate(now time.Time) {
+	e.mu.Lock()
+	var notify []models.Alert
+	for _, state := range e.rules {
+		for _, alert := range e.evaluateRule(state, now) {
+			if len(alert.SilencedBy) == 0 {
+				notify = append(notify, alert)
+			}
+		}
+	}
+	groups := e.dispatcher.dispatch(notify, now)
+	e.mu.Unlock()
+
+	if e.config.Notifier == nil {
+		return
+	}
+	for _, group := range groups {
+		group.Services = e.serviceMetadata(group)
+		if err := e.config.Notifier.Notify(group); err != nil {
+			log.Printf("Alert notification failed: %v", err)
+		}
+	}
+}
+
+// serviceMetadata returns the registry entries of the services named by a
+// group's alerts, so notifications can say who owns them
+func (e *Engine) serviceMetadata(group models.AlertGroup) []models.ServiceMetadata {
+	registry := e.stores.ServiceRegistry(group.Tenant)
+	var services []models.ServiceMetadata
+	seen := make(map[string]bool)
+	for _, alert := range group.Alerts {
+		service := alert.Labels["service"]
+		if service == "" || seen[service] {
+			continue
+		}
+		seen[service] = true
+		if m, ok := registry.Get(service); ok {
+			services = append(services, m)
+		}
+	}
+	return services
+}
+
+// evaluateRule updates a rule's alerts and returns those to notify of.
+// Callers hold e.mu.
+func (e *Engine) evaluateRule(state *ruleState, now time.Time) []models.Alert {
+	rule := state.rule
+	start := time.Now()
+	samples, err := e.samples(state, now)
+	state.lastEvaluation = now
+	state.evaluationTime = time.Since(start)
+	if err != nil {
+		// Keep the alerts as they are rather than resolving them on a
+		// failed read
+		state.health = "error"
+		state.lastError = err.Error()
+		return nil
+	}
+	state.health = "ok"
+	state.lastError = ""
+
+	active := make(map[string]bool)
+	for _, s := range samples {
+		if !compare[rule.Op](s.value, rule.Threshold) {
+			continue
+		}
+		key := labelsKey(s.labels)
+		active[key] = true
+
+		alert, ok := state.alerts[key]
+		if !ok || alert.State == models.AlertStateResolved {
+			alert = &models.Alert{
+				Rule:        rule.Name,
+				Tenant:      rule.Tenant,
+				Labels:      alertLabels(rule, s.labels),
+				Annotations: rule.Annotations,
+				State:       models.AlertStatePending,
+				ActiveAt:    now,
+			}
+			state.alerts[key] = alert
+		}
+		alert.Value = s.value
+		if alert.State == models.AlertStatePending && now.Sub(alert.ActiveAt) >= time.Duration(rule.For) {
+			alert.State = models.AlertStateFiring
+			alert.FiredAt = now
+		}
+	}
+
+	var notify []models.Alert
+	for key, alert := range state.alerts {
+		alert.SilencedBy = e.config.Silences.Match(rule.Tenant, alert.Labels, now)
+		switch {
+		case active[key]:
+			if alert.State == models.AlertStateFiring {
+				notify = append(notify, *alert)
+			}
+		case alert.State == models.AlertStatePending:
+			delete(state.alerts, key)
+		case alert.State == models.AlertStateFiring:
+			alert.State = models.AlertStateResolved
+			alert.ResolvedAt = now
+			notify = append(notify, *alert)
+		case now.Sub(alert.ResolvedAt) > e.config.ResolvedRetention:
+			delete(state.alerts, key)
+		}
+	}
+	return notify
+}
+
+// samples reads the values a rule's condition is checked against
+func (e *Engine) samples(state *ruleState, now time.Time) ([]sample, error) {
+	rule := state.rule
+	if state.query != nil {
+		lookback := metricLookback
+		if state.query.Range > 0 {
+			lookback = state.query.Range
+		}
+		buckets, err := e.stores.Metrics(rule.Tenant).QueryMetrics(state.query.Plan(now.Add(-lookback), now, lookback))
+		if err != nil {
+			return nil, err
+		}
+		var samples []sample
+		for _, series := range state.query.Evaluate(buckets) {
+			if len(series.Samples) > 0 {
+				samples = append(samples, sample{labels: series.Labels, value: series.Samples[len(series.Samples)-1].Value})
+			}
+		}
+		return samples, nil
+	}
+
+	if cond := rule.SLO; cond != nil {
+		if e.config.SLOs == nil {
+			return nil, errors.New("SLO tracking is not enabled")
+		}
+		value, err := e.config.SLOs.Stat(rule.Tenant, cond.Name, cond.Stat, time.Duration(cond.Window), now)
+		if err != nil {
+			return nil, err
+		}
+		return []sample{{labels: map[string]string{"slo": cond.Name}, value: value}}, nil
+	}
+
+	spans := rule.Spans
+	window := time.Duration(spans.Window)
+	buckets, err := e.stores.Spans(rule.Tenant).LatencyPercentiles(models.LatencyQuery{
+		Service:   spans.Service,
+		Operation: spans.Operation,
+		StartTime: now.Add(-window),
+		EndTime:   now,
+		Step:      window,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Without spans, only counts and rates have a value
+	if spanCount(buckets) == 0 && spans.Stat != models.SpanStatCount && spans.Stat != models.SpanStatRate {
+		return nil, nil
+	}
+	labels := map[string]string{"service": spans.Service}
+	if spans.Operation != "" {
+		labels["operation"] = spans.Operation
+	}
+	return []sample{{labels: labels, value: spanStats[spans.Stat](buckets, window)}}, nil
+}
+
+// alertLabels merges a sample's labels with the rule's, which win
+func alertLabels(rule models.AlertRule, labels map[string]string) map[string]string {
+	merged := map[string]string{"alertname": rule.Name}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range rule.Labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Alerts returns a tenant's alerts in a state, or in any state if state is
+// empty, firing first, then by rule
+func (e *Engine) Alerts(tenant string, state models.AlertState) []models.Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	alerts := []models.Alert{}
+	for _, rs := range e.rules {
+		if rs.rule.Tenant != tenant {
+			continue
+		}
+		for _, alert := range rs.alerts {
+			if state == "" || alert.State == state {
+				alerts = append(alerts, *alert)
+			}
+		}
+	}
+	sortAlerts(alerts)
+	return alerts
+}
+
+// Rules returns the status of a tenant's rules
+func (e *Engine) Rules(tenant string) []models.AlertRuleStatus {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	statuses := []models.AlertRuleStatus{}
+	for _, rs := range e.rules {
+		if rs.rule.Tenant != tenant {
+			continue
+		}
+		status := models.AlertRuleStatus{
+			Rule:           rs.rule,
+			Health:         rs.health,
+			LastError:      rs.lastError,
+			LastEvaluation: rs.lastEvaluation,
+			EvaluationTime: rs.evaluationTime,
+			Alerts:         []models.Alert{},
+		}
+		for _, alert := range rs.alerts {
+			status.Alerts = append(status.Alerts, *alert)
+		}
+		sortAlerts(status.Alerts)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+var stateOrder = map[models.AlertState]int{
+	models.AlertStateFiring:   0,
+	models.AlertStatePending:  1,
+	models.AlertStateResolved: 2,
+}
+
+func sortAlerts(alerts []models.Alert) {
+	sort.Slice(alerts, func(i, j int) bool {
+		a, b := alerts[i], alerts[j]
+		if a.State != b.State {
+			return stateOrder[a.State] < stateOrder[b.State]
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return labelsKey(a.Labels) < labelsKey(b.Labels)
+	})
+}
@@ -0,0 +1,44 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Notifier delivers alert notifications, one per group
+type Notifier interface {
+	Notify(group models.AlertGroup) error
+}
+
+// WebhookNotifier posts each alert group as JSON to a URL
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier posting to url
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify posts a group in one request
+func (n *WebhookNotifier) Notify(group models.AlertGroup) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
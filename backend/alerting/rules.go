@@ -0,0 +1,164 @@
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/promql"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Default windows of span statistics and SLO rules that don't set one
+const (
+	defaultSpanWindow = 5 * time.Minute
+	defaultSLOWindow  = time.Hour
+)
+
+// ruleFile is the format of alert rule files
+type ruleFile struct {
+	Rules []models.AlertRule `json:"rules"`
+}
+
+// LoadRules reads and validates the alert rules of a JSON file of the form
+// {"rules": [...]}
+func LoadRules(path string) ([]models.AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file ruleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range file.Rules {
+		if err := ValidateRule(&file.Rules[i]); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+// ValidateRule checks a rule and fills in its defaults
+func ValidateRule(rule *models.AlertRule) error {
+	if rule.Name == "" {
+		return errors.New("missing name")
+	}
+	if rule.Tenant == "" {
+		rule.Tenant = models.DefaultTenant
+	}
+	if _, ok := compare[rule.Op]; !ok {
+		return fmt.Errorf("%s: invalid op %q: want >, >=, <, <=, == or !=", rule.Name, rule.Op)
+	}
+	if rule.For < 0 {
+		return fmt.Errorf("%s: negative for", rule.Name)
+	}
+
+	conditions := 0
+	for _, set := range []bool{rule.Query != "", rule.Spans != nil, rule.SLO != nil} {
+		if set {
+			conditions++
+		}
+	}
+	if conditions > 1 {
+		return fmt.Errorf("%s: set only one of query, spans and slo", rule.Name)
+	}
+
+	switch {
+	case rule.Query != "":
+		if _, err := promql.Parse(rule.Query); err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+	case rule.Spans != nil:
+		spans := rule.Spans
+		if spans.Service == "" {
+			return fmt.Errorf("%s: spans rules need a service", rule.Name)
+		}
+		if _, ok := spanStats[spans.Stat]; !ok {
+			return fmt.Errorf("%s: invalid stat %q", rule.Name, spans.Stat)
+		}
+		if spans.Window < 0 {
+			return fmt.Errorf("%s: negative window", rule.Name)
+		}
+		if spans.Window == 0 {
+			spans.Window = models.Duration(defaultSpanWindow)
+		}
+	case rule.SLO != nil:
+		cond := rule.SLO
+		if cond.Name == "" {
+			return fmt.Errorf("%s: slo rules need an SLO name", rule.Name)
+		}
+		switch cond.Stat {
+		case models.SLOStatBurnRate, models.SLOStatBudgetRemaining, models.SLOStatSLI:
+		default:
+			return fmt.Errorf("%s: invalid SLO stat %q: want burn_rate, budget_remaining or sli", rule.Name, cond.Stat)
+		}
+		if cond.Window < 0 {
+			return fmt.Errorf("%s: negative window", rule.Name)
+		}
+		if cond.Window == 0 {
+			cond.Window = models.Duration(defaultSLOWindow)
+		}
+	default:
+		return fmt.Errorf("%s: missing query, spans or slo", rule.Name)
+	}
+	return nil
+}
+
+// compare holds the comparison of each rule op
+var compare = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// spanStats computes each span statistic from the latency buckets of a
+// window. Buckets are aligned to the window, so it may straddle two of
+// them; latencies take the higher of their percentiles.
+var spanStats = map[string]func(buckets []models.LatencyBucket, window time.Duration) float64{
+	models.SpanStatCount: func(b []models.LatencyBucket, _ time.Duration) float64 {
+		return float64(spanCount(b))
+	},
+	models.SpanStatRate: func(b []models.LatencyBucket, window time.Duration) float64 {
+		return float64(spanCount(b)) / window.Seconds()
+	},
+	models.SpanStatErrorRate: func(b []models.LatencyBucket, _ time.Duration) float64 {
+		var errors uint64
+		for _, bucket := range b {
+			errors += bucket.Errors
+		}
+		if n := spanCount(b); n > 0 {
+			return float64(errors) / float64(n)
+		}
+		return 0
+	},
+	models.SpanStatP50: maxLatency(func(b models.LatencyBucket) float64 { return b.P50 }),
+	models.SpanStatP90: maxLatency(func(b models.LatencyBucket) float64 { return b.P90 }),
+	models.SpanStatP95: maxLatency(func(b models.LatencyBucket) float64 { return b.P95 }),
+	models.SpanStatP99: maxLatency(func(b models.LatencyBucket) float64 { return b.P99 }),
+}
+
+func spanCount(buckets []models.LatencyBucket) uint64 {
+	var n uint64
+	for _, bucket := range buckets {
+		n += bucket.Count
+	}
+	return n
+}
+
+func maxLatency(percentile func(models.LatencyBucket) float64) func([]models.LatencyBucket, time.Duration) float64 {
+	return func(buckets []models.LatencyBucket, _ time.Duration) float64 {
+		v := 0.0
+		for _, bucket := range buckets {
+			if bucket.Count > 0 {
+				v = max(v, percentile(bucket))
+			}
+		}
+		return v
+	}
+}
@@ -0,0 +1,221 @@
+package alerting
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/promql"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// silenceRetention is how long expired silences stay listed
+const silenceRetention = 24 * time.Hour
+
+// ErrSilenceNotFound is returned when expiring an unknown silence
+var ErrSilenceNotFound = errors.New("silence not found")
+
+// silence is a stored silence and its parsed matchers
+type silence struct {
+	models.Silence
+	selector promql.Selector
+}
+
+func (s *silence) state(now time.Time) string {
+	switch {
+	case now.Before(s.StartsAt):
+		return models.SilenceStatePending
+	case now.Before(s.EndsAt):
+		return models.SilenceStateActive
+	}
+	return models.SilenceStateExpired
+}
+
+// Silences stores silences, written to a file when it has a path
+type Silences struct {
+	mu       sync.RWMutex
+	silences map[string]*silence
+	path     string
+}
+
+// NewSilences creates a silence store. With a path, silences are loaded
+// from and saved to that file.
+func NewSilences(path string) (*Silences, error) {
+	store := &Silences{silences: make(map[string]*silence), path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []models.Silence
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("load silences: %w", err)
+	}
+	for _, s := range saved {
+		selector, err := parseMatchers(s.Matchers)
+		if err != nil {
+			return nil, fmt.Errorf("load silence %s: %w", s.ID, err)
+		}
+		store.silences[s.ID] = &silence{Silence: s, selector: selector}
+	}
+	return store, nil
+}
+
+func parseMatchers(matchers string) (promql.Selector, error) {
+	selector, err := promql.ParseSelector(matchers)
+	if err != nil {
+		return selector, err
+	}
+	if len(selector.Matchers) == 0 {
+		return selector, errors.New("a silence needs at least one matcher")
+	}
+	return selector, nil
+}
+
+// Add validates and stores a new silence, assigning its ID. A silence
+// without a start starts now.
+func (s *Silences) Add(sil models.Silence) (models.Silence, error) {
+	selector, err := parseMatchers(sil.Matchers)
+	if err != nil {
+		return models.Silence{}, err
+	}
+	now := time.Now()
+	if sil.StartsAt.IsZero() {
+		sil.StartsAt = now
+	}
+	if !sil.EndsAt.After(sil.StartsAt) {
+		return models.Silence{}, errors.New("ends_at must be after starts_at")
+	}
+	if sil.Tenant == "" {
+		sil.Tenant = models.DefaultTenant
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return models.Silence{}, err
+	}
+	sil.ID = hex.EncodeToString(id)
+	sil.CreatedAt = now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	s.silences[sil.ID] = &silence{Silence: sil, selector: selector}
+	if err := s.save(); err != nil {
+		delete(s.silences, sil.ID)
+		return models.Silence{}, err
+	}
+	sil.State = s.silences[sil.ID].state(now)
+	return sil, nil
+}
+
+// Expire ends a tenant's silence now
+func (s *Silences) Expire(tenant, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sil, ok := s.silences[id]
+	if !ok || sil.Tenant != tenant {
+		return ErrSilenceNotFound
+	}
+	now := time.Now()
+	if sil.state(now) == models.SilenceStateExpired {
+		return nil
+	}
+	previous := sil.Silence
+	if now.Before(sil.StartsAt) {
+		sil.StartsAt = now
+	}
+	sil.EndsAt = now
+	if err := s.save(); err != nil {
+		sil.Silence = previous
+		return err
+	}
+	return nil
+}
+
+// List returns a tenant's silences, active and pending first, then by end
+func (s *Silences) List(tenant string) []models.Silence {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	silences := []models.Silence{}
+	for _, sil := range s.silences {
+		if sil.Tenant != tenant || now.Sub(sil.EndsAt) > silenceRetention {
+			continue
+		}
+		listed := sil.Silence
+		listed.State = sil.state(now)
+		silences = append(silences, listed)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		a, b := silences[i], silences[j]
+		if (a.State == models.SilenceStateExpired) != (b.State == models.SilenceStateExpired) {
+			return b.State == models.SilenceStateExpired
+		}
+		return a.EndsAt.After(b.EndsAt)
+	})
+	return silences
+}
+
+// Match returns the IDs of the silences active at a time that match an
+// alert's labels
+func (s *Silences) Match(tenant string, labels map[string]string, now time.Time) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for id, sil := range s.silences {
+		if sil.Tenant == tenant && sil.state(now) == models.SilenceStateActive && sil.selector.Matches(labels) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// prune drops silences that expired more than silenceRetention ago.
+// Callers hold s.mu.
+func (s *Silences) prune(now time.Time) {
+	for id, sil := range s.silences {
+		if now.Sub(sil.EndsAt) > silenceRetention {
+			delete(s.silences, id)
+		}
+	}
+}
+
+// save writes the silences to the store's file, if any. Callers hold s.mu.
+func (s *Silences) save() error {
+	if s.path == "" {
+		return nil
+	}
+	saved := make([]models.Silence, 0, len(s.silences))
+	for _, sil := range s.silences {
+		saved = append(saved, sil.Silence)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,234 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Config configures the archiver
+type Config struct {
+	// After is the age at which traces are archived. It must be shorter
+	// than the span TTL so traces are archived before they expire.
+	After time.Duration
+	// Interval is how often the archiver runs
+	Interval time.Duration
+}
+
+// Stats reports archiver counters
+type Stats struct {
+	Archived int64 `json:"archived"`
+	// Rearchived counts traces from windows already archived that were
+	// archived again, or at last, because late spans were stored for them
+	Rearchived int64     `json:"rearchived"`
+	Failed     int64     `json:"failed"`
+	LastRun    time.Time `json:"last_run"`
+}
+
+// Archiver copies traces older than a cutoff from hot storage to an object
+// store as gzipped JSON, one object per trace keyed by tenant and trace ID,
+// and fetches them back on demand
+type Archiver struct {
+	stores  *storage.TenantStores
+	objects ObjectStore
+	config  Config
+
+	mu         sync.Mutex
+	watermarks map[string]time.Time // Tenant -> archived up to
+	written    map[string]time.Time // Tenant -> spans stored by then are archived
+	stats      Stats
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates an archiver and starts its archive loop
+func New(stores *storage.TenantStores, objects ObjectStore, config Config) *Archiver {
+	if config.After <= 0 {
+		config.After = time.Hour
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Minute
+	}
+
+	a := &Archiver{
+		stores:     stores,
+		objects:    objects,
+		config:     config,
+		watermarks: make(map[string]time.Time),
+		written:    make(map[string]time.Time),
+		stopCh:     make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.loop()
+	return a
+}
+
+// objectKey returns the key of an archived trace. Tenant IDs are validated
+// where requests name them, so they are a single key segment.
+func objectKey(tenant string, traceID models.TraceID) string {
+	id := traceID.String()
+	return tenant + "/traces/" + id[:2] + "/" + id + ".json.gz"
+}
+
+func (a *Archiver) loop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Run()
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+// Run archives every tenant's traces that started between the previous
+// run's cutoff and now minus the archive age, and archives again the
+// traces before that window that spans were stored for since the previous
+// run, so that late spans reach the archived copy. Archiving is
+// idempotent, so after a restart the first run simply rewrites older
+// objects.
+func (a *Archiver) Run() {
+	cutoff := time.Now().Add(-a.config.After)
+
+	for _, tenant := range a.stores.Tenants() {
+		if !models.ValidTenant(tenant) {
+			continue
+		}
+		a.mu.Lock()
+		from := a.watermarks[tenant]
+		written := a.written[tenant]
+		a.mu.Unlock()
+		spans := a.stores.Spans(tenant)
+		scanned := time.Now()
+
+		// Select by start time only: a trace that started before the cutoff
+		// but is still running would otherwise fall between two windows
+		summaries, err := spans.QueryTraces(models.TraceQuery{
+			StartTime:      from,
+			IncludePartial: true,
+		})
+		if err != nil {
+			log.Printf("Archive query for tenant %s failed: %v", tenant, err)
+			continue
+		}
+
+		archived, failed := 0, 0
+		for _, summary := range summaries {
+			if summary.StartTime.After(cutoff) {
+				continue
+			}
+			if err := a.archiveTrace(tenant, summary.TraceID); err != nil {
+				log.Printf("Failed to archive trace %s: %v", summary.TraceID, err)
+				failed++
+				continue
+			}
+			archived++
+		}
+
+		rearchived := 0
+		if !from.IsZero() && !written.IsZero() {
+			late, err := spans.QueryTraces(models.TraceQuery{
+				WrittenAfter:   written,
+				IncludePartial: true,
+			})
+			if err != nil {
+				log.Printf("Archive query for tenant %s failed: %v", tenant, err)
+				failed++
+			}
+			for _, summary := range late {
+				// Traces from the window just archived are up to date
+				if !summary.StartTime.Before(from) {
+					continue
+				}
+				if err := a.archiveTrace(tenant, summary.TraceID); err != nil {
+					log.Printf("Failed to archive trace %s: %v", summary.TraceID, err)
+					failed++
+					continue
+				}
+				rearchived++
+			}
+		}
+
+		a.mu.Lock()
+		// Retry the window next time if anything failed
+		if failed == 0 {
+			a.watermarks[tenant] = cutoff
+			a.written[tenant] = scanned
+		}
+		a.stats.Archived += int64(archived)
+		a.stats.Rearchived += int64(rearchived)
+		a.stats.Failed += int64(failed)
+		a.mu.Unlock()
+	}
+
+	a.mu.Lock()
+	a.stats.LastRun = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *Archiver) archiveTrace(tenant string, traceID models.TraceID) error {
+	trace, err := a.stores.Spans(tenant).GetTrace(traceID)
+	if err != nil || trace == nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(trace.Spans); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return a.objects.Put(objectKey(tenant, traceID), buf.Bytes())
+}
+
+// GetTrace fetches an archived trace. It returns nil if the trace isn't
+// archived.
+func (a *Archiver) GetTrace(tenant string, traceID models.TraceID) (*models.Trace, error) {
+	data, err := a.objects.Get(objectKey(tenant, traceID))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var spans []models.Span
+	if err := json.NewDecoder(io.LimitReader(zr, 256<<20)).Decode(&spans); err != nil {
+		return nil, err
+	}
+	return models.BuildTrace(models.CorrectClockSkew(spans)), nil
+}
+
+// Stats returns a snapshot of the archiver counters
+func (a *Archiver) Stats() Stats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
+
+// Close stops the archive loop
+func (a *Archiver) Close() {
+	close(a.stopCh)
+	a.wg.Wait()
+}
@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by ObjectStore.Get for missing objects
+var ErrNotFound = errors.New("object not found")
+
+// ObjectStore is the blob storage archived traces are written to
+type ObjectStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// OpenObjectStore opens an object store from a URL: file:///path for a
+// local directory or s3://bucket/prefix for S3 and S3-compatible storage
+func OpenObjectStore(target string, s3cfg S3Config) (ObjectStore, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive target %q: %w", target, err)
+	}
+	switch u.Scheme {
+	case "file", "":
+		dir := u.Path
+		if u.Scheme == "" {
+			dir = target
+		}
+		return NewFileStore(dir)
+	case "s3":
+		s3cfg.Bucket = u.Host
+		s3cfg.Prefix = strings.TrimPrefix(u.Path, "/")
+		return NewS3Store(s3cfg)
+	default:
+		return nil, fmt.Errorf("unsupported archive target scheme %q", u.Scheme)
+	}
+}
+
+// FileStore stores objects as files under a directory
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a file store rooted at dir
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) path(key string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(key))
+}
+
+// Put writes an object atomically
+func (f *FileStore) Put(key string, data []byte) error {
+	path := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get reads an object
+func (f *FileStore) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
@@ -0,0 +1,163 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Config configures access to S3 or an S3-compatible object store
+type S3Config struct {
+	Bucket string
+	Prefix string
+	Region string
+	// Endpoint overrides the AWS endpoint, e.g. for MinIO. Requests use
+	// path-style addressing when it is set.
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3Store stores objects in an S3 bucket, signing requests with AWS
+// Signature Version 4
+type S3Store struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+// NewS3Store creates an S3 object store
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 archive requires a bucket")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("s3 archive requires credentials")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &S3Store{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (s *S3Store) objectURL(key string) *url.URL {
+	if s.cfg.Prefix != "" {
+		key = strings.TrimSuffix(s.cfg.Prefix, "/") + "/" + key
+	}
+	if s.cfg.Endpoint != "" {
+		u, _ := url.Parse(strings.TrimSuffix(s.cfg.Endpoint, "/"))
+		u.Path += "/" + s.cfg.Bucket + "/" + key
+		return u
+	}
+	return &url.URL{
+		Scheme: "https",
+		Host:   fmt.Sprintf("%s.s3.%s.amazonaws.com", s.cfg.Bucket, s.cfg.Region),
+		Path:   "/" + key,
+	}
+}
+
+// Put uploads an object
+func (s *S3Store) Put(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("s3 put %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// Get downloads an object
+func (s *S3Store) Get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("s3 get %s: %s", key, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3Store) do(method, key string, body []byte) (*http.Response, error) {
+	u := s.objectURL(key)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds SigV4 authentication headers to req
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	const algorithm = "AWS4-HMAC-SHA256"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.cfg.SessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(req.Header.Get(h)) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.cfg.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
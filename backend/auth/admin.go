@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// RequireAdmin passes on requests of admin principals, rejecting others
+// with 403 Forbidden
+func (a *Authenticator) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return a.RequireFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, _ := PrincipalFromContext(r.Context()); !p.Admin {
+			http.Error(w, "Forbidden: needs an admin", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// manages reports whether a principal may manage a token. Admins bound to
+// a tenant only manage that tenant's tokens.
+func manages(p Principal, token models.APIToken) bool {
+	return p.Tenant == "" || token.Tenant == p.Tenant
+}
+
+// grants reports whether a principal may grant scopes. Admins bound to a
+// tenant may not grant the replicate scope, which skips quotas.
+func grants(p Principal, scopes []string) bool {
+	return p.Tenant == "" || !slices.Contains(scopes, models.TokenScopeReplicate)
+}
+
+// tokenRequest is the body of a token creation request. Duration, e.g.
+// "2160h", may be given instead of expires_at.
+type tokenRequest struct {
+	Name      string           `json:"name"`
+	Scopes    []string         `json:"scopes"`
+	Service   string           `json:"service"`
+	Tenant    string           `json:"tenant"`
+	ExpiresAt time.Time        `json:"expires_at"`
+	Duration  *models.Duration `json:"duration"`
+}
+
+// handleTokens lists the API tokens the principal manages, including
+// revoked ones
+func (a *Authenticator) handleTokens(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFromContext(r.Context())
+	tokens := slices.DeleteFunc(a.config.Tokens.List(), func(t models.APIToken) bool { return !manages(p, t) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// handleCreateToken creates a token and returns its secret, which is never
+// shown again, e.g. {"name": "checkout", "scopes": ["ingest"],
+// "service": "checkout"}. Tokens created by an admin bound to a tenant are
+// bound to it too.
+func (a *Authenticator) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	spec := models.APIToken{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		Service:   req.Service,
+		Tenant:    req.Tenant,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if req.Duration != nil {
+		spec.ExpiresAt = time.Now().Add(time.Duration(*req.Duration))
+	}
+
+	p, _ := PrincipalFromContext(r.Context())
+	if spec.Tenant == "" {
+		spec.Tenant = p.Tenant
+	}
+	if !manages(p, spec) {
+		http.Error(w, "Forbidden: token for another tenant", http.StatusForbidden)
+		return
+	}
+	if !grants(p, spec.Scopes) {
+		http.Error(w, "Forbidden: tenant admins can't grant the replicate scope", http.StatusForbidden)
+		return
+	}
+	created, err := a.config.Tokens.Create(spec, p.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// handleScopeToken replaces a token's scopes, e.g. {"scopes": ["read"]}
+func (a *Authenticator) handleScopeToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	p, _ := PrincipalFromContext(r.Context())
+	if token, ok := a.config.Tokens.Get(r.PathValue("id")); !ok || !manages(p, token) {
+		http.Error(w, ErrTokenNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if !grants(p, req.Scopes) {
+		http.Error(w, "Forbidden: tenant admins can't grant the replicate scope", http.StatusForbidden)
+		return
+	}
+	token, err := a.config.Tokens.SetScopes(r.PathValue("id"), req.Scopes)
+	if errors.Is(err, ErrTokenNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+// handleRevokeToken revokes a token
+func (a *Authenticator) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFromContext(r.Context())
+	if token, ok := a.config.Tokens.Get(r.PathValue("id")); !ok || !manages(p, token) {
+		http.Error(w, ErrTokenNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	err := a.config.Tokens.Revoke(r.PathValue("id"))
+	if errors.Is(err, ErrTokenNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
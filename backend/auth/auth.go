@@ -0,0 +1,327 @@
+// Package auth authenticates dashboard and query API users, with passwords
+// checked against a file of bcrypt hashes or by OpenID Connect single
+// sign-on. Logged-in users hold a session cookie; API clients such as
+// Grafana may send static users' credentials with HTTP basic auth or a
+// managed API token instead.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// DefaultSessionTTL is how long a login lasts
+const DefaultSessionTTL = 12 * time.Hour
+
+// Cookie names. The OIDC cookie holds the state and nonce of a sign-in in
+// progress.
+const (
+	SessionCookie = "omnitrace_session"
+	oidcCookie    = "omnitrace_oidc"
+)
+
+// oidcLoginTTL is how long a user has to complete a sign-in at the provider
+const oidcLoginTTL = 10 * time.Minute
+
+// Config configures an authenticator. At least one of Users and OIDC is
+// set.
+type Config struct {
+	// Users, if set, may log in with their passwords
+	Users *Users
+	// OIDC, if set, signs users in with their identity provider
+	OIDC       *OIDC
+	SessionTTL time.Duration
+	// SecureCookies marks cookies as HTTPS-only, for collectors served
+	// over TLS, e.g. behind a proxy
+	SecureCookies bool
+	// Tokens, if set, are accepted as bearer tokens and managed through
+	// the admin API
+	Tokens *TokenStore
+	// Admins are the users who may manage tokens
+	Admins []string
+}
+
+// Authenticator logs users in and out and rejects requests without a
+// valid session or credentials
+type Authenticator struct {
+	config   Config
+	sessions *sessions
+}
+
+// New creates an authenticator
+func New(config Config) *Authenticator {
+	if config.SessionTTL <= 0 {
+		config.SessionTTL = DefaultSessionTTL
+	}
+	return &Authenticator{config: config, sessions: newSessions(config.SessionTTL)}
+}
+
+// Principal is the user or API token behind a request
+type Principal struct {
+	// Name is the user name, or token: and the token's name
+	Name string
+	// Tenant, if set, is the only tenant the principal may read
+	Tenant string
+	// Admin principals may manage API tokens
+	Admin bool
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal of an authenticated request
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// RegisterRoutes registers the login and logout routes, and the token
+// admin API when tokens are managed
+func (a *Authenticator) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /login", a.handleLoginPage)
+	mux.HandleFunc("POST /login", a.handleLogin)
+	mux.HandleFunc("POST /logout", a.handleLogout)
+	mux.HandleFunc("GET /login/oidc", a.handleOIDCLogin)
+	mux.HandleFunc("GET /login/oidc/callback", a.handleOIDCCallback)
+	if a.config.Tokens != nil {
+		mux.HandleFunc("GET /api/admin/tokens", a.RequireAdmin(a.handleTokens))
+		mux.HandleFunc("POST /api/admin/tokens", a.RequireAdmin(a.handleCreateToken))
+		mux.HandleFunc("PATCH /api/admin/tokens/{id}", a.RequireAdmin(a.handleScopeToken))
+		mux.HandleFunc("DELETE /api/admin/tokens/{id}", a.RequireAdmin(a.handleRevokeToken))
+	}
+}
+
+// Require passes on requests with a valid session cookie, basic auth
+// credentials or read token. Other page requests are redirected to the
+// login page, and API requests are rejected with 401.
+func (a *Authenticator) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := a.authenticate(r); ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+			return
+		}
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		if a.config.Users != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="omnitrace"`)
+		} else if a.config.Tokens != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="omnitrace"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// RequireFunc is Require for handler functions
+func (a *Authenticator) RequireFunc(next http.HandlerFunc) http.HandlerFunc {
+	return a.Require(next).ServeHTTP
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (Principal, bool) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if user, ok := a.sessions.user(cookie.Value); ok {
+			return a.user(user), true
+		}
+	}
+	if name, password, ok := r.BasicAuth(); ok && a.config.Users != nil {
+		if a.config.Users.Authenticate(name, password) {
+			return a.user(name), true
+		}
+	}
+	if token := bearerToken(r.Header.Get("Authorization")); token != "" && a.config.Tokens != nil {
+		if t, ok := a.config.Tokens.Authenticate(token, models.TokenScopeRead); ok {
+			return Principal{
+				Name:   "token:" + t.Name,
+				Tenant: t.Tenant,
+				Admin:  slices.Contains(t.Scopes, models.TokenScopeAdmin),
+			}, true
+		}
+	}
+	return Principal{}, false
+}
+
+func (a *Authenticator) user(name string) Principal {
+	return Principal{Name: name, Admin: slices.Contains(a.config.Admins, name)}
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" value
+func bearerToken(header string) string {
+	const prefix = "bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+// loginPage is the login form. Password fields are shown when static users
+// are configured and the SSO link when OIDC is.
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>OmniTrace - Log in</title>
+<style>
+body { font-family: sans-serif; background: #0f1117; color: #e4e6eb; display: flex; justify-content: center; padding-top: 15vh; }
+form, .sso { display: flex; flex-direction: column; gap: 0.75rem; width: 18rem; }
+input, button, a.button { padding: 0.5rem; border-radius: 4px; border: 1px solid #2d3140; font-size: 1rem; }
+button, a.button { background: #3b82f6; color: #fff; border: none; cursor: pointer; text-align: center; text-decoration: none; }
+.error { color: #f87171; }
+</style>
+</head>
+<body>
+<div>
+<h1>OmniTrace</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Password}}<form method="post" action="/login">
+<input type="hidden" name="next" value="{{.Next}}">
+<input name="username" placeholder="Username" autocomplete="username" required autofocus>
+<input name="password" type="password" placeholder="Password" autocomplete="current-password" required>
+<button type="submit">Log in</button>
+</form>{{end}}
+{{if .SSO}}<p class="sso"><a class="button" href="/login/oidc?next={{.Next}}">Sign in with SSO</a></p>{{end}}
+</div>
+</body>
+</html>
+`))
+
+func (a *Authenticator) renderLogin(w http.ResponseWriter, status int, next, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	loginPage.Execute(w, map[string]any{
+		"Password": a.config.Users != nil,
+		"SSO":      a.config.OIDC != nil,
+		"Next":     next,
+		"Error":    message,
+	})
+}
+
+func (a *Authenticator) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	a.renderLogin(w, http.StatusOK, safeNext(r.URL.Query().Get("next")), "")
+}
+
+// handleLogin checks a static user's password from the login form
+func (a *Authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.PostFormValue("next"))
+	if a.config.Users == nil {
+		http.Error(w, "Password login is not enabled", http.StatusNotFound)
+		return
+	}
+	user := r.PostFormValue("username")
+	if !a.config.Users.Authenticate(user, r.PostFormValue("password")) {
+		log.Printf("Failed login for %q from %s", user, r.RemoteAddr)
+		a.renderLogin(w, http.StatusUnauthorized, next, "Invalid username or password")
+		return
+	}
+	a.startSession(w, r, user, next)
+}
+
+func (a *Authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		a.sessions.end(cookie.Value)
+	}
+	a.setCookie(w, SessionCookie, "", "/", -1)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// handleOIDCLogin sends the user to the identity provider
+func (a *Authenticator) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if a.config.OIDC == nil {
+		http.Error(w, "SSO is not enabled", http.StatusNotFound)
+		return
+	}
+	state, err1 := randomString()
+	nonce, err2 := randomString()
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	next := safeNext(r.URL.Query().Get("next"))
+	value := state + "." + nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(next))
+	a.setCookie(w, oidcCookie, value, "/login/oidc", int(oidcLoginTTL/time.Second))
+	http.Redirect(w, r, a.config.OIDC.authCodeURL(state, nonce), http.StatusFound)
+}
+
+// handleOIDCCallback completes a sign-in the provider redirected back from
+func (a *Authenticator) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if a.config.OIDC == nil {
+		http.Error(w, "SSO is not enabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		a.renderLogin(w, http.StatusUnauthorized, "/", "Sign-in failed: "+e)
+		return
+	}
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		a.renderLogin(w, http.StatusBadRequest, "/", "Sign-in expired, please try again")
+		return
+	}
+	a.setCookie(w, oidcCookie, "", "/login/oidc", -1)
+	parts := strings.SplitN(cookie.Value, ".", 3)
+	if len(parts) != 3 || parts[0] != query.Get("state") {
+		a.renderLogin(w, http.StatusBadRequest, "/", "Sign-in expired, please try again")
+		return
+	}
+	next, _ := base64.RawURLEncoding.DecodeString(parts[2])
+
+	user, err := a.config.OIDC.exchange(r.Context(), query.Get("code"), parts[1])
+	if err != nil {
+		log.Printf("SSO sign-in failed: %v", err)
+		a.renderLogin(w, http.StatusUnauthorized, "/", "Sign-in failed")
+		return
+	}
+	a.startSession(w, r, user, safeNext(string(next)))
+}
+
+// startSession sets a new session cookie and redirects to next
+func (a *Authenticator) startSession(w http.ResponseWriter, r *http.Request, user, next string) {
+	token, err := a.sessions.create(user)
+	if err != nil {
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+	a.setCookie(w, SessionCookie, token, "/", int(a.config.SessionTTL/time.Second))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// setCookie sets an HTTP-only cookie. SameSite=Lax keeps other sites from
+// making requests with it that change state.
+func (a *Authenticator) setCookie(w http.ResponseWriter, name, value, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.config.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// safeNext returns next if it is a path on this host, so that logins can't
+// redirect elsewhere, or / otherwise
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, e.g. https://accounts.google.com
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this collector's /login/oidc/callback URL as
+	// registered with the provider
+	RedirectURL string
+	// Scopes requested in addition to openid (default: email, profile)
+	Scopes []string
+	// AllowedUsers and AllowedDomains are who may sign in: users by
+	// verified email or subject, and any verified email of a domain. At
+	// least one must be set.
+	AllowedUsers   []string
+	AllowedDomains []string
+}
+
+// OIDCPrefix starts the names of users signed in with OIDC, e.g.
+// "oidc:alice@example.com", so that they can't be mistaken for static
+// users. Admins signed in with OIDC are listed under these names.
+const OIDCPrefix = "oidc:"
+
+// OIDC signs users in with the authorization code flow. ID tokens come
+// straight from the provider's token endpoint over TLS, so their claims
+// are checked but, as OpenID Connect Core 3.1.3.7 allows, not their
+// signature.
+type OIDC struct {
+	config   OIDCConfig
+	authURL  string
+	tokenURL string
+	client   *http.Client
+}
+
+// NewOIDC discovers a provider's endpoints
+func NewOIDC(ctx context.Context, config OIDCConfig) (*OIDC, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("OIDC needs an issuer, client ID and redirect URL")
+	}
+	if len(config.AllowedUsers) == 0 && len(config.AllowedDomains) == 0 {
+		return nil, errors.New("OIDC needs allowed users or domains")
+	}
+	if config.Scopes == nil {
+		config.Scopes = []string{"email", "profile"}
+	}
+	o := &OIDC{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+
+	discoveryURL := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery: %s returned status %d", discoveryURL, resp.StatusCode)
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q does not match %q", discovery.Issuer, config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" {
+		return nil, errors.New("OIDC discovery: missing authorization or token endpoint")
+	}
+	o.authURL = discovery.AuthorizationEndpoint
+	o.tokenURL = discovery.TokenEndpoint
+	return o, nil
+}
+
+// authCodeURL returns the provider URL that starts a sign-in
+func (o *OIDC) authCodeURL(state, nonce string) string {
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.config.ClientID},
+		"redirect_uri":  {o.config.RedirectURL},
+		"scope":         {strings.Join(append([]string{"openid"}, o.config.Scopes...), " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(o.authURL, "?") {
+		sep = "&"
+	}
+	return o.authURL + sep + query.Encode()
+}
+
+// idClaims are the ID token claims that are checked or name the user
+type idClaims struct {
+	Issuer   string   `json:"iss"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	Nonce    string   `json:"nonce"`
+	Subject  string   `json:"sub"`
+	Email    string   `json:"email"`
+	Verified verified `json:"email_verified"`
+}
+
+// verified is the email_verified claim, which some providers send as a
+// string
+type verified bool
+
+func (v *verified) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*v = verified(b)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*v = verified(strings.EqualFold(s, "true"))
+	return nil
+}
+
+// audience is a JWT audience, a string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// exchange trades an authorization code for an ID token and returns the
+// user it names: OIDCPrefix and their verified email, or their subject if
+// their email isn't verified. Users who aren't allowed are rejected.
+func (o *OIDC) exchange(ctx context.Context, code, nonce string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.config.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token exchange: status %d", resp.StatusCode)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("token exchange: missing or malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("token exchange: malformed ID token")
+	}
+	var claims idClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.New("token exchange: malformed ID token")
+	}
+
+	switch {
+	case claims.Issuer != o.config.Issuer:
+		return "", fmt.Errorf("ID token issuer %q does not match", claims.Issuer)
+	case !slices.Contains(claims.Audience, o.config.ClientID):
+		return "", errors.New("ID token is not for this client")
+	case time.Now().Unix() >= claims.Expiry:
+		return "", errors.New("ID token expired")
+	case claims.Nonce != nonce:
+		return "", errors.New("ID token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("ID token names no user")
+	}
+	user := claims.Subject
+	if claims.Email != "" && claims.Verified {
+		user = claims.Email
+	}
+	if !o.allowed(user, claims.Subject, bool(claims.Verified)) {
+		return "", fmt.Errorf("user %q is not allowed", user)
+	}
+	return OIDCPrefix + user, nil
+}
+
+// allowed reports whether a user may sign in, by their verified email or
+// subject, or the domain of their verified email
+func (o *OIDC) allowed(user, subject string, verified bool) bool {
+	if slices.Contains(o.config.AllowedUsers, subject) {
+		return true
+	}
+	if !verified || user == subject {
+		return false
+	}
+	if slices.ContainsFunc(o.config.AllowedUsers, func(allowed string) bool { return strings.EqualFold(allowed, user) }) {
+		return true
+	}
+	_, domain, _ := strings.Cut(user, "@")
+	return slices.ContainsFunc(o.config.AllowedDomains, func(allowed string) bool { return strings.EqualFold(allowed, domain) })
+}
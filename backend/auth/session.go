@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// session is a logged-in user
+type session struct {
+	user    string
+	expires time.Time
+}
+
+// sessions holds the sessions of logged-in users in memory, keyed by the
+// SHA-256 digest of their cookie value. Sessions end on restart.
+type sessions struct {
+	mu       sync.Mutex
+	sessions map[[sha256.Size]byte]session
+	ttl      time.Duration
+}
+
+func newSessions(ttl time.Duration) *sessions {
+	return &sessions{sessions: make(map[[sha256.Size]byte]session), ttl: ttl}
+}
+
+// create starts a session and returns its token
+func (s *sessions) create(user string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[sha256.Sum256([]byte(token))] = session{user: user, expires: now.Add(s.ttl)}
+	return token, nil
+}
+
+// user returns the user of an unexpired session
+func (s *sessions) user(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sha256.Sum256([]byte(token))]
+	if !ok || time.Now().After(sess.expires) {
+		return "", false
+	}
+	return sess.user, true
+}
+
+// end ends a session
+func (s *sessions) end(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sha256.Sum256([]byte(token)))
+}
@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// TokenPrefix starts every managed API token, so leaked tokens are easy to
+// recognize
+const TokenPrefix = "omt_"
+
+// lastUsedResolution is how stale a token's last use may be; uses are
+// recorded at most this often and saved on the same schedule
+const lastUsedResolution = time.Minute
+
+// ErrTokenNotFound is returned when changing an unknown token
+var ErrTokenNotFound = errors.New("token not found")
+
+// storedToken is a token and the SHA-256 digest of its secret
+type storedToken struct {
+	models.APIToken
+	Hash string `json:"hash"`
+}
+
+// TokenStore holds managed API tokens. Secrets are kept only as SHA-256
+// digests. With a file, tokens are loaded from it and saved to it on every
+// change, and their last use every minute.
+type TokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*storedToken // ID -> token
+	byHash map[string]*storedToken
+	path   string
+	dirty  bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewTokenStore creates a token store. With a path, tokens are loaded from
+// and saved to that file.
+func NewTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{
+		tokens: make(map[string]*storedToken),
+		byHash: make(map[string]*storedToken),
+		path:   path,
+		stopCh: make(chan struct{}),
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			var saved []*storedToken
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("load tokens: %w", err)
+			}
+			for _, t := range saved {
+				s.tokens[t.ID] = t
+				s.byHash[t.Hash] = t
+			}
+		}
+	}
+	s.wg.Add(1)
+	go s.loop()
+	return s, nil
+}
+
+func (s *TokenStore) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(lastUsedResolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// flush saves last uses recorded since the last save
+func (s *TokenStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Failed to save API tokens: %v", err)
+	}
+}
+
+// Close stops the save loop and saves last uses
+func (s *TokenStore) Close() {
+	close(s.stopCh)
+	s.wg.Wait()
+	s.flush()
+}
+
+// validScopes reports whether scopes is a non-empty list of known scopes
+func validScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("a token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case models.TokenScopeIngest, models.TokenScopeReplicate, models.TokenScopeRead, models.TokenScopeAdmin:
+		default:
+			return fmt.Errorf("invalid scope %q: want ingest, replicate, read or admin", scope)
+		}
+	}
+	return nil
+}
+
+// Create validates and stores a new token from spec's name, scopes,
+// service, tenant and expiry, and returns it with its secret
+func (s *TokenStore) Create(spec models.APIToken, createdBy string) (models.CreatedAPIToken, error) {
+	if spec.Name == "" {
+		return models.CreatedAPIToken{}, errors.New("missing name")
+	}
+	if err := validScopes(spec.Scopes); err != nil {
+		return models.CreatedAPIToken{}, err
+	}
+	if spec.Tenant != "" && !models.ValidTenant(spec.Tenant) {
+		return models.CreatedAPIToken{}, fmt.Errorf("invalid tenant %q", spec.Tenant)
+	}
+	now := time.Now()
+	if !spec.ExpiresAt.IsZero() && !spec.ExpiresAt.After(now) {
+		return models.CreatedAPIToken{}, errors.New("expires_at must be in the future")
+	}
+
+	secret := make([]byte, 32)
+	id := make([]byte, 8)
+	if _, err := rand.Read(secret); err != nil {
+		return models.CreatedAPIToken{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return models.CreatedAPIToken{}, err
+	}
+	token := TokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	stored := &storedToken{
+		APIToken: models.APIToken{
+			ID:        hex.EncodeToString(id),
+			Name:      spec.Name,
+			Prefix:    token[:len(TokenPrefix)+6],
+			Scopes:    slices.Compact(slices.Sorted(slices.Values(spec.Scopes))),
+			Service:   spec.Service,
+			Tenant:    spec.Tenant,
+			CreatedBy: createdBy,
+			CreatedAt: now,
+			ExpiresAt: spec.ExpiresAt,
+		},
+		Hash: hashToken(token),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[stored.ID] = stored
+	s.byHash[stored.Hash] = stored
+	if err := s.save(); err != nil {
+		delete(s.tokens, stored.ID)
+		delete(s.byHash, stored.Hash)
+		return models.CreatedAPIToken{}, err
+	}
+	return models.CreatedAPIToken{APIToken: stored.APIToken, Token: token}, nil
+}
+
+// List returns the tokens, newest first
+func (s *TokenStore) List() []models.APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := make([]models.APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t.APIToken)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// Get returns a token by ID
+func (s *TokenStore) Get(id string) (models.APIToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return models.APIToken{}, false
+	}
+	return t.APIToken, true
+}
+
+// SetScopes replaces a token's scopes
+func (s *TokenStore) SetScopes(id string, scopes []string) (models.APIToken, error) {
+	if err := validScopes(scopes); err != nil {
+		return models.APIToken{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return models.APIToken{}, ErrTokenNotFound
+	}
+	previous := t.Scopes
+	t.Scopes = slices.Compact(slices.Sorted(slices.Values(scopes)))
+	if err := s.save(); err != nil {
+		t.Scopes = previous
+		return models.APIToken{}, err
+	}
+	return t.APIToken, nil
+}
+
+// Revoke stops a token from authenticating. Revoked tokens stay listed.
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	if !t.RevokedAt.IsZero() {
+		return nil
+	}
+	t.RevokedAt = time.Now()
+	if err := s.save(); err != nil {
+		t.RevokedAt = time.Time{}
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the token a secret belongs to if it is active and
+// has scope. Admin tokens also have the read scope.
+func (s *TokenStore) Authenticate(secret, scope string) (models.APIToken, bool) {
+	if secret == "" {
+		return models.APIToken{}, false
+	}
+	hash := hashToken(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.byHash[hash]
+	now := time.Now()
+	if !ok || !t.RevokedAt.IsZero() || (!t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)) {
+		return models.APIToken{}, false
+	}
+	if !slices.Contains(t.Scopes, scope) && !(scope == models.TokenScopeRead && slices.Contains(t.Scopes, models.TokenScopeAdmin)) {
+		return models.APIToken{}, false
+	}
+	if now.Sub(t.LastUsedAt) >= lastUsedResolution {
+		t.LastUsedAt = now
+		s.dirty = true
+	}
+	return t.APIToken, true
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// save writes the tokens to the store's file, if any. Callers hold s.mu.
+func (s *TokenStore) save() error {
+	if s.path == "" {
+		s.dirty = false
+		return nil
+	}
+	saved := make([]*storedToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		saved = append(saved, t)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when a user doesn't exist, so that unknown
+// and known users take as long to reject
+const dummyHash = "$2b$10$omnitracedummysaltomneu5y6Wa8NoYiDvVoixgEG8AJtqS8PQx."
+
+// Users holds static users and their bcrypt password hashes
+type Users struct {
+	hashes map[string][]byte
+}
+
+// LoadUsers reads a file of user:hash lines, as written by htpasswd -B.
+// Blank lines and lines starting with # are skipped.
+func LoadUsers(path string) (*Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := &Users{hashes: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(text, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: want user:hash", path, line)
+		}
+		// A malformed hash fails with something other than a mismatch
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), nil); err != nil && !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		users.hashes[name] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Authenticate reports whether password is the user's
+func (u *Users) Authenticate(name, password string) bool {
+	hash, ok := u.hashes[name]
+	if !ok {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// Len returns the number of users
+func (u *Users) Len() int {
+	return len(u.hashes)
+}
@@ -0,0 +1,56 @@
+package certs
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// renewBefore is how long before expiry certificates are renewed
+const renewBefore = 30 * 24 * time.Hour
+
+// ACMEConfig configures certificates from an ACME certificate authority
+type ACMEConfig struct {
+	// Domains the certificate covers; the CA validates each over HTTP on
+	// port 80
+	Domains []string
+	// Email is the account contact for expiry notices
+	Email string
+	// DirectoryURL is the CA's directory (default: Let's Encrypt)
+	DirectoryURL string
+	// CacheDir keeps the account key and certificates across restarts
+	CacheDir string
+	// AcceptTOS agrees to the CA's terms of service, which it requires
+	// before issuing certificates
+	AcceptTOS bool
+}
+
+// NewACME returns a manager that obtains certificates for the configured
+// domains from an ACME CA with http-01 challenges, when a client first
+// asks for one, and renews them 30 days before they expire. Its
+// HTTPHandler answers the challenges and redirects other requests to
+// HTTPS, and must be served on port 80 of every domain.
+func NewACME(config ACMEConfig) (*autocert.Manager, error) {
+	if len(config.Domains) == 0 {
+		return nil, errors.New("ACME needs at least one domain")
+	}
+	if !config.AcceptTOS {
+		return nil, errors.New("ACME needs the CA's terms of service accepted")
+	}
+	if config.CacheDir == "" {
+		return nil, errors.New("ACME needs a cache directory")
+	}
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(config.Domains...),
+		Email:       config.Email,
+		RenewBefore: renewBefore,
+	}
+	if config.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: config.DirectoryURL}
+	}
+	return m, nil
+}
@@ -0,0 +1,119 @@
+// Package certs provides the certificates the collector serves TLS with:
+// a key pair read from files and reloaded when they change, or
+// certificates obtained and renewed from an ACME certificate authority
+// such as Let's Encrypt.
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is how often certificate files are checked for
+// changes
+const DefaultReloadInterval = 30 * time.Second
+
+// FileSource serves a certificate read from PEM files, reloading it when
+// either file changes, e.g. when cert-manager or certbot renews it
+type FileSource struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the two files
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewFileSource loads a key pair and checks it for changes every interval
+func NewFileSource(certFile, keyFile string, interval time.Duration) (*FileSource, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	s := &FileSource{certFile: certFile, keyFile: keyFile, stopCh: make(chan struct{})}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.loop(interval)
+	return s, nil
+}
+
+func (s *FileSource) loop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				// Keep serving the previous certificate; the files may be
+				// mid-rotation
+				log.Printf("TLS certificate reload failed: %v", err)
+			}
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// reload reads the key pair if either file changed since it was last read
+func (s *FileSource) reload() error {
+	modTime, err := latestModTime(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	unchanged := s.cert != nil && modTime.Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS key pair: %w", err)
+	}
+	s.mu.Lock()
+	reloaded := s.cert != nil
+	s.cert = &cert
+	s.modTime = modTime
+	s.mu.Unlock()
+	if reloaded {
+		log.Printf("Reloaded TLS certificate from %s", s.certFile)
+	}
+	return nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *FileSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// Close stops checking for changes
+func (s *FileSource) Close() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Client queries the shards of a cluster through their /api/cluster API
+type Client struct {
+	membership *Membership
+	token      string
+	http       *http.Client
+}
+
+// NewClient creates a client of the shards of m. token authenticates it
+// when the shards require auth.
+func NewClient(m *Membership, token string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{membership: m, token: token, http: &http.Client{Timeout: timeout}}
+}
+
+// gather sends a request to every shard at once and returns the decoded
+// responses of those that had a result; shards responding 404 have none.
+// It fails if any shard fails, rather than return partial results.
+func gather[T any](c *Client, tenant, method, path string, body any) ([]T, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	shards := c.membership.Ring().Members()
+	results := make([]*T, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = fetch[T](c, shard, tenant, method, path, data)
+		}()
+	}
+	wg.Wait()
+
+	var gathered []T
+	for i, result := range results {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("shard %s: %w", shards[i], errs[i])
+		}
+		if result != nil {
+			gathered = append(gathered, *result)
+		}
+	}
+	return gathered, nil
+}
+
+// fetch sends one request to a shard, returning nil for a 404
+func fetch[T any](c *Client, shard, tenant, method, path string, body []byte) (*T, error) {
+	req, err := http.NewRequest(method, shard+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(models.TenantHeader, tenant)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var result T
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &result, nil
+}
+
+// ServiceGraph merges the service graphs of the shards between start and
+// end
+func (c *Client) ServiceGraph(tenant string, start, end time.Time) (models.ServiceGraph, error) {
+	params := url.Values{
+		"start": {start.Format(time.RFC3339Nano)},
+		"end":   {end.Format(time.RFC3339Nano)},
+	}
+	graphs, err := gather[models.ServiceGraph](c, tenant, http.MethodGet, "/api/cluster/servicegraph?"+params.Encode(), nil)
+	if err != nil {
+		return models.ServiceGraph{}, err
+	}
+	return mergeServiceGraphs(graphs), nil
+}
@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReloadInterval is how often the members file is checked for
+// changes
+const DefaultReloadInterval = 10 * time.Second
+
+// Membership holds the shards of the cluster: a static list, plus those
+// listed in a members file that is reloaded when it changes, e.g. when a
+// Kubernetes ConfigMap or a service discovery agent rewrites it
+type Membership struct {
+	shards []string
+	file   string
+
+	ring    atomic.Pointer[Ring]
+	modTime time.Time
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewMembership loads the members file, if any, and checks it for changes
+// every interval. It fails if the cluster has no shards.
+func NewMembership(shards []string, file string, interval time.Duration) (*Membership, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	m := &Membership{shards: normalize(shards), file: file, stopCh: make(chan struct{})}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	if file != "" {
+		m.wg.Add(1)
+		go m.loop(interval)
+	}
+	return m, nil
+}
+
+// Ring returns the current ring
+func (m *Membership) Ring() *Ring {
+	return m.ring.Load()
+}
+
+func (m *Membership) loop(interval time.Duration) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.reload(); err != nil {
+				// Keep the previous shards; the file may be mid-rewrite
+				log.Printf("Cluster members reload failed: %v", err)
+			}
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// reload rebuilds the ring if the members file changed since it was last
+// read
+func (m *Membership) reload() error {
+	members := m.shards
+	if m.file != "" {
+		info, err := os.Stat(m.file)
+		if err != nil {
+			return err
+		}
+		if m.ring.Load() != nil && info.ModTime().Equal(m.modTime) {
+			return nil
+		}
+		listed, err := readMembers(m.file)
+		if err != nil {
+			return err
+		}
+		m.modTime = info.ModTime()
+		members = normalize(append(slices.Clone(m.shards), listed...))
+	}
+	if len(members) == 0 {
+		return errors.New("cluster has no shards")
+	}
+
+	previous := m.ring.Load()
+	if previous != nil && slices.Equal(previous.Members(), members) {
+		return nil
+	}
+	m.ring.Store(NewRing(members))
+	log.Printf("Cluster shards: %s", strings.Join(members, ", "))
+	return nil
+}
+
+// readMembers reads shard URLs, one per line. Blank lines and lines
+// starting with # are ignored.
+func readMembers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var members []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		members = append(members, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return members, nil
+}
+
+// normalize sorts shard URLs and drops duplicates and trailing slashes, so
+// every frontend builds the same ring from the same shards
+func normalize(shards []string) []string {
+	normalized := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		if shard = strings.TrimRight(strings.TrimSpace(shard), "/"); shard != "" {
+			normalized = append(normalized, shard)
+		}
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+// Close stops checking for changes
+func (m *Membership) Close() {
+	close(m.stopCh)
+	m.wg.Wait()
+}
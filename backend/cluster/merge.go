@@ -0,0 +1,256 @@
+package cluster
+
+import (
+	"sort"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// mergeTraces merges the parts of a trace held by several shards, which
+// happens for traces whose spans arrived on both sides of a change of
+// shards
+func mergeTraces(parts []models.Trace) *models.Trace {
+	switch len(parts) {
+	case 0:
+		return nil
+	case 1:
+		return &parts[0]
+	}
+
+	var spans []models.Span
+	seen := make(map[models.SpanID]bool)
+	partial, truncated := false, false
+	for _, part := range parts {
+		partial = partial || part.Partial
+		truncated = truncated || part.Truncated
+		for _, span := range part.Spans {
+			if !seen[span.SpanID] {
+				seen[span.SpanID] = true
+				spans = append(spans, span)
+			}
+		}
+	}
+	trace := models.BuildTrace(spans)
+	trace.Partial = partial
+	trace.Truncated = truncated
+	return trace
+}
+
+// mergeSummaries merges the trace query results of the shards into the
+// result order. A trace split across shards is listed once.
+func mergeSummaries(results [][]models.TraceSummary, order models.TraceOrder) []models.TraceSummary {
+	var merged []models.TraceSummary
+	seen := make(map[models.TraceID]bool)
+	for _, summaries := range results {
+		for _, summary := range summaries {
+			if !seen[summary.TraceID] {
+				seen[summary.TraceID] = true
+				merged = append(merged, summary)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Cursor().Before(merged[j].Cursor(), order) })
+	return merged
+}
+
+// mergeServices returns the sorted union of the services of the shards
+func mergeServices(results [][]string) []string {
+	seen := make(map[string]bool)
+	services := []string{}
+	for _, names := range results {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				services = append(services, name)
+			}
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// mergeOperations sums the operation counts of the shards, sorted by
+// operation name
+func mergeOperations(results [][]models.OperationStats) []models.OperationStats {
+	byName := make(map[string]*models.OperationStats)
+	for _, operations := range results {
+		for _, op := range operations {
+			total, ok := byName[op.Name]
+			if !ok {
+				total = &models.OperationStats{Name: op.Name}
+				byName[op.Name] = total
+			}
+			total.SpanCount += op.SpanCount
+			total.ErrorCount += op.ErrorCount
+		}
+	}
+
+	operations := make([]models.OperationStats, 0, len(byName))
+	for _, op := range byName {
+		op.ErrorRate = float64(op.ErrorCount) / float64(op.SpanCount)
+		operations = append(operations, *op)
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].Name < operations[j].Name })
+	return operations
+}
+
+// mergeLatency merges the latency buckets of the shards. Percentiles
+// can't be combined exactly, so each is the average of the shards'
+// weighted by their span counts, which is close when traces are spread
+// evenly.
+func mergeLatency(results [][]models.LatencyBucket) []models.LatencyBucket {
+	byStart := make(map[int64]*models.LatencyBucket)
+	for _, buckets := range results {
+		for _, b := range buckets {
+			total, ok := byStart[b.StartTime.Unix()]
+			if !ok {
+				total = &models.LatencyBucket{StartTime: b.StartTime}
+				byStart[b.StartTime.Unix()] = total
+			}
+			n := float64(b.Count)
+			total.P50 += b.P50 * n
+			total.P90 += b.P90 * n
+			total.P95 += b.P95 * n
+			total.P99 += b.P99 * n
+			total.Count += b.Count
+			total.Errors += b.Errors
+		}
+	}
+
+	buckets := make([]models.LatencyBucket, 0, len(byStart))
+	for _, b := range byStart {
+		if n := float64(b.Count); n > 0 {
+			b.P50 /= n
+			b.P90 /= n
+			b.P95 /= n
+			b.P99 /= n
+		}
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].StartTime.Before(buckets[j].StartTime) })
+	return buckets
+}
+
+// mergeOperationSummaries merges the operation summaries of the shards,
+// with percentiles weighted by span count as in mergeLatency
+func mergeOperationSummaries(results [][]models.OperationSummary, query models.OperationSummaryQuery) []models.OperationSummary {
+	byName := make(map[string]*models.OperationSummary)
+	for _, operations := range results {
+		for _, op := range operations {
+			total, ok := byName[op.Name]
+			if !ok {
+				total = &models.OperationSummary{Name: op.Name}
+				byName[op.Name] = total
+			}
+			n := float64(op.Count)
+			total.P50 += op.P50 * n
+			total.P90 += op.P90 * n
+			total.P95 += op.P95 * n
+			total.P99 += op.P99 * n
+			total.Count += op.Count
+			total.Errors += op.Errors
+		}
+	}
+
+	operations := make([]models.OperationSummary, 0, len(byName))
+	for _, op := range byName {
+		if n := float64(op.Count); n > 0 {
+			op.P50 /= n
+			op.P90 /= n
+			op.P95 /= n
+			op.P99 /= n
+		}
+		op.SetRates(query)
+		operations = append(operations, *op)
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].Name < operations[j].Name })
+	return operations
+}
+
+// mergeTagCounts sums the shards' tag key or value counts, most frequent
+// first, up to limit (0 = all)
+func mergeTagCounts(results [][]models.TagCount, limit int) []models.TagCount {
+	totals := make(map[string]int)
+	for _, counts := range results {
+		for _, c := range counts {
+			totals[c.Name] += c.Count
+		}
+	}
+
+	counts := make([]models.TagCount, 0, len(totals))
+	for name, count := range totals {
+		counts = append(counts, models.TagCount{Name: name, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// mergeServiceGraphs sums the calls of the shards' service graphs
+func mergeServiceGraphs(graphs []models.ServiceGraph) models.ServiceGraph {
+	type edgeKey struct{ source, target string }
+	nodes := make(map[string]*models.ServiceNode)
+	edges := make(map[edgeKey]*models.ServiceEdge)
+	for _, graph := range graphs {
+		for _, n := range graph.Nodes {
+			total, ok := nodes[n.Name]
+			if !ok {
+				total = &models.ServiceNode{Name: n.Name}
+				nodes[n.Name] = total
+			}
+			// Averages are weighted by count until divided below
+			total.AvgDuration += n.AvgDuration * float64(n.SpanCount)
+			total.SpanCount += n.SpanCount
+			total.ErrorCount += n.ErrorCount
+		}
+		for _, e := range graph.Edges {
+			key := edgeKey{e.Source, e.Target}
+			total, ok := edges[key]
+			if !ok {
+				total = &models.ServiceEdge{Source: e.Source, Target: e.Target}
+				edges[key] = total
+			}
+			total.ErrorRate += e.ErrorRate * float64(e.CallCount)
+			total.AvgLatency += e.AvgLatency * float64(e.CallCount)
+			total.CallCount += e.CallCount
+		}
+	}
+
+	merged := models.ServiceGraph{
+		Nodes: make([]models.ServiceNode, 0, len(nodes)),
+		Edges: make([]models.ServiceEdge, 0, len(edges)),
+	}
+	connections := make(map[string][]string)
+	for _, e := range edges {
+		if e.CallCount > 0 {
+			e.ErrorRate /= float64(e.CallCount)
+			e.AvgLatency /= float64(e.CallCount)
+		}
+		merged.Edges = append(merged.Edges, *e)
+		connections[e.Source] = append(connections[e.Source], e.Target)
+	}
+	for _, n := range nodes {
+		if n.SpanCount > 0 {
+			n.AvgDuration /= float64(n.SpanCount)
+		}
+		n.Connections = connections[n.Name]
+		sort.Strings(n.Connections)
+		merged.Nodes = append(merged.Nodes, *n)
+	}
+
+	sort.Slice(merged.Nodes, func(i, j int) bool { return merged.Nodes[i].Name < merged.Nodes[j].Name })
+	sort.Slice(merged.Edges, func(i, j int) bool {
+		if merged.Edges[i].Source != merged.Edges[j].Source {
+			return merged.Edges[i].Source < merged.Edges[j].Source
+		}
+		return merged.Edges[i].Target < merged.Edges[j].Target
+	})
+	return merged
+}
@@ -0,0 +1,91 @@
+// Package cluster implements cluster mode, which spreads traces across
+// collectors. A frontend collector routes each span to the shard that owns
+// its trace on a consistent-hash ring, so every shard stores, assembles and
+// derives data from complete traces, and answers trace queries by asking
+// every shard and merging their results.
+package cluster
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points each shard has on the ring, which
+// evens out the share of traces each one owns
+const virtualNodes = 128
+
+// Ring assigns keys to members by consistent hashing: each member owns the
+// keys hashing between its points and the previous ones, so adding or
+// removing a member only moves the keys of the points it gains or loses
+type Ring struct {
+	members []string
+	points  []uint64
+	// owners holds the member of each point
+	owners []string
+}
+
+// NewRing creates a ring of the given members
+func NewRing(members []string) *Ring {
+	members = slices.Clone(members)
+	slices.Sort(members)
+	members = slices.Compact(members)
+
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(members)*virtualNodes)
+	for _, member := range members {
+		for i := range virtualNodes {
+			points = append(points, point{hashKey(member + "#" + strconv.Itoa(i)), member})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	r := &Ring{members: members, points: make([]uint64, len(points)), owners: make([]string, len(points))}
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.owners[i] = p.owner
+	}
+	return r
+}
+
+// Owner returns the member owning key, or "" if the ring is empty
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// Members returns the sorted members of the ring
+func (r *Ring) Members() []string {
+	return slices.Clone(r.members)
+}
+
+// hashKey hashes a key onto the ring. FNV-1a is stable across processes,
+// so every frontend agrees on the owners; the finalizer spreads the
+// similar keys of one member's points across the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/forwarder"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// RouterConfig configures how a frontend sends spans to the shards
+type RouterConfig struct {
+	// Token authenticates the frontend to the shards when they require
+	// auth
+	Token         string
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+// Router sends spans to the shards owning their traces, through one
+// forwarder per shard so that each batches, retries and queues on its own
+// and a slow shard doesn't hold up the others
+type Router struct {
+	membership *Membership
+	config     RouterConfig
+
+	mu sync.Mutex
+	// ring is the ring the forwarders were last checked against
+	ring       *Ring
+	forwarders map[string]*forwarder.Forwarder
+}
+
+// NewRouter creates a router sending to the shards of m
+func NewRouter(m *Membership, config RouterConfig) *Router {
+	return &Router{
+		membership: m,
+		config:     config,
+		forwarders: make(map[string]*forwarder.Forwarder),
+	}
+}
+
+// Route queues spans for the shards owning their traces
+func (r *Router) Route(spans []models.Span) {
+	ring := r.membership.Ring()
+	byShard := make(map[string][]models.Span)
+	for _, span := range spans {
+		owner := ring.Owner(span.TraceID.String())
+		byShard[owner] = append(byShard[owner], span)
+	}
+	for shard, shardSpans := range byShard {
+		r.forwarder(ring, shard).Forward(shardSpans)
+	}
+}
+
+// forwarder returns the forwarder of a shard
+func (r *Router) forwarder(ring *Ring, shard string) *forwarder.Forwarder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ring != r.ring {
+		r.retireLocked(ring)
+		r.ring = ring
+	}
+	f, ok := r.forwarders[shard]
+	if !ok {
+		config := forwarder.Config{
+			Endpoint:      shard,
+			Protocol:      forwarder.ProtocolOmniTrace,
+			FlushInterval: r.config.FlushInterval,
+			Timeout:       r.config.Timeout,
+			MaxRetries:    3,
+		}
+		if r.config.Token != "" {
+			config.Headers = map[string]string{"Authorization": "Bearer " + r.config.Token}
+		}
+		f = forwarder.New(config)
+		r.forwarders[shard] = f
+	}
+	return f
+}
+
+// retireLocked closes the forwarders of shards that left the ring. Closing
+// sends the spans they still queue, so it happens in the background.
+func (r *Router) retireLocked(ring *Ring) {
+	members := make(map[string]bool)
+	for _, member := range ring.Members() {
+		members[member] = true
+	}
+	for shard, f := range r.forwarders {
+		if members[shard] {
+			continue
+		}
+		delete(r.forwarders, shard)
+		go func() {
+			if err := f.Close(); err != nil {
+				log.Printf("Cluster: spans queued for removed shard %s: %v", shard, err)
+			}
+		}()
+	}
+}
+
+// Stats returns the forwarding counters of each shard spans were routed
+// to
+func (r *Router) Stats() map[string]forwarder.Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]forwarder.Stats, len(r.forwarders))
+	for shard, f := range r.forwarders {
+		stats[shard] = f.Stats()
+	}
+	return stats
+}
+
+// Close sends the queued spans and stops the forwarders
+func (r *Router) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for _, f := range r.forwarders {
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
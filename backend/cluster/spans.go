@@ -0,0 +1,251 @@
+package cluster
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Backend is the name of the span storage backend of frontends, which
+// reads from the shards
+const Backend = "cluster"
+
+// matchPageSize is the number of trace query results fetched at a time
+// from the shards when a query's Match function is checked on the frontend
+const matchPageSize = 100
+
+// errShardsOnly is returned for operations on stored spans, which only
+// the shards can carry out
+var errShardsOnly = errors.New("spans are stored by the cluster's shards")
+
+// SpanBackend returns the factory of the frontend's span backends. Reads
+// gather the results of every shard; spans are written by the Router.
+func (c *Client) SpanBackend() storage.SpanBackendFactory {
+	return func(tenant string, _ storage.TenantConfig) (storage.SpanBackend, error) {
+		return &spanBackend{client: c, tenant: tenant}, nil
+	}
+}
+
+// spanBackend reads a tenant's spans from the shards
+type spanBackend struct {
+	client *Client
+	tenant string
+}
+
+func (b *spanBackend) Store(span models.Span) error {
+	return errShardsOnly
+}
+
+func (b *spanBackend) StoreBatch(spans []models.Span) ([]models.Span, error) {
+	return nil, errShardsOnly
+}
+
+// GetTrace merges the parts of the trace held by each shard
+func (b *spanBackend) GetTrace(traceID models.TraceID) (*models.Trace, error) {
+	parts, err := gather[models.Trace](b.client, b.tenant, http.MethodGet, "/api/cluster/traces/"+traceID.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return mergeTraces(parts), nil
+}
+
+// QueryTraces merges the first results of every shard. A query's Match
+// function can't be sent to the shards, so it is checked here on each
+// candidate trace.
+func (b *spanBackend) QueryTraces(query models.TraceQuery) ([]models.TraceSummary, error) {
+	if query.Match != nil {
+		return b.queryMatching(query)
+	}
+
+	shardQuery := query
+	shardQuery.Offset = 0
+	if query.Limit > 0 {
+		shardQuery.Limit = query.Offset + query.Limit
+	}
+	results, err := gather[[]models.TraceSummary](b.client, b.tenant, http.MethodPost, "/api/cluster/traces/search", shardQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := mergeSummaries(results, query.TraceOrder)
+	if query.Offset >= len(summaries) {
+		return nil, nil
+	}
+	summaries = summaries[query.Offset:]
+	if query.Limit > 0 && len(summaries) > query.Limit {
+		summaries = summaries[:query.Limit]
+	}
+	return summaries, nil
+}
+
+// CountTraces sums the counts of every shard, so a trace split across
+// shards is counted once per shard. With a Match function, the candidates
+// are fetched and checked like for QueryTraces.
+func (b *spanBackend) CountTraces(query models.TraceQuery) (int, error) {
+	query.TraceOrder, query.After = models.TraceOrder{}, nil
+	query.Offset, query.Limit = 0, 0
+	if query.Match != nil {
+		summaries, err := b.queryMatching(query)
+		return len(summaries), err
+	}
+
+	results, err := gather[int](b.client, b.tenant, http.MethodPost, "/api/cluster/traces/count", query)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, n := range results {
+		count += n
+	}
+	return count, nil
+}
+
+// queryMatching pages through the results of a query without its Match
+// function and fetches each trace to check it
+func (b *spanBackend) queryMatching(query models.TraceQuery) ([]models.TraceSummary, error) {
+	page := query
+	page.Match = nil
+	page.Offset = 0
+	page.Limit = matchPageSize
+
+	var summaries []models.TraceSummary
+	skipped := 0
+	for {
+		candidates, err := b.QueryTraces(page)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			trace, err := b.GetTrace(candidate.TraceID)
+			if err != nil {
+				return nil, err
+			}
+			if trace == nil || !query.Match(trace) {
+				continue
+			}
+			if skipped < query.Offset {
+				skipped++
+				continue
+			}
+			summaries = append(summaries, candidate)
+			if query.Limit > 0 && len(summaries) >= query.Limit {
+				return summaries, nil
+			}
+		}
+		if len(candidates) < page.Limit {
+			return summaries, nil
+		}
+		after := candidates[len(candidates)-1].Cursor()
+		page.After = &after
+	}
+}
+
+func (b *spanBackend) FindSpan(traceID models.TraceID, spanID models.SpanID) (models.Span, bool) {
+	trace, err := b.GetTrace(traceID)
+	if err != nil || trace == nil {
+		return models.Span{}, false
+	}
+	for _, span := range trace.Spans {
+		if span.SpanID == spanID {
+			return span, true
+		}
+	}
+	return models.Span{}, false
+}
+
+func (b *spanBackend) ChildSpans(traceID models.TraceID, parentID models.SpanID) []models.Span {
+	trace, err := b.GetTrace(traceID)
+	if err != nil || trace == nil {
+		return nil
+	}
+	var children []models.Span
+	for _, span := range trace.Spans {
+		if span.ParentSpanID == parentID {
+			children = append(children, span)
+		}
+	}
+	return children
+}
+
+// Services returns the services of every shard. The interface has no
+// error, so shards that fail to answer are left out.
+func (b *spanBackend) Services() []string {
+	results, _ := gather[[]string](b.client, b.tenant, http.MethodGet, "/api/cluster/services", nil)
+	return mergeServices(results)
+}
+
+// Operations sums the operation counts of every shard. Shards that fail
+// to answer are left out, as for Services.
+func (b *spanBackend) Operations(service string) []models.OperationStats {
+	results, _ := gather[[]models.OperationStats](b.client, b.tenant, http.MethodGet, "/api/cluster/services/"+url.PathEscape(service)+"/operations", nil)
+	return mergeOperations(results)
+}
+
+func (b *spanBackend) LatencyPercentiles(query models.LatencyQuery) ([]models.LatencyBucket, error) {
+	results, err := gather[[]models.LatencyBucket](b.client, b.tenant, http.MethodPost, "/api/cluster/stats/latency", query)
+	if err != nil {
+		return nil, err
+	}
+	return mergeLatency(results), nil
+}
+
+// OperationSummaries merges the operation summaries of every shard, with
+// percentiles averaged like LatencyPercentiles'
+func (b *spanBackend) OperationSummaries(query models.OperationSummaryQuery) ([]models.OperationSummary, error) {
+	results, err := gather[[]models.OperationSummary](b.client, b.tenant, http.MethodPost, "/api/cluster/stats/operations", query)
+	if err != nil {
+		return nil, err
+	}
+	return mergeOperationSummaries(results, query), nil
+}
+
+// TagKeys sums the tag key counts of every shard. Shards are asked for
+// all their keys, so that the limit applies to the merged counts.
+func (b *spanBackend) TagKeys(query models.TagQuery) ([]models.TagCount, error) {
+	return b.tagCounts("/api/cluster/tags/keys", query)
+}
+
+// TagValues sums the tag value counts of every shard, like TagKeys
+func (b *spanBackend) TagValues(query models.TagQuery) ([]models.TagCount, error) {
+	return b.tagCounts("/api/cluster/tags/values", query)
+}
+
+func (b *spanBackend) tagCounts(path string, query models.TagQuery) ([]models.TagCount, error) {
+	limit := query.Limit
+	query.Limit = 0
+	results, err := gather[[]models.TagCount](b.client, b.tenant, http.MethodPost, path, query)
+	if err != nil {
+		return nil, err
+	}
+	return mergeTagCounts(results, limit), nil
+}
+
+// Stats reports nothing: the frontend stores no spans
+func (b *spanBackend) Stats() storage.SpanStoreStats {
+	return storage.SpanStoreStats{}
+}
+
+func (b *spanBackend) ServiceStats() (map[string]storage.SpanStoreStats, error) {
+	return nil, errShardsOnly
+}
+
+func (b *spanBackend) DeleteTrace(traceID models.TraceID) (bool, error) {
+	return false, errShardsOnly
+}
+
+func (b *spanBackend) DeleteService(service string) (int, error) {
+	return 0, errShardsOnly
+}
+
+func (b *spanBackend) GC() {}
+
+func (b *spanBackend) Compact() error {
+	return nil
+}
+
+func (b *spanBackend) Close() error {
+	return nil
+}
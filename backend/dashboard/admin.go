@@ -0,0 +1,188 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/omnitrace/omnitrace/backend/auth"
+	"github.com/omnitrace/omnitrace/backend/ingestion"
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// storageStats is the response of the storage admin endpoint
+type storageStats struct {
+	Memory  memoryStats                   `json:"memory"`
+	Tenants map[string]tenantStorageStats `json:"tenants"`
+}
+
+// memoryStats reports the collector's memory use, in bytes
+type memoryStats struct {
+	HeapAlloc uint64 `json:"heap_alloc_bytes"`
+	HeapInuse uint64 `json:"heap_inuse_bytes"`
+	Sys       uint64 `json:"sys_bytes"`
+}
+
+type tenantStorageStats struct {
+	storage.TenantStats
+	Services map[string]storage.SpanStoreStats `json:"services"`
+}
+
+// adminRoute registers a storage admin handler. Admin endpoints delete
+// data, so they are only served to admins and not at all without auth.
+func (s *Server) adminRoute(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+	if s.auth == nil {
+		h = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Storage admin API is not enabled: it requires authentication", http.StatusNotFound)
+		}
+	} else {
+		h = s.auth.RequireAdmin(h)
+	}
+	if s.telemetry != nil {
+		h = s.telemetry.Instrument(pattern, h)
+	}
+	mux.HandleFunc(pattern, h)
+}
+
+// RegisterIngestRoutes registers the admin API of an ingestion server's
+// counters: its queue, span validation by reason, stored and duplicate
+// spans, rejected sources and idempotency keys
+func (s *Server) RegisterIngestRoutes(mux *http.ServeMux, ingest *ingestion.Server) {
+	s.adminRoute(mux, "GET /api/admin/ingest/queue", unboundAdmin(ingest.HandleQueueStats))
+	s.adminRoute(mux, "GET /api/admin/ingest/validation", unboundAdmin(ingest.HandleValidationStats))
+	s.adminRoute(mux, "GET /api/admin/ingest/spans", unboundAdmin(ingest.HandleProcessorStats))
+	s.adminRoute(mux, "GET /api/admin/ingest/sources", unboundAdmin(ingest.HandleSourceStats))
+	s.adminRoute(mux, "GET /api/admin/ingest/idempotency", unboundAdmin(ingest.HandleIdempotencyStats))
+}
+
+// unboundAdmin refuses admins bound to a tenant the collector-wide
+// counters of h, which cover every tenant
+func unboundAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bound := boundTenant(r); bound != "" {
+			http.Error(w, "Forbidden: admins of tenant "+bound+" may not read collector-wide counters", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// boundTenant returns the tenant the request's principal is bound to, or
+// "" for admins of every tenant
+func boundTenant(r *http.Request) string {
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok {
+		return p.Tenant
+	}
+	return ""
+}
+
+// handleStorageStats reports the collector's memory use and, per tenant,
+// the stored traces, spans, metric series and pinned traces, with traces
+// and spans broken down by service. Admins bound to a tenant only see
+// their own.
+func (s *Server) handleStorageStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := storageStats{
+		Memory:  memoryStats{HeapAlloc: mem.HeapAlloc, HeapInuse: mem.HeapInuse, Sys: mem.Sys},
+		Tenants: make(map[string]tenantStorageStats),
+	}
+	bound := boundTenant(r)
+	for tenant, tenantStats := range s.stores.Stats() {
+		if bound != "" && tenant != bound {
+			continue
+		}
+		services, err := s.stores.Spans(tenant).ServiceStats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats.Tenants[tenant] = tenantStorageStats{TenantStats: tenantStats, Services: services}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleDeleteTrace deletes a trace from hot storage. Pinned and archived
+// copies are kept.
+func (s *Server) handleDeleteTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	traceID, err := models.ParseTraceID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Trace not found", http.StatusNotFound)
+		return
+	}
+
+	deleted, err := s.stores.Spans(tenant).DeleteTrace(traceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Trace not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteService purges the spans, metric series and errors of a
+// service and reports how many were removed
+func (s *Server) handleDeleteService(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := s.stores.DeleteService(tenant, r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deleted)
+}
+
+// handleCompact removes expired data from every tenant now rather than at
+// the next cleanup, and reclaims the space it used. Admins bound to a
+// tenant compact only that tenant.
+func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if bound := boundTenant(r); bound != "" {
+		if s.stores.Exists(bound) {
+			err = s.stores.CompactTenant(bound)
+		}
+	} else {
+		err = s.stores.Compact()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUsage reports what each tenant ingested today, by service, and
+// since the collector started, with its quota and the spans and metrics
+// rejected over it. Admins bound to a tenant only see their own.
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	usage := map[string]ingestion.TenantUsage{}
+	if s.quotas != nil {
+		usage = s.quotas.Usage()
+	}
+	if bound := boundTenant(r); bound != "" {
+		filtered := map[string]ingestion.TenantUsage{}
+		if u, ok := usage[bound]; ok {
+			filtered[bound] = u
+		}
+		usage = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"tenants": usage})
+}
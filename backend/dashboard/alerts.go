@@ -0,0 +1,152 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/alerting"
+	"github.com/omnitrace/omnitrace/backend/auth"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// handleAlerts lists the tenant's alerts, optionally only those in one
+// state (state=pending|firing|resolved)
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusNotFound)
+		return
+	}
+
+	state := models.AlertState(r.URL.Query().Get("state"))
+	switch state {
+	case "", models.AlertStatePending, models.AlertStateFiring, models.AlertStateResolved:
+	default:
+		http.Error(w, fmt.Sprintf("invalid state %q: want pending, firing or resolved", state), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.alerts.Alerts(tenant, state))
+}
+
+// handleAlertRules lists the tenant's alert rules with their last
+// evaluation and alerts
+func (s *Server) handleAlertRules(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.alerts.Rules(tenant))
+}
+
+// silenceRequest is the body of a silence request. Duration, e.g. "2h",
+// may be given instead of ends_at. With auth enabled, created_by is the
+// logged-in user's name instead.
+type silenceRequest struct {
+	Matchers  string           `json:"matchers"`
+	StartsAt  time.Time        `json:"starts_at"`
+	EndsAt    time.Time        `json:"ends_at"`
+	Duration  *models.Duration `json:"duration"`
+	CreatedBy string           `json:"created_by"`
+	Comment   string           `json:"comment"`
+}
+
+// handleSilences lists the tenant's silences, including those expired in
+// the last day
+func (s *Server) handleSilences(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.alerts.Silences().List(tenant))
+}
+
+// handleCreateSilence mutes the notifications of the alerts matching a
+// selector, e.g. {"matchers": "{service=\"checkout\"}", "duration": "2h"}
+func (s *Server) handleCreateSilence(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req silenceRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	createdBy := req.CreatedBy
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok {
+		createdBy = p.Name
+	}
+	sil := models.Silence{
+		Tenant:    tenant,
+		Matchers:  req.Matchers,
+		StartsAt:  req.StartsAt,
+		EndsAt:    req.EndsAt,
+		CreatedBy: createdBy,
+		Comment:   req.Comment,
+	}
+	if req.Duration != nil {
+		if sil.StartsAt.IsZero() {
+			sil.StartsAt = time.Now()
+		}
+		sil.EndsAt = sil.StartsAt.Add(time.Duration(*req.Duration))
+	}
+
+	created, err := s.alerts.Silences().Add(sil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// handleExpireSilence ends a silence now
+func (s *Server) handleExpireSilence(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusNotFound)
+		return
+	}
+
+	err := s.alerts.Silences().Expire(tenant, r.PathValue("id"))
+	if errors.Is(err, alerting.ErrSilenceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
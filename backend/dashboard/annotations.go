@@ -0,0 +1,81 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/omnitrace/omnitrace/backend/auth"
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// annotationRequest is the body of an annotation request. The author is
+// only taken from it when auth is disabled; otherwise it is the logged-in
+// user or token.
+type annotationRequest struct {
+	Text   string `json:"text"`
+	Author string `json:"author"`
+}
+
+// handleAnnotateTrace attaches a note to a trace, e.g. {"text": "Slow
+// because of the cache flush at 14:02"}
+func (s *Server) handleAnnotateTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	trace, ok := s.findTrace(w, tenant, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	var req annotationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	author := req.Author
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok {
+		author = p.Name
+	}
+	if author == "" {
+		author = "anonymous"
+	}
+
+	annotation, err := s.stores.Annotations(tenant).Add(models.TraceAnnotation{
+		TraceID: trace.TraceID,
+		Author:  author,
+		Text:    req.Text,
+	})
+	if errors.Is(err, storage.ErrInvalidAnnotation) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(annotation)
+}
+
+// handleTraceAnnotations lists the notes attached to a trace, oldest first.
+// They outlive the trace's spans.
+func (s *Server) handleTraceAnnotations(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	traceID, err := models.ParseTraceID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Trace not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.Annotations(tenant).Trace(traceID))
+}
@@ -0,0 +1,204 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// maxClusterQueryBytes limits the body of a query from a cluster frontend
+const maxClusterQueryBytes = 1 << 20
+
+// The /api/cluster API answers the queries of cluster frontends from this
+// collector's storage, as shard. Unlike the public API it takes storage
+// queries as they are and returns their results without looking in the
+// pinned traces or the archive, which the frontend has its own of.
+
+// handleClusterSearch runs a trace query posted as JSON
+func (s *Server) handleClusterSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	var query models.TraceQuery
+	if !decodeClusterQuery(w, r, &query) {
+		return
+	}
+
+	summaries, err := s.stores.Spans(tenant).QueryTraces(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if summaries == nil {
+		summaries = []models.TraceSummary{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// handleClusterCount counts the traces matching a query posted as JSON
+func (s *Server) handleClusterCount(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	var query models.TraceQuery
+	if !decodeClusterQuery(w, r, &query) {
+		return
+	}
+
+	count, err := s.stores.Spans(tenant).CountTraces(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(count)
+}
+
+// handleClusterTrace returns the spans of a trace stored here, or 404
+func (s *Server) handleClusterTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	traceID, err := models.ParseTraceID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, errTraceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	trace, err := s.stores.Spans(tenant).GetTrace(traceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if trace == nil {
+		http.Error(w, errTraceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trace)
+}
+
+func (s *Server) handleClusterServices(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.Spans(tenant).Services())
+}
+
+func (s *Server) handleClusterOperations(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.Spans(tenant).Operations(r.PathValue("service")))
+}
+
+// handleClusterLatency computes latency percentiles for a query posted as
+// JSON
+func (s *Server) handleClusterLatency(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	var query models.LatencyQuery
+	if !decodeClusterQuery(w, r, &query) {
+		return
+	}
+
+	buckets, err := s.stores.Spans(tenant).LatencyPercentiles(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
+
+func (s *Server) handleClusterOperationStats(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	var query models.OperationSummaryQuery
+	if !decodeClusterQuery(w, r, &query) {
+		return
+	}
+
+	operations, err := s.stores.Spans(tenant).OperationSummaries(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(operations)
+}
+
+// handleClusterTagKeys and handleClusterTagValues count this shard's tag
+// keys or values for a query posted as JSON
+func (s *Server) handleClusterTagKeys(w http.ResponseWriter, r *http.Request) {
+	s.handleClusterTags(w, r, storage.SpanReader.TagKeys)
+}
+
+func (s *Server) handleClusterTagValues(w http.ResponseWriter, r *http.Request) {
+	s.handleClusterTags(w, r, storage.SpanReader.TagValues)
+}
+
+func (s *Server) handleClusterTags(w http.ResponseWriter, r *http.Request, lookup func(storage.SpanReader, models.TagQuery) ([]models.TagCount, error)) {
+	var query models.TagQuery
+	if !decodeClusterQuery(w, r, &query) {
+		return
+	}
+	s.writeTagCounts(w, r, query, lookup)
+}
+
+// handleClusterServiceGraph returns the service graph built here from
+// the spans of complete traces
+func (s *Server) handleClusterServiceGraph(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.ServiceGraph(tenant).Graph(start, end))
+}
+
+func decodeClusterQuery(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxClusterQueryBytes)).Decode(v); err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// serviceGraph returns the service graph of a tenant, merged from the
+// shards on a cluster frontend, whose spans are stored by them
+func (s *Server) serviceGraph(tenant string, start, end time.Time) (models.ServiceGraph, error) {
+	if s.cluster != nil {
+		return s.cluster.ServiceGraph(tenant, start, end)
+	}
+	return s.stores.ServiceGraph(tenant).Graph(start, end), nil
+}
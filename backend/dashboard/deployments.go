@@ -0,0 +1,76 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// defaultDeployments is how many deployments are listed without a limit
+const defaultDeployments = 100
+
+// handleDeployments lists deployment markers, newest first. Parameters:
+// service, start, end or lookback (default 7 days), and limit (default
+// 100).
+func (s *Server) handleDeployments(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	start, end, err := parseTimeRange(r, 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := models.DeploymentQuery{
+		Service:   r.URL.Query().Get("service"),
+		StartTime: start,
+		EndTime:   end,
+		Limit:     defaultDeployments,
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if query.Limit, err = parseCount("limit", v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.Deployments(tenant).List(query))
+}
+
+// handleRecordDeployment records a deployment marker, e.g. {"service":
+// "checkout", "version": "1.4.2", "metadata": {"commit": "3f2a9c1"}}. The
+// timestamp defaults to now.
+func (s *Server) handleRecordDeployment(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	var d models.Deployment
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&d); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	recorded, err := s.stores.Deployments(tenant).Record(d)
+	if errors.Is(err, storage.ErrInvalidDeployment) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(recorded)
+}
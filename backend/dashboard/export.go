@@ -0,0 +1,89 @@
+package dashboard
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// handleExport streams a tenant's spans and metric points in a time range
+// (the last 24 hours by default) as newline-delimited JSON records, for
+// backups and for cloning data into another collector. Spans are exported
+// by trace, so a trace that started in the range is exported whole.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	start, end, err := parseTimeRange(r, 24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spans := s.stores.Spans(tenant)
+	summaries, err := spans.QueryTraces(models.TraceQuery{StartTime: start, EndTime: end, IncludePartial: true})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	points, err := s.stores.Metrics(tenant).Points(models.MetricQuery{StartTime: start, EndTime: end})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	// Once streaming has started errors can't be reported with a status, so
+	// the export is cut short and the client sees a truncated body
+	for _, summary := range summaries {
+		trace, err := spans.GetTrace(summary.TraceID)
+		if err != nil {
+			log.Printf("Export of tenant %s stopped: %v", tenant, err)
+			return
+		}
+		// Expired since the query
+		if trace == nil {
+			continue
+		}
+		for _, span := range trace.Spans {
+			span = unskewSpan(span)
+			if err := enc.Encode(models.ExportRecord{Span: &span}); err != nil {
+				return
+			}
+		}
+	}
+	for i := range points {
+		if err := enc.Encode(models.ExportRecord{Metric: &points[i]}); err != nil {
+			return
+		}
+	}
+	bw.Flush()
+}
+
+// unskewSpan reverts the clock skew correction applied when a trace is
+// read, so a span is exported as it was ingested and corrected again when
+// imported
+func unskewSpan(span models.Span) models.Span {
+	shift, err := time.ParseDuration(span.Tags[models.ClockSkewTag])
+	if err != nil {
+		return span
+	}
+	span.StartTime = span.StartTime.Add(-shift)
+	span.EndTime = span.EndTime.Add(-shift)
+	tags := make(map[string]string, len(span.Tags)-1)
+	for k, v := range span.Tags {
+		if k != models.ClockSkewTag {
+			tags[k] = v
+		}
+	}
+	span.Tags = tags
+	return span
+}
@@ -0,0 +1,63 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// handleFlamegraph merges the call trees of recent traces of a service's
+// operation into one weighted tree. Parameters: service (required),
+// operation (defaults to the service's entry spans), range, the lookback
+// (default 1h; start and end also work), limit, the number of traces to
+// sample, and format=folded for folded stack text instead of JSON.
+func (s *Server) handleFlamegraph(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	service := q.Get("service")
+	if service == "" {
+		http.Error(w, "service is required", http.StatusBadRequest)
+		return
+	}
+
+	start, end, err := parseRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseSampleLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	graph, err := storage.BuildFlamegraph(s.stores.Spans(tenant), models.FlamegraphQuery{
+		Service:   service,
+		Operation: q.Get("operation"),
+		StartTime: start,
+		EndTime:   end,
+		MaxTraces: limit,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(graph)
+	case "folded":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		storage.WriteFolded(w, graph)
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,96 @@
+package dashboard
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// contentSecurityPolicy limits the dashboard to its own scripts, plus the
+// inline styles it renders and its web font
+const contentSecurityPolicy = "default-src 'self'; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; " +
+	"font-src https://fonts.gstatic.com; " +
+	"img-src 'self' data:; " +
+	"frame-ancestors 'none'"
+
+// corsMaxAge is how many seconds browsers may cache a preflight response
+const corsMaxAge = "600"
+
+// CORSConfig lists what browser frontends on other origins may do with the
+// API. CORS is disabled when AllowedOrigins is empty.
+type CORSConfig struct {
+	// AllowedOrigins are origins such as https://app.example.com; "*"
+	// allows any origin
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+}
+
+// allows reports whether origin may call the API
+func (c CORSConfig) allows(origin string) bool {
+	return origin != "" && (slices.Contains(c.AllowedOrigins, "*") || slices.Contains(c.AllowedOrigins, origin))
+}
+
+// isAPIPath reports whether path is served by an API rather than the
+// dashboard UI
+func isAPIPath(path string) bool {
+	for _, prefix := range []string{"/api/", "/jaeger/api/", "/tempo/api/", "/zipkin/api/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers wraps the collector's handler to answer cross-origin API requests
+// from allowed origins, including preflight requests, and to set security
+// headers on every response. Credentials aren't allowed cross-origin, so
+// frontends authenticate with bearer tokens rather than session cookies.
+func Headers(next http.Handler, cors CORSConfig) http.Handler {
+	methods := strings.Join(cors.AllowedMethods, ", ")
+	headers := strings.Join(cors.AllowedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		if r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
+		if !isAPIPath(r.URL.Path) {
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Content-Security-Policy", contentSecurityPolicy)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(cors.AllowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if !cors.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if slices.Contains(cors.AllowedOrigins, "*") {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// Preflight requests carry no credentials, so they are answered
+		// here rather than by the authenticated routes
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			h.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
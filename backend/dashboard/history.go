@@ -0,0 +1,87 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/history"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// handleHistoryTraces searches the summaries of compacted traces, which
+// outlive the traces themselves. It takes the parameters of /api/traces;
+// without a time range, the whole history retention matches.
+func (s *Server) handleHistoryTraces(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.history == nil {
+		http.Error(w, "Trace history is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query, err := parseTraceQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	summaries, total, err := s.history.Traces(tenant, pageQuery(query))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newTraceList(query, summaries, total))
+}
+
+// handleHistoryOperations returns the span count, errors and latency
+// percentiles of operations over the history retention, per step.
+// Parameters: service, operation, start, end or lookback (default 24h),
+// and step, a multiple of an hour (default 1h).
+func (s *Server) handleHistoryOperations(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.history == nil {
+		http.Error(w, "Trace history is not enabled", http.StatusNotFound)
+		return
+	}
+
+	start, end, err := parseTimeRange(r, 24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := models.LatencyQuery{
+		Service:   r.URL.Query().Get("service"),
+		Operation: r.URL.Query().Get("operation"),
+		StartTime: start,
+		EndTime:   end,
+		Step:      history.Resolution,
+	}
+	if step := r.URL.Query().Get("step"); step != "" {
+		d, err := time.ParseDuration(step)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid step", http.StatusBadRequest)
+			return
+		}
+		query.Step = d
+	}
+	if end.Sub(start)/query.Step > maxTimeBuckets {
+		http.Error(w, "Step too small for time range", http.StatusBadRequest)
+		return
+	}
+
+	operations, err := s.history.Operations(tenant, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"operations": operations})
+}
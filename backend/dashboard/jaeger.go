@@ -0,0 +1,369 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// jaegerDefaultLimit is the number of traces a Jaeger search returns when
+// it doesn't set a limit, as in Jaeger
+const jaegerDefaultLimit = 20
+
+// jaegerResponse is the envelope of Jaeger query API responses
+type jaegerResponse struct {
+	Data   interface{}   `json:"data"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Errors []jaegerError `json:"errors"`
+}
+
+type jaegerError struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+	Warnings  []string                 `json:"warnings"`
+}
+
+type jaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	OperationName string            `json:"operationName"`
+	References    []jaegerReference `json:"references"`
+	StartTime     int64             `json:"startTime"` // Unix microseconds
+	Duration      int64             `json:"duration"`  // Microseconds
+	Tags          []jaegerKeyValue  `json:"tags"`
+	Logs          []jaegerLog       `json:"logs"`
+	ProcessID     string            `json:"processID"`
+	Warnings      []string          `json:"warnings"`
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerKeyValue struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type jaegerLog struct {
+	Timestamp int64            `json:"timestamp"`
+	Fields    []jaegerKeyValue `json:"fields"`
+}
+
+type jaegerProcess struct {
+	ServiceName string           `json:"serviceName"`
+	Tags        []jaegerKeyValue `json:"tags"`
+}
+
+type jaegerOperation struct {
+	Name     string `json:"name"`
+	SpanKind string `json:"spanKind"`
+}
+
+func writeJaegerData(w http.ResponseWriter, data interface{}, total int) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jaegerResponse{Data: data, Total: total})
+}
+
+func writeJaegerError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(jaegerResponse{Errors: []jaegerError{{Code: status, Msg: err.Error()}}})
+}
+
+func (s *Server) handleJaegerServices(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	services := s.stores.Spans(tenant).Services()
+	if services == nil {
+		services = []string{}
+	}
+	writeJaegerData(w, services, len(services))
+}
+
+func (s *Server) handleJaegerServiceOperations(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	operations := s.stores.Spans(tenant).Operations(r.PathValue("service"))
+	names := make([]string, 0, len(operations))
+	for _, op := range operations {
+		names = append(names, op.Name)
+	}
+	writeJaegerData(w, names, len(names))
+}
+
+// handleJaegerOperations lists the operations of the "service" parameter.
+// Operations aren't indexed by span kind, so it is left empty.
+func (s *Server) handleJaegerOperations(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	service := r.URL.Query().Get("service")
+	if service == "" {
+		writeJaegerError(w, http.StatusBadRequest, fmt.Errorf("parameter 'service' is required"))
+		return
+	}
+	operations := s.stores.Spans(tenant).Operations(service)
+	ops := make([]jaegerOperation, 0, len(operations))
+	for _, op := range operations {
+		ops = append(ops, jaegerOperation{Name: op.Name})
+	}
+	writeJaegerData(w, ops, len(ops))
+}
+
+// handleJaegerTraces searches traces with Jaeger's parameters: service,
+// operation, tags (a JSON object of tags some span must have), start and
+// end in Unix microseconds, minDuration, maxDuration and limit. Repeated
+// traceID parameters fetch those traces instead.
+func (s *Server) handleJaegerTraces(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	if ids := q["traceID"]; len(ids) > 0 {
+		traces := make([]jaegerTrace, 0, len(ids))
+		for _, id := range ids {
+			trace, status, err := s.lookupTrace(tenant, id)
+			if errors.Is(err, errTraceNotFound) {
+				continue
+			}
+			if err != nil {
+				writeJaegerError(w, status, err)
+				return
+			}
+			traces = append(traces, newJaegerTrace(trace))
+		}
+		writeJaegerData(w, traces, len(traces))
+		return
+	}
+
+	query, err := parseJaegerQuery(r)
+	if err != nil {
+		writeJaegerError(w, http.StatusBadRequest, err)
+		return
+	}
+	summaries, err := s.stores.Spans(tenant).QueryTraces(query)
+	if err != nil {
+		writeJaegerError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	traces := make([]jaegerTrace, 0, len(summaries))
+	for _, summary := range summaries {
+		trace, err := s.stores.Spans(tenant).GetTrace(summary.TraceID)
+		if err != nil {
+			writeJaegerError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if trace != nil { // Expired since the query
+			traces = append(traces, newJaegerTrace(trace))
+		}
+	}
+	writeJaegerData(w, traces, len(traces))
+}
+
+func (s *Server) handleJaegerTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	trace, status, err := s.lookupTrace(tenant, r.PathValue("id"))
+	if err != nil {
+		writeJaegerError(w, status, err)
+		return
+	}
+	writeJaegerData(w, []jaegerTrace{newJaegerTrace(trace)}, 1)
+}
+
+// parseJaegerQuery reads the search parameters of the Jaeger API. Unlike
+// the dashboard's, operation and tags match any span of the service rather
+// than the root span, as they do in Jaeger.
+func parseJaegerQuery(r *http.Request) (models.TraceQuery, error) {
+	q := r.URL.Query()
+	query := models.TraceQuery{
+		Service: q.Get("service"),
+		Limit:   jaegerDefaultLimit,
+	}
+
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if query.Limit, err = parseCount("limit", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("minDuration"); v != "" {
+		if query.MinDuration, err = parseDuration("minDuration", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("maxDuration"); v != "" {
+		if query.MaxDuration, err = parseDuration("maxDuration", v); err != nil {
+			return query, err
+		}
+	}
+
+	query.EndTime = time.Now()
+	if v := q.Get("end"); v != "" {
+		if query.EndTime, err = parseJaegerTime("end", v); err != nil {
+			return query, err
+		}
+	}
+	query.StartTime = query.EndTime.Add(-time.Hour)
+	if v := q.Get("start"); v != "" {
+		if query.StartTime, err = parseJaegerTime("start", v); err != nil {
+			return query, err
+		}
+	}
+
+	var tags map[string]string
+	if v := q.Get("tags"); v != "" {
+		if err := json.Unmarshal([]byte(v), &tags); err != nil {
+			return query, fmt.Errorf("invalid tags %q: want a JSON object of strings", v)
+		}
+	}
+	operation := q.Get("operation")
+	if operation != "" || len(tags) > 0 {
+		query.Match = func(trace *models.Trace) bool {
+			for i := range trace.Spans {
+				span := &trace.Spans[i]
+				if query.Service != "" && span.ServiceName != query.Service {
+					continue
+				}
+				if operation != "" && span.OperationName != operation {
+					continue
+				}
+				if jaegerSpanHasTags(span, tags) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return query, nil
+}
+
+// parseJaegerTime parses Unix microseconds
+func parseJaegerTime(name, value string) (time.Time, error) {
+	us, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q: want Unix microseconds", name, value)
+	}
+	return time.UnixMicro(us), nil
+}
+
+// jaegerSpanHasTags reports whether a span has every tag, counting the
+// error tag Jaeger derives from the span status
+func jaegerSpanHasTags(span *models.Span, tags map[string]string) bool {
+	for key, value := range tags {
+		if key == "error" && value == "true" && span.Status == models.SpanStatusError {
+			continue
+		}
+		if v, ok := span.Tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// newJaegerTrace converts a trace to Jaeger's format, with one process per
+// service
+func newJaegerTrace(trace *models.Trace) jaegerTrace {
+	jt := jaegerTrace{
+		TraceID:   trace.TraceID.String(),
+		Spans:     make([]jaegerSpan, 0, len(trace.Spans)),
+		Processes: make(map[string]jaegerProcess),
+	}
+	processIDs := make(map[string]string)
+	for i := range trace.Spans {
+		span := &trace.Spans[i]
+		processID, ok := processIDs[span.ServiceName]
+		if !ok {
+			processID = "p" + strconv.Itoa(len(processIDs)+1)
+			processIDs[span.ServiceName] = processID
+			jt.Processes[processID] = jaegerProcess{ServiceName: span.ServiceName, Tags: []jaegerKeyValue{}}
+		}
+		jt.Spans = append(jt.Spans, newJaegerSpan(span, processID))
+	}
+	return jt
+}
+
+func newJaegerSpan(span *models.Span, processID string) jaegerSpan {
+	js := jaegerSpan{
+		TraceID:       span.TraceID.String(),
+		SpanID:        span.SpanID.String(),
+		OperationName: span.OperationName,
+		References:    []jaegerReference{},
+		StartTime:     span.StartTime.UnixMicro(),
+		Duration:      span.Duration.Microseconds(),
+		Tags:          jaegerTags(span.Tags),
+		Logs:          make([]jaegerLog, 0, len(span.Logs)),
+		ProcessID:     processID,
+	}
+	if !span.ParentSpanID.IsZero() {
+		js.References = append(js.References, jaegerReference{RefType: "CHILD_OF", TraceID: js.TraceID, SpanID: span.ParentSpanID.String()})
+	}
+	for _, link := range span.Links {
+		js.References = append(js.References, jaegerReference{RefType: "FOLLOWS_FROM", TraceID: link.TraceID.String(), SpanID: link.SpanID.String()})
+	}
+	if span.Kind != "" && span.Kind != models.SpanKindInternal {
+		js.Tags = append(js.Tags, jaegerKeyValue{Key: "span.kind", Type: "string", Value: string(span.Kind)})
+	}
+	if span.Status == models.SpanStatusError {
+		js.Tags = append(js.Tags, jaegerKeyValue{Key: "error", Type: "bool", Value: true})
+		if span.StatusMessage != "" {
+			js.Tags = append(js.Tags, jaegerKeyValue{Key: "otel.status_description", Type: "string", Value: span.StatusMessage})
+		}
+	}
+	for _, log := range span.Logs {
+		js.Logs = append(js.Logs, jaegerLog{Timestamp: log.Timestamp.UnixMicro(), Fields: jaegerTags(log.Fields)})
+	}
+	if span.ErrorInfo != nil {
+		js.Logs = append(js.Logs, jaegerLog{
+			Timestamp: span.EndTime.UnixMicro(),
+			Fields: []jaegerKeyValue{
+				{Key: "event", Type: "string", Value: "error"},
+				{Key: "error.kind", Type: "string", Value: span.ErrorInfo.Type},
+				{Key: "message", Type: "string", Value: span.ErrorInfo.Message},
+			},
+		})
+	}
+	return js
+}
+
+// jaegerTags converts tags to Jaeger string tags, sorted by key
+func jaegerTags(tags map[string]string) []jaegerKeyValue {
+	kvs := make([]jaegerKeyValue, 0, len(tags))
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		kvs = append(kvs, jaegerKeyValue{Key: key, Type: "string", Value: tags[key]})
+	}
+	return kvs
+}
@@ -0,0 +1,291 @@
+package dashboard
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// unixMillisThreshold separates Unix seconds from milliseconds: as seconds
+// it would be over 1000 years from now
+const unixMillisThreshold = 100000000000
+
+// parseTime parses an RFC 3339 timestamp, Unix seconds or Unix milliseconds
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n >= unixMillisThreshold || n <= -unixMillisThreshold {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want RFC 3339, Unix seconds or Unix milliseconds", value)
+}
+
+// parseDuration parses a non-negative Go duration such as 500ms, or a
+// number of milliseconds
+func parseDuration(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		ms, msErr := strconv.ParseInt(value, 10, 64)
+		if msErr != nil {
+			return 0, fmt.Errorf("invalid %s %q: want a duration such as 500ms or milliseconds", name, value)
+		}
+		d = time.Duration(ms) * time.Millisecond
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, value)
+	}
+	return d, nil
+}
+
+// parseCount parses a non-negative integer parameter
+func parseCount(name, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: want a non-negative integer", name, value)
+	}
+	return n, nil
+}
+
+// parseTimeRange reads the "start" and "end" query parameters, falling back
+// to a window of "lookback" (or defaultLookback) ending now
+func parseTimeRange(r *http.Request, defaultLookback time.Duration) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+
+	end := time.Now()
+	if v := q.Get("end"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end = t
+	}
+
+	lookback := defaultLookback
+	if v := q.Get("lookback"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid lookback %q", v)
+		}
+		lookback = d
+	}
+	start := end.Add(-lookback)
+	if v := q.Get("start"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start = t
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end is before start")
+	}
+	return start, end, nil
+}
+
+// parseRange reads the time range of the endpoints taking a "range"
+// lookback, which defaults to 1h. Start and end also work, as in
+// parseTimeRange.
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+	lookback := time.Hour
+	if v := r.URL.Query().Get("range"); v != "" {
+		d, err := parseDuration("range", v)
+		if err != nil || d == 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q: want a positive duration", v)
+		}
+		lookback = d
+	}
+	return parseTimeRange(r, lookback)
+}
+
+// parseTraceQuery reads the trace search parameters shared by the trace
+// endpoints. Without start, end or lookback, traces of the whole retention
+// window match.
+func parseTraceQuery(r *http.Request) (models.TraceQuery, error) {
+	q := r.URL.Query()
+	query := models.TraceQuery{
+		Service:   q.Get("service"),
+		Operation: q.Get("operation"),
+		Limit:     50,
+	}
+
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if query.Limit, err = parseCount("limit", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if query.Offset, err = parseCount("offset", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("error"); v != "" {
+		hasError, err := strconv.ParseBool(v)
+		if err != nil {
+			return query, fmt.Errorf("invalid error %q: want true or false", v)
+		}
+		query.HasError = &hasError
+	}
+	if v := q.Get("partial"); v != "" {
+		if query.IncludePartial, err = strconv.ParseBool(v); err != nil {
+			return query, fmt.Errorf("invalid partial %q: want true or false", v)
+		}
+	}
+	switch v := q.Get("sort"); v {
+	case "", models.TraceSortStartTime, models.TraceSortDuration, models.TraceSortSpanCount, models.TraceSortErrorCount:
+		query.SortBy = v
+	default:
+		return query, fmt.Errorf("invalid sort %q: want start_time, duration, span_count or error_count", v)
+	}
+	switch v := q.Get("order"); v {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return query, fmt.Errorf("invalid order %q: want asc or desc", v)
+	}
+
+	if v := q.Get("minDuration"); v != "" {
+		if query.MinDuration, err = parseDuration("minDuration", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("maxDuration"); v != "" {
+		if query.MaxDuration, err = parseDuration("maxDuration", v); err != nil {
+			return query, err
+		}
+	}
+	if query.MaxDuration > 0 && query.MinDuration > query.MaxDuration {
+		return query, fmt.Errorf("minDuration %s is greater than maxDuration %s", query.MinDuration, query.MaxDuration)
+	}
+
+	if q.Get("start") != "" || q.Get("end") != "" || q.Get("lookback") != "" {
+		if query.StartTime, query.EndTime, err = parseTimeRange(r, time.Hour); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		if query.After, err = decodeTraceCursor(v, query.TraceOrder); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// traceCursor is the content of the opaque continuation token of trace
+// queries
+type traceCursor struct {
+	SortBy    string             `json:"sort,omitempty"`
+	Ascending bool               `json:"asc,omitempty"`
+	After     models.TraceCursor `json:"after"`
+}
+
+func encodeTraceCursor(order models.TraceOrder, after models.TraceCursor) string {
+	data, _ := json.Marshal(traceCursor{SortBy: order.SortBy, Ascending: order.Ascending, After: after})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTraceCursor(value string, order models.TraceOrder) (*models.TraceCursor, error) {
+	var cursor traceCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if cursor.SortBy != order.SortBy || cursor.Ascending != order.Ascending {
+		return nil, fmt.Errorf("cursor is for a different sort order")
+	}
+	return &cursor.After, nil
+}
+
+// traceList is the response of the trace search endpoints. Total counts
+// every matching trace and Truncated tells whether more follow the page.
+// NextCursor, passed as the cursor parameter, continues after the last
+// trace.
+type traceList struct {
+	Traces     []models.TraceSummary `json:"traces"`
+	Total      int                   `json:"total"`
+	Truncated  bool                  `json:"truncated"`
+	NextCursor string                `json:"next_cursor,omitempty"`
+}
+
+// pageQuery returns the query to run for a page of results, which asks
+// for one trace past the limit to tell whether the page is the last
+func pageQuery(query models.TraceQuery) models.TraceQuery {
+	if query.Limit > 0 {
+		query.Limit++
+	}
+	return query
+}
+
+// newTraceList cuts the results of pageQuery(query) down to the page
+func newTraceList(query models.TraceQuery, summaries []models.TraceSummary, total int) traceList {
+	list := traceList{Traces: summaries, Total: total}
+	if query.Limit > 0 && len(summaries) > query.Limit {
+		list.Traces = summaries[:query.Limit]
+		list.Truncated = true
+		list.NextCursor = encodeTraceCursor(query.TraceOrder, list.Traces[len(list.Traces)-1].Cursor())
+	}
+	if list.Traces == nil {
+		list.Traces = []models.TraceSummary{}
+	}
+	return list
+}
+
+// parseLabels reads "label" query parameters of the form name=value, which
+// may repeat
+func parseLabels(r *http.Request) (map[string]string, error) {
+	values := r.URL.Query()["label"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(values))
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label %q: want name=value", v)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// Traces returned by /api/traces/top by default, and at most
+const (
+	defaultTopTraces = 10
+	maxTopTraces     = 1000
+)
+
+// Trace sampling for aggregations: how many recent traces are merged by
+// default, and at most
+const (
+	defaultSampledTraces = 500
+	maxSampledTraces     = 5000
+)
+
+// parseSampleLimit reads the "limit" parameter of the endpoints that
+// aggregate a sample of recent traces
+func parseSampleLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultSampledTraces, nil
+	}
+	n, err := parseCount("limit", v)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid limit %q: want a positive integer", v)
+	}
+	return min(n, maxSampledTraces), nil
+}
@@ -0,0 +1,108 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// pinRequest is the optional body of a pin request
+type pinRequest struct {
+	Note string `json:"note"`
+}
+
+// handlePinTrace pins a trace so it outlives its TTL. The trace is copied
+// as it is now, from hot storage or the archive.
+func (s *Server) handlePinTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	traceID, err := models.ParseTraceID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Trace not found", http.StatusNotFound)
+		return
+	}
+
+	var req pinRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	trace, err := s.stores.Spans(tenant).GetTrace(traceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if trace == nil && s.archive != nil {
+		trace, err = s.archive.GetTrace(tenant, traceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	if trace == nil {
+		// Re-pinning only updates the note of a trace that has expired
+		trace = s.stores.Pins(tenant).GetTrace(traceID)
+	}
+	if trace == nil {
+		http.Error(w, "Trace not found", http.StatusNotFound)
+		return
+	}
+
+	pinned, err := s.stores.Pins(tenant).Pin(trace, req.Note)
+	if errors.Is(err, storage.ErrPinLimit) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pinned)
+}
+
+// handleUnpinTrace unpins a trace, leaving it to expire with its TTL
+func (s *Server) handleUnpinTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	traceID, err := models.ParseTraceID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Trace not pinned", http.StatusNotFound)
+		return
+	}
+
+	unpinned, err := s.stores.Pins(tenant).Unpin(traceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !unpinned {
+		http.Error(w, "Trace not pinned", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePinnedTraces lists the pinned traces, most recently pinned first
+func (s *Server) handlePinnedTraces(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	pins := s.stores.Pins(tenant).List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pins)
+}
@@ -0,0 +1,298 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/promql"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// promLookback is how far back an instant query without a range looks for
+// samples, as in Prometheus
+const promLookback = 5 * time.Minute
+
+// promResponse is the envelope of Prometheus HTTP API responses
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// promQueryData is the data of a query response
+type promQueryData struct {
+	ResultType string        `json:"resultType"`
+	Result     []interface{} `json:"result"`
+}
+
+type promVectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+type promMatrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+func writePromData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(promResponse{Status: "success", Data: data})
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(promResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// promSample formats a sample as Prometheus does: Unix seconds and the
+// value as a string
+func promSample(t time.Time, v float64) [2]interface{} {
+	return [2]interface{}{float64(t.UnixMilli()) / 1000, strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+// parsePromTime parses Unix seconds, possibly fractional, or RFC 3339
+func parsePromTime(name, value string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q: want Unix seconds or RFC 3339", name, value)
+}
+
+// parsePromDuration parses seconds, possibly fractional, or a Prometheus
+// duration
+func parsePromDuration(name, value string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(value, 64); err == nil && f > 0 && !math.IsInf(f, 0) {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if d, err := promql.ParseDuration(value); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid %s %q: want a positive duration", name, value)
+}
+
+// runPromQuery plans a query, reads its buckets and evaluates them
+func (s *Server) runPromQuery(tenant string, q *promql.Query, start, end time.Time, step time.Duration) ([]promql.Series, error) {
+	buckets, err := s.stores.Metrics(tenant).QueryMetrics(q.Plan(start, end, step))
+	if err != nil {
+		return nil, err
+	}
+	return q.Evaluate(buckets), nil
+}
+
+// handlePromQuery serves the Prometheus instant query API,
+// /api/v1/query?query=&time=, with the subset of PromQL in package promql
+func (s *Server) handlePromQuery(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := promql.Parse(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	at := time.Now()
+	if v := r.FormValue("time"); v != "" {
+		if at, err = parsePromTime("time", v); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+	}
+
+	lookback := promLookback
+	if q.Range > 0 {
+		lookback = q.Range
+	}
+	series, err := s.runPromQuery(tenant, q, at.Add(-lookback), at, lookback)
+	if err != nil {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+
+	data := promQueryData{ResultType: "vector", Result: []interface{}{}}
+	for _, s := range series {
+		if len(s.Samples) == 0 {
+			continue
+		}
+		last := s.Samples[len(s.Samples)-1]
+		data.Result = append(data.Result, promVectorSample{Metric: s.Labels, Value: promSample(at, last.Value)})
+	}
+	writePromData(w, data)
+}
+
+// handlePromQueryRange serves the Prometheus range query API,
+// /api/v1/query_range?query=&start=&end=&step=
+func (s *Server) handlePromQueryRange(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := promql.Parse(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	start, err := parsePromTime("start", r.FormValue("start"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	end, err := parsePromTime("end", r.FormValue("end"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	step, err := parsePromDuration("step", r.FormValue("step"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if end.Before(start) {
+		writePromError(w, http.StatusBadRequest, "bad_data", errors.New("end is before start"))
+		return
+	}
+	if end.Sub(start)/step > maxTimeBuckets {
+		writePromError(w, http.StatusBadRequest, "bad_data", errors.New("step too small for time range"))
+		return
+	}
+
+	series, err := s.runPromQuery(tenant, q, start, end, step)
+	if err != nil {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+
+	data := promQueryData{ResultType: "matrix", Result: []interface{}{}}
+	for _, s := range series {
+		out := promMatrixSeries{Metric: s.Labels, Values: make([][2]interface{}, 0, len(s.Samples))}
+		for _, sample := range s.Samples {
+			out.Values = append(out.Values, promSample(sample.Time, sample.Value))
+		}
+		data.Result = append(data.Result, out)
+	}
+	writePromData(w, data)
+}
+
+// promSeries returns the label sets of the series matching the match[]
+// parameters, or every series without them, within start and end if set
+func (s *Server) promSeries(w http.ResponseWriter, r *http.Request) ([]map[string]string, bool) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return nil, false
+	}
+	if err := r.ParseForm(); err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return nil, false
+	}
+
+	var selectors []promql.Selector
+	for _, v := range r.Form["match[]"] {
+		sel, err := promql.ParseSelector(v)
+		if err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err)
+			return nil, false
+		}
+		selectors = append(selectors, sel)
+	}
+	query := models.MetricQuery{
+		Match: func(m models.Metric) bool {
+			if len(selectors) == 0 {
+				return true
+			}
+			labels := promql.MetricLabels(m)
+			for _, sel := range selectors {
+				if sel.Matches(labels) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	var err error
+	if v := r.FormValue("start"); v != "" {
+		if query.StartTime, err = parsePromTime("start", v); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err)
+			return nil, false
+		}
+	}
+	if v := r.FormValue("end"); v != "" {
+		if query.EndTime, err = parsePromTime("end", v); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err)
+			return nil, false
+		}
+	}
+
+	series, err := s.stores.Metrics(tenant).Series(query)
+	if err != nil {
+		writePromError(w, http.StatusInternalServerError, "internal", err)
+		return nil, false
+	}
+	labelSets := make([]map[string]string, 0, len(series))
+	for _, entry := range series {
+		labelSets = append(labelSets, promql.Labels(entry.Name, entry.Service, entry.Labels))
+	}
+	return labelSets, true
+}
+
+// handlePromSeries serves /api/v1/series?match[]=
+func (s *Server) handlePromSeries(w http.ResponseWriter, r *http.Request) {
+	labelSets, ok := s.promSeries(w, r)
+	if !ok {
+		return
+	}
+	writePromData(w, labelSets)
+}
+
+// handlePromLabels serves /api/v1/labels, the label names in use
+func (s *Server) handlePromLabels(w http.ResponseWriter, r *http.Request) {
+	labelSets, ok := s.promSeries(w, r)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, labels := range labelSets {
+		for name := range labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	writePromData(w, names)
+}
+
+// handlePromLabelValues serves /api/v1/label/{name}/values
+func (s *Server) handlePromLabelValues(w http.ResponseWriter, r *http.Request) {
+	labelSets, ok := s.promSeries(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	seen := make(map[string]bool)
+	values := []string{}
+	for _, labels := range labelSets {
+		if v, ok := labels[name]; ok && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	writePromData(w, values)
+}
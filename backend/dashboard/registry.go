@@ -0,0 +1,103 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// handleServiceRegistry lists the metadata of every registered service
+func (s *Server) handleServiceRegistry(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.ServiceRegistry(tenant).List())
+}
+
+// handleServiceMetadata returns the metadata registered for a service
+func (s *Server) handleServiceMetadata(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	m, ok := s.stores.ServiceRegistry(tenant).Get(r.PathValue("service"))
+	if !ok {
+		http.Error(w, "Service not registered", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// handleSetServiceMetadata registers a service's metadata, e.g. {"team":
+// "payments", "repo": "https://github.com/acme/checkout", "runbook":
+// "https://wiki.acme.dev/checkout", "tier": "1"}, replacing any earlier
+// entry
+func (s *Server) handleSetServiceMetadata(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	var m models.ServiceMetadata
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&m); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	m.Service = r.PathValue("service")
+
+	registered, err := s.stores.ServiceRegistry(tenant).Set(m)
+	if errors.Is(err, storage.ErrInvalidServiceMetadata) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(registered)
+}
+
+// handleDeleteServiceMetadata removes a service from the registry
+func (s *Server) handleDeleteServiceMetadata(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := s.stores.ServiceRegistry(tenant).Delete(r.PathValue("service"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Service not registered", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serviceInfos joins services seen in spans with their registry entries
+func (s *Server) serviceInfos(tenant string, services []string) []models.ServiceInfo {
+	registry := s.stores.ServiceRegistry(tenant)
+	infos := make([]models.ServiceInfo, 0, len(services))
+	for _, service := range services {
+		info := models.ServiceInfo{Name: service}
+		if m, ok := registry.Get(service); ok {
+			info.Metadata = &m
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,215 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/omnitrace/omnitrace/backend/auth"
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/backend/traceql"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// searchRequest is the body of a save search request. The owner is only
+// taken from it when auth is disabled; otherwise it is the logged-in user
+// or token.
+type searchRequest struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	Owner string `json:"owner"`
+	Team  string `json:"team"`
+}
+
+// handleSavedSearches lists saved searches by name. Parameters: owner and
+// team, either of which a search must match when given.
+func (s *Server) handleSavedSearches(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.Searches(tenant).List(q.Get("owner"), q.Get("team")))
+}
+
+// handleSaveSearch saves a named trace search, e.g. {"name": "Payment
+// errors > 2s", "query": "service=payments&error=true&minDuration=2s",
+// "team": "payments"}
+func (s *Server) handleSaveSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	var req searchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	query, err := normalizeSearchQuery(req.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	owner := req.Owner
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok {
+		owner = p.Name
+	}
+	if owner == "" {
+		owner = "anonymous"
+	}
+
+	saved, err := s.stores.Searches(tenant).Save(models.SavedSearch{
+		Name:  req.Name,
+		Query: query,
+		Owner: owner,
+		Team:  req.Team,
+	})
+	if errors.Is(err, storage.ErrInvalidSearch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, storage.ErrSearchLimit) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// handleDeleteSearch deletes a saved search. With auth enabled, only its
+// owner and admins may.
+func (s *Server) handleDeleteSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	searches := s.stores.Searches(tenant)
+	search, ok := searches.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Search not found", http.StatusNotFound)
+		return
+	}
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok && !p.Admin && p.Name != search.Owner {
+		http.Error(w, "Only the owner may delete a search", http.StatusForbidden)
+		return
+	}
+
+	deleted, err := searches.Delete(search.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Search not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateLink returns the short link of a trace search, e.g.
+// {"query": "service=payments&error=true"}, creating it if needed
+func (s *Server) handleCreateLink(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	var req searchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	query, err := normalizeSearchQuery(req.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	link, err := s.stores.Searches(tenant).Link(query)
+	if errors.Is(err, storage.ErrInvalidSearch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": link.ID, "query": link.Query, "url": "/s/" + link.ID})
+}
+
+// handleLink returns a short link's query
+func (s *Server) handleLink(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	link, ok := s.stores.Searches(tenant).ResolveLink(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
+}
+
+// handleFollowLink redirects a short link to its search
+func (s *Server) handleFollowLink(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	link, ok := s.stores.Searches(tenant).ResolveLink(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, searchPath(link.Query), http.StatusFound)
+}
+
+// normalizeSearchQuery checks that a search query is one /api/traces or
+// /api/query accepts, and returns it with its parameters sorted so that
+// equal searches get the same link. Cursors are dropped: they only mean
+// something while their results are stored.
+func normalizeSearchQuery(raw string) (string, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(raw, "?"))
+	if err != nil {
+		return "", errors.New("invalid query: " + err.Error())
+	}
+	values.Del("cursor")
+	if q := values.Get("q"); q != "" {
+		if _, err := traceql.Parse(q); err != nil {
+			return "", errors.New("invalid query: " + err.Error())
+		}
+	}
+	query := values.Encode()
+	if _, err := parseTraceQuery(&http.Request{URL: &url.URL{RawQuery: query}}); err != nil {
+		return "", err
+	}
+	return query, nil
+}
+
+// searchPath is the API path running a search query
+func searchPath(query string) string {
+	if values, _ := url.ParseQuery(query); values.Has("q") {
+		return "/api/query?" + query
+	}
+	return "/api/traces?" + query
+}
@@ -2,114 +2,549 @@ package dashboard
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/omnitrace/omnitrace/backend/alerting"
+	"github.com/omnitrace/omnitrace/backend/archive"
+	"github.com/omnitrace/omnitrace/backend/auth"
+	"github.com/omnitrace/omnitrace/backend/cluster"
+	"github.com/omnitrace/omnitrace/backend/history"
+	"github.com/omnitrace/omnitrace/backend/ingestion"
+	"github.com/omnitrace/omnitrace/backend/slo"
 	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/backend/tail"
+	"github.com/omnitrace/omnitrace/backend/telemetry"
+	"github.com/omnitrace/omnitrace/backend/traceql"
 	"github.com/omnitrace/omnitrace/internal/models"
 )
 
+// errTraceNotFound is returned when a trace is in neither storage nor the
+// archive
+var errTraceNotFound = errors.New("Trace not found")
+
+// maxTimeBuckets caps the number of time buckets a stats query may return
+const maxTimeBuckets = 11000
+
 // Server serves the dashboard UI and API
 type Server struct {
-	spanStore   *storage.SpanStore
-	metricStore *storage.MetricStore
-	staticDir   string
+	stores        *storage.TenantStores
+	staticDir     string
+	requireTenant bool
+	archive       *archive.Archiver
+	history       *history.History
+	tail          *tail.Hub
+	tailMaxRate   int
+	telemetry     *telemetry.Registry
+	alerts        *alerting.Engine
+	slos          *slo.Tracker
+	auth          *auth.Authenticator
+	cluster       *cluster.Client
+	quotas        *ingestion.Quotas
+	// shutdown is closed to end the live tail streams
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// ServerOption is a function that configures a Server
+type ServerOption func(*Server)
+
+// WithRequireTenant rejects queries that don't name a tenant instead of
+// falling back to the default tenant
+func WithRequireTenant(require bool) ServerOption {
+	return func(s *Server) {
+		s.requireTenant = require
+	}
+}
+
+// WithArchive serves traces that are no longer in hot storage from the
+// archive
+func WithArchive(a *archive.Archiver) ServerOption {
+	return func(s *Server) {
+		s.archive = a
+	}
+}
+
+// WithHistory serves the summaries and operation statistics of compacted
+// traces
+func WithHistory(h *history.History) ServerOption {
+	return func(s *Server) {
+		s.history = h
+	}
+}
+
+// WithLiveTail serves live tails of new traces from h, each connection
+// capped at maxRate traces per second
+func WithLiveTail(h *tail.Hub, maxRate int) ServerOption {
+	return func(s *Server) {
+		s.tail = h
+		if maxRate > 0 {
+			s.tailMaxRate = maxRate
+		}
+	}
+}
+
+// WithTelemetry records the latency of API requests in reg
+func WithTelemetry(reg *telemetry.Registry) ServerOption {
+	return func(s *Server) {
+		s.telemetry = reg
+	}
+}
+
+// WithAlerts serves the alerts and rules of an alerting engine
+func WithAlerts(e *alerting.Engine) ServerOption {
+	return func(s *Server) {
+		s.alerts = e
+	}
+}
+
+// WithSLOs serves the SLOs of a tracker
+func WithSLOs(t *slo.Tracker) ServerOption {
+	return func(s *Server) {
+		s.slos = t
+	}
+}
+
+// WithAuth requires a logged-in user for the UI and API
+func WithAuth(a *auth.Authenticator) ServerOption {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithCluster serves a cluster frontend, whose span storage reads from
+// the shards, with the service graph the shards build
+func WithCluster(c *cluster.Client) ServerOption {
+	return func(s *Server) {
+		s.cluster = c
+	}
+}
+
+// WithQuotas serves the ingest usage and quotas of each tenant on the
+// admin API
+func WithQuotas(q *ingestion.Quotas) ServerOption {
+	return func(s *Server) {
+		s.quotas = q
+	}
 }
 
 // NewServer creates a new dashboard server
-func NewServer(spanStore *storage.SpanStore, metricStore *storage.MetricStore, staticDir string) *Server {
-	return &Server{
-		spanStore:   spanStore,
-		metricStore: metricStore,
+func NewServer(stores *storage.TenantStores, staticDir string, opts ...ServerOption) *Server {
+	s := &Server{
+		stores:      stores,
 		staticDir:   staticDir,
+		tailMaxRate: defaultTailMaxRate,
+		shutdown:    make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Shutdown ends the live tail streams, which would otherwise hold a
+// graceful server shutdown open. Other requests are left to finish.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
 }
 
 // RegisterRoutes registers the dashboard routes
 func (s *Server) RegisterRoutes(mux *http.ServeMux) {
 	// API routes
-	mux.HandleFunc("/api/traces", s.handleTraces)
-	mux.HandleFunc("/api/traces/", s.handleTraceDetail) // Matches /api/traces/{id}
-	mux.HandleFunc("/api/metrics", s.handleMetrics)
-	mux.HandleFunc("/api/services", s.handleServices)
+	s.route(mux, "/api/traces", s.handleTraces)
+	s.route(mux, "/api/traces/", s.handleTraceDetail) // Matches /api/traces/{id}
+	// Streams are long-lived, so they aren't timed
+	mux.HandleFunc("/api/traces/stream", s.authenticated(s.handleTraceStream))
+	s.route(mux, "GET /api/traces/pinned", s.handlePinnedTraces)
+	s.route(mux, "GET /api/traces/top", s.handleTopTraces)
+	s.route(mux, "POST /api/traces/{id}/pin", s.handlePinTrace)
+	s.route(mux, "DELETE /api/traces/{id}/pin", s.handleUnpinTrace)
+	s.route(mux, "GET /api/traces/{id}/annotations", s.handleTraceAnnotations)
+	s.route(mux, "POST /api/traces/{id}/annotations", s.handleAnnotateTrace)
+	s.route(mux, "GET /api/traces/{id}/criticalpath", s.handleCriticalPath)
+	s.route(mux, "/api/query", s.handleQuery)
+	s.route(mux, "/api/metrics", s.handleMetrics)
+	s.route(mux, "/api/metrics/series", s.handleMetricSeries)
+	s.route(mux, "/api/metrics/cardinality", s.handleMetricCardinality)
+	s.route(mux, "/api/services", s.handleServices)
+	s.route(mux, "/api/services/", s.handleServiceOperations) // Matches /api/services/{name}/operations
+	s.route(mux, "GET /api/services/metadata", s.handleServiceRegistry)
+	s.route(mux, "GET /api/services/{service}/metadata", s.handleServiceMetadata)
+	s.route(mux, "PUT /api/services/{service}/metadata", s.handleSetServiceMetadata)
+	s.route(mux, "DELETE /api/services/{service}/metadata", s.handleDeleteServiceMetadata)
+	s.route(mux, "/api/servicegraph", s.handleServiceGraph)
+	s.route(mux, "/api/stats/latency", s.handleLatencyStats)
+	s.route(mux, "/api/stats/breakdown", s.handleLatencyBreakdown)
+	s.route(mux, "/api/stats/operations", s.handleOperationStats)
+	s.route(mux, "/api/stats/errors", s.handleErrorStats)
+	s.route(mux, "/api/flamegraph", s.handleFlamegraph)
+	s.route(mux, "/api/errors", s.handleErrorGroups)
+	s.route(mux, "/api/errors/events", s.handleErrorEvents)
+	s.route(mux, "GET /api/tags/keys", s.handleTagKeys)
+	s.route(mux, "GET /api/tags/values", s.handleTagValues)
+	s.route(mux, "GET /api/alerts", s.handleAlerts)
+	s.route(mux, "GET /api/alerts/rules", s.handleAlertRules)
+	s.route(mux, "GET /api/alerts/silences", s.handleSilences)
+	s.route(mux, "POST /api/alerts/silences", s.handleCreateSilence)
+	s.route(mux, "DELETE /api/alerts/silences/{id}", s.handleExpireSilence)
+	s.route(mux, "GET /api/searches", s.handleSavedSearches)
+	s.route(mux, "POST /api/searches", s.handleSaveSearch)
+	s.route(mux, "DELETE /api/searches/{id}", s.handleDeleteSearch)
+	s.route(mux, "POST /api/links", s.handleCreateLink)
+	s.route(mux, "GET /api/links/{id}", s.handleLink)
+	s.route(mux, "GET /s/{id}", s.handleFollowLink)
+	s.route(mux, "GET /api/deployments", s.handleDeployments)
+	s.route(mux, "POST /api/deployments", s.handleRecordDeployment)
+	s.route(mux, "GET /api/slos", s.handleSLOs)
+	s.route(mux, "POST /api/slos", s.handleCreateSLO)
+	s.route(mux, "GET /api/slos/{name}", s.handleSLO)
+	s.route(mux, "DELETE /api/slos/{name}", s.handleDeleteSLO)
+	s.route(mux, "GET /api/export", s.handleExport)
+	s.route(mux, "GET /api/history/traces", s.handleHistoryTraces)
+	s.route(mux, "GET /api/history/operations", s.handleHistoryOperations)
+
+	// Prometheus HTTP API, for Grafana's Prometheus data source
+	s.route(mux, "/api/v1/query", s.handlePromQuery)
+	s.route(mux, "/api/v1/query_range", s.handlePromQueryRange)
+	s.route(mux, "/api/v1/series", s.handlePromSeries)
+	s.route(mux, "/api/v1/labels", s.handlePromLabels)
+	s.route(mux, "/api/v1/label/{name}/values", s.handlePromLabelValues)
+
+	// Storage administration, for admins
+	s.adminRoute(mux, "GET /api/admin/storage", s.handleStorageStats)
+	s.adminRoute(mux, "DELETE /api/admin/storage/traces/{id}", s.handleDeleteTrace)
+	s.adminRoute(mux, "DELETE /api/admin/storage/services/{name}", s.handleDeleteService)
+	s.adminRoute(mux, "POST /api/admin/storage/compact", s.handleCompact)
+	s.adminRoute(mux, "GET /api/admin/usage", s.handleUsage)
+
+	// Jaeger query API, for the Jaeger UI and Grafana's Jaeger data source
+	s.route(mux, "GET /jaeger/api/services", s.handleJaegerServices)
+	s.route(mux, "GET /jaeger/api/services/{service}/operations", s.handleJaegerServiceOperations)
+	s.route(mux, "GET /jaeger/api/operations", s.handleJaegerOperations)
+	s.route(mux, "GET /jaeger/api/traces", s.handleJaegerTraces)
+	s.route(mux, "GET /jaeger/api/traces/{id}", s.handleJaegerTrace)
+
+	// Tempo API, for Grafana's Tempo data source
+	s.route(mux, "GET /tempo/api/echo", s.handleTempoEcho)
+	s.route(mux, "GET /tempo/api/search", s.handleTempoSearch)
+	s.route(mux, "GET /tempo/api/traces/{id}", s.handleTempoTrace)
+	s.route(mux, "GET /tempo/api/search/tags", s.handleTempoTags)
+	s.route(mux, "GET /tempo/api/search/tag/{name}/values", s.handleTempoTagValues)
+	s.route(mux, "GET /tempo/api/v2/search/tags", s.handleTempoTagsV2)
+	s.route(mux, "GET /tempo/api/v2/search/tag/{name}/values", s.handleTempoTagValuesV2)
+
+	// Zipkin API v2, for tools built against Zipkin
+	s.route(mux, "GET /zipkin/api/v2/services", s.handleZipkinServices)
+	s.route(mux, "GET /zipkin/api/v2/spans", s.handleZipkinSpanNames)
+	s.route(mux, "GET /zipkin/api/v2/remoteServices", s.handleZipkinRemoteServices)
+	s.route(mux, "GET /zipkin/api/v2/traces", s.handleZipkinTraces)
+	s.route(mux, "GET /zipkin/api/v2/trace/{id}", s.handleZipkinTrace)
+	s.route(mux, "GET /zipkin/api/v2/traceMany", s.handleZipkinTraceMany)
+	s.route(mux, "GET /zipkin/api/v2/dependencies", s.handleZipkinDependencies)
 
 	// Static files
 	fs := http.FileServer(http.Dir(s.staticDir))
-	mux.Handle("/", fs)
+	mux.HandleFunc("/", s.authenticated(fs.ServeHTTP))
+	if s.auth != nil {
+		s.auth.RegisterRoutes(mux)
+	}
+}
+
+// RegisterShardRoutes registers the shard API, which cluster frontends and
+// query collectors read this collector's spans through
+func (s *Server) RegisterShardRoutes(mux *http.ServeMux) {
+	s.route(mux, "POST /api/cluster/traces/search", s.handleClusterSearch)
+	s.route(mux, "POST /api/cluster/traces/count", s.handleClusterCount)
+	s.route(mux, "GET /api/cluster/traces/{id}", s.handleClusterTrace)
+	s.route(mux, "GET /api/cluster/services", s.handleClusterServices)
+	s.route(mux, "GET /api/cluster/services/{service}/operations", s.handleClusterOperations)
+	s.route(mux, "POST /api/cluster/stats/latency", s.handleClusterLatency)
+	s.route(mux, "POST /api/cluster/stats/operations", s.handleClusterOperationStats)
+	s.route(mux, "POST /api/cluster/tags/keys", s.handleClusterTagKeys)
+	s.route(mux, "POST /api/cluster/tags/values", s.handleClusterTagValues)
+	s.route(mux, "GET /api/cluster/servicegraph", s.handleClusterServiceGraph)
+}
+
+// route registers an API handler, timed when telemetry is enabled
+func (s *Server) route(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+	h = s.authenticated(h)
+	if s.telemetry != nil {
+		h = s.telemetry.Instrument(pattern, h)
+	}
+	mux.HandleFunc(pattern, h)
+}
+
+// authenticated requires a logged-in user for h when auth is enabled
+func (s *Server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	if s.auth == nil {
+		return h
+	}
+	return s.auth.RequireFunc(h)
 }
 
 func (s *Server) handleTraces(w http.ResponseWriter, r *http.Request) {
-	query := models.TraceQuery{
-		Limit:  50,
-		Offset: 0,
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
 	}
 
-	// Parse query params
-	if limit := r.URL.Query().Get("limit"); limit != "" {
-		if l, err := strconv.Atoi(limit); err == nil {
-			query.Limit = l
-		}
+	query, err := parseTraceQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if service := r.URL.Query().Get("service"); service != "" {
-		query.Service = service
+	query.Text = r.URL.Query().Get("q")
+	s.writeTraceList(w, tenant, query)
+}
+
+// writeTraceList runs a trace search and writes a page of its results
+func (s *Server) writeTraceList(w http.ResponseWriter, tenant string, query models.TraceQuery) {
+	spans := s.stores.Spans(tenant)
+	summaries, err := spans.QueryTraces(pageQuery(query))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total, err := spans.CountTraces(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newTraceList(query, summaries, total))
+}
+
+// handleTopTraces returns the slowest traces, or the traces with the most
+// error spans, from the trace index. Parameters: by=duration (default) or
+// errors, service, range, the lookback (default 1h; start and end also
+// work), and limit (default 10).
+func (s *Server) handleTopTraces(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
 	}
-	if operation := r.URL.Query().Get("operation"); operation != "" {
-		query.Operation = operation
+
+	q := r.URL.Query()
+	query := models.TraceQuery{Service: q.Get("service"), Limit: defaultTopTraces}
+	switch by := q.Get("by"); by {
+	case "", "duration":
+		query.SortBy = models.TraceSortDuration
+	case "errors":
+		hasError := true
+		query.SortBy = models.TraceSortErrorCount
+		query.HasError = &hasError
+	default:
+		http.Error(w, "invalid by "+strconv.Quote(by)+": want duration or errors", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if query.StartTime, query.EndTime, err = parseRange(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if hasError := r.URL.Query().Get("error"); hasError != "" {
-		val := hasError == "true"
-		query.HasError = &val
+	if v := q.Get("limit"); v != "" {
+		n, err := parseCount("limit", v)
+		if err != nil || n == 0 {
+			http.Error(w, "invalid limit "+strconv.Quote(v)+": want a positive integer", http.StatusBadRequest)
+			return
+		}
+		query.Limit = min(n, maxTopTraces)
 	}
-	// Time range params parsing omitted for brevity
 
-	summaries, err := s.spanStore.QueryTraces(query)
+	summaries, err := s.stores.Spans(tenant).QueryTraces(query)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if summaries == nil {
+		summaries = []models.TraceSummary{}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(summaries)
+	json.NewEncoder(w).Encode(map[string]any{"traces": summaries})
+}
+
+// handleQuery searches traces with a query language expression in the "q"
+// parameter, e.g. {service="checkout" && duration>500ms}
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+	parsed, err := traceql.Parse(q)
+	if err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	base, err := parseTraceQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.writeTraceList(w, tenant, parsed.Plan(base))
 }
 
 func (s *Server) handleTraceDetail(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
 	traceID := filepath.Base(r.URL.Path)
 	if traceID == "" || traceID == "traces" {
 		http.Error(w, "Missing trace ID", http.StatusBadRequest)
 		return
 	}
 
-	trace, err := s.spanStore.GetTrace(traceID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	trace, ok := s.findTrace(w, tenant, traceID)
+	if !ok {
 		return
 	}
-	if trace == nil {
-		http.Error(w, "Trace not found", http.StatusNotFound)
+	annotated := *trace
+	annotated.Annotations = s.stores.Annotations(tenant).Trace(trace.TraceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotated)
+}
+
+// handleCriticalPath returns the critical path of a trace: the spans that
+// determine its end-to-end latency, with each one's contribution
+func (s *Server) handleCriticalPath(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	trace, ok := s.findTrace(w, tenant, r.PathValue("id"))
+	if !ok {
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(trace)
+	json.NewEncoder(w).Encode(trace.CriticalPath())
 }
 
+// findTrace looks a trace up in hot storage, then the pinned traces, then
+// the archive. If it isn't found, it writes the error response and
+// returns false.
+func (s *Server) findTrace(w http.ResponseWriter, tenant, traceID string) (*models.Trace, bool) {
+	trace, status, err := s.lookupTrace(tenant, traceID)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+	return trace, true
+}
+
+// lookupTrace looks a trace up in hot storage, then the pinned traces, then
+// the archive. On failure it returns the status code of the error. A
+// malformed trace ID can't match a trace, so it isn't found either.
+func (s *Server) lookupTrace(tenant, id string) (*models.Trace, int, error) {
+	traceID, err := models.ParseTraceID(id)
+	if err != nil {
+		return nil, http.StatusNotFound, errTraceNotFound
+	}
+	trace, err := s.stores.Spans(tenant).GetTrace(traceID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if trace == nil {
+		trace = s.stores.Pins(tenant).GetTrace(traceID)
+	}
+	if trace == nil && s.archive != nil {
+		trace, err = s.archive.GetTrace(tenant, traceID)
+		if err != nil {
+			return nil, http.StatusBadGateway, err
+		}
+	}
+	if trace == nil {
+		return nil, http.StatusNotFound, errTraceNotFound
+	}
+	return trace, http.StatusOK, nil
+}
+
+// handleMetrics returns a metric aggregated per time bucket. Parameters:
+// name (required), service, label=name=value (repeatable), start, end or
+// lookback, step, function (rate or increase, for counters) over window,
+// and groupBy, a comma separated list of labels to sum series by.
 func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
 	name := r.URL.Query().Get("name")
 	if name == "" {
 		http.Error(w, "Missing metric name", http.StatusBadRequest)
 		return
 	}
 
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	labels, err := parseLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
 	query := models.MetricQuery{
 		Name:      name,
-		StartTime: time.Now().Add(-1 * time.Hour),
-		EndTime:   time.Now(),
+		Labels:    labels,
+		Service:   q.Get("service"),
+		StartTime: start,
+		EndTime:   end,
 		Step:      time.Minute,
+		Function:  q.Get("function"),
+	}
+	if step := q.Get("step"); step != "" {
+		d, err := time.ParseDuration(step)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid step", http.StatusBadRequest)
+			return
+		}
+		query.Step = d
+	}
+	if end.Sub(start)/query.Step > maxTimeBuckets {
+		http.Error(w, "Step too small for time range", http.StatusBadRequest)
+		return
+	}
+	switch query.Function {
+	case "", models.MetricFunctionRate, models.MetricFunctionIncrease:
+	default:
+		http.Error(w, "Invalid function", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("window"); v != "" {
+		if query.Window, err = parseDuration("window", v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("groupBy"); v != "" {
+		query.GroupBy = strings.Split(v, ",")
 	}
 
-	metrics, err := s.metricStore.QueryMetrics(query)
+	metrics, err := s.stores.Metrics(tenant).QueryMetrics(query)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -119,11 +554,368 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(metrics)
 }
 
+// handleMetricSeries lists the stored metric series. Parameters: name,
+// service and label=name=value (repeatable) filter the series; start, end
+// or lookback keep those with points in that range.
+func (s *Server) handleMetricSeries(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	labels, err := parseLabels(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	query := models.MetricQuery{
+		Name:    q.Get("name"),
+		Service: q.Get("service"),
+		Labels:  labels,
+	}
+	if q.Get("start") != "" || q.Get("end") != "" || q.Get("lookback") != "" {
+		if query.StartTime, query.EndTime, err = parseTimeRange(r, time.Hour); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	series, err := s.stores.Metrics(tenant).Series(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// handleMetricCardinality reports the metrics and services with the most
+// series, and each metric's labels with the most values. top limits each
+// list (default 20).
+func (s *Server) handleMetricCardinality(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	top := 20
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := parseCount("top", v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stores.Metrics(tenant).Cardinality(top))
+}
+
 func (s *Server) handleServices(w http.ResponseWriter, r *http.Request) {
-	// In a real implementation this would aggregate from storage
-	// For now returns a stub or simple list
-	services := []string{"demo-service", "auth-service", "db-service"}
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	services := s.stores.Spans(tenant).Services()
 
 	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("metadata") == "true" {
+		json.NewEncoder(w).Encode(s.serviceInfos(tenant, services))
+		return
+	}
 	json.NewEncoder(w).Encode(services)
 }
+
+func (s *Server) handleServiceOperations(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/services/")
+	service, ok := strings.CutSuffix(rest, "/operations")
+	if !ok || service == "" || strings.Contains(service, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	operations := s.stores.Spans(tenant).Operations(service)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(operations)
+}
+
+func (s *Server) handleServiceGraph(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	graph, err := s.serviceGraph(tenant, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	registry := s.stores.ServiceRegistry(tenant)
+	for i := range graph.Nodes {
+		if m, ok := registry.Get(graph.Nodes[i].Name); ok {
+			graph.Nodes[i].Metadata = &m
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(graph)
+}
+
+func (s *Server) handleLatencyStats(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := models.LatencyQuery{
+		Service:   r.URL.Query().Get("service"),
+		Operation: r.URL.Query().Get("operation"),
+		StartTime: start,
+		EndTime:   end,
+		Step:      time.Minute,
+	}
+	if step := r.URL.Query().Get("step"); step != "" {
+		d, err := time.ParseDuration(step)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid step", http.StatusBadRequest)
+			return
+		}
+		query.Step = d
+	}
+	if end.Sub(start)/query.Step > maxTimeBuckets {
+		http.Error(w, "Step too small for time range", http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := s.stores.Spans(tenant).LatencyPercentiles(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
+
+// handleErrorStats returns the span count, errors and error rate per time
+// bucket, from the span statuses. Parameters: service, operation, range,
+// the lookback (default 1h; start and end also work), and step (default
+// 1m).
+func (s *Server) handleErrorStats(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	start, end, err := parseRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := models.LatencyQuery{
+		Service:   r.URL.Query().Get("service"),
+		Operation: r.URL.Query().Get("operation"),
+		StartTime: start,
+		EndTime:   end,
+		Step:      time.Minute,
+	}
+	if step := r.URL.Query().Get("step"); step != "" {
+		d, err := time.ParseDuration(step)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid step", http.StatusBadRequest)
+			return
+		}
+		query.Step = d
+	}
+	if end.Sub(start)/query.Step > maxTimeBuckets {
+		http.Error(w, "Step too small for time range", http.StatusBadRequest)
+		return
+	}
+
+	// The latency buckets already count spans and errors
+	latency, err := s.stores.Spans(tenant).LatencyPercentiles(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buckets := make([]models.ErrorRateBucket, len(latency))
+	for i, b := range latency {
+		buckets[i] = models.ErrorRateBucket{StartTime: b.StartTime, Count: b.Count, Errors: b.Errors}
+		if b.Count > 0 {
+			buckets[i].ErrorRate = float64(b.Errors) / float64(b.Count)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
+
+// handleOperationStats returns the request rate, errors and latency
+// percentiles of each operation of a service. Parameters: service
+// (required) and range, the lookback (default 1h; start and end also
+// work).
+func (s *Server) handleOperationStats(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	service := q.Get("service")
+	if service == "" {
+		http.Error(w, "service is required", http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	operations, err := s.stores.Spans(tenant).OperationSummaries(models.OperationSummaryQuery{
+		Service:   service,
+		StartTime: start,
+		EndTime:   end,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(operations)
+}
+
+// handleLatencyBreakdown attributes a service's average request latency
+// per time bucket to the services it calls, for stacked charts.
+// Parameters: service (required), operation, start, end or lookback,
+// step, and limit, the number of recent traces to sample.
+func (s *Server) handleLatencyBreakdown(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	service := r.URL.Query().Get("service")
+	if service == "" {
+		http.Error(w, "service is required", http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseSampleLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := models.LatencyBreakdownQuery{
+		Service:   service,
+		Operation: r.URL.Query().Get("operation"),
+		StartTime: start,
+		EndTime:   end,
+		Step:      time.Minute,
+		MaxTraces: limit,
+	}
+	if step := r.URL.Query().Get("step"); step != "" {
+		d, err := time.ParseDuration(step)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid step", http.StatusBadRequest)
+			return
+		}
+		query.Step = d
+	}
+	if end.Sub(start)/query.Step > maxTimeBuckets {
+		http.Error(w, "Step too small for time range", http.StatusBadRequest)
+		return
+	}
+
+	breakdown, err := storage.BuildLatencyBreakdown(s.stores.Spans(tenant), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breakdown)
+}
+
+func (s *Server) handleErrorEvents(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	query := models.ErrorEventQuery{
+		Service:  r.URL.Query().Get("service"),
+		Severity: r.URL.Query().Get("severity"),
+		Limit:    100,
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		if l, err := strconv.Atoi(limit); err == nil {
+			query.Limit = l
+		}
+	}
+
+	events, err := s.stores.Errors(tenant).QueryErrors(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func (s *Server) handleErrorGroups(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	query := models.ErrorGroupQuery{
+		Service: r.URL.Query().Get("service"),
+		SortBy:  r.URL.Query().Get("sort"),
+		Limit:   100,
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		if l, err := strconv.Atoi(limit); err == nil {
+			query.Limit = l
+		}
+	}
+
+	groups, err := s.stores.Errors(tenant).QueryGroups(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
@@ -0,0 +1,105 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/slo"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// handleSLOs lists the status of the tenant's SLOs
+func (s *Server) handleSLOs(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.slos == nil {
+		http.Error(w, "SLO tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.slos.List(tenant, time.Now()))
+}
+
+// handleCreateSLO starts tracking an SLO, e.g. {"name": "checkout-latency",
+// "service": "checkout", "type": "latency", "threshold": "500ms",
+// "objective": 0.99, "window": "720h"}
+func (s *Server) handleCreateSLO(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.slos == nil {
+		http.Error(w, "SLO tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var def models.SLO
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&def); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	def.Tenant = tenant
+
+	created, err := s.slos.Add(def)
+	if errors.Is(err, slo.ErrSLOExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// handleSLO returns an SLO's SLI, remaining error budget and burn rates
+func (s *Server) handleSLO(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.slos == nil {
+		http.Error(w, "SLO tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	status, err := s.slos.Get(tenant, r.PathValue("name"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleDeleteSLO stops tracking an SLO
+func (s *Server) handleDeleteSLO(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.slos == nil {
+		http.Error(w, "SLO tracking is not enabled", http.StatusNotFound)
+		return
+	}
+
+	err := s.slos.Delete(tenant, r.PathValue("name"))
+	if errors.Is(err, slo.ErrSLONotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
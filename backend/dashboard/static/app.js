@@ -36,7 +36,7 @@ async function loadTraces() {
 
     try {
         const response = await fetch('/api/traces?limit=20');
-        const traces = await response.json();
+        const { traces } = await response.json();
 
         list.innerHTML = '';
         if (!traces || traces.length === 0) {
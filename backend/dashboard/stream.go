@@ -0,0 +1,147 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Live tail pacing: summaries go out once per tick, at most the
+// connection's rate per tick
+const (
+	tailTick           = time.Second
+	tailHeartbeat      = 15 * time.Second
+	defaultTailRate    = 10
+	defaultTailMaxRate = 50
+	// tailPendingFactor times the rate is how many traces may wait for
+	// the filter between ticks
+	tailPendingFactor = 10
+)
+
+// tailFilter selects the traces a live tail connection receives
+type tailFilter struct {
+	service     string
+	errorsOnly  bool
+	minDuration time.Duration
+}
+
+func (f tailFilter) match(trace *models.Trace) bool {
+	if f.service != "" && !slices.Contains(trace.Services, f.service) {
+		return false
+	}
+	if f.errorsOnly && !trace.HasError {
+		return false
+	}
+	return trace.Duration >= f.minDuration
+}
+
+// handleTraceStream streams summaries of traces as they receive new spans,
+// as server-sent events. A trace is sent again when more of its spans
+// arrive, so clients should update traces by ID. Parameters: service,
+// error=true, minDuration, and rate, the maximum traces per second (capped
+// by the server). When a client falls behind, a "dropped" event reports
+// how many notifications were discarded.
+func (s *Server) handleTraceStream(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+	if s.tail == nil {
+		http.Error(w, "Live tail is not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := tailFilter{service: q.Get("service")}
+	if v := q.Get("error"); v != "" {
+		errorsOnly, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid error %q: want true or false", v), http.StatusBadRequest)
+			return
+		}
+		filter.errorsOnly = errorsOnly
+	}
+	if v := q.Get("minDuration"); v != "" {
+		d, err := parseDuration("minDuration", v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.minDuration = d
+	}
+	rate := defaultTailRate
+	if v := q.Get("rate"); v != "" {
+		n, err := parseCount("rate", v)
+		if err != nil || n == 0 {
+			http.Error(w, fmt.Sprintf("invalid rate %q: want a positive integer", v), http.StatusBadRequest)
+			return
+		}
+		rate = n
+	}
+	rate = min(rate, s.tailMaxRate)
+
+	// Streams outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sub := s.tail.Subscribe(tenant, rate*tailPendingFactor)
+	defer s.tail.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, ": connected\n\n")
+	if rc.Flush() != nil {
+		return
+	}
+
+	ticker := time.NewTicker(tailTick)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	spans := s.stores.Spans(tenant)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.shutdown:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-ticker.C:
+			traceIDs, dropped := sub.Take(0)
+			sent := 0
+			for _, traceID := range traceIDs {
+				trace, err := spans.GetTrace(traceID)
+				if err != nil || trace == nil || !filter.match(trace) {
+					continue
+				}
+				if sent >= rate {
+					dropped++
+					continue
+				}
+				data, err := json.Marshal(trace.ToSummary())
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: trace\ndata: %s\n\n", data)
+				sent++
+			}
+			if dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// defaultTagCompletions is how many tag keys or values are completed
+// without a limit
+const defaultTagCompletions = 50
+
+// handleTagKeys lists the tag keys of a service's spans, or of all spans,
+// by the number of traces carrying them, for autocompletion. Parameters:
+// service and limit (default 50).
+func (s *Server) handleTagKeys(w http.ResponseWriter, r *http.Request) {
+	query, ok := parseTagQuery(w, r)
+	if !ok {
+		return
+	}
+	s.writeTagCounts(w, r, query, storage.SpanReader.TagKeys)
+}
+
+// handleTagValues lists the values of a tag key by the number of traces
+// carrying them, for autocompletion. Parameters: key (required) and limit
+// (default 50).
+func (s *Server) handleTagValues(w http.ResponseWriter, r *http.Request) {
+	query, ok := parseTagQuery(w, r)
+	if !ok {
+		return
+	}
+	if query.Key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	s.writeTagCounts(w, r, query, storage.SpanReader.TagValues)
+}
+
+func parseTagQuery(w http.ResponseWriter, r *http.Request) (models.TagQuery, bool) {
+	q := r.URL.Query()
+	query := models.TagQuery{Service: q.Get("service"), Key: q.Get("key"), Limit: defaultTagCompletions}
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if query.Limit, err = parseCount("limit", v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return query, false
+		}
+	}
+	return query, true
+}
+
+func (s *Server) writeTagCounts(w http.ResponseWriter, r *http.Request, query models.TagQuery, lookup func(storage.SpanReader, models.TagQuery) ([]models.TagCount, error)) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	counts, err := lookup(s.stores.Spans(tenant), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if counts == nil {
+		counts = []models.TagCount{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
@@ -0,0 +1,352 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/omnitrace/omnitrace/backend/traceql"
+	"github.com/omnitrace/omnitrace/internal/models"
+	"github.com/omnitrace/omnitrace/internal/otlp"
+)
+
+// tempoDefaultLimit is the number of traces a Tempo search returns when it
+// doesn't set a limit, as in Tempo
+const tempoDefaultLimit = 20
+
+// tempoTagSampleTraces is how many recent traces tag names and values are
+// collected from, as tags aren't indexed
+const tempoTagSampleTraces = 200
+
+// tempoIntrinsics are the span attributes TraceQL addresses without a scope
+var tempoIntrinsics = []string{"duration", "kind", "name", "status"}
+
+type tempoSearchResponse struct {
+	Traces  []tempoTraceSummary `json:"traces"`
+	Metrics tempoSearchMetrics  `json:"metrics"`
+}
+
+type tempoTraceSummary struct {
+	TraceID           string `json:"traceID"`
+	RootServiceName   string `json:"rootServiceName"`
+	RootTraceName     string `json:"rootTraceName"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	DurationMs        int64  `json:"durationMs"`
+}
+
+type tempoSearchMetrics struct {
+	InspectedTraces int `json:"inspectedTraces"`
+}
+
+type tempoTagScope struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+type tempoTagValue struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (s *Server) handleTempoEcho(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, "echo")
+}
+
+// handleTempoSearch searches traces with Tempo's parameters: a TraceQL
+// query in q or logfmt tags such as service.name=checkout, start and end
+// in Unix seconds, minDuration, maxDuration and limit
+func (s *Server) handleTempoSearch(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseTempoQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	summaries, err := s.stores.Spans(tenant).QueryTraces(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := tempoSearchResponse{
+		Traces:  make([]tempoTraceSummary, 0, len(summaries)),
+		Metrics: tempoSearchMetrics{InspectedTraces: len(summaries)},
+	}
+	for _, summary := range summaries {
+		resp.Traces = append(resp.Traces, tempoTraceSummary{
+			TraceID:           summary.TraceID.String(),
+			RootServiceName:   summary.RootService,
+			RootTraceName:     summary.RootOperation,
+			StartTimeUnixNano: strconv.FormatInt(summary.StartTime.UnixNano(), 10),
+			DurationMs:        summary.Duration.Milliseconds(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseTempoQuery reads the search parameters of the Tempo API
+func parseTempoQuery(r *http.Request) (models.TraceQuery, error) {
+	q := r.URL.Query()
+	query := models.TraceQuery{Limit: tempoDefaultLimit}
+
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if query.Limit, err = parseCount("limit", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("minDuration"); v != "" {
+		if query.MinDuration, err = parseDuration("minDuration", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("maxDuration"); v != "" {
+		if query.MaxDuration, err = parseDuration("maxDuration", v); err != nil {
+			return query, err
+		}
+	}
+	if query.StartTime, query.EndTime, err = parseTimeRange(r, time.Hour); err != nil {
+		return query, err
+	}
+
+	text := q.Get("q")
+	if text == "" && q.Get("tags") != "" {
+		if text, err = tempoTagsQuery(q.Get("tags")); err != nil {
+			return query, err
+		}
+	}
+	if text == "" {
+		return query, nil
+	}
+	parsed, err := traceql.Parse(text)
+	if err != nil {
+		return query, fmt.Errorf("invalid query: %w", err)
+	}
+	return parsed.Plan(query), nil
+}
+
+// tempoTagsQuery turns logfmt tags such as service.name=checkout
+// http.method="GET" into the equivalent TraceQL query
+func tempoTagsQuery(tags string) (string, error) {
+	var conds []string
+	for rest := strings.TrimSpace(tags); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \"") {
+			return "", fmt.Errorf("invalid tags %q: want key=value pairs", tags)
+		}
+		rest = value
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return "", fmt.Errorf("invalid tags %q: unterminated quote", tags)
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+
+		switch key {
+		case "service.name":
+			key = "resource.service.name"
+		case "name", "status":
+		default:
+			key = "span." + key
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+		conds = append(conds, key+`="`+value+`"`)
+	}
+	return "{" + strings.Join(conds, " && ") + "}", nil
+}
+
+// handleTempoTrace returns a trace as a Tempo trace: OTLP resource spans
+// called batches, in protobuf if the client accepts it, as Grafana does,
+// and in OTLP/JSON otherwise
+func (s *Server) handleTempoTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	trace, ok := s.findTrace(w, tenant, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	data := otlp.FromSpans(trace.Spans)
+	if strings.Contains(r.Header.Get("Accept"), "application/protobuf") {
+		// An export request has the same wire format as Tempo's trace,
+		// whose field 1 is also the resource spans
+		body, err := proto.Marshal(otlp.ToProtoTraces(data))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/protobuf")
+		w.Write(body)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"batches": data.ResourceSpans})
+}
+
+// handleTempoTags lists the tag names of recent spans
+func (s *Server) handleTempoTags(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	tags, err := s.sampleTags(r, tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := append([]string{"service.name"}, sortedKeys(tags)...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"tagNames": names})
+}
+
+// handleTempoTagsV2 lists the tag names of recent spans by scope
+func (s *Server) handleTempoTagsV2(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	tags, err := s.sampleTags(r, tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scopes := []tempoTagScope{
+		{Name: "resource", Tags: []string{"service.name"}},
+		{Name: "span", Tags: sortedKeys(tags)},
+		{Name: "intrinsic", Tags: tempoIntrinsics},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]tempoTagScope{"scopes": scopes})
+}
+
+func (s *Server) handleTempoTagValues(w http.ResponseWriter, r *http.Request) {
+	values, ok := s.tempoTagValues(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"tagValues": values})
+}
+
+func (s *Server) handleTempoTagValuesV2(w http.ResponseWriter, r *http.Request) {
+	values, ok := s.tempoTagValues(w, r)
+	if !ok {
+		return
+	}
+	typed := make([]tempoTagValue, 0, len(values))
+	for _, v := range values {
+		typed = append(typed, tempoTagValue{Type: "string", Value: v})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]tempoTagValue{"tagValues": typed})
+}
+
+// tempoTagValues returns the values of the tag in the name path parameter,
+// scoped as in TraceQL (resource.service.name, span.http.method, name) or
+// not. Services are listed in full, other values are those of recent spans.
+func (s *Server) tempoTagValues(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	name := r.PathValue("name")
+	if name == "service.name" || name == "resource.service.name" {
+		services := s.stores.Spans(tenant).Services()
+		if services == nil {
+			services = []string{}
+		}
+		return services, true
+	}
+	tag, scoped := strings.CutPrefix(name, "span.")
+	if !scoped {
+		tag = strings.TrimPrefix(name, ".")
+	}
+
+	values := make(map[string]struct{})
+	err := s.sampleSpans(r, tenant, func(span *models.Span) {
+		var v string
+		switch {
+		case !scoped && tag == "name":
+			v = span.OperationName
+		case !scoped && tag == "kind":
+			v = string(span.Kind)
+		case !scoped && tag == "status":
+			v = string(span.Status)
+		default:
+			v = span.Tags[tag]
+		}
+		if v != "" {
+			values[v] = struct{}{}
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return sortedKeys(values), true
+}
+
+// sampleTags returns the tag names of the spans of recent traces
+func (s *Server) sampleTags(r *http.Request, tenant string) (map[string]struct{}, error) {
+	tags := make(map[string]struct{})
+	err := s.sampleSpans(r, tenant, func(span *models.Span) {
+		for key := range span.Tags {
+			tags[key] = struct{}{}
+		}
+	})
+	return tags, err
+}
+
+// sampleSpans calls fn with each span of up to tempoTagSampleTraces traces
+// in the request's time range, by default the last hour
+func (s *Server) sampleSpans(r *http.Request, tenant string, fn func(span *models.Span)) error {
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		return err
+	}
+	query := models.TraceQuery{
+		StartTime:      start,
+		EndTime:        end,
+		Limit:          tempoTagSampleTraces,
+		IncludePartial: true,
+		Match: func(trace *models.Trace) bool {
+			for i := range trace.Spans {
+				fn(&trace.Spans[i])
+			}
+			return true
+		},
+	}
+	_, err = s.stores.Spans(tenant).QueryTraces(query)
+	return err
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
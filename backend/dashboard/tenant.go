@@ -0,0 +1,49 @@
+package dashboard
+
+import (
+	"net/http"
+
+	"github.com/omnitrace/omnitrace/backend/auth"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// tenant resolves the tenant a query runs against from the tenant header or
+// the "tenant" query parameter. When tenants are required and none is
+// given, or the tenant ID isn't valid, it writes a 400 response and
+// returns false, and a write to a tenant nothing was ingested for gets a
+// 404. Principals bound to a tenant default to it and may not query
+// others.
+func (s *Server) tenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tenant := r.Header.Get(models.TenantHeader)
+	if tenant == "" {
+		tenant = r.URL.Query().Get("tenant")
+	}
+	if p, ok := auth.PrincipalFromContext(r.Context()); ok && p.Tenant != "" {
+		if tenant != "" && tenant != p.Tenant {
+			http.Error(w, "Forbidden: not allowed to read tenant "+tenant, http.StatusForbidden)
+			return "", false
+		}
+		return p.Tenant, true
+	}
+	if tenant == "" {
+		if s.requireTenant {
+			http.Error(w, "Missing tenant: set the "+models.TenantHeader+" header or tenant parameter", http.StatusBadRequest)
+			return "", false
+		}
+		tenant = models.DefaultTenant
+	}
+	if !models.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+		return "", false
+	}
+	// Reads of a tenant nothing was ingested for come back empty, but
+	// writes would create its stores, which only ingestion does
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.stores.Exists(tenant) {
+		if tenant != models.DefaultTenant {
+			http.Error(w, "Unknown tenant "+tenant, http.StatusNotFound)
+			return "", false
+		}
+		s.stores.Open(tenant)
+	}
+	return tenant, true
+}
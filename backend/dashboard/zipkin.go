@@ -0,0 +1,433 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Zipkin search defaults, as in Zipkin
+const (
+	zipkinDefaultLimit    = 10
+	zipkinDefaultLookback = 24 * time.Hour
+)
+
+type zipkinSpan struct {
+	TraceID        string             `json:"traceId"`
+	ParentID       string             `json:"parentId,omitempty"`
+	ID             string             `json:"id"`
+	Kind           string             `json:"kind,omitempty"`
+	Name           string             `json:"name,omitempty"`
+	Timestamp      int64              `json:"timestamp,omitempty"` // Unix microseconds
+	Duration       int64              `json:"duration,omitempty"`  // Microseconds
+	LocalEndpoint  *zipkinEndpoint    `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *zipkinEndpoint    `json:"remoteEndpoint,omitempty"`
+	Annotations    []zipkinAnnotation `json:"annotations,omitempty"`
+	Tags           map[string]string  `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+type zipkinDependencyLink struct {
+	Parent     string `json:"parent"`
+	Child      string `json:"child"`
+	CallCount  int    `json:"callCount"`
+	ErrorCount int    `json:"errorCount,omitempty"`
+}
+
+func writeZipkin(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleZipkinServices(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	services := s.stores.Spans(tenant).Services()
+	if services == nil {
+		services = []string{}
+	}
+	writeZipkin(w, services)
+}
+
+// handleZipkinSpanNames lists the span names of the serviceName parameter
+func (s *Server) handleZipkinSpanNames(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	service := r.URL.Query().Get("serviceName")
+	if service == "" {
+		http.Error(w, "serviceName is required", http.StatusBadRequest)
+		return
+	}
+	operations := s.stores.Spans(tenant).Operations(service)
+	names := make([]string, 0, len(operations))
+	for _, op := range operations {
+		names = append(names, op.Name)
+	}
+	slices.Sort(names)
+	writeZipkin(w, names)
+}
+
+// handleZipkinRemoteServices lists the services the serviceName parameter
+// calls, from the service graph of the last day
+func (s *Server) handleZipkinRemoteServices(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	service := r.URL.Query().Get("serviceName")
+	if service == "" {
+		http.Error(w, "serviceName is required", http.StatusBadRequest)
+		return
+	}
+	end := time.Now()
+	graph, err := s.serviceGraph(tenant, end.Add(-zipkinDefaultLookback), end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	remotes := []string{}
+	for _, edge := range graph.Edges {
+		if edge.Source == service && !slices.Contains(remotes, edge.Target) {
+			remotes = append(remotes, edge.Target)
+		}
+	}
+	slices.Sort(remotes)
+	writeZipkin(w, remotes)
+}
+
+// handleZipkinTraces searches traces with Zipkin's parameters:
+// serviceName, spanName, remoteServiceName, annotationQuery (such as
+// "error and http.method=GET"), minDuration and maxDuration in
+// microseconds, endTs and lookback in milliseconds, and limit
+func (s *Server) handleZipkinTraces(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseZipkinQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	summaries, err := s.stores.Spans(tenant).QueryTraces(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	traces := make([][]zipkinSpan, 0, len(summaries))
+	for _, summary := range summaries {
+		trace, err := s.stores.Spans(tenant).GetTrace(summary.TraceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if trace != nil { // Expired since the query
+			traces = append(traces, newZipkinTrace(trace))
+		}
+	}
+	writeZipkin(w, traces)
+}
+
+func (s *Server) handleZipkinTrace(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	trace, ok := s.findTrace(w, tenant, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	writeZipkin(w, newZipkinTrace(trace))
+}
+
+// handleZipkinTraceMany returns the traces of the comma-separated traceIds
+// parameter that exist
+func (s *Server) handleZipkinTraceMany(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	var ids []string
+	for _, id := range strings.Split(r.URL.Query().Get("traceIds"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, "traceIds is required", http.StatusBadRequest)
+		return
+	}
+	traces := make([][]zipkinSpan, 0, len(ids))
+	for _, id := range ids {
+		trace, status, err := s.lookupTrace(tenant, id)
+		if errors.Is(err, errTraceNotFound) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		traces = append(traces, newZipkinTrace(trace))
+	}
+	writeZipkin(w, traces)
+}
+
+// handleZipkinDependencies returns the service graph between endTs and
+// lookback before it, both in milliseconds, as dependency links
+func (s *Server) handleZipkinDependencies(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := s.tenant(w, r)
+	if !ok {
+		return
+	}
+
+	start, end, err := parseZipkinTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	graph, err := s.serviceGraph(tenant, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	links := make([]zipkinDependencyLink, 0, len(graph.Edges))
+	for _, edge := range graph.Edges {
+		links = append(links, zipkinDependencyLink{
+			Parent:     edge.Source,
+			Child:      edge.Target,
+			CallCount:  edge.CallCount,
+			ErrorCount: int(math.Round(float64(edge.CallCount) * edge.ErrorRate)),
+		})
+	}
+	writeZipkin(w, links)
+}
+
+// parseZipkinQuery reads the search parameters of the Zipkin API. Span
+// name, remote service and annotation conditions must hold for one span
+// of the service, as in Zipkin.
+func parseZipkinQuery(r *http.Request) (models.TraceQuery, error) {
+	q := r.URL.Query()
+	query := models.TraceQuery{
+		Service: q.Get("serviceName"),
+		Limit:   zipkinDefaultLimit,
+	}
+
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if query.Limit, err = parseCount("limit", v); err != nil {
+			return query, err
+		}
+	}
+	if v := q.Get("minDuration"); v != "" {
+		us, err := parseCount("minDuration", v)
+		if err != nil {
+			return query, err
+		}
+		query.MinDuration = time.Duration(us) * time.Microsecond
+	}
+	if v := q.Get("maxDuration"); v != "" {
+		us, err := parseCount("maxDuration", v)
+		if err != nil {
+			return query, err
+		}
+		query.MaxDuration = time.Duration(us) * time.Microsecond
+	}
+	if query.StartTime, query.EndTime, err = parseZipkinTimeRange(r); err != nil {
+		return query, err
+	}
+
+	spanName := q.Get("spanName")
+	if spanName == "all" { // Zipkin UI's wildcard
+		spanName = ""
+	}
+	remote := q.Get("remoteServiceName")
+	conds, err := parseAnnotationQuery(q.Get("annotationQuery"))
+	if err != nil {
+		return query, err
+	}
+	if spanName == "" && remote == "" && len(conds) == 0 {
+		return query, nil
+	}
+	query.Match = func(trace *models.Trace) bool {
+		for i := range trace.Spans {
+			span := &trace.Spans[i]
+			if query.Service != "" && span.ServiceName != query.Service {
+				continue
+			}
+			if spanName != "" && !strings.EqualFold(span.OperationName, spanName) {
+				continue
+			}
+			if remote != "" && span.Tags[models.PeerServiceTag] != remote {
+				continue
+			}
+			if zipkinSpanMatches(span, conds) {
+				return true
+			}
+		}
+		return false
+	}
+	return query, nil
+}
+
+// parseZipkinTimeRange reads endTs and lookback in milliseconds
+func parseZipkinTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	end := time.Now()
+	if v := q.Get("endTs"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid endTs %q: want Unix milliseconds", v)
+		}
+		end = time.UnixMilli(ms)
+	}
+	lookback := zipkinDefaultLookback
+	if v := q.Get("lookback"); v != "" {
+		ms, err := parseCount("lookback", v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		lookback = time.Duration(ms) * time.Millisecond
+	}
+	return end.Add(-lookback), end, nil
+}
+
+// annotationCond is one term of an annotation query: a tag equality, or a
+// tag or annotation that must be present when value is empty
+type annotationCond struct {
+	key, value string
+}
+
+// parseAnnotationQuery parses terms joined by "and", such as
+// "error and http.method=GET"
+func parseAnnotationQuery(text string) ([]annotationCond, error) {
+	var conds []annotationCond
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	for _, term := range strings.Split(text, " and ") {
+		term = strings.TrimSpace(term)
+		key, value, _ := strings.Cut(term, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid annotationQuery %q", text)
+		}
+		conds = append(conds, annotationCond{key: key, value: value})
+	}
+	return conds, nil
+}
+
+// zipkinSpanMatches reports whether a span satisfies every condition,
+// counting the error tag Zipkin derives from the span status
+func zipkinSpanMatches(span *models.Span, conds []annotationCond) bool {
+	for _, c := range conds {
+		if c.key == "error" && c.value == "" && span.Status == models.SpanStatusError {
+			continue
+		}
+		v, ok := span.Tags[c.key]
+		if c.value == "" {
+			if !ok && !zipkinHasAnnotation(span, c.key) {
+				return false
+			}
+			continue
+		}
+		if !ok || v != c.value {
+			return false
+		}
+	}
+	return true
+}
+
+func zipkinHasAnnotation(span *models.Span, value string) bool {
+	for _, log := range span.Logs {
+		if zipkinAnnotationValue(log) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// zipkinAnnotationValue is a log as an annotation: its event field, or
+// its fields as JSON
+func zipkinAnnotationValue(log models.SpanLog) string {
+	if event, ok := log.Fields["event"]; ok && len(log.Fields) == 1 {
+		return event
+	}
+	data, _ := json.Marshal(log.Fields)
+	return string(data)
+}
+
+func newZipkinTrace(trace *models.Trace) []zipkinSpan {
+	spans := make([]zipkinSpan, 0, len(trace.Spans))
+	for i := range trace.Spans {
+		spans = append(spans, newZipkinSpan(&trace.Spans[i]))
+	}
+	return spans
+}
+
+func newZipkinSpan(span *models.Span) zipkinSpan {
+	zs := zipkinSpan{
+		TraceID:       span.TraceID.String(),
+		ParentID:      span.ParentSpanID.String(),
+		ID:            span.SpanID.String(),
+		Name:          span.OperationName,
+		Timestamp:     span.StartTime.UnixMicro(),
+		Duration:      span.Duration.Microseconds(),
+		LocalEndpoint: &zipkinEndpoint{ServiceName: span.ServiceName},
+	}
+	switch span.Kind {
+	case models.SpanKindServer, models.SpanKindClient, models.SpanKindProducer, models.SpanKindConsumer:
+		zs.Kind = strings.ToUpper(string(span.Kind))
+	}
+	if peer := span.PeerService(); peer != "" {
+		zs.RemoteEndpoint = &zipkinEndpoint{ServiceName: peer}
+	}
+	if len(span.Tags) > 0 || span.Status == models.SpanStatusError {
+		zs.Tags = make(map[string]string, len(span.Tags)+1)
+		for k, v := range span.Tags {
+			zs.Tags[k] = v
+		}
+	}
+	if span.Status == models.SpanStatusError {
+		// Zipkin marks failed spans with an error tag holding the message
+		zs.Tags["error"] = span.StatusMessage
+		if zs.Tags["error"] == "" && span.ErrorInfo != nil {
+			zs.Tags["error"] = span.ErrorInfo.Message
+		}
+		if zs.Tags["error"] == "" {
+			zs.Tags["error"] = "true"
+		}
+	}
+	for _, log := range span.Logs {
+		zs.Annotations = append(zs.Annotations, zipkinAnnotation{
+			Timestamp: log.Timestamp.UnixMicro(),
+			Value:     zipkinAnnotationValue(log),
+		})
+	}
+	return zs
+}
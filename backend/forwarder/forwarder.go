@@ -0,0 +1,330 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+	"github.com/omnitrace/omnitrace/internal/otlp"
+)
+
+// Protocol selects the wire format used to forward spans
+type Protocol string
+
+const (
+	// ProtocolOmniTrace forwards to another OmniTrace collector's /api/v1/spans
+	ProtocolOmniTrace Protocol = "omnitrace"
+	// ProtocolOTLP forwards to an OTLP/HTTP JSON receiver's /v1/traces
+	ProtocolOTLP Protocol = "otlp"
+)
+
+// Config configures the forwarder
+type Config struct {
+	Endpoint      string
+	Protocol      Protocol
+	Headers       map[string]string
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	MaxRetries    int
+	RetryBackoff  time.Duration
+	QueueSize     int
+	// Senders is the number of batches sent at once
+	Senders int
+}
+
+// Stats reports forwarder counters
+type Stats struct {
+	Forwarded int64 `json:"forwarded"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+	Retries   int64 `json:"retries"`
+	Queued    int   `json:"queued"`
+}
+
+// Forwarder batches ingested spans and sends them to a downstream endpoint
+// with retries, so OmniTrace can run as an edge aggregator
+type Forwarder struct {
+	config Config
+	client *http.Client
+	buffer []models.Span
+	// batches holds the flushed batches waiting for a sender
+	batches chan []models.Span
+	// pending counts the spans in batches
+	pending int
+	closed  bool
+	mu      sync.Mutex
+	stats   Stats
+	// unreachable is the error of the last send that got no response
+	// from downstream, cleared by the next one that does
+	unreachable error
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+	senders     sync.WaitGroup
+}
+
+// New creates a new forwarder and starts its flush loop
+func New(config Config) *Forwarder {
+	if config.Protocol == "" {
+		config.Protocol = ProtocolOmniTrace
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 5 * time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 500 * time.Millisecond
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100 * config.BatchSize
+	}
+	if config.Senders <= 0 {
+		config.Senders = 4
+	}
+
+	f := &Forwarder{
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout},
+		buffer:  make([]models.Span, 0, config.BatchSize),
+		batches: make(chan []models.Span, max(config.QueueSize/config.BatchSize, 1)),
+		stopCh:  make(chan struct{}),
+	}
+
+	f.wg.Add(1)
+	go f.flushLoop()
+	f.senders.Add(config.Senders)
+	for range config.Senders {
+		go f.sendLoop()
+	}
+
+	return f
+}
+
+// Forward queues spans for forwarding. Batches that don't fit in the
+// queue are dropped rather than blocking ingestion, as are spans
+// forwarded after Close.
+func (f *Forwarder) Forward(spans []models.Span) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		f.stats.Dropped += int64(len(spans))
+		return
+	}
+	for _, span := range spans {
+		f.buffer = append(f.buffer, span)
+		if len(f.buffer) >= f.config.BatchSize {
+			f.flushLocked()
+		}
+	}
+}
+
+// Stats returns a snapshot of the forwarder counters
+func (f *Forwarder) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats := f.stats
+	stats.Queued = len(f.buffer) + f.pending
+	return stats
+}
+
+// Reachable returns why downstream wasn't reachable on the last send, or
+// nil if it was or nothing was sent yet
+func (f *Forwarder) Reachable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.unreachable
+}
+
+// Close stops the flush loop, waits for the senders to send the queued
+// batches and sends any buffered spans
+func (f *Forwarder) Close() error {
+	close(f.stopCh)
+	f.wg.Wait()
+
+	f.mu.Lock()
+	f.closed = true
+	close(f.batches)
+	spans := f.takeLocked()
+	f.mu.Unlock()
+
+	f.senders.Wait()
+	return f.sendBatches(spans)
+}
+
+func (f *Forwarder) flushLoop() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.Lock()
+			f.flushLocked()
+			f.mu.Unlock()
+		case <-f.stopCh:
+			return
+		}
+	}
+}
+
+func (f *Forwarder) takeLocked() []models.Span {
+	spans := make([]models.Span, len(f.buffer))
+	copy(spans, f.buffer)
+	f.buffer = f.buffer[:0]
+	return spans
+}
+
+// flushLocked queues the buffered spans for the senders, dropping them if
+// the queue is full
+func (f *Forwarder) flushLocked() {
+	if len(f.buffer) == 0 {
+		return
+	}
+
+	spans := f.takeLocked()
+	select {
+	case f.batches <- spans:
+		f.pending += len(spans)
+	default:
+		f.stats.Dropped += int64(len(spans))
+	}
+}
+
+// sendLoop sends queued batches until Close
+func (f *Forwarder) sendLoop() {
+	defer f.senders.Done()
+
+	for spans := range f.batches {
+		f.mu.Lock()
+		f.pending -= len(spans)
+		f.mu.Unlock()
+
+		if err := f.sendBatches(spans); err != nil {
+			log.Printf("Forwarder: %v", err)
+		}
+	}
+}
+
+// sendBatches sends spans in batches of at most BatchSize, one tenant per
+// batch so the tenant can travel in the request header
+func (f *Forwarder) sendBatches(spans []models.Span) error {
+	byTenant := make(map[string][]models.Span)
+	for _, span := range spans {
+		byTenant[span.TenantID] = append(byTenant[span.TenantID], span)
+	}
+
+	var lastErr error
+	for tenant, tenantSpans := range byTenant {
+		for start := 0; start < len(tenantSpans); start += f.config.BatchSize {
+			end := start + f.config.BatchSize
+			if end > len(tenantSpans) {
+				end = len(tenantSpans)
+			}
+			if err := f.sendWithRetry(tenant, tenantSpans[start:end]); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+func (f *Forwarder) sendWithRetry(tenant string, spans []models.Span) error {
+	// Retries carry the same key, so that the collector doesn't store a
+	// batch twice when only its response was lost
+	key := rand.Text()
+	backoff := f.config.RetryBackoff
+
+	var err error
+	for attempt := 0; attempt <= f.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			f.mu.Lock()
+			f.stats.Retries++
+			f.mu.Unlock()
+
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retryable bool
+		if retryable, err = f.send(tenant, key, spans); err == nil {
+			f.mu.Lock()
+			f.stats.Forwarded += int64(len(spans))
+			f.mu.Unlock()
+			return nil
+		}
+		if !retryable {
+			break
+		}
+	}
+
+	f.mu.Lock()
+	f.stats.Failed += int64(len(spans))
+	f.mu.Unlock()
+
+	return fmt.Errorf("failed to forward %d spans: %w", len(spans), err)
+}
+
+// send posts one batch, reporting whether a failure is worth retrying
+func (f *Forwarder) send(tenant, key string, spans []models.Span) (bool, error) {
+	var (
+		path    string
+		payload interface{}
+	)
+	switch f.config.Protocol {
+	case ProtocolOTLP:
+		path = "/v1/traces"
+		payload = otlp.FromSpans(spans)
+	default:
+		path = "/api/v1/spans"
+		payload = models.SpanBatch{Spans: spans}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, f.config.Endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(models.IdempotencyHeader, key)
+	if tenant != "" {
+		req.Header.Set(models.TenantHeader, tenant)
+	}
+	for k, v := range f.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := f.client.Do(req)
+	f.mu.Lock()
+	f.unreachable = err
+	f.mu.Unlock()
+	if err != nil {
+		return true, fmt.Errorf("failed to send spans: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		return true, nil
+	}
+
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("downstream returned status %d", resp.StatusCode)
+}
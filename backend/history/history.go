@@ -0,0 +1,249 @@
+// Package history keeps a compact record of traces beyond the span TTL:
+// the summary of each trace, and the hourly span count, errors and latency
+// histogram of each operation. Traces are compacted into these records
+// once they reach a set age, before they expire, and the records are kept
+// on disk for a much longer retention, so latency and error trends can be
+// analyzed long after the spans themselves are gone.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Default compaction settings
+const (
+	DefaultAfter     = 15 * time.Minute
+	DefaultInterval  = 5 * time.Minute
+	DefaultRetention = 30 * 24 * time.Hour
+)
+
+// Resolution is the period of the operation statistics
+const Resolution = time.Hour
+
+// Config configures trace history
+type Config struct {
+	// Dir is the directory the records are kept in
+	Dir string
+	// After is the age at which traces are compacted. It must be shorter
+	// than the span TTL so traces are compacted before they expire, and
+	// longer than the trace assembly delay so they are complete.
+	After time.Duration
+	// Interval is how often traces are compacted
+	Interval time.Duration
+	// Retention is how long the records are kept
+	Retention time.Duration
+}
+
+// Stats reports compaction counters
+type Stats struct {
+	Compacted int64 `json:"compacted"`
+	// Failed counts the runs in which a tenant's traces failed to compact
+	Failed  int64     `json:"failed"`
+	LastRun time.Time `json:"last_run"`
+}
+
+// History compacts traces into summaries and operation statistics, and
+// answers queries over them
+type History struct {
+	stores *storage.TenantStores
+	config Config
+
+	mu         sync.Mutex
+	watermarks map[string]time.Time // Tenant -> compacted up to
+	// days caches the operation statistics of the days still being
+	// compacted, by tenant and day
+	days  map[string]map[string]operationStats
+	stats Stats
+
+	// files guards the record files, written by Run and read by queries
+	files sync.RWMutex
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates the history kept in config.Dir, restoring how far each
+// tenant's traces were compacted, and starts its compaction loop
+func New(stores *storage.TenantStores, config Config) (*History, error) {
+	if config.After <= 0 {
+		config.After = DefaultAfter
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Retention <= 0 {
+		config.Retention = DefaultRetention
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	h := &History{
+		stores:     stores,
+		config:     config,
+		watermarks: make(map[string]time.Time),
+		days:       make(map[string]map[string]operationStats),
+		stopCh:     make(chan struct{}),
+	}
+	data, err := os.ReadFile(h.watermarksPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &h.watermarks); err != nil {
+			return nil, err
+		}
+	}
+
+	h.wg.Add(1)
+	go h.loop()
+	return h, nil
+}
+
+func (h *History) loop() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Run()
+		case <-h.stopCh:
+			return
+		}
+	}
+}
+
+// Run compacts every tenant's traces that started between the previous
+// run's cutoff and now minus the compaction age, then removes the records
+// past their retention. A tenant's window is retried on the next run if
+// it fails.
+func (h *History) Run() {
+	now := time.Now()
+	cutoff := now.Add(-h.config.After)
+
+	for _, tenant := range h.stores.Tenants() {
+		compacted, err := h.compact(tenant, cutoff)
+		h.mu.Lock()
+		if err != nil {
+			log.Printf("History compaction for tenant %s failed: %v", tenant, err)
+			h.stats.Failed++
+		}
+		h.stats.Compacted += int64(compacted)
+		h.mu.Unlock()
+	}
+
+	if err := h.prune(now.Add(-h.config.Retention)); err != nil {
+		log.Printf("History pruning failed: %v", err)
+	}
+
+	h.mu.Lock()
+	h.stats.LastRun = now
+	h.mu.Unlock()
+}
+
+// compact records the traces of a tenant that started after its watermark
+// and up to cutoff, and returns how many it recorded
+func (h *History) compact(tenant string, cutoff time.Time) (int, error) {
+	h.mu.Lock()
+	from := h.watermarks[tenant]
+	h.mu.Unlock()
+
+	spans := h.stores.Spans(tenant)
+	// Select by start time only, as the archiver does, so that traces
+	// still running at one cutoff are compacted by the next run
+	summaries, err := spans.QueryTraces(models.TraceQuery{
+		StartTime:      from,
+		IncludePartial: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	traces := make(map[string][]traceRecord)
+	operations := make(operationStats)
+	for _, summary := range summaries {
+		if summary.StartTime.After(cutoff) || (!from.IsZero() && !summary.StartTime.After(from)) {
+			continue
+		}
+		trace, err := spans.GetTrace(summary.TraceID)
+		if err != nil {
+			return 0, err
+		}
+		if trace == nil {
+			// Expired since the query
+			continue
+		}
+		day := dayOf(summary.StartTime)
+		traces[day] = append(traces[day], newTraceRecord(summary, trace))
+		for _, span := range trace.Spans {
+			operations.add(span)
+		}
+	}
+
+	compacted := 0
+	for _, records := range traces {
+		compacted += len(records)
+	}
+	if err := h.write(tenant, traces, operations); err != nil {
+		return 0, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watermarks[tenant] = cutoff
+	h.evictLocked(tenant, cutoff)
+	return compacted, h.saveWatermarksLocked()
+}
+
+// evictLocked drops the cached operation statistics of days before the
+// one traces are now being compacted in
+func (h *History) evictLocked(tenant string, cutoff time.Time) {
+	current := dayOf(cutoff)
+	for day := range h.days[tenant] {
+		if day < current {
+			delete(h.days[tenant], day)
+		}
+	}
+}
+
+func (h *History) watermarksPath() string {
+	return filepath.Join(h.config.Dir, "watermarks.json")
+}
+
+// saveWatermarksLocked writes how far each tenant's traces were
+// compacted, so that a restart doesn't compact them again
+func (h *History) saveWatermarksLocked() error {
+	data, err := json.Marshal(h.watermarks)
+	if err != nil {
+		return err
+	}
+	tmp := h.watermarksPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.watermarksPath())
+}
+
+// Stats returns a snapshot of the compaction counters
+func (h *History) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// Close stops the compaction loop
+func (h *History) Close() {
+	close(h.stopCh)
+	h.wg.Wait()
+}
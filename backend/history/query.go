@@ -0,0 +1,158 @@
+package history
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Traces returns the compacted traces of a tenant matching the query's
+// time range, service (any service of the trace), operation (the root's),
+// duration bounds and error flag, in the query's result order and paged by
+// its offset, cursor and limit. It also returns how many traces match in
+// all.
+func (h *History) Traces(tenant string, query models.TraceQuery) ([]models.TraceSummary, int, error) {
+	end := query.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if query.StartTime.IsZero() {
+		query.StartTime = end.Add(-h.config.Retention)
+	}
+
+	h.files.RLock()
+	defer h.files.RUnlock()
+
+	var matches []models.TraceSummary
+	seen := make(map[models.TraceID]bool)
+	for _, day := range days(query.StartTime, end) {
+		err := readTraces(h.tracesPath(tenant, day), func(r traceRecord) {
+			// A window retried after a failed write may be recorded twice
+			if seen[r.TraceID] || !matchRecord(r, query, end) {
+				return
+			}
+			seen[r.TraceID] = true
+			matches = append(matches, r.TraceSummary)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	total := len(matches)
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Cursor().Before(matches[j].Cursor(), query.TraceOrder) })
+	if query.After != nil {
+		i := sort.Search(len(matches), func(i int) bool { return query.After.Before(matches[i].Cursor(), query.TraceOrder) })
+		matches = matches[i:]
+	}
+	if query.Offset >= len(matches) {
+		return nil, total, nil
+	}
+	matches = matches[query.Offset:]
+	if query.Limit > 0 && len(matches) > query.Limit {
+		matches = matches[:query.Limit]
+	}
+	return matches, total, nil
+}
+
+func matchRecord(r traceRecord, query models.TraceQuery, end time.Time) bool {
+	switch {
+	case r.StartTime.Before(query.StartTime) || r.StartTime.After(end):
+		return false
+	case query.Service != "" && !slices.Contains(r.Services, query.Service):
+		return false
+	case query.Operation != "" && r.RootOperation != query.Operation:
+		return false
+	case query.MinDuration > 0 && r.Duration < query.MinDuration:
+		return false
+	case query.MaxDuration > 0 && r.Duration > query.MaxDuration:
+		return false
+	case query.HasError != nil && r.HasError != *query.HasError:
+		return false
+	}
+	return true
+}
+
+// Operations returns the span count, errors and latency percentiles of a
+// tenant's operations matching the query's service and operation, if set,
+// in periods of its step. The step must be a multiple of the Resolution
+// and defaults to it.
+func (h *History) Operations(tenant string, query models.LatencyQuery) ([]models.OperationHistory, error) {
+	step := query.Step
+	if step <= 0 {
+		step = Resolution
+	}
+	if step%Resolution != 0 {
+		return nil, fmt.Errorf("step must be a multiple of %s", Resolution)
+	}
+	end := query.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	start := query.StartTime
+	if start.IsZero() {
+		start = end.Add(-h.config.Retention)
+	}
+	start = start.Truncate(Resolution)
+
+	h.files.RLock()
+	defer h.files.RUnlock()
+
+	totals := make(operationStats)
+	for _, day := range days(start, end) {
+		h.mu.Lock()
+		stats, ok := h.days[tenant][day]
+		h.mu.Unlock()
+		if !ok {
+			var err error
+			if stats, err = readOperations(h.operationsPath(tenant, day)); err != nil {
+				return nil, err
+			}
+		}
+		for _, r := range stats {
+			if r.StartTime.Before(start) || r.StartTime.After(end) {
+				continue
+			}
+			if (query.Service != "" && r.Service != query.Service) || (query.Operation != "" && r.Operation != query.Operation) {
+				continue
+			}
+			totals.merge(r, r.StartTime.Truncate(step))
+		}
+	}
+
+	byOperation := make(map[[2]string]*models.OperationHistory)
+	for _, r := range totals {
+		key := [2]string{r.Service, r.Operation}
+		op, ok := byOperation[key]
+		if !ok {
+			op = &models.OperationHistory{Service: r.Service, Operation: r.Operation}
+			byOperation[key] = op
+		}
+		q := r.Latency.Quantiles(0.5, 0.9, 0.95, 0.99)
+		op.Buckets = append(op.Buckets, models.LatencyBucket{
+			StartTime: r.StartTime,
+			Count:     r.Latency.Count(),
+			Errors:    r.Errors,
+			P50:       q[0] / 1000,
+			P90:       q[1] / 1000,
+			P95:       q[2] / 1000,
+			P99:       q[3] / 1000,
+		})
+	}
+
+	operations := make([]models.OperationHistory, 0, len(byOperation))
+	for _, op := range byOperation {
+		sort.Slice(op.Buckets, func(i, j int) bool { return op.Buckets[i].StartTime.Before(op.Buckets[j].StartTime) })
+		operations = append(operations, *op)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		if operations[i].Service != operations[j].Service {
+			return operations[i].Service < operations[j].Service
+		}
+		return operations[i].Operation < operations[j].Operation
+	})
+	return operations, nil
+}
@@ -0,0 +1,328 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Each tenant's records are kept in its own directory, in one file of
+// trace records and one of operation statistics per day (UTC) the traces
+// started on, so that a query reads only the days in its time range and
+// retention removes whole files:
+//
+//	<dir>/<tenant>/traces-2006-01-02.jsonl
+//	<dir>/<tenant>/operations-2006-01-02.json
+const (
+	tracesPrefix     = "traces-"
+	tracesSuffix     = ".jsonl"
+	operationsPrefix = "operations-"
+	operationsSuffix = ".json"
+	dayLayout        = "2006-01-02"
+)
+
+// traceRecord is the record of a compacted trace: its summary and the
+// services it went through, which trace queries filter on
+type traceRecord struct {
+	models.TraceSummary
+	Services []string `json:"services"`
+}
+
+func newTraceRecord(summary models.TraceSummary, trace *models.Trace) traceRecord {
+	return traceRecord{TraceSummary: summary, Services: trace.Services}
+}
+
+// operationKey identifies the statistics of an operation in one period
+type operationKey struct {
+	service   string
+	operation string
+	start     int64
+}
+
+// operationRecord is the span count, errors and latency of an operation
+// in one period. Latencies are recorded in microseconds.
+type operationRecord struct {
+	Service   string             `json:"service"`
+	Operation string             `json:"operation"`
+	StartTime time.Time          `json:"start_time"`
+	Errors    uint64             `json:"errors"`
+	Latency   *storage.Histogram `json:"latency_us"`
+}
+
+// operationStats holds operation statistics by operation and period
+type operationStats map[operationKey]*operationRecord
+
+// add records a span in the statistics of its operation and hour
+func (s operationStats) add(span models.Span) {
+	start := span.StartTime.UTC().Truncate(Resolution)
+	s.merge(&operationRecord{
+		Service:   span.ServiceName,
+		Operation: span.OperationName,
+		StartTime: start,
+		Errors:    boolCount(span.Status == models.SpanStatusError),
+		Latency:   recordLatency(span.Duration),
+	}, start)
+}
+
+// merge adds a record to the statistics of its operation in the period
+// starting at start
+func (s operationStats) merge(r *operationRecord, start time.Time) {
+	key := operationKey{r.Service, r.Operation, start.Unix()}
+	total, ok := s[key]
+	if !ok {
+		total = &operationRecord{
+			Service:   r.Service,
+			Operation: r.Operation,
+			StartTime: start,
+			Latency:   storage.NewHistogram(),
+		}
+		s[key] = total
+	}
+	total.Errors += r.Errors
+	total.Latency.Merge(r.Latency)
+}
+
+// byDay splits the statistics by the day their hour is in
+func (s operationStats) byDay() map[string]operationStats {
+	days := make(map[string]operationStats)
+	for key, r := range s {
+		day := dayOf(r.StartTime)
+		if days[day] == nil {
+			days[day] = make(operationStats)
+		}
+		days[day][key] = r
+	}
+	return days
+}
+
+func recordLatency(d time.Duration) *storage.Histogram {
+	h := storage.NewHistogram()
+	h.Record(float64(d.Microseconds()))
+	return h
+}
+
+func boolCount(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func dayOf(t time.Time) string {
+	return t.UTC().Format(dayLayout)
+}
+
+// days returns the days from start to end, latest first
+func days(start, end time.Time) []string {
+	var result []string
+	last := end.UTC().Truncate(24 * time.Hour)
+	for day := start.UTC().Truncate(24 * time.Hour); !day.After(last); day = day.Add(24 * time.Hour) {
+		result = append([]string{day.Format(dayLayout)}, result...)
+	}
+	return result
+}
+
+// tenantDir returns a tenant's history directory. Tenant IDs are validated
+// where requests name them, so they are a single path element.
+func (h *History) tenantDir(tenant string) string {
+	return filepath.Join(h.config.Dir, tenant)
+}
+
+func (h *History) tracesPath(tenant, day string) string {
+	return filepath.Join(h.tenantDir(tenant), tracesPrefix+day+tracesSuffix)
+}
+
+func (h *History) operationsPath(tenant, day string) string {
+	return filepath.Join(h.tenantDir(tenant), operationsPrefix+day+operationsSuffix)
+}
+
+// write appends trace records to their days' files and merges operation
+// statistics into theirs
+func (h *History) write(tenant string, traces map[string][]traceRecord, operations operationStats) error {
+	if len(traces) == 0 && len(operations) == 0 {
+		return nil
+	}
+	h.files.Lock()
+	defer h.files.Unlock()
+
+	if err := os.MkdirAll(h.tenantDir(tenant), 0o755); err != nil {
+		return err
+	}
+	for day, records := range traces {
+		if err := appendTraces(h.tracesPath(tenant, day), records); err != nil {
+			return err
+		}
+	}
+	for day, stats := range operations.byDay() {
+		cached, err := h.cachedOperations(tenant, day)
+		if err != nil {
+			return err
+		}
+		for key, r := range stats {
+			cached.merge(r, time.Unix(key.start, 0).UTC())
+		}
+		if err := writeOperations(h.operationsPath(tenant, day), cached); err != nil {
+			// Reread the day on the retry rather than count it twice
+			h.mu.Lock()
+			delete(h.days[tenant], day)
+			h.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// cachedOperations returns the operation statistics of a day being
+// compacted, read from its file the first time
+func (h *History) cachedOperations(tenant, day string) (operationStats, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if stats, ok := h.days[tenant][day]; ok {
+		return stats, nil
+	}
+	stats, err := readOperations(h.operationsPath(tenant, day))
+	if err != nil {
+		return nil, err
+	}
+	if h.days[tenant] == nil {
+		h.days[tenant] = make(map[string]operationStats)
+	}
+	h.days[tenant][day] = stats
+	return stats, nil
+}
+
+func appendTraces(path string, records []traceRecord) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readTraces calls fn with each trace record of a day's file. A missing
+// file has none.
+func readTraces(path string, fn func(traceRecord)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var r traceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fn(r)
+	}
+	return scanner.Err()
+}
+
+func writeOperations(path string, stats operationStats) error {
+	records := make([]*operationRecord, 0, len(stats))
+	for _, r := range stats {
+		records = append(records, r)
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readOperations reads the operation statistics of a day's file. A missing
+// file has none.
+func readOperations(path string) (operationStats, error) {
+	stats := make(operationStats)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*operationRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, r := range records {
+		stats[operationKey{r.Service, r.Operation, r.StartTime.Unix()}] = r
+	}
+	return stats, nil
+}
+
+// prune removes the files of days before cutoff's
+func (h *History) prune(cutoff time.Time) error {
+	h.files.Lock()
+	defer h.files.Unlock()
+
+	oldest := dayOf(cutoff)
+	tenants, err := os.ReadDir(h.config.Dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, tenant := range tenants {
+		if !tenant.IsDir() {
+			continue
+		}
+		dir := filepath.Join(h.config.Dir, tenant.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, file := range files {
+			if day, ok := fileDay(file.Name()); ok && day < oldest {
+				if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fileDay returns the day of a record file from its name
+func fileDay(name string) (string, bool) {
+	for _, affix := range [][2]string{{tracesPrefix, tracesSuffix}, {operationsPrefix, operationsSuffix}} {
+		if day, ok := strings.CutPrefix(name, affix[0]); ok {
+			if day, ok = strings.CutSuffix(day, affix[1]); ok {
+				if _, err := time.Parse(dayLayout, day); err == nil {
+					return day, true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,227 @@
+package ingestion
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Identity is the authenticated principal behind an ingestion request. An
+// empty Service means the token may write spans for any service.
+type Identity struct {
+	Service string
+	Tenant  string
+	// Sources, if set, restricts the token to these source networks
+	Sources []netip.Prefix
+	// Replicate allows writing peer replicas and backup imports, which
+	// skip quotas and the span age window
+	Replicate bool
+}
+
+// TokenLookup resolves bearer tokens an authenticator doesn't hold itself,
+// such as managed API tokens
+type TokenLookup func(token string) (Identity, bool)
+
+// TokenAuthenticator authenticates ingestion requests by bearer token.
+// Tokens are kept only as SHA-256 digests.
+type TokenAuthenticator struct {
+	tokens  map[[sha256.Size]byte]Identity
+	lookups []TokenLookup
+}
+
+// NewTokenAuthenticator creates an authenticator from a token -> identity
+// map, consulting lookups for other tokens
+func NewTokenAuthenticator(tokens map[string]Identity, lookups ...TokenLookup) *TokenAuthenticator {
+	a := &TokenAuthenticator{tokens: make(map[[sha256.Size]byte]Identity, len(tokens)), lookups: lookups}
+	for token, id := range tokens {
+		a.tokens[sha256.Sum256([]byte(token))] = id
+	}
+	return a
+}
+
+// Authenticate looks up the identity for a bearer token
+func (a *TokenAuthenticator) Authenticate(token string) (Identity, bool) {
+	if token == "" {
+		return Identity{}, false
+	}
+	if id, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return id, true
+	}
+	for _, lookup := range a.lookups {
+		if id, ok := lookup(token); ok {
+			return id, true
+		}
+	}
+	return Identity{}, false
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" value
+func bearerToken(header string) string {
+	const prefix = "bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity of a request. Unauthenticated
+// requests carry only a tenant.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// resolveTenant picks the tenant for a write: a token-bound tenant always
+// wins over the tenant header, which wins over the default tenant
+func resolveTenant(id Identity, header string) string {
+	if id.Tenant != "" {
+		return id.Tenant
+	}
+	if header != "" {
+		return header
+	}
+	return models.DefaultTenant
+}
+
+// withAuth rejects requests from sources the source filter doesn't admit
+// and requests without a valid bearer token when token auth is enabled,
+// and attaches the identity and tenant to the request context
+func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		source := requestSource(r)
+		if !s.sources.allow(source) {
+			http.Error(w, "Source not allowed", http.StatusForbidden)
+			return
+		}
+		var id Identity
+		if s.auth != nil {
+			var ok bool
+			id, ok = s.auth.Authenticate(bearerToken(r.Header.Get("Authorization")))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="omnitrace"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !s.sources.allowToken(id, source) {
+				http.Error(w, "Source not allowed for this token", http.StatusForbidden)
+				return
+			}
+		}
+		id.Tenant = resolveTenant(id, r.Header.Get(models.TenantHeader))
+		if !models.ValidTenant(id.Tenant) {
+			http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	}
+}
+
+// withReplicate rejects requests whose token may not write replicas or
+// imports when token auth is enabled. It goes inside withAuth.
+func (s *Server) withReplicate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, _ := IdentityFromContext(r.Context()); s.auth != nil && !id.Replicate {
+			http.Error(w, "Token may not write replicas or imports", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// UnaryServerInterceptor filters OTLP/gRPC requests by source like
+// withAuth, authenticates them using the "authorization" metadata key and
+// resolves their tenant. A nil authenticator only resolves the tenant, and
+// a nil filter admits any source.
+func (a *TokenAuthenticator) UnaryServerInterceptor(sources *SourceFilter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		source := grpcSource(ctx)
+		if !sources.allow(source) {
+			return nil, status.Error(codes.PermissionDenied, "source not allowed")
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		first := func(key string) string {
+			if values := md.Get(key); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		}
+
+		var id Identity
+		if a != nil {
+			var ok bool
+			id, ok = a.Authenticate(bearerToken(first("authorization")))
+			if !ok {
+				return nil, status.Error(codes.Unauthenticated, "invalid or missing bearer token")
+			}
+			if !sources.allowToken(id, source) {
+				return nil, status.Error(codes.PermissionDenied, "source not allowed for this token")
+			}
+		}
+		id.Tenant = resolveTenant(id, first(strings.ToLower(models.TenantHeader)))
+		if !models.ValidTenant(id.Tenant) {
+			return nil, status.Error(codes.InvalidArgument, "invalid tenant ID")
+		}
+
+		return handler(context.WithValue(ctx, identityKey{}, id), req)
+	}
+}
+
+// stampSpans assigns the request's tenant to spans and overwrites the
+// service of spans written by a service-scoped identity, so spoofed
+// service_name and tenant_id values can't pollute other data. The claimed
+// service is kept in the omnitrace.claimed_service tag.
+func stampSpans(ctx context.Context, spans []models.Span) {
+	id, _ := IdentityFromContext(ctx)
+	for i := range spans {
+		span := &spans[i]
+		span.TenantID = resolveTenant(id, "")
+		if id.Service != "" && span.ServiceName != id.Service {
+			if span.ServiceName != "" {
+				span.AddTag("omnitrace.claimed_service", span.ServiceName)
+			}
+			span.ServiceName = id.Service
+		}
+	}
+}
+
+// requestTenant returns the tenant a request writes to, as stamped on its
+// spans and metrics
+func requestTenant(r *http.Request) string {
+	id, _ := IdentityFromContext(r.Context())
+	return resolveTenant(id, "")
+}
+
+// stampMetrics applies the request's tenant and identity service to metrics
+func stampMetrics(ctx context.Context, metrics []models.Metric) {
+	id, _ := IdentityFromContext(ctx)
+	for i := range metrics {
+		metrics[i].TenantID = resolveTenant(id, "")
+		if id.Service != "" {
+			metrics[i].Service = id.Service
+		}
+	}
+}
+
+// stampErrors applies the request's tenant and identity service to error
+// events
+func stampErrors(ctx context.Context, events []models.ErrorEvent) {
+	id, _ := IdentityFromContext(ctx)
+	for i := range events {
+		events[i].TenantID = resolveTenant(id, "")
+		if id.Service != "" {
+			events[i].Service = id.Service
+		}
+	}
+}
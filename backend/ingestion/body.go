@@ -0,0 +1,185 @@
+package ingestion
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+	"github.com/omnitrace/omnitrace/internal/msgpack"
+)
+
+// DefaultMaxBodyBytes is the default limit on decoded request body size
+const DefaultMaxBodyBytes = 10 << 20
+
+// gzipBody closes both the gzip reader and the underlying body
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+// withBody transparently decodes gzip-encoded request bodies and enforces
+// the configured body size limit. The limit applies to the compressed and
+// the decompressed stream, so a small gzip bomb can't bypass it.
+func (s *Server) withBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > s.maxBodyBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+		case "gzip":
+			zr, err := newGzipReader(r.Body)
+			if err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			// Handlers are done with the body when they return
+			defer gzipReaders.Put(zr)
+			r.Body = http.MaxBytesReader(w, gzipBody{Reader: zr, body: r.Body}, s.maxBodyBytes)
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// newGzipReader returns a pooled gzip reader reading from r
+func newGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if zr, ok := gzipReaders.Get().(*gzip.Reader); ok {
+		if err := zr.Reset(r); err != nil {
+			gzipReaders.Put(zr)
+			return nil, err
+		}
+		return zr, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// decodeBody decodes a request body into v, as MessagePack when its
+// Content-Type says so and as JSON otherwise
+func decodeBody(r *http.Request, v any) error {
+	if !msgpack.IsContentType(r.Header.Get("Content-Type")) {
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+	// Unmarshal copies what it keeps, so the buffer can go back to the
+	// pool
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(buf.Bytes(), v)
+}
+
+// decodeSpans decodes a span batch request body, appending its spans to
+// spans. JSON batches are decoded by decodeSpanBatch, passing malformed
+// on.
+func decodeSpans(r *http.Request, spans []models.Span, malformed func(int, error)) ([]models.Span, error) {
+	if !msgpack.IsContentType(r.Header.Get("Content-Type")) {
+		return decodeSpanBatch(r.Body, spans, malformed)
+	}
+	batch := models.SpanBatch{Spans: spans}
+	err := decodeBody(r, &batch)
+	return batch.Spans, err
+}
+
+// decodeSpanBatch decodes a models.SpanBatch one span at a time, appending
+// the spans to spans, so that a large batch is never buffered whole. Like
+// decoding the batch itself, it ignores unknown fields and data after the
+// batch. A span that is valid JSON but not a valid span, such as one with
+// a malformed ID, is passed to malformed with its index and skipped, or
+// fails the batch if malformed is nil.
+func decodeSpanBatch(r io.Reader, spans []models.Span, malformed func(int, error)) ([]models.Span, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return spans, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return spans, err
+		}
+		if key, _ := tok.(string); !strings.EqualFold(key, "spans") {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return spans, err
+			}
+			continue
+		}
+
+		if tok, err = dec.Token(); err != nil {
+			return spans, err
+		}
+		if tok == nil {
+			continue
+		}
+		if tok != json.Delim('[') {
+			return spans, fmt.Errorf("spans: want an array, got %v", tok)
+		}
+		for index := 0; dec.More(); index++ {
+			spans = append(spans, models.Span{})
+			if err := dec.Decode(&spans[len(spans)-1]); err != nil {
+				if malformed == nil || !isMalformedSpan(err) {
+					return spans, err
+				}
+				spans[len(spans)-1] = models.Span{}
+				spans = spans[:len(spans)-1]
+				malformed(index, err)
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return spans, err
+		}
+	}
+	return spans, expectDelim(dec, '}')
+}
+
+// isMalformedSpan reports whether err, from decoding one span, was the
+// span's content rather than the JSON or the body, in which case the
+// decoder has read past the span and can go on
+func isMalformedSpan(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var maxErr *http.MaxBytesError
+	return !errors.As(err, &syntaxErr) && !errors.As(err, &maxErr) &&
+		!errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// expectDelim reads the next token, which must be delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("want %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+// writeBodyError reports a request body read/decode failure, mapping body
+// size violations to 413
+func writeBodyError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Invalid request body", http.StatusBadRequest)
+}
@@ -0,0 +1,112 @@
+package ingestion
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Patterns for variable parts of error messages, applied in order
+var messageTemplatePatterns = []struct {
+	re          *regexp.Regexp
+	placeholder string
+}{
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), "<uuid>"},
+	{regexp.MustCompile(`"[^"]*"|'[^']*'`), "<str>"},
+	{regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}(?::\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b|\b[0-9a-fA-F]{16,}\b`), "<hex>"},
+	{regexp.MustCompile(`\b\d+(?:\.\d+)?\b`), "<num>"},
+}
+
+// messageTemplate replaces IDs, numbers and quoted values in an error
+// message with placeholders so that occurrences group together
+func messageTemplate(message string) string {
+	for _, p := range messageTemplatePatterns {
+		message = p.re.ReplaceAllString(message, p.placeholder)
+	}
+	return message
+}
+
+// topFrame returns the function of the first stack frame, without the
+// file/line suffix so that groups survive unrelated code changes
+func topFrame(stack []string) string {
+	if len(stack) == 0 {
+		return ""
+	}
+	frame := stack[0]
+	if i := strings.Index(frame, " ("); i >= 0 {
+		frame = frame[:i]
+	}
+	return frame
+}
+
+// fingerprintError computes the grouping fingerprint of an error from its
+// service, type, message template and top stack frame
+func fingerprintError(service, errType, template, frame string) string {
+	h := sha1.New()
+	for _, part := range []string{service, errType, template, frame} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// ErrorGrouper fingerprints errored spans and error events and records the
+// resulting occurrences as error groups
+type ErrorGrouper struct {
+	stores *storage.TenantStores
+}
+
+// NewErrorGrouper creates a new error grouper
+func NewErrorGrouper(stores *storage.TenantStores) *ErrorGrouper {
+	return &ErrorGrouper{stores: stores}
+}
+
+// ObserveSpan records an errored span in its error group
+func (g *ErrorGrouper) ObserveSpan(span models.Span) {
+	if span.Status != models.SpanStatusError {
+		return
+	}
+
+	errType := "error"
+	message := span.StatusMessage
+	var stack []string
+	if span.ErrorInfo != nil {
+		if span.ErrorInfo.Type != "" {
+			errType = span.ErrorInfo.Type
+		}
+		if span.ErrorInfo.Message != "" {
+			message = span.ErrorInfo.Message
+		}
+		stack = span.ErrorInfo.StackTrace
+	}
+	if t, ok := span.Tags["error.type"]; ok && t != "" {
+		errType = t
+	}
+
+	g.observe(span.TenantID, span.ServiceName, errType, message, stack, span.TraceID.String(), span.EndTime)
+}
+
+// ObserveEvent records a standalone error event in its error group
+func (g *ErrorGrouper) ObserveEvent(event models.ErrorEvent) {
+	g.observe(event.TenantID, event.Service, event.Type, event.Message, event.StackTrace, event.TraceID, event.Timestamp)
+}
+
+func (g *ErrorGrouper) observe(tenant, service, errType, message string, stack []string, traceID string, seen time.Time) {
+	template := messageTemplate(message)
+	frame := topFrame(stack)
+
+	g.stores.Errors(tenant).RecordOccurrence(models.ErrorGroup{
+		Fingerprint:     fingerprintError(service, errType, template, frame),
+		Service:         service,
+		Type:            errType,
+		MessageTemplate: template,
+		TopFrame:        frame,
+		SampleMessage:   message,
+	}, traceID, seen)
+}
@@ -0,0 +1,217 @@
+package ingestion
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Default idempotency settings
+const (
+	DefaultIdempotencyTTL     = 10 * time.Minute
+	DefaultIdempotencyMaxKeys = 100000
+)
+
+const (
+	// maxIdempotencyKeyLength caps the length of a key
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBody caps the response body kept for a key. Ingestion
+	// responses are small; a longer one is replayed cut short.
+	maxIdempotentBody = 64 << 10
+)
+
+// idempotentResponse is the recorded response to a batch, or a batch still
+// being handled while done is false
+type idempotentResponse struct {
+	key         string
+	expires     time.Time
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+}
+
+// IdempotencyStats reports idempotency key counters
+type IdempotencyStats struct {
+	Keys int `json:"keys"`
+	// Replayed counts requests answered with a recorded response, and
+	// Conflicts those rejected because the batch was still being handled
+	Replayed  int64 `json:"replayed"`
+	Conflicts int64 `json:"conflicts"`
+}
+
+// Idempotency remembers the responses to recently ingested batches by
+// idempotency key, so that a batch retried after a timeout is answered as
+// before rather than stored twice. Keys are scoped to the tenant and path
+// and kept for a fixed TTL, up to a maximum count.
+type Idempotency struct {
+	ttl     time.Duration
+	maxKeys int
+	now     func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]*list.Element
+	order     *list.List // of *idempotentResponse, oldest first
+	replayed  int64
+	conflicts int64
+}
+
+// NewIdempotency creates an idempotency key cache
+func NewIdempotency(ttl time.Duration, maxKeys int) *Idempotency {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if maxKeys <= 0 {
+		maxKeys = DefaultIdempotencyMaxKeys
+	}
+	return &Idempotency{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		now:     time.Now,
+		keys:    make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// begin claims key for a batch about to be handled. If the key is already
+// known it returns its response instead, which isn't done if the batch is
+// still being handled.
+func (c *Idempotency) begin(key string) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	// Every entry has the same TTL, so the oldest expire first
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*idempotentResponse)
+		if now.Before(entry.expires) && c.order.Len() < c.maxKeys {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.keys, entry.key)
+	}
+
+	if elem, ok := c.keys[key]; ok {
+		entry := *elem.Value.(*idempotentResponse)
+		if entry.done {
+			c.replayed++
+		} else {
+			c.conflicts++
+		}
+		return &entry, true
+	}
+	c.keys[key] = c.order.PushBack(&idempotentResponse{key: key, expires: now.Add(c.ttl)})
+	return nil, false
+}
+
+// finish records the response to the batch that claimed key. Only success
+// is recorded; otherwise the key is released, so that a retry is handled
+// again.
+func (c *Idempotency) finish(key string, status int, contentType string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.keys[key]
+	if !ok {
+		return
+	}
+	if status < 200 || status > 299 {
+		c.order.Remove(elem)
+		delete(c.keys, key)
+		return
+	}
+	entry := elem.Value.(*idempotentResponse)
+	entry.done = true
+	entry.status = status
+	entry.contentType = contentType
+	entry.body = body
+}
+
+// Stats returns a snapshot of the idempotency counters
+func (c *Idempotency) Stats() IdempotencyStats {
+	if c == nil {
+		return IdempotencyStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return IdempotencyStats{
+		Keys:      c.order.Len(),
+		Replayed:  c.replayed,
+		Conflicts: c.conflicts,
+	}
+}
+
+// idempotencyRecorder passes a response on while keeping a copy of it
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if room := maxIdempotentBody - r.body.Len(); room > 0 {
+		r.body.Write(data[:min(len(data), room)])
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// withIdempotency answers a batch carrying an idempotency key already seen
+// with the response recorded for it, and one whose first request is still
+// being handled with 409, instead of handling it again. It must run inside
+// withAuth, which establishes the tenant keys are scoped to.
+func (s *Server) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(models.IdempotencyHeader)
+		if s.idempotency == nil || key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency key too long", http.StatusBadRequest)
+			return
+		}
+
+		scoped := requestTenant(r) + "\x00" + r.URL.Path + "\x00" + key
+		if recorded, ok := s.idempotency.begin(scoped); ok {
+			if !recorded.done {
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+				http.Error(w, "A request with this idempotency key is in progress", http.StatusConflict)
+				return
+			}
+			if recorded.contentType != "" {
+				w.Header().Set("Content-Type", recorded.contentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(recorded.status)
+			w.Write(recorded.body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		status := http.StatusInternalServerError
+		defer func() {
+			// A handler that panics leaves status at 500, releasing the key
+			s.idempotency.finish(scoped, status, w.Header().Get("Content-Type"), rec.body.Bytes())
+		}()
+		next(rec, r)
+		status = rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package ingestion
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// importBatchSize is how many records of a backup are stored at once
+const importBatchSize = 1000
+
+// importResult is the response of the import endpoint
+type importResult struct {
+	// Spans counts the spans read, and StoredSpans those stored, leaving
+	// out invalid spans and those already stored
+	Spans       int `json:"spans"`
+	StoredSpans int `json:"stored_spans"`
+	Metrics     int `json:"metrics"`
+}
+
+// HandleImport restores a backup of newline-delimited JSON records, as
+// written by the dashboard's export endpoint, into the request's tenant.
+// Backups can be much larger than ingestion batches, so the body is
+// streamed and only each record is held to the body size limit. Records
+// are stored before the response is sent, bypassing the ingestion queue.
+func (s *Server) HandleImport(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var (
+		result  importResult
+		spans   []models.Span
+		metrics []models.Metric
+	)
+	flush := func() {
+		stampSpans(r.Context(), spans)
+		stampMetrics(r.Context(), metrics)
+		result.StoredSpans += s.processor.RestoreSpans(spans)
+		s.processor.ProcessMetrics(metrics)
+		spans, metrics = spans[:0], metrics[:0]
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxBodyBytes))
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var record models.ExportRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			flush()
+			writeImportError(w, fmt.Errorf("line %d: %w", line, err), result)
+			return
+		}
+		switch {
+		case record.Span != nil:
+			spans = append(spans, *record.Span)
+			result.Spans++
+		case record.Metric != nil:
+			metrics = append(metrics, *record.Metric)
+			result.Metrics++
+		}
+		if len(spans)+len(metrics) >= importBatchSize {
+			flush()
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = fmt.Errorf("record larger than %d bytes", s.maxBodyBytes)
+		}
+		writeImportError(w, fmt.Errorf("line %d: %w", line+1, err), result)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeImportError reports a malformed backup along with the records
+// imported before it
+func writeImportError(w http.ResponseWriter, err error, result importResult) {
+	http.Error(w, fmt.Sprintf("Invalid backup at %v (imported %d spans, %d metrics)", err, result.Spans, result.Metrics), http.StatusBadRequest)
+}
@@ -0,0 +1,212 @@
+package ingestion
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/omnitrace/omnitrace/internal/otlp"
+)
+
+// OTLP/HTTP content types
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+// HandleOTLPTraces handles OTLP/HTTP trace exports (protobuf or JSON)
+func (s *Server) HandleOTLPTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The request is decoded into new values, so the buffer can go back
+	// to the pool once the handler is done
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	body := buf.Bytes()
+
+	var data otlp.TracesData
+	isProto := isProtobuf(r)
+	if isProto {
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		data = otlp.FromProtoTraces(req)
+	} else if err := json.Unmarshal(body, &data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	spans := otlp.ToSpans(data)
+	log.Printf("Received OTLP batch of %d spans", len(spans))
+
+	// Process spans asynchronously
+	stampSpans(r.Context(), spans)
+	if !s.admit(w, requestTenant(r), signalSpans, s.quotas.AdmitSpans(spans)) {
+		return
+	}
+	if !s.enqueue(w, func() { s.processor.ProcessSpans(spans) }) {
+		s.quotas.RefundSpans(spans)
+		return
+	}
+
+	writeOTLPResponse(w, isProto, &coltracepb.ExportTraceServiceResponse{})
+}
+
+// HandleOTLPMetrics handles OTLP/HTTP metric exports (protobuf or JSON)
+func (s *Server) HandleOTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The request is decoded into new values, so the buffer can go back
+	// to the pool once the handler is done
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, err := buf.ReadFrom(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	body := buf.Bytes()
+
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	isProto := isProtobuf(r)
+	if isProto {
+		err = proto.Unmarshal(body, req)
+	} else {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, req)
+	}
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	metrics := otlp.ToMetrics(req)
+	stampMetrics(r.Context(), metrics)
+	if !s.admit(w, requestTenant(r), signalMetrics, s.quotas.AdmitMetrics(metrics)) {
+		return
+	}
+
+	// Process metrics asynchronously
+	if !s.enqueue(w, func() { s.processor.ProcessMetrics(metrics) }) {
+		s.quotas.RefundMetrics(metrics)
+		return
+	}
+
+	writeOTLPResponse(w, isProto, &colmetricspb.ExportMetricsServiceResponse{})
+}
+
+func isProtobuf(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeProtobuf)
+}
+
+// writeOTLPResponse writes an empty export response in the request's encoding
+func writeOTLPResponse(w http.ResponseWriter, isProto bool, resp proto.Message) {
+	var (
+		data []byte
+		err  error
+	)
+	if isProto {
+		w.Header().Set("Content-Type", contentTypeProtobuf)
+		data, err = proto.Marshal(resp)
+	} else {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		data, err = protojson.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// OTLPGRPCServer implements the OTLP/gRPC trace and metrics services
+type OTLPGRPCServer struct {
+	processor *Processor
+	queue     *Queue
+	quotas    *Quotas
+}
+
+// NewOTLPGRPCServer creates a new OTLP/gRPC receiver that processes exports
+// on queue. Exports are rejected with Unavailable when the queue is full, so
+// OTLP clients retry with backoff, and with ResourceExhausted when their
+// tenant is over its quota (quotas may be nil).
+func NewOTLPGRPCServer(processor *Processor, queue *Queue, quotas *Quotas) *OTLPGRPCServer {
+	return &OTLPGRPCServer{processor: processor, queue: queue, quotas: quotas}
+}
+
+// ServerOptions returns the gRPC server options needed by the receiver: an
+// interceptor resolving the tenant and, when auth is non-nil, enforcing
+// token auth, and when sources is non-nil, filtering sources
+func ServerOptions(auth *TokenAuthenticator, sources *SourceFilter) []grpc.ServerOption {
+	return []grpc.ServerOption{grpc.UnaryInterceptor(auth.UnaryServerInterceptor(sources))}
+}
+
+// Register registers the OTLP trace and metrics services on a gRPC server
+func (s *OTLPGRPCServer) Register(gs *grpc.Server) {
+	coltracepb.RegisterTraceServiceServer(gs, otlpTraceService{processor: s.processor, queue: s.queue, quotas: s.quotas})
+	colmetricspb.RegisterMetricsServiceServer(gs, otlpMetricsService{processor: s.processor, queue: s.queue, quotas: s.quotas})
+}
+
+type otlpTraceService struct {
+	coltracepb.UnimplementedTraceServiceServer
+	processor *Processor
+	queue     *Queue
+	quotas    *Quotas
+}
+
+// Export implements the OTLP TraceService
+func (s otlpTraceService) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	spans := otlp.ToSpans(otlp.FromProtoTraces(req))
+	stampSpans(ctx, spans)
+	if err := s.quotas.AdmitSpans(spans); err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err := s.queue.Submit(func() { s.processor.ProcessSpans(spans) }); err != nil {
+		s.quotas.RefundSpans(spans)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+type otlpMetricsService struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	processor *Processor
+	queue     *Queue
+	quotas    *Quotas
+}
+
+// Export implements the OTLP MetricsService
+func (s otlpMetricsService) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	metrics := otlp.ToMetrics(req)
+	stampMetrics(ctx, metrics)
+	if err := s.quotas.AdmitMetrics(metrics); err != nil {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err := s.queue.Submit(func() { s.processor.ProcessMetrics(metrics) }); err != nil {
+		s.quotas.RefundMetrics(metrics)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
@@ -0,0 +1,60 @@
+package ingestion
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// The ingestion hot path recycles its short-lived buffers instead of
+// allocating them per request, so that bursts don't turn into GC pauses.
+// Buffers that grew past these caps are left to the GC rather than pinned
+// in a pool.
+const (
+	maxPooledSpans = 1 << 14
+	maxPooledBytes = 4 << 20
+)
+
+var (
+	// spanSlices holds span slices that batches are decoded into and split
+	// across the span workers. Their spans are copied onward, so a slice
+	// is free again once it has been handed on.
+	spanSlices = sync.Pool{New: func() any { return new([]models.Span) }}
+	// bodyBuffers holds the buffers OTLP/HTTP bodies are read into
+	bodyBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	// gzipReaders holds the *gzip.Reader of gzip-encoded request bodies
+	gzipReaders sync.Pool
+)
+
+// getSpans returns an empty span slice from the pool
+func getSpans() []models.Span {
+	return (*spanSlices.Get().(*[]models.Span))[:0]
+}
+
+// putSpans returns a span slice to the pool. The caller must not use it,
+// or any slice sharing its array, afterwards.
+func putSpans(spans []models.Span) {
+	if cap(spans) == 0 || cap(spans) > maxPooledSpans {
+		return
+	}
+	// Drop the spans' strings and maps for the GC
+	clear(spans[:cap(spans)])
+	spans = spans[:0]
+	spanSlices.Put(&spans)
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns a buffer to the pool once nothing refers to its bytes
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBytes {
+		return
+	}
+	bodyBuffers.Put(buf)
+}
@@ -1,42 +1,573 @@
 package ingestion
 
 import (
+	"hash/fnv"
 	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/omnitrace/omnitrace/backend/forwarder"
+	"github.com/omnitrace/omnitrace/backend/replication"
 	"github.com/omnitrace/omnitrace/backend/storage"
 	"github.com/omnitrace/omnitrace/internal/models"
 )
 
-// Processor processes incoming data before storage
+// ProcessorStats counts spans written by the processor
+type ProcessorStats struct {
+	Stored uint64 `json:"stored"`
+	Routed uint64 `json:"routed,omitempty"`
+	// Replicas counts the stored spans that peers replicated here
+	Replicas   uint64      `json:"replicas,omitempty"`
+	Duplicates uint64      `json:"duplicates"`
+	Queued     int         `json:"queued"`
+	Spill      *SpillStats `json:"spill,omitempty"`
+}
+
+// Default span write batching settings
+const (
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = 100 * time.Millisecond
+	// DefaultWriteQueueSize is the number of batches each span worker
+	// buffers before spilling or applying backpressure
+	DefaultWriteQueueSize = 256
+)
+
+// Processor processes incoming data before storage. Spans are sharded by
+// trace ID across a fixed pool of workers, which buffer them and write each
+// tenant's spans to storage in batches. Each worker has a bounded queue;
+// when a storage stall fills it, batches spill to disk (if configured) and
+// are replayed once the worker catches up, instead of blocking ingestion.
 type Processor struct {
-	spanStore   *storage.SpanStore
-	metricStore *storage.MetricStore
+	stores      *storage.TenantStores
+	grouper     *ErrorGrouper
+	graph       *ServiceGraphBuilder
+	forwarder   *forwarder.Forwarder
+	router      SpanRouter
+	replicator  *replication.Replicator
+	validator   *Validator
+	redactor    *Redactor
+	spanMetrics *SpanMetrics
+	observers   []SpanObserver
+
+	workers       int
+	batchSize     int
+	flushInterval time.Duration
+	queueSize     int
+	shards        []chan []models.Span
+	wg            sync.WaitGroup
+
+	spill      *Spill
+	stopReplay chan struct{}
+	replayDone chan struct{}
+
+	stored     atomic.Uint64
+	routed     atomic.Uint64
+	replicas   atomic.Uint64
+	duplicates atomic.Uint64
+
+	// mu guards closed. Senders to the shards register in sending while
+	// holding it, and Close waits for them before closing the shards, so
+	// that no one holds it while a full shard blocks.
+	mu        sync.RWMutex
+	closed    bool
+	sending   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// SpanObserver is notified of each tenant's newly stored spans
+type SpanObserver interface {
+	Observe(tenant string, spans []models.Span)
+}
+
+// SpanRouter sends spans to the collectors that store them, such as the
+// shards of a cluster
+type SpanRouter interface {
+	Route(spans []models.Span)
+}
+
+// ProcessorOption is a function that configures a Processor
+type ProcessorOption func(*Processor)
+
+// WithForwarder forwards every stored span batch to a downstream endpoint
+func WithForwarder(f *forwarder.Forwarder) ProcessorOption {
+	return func(p *Processor) {
+		p.forwarder = f
+	}
+}
+
+// WithRouter routes spans to other collectors instead of storing them.
+// Span metrics, error groups and observers still see the routed spans;
+// the service graph is left to the collectors storing them, which can
+// pair spans with their parents.
+func WithRouter(r SpanRouter) ProcessorOption {
+	return func(p *Processor) {
+		p.router = r
+	}
+}
+
+// WithReplicator replicates every stored span batch to peer collectors.
+// Spans stored as replicas of a peer's aren't replicated again.
+func WithReplicator(r *replication.Replicator) ProcessorOption {
+	return func(p *Processor) {
+		p.replicator = r
+	}
+}
+
+// WithValidator replaces the default span validator
+func WithValidator(v *Validator) ProcessorOption {
+	return func(p *Processor) {
+		if v != nil {
+			p.validator = v
+		}
+	}
+}
+
+// WithRedactor scrubs sensitive tag, log and error message values from
+// spans and error events before they are stored or forwarded
+func WithRedactor(r *Redactor) ProcessorOption {
+	return func(p *Processor) {
+		p.redactor = r
+	}
+}
+
+// WithSpanMetrics derives request, error and duration metrics from stored
+// spans
+func WithSpanMetrics(g *SpanMetrics) ProcessorOption {
+	return func(p *Processor) {
+		p.spanMetrics = g
+	}
+}
+
+// WithObserver notifies o of every batch of newly stored spans, e.g. to feed
+// live tails
+func WithObserver(o SpanObserver) ProcessorOption {
+	return func(p *Processor) {
+		p.observers = append(p.observers, o)
+	}
+}
+
+// WithWorkers sets the number of span write workers (default: one per CPU)
+func WithWorkers(n int) ProcessorOption {
+	return func(p *Processor) {
+		if n > 0 {
+			p.workers = n
+		}
+	}
+}
+
+// WithBatchSize sets the number of buffered spans that triggers a write
+func WithBatchSize(n int) ProcessorOption {
+	return func(p *Processor) {
+		if n > 0 {
+			p.batchSize = n
+		}
+	}
+}
+
+// WithFlushInterval sets how long spans may stay buffered before a write
+func WithFlushInterval(d time.Duration) ProcessorOption {
+	return func(p *Processor) {
+		if d > 0 {
+			p.flushInterval = d
+		}
+	}
 }
 
-// NewProcessor creates a new processor
-func NewProcessor(spanStore *storage.SpanStore, metricStore *storage.MetricStore) *Processor {
-	return &Processor{
-		spanStore:   spanStore,
-		metricStore: metricStore,
+// WithWriteQueueSize sets the number of batches each span worker buffers
+func WithWriteQueueSize(n int) ProcessorOption {
+	return func(p *Processor) {
+		if n > 0 {
+			p.queueSize = n
+		}
 	}
 }
 
-// ProcessSpans normalizes and stores spans
+// WithSpill spills span batches to disk when the write queues are full
+func WithSpill(s *Spill) ProcessorOption {
+	return func(p *Processor) {
+		p.spill = s
+	}
+}
+
+// NewProcessor creates a new processor and starts its span workers. Data is
+// routed to the stores of the tenant recorded on each span, metric or error
+// event.
+func NewProcessor(stores *storage.TenantStores, opts ...ProcessorOption) *Processor {
+	p := &Processor{
+		stores:        stores,
+		grouper:       NewErrorGrouper(stores),
+		graph:         NewServiceGraphBuilder(stores),
+		validator:     NewValidator(DefaultValidatorConfig()),
+		workers:       runtime.NumCPU(),
+		batchSize:     DefaultBatchSize,
+		flushInterval: DefaultFlushInterval,
+		queueSize:     DefaultWriteQueueSize,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.shards = make([]chan []models.Span, p.workers)
+	p.wg.Add(p.workers)
+	for i := range p.shards {
+		p.shards[i] = make(chan []models.Span, p.queueSize)
+		go p.spanWorker(p.shards[i])
+	}
+
+	if p.spill != nil {
+		p.stopReplay = make(chan struct{})
+		p.replayDone = make(chan struct{})
+		go func() {
+			defer close(p.replayDone)
+			p.spill.Replay(p.stopReplay, p.dispatch)
+		}()
+	}
+	return p
+}
+
+// ProcessSpans validates and redacts spans and hands them to the span
+// workers. Spans of the same trace always go to the same worker so they
+// are written together.
 func (p *Processor) ProcessSpans(spans []models.Span) {
+	valid := getSpans()
+	defer putSpans(valid)
+	for _, span := range spans {
+		if _, ok := p.validator.Validate(&span); ok {
+			valid = append(valid, span)
+		}
+	}
+	p.ProcessValidSpans(valid)
+}
+
+// ValidateSpans validates spans ahead of ProcessValidSpans, for callers
+// that report rejections. It moves the valid spans, normalized, to the
+// front of spans and returns them with the rejections, whose indexes are
+// positions in spans.
+func (p *Processor) ValidateSpans(spans []models.Span) ([]models.Span, []models.IngestError) {
+	var rejected []models.IngestError
+	n := 0
+	for i := range spans {
+		if reason, ok := p.validator.Validate(&spans[i]); !ok {
+			rejected = append(rejected, models.IngestError{Index: i, Reason: reason})
+			continue
+		}
+		spans[n] = spans[i]
+		n++
+	}
+	clear(spans[n:])
+	return spans[:n], rejected
+}
+
+// ProcessValidSpans is ProcessSpans for spans that ValidateSpans passed.
+// Redaction writes to the spans in place.
+func (p *Processor) ProcessValidSpans(spans []models.Span) {
+	if p.redactor != nil {
+		for i := range spans {
+			p.redactor.RedactSpan(&spans[i])
+		}
+	}
+
+	if !p.beginSend() {
+		log.Printf("Processor closed, dropping %d spans", len(spans))
+		return
+	}
+	defer p.sending.Done()
+
+	var overflow []models.Span
+	for i, batch := range p.shardBatches(spans) {
+		if len(batch) == 0 {
+			continue
+		}
+		if p.spill == nil {
+			p.shards[i] <- batch
+			continue
+		}
+		select {
+		case p.shards[i] <- batch:
+		default:
+			overflow = append(overflow, batch...)
+			putSpans(batch)
+		}
+	}
+	if len(overflow) > 0 {
+		if err := p.spill.Write(overflow); err != nil {
+			log.Printf("Failed to spill %d spans: %v", len(overflow), err)
+		}
+	}
+}
+
+// dispatch hands spans replayed from the spill to the span workers,
+// waiting for queue space
+func (p *Processor) dispatch(spans []models.Span) {
+	if !p.beginSend() {
+		return
+	}
+	defer p.sending.Done()
+
+	for i, batch := range p.shardBatches(spans) {
+		if len(batch) > 0 {
+			p.shards[i] <- batch
+		}
+	}
+}
+
+// beginSend registers a sender to the shards, which calls p.sending.Done
+// when it is done, or returns false once the processor is closed
+func (p *Processor) beginSend() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	p.sending.Add(1)
+	return true
+}
+
+// shardBatches splits spans into one batch per span worker. The batches
+// come from the span slice pool, and the worker receiving one returns it.
+func (p *Processor) shardBatches(spans []models.Span) [][]models.Span {
+	batches := make([][]models.Span, len(p.shards))
+	for _, span := range spans {
+		i := p.shardFor(span.TraceID)
+		if batches[i] == nil {
+			batches[i] = getSpans()
+		}
+		batches[i] = append(batches[i], span)
+	}
+	return batches
+}
+
+// ValidationStats returns the span validator's accept/reject counters
+func (p *Processor) ValidationStats() ValidationStats {
+	return p.validator.Stats()
+}
+
+// Stats returns the processor's span write counters
+func (p *Processor) Stats() ProcessorStats {
+	stats := ProcessorStats{
+		Stored:     p.stored.Load(),
+		Routed:     p.routed.Load(),
+		Replicas:   p.replicas.Load(),
+		Duplicates: p.duplicates.Load(),
+	}
+	for _, shard := range p.shards {
+		stats.Queued += len(shard)
+	}
+	if p.spill != nil {
+		spill := p.spill.Stats()
+		stats.Spill = &spill
+	}
+	return stats
+}
+
+// Close stops the span workers after writing all buffered spans. Spilled
+// spans not yet replayed stay on disk for the next start.
+func (p *Processor) Close() {
+	p.closeOnce.Do(func() {
+		// Stop replaying first: replay sends to the shards closed below
+		if p.spill != nil {
+			close(p.stopReplay)
+			<-p.replayDone
+		}
+
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+
+		// Senders blocked on a full shard get through as the workers
+		// drain it
+		p.sending.Wait()
+		for _, shard := range p.shards {
+			close(shard)
+		}
+
+		p.wg.Wait()
+
+		if p.spill != nil {
+			if err := p.spill.Close(); err != nil {
+				log.Printf("Failed to close spill: %v", err)
+			}
+		}
+	})
+}
+
+func (p *Processor) shardFor(traceID models.TraceID) int {
+	h := fnv.New32a()
+	h.Write(traceID[:])
+	return int(h.Sum32() % uint32(len(p.shards)))
+}
+
+// spanWorker buffers spans until the batch size or flush interval is
+// reached, then writes them
+func (p *Processor) spanWorker(in <-chan []models.Span) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	var pending []models.Span
+	for {
+		select {
+		case batch, ok := <-in:
+			if !ok {
+				p.writeSpans(pending)
+				return
+			}
+			pending = append(pending, batch...)
+			putSpans(batch)
+			if len(pending) >= p.batchSize {
+				p.writeSpans(pending)
+				pending = reuse(pending)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				p.writeSpans(pending)
+				pending = reuse(pending)
+			}
+		}
+	}
+}
+
+// reuse empties a buffer of written spans for the next batch. Everything
+// writeSpans hands the spans to copies them.
+func reuse(pending []models.Span) []models.Span {
+	clear(pending)
+	return pending[:0]
+}
+
+// writeSpans stores or routes spans, then derives span metrics from and
+// forwards the spans that weren't duplicates of stored ones. Stored spans
+// are also replicated to the peers.
+func (p *Processor) writeSpans(spans []models.Span) {
+	var written []models.Span
+	if p.router != nil {
+		written = p.routeSpans(spans)
+	} else {
+		written = p.storeSpans(spans)
+		if p.replicator != nil {
+			p.replicator.Replicate(written)
+		}
+	}
+
+	if p.spanMetrics != nil {
+		p.ProcessMetrics(p.spanMetrics.Generate(written))
+	}
+
+	if p.forwarder != nil && len(written) > 0 {
+		p.forwarder.Forward(written)
+	}
+}
+
+// routeSpans hands spans to the router, then notifies the observers and
+// records errors. Duplicates can't be told apart here and are passed on.
+func (p *Processor) routeSpans(spans []models.Span) []models.Span {
+	if len(spans) == 0 {
+		return nil
+	}
+	p.router.Route(spans)
+	p.routed.Add(uint64(len(spans)))
+
+	byTenant := make(map[string][]models.Span)
+	for _, span := range spans {
+		byTenant[span.TenantID] = append(byTenant[span.TenantID], span)
+	}
+	// The shards store the spans, but errors and metrics derived from
+	// them are kept here
+	for tenant := range byTenant {
+		p.stores.Open(tenant)
+	}
 	for _, span := range spans {
-		// Basic validation could go here
-		if span.TraceID == "" || span.SpanID == "" {
+		p.grouper.ObserveSpan(span)
+	}
+	for tenant, tenantSpans := range byTenant {
+		for _, o := range p.observers {
+			o.Observe(tenant, tenantSpans)
+		}
+	}
+	return spans
+}
+
+// storeSpans stores spans with one batch write per tenant, then updates
+// the service graph and records errors. It returns the spans that weren't
+// duplicates of stored ones.
+func (p *Processor) storeSpans(spans []models.Span) []models.Span {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	byTenant := make(map[string][]models.Span)
+	for _, span := range spans {
+		byTenant[span.TenantID] = append(byTenant[span.TenantID], span)
+	}
+	stored := make([]models.Span, 0, len(spans))
+	for tenant, tenantSpans := range byTenant {
+		p.stores.Open(tenant)
+		added, err := p.stores.Spans(tenant).StoreBatch(tenantSpans)
+		if err != nil {
+			log.Printf("Failed to store %d spans: %v", len(tenantSpans), err)
 			continue
 		}
+		p.graph.Observe(tenant, added)
+		for _, o := range p.observers {
+			o.Observe(tenant, added)
+		}
+		p.stored.Add(uint64(len(added)))
+		p.duplicates.Add(uint64(len(tenantSpans) - len(added)))
+		stored = append(stored, added...)
+	}
 
-		log.Printf("Storing span: %s", span.TraceID)
+	for _, span := range stored {
+		p.grouper.ObserveSpan(span)
+	}
+	return stored
+}
 
-		// In a real system, we might enrich with geo-ip, etc.
+// RestoreSpans validates spans read from a backup and stores them right
+// away rather than through the span workers. Span metrics are not derived
+// from them, as the backup holds the metrics derived at the time, and they
+// aren't forwarded. It returns how many spans were stored, leaving out
+// invalid spans and those already stored. With a router, the valid spans
+// are routed instead and all counted.
+func (p *Processor) RestoreSpans(spans []models.Span) int {
+	valid := p.validSpans(spans)
+	if p.router != nil {
+		p.router.Route(valid)
+		p.routed.Add(uint64(len(valid)))
+		return len(valid)
+	}
+	return len(p.storeSpans(valid))
+}
 
-		if err := p.spanStore.Store(span); err != nil {
-			log.Printf("Failed to store span: %v", err)
+// StoreReplicas validates spans replicated by a peer collector and stores
+// them right away. Span metrics are derived from them, so that this
+// collector's metrics cover the peer's traffic when queries fail over to
+// it, but they are neither forwarded nor replicated again: the peer does
+// both. It returns how many spans were stored.
+func (p *Processor) StoreReplicas(spans []models.Span) int {
+	stored := p.storeSpans(p.validSpans(spans))
+	p.replicas.Add(uint64(len(stored)))
+	if p.spanMetrics != nil {
+		p.ProcessMetrics(p.spanMetrics.Generate(stored))
+	}
+	return len(stored)
+}
+
+// validSpans returns the spans stored before that pass validation,
+// redacted
+func (p *Processor) validSpans(spans []models.Span) []models.Span {
+	valid := make([]models.Span, 0, len(spans))
+	for _, span := range spans {
+		if _, ok := p.validator.ValidateStored(&span); !ok {
+			continue
+		}
+		if p.redactor != nil {
+			p.redactor.RedactSpan(&span)
 		}
+		valid = append(valid, span)
 	}
+	return valid
 }
 
 // ProcessMetrics aggregates and stores metrics
@@ -46,8 +577,31 @@ func (p *Processor) ProcessMetrics(metrics []models.Metric) {
 			continue
 		}
 
-		if err := p.metricStore.Store(metric); err != nil {
+		p.stores.Open(metric.TenantID)
+		if err := p.stores.Metrics(metric.TenantID).Store(metric); err != nil {
 			log.Printf("Failed to store metric: %v", err)
 		}
 	}
 }
+
+// ProcessErrors redacts and stores standalone error events
+func (p *Processor) ProcessErrors(events []models.ErrorEvent) {
+	for _, event := range events {
+		if event.Message == "" {
+			continue
+		}
+		if event.Timestamp.IsZero() {
+			event.Timestamp = time.Now()
+		}
+		if p.redactor != nil {
+			p.redactor.RedactErrorEvent(&event)
+		}
+
+		p.stores.Open(event.TenantID)
+		if err := p.stores.Errors(event.TenantID).Store(event); err != nil {
+			log.Printf("Failed to store error event: %v", err)
+		}
+
+		p.grouper.ObserveEvent(event)
+	}
+}
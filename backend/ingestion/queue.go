@@ -0,0 +1,137 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Default ingestion queue settings
+const (
+	DefaultQueueSize = 1000
+	// retryAfterSeconds is the Retry-After hint sent when the queue is full
+	retryAfterSeconds = 1
+)
+
+// ErrQueueFull is returned by Submit when the queue has no free slot
+var ErrQueueFull = errors.New("ingestion queue full")
+
+// QueueStats is a snapshot of ingestion queue activity
+type QueueStats struct {
+	Depth     int    `json:"depth"`
+	Capacity  int    `json:"capacity"`
+	Workers   int    `json:"workers"`
+	Submitted uint64 `json:"submitted"`
+	Rejected  uint64 `json:"rejected"`
+	Processed uint64 `json:"processed"`
+}
+
+// Queue is a bounded work queue drained by a fixed pool of workers. It
+// replaces one goroutine per request so that a burst of ingestion traffic
+// is rejected instead of exhausting memory.
+type Queue struct {
+	jobs    chan func()
+	workers int
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+
+	submitted atomic.Uint64
+	rejected  atomic.Uint64
+	processed atomic.Uint64
+}
+
+// NewQueue creates a queue holding up to size pending jobs and starts its
+// workers. Non-positive values fall back to DefaultQueueSize and one worker
+// per CPU.
+func NewQueue(size, workers int) *Queue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	q := &Queue{
+		jobs:    make(chan func(), size),
+		workers: workers,
+	}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Submit enqueues job without blocking. It returns ErrQueueFull when the
+// queue is full or closed.
+func (q *Queue) Submit(job func()) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		q.rejected.Add(1)
+		return ErrQueueFull
+	}
+	select {
+	case q.jobs <- job:
+		q.submitted.Add(1)
+		return nil
+	default:
+		q.rejected.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Stats returns a snapshot of the queue depth and counters
+func (q *Queue) Stats() QueueStats {
+	return QueueStats{
+		Depth:     len(q.jobs),
+		Capacity:  cap(q.jobs),
+		Workers:   q.workers,
+		Submitted: q.submitted.Load(),
+		Rejected:  q.rejected.Load(),
+		Processed: q.processed.Load(),
+	}
+}
+
+// Close stops accepting jobs and waits for pending jobs to finish
+func (q *Queue) Close() {
+	q.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting jobs and waits for pending jobs to finish or
+// ctx to be done, in which case it returns how many jobs were left. The
+// workers keep draining them in the background.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w with %d requests pending", ctx.Err(), len(q.jobs))
+	}
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		job()
+		q.processed.Add(1)
+	}
+}
@@ -0,0 +1,326 @@
+package ingestion
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Quota limits what a tenant may ingest. Daily quotas reset at midnight
+// UTC; throughput quotas allow a second's worth of burst. Zero means no
+// limit.
+type Quota struct {
+	SpansPerDay      int64 `json:"spans_per_day,omitempty"`
+	SpansPerSecond   int64 `json:"spans_per_second,omitempty"`
+	MetricsPerDay    int64 `json:"metrics_per_day,omitempty"`
+	MetricsPerSecond int64 `json:"metrics_per_second,omitempty"`
+}
+
+// Signals counted against quotas
+const (
+	signalSpans   = "spans"
+	signalMetrics = "metrics"
+)
+
+// QuotaError reports a batch rejected because its tenant is over quota
+type QuotaError struct {
+	Tenant string
+	Signal string // "spans" or "metrics"
+	Period string // "day" or "second"
+	Limit  int64
+	// Remaining is what is left of a daily quota
+	Remaining int64
+	// RetryAfter is when the batch would fit again: at the next day for
+	// daily quotas, once the throughput debt is paid for throughput quotas
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("tenant %s is over its quota of %d %s per %s", e.Tenant, e.Limit, e.Signal, e.Period)
+}
+
+// ServiceUsage counts what a service ingested today
+type ServiceUsage struct {
+	Spans   int64 `json:"spans"`
+	Metrics int64 `json:"metrics"`
+}
+
+// TenantUsage reports what a tenant ingested today and since the collector
+// started, and the batches rejected over quota
+type TenantUsage struct {
+	// Day is the UTC day the daily counts are for
+	Day             string                  `json:"day"`
+	Spans           int64                   `json:"spans"`
+	Metrics         int64                   `json:"metrics"`
+	TotalSpans      int64                   `json:"total_spans"`
+	TotalMetrics    int64                   `json:"total_metrics"`
+	RejectedSpans   int64                   `json:"rejected_spans"`
+	RejectedMetrics int64                   `json:"rejected_metrics"`
+	Quota           Quota                   `json:"quota"`
+	Services        map[string]ServiceUsage `json:"services"`
+}
+
+// tokenBucket limits throughput to rate per second. A batch is admitted
+// while any tokens are left and may take the bucket into debt, so that
+// batches larger than the rate still get through, spaced out.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ready refills the bucket at rate per second and reports whether a batch
+// would be admitted, or how long until it would be
+func (b *tokenBucket) ready(rate int64, now time.Time) (time.Duration, bool) {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	}
+	b.last = now
+	if b.tokens <= 0 {
+		return time.Duration(-b.tokens / float64(rate) * float64(time.Second)), false
+	}
+	return 0, true
+}
+
+// tenantQuotaState is a tenant's usage and throughput buckets
+type tenantQuotaState struct {
+	usage   TenantUsage
+	spans   tokenBucket
+	metrics tokenBucket
+}
+
+// Quotas accounts what each tenant and service ingests, and rejects
+// batches that would take a tenant over its quota
+type Quotas struct {
+	defaults  Quota
+	overrides map[string]Quota
+
+	mu      sync.Mutex
+	tenants map[string]*tenantQuotaState
+}
+
+// NewQuotas creates quotas with default limits and per-tenant overrides.
+// Zero limits only account usage.
+func NewQuotas(defaults Quota, overrides map[string]Quota) *Quotas {
+	return &Quotas{defaults: defaults, overrides: overrides, tenants: make(map[string]*tenantQuotaState)}
+}
+
+// Quota returns the quota of a tenant
+func (q *Quotas) Quota(tenant string) Quota {
+	if quota, ok := q.overrides[tenant]; ok {
+		return quota
+	}
+	return q.defaults
+}
+
+// AdmitSpans charges a batch of spans to their tenants, or rejects the
+// whole batch with a *QuotaError if a tenant is over quota
+func (q *Quotas) AdmitSpans(spans []models.Span) error {
+	return q.admit(signalSpans, len(spans), func(i int) (string, string) {
+		return spans[i].TenantID, spans[i].ServiceName
+	})
+}
+
+// AdmitMetrics charges a batch of metrics like AdmitSpans
+func (q *Quotas) AdmitMetrics(metrics []models.Metric) error {
+	return q.admit(signalMetrics, len(metrics), func(i int) (string, string) {
+		return metrics[i].TenantID, metrics[i].Service
+	})
+}
+
+// admit charges n items, whose tenant and service are returned by item
+func (q *Quotas) admit(signal string, n int, item func(i int) (tenant, service string)) error {
+	if q == nil || n == 0 {
+		return nil
+	}
+	perTenant := make(map[string]int64)
+	for i := range n {
+		tenant, _ := item(i)
+		perTenant[tenant]++
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	// A batch nearly always has one tenant; with several, each is checked
+	// before any is charged
+	for _, tenant := range slices.Sorted(maps.Keys(perTenant)) {
+		if err := q.check(tenant, signal, perTenant[tenant], now); err != nil {
+			return err
+		}
+	}
+	for tenant, count := range perTenant {
+		st, quota := q.state(tenant, now), q.Quota(tenant)
+		if signal == signalSpans && quota.SpansPerSecond > 0 {
+			st.spans.tokens -= float64(count)
+		} else if signal == signalMetrics && quota.MetricsPerSecond > 0 {
+			st.metrics.tokens -= float64(count)
+		}
+	}
+	for i := range n {
+		tenant, service := item(i)
+		st := q.state(tenant, now)
+		su := st.usage.Services[service]
+		if signal == signalSpans {
+			st.usage.Spans++
+			st.usage.TotalSpans++
+			su.Spans++
+		} else {
+			st.usage.Metrics++
+			st.usage.TotalMetrics++
+			su.Metrics++
+		}
+		st.usage.Services[service] = su
+	}
+	return nil
+}
+
+// RefundSpans takes back the charge of a batch of spans admitted by
+// AdmitSpans that was then not accepted, such as when the ingestion queue
+// was full, so that retrying it isn't charged twice
+func (q *Quotas) RefundSpans(spans []models.Span) {
+	q.refund(signalSpans, len(spans), func(i int) (string, string) {
+		return spans[i].TenantID, spans[i].ServiceName
+	})
+}
+
+// RefundMetrics takes back the charge of a batch of metrics like
+// RefundSpans
+func (q *Quotas) RefundMetrics(metrics []models.Metric) {
+	q.refund(signalMetrics, len(metrics), func(i int) (string, string) {
+		return metrics[i].TenantID, metrics[i].Service
+	})
+}
+
+// refund reverses admit's charge of n items. Counts charged on a previous
+// day are gone already and aren't refunded.
+func (q *Quotas) refund(signal string, n int, item func(i int) (tenant, service string)) {
+	if q == nil || n == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for i := range n {
+		tenant, service := item(i)
+		st, quota := q.state(tenant, now), q.Quota(tenant)
+		su := st.usage.Services[service]
+		if signal == signalSpans {
+			st.usage.Spans = max(st.usage.Spans-1, 0)
+			st.usage.TotalSpans = max(st.usage.TotalSpans-1, 0)
+			su.Spans = max(su.Spans-1, 0)
+			if quota.SpansPerSecond > 0 {
+				st.spans.tokens = min(st.spans.tokens+1, float64(quota.SpansPerSecond))
+			}
+		} else {
+			st.usage.Metrics = max(st.usage.Metrics-1, 0)
+			st.usage.TotalMetrics = max(st.usage.TotalMetrics-1, 0)
+			su.Metrics = max(su.Metrics-1, 0)
+			if quota.MetricsPerSecond > 0 {
+				st.metrics.tokens = min(st.metrics.tokens+1, float64(quota.MetricsPerSecond))
+			}
+		}
+		if su == (ServiceUsage{}) {
+			delete(st.usage.Services, service)
+		} else {
+			st.usage.Services[service] = su
+		}
+	}
+}
+
+// check returns why n more items of a signal don't fit a tenant's quota.
+// Callers hold q.mu.
+func (q *Quotas) check(tenant, signal string, n int64, now time.Time) error {
+	st := q.state(tenant, now)
+	quota := q.Quota(tenant)
+	perDay, perSecond, used, bucket, rejected := quota.SpansPerDay, quota.SpansPerSecond, st.usage.Spans, &st.spans, &st.usage.RejectedSpans
+	if signal == signalMetrics {
+		perDay, perSecond, used, bucket, rejected = quota.MetricsPerDay, quota.MetricsPerSecond, st.usage.Metrics, &st.metrics, &st.usage.RejectedMetrics
+	}
+
+	if perDay > 0 && used+n > perDay {
+		*rejected += n
+		return &QuotaError{Tenant: tenant, Signal: signal, Period: "day", Limit: perDay, Remaining: max(perDay-used, 0), RetryAfter: untilNextDay(now)}
+	}
+	if perSecond > 0 {
+		if wait, ok := bucket.ready(perSecond, now); !ok {
+			*rejected += n
+			return &QuotaError{Tenant: tenant, Signal: signal, Period: "second", Limit: perSecond, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// state returns a tenant's quota state, starting a new day's counts when
+// the day has changed. Callers hold q.mu.
+func (q *Quotas) state(tenant string, now time.Time) *tenantQuotaState {
+	day := now.UTC().Format(time.DateOnly)
+	st, ok := q.tenants[tenant]
+	if !ok {
+		st = &tenantQuotaState{}
+		q.tenants[tenant] = st
+	}
+	if st.usage.Day != day {
+		st.usage.Day = day
+		st.usage.Spans, st.usage.Metrics = 0, 0
+		st.usage.RejectedSpans, st.usage.RejectedMetrics = 0, 0
+		st.usage.Services = make(map[string]ServiceUsage)
+	}
+	return st
+}
+
+// remaining returns a tenant's daily quota of a signal and what is left
+// of it, or false if it has none
+func (q *Quotas) remaining(tenant, signal string) (limit, remaining int64, ok bool) {
+	if q == nil {
+		return 0, 0, false
+	}
+	quota := q.Quota(tenant)
+	limit = quota.SpansPerDay
+	if signal == signalMetrics {
+		limit = quota.MetricsPerDay
+	}
+	if limit <= 0 {
+		return 0, 0, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := q.state(tenant, time.Now())
+	used := st.usage.Spans
+	if signal == signalMetrics {
+		used = st.usage.Metrics
+	}
+	return limit, max(limit-used, 0), true
+}
+
+// Usage reports each tenant's usage. Tenants that ingested nothing since
+// the collector started are left out.
+func (q *Quotas) Usage() map[string]TenantUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	usage := make(map[string]TenantUsage, len(q.tenants))
+	for tenant := range q.tenants {
+		u := q.state(tenant, now).usage
+		u.Quota = q.Quota(tenant)
+		u.Services = maps.Clone(u.Services)
+		usage[tenant] = u
+	}
+	return usage
+}
+
+// untilNextDay returns the time left until midnight UTC
+func untilNextDay(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
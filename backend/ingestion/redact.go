@@ -0,0 +1,227 @@
+package ingestion
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// RedactMode selects what happens to a sensitive value
+type RedactMode string
+
+const (
+	// RedactHash replaces sensitive values with a keyed hash, so equal
+	// values can still be correlated
+	RedactHash RedactMode = "hash"
+	// RedactRemove deletes deny-listed tags and masks pattern matches
+	RedactRemove RedactMode = "remove"
+)
+
+// redactedValue replaces pattern matches in RedactRemove mode
+const redactedValue = "[REDACTED]"
+
+// BuiltinRedactPatterns are the value patterns available by name
+var BuiltinRedactPatterns = map[string]string{
+	"email":        `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	"credit_card":  `\b(?:\d[ \-]?){12,18}\d\b`,
+	"bearer_token": `(?i)bearer\s+[A-Za-z0-9\-._~+/]+=*`,
+	"jwt":          `\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\b`,
+	"ssn":          `\b\d{3}-\d{2}-\d{4}\b`,
+}
+
+// RedactorConfig configures attribute redaction
+type RedactorConfig struct {
+	// Keys are tag and log field keys whose values are always redacted,
+	// matched case-insensitively
+	Keys []string
+	// Patterns are built-in pattern names or regular expressions matched
+	// against every tag and log field value
+	Patterns []string
+	Mode     RedactMode
+	// Salt keys the hash in RedactHash mode so that hashes of low-entropy
+	// values can't be reversed by guessing
+	Salt string
+}
+
+// Redactor scrubs sensitive span tag and log field values, and values in
+// status and error messages, before storage
+type Redactor struct {
+	keys     map[string]bool
+	patterns []*regexp.Regexp
+	mode     RedactMode
+	salt     []byte
+}
+
+// NewRedactor compiles a redactor. Patterns that name a built-in pattern
+// use it; anything else is compiled as a regular expression.
+func NewRedactor(cfg RedactorConfig) (*Redactor, error) {
+	r := &Redactor{
+		keys: make(map[string]bool, len(cfg.Keys)),
+		mode: cfg.Mode,
+		salt: []byte(cfg.Salt),
+	}
+	if r.mode == "" {
+		r.mode = RedactHash
+	}
+	if r.mode != RedactHash && r.mode != RedactRemove {
+		return nil, fmt.Errorf("unknown redaction mode %q", cfg.Mode)
+	}
+
+	for _, key := range cfg.Keys {
+		r.keys[strings.ToLower(key)] = true
+	}
+	for _, pattern := range cfg.Patterns {
+		if builtin, ok := BuiltinRedactPatterns[pattern]; ok {
+			pattern = builtin
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// RedactSpan scrubs the tags, log fields, link tags, status message and
+// error details of span in place. Tags maps, error info and stack traces
+// are copied before being written.
+func (r *Redactor) RedactSpan(span *models.Span) {
+	if tags, changed := r.redactFields(span.Tags); changed {
+		span.Tags = tags
+	}
+	span.StatusMessage = r.redactValue(span.StatusMessage)
+	if span.ErrorInfo != nil {
+		span.ErrorInfo = r.redactErrorInfo(span.ErrorInfo)
+	}
+	for i := range span.Logs {
+		if fields, changed := r.redactFields(span.Logs[i].Fields); changed {
+			span.Logs[i].Fields = fields
+		}
+	}
+	for i := range span.Links {
+		if tags, changed := r.redactFields(span.Links[i].Tags); changed {
+			span.Links[i].Tags = tags
+		}
+	}
+}
+
+// RedactErrorEvent scrubs the message, stack trace and tags of a
+// standalone error event in place, copying its tags and stack trace before
+// writing them
+func (r *Redactor) RedactErrorEvent(event *models.ErrorEvent) {
+	event.Message = r.redactValue(event.Message)
+	event.StackTrace = r.redactLines(event.StackTrace)
+	if tags, changed := r.redactFields(event.Tags); changed {
+		event.Tags = tags
+	}
+}
+
+// redactErrorInfo returns a copy of info with the value patterns applied
+// to its message, causes and stack trace, or info itself if none matched
+func (r *Redactor) redactErrorInfo(info *models.ErrorInfo) *models.ErrorInfo {
+	redacted := *info
+	redacted.Message = r.redactValue(info.Message)
+	redacted.StackTrace = r.redactLines(info.StackTrace)
+	changed := redacted.Message != info.Message || !slices.Equal(redacted.StackTrace, info.StackTrace)
+	causesCopied := false
+	for i, cause := range info.Causes {
+		message := r.redactValue(cause.Message)
+		if message == cause.Message {
+			continue
+		}
+		if !causesCopied {
+			redacted.Causes = slices.Clone(info.Causes)
+			causesCopied = true
+		}
+		redacted.Causes[i].Message = message
+	}
+	changed = changed || causesCopied
+	if !changed {
+		return info
+	}
+	return &redacted
+}
+
+// redactLines returns lines with the value patterns applied, copied if
+// any matched
+func (r *Redactor) redactLines(lines []string) []string {
+	var out []string
+	for i, line := range lines {
+		if redacted := r.redactValue(line); redacted != line {
+			if out == nil {
+				out = append([]string(nil), lines...)
+			}
+			out[i] = redacted
+		}
+	}
+	if out == nil {
+		return lines
+	}
+	return out
+}
+
+// redactValue applies the value patterns to v
+func (r *Redactor) redactValue(v string) string {
+	for _, re := range r.patterns {
+		v = re.ReplaceAllStringFunc(v, func(match string) string {
+			if r.mode == RedactRemove {
+				return redactedValue
+			}
+			return r.hash(match)
+		})
+	}
+	return v
+}
+
+// redactFields returns a scrubbed copy of fields and whether anything was
+// redacted
+func (r *Redactor) redactFields(fields map[string]string) (map[string]string, bool) {
+	var out map[string]string
+	set := func(k, v string, keep bool) {
+		if out == nil {
+			out = make(map[string]string, len(fields))
+			for fk, fv := range fields {
+				out[fk] = fv
+			}
+		}
+		if keep {
+			out[k] = v
+		} else {
+			delete(out, k)
+		}
+	}
+
+	for k, v := range fields {
+		if r.keys[strings.ToLower(k)] {
+			if r.mode == RedactRemove {
+				set(k, "", false)
+			} else {
+				set(k, r.hash(v), true)
+			}
+			continue
+		}
+
+		if redacted := r.redactValue(v); redacted != v {
+			set(k, redacted, true)
+		}
+	}
+
+	if out == nil {
+		return fields, false
+	}
+	return out, true
+}
+
+// hash returns a short keyed digest of value
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
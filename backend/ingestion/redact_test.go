@@ -0,0 +1,124 @@
+package ingestion
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+const testEmail = "alice@example.com"
+
+// newRedactingProcessor returns a processor removing email addresses, over
+// fresh stores
+func newRedactingProcessor(t *testing.T) (*Processor, *storage.TenantStores) {
+	t.Helper()
+	stores, err := storage.NewTenantStores(storage.TenantConfig{
+		MaxSpans:  1000,
+		SpanTTL:   time.Hour,
+		MaxErrors: 1000,
+		ErrorTTL:  time.Hour,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stores.Close() })
+	redactor, err := NewRedactor(RedactorConfig{Patterns: []string{"email"}, Mode: RedactRemove})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProcessor(stores, WithRedactor(redactor), WithWorkers(1)), stores
+}
+
+func TestRedactSpanErrorText(t *testing.T) {
+	r, err := NewRedactor(RedactorConfig{Patterns: []string{"email"}, Mode: RedactRemove})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &models.ErrorInfo{
+		Message:    "no account for " + testEmail,
+		StackTrace: []string{"main.lookup(" + testEmail + ")", "main.main()"},
+		Causes:     []models.ErrorCause{{Type: "*errors.errorString", Message: "user " + testEmail + " not found"}},
+	}
+	original := *info
+	span := models.Span{StatusMessage: "lookup of " + testEmail + " failed", ErrorInfo: info}
+	r.RedactSpan(&span)
+
+	for _, text := range append([]string{span.StatusMessage, span.ErrorInfo.Message, span.ErrorInfo.Causes[0].Message}, span.ErrorInfo.StackTrace...) {
+		if strings.Contains(text, testEmail) {
+			t.Errorf("email not redacted from %q", text)
+		}
+	}
+	if span.ErrorInfo.StackTrace[1] != "main.main()" {
+		t.Errorf("unmatched stack frame changed to %q", span.ErrorInfo.StackTrace[1])
+	}
+	if info.Message != original.Message || info.StackTrace[0] != original.StackTrace[0] || info.Causes[0].Message != "user "+testEmail+" not found" {
+		t.Errorf("the span's original error info was written to: %+v", info)
+	}
+}
+
+func TestProcessSpansRedactsStatusMessage(t *testing.T) {
+	p, stores := newRedactingProcessor(t)
+	traceID, _ := models.ParseTraceID("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := models.ParseSpanID("00f067aa0ba902b7")
+	start := time.Now().Add(-time.Second)
+	p.ProcessSpans([]models.Span{{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: "GET /account",
+		ServiceName:   "accounts",
+		StartTime:     start,
+		EndTime:       start.Add(time.Millisecond),
+		Status:        models.SpanStatusError,
+		StatusMessage: "no account for " + testEmail,
+	}})
+	p.Close()
+
+	trace, err := stores.Spans(models.DefaultTenant).GetTrace(traceID)
+	if err != nil || trace == nil || len(trace.Spans) != 1 {
+		t.Fatalf("GetTrace = %+v, %v; want the stored span", trace, err)
+	}
+	if msg := trace.Spans[0].StatusMessage; strings.Contains(msg, testEmail) {
+		t.Errorf("stored status message %q contains the email", msg)
+	}
+}
+
+func TestHandleErrorsRedactsEvents(t *testing.T) {
+	p, stores := newRedactingProcessor(t)
+	queue := NewQueue(10, 1)
+	srv := NewServer(p, WithQueue(queue))
+
+	body := `{"errors":[{"service":"accounts","message":"no account for ` + testEmail + `","type":"NotFound","stack_trace":["main.lookup(` + testEmail + `)"],"tags":{"user":"` + testEmail + `"}}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/errors", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	srv.HandleErrors(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	queue.Close()
+	p.Close()
+
+	events, err := stores.Errors(models.DefaultTenant).QueryErrors(models.ErrorEventQuery{})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("QueryErrors = %+v, %v; want the posted event", events, err)
+	}
+	event := events[0]
+	for _, text := range append([]string{event.Message, event.Tags["user"]}, event.StackTrace...) {
+		if strings.Contains(text, testEmail) {
+			t.Errorf("stored event text %q contains the email", text)
+		}
+	}
+	groups, err := stores.Errors(models.DefaultTenant).QueryGroups(models.ErrorGroupQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range groups {
+		if strings.Contains(group.SampleMessage, testEmail) {
+			t.Errorf("error group sample message %q contains the email", group.SampleMessage)
+		}
+	}
+}
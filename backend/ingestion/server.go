@@ -2,44 +2,271 @@ package ingestion
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/omnitrace/omnitrace/internal/models"
 )
 
 // Server handles HTTP ingestion of spans and metrics
 type Server struct {
-	processor *Processor
+	processor    *Processor
+	maxBodyBytes int64
+	auth         *TokenAuthenticator
+	queue        *Queue
+	quotas       *Quotas
+	sources      *SourceFilter
+	idempotency  *Idempotency
+}
+
+// ServerOption is a function that configures a Server
+type ServerOption func(*Server)
+
+// WithMaxBodyBytes limits the decoded size of request bodies. Larger
+// requests are rejected with 413.
+func WithMaxBodyBytes(n int64) ServerOption {
+	return func(s *Server) {
+		if n > 0 {
+			s.maxBodyBytes = n
+		}
+	}
+}
+
+// WithTokenAuth requires a valid bearer token on every ingestion request
+func WithTokenAuth(auth *TokenAuthenticator) ServerOption {
+	return func(s *Server) {
+		s.auth = auth
+	}
+}
+
+// WithQueue sets the queue that decoded batches are processed on. Sharing
+// one queue with the OTLP/gRPC receiver bounds their combined backlog.
+func WithQueue(q *Queue) ServerOption {
+	return func(s *Server) {
+		s.queue = q
+	}
+}
+
+// WithQuotas accounts ingested spans and metrics per tenant and service,
+// and rejects batches over their tenant's quota with 429
+func WithQuotas(q *Quotas) ServerOption {
+	return func(s *Server) {
+		s.quotas = q
+	}
+}
+
+// WithSourceFilter rejects ingestion requests from sources the filter
+// doesn't admit with 403
+func WithSourceFilter(f *SourceFilter) ServerOption {
+	return func(s *Server) {
+		s.sources = f
+	}
+}
+
+// WithIdempotency answers batches retried with the same idempotency key
+// from the cache rather than ingesting them again
+func WithIdempotency(c *Idempotency) ServerOption {
+	return func(s *Server) {
+		s.idempotency = c
+	}
 }
 
 // NewServer creates a new ingestion server
-func NewServer(processor *Processor) *Server {
-	return &Server{
-		processor: processor,
+func NewServer(processor *Processor, opts ...ServerOption) *Server {
+	s := &Server{
+		processor:    processor,
+		maxBodyBytes: DefaultMaxBodyBytes,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.queue == nil {
+		s.queue = NewQueue(DefaultQueueSize, 0)
+	}
+	return s
+}
+
+// enqueue submits job to the ingestion queue. When the queue is full it
+// replies 429 with a Retry-After hint and returns false.
+func (s *Server) enqueue(w http.ResponseWriter, job func()) bool {
+	if err := s.queue.Submit(job); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+		http.Error(w, "Ingestion queue full", http.StatusTooManyRequests)
+		return false
 	}
+	return true
 }
 
-// HandleSpans handles interactions for span ingestion
+// admit charges a batch to its tenant's quota of a signal with the
+// result of Quotas.AdmitSpans or AdmitMetrics. A batch the queue then
+// turns away is refunded with RefundSpans or RefundMetrics. It sets the X-Quota-Limit,
+// X-Quota-Remaining and X-Quota-Reset (seconds) headers of a daily quota,
+// and over quota replies 429 with a Retry-After hint and returns false.
+func (s *Server) admit(w http.ResponseWriter, tenant, signal string, err error) bool {
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		retryAfter := strconv.Itoa(max(int(math.Ceil(quotaErr.RetryAfter.Seconds())), 1))
+		w.Header().Set("X-Quota-Limit", strconv.FormatInt(quotaErr.Limit, 10))
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(quotaErr.Remaining, 10))
+		w.Header().Set("X-Quota-Reset", retryAfter)
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, quotaErr.Error(), http.StatusTooManyRequests)
+		return false
+	}
+	if limit, remaining, ok := s.quotas.remaining(tenant, signal); ok {
+		w.Header().Set("X-Quota-Limit", strconv.FormatInt(limit, 10))
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+		w.Header().Set("X-Quota-Reset", strconv.Itoa(int(math.Ceil(untilNextDay(time.Now()).Seconds()))))
+	}
+	return true
+}
+
+// HandleSpans handles interactions for span ingestion. Spans are decoded
+// and validated before the batch is queued, so that the response can say
+// which were rejected and why.
 func (s *Server) HandleSpans(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var batch models.SpanBatch
-	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	var malformed []models.IngestError
+	spans, err := decodeSpans(r, getSpans(), func(index int, err error) {
+		malformed = append(malformed, models.IngestError{Index: index, Reason: models.IngestRejectMalformed, Message: err.Error()})
+	})
+	if err != nil {
+		putSpans(spans)
+		writeBodyError(w, err)
 		return
 	}
 
-	log.Printf("Received batch of %d spans", len(batch.Spans))
+	log.Printf("Received batch of %d spans", len(spans)+len(malformed))
 
-	// Process spans asynchronously
-	go s.processor.ProcessSpans(batch.Spans)
+	spans, invalid := s.processor.ValidateSpans(spans)
+	rejected := batchRejections(malformed, invalid)
 
-	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte(`{"status":"accepted"}`))
+	// Process spans asynchronously. The slice goes back to the pool once
+	// they have been handed on.
+	stampSpans(r.Context(), spans)
+	if !s.admit(w, requestTenant(r), signalSpans, s.quotas.AdmitSpans(spans)) {
+		putSpans(spans)
+		return
+	}
+	if !s.enqueue(w, func() {
+		s.processor.ProcessValidSpans(spans)
+		putSpans(spans)
+	}) {
+		s.quotas.RefundSpans(spans)
+		putSpans(spans)
+		return
+	}
+
+	writeIngestResult(w, len(spans), rejected)
+}
+
+// batchRejections merges the rejections of spans that didn't decode, by
+// batch index, with those of decoded spans that didn't validate, by
+// position among the decoded spans, into one list by batch index
+func batchRejections(malformed, invalid []models.IngestError) []models.IngestError {
+	if len(malformed) == 0 {
+		return invalid
+	}
+	rejected := make([]models.IngestError, 0, len(malformed)+len(invalid))
+	k := 0
+	for _, rejection := range invalid {
+		// A decoded span's batch index is its position plus the
+		// malformed spans before it
+		for k < len(malformed) && malformed[k].Index <= rejection.Index+k {
+			rejected = append(rejected, malformed[k])
+			k++
+		}
+		rejection.Index += k
+		rejected = append(rejected, rejection)
+	}
+	return append(rejected, malformed[k:]...)
+}
+
+// writeIngestResult replies to a span batch with the number of spans
+// accepted and the rejections: 202, or 400 if nothing was accepted
+func writeIngestResult(w http.ResponseWriter, accepted int, rejected []models.IngestError) {
+	result := models.IngestResult{
+		Status:   models.IngestStatusAccepted,
+		Accepted: accepted,
+		Rejected: len(rejected),
+		Errors:   rejected,
+	}
+	status := http.StatusAccepted
+	switch {
+	case len(rejected) > 0 && accepted == 0:
+		result.Status = models.IngestStatusRejected
+		status = http.StatusBadRequest
+	case len(rejected) > 0:
+		result.Status = models.IngestStatusPartial
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleSpansV2 handles span ingestion in the v2 format, whose spans are
+// grouped by resource and carry typed attributes, events and links. They
+// are translated into the same spans HandleSpans takes, and validated the
+// same way; rejections are indexed by span across all the batch's
+// resources, in order.
+func (s *Server) HandleSpansV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch models.SpanBatchV2
+	if err := decodeBody(r, &batch); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	spans := batch.ToSpans(getSpans())
+
+	log.Printf("Received v2 batch of %d spans", len(spans))
+
+	spans, invalid := s.processor.ValidateSpans(spans)
+
+	stampSpans(r.Context(), spans)
+	if !s.admit(w, requestTenant(r), signalSpans, s.quotas.AdmitSpans(spans)) {
+		putSpans(spans)
+		return
+	}
+	if !s.enqueue(w, func() {
+		s.processor.ProcessValidSpans(spans)
+		putSpans(spans)
+	}) {
+		s.quotas.RefundSpans(spans)
+		putSpans(spans)
+		return
+	}
+
+	writeIngestResult(w, len(spans), invalid)
+}
+
+// HandleReplicate stores spans replicated by a peer collector. Unlike
+// HandleSpans it stores them before responding, so that a 200 tells the
+// peer they are held here, and doesn't replicate them again.
+func (s *Server) HandleReplicate(w http.ResponseWriter, r *http.Request) {
+	spans, err := decodeSpanBatch(r.Body, getSpans(), nil)
+	defer putSpans(spans)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	stampSpans(r.Context(), spans)
+	stored := s.processor.StoreReplicas(spans)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"stored": stored})
 }
 
 // HandleMetrics handles interactions for metric ingestion
@@ -50,20 +277,88 @@ func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var batch models.MetricBatch
-	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeBody(r, &batch); err != nil {
+		writeBodyError(w, err)
 		return
 	}
 
 	// Process metrics asynchronously
-	go s.processor.ProcessMetrics(batch.Metrics)
+	stampMetrics(r.Context(), batch.Metrics)
+	if !s.admit(w, requestTenant(r), signalMetrics, s.quotas.AdmitMetrics(batch.Metrics)) {
+		return
+	}
+	if !s.enqueue(w, func() { s.processor.ProcessMetrics(batch.Metrics) }) {
+		s.quotas.RefundMetrics(batch.Metrics)
+		return
+	}
 
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte(`{"status":"accepted"}`))
 }
 
-// RegisterRoutes registers the ingestion routes
+// HandleErrors handles interactions for standalone error event ingestion
+func (s *Server) HandleErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch models.ErrorEventBatch
+	if err := decodeBody(r, &batch); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	// Process error events asynchronously
+	stampErrors(r.Context(), batch.Errors)
+	if !s.enqueue(w, func() { s.processor.ProcessErrors(batch.Errors) }) {
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"accepted"}`))
+}
+
+// HandleQueueStats reports ingestion queue depth and counters
+func (s *Server) HandleQueueStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.queue.Stats())
+}
+
+// HandleValidationStats reports span validation counters by reason
+func (s *Server) HandleValidationStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.processor.ValidationStats())
+}
+
+// HandleSourceStats reports the requests rejected for their source
+func (s *Server) HandleSourceStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sources.Stats())
+}
+
+// HandleIdempotencyStats reports idempotency key counters
+func (s *Server) HandleIdempotencyStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.idempotency.Stats())
+}
+
+// HandleProcessorStats reports stored and duplicate span counts
+func (s *Server) HandleProcessorStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.processor.Stats())
+}
+
+// RegisterRoutes registers the ingestion routes. The stats handlers are
+// left to the dashboard's admin API, which authenticates admins.
 func (s *Server) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/api/v1/spans", s.HandleSpans)
-	mux.HandleFunc("/api/v1/metrics", s.HandleMetrics)
+	mux.HandleFunc("/api/v1/spans", s.withAuth(s.withIdempotency(s.withBody(s.HandleSpans))))
+	mux.HandleFunc("POST /api/v1/spans/stream", s.withAuth(s.HandleSpanStream))
+	mux.HandleFunc("/api/v2/spans", s.withAuth(s.withIdempotency(s.withBody(s.HandleSpansV2))))
+	mux.HandleFunc("/api/v1/metrics", s.withAuth(s.withIdempotency(s.withBody(s.HandleMetrics))))
+	mux.HandleFunc("/api/v1/errors", s.withAuth(s.withIdempotency(s.withBody(s.HandleErrors))))
+	mux.HandleFunc("/v1/traces", s.withAuth(s.withIdempotency(s.withBody(s.HandleOTLPTraces))))
+	mux.HandleFunc("/v1/metrics", s.withAuth(s.withIdempotency(s.withBody(s.HandleOTLPMetrics))))
+	mux.HandleFunc("POST /api/v1/import", s.withAuth(s.withReplicate(s.HandleImport)))
+	mux.HandleFunc("POST /api/v1/replicate", s.withAuth(s.withReplicate(s.withBody(s.HandleReplicate))))
 }
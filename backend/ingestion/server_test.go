@@ -0,0 +1,55 @@
+package ingestion
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+func TestHandleSpansV2RejectsInvalidSpans(t *testing.T) {
+	stores, err := storage.NewTenantStores(storage.TenantConfig{MaxSpans: 1000, SpanTTL: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stores.Close() })
+	p := NewProcessor(stores, WithWorkers(1))
+	queue := NewQueue(10, 1)
+	srv := NewServer(p, WithQueue(queue))
+
+	start := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	span := func(spanID string) string {
+		return `{"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"` + spanID + `","name":"GET /","start_time":"` + start + `"}`
+	}
+	body := `{"resource_spans":[` +
+		`{"resource":{"service.name":"web"},"spans":[` + span("00f067aa0ba902b7") + `,` + span("53995c3f42cd8ad8") + `]},` +
+		`{"resource":{"service.name":"db"},"spans":[` + span("0000000000000000") + `]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/spans", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	srv.HandleSpansV2(rec, req)
+	queue.Close()
+	p.Close()
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	var result models.IngestResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	want := []models.IngestError{{Index: 2, Reason: RejectInvalidSpanID}}
+	if result.Status != models.IngestStatusPartial || result.Accepted != 2 || len(result.Errors) != 1 || result.Errors[0] != want[0] {
+		t.Errorf("result = %+v, want 2 accepted and errors %+v", result, want)
+	}
+
+	traceID, _ := models.ParseTraceID("4bf92f3577b34da6a3ce929d0e0e4736")
+	trace, err := stores.Spans(models.DefaultTenant).GetTrace(traceID)
+	if err != nil || trace == nil || len(trace.Spans) != 2 {
+		t.Errorf("GetTrace = %+v, %v; want the two valid spans stored", trace, err)
+	}
+}
@@ -0,0 +1,68 @@
+package ingestion
+
+import (
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// ServiceGraphBuilder records calls between services by pairing each span
+// with its parent from another service. A parent and child may arrive in
+// different batches, so a pair is recorded by whichever of the two is
+// stored last. Client spans tagged with peer.service record their call
+// directly, which also covers calls to uninstrumented services.
+type ServiceGraphBuilder struct {
+	stores *storage.TenantStores
+}
+
+// NewServiceGraphBuilder creates a service graph builder
+func NewServiceGraphBuilder(stores *storage.TenantStores) *ServiceGraphBuilder {
+	return &ServiceGraphBuilder{stores: stores}
+}
+
+// Observe records the node and edge statistics of spans just stored for
+// a tenant
+func (b *ServiceGraphBuilder) Observe(tenant string, spans []models.Span) {
+	spanStore := b.stores.Spans(tenant)
+	graph := b.stores.ServiceGraph(tenant)
+
+	type spanKey struct {
+		traceID models.TraceID
+		spanID  models.SpanID
+	}
+	inBatch := make(map[spanKey]bool, len(spans))
+	for _, span := range spans {
+		inBatch[spanKey{span.TraceID, span.SpanID}] = true
+	}
+
+	for _, span := range spans {
+		graph.RecordSpan(span)
+
+		if peer := span.PeerService(); peer != "" {
+			graph.RecordCall(span.ServiceName, peer, span.StartTime, span.Duration, span.Status == models.SpanStatusError)
+		}
+
+		// Pair with a stored parent
+		if !span.ParentSpanID.IsZero() {
+			if parent, ok := spanStore.FindSpan(span.TraceID, span.ParentSpanID); ok {
+				recordPair(graph, parent, span)
+			}
+		}
+
+		// Pair with children stored by earlier batches; children in this
+		// batch pair with span themselves
+		for _, child := range spanStore.ChildSpans(span.TraceID, span.SpanID) {
+			if !inBatch[spanKey{child.TraceID, child.SpanID}] {
+				recordPair(graph, span, child)
+			}
+		}
+	}
+}
+
+// recordPair records the call from parent's service to child's service.
+// Parents that named their peer already recorded the call.
+func recordPair(graph *storage.ServiceGraphStore, parent, child models.Span) {
+	if parent.ServiceName == child.ServiceName || parent.PeerService() != "" {
+		return
+	}
+	graph.RecordCall(parent.ServiceName, child.ServiceName, child.StartTime, child.Duration, child.Status == models.SpanStatusError)
+}
@@ -0,0 +1,160 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/peer"
+)
+
+// maxSourceStats caps the distinct rejected addresses counted one by one.
+// Rejections from further addresses only count in the totals.
+const maxSourceStats = 1000
+
+// Reasons a source is rejected
+const (
+	sourceNotAllowed  = "not_allowed"
+	sourceTokenDenied = "token_source"
+)
+
+// SourceStats counts ingestion requests rejected for their source address,
+// by reason and by address
+type SourceStats struct {
+	Rejected  map[string]uint64 `json:"rejected"`
+	BySource  map[string]uint64 `json:"by_source"`
+	Allowlist []string          `json:"allowlist,omitempty"`
+}
+
+// SourceFilter admits ingestion requests by source address: from the
+// networks on an allowlist, if there is one, and for tokens restricted to
+// sources, from those only. The source is the connection's remote address;
+// behind a proxy, filter at the proxy.
+type SourceFilter struct {
+	allowed []netip.Prefix
+
+	mu       sync.Mutex
+	rejected map[string]uint64
+	bySource map[string]uint64
+}
+
+// NewSourceFilter creates a filter admitting sources in allowed, or any
+// source if it is empty
+func NewSourceFilter(allowed []netip.Prefix) *SourceFilter {
+	return &SourceFilter{allowed: allowed, rejected: make(map[string]uint64), bySource: make(map[string]uint64)}
+}
+
+// ParseSources parses CIDR prefixes and single addresses, e.g.
+// "10.0.0.0/8" or "192.168.1.7"
+func ParseSources(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source %q: want a CIDR prefix or an IP address", v)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %q: want a CIDR prefix or an IP address", v)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allow reports whether the allowlist admits a source. Rejections are
+// counted.
+func (f *SourceFilter) allow(source netip.Addr) bool {
+	if f == nil || len(f.allowed) == 0 || contains(f.allowed, source) {
+		return true
+	}
+	f.reject(sourceNotAllowed, source)
+	return false
+}
+
+// allowToken reports whether an identity may write from a source.
+// Rejections are counted.
+func (f *SourceFilter) allowToken(id Identity, source netip.Addr) bool {
+	if len(id.Sources) == 0 || contains(id.Sources, source) {
+		return true
+	}
+	if f != nil {
+		f.reject(sourceTokenDenied, source)
+	}
+	return false
+}
+
+func (f *SourceFilter) reject(reason string, source netip.Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejected[reason]++
+	key := source.String()
+	if _, ok := f.bySource[key]; ok || len(f.bySource) < maxSourceStats {
+		f.bySource[key]++
+	}
+}
+
+// Stats returns the rejection counters
+func (f *SourceFilter) Stats() SourceStats {
+	stats := SourceStats{Rejected: make(map[string]uint64), BySource: make(map[string]uint64)}
+	if f == nil {
+		return stats
+	}
+	for _, prefix := range f.allowed {
+		stats.Allowlist = append(stats.Allowlist, prefix.String())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for reason, n := range f.rejected {
+		stats.Rejected[reason] = n
+	}
+	for source, n := range f.bySource {
+		stats.BySource[source] = n
+	}
+	return stats
+}
+
+// contains reports whether any prefix contains addr. An invalid address,
+// from a connection without one, is in none.
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestSource returns the remote address of a request's connection
+func requestSource(r *http.Request) netip.Addr {
+	return parseSource(r.RemoteAddr)
+}
+
+// grpcSource returns the remote address of a gRPC call's connection
+func grpcSource(ctx context.Context) netip.Addr {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return parseSource(p.Addr.String())
+	}
+	return netip.Addr{}
+}
+
+// parseSource parses a host:port address, with IPv4-mapped IPv6 addresses
+// unmapped so they match IPv4 prefixes
+func parseSource(hostport string) netip.Addr {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
@@ -0,0 +1,107 @@
+package ingestion
+
+import (
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Names of the metrics derived from spans
+const (
+	SpanCallsMetric    = "span.calls"
+	SpanErrorsMetric   = "span.errors"
+	SpanDurationMetric = "span.duration_ms"
+)
+
+// spanMetricKey groups spans into one request/error series
+type spanMetricKey struct {
+	tenant    string
+	service   string
+	operation string
+	kind      models.SpanKind
+}
+
+// SpanMetrics derives RED (rate, errors, duration) metrics per service and
+// operation from ingested spans, so latency and error rate can be charted
+// for applications that only send spans
+type SpanMetrics struct{}
+
+// NewSpanMetrics creates a span metrics generator
+func NewSpanMetrics() *SpanMetrics {
+	return &SpanMetrics{}
+}
+
+// Generate returns the metrics for a batch of spans: one call and one error
+// counter point per service, operation and kind, and one duration point per
+// span
+func (g *SpanMetrics) Generate(spans []models.Span) []models.Metric {
+	type counts struct {
+		calls, errors float64
+		last          time.Time
+	}
+	series := make(map[spanMetricKey]*counts)
+	metrics := make([]models.Metric, 0, len(spans))
+
+	for _, span := range spans {
+		key := spanMetricKey{span.TenantID, span.ServiceName, span.OperationName, span.Kind}
+		c, ok := series[key]
+		if !ok {
+			c = &counts{}
+			series[key] = c
+		}
+		c.calls++
+		if span.Status == models.SpanStatusError {
+			c.errors++
+		}
+		if span.EndTime.After(c.last) {
+			c.last = span.EndTime
+		}
+
+		metrics = append(metrics, models.Metric{
+			Name:      SpanDurationMetric,
+			Type:      models.MetricTypeHistogram,
+			Value:     float64(span.Duration) / float64(time.Millisecond),
+			Timestamp: span.EndTime,
+			Labels:    spanMetricLabels(key, span.Status),
+			Service:   span.ServiceName,
+			TenantID:  span.TenantID,
+		})
+	}
+
+	for key, c := range series {
+		labels := spanMetricLabels(key, "")
+		metrics = append(metrics,
+			models.Metric{
+				Name:      SpanCallsMetric,
+				Type:      models.MetricTypeCounter,
+				Value:     c.calls,
+				Timestamp: c.last,
+				Labels:    labels,
+				Service:   key.service,
+				TenantID:  key.tenant,
+			},
+			models.Metric{
+				Name:      SpanErrorsMetric,
+				Type:      models.MetricTypeCounter,
+				Value:     c.errors,
+				Timestamp: c.last,
+				Labels:    labels,
+				Service:   key.service,
+				TenantID:  key.tenant,
+			},
+		)
+	}
+
+	return metrics
+}
+
+func spanMetricLabels(key spanMetricKey, status models.SpanStatus) map[string]string {
+	labels := map[string]string{
+		"operation": key.operation,
+		"kind":      string(key.kind),
+	}
+	if status != "" {
+		labels["status"] = string(status)
+	}
+	return labels
+}
@@ -0,0 +1,268 @@
+package ingestion
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Default spill settings
+const (
+	DefaultSpillMaxBytes = 1 << 30
+	spillSegmentBytes    = 8 << 20
+	spillSegmentPrefix   = "spill-"
+	spillSegmentSuffix   = ".jsonl"
+)
+
+// ErrSpillFull is returned when spilling would exceed the spill size limit
+var ErrSpillFull = errors.New("spill directory full")
+
+// SpillStats is a snapshot of disk spill activity
+type SpillStats struct {
+	PendingBytes int64  `json:"pending_bytes"`
+	Spilled      uint64 `json:"spilled"`
+	Replayed     uint64 `json:"replayed"`
+	Dropped      uint64 `json:"dropped"`
+}
+
+// Spill is a disk-backed FIFO of span batches. The processor spills
+// batches when its in-memory queues are full and replays them once storage
+// catches up. Batches are stored as JSON lines in segment files, so spans
+// spilled before a restart are replayed on the next start.
+type Spill struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	seq     uint64
+	active  *os.File
+	written int64 // bytes in the active segment
+	pending int64 // bytes in all segments not yet replayed
+	notify  chan struct{}
+
+	spilled  atomic.Uint64
+	replayed atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// NewSpill opens a spill directory, creating it if needed. Segments left
+// by a previous run are kept for replay.
+func NewSpill(dir string, maxBytes int64) (*Spill, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultSpillMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create spill dir: %w", err)
+	}
+
+	s := &Spill{
+		dir:      dir,
+		maxBytes: maxBytes,
+		notify:   make(chan struct{}, 1),
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		if info, err := os.Stat(seg); err == nil {
+			s.pending += info.Size()
+		}
+		var seq uint64
+		fmt.Sscanf(filepath.Base(seg), spillSegmentPrefix+"%d"+spillSegmentSuffix, &seq)
+		if seq > s.seq {
+			s.seq = seq
+		}
+	}
+	if len(segments) > 0 {
+		s.signal()
+	}
+	return s, nil
+}
+
+// Write appends a batch to the active segment
+func (s *Spill) Write(spans []models.Span) error {
+	line, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending+int64(len(line)) > s.maxBytes {
+		s.dropped.Add(uint64(len(spans)))
+		return ErrSpillFull
+	}
+	if s.active == nil || s.written >= spillSegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(line); err != nil {
+		return err
+	}
+	s.written += int64(len(line))
+	s.pending += int64(len(line))
+	s.spilled.Add(uint64(len(spans)))
+	s.signal()
+	return nil
+}
+
+// rotate closes the active segment and opens the next. Callers hold s.mu.
+func (s *Spill) rotate() error {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	s.seq++
+	f, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", spillSegmentPrefix, s.seq, spillSegmentSuffix)))
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.written = 0
+	return nil
+}
+
+// segments returns the segment files in write order
+func (s *Spill) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, spillSegmentPrefix) && strings.HasSuffix(name, spillSegmentSuffix) {
+			segments = append(segments, filepath.Join(s.dir, name))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func (s *Spill) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Replay reads back spilled batches oldest first, passing each to fn, until
+// stop is closed. A segment is deleted once all its batches were replayed.
+func (s *Spill) Replay(stop <-chan struct{}, fn func([]models.Span)) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.notify:
+		}
+
+		for {
+			seg, ok := s.nextSegment()
+			if !ok {
+				break
+			}
+			if !s.replaySegment(seg, stop, fn) {
+				return
+			}
+		}
+	}
+}
+
+// nextSegment returns the oldest segment, sealing the active one first so
+// that it is never read while being written
+func (s *Spill) nextSegment() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := s.segments()
+	if err != nil || len(segments) == 0 {
+		return "", false
+	}
+	if s.active != nil && segments[0] == s.active.Name() {
+		s.active.Close()
+		s.active = nil
+	}
+	return segments[0], true
+}
+
+// replaySegment replays one segment and deletes it. It returns false if
+// stop was closed before the segment was fully replayed; the segment is
+// then kept and replayed from the start on the next run.
+func (s *Spill) replaySegment(path string, stop <-chan struct{}, fn func([]models.Span)) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), spillSegmentBytes+DefaultMaxBodyBytes)
+	for scanner.Scan() {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+
+		var spans []models.Span
+		if err := json.Unmarshal(scanner.Bytes(), &spans); err != nil {
+			continue
+		}
+		fn(spans)
+		s.replayed.Add(uint64(len(spans)))
+	}
+
+	os.Remove(path)
+	s.mu.Lock()
+	s.pending -= size
+	if s.pending < 0 {
+		s.pending = 0
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// Stats returns a snapshot of the spill counters
+func (s *Spill) Stats() SpillStats {
+	s.mu.Lock()
+	pending := s.pending
+	s.mu.Unlock()
+
+	return SpillStats{
+		PendingBytes: pending,
+		Spilled:      s.spilled.Load(),
+		Replayed:     s.replayed.Load(),
+		Dropped:      s.dropped.Load(),
+	}
+}
+
+// Close closes the active segment. Unreplayed segments stay on disk.
+func (s *Spill) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
@@ -0,0 +1,201 @@
+package ingestion
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+const (
+	// streamBatchSize is the most spans of a stream queued as one batch
+	streamBatchSize = 500
+	// streamIdleTimeout is how long a stream may go without a line
+	streamIdleTimeout = time.Minute
+	// maxStreamErrors caps the line errors a stream's response lists
+	maxStreamErrors = 100
+)
+
+// streamResult is the response of the span stream endpoint
+type streamResult struct {
+	// Accepted counts the spans queued, and Rejected the lines that
+	// weren't spans or whose spans failed validation. Errors lists the
+	// first of those.
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Errors   []streamLineError `json:"errors,omitempty"`
+}
+
+// streamLineError reports a line of a stream that wasn't a valid span
+type streamLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// HandleSpanStream ingests newline-delimited JSON spans, one per line, so
+// that an agent can hold the connection open and write spans as they end
+// rather than building batches. Spans are queued as soon as no more input
+// is waiting, or every streamBatchSize lines, and only each line is held
+// to the body size limit. A line that isn't a span, or whose span fails
+// validation, is reported in the response and skipped; only valid spans
+// count against the quota. The stream ends at EOF, after
+// streamIdleTimeout without a line, or when the quota or queue turns a
+// batch away.
+func (s *Server) HandleSpanStream(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// The server's timeouts are meant for single requests; a stream is
+	// instead cut off when it goes idle
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	rc.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+
+	var result streamResult
+	reject := func(line int, err error) {
+		result.Rejected++
+		if len(result.Errors) < maxStreamErrors {
+			result.Errors = append(result.Errors, streamLineError{Line: line, Error: err.Error()})
+		}
+	}
+
+	tenant := requestTenant(r)
+	spans := getSpans()
+	// lines holds the line number of each span read but not yet queued
+	var lines []int
+	flush := func() bool {
+		if len(spans) == 0 {
+			return true
+		}
+		batch, invalid := s.processor.ValidateSpans(spans)
+		for _, rejected := range invalid {
+			reject(lines[rejected.Index], errors.New(rejected.Reason))
+		}
+		spans = getSpans()
+		lines = lines[:0]
+		if len(batch) == 0 {
+			putSpans(batch)
+			return true
+		}
+		stampSpans(r.Context(), batch)
+		if !s.admit(w, tenant, signalSpans, s.quotas.AdmitSpans(batch)) {
+			putSpans(batch)
+			return false
+		}
+		if !s.enqueue(w, func() {
+			s.processor.ProcessValidSpans(batch)
+			putSpans(batch)
+		}) {
+			s.quotas.RefundSpans(batch)
+			putSpans(batch)
+			return false
+		}
+		result.Accepted += len(batch)
+		return true
+	}
+	defer func() { putSpans(spans) }()
+
+	reader := bufio.NewReaderSize(body, 64*1024)
+	for line := 1; ; line++ {
+		data, err := readStreamLine(reader, s.maxBodyBytes)
+		if errors.Is(err, errLineTooLong) {
+			reject(line, fmt.Errorf("line larger than %d bytes", s.maxBodyBytes))
+		} else if err != nil && err != io.EOF {
+			log.Printf("Span stream ended at line %d: %v", line, err)
+			if flush() {
+				writeBodyError(w, err)
+			}
+			return
+		}
+
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			spans = append(spans, models.Span{})
+			if jsonErr := json.Unmarshal(data, &spans[len(spans)-1]); jsonErr != nil {
+				spans = spans[:len(spans)-1]
+				reject(line, jsonErr)
+			} else {
+				lines = append(lines, line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		rc.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+
+		// Queue what has been read when the client has nothing more
+		// waiting, so that a slow stream's spans don't sit here
+		if len(spans) >= streamBatchSize || reader.Buffered() == 0 {
+			if !flush() {
+				return
+			}
+		}
+	}
+	if !flush() {
+		return
+	}
+
+	log.Printf("Received span stream of %d spans (%d lines rejected)", result.Accepted, result.Rejected)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// errLineTooLong reports a stream line over the size limit, which has been
+// skipped
+var errLineTooLong = errors.New("line too long")
+
+// readStreamLine reads the next line of r, newline included. A line
+// longer than limit is read to its end and dropped with errLineTooLong.
+// The returned slice is only valid until the next read.
+func readStreamLine(r *bufio.Reader, limit int64) ([]byte, error) {
+	data, err := r.ReadSlice('\n')
+	if err == nil || err == io.EOF {
+		if int64(len(data)) > limit {
+			return nil, errLineTooLong
+		}
+		return data, err
+	}
+	if err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	// The line is longer than the reader's buffer
+	line := append([]byte(nil), data...)
+	for err == bufio.ErrBufferFull {
+		data, err = r.ReadSlice('\n')
+		if line != nil {
+			line = append(line, data...)
+			if int64(len(line)) > limit {
+				line = nil
+			}
+		}
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if line == nil {
+		return nil, errLineTooLong
+	}
+	return line, err
+}
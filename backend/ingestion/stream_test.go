@@ -0,0 +1,64 @@
+package ingestion
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+func TestHandleSpanStreamRejectsInvalidSpans(t *testing.T) {
+	stores, err := storage.NewTenantStores(storage.TenantConfig{MaxSpans: 1000, SpanTTL: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stores.Close() })
+	p := NewProcessor(stores, WithWorkers(1))
+	queue := NewQueue(10, 1)
+	srv := NewServer(p, WithQueue(queue))
+
+	start := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	body := strings.Join([]string{
+		`{"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"00f067aa0ba902b7","operation_name":"GET /","service_name":"web","start_time":"` + start + `"}`,
+		`{"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","operation_name":"no span ID","service_name":"web","start_time":"` + start + `"}`,
+		`not json`,
+		`{"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"53995c3f42cd8ad8","operation_name":"no start","service_name":"web"}`,
+	}, "\n")
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/spans/stream", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	srv.HandleSpanStream(rec, req)
+	queue.Close()
+	p.Close()
+
+	var result streamResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body, err)
+	}
+	if result.Accepted != 1 || result.Rejected != 3 {
+		t.Errorf("accepted %d and rejected %d lines, want 1 and 3", result.Accepted, result.Rejected)
+	}
+	want := []streamLineError{
+		{Line: 2, Error: RejectInvalidSpanID},
+		{Line: 4, Error: RejectMissingStart},
+	}
+	var got []streamLineError
+	for _, e := range result.Errors {
+		if e.Line != 3 {
+			got = append(got, e)
+		}
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("validation errors = %+v, want %+v", got, want)
+	}
+
+	traceID, _ := models.ParseTraceID("4bf92f3577b34da6a3ce929d0e0e4736")
+	trace, err := stores.Spans(models.DefaultTenant).GetTrace(traceID)
+	if err != nil || trace == nil || len(trace.Spans) != 1 {
+		t.Errorf("GetTrace = %+v, %v; want only the valid span stored", trace, err)
+	}
+}
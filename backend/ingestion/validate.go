@@ -0,0 +1,226 @@
+package ingestion
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Default span validation settings
+const (
+	DefaultMaxFutureSkew     = 5 * time.Minute
+	DefaultLateThreshold     = 5 * time.Minute
+	DefaultMaxTagValueLength = 4096
+	DefaultMaxTags           = 128
+)
+
+// Rejection reasons reported by the validator
+const (
+	RejectInvalidTraceID = "invalid_trace_id"
+	RejectInvalidSpanID  = "invalid_span_id"
+	RejectMissingStart   = "missing_start_time"
+	RejectTooOld         = "span_too_old"
+)
+
+// truncatedSuffix marks tag values cut to the maximum length
+const truncatedSuffix = "...[truncated]"
+
+// ValidatorConfig configures span validation and normalization
+type ValidatorConfig struct {
+	// MaxFutureSkew is how far in the future a span may start before its
+	// timestamps are clamped to the collector's clock
+	MaxFutureSkew time.Duration
+	// MaxSpanAge rejects spans that ended longer ago than this, e.g. ones
+	// a client buffered for days (0 = no limit)
+	MaxSpanAge time.Duration
+	// LateThreshold tags spans that arrive longer than this after they
+	// ended with models.LateArrivalTag (0 = never)
+	LateThreshold time.Duration
+	// MaxTagValueLength truncates longer tag values (0 = no limit)
+	MaxTagValueLength int
+	// MaxTags drops tags beyond this count per span (0 = no limit)
+	MaxTags int
+}
+
+// DefaultValidatorConfig returns the default validation settings
+func DefaultValidatorConfig() ValidatorConfig {
+	return ValidatorConfig{
+		MaxFutureSkew:     DefaultMaxFutureSkew,
+		LateThreshold:     DefaultLateThreshold,
+		MaxTagValueLength: DefaultMaxTagValueLength,
+		MaxTags:           DefaultMaxTags,
+	}
+}
+
+// ValidationStats is a snapshot of validator counters. Rejected and
+// Normalized are keyed by reason.
+type ValidationStats struct {
+	Accepted   uint64            `json:"accepted"`
+	Rejected   map[string]uint64 `json:"rejected"`
+	Normalized map[string]uint64 `json:"normalized"`
+}
+
+// Validator rejects malformed spans and normalizes the rest before they
+// are stored
+type Validator struct {
+	cfg ValidatorConfig
+	now func() time.Time
+
+	mu         sync.Mutex
+	accepted   uint64
+	rejected   map[string]uint64
+	normalized map[string]uint64
+}
+
+// NewValidator creates a validator with the given settings
+func NewValidator(cfg ValidatorConfig) *Validator {
+	return &Validator{
+		cfg:        cfg,
+		now:        time.Now,
+		rejected:   make(map[string]uint64),
+		normalized: make(map[string]uint64),
+	}
+}
+
+// Validate checks span and normalizes it in place. It returns false with
+// the rejection reason when the span must be dropped.
+func (v *Validator) Validate(span *models.Span) (string, bool) {
+	return v.validate(span, true)
+}
+
+// ValidateStored is Validate for spans stored before, read from a backup
+// or replicated by a peer. They were checked against the arrival window
+// when they first arrived, so they are accepted however old they are and
+// aren't tagged late again.
+func (v *Validator) ValidateStored(span *models.Span) (string, bool) {
+	return v.validate(span, false)
+}
+
+func (v *Validator) validate(span *models.Span, arriving bool) (string, bool) {
+	// IDs are checked for hex digits when they are decoded, which leaves
+	// the all-zero IDs
+	reason := ""
+	switch {
+	case span.TraceID.IsZero():
+		reason = RejectInvalidTraceID
+	case span.SpanID.IsZero():
+		reason = RejectInvalidSpanID
+	case span.StartTime.IsZero():
+		reason = RejectMissingStart
+	case arriving && v.cfg.MaxSpanAge > 0 && v.age(span) > v.cfg.MaxSpanAge:
+		reason = RejectTooOld
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if reason != "" {
+		v.rejected[reason]++
+		return reason, false
+	}
+	v.accepted++
+	v.normalize(span)
+	if arriving {
+		v.tagLate(span)
+	}
+	return "", true
+}
+
+// age is how long ago span ended, or started if its end is missing or
+// before its start
+func (v *Validator) age(span *models.Span) time.Duration {
+	end := span.EndTime
+	if end.Before(span.StartTime) {
+		end = span.StartTime
+	}
+	return v.now().Sub(end)
+}
+
+// tagLate tags a span that arrived longer than the late threshold after
+// it ended with how long after. Callers hold v.mu.
+func (v *Validator) tagLate(span *models.Span) {
+	if v.cfg.LateThreshold <= 0 {
+		return
+	}
+	if _, ok := span.Tags[models.LateArrivalTag]; ok {
+		return
+	}
+	if age := v.age(span); age > v.cfg.LateThreshold {
+		span.AddTag(models.LateArrivalTag, age.Round(time.Second).String())
+		v.normalized["late_arrival"]++
+	}
+}
+
+// normalize fixes up timestamps, defaults and tags. Callers hold v.mu.
+func (v *Validator) normalize(span *models.Span) {
+	if span.EndTime.Before(span.StartTime) {
+		span.EndTime = span.StartTime
+		v.normalized["end_before_start"]++
+	}
+
+	// Shift future spans back to now, keeping their duration
+	if v.cfg.MaxFutureSkew > 0 {
+		now := v.now()
+		if span.StartTime.After(now.Add(v.cfg.MaxFutureSkew)) {
+			shift := span.StartTime.Sub(now)
+			span.StartTime = span.StartTime.Add(-shift)
+			span.EndTime = span.EndTime.Add(-shift)
+			v.normalized["future_timestamp"]++
+		}
+	}
+	if span.Duration != span.EndTime.Sub(span.StartTime) {
+		span.CalculateDuration()
+	}
+
+	if span.Kind == "" {
+		span.Kind = models.SpanKindInternal
+		v.normalized["default_kind"]++
+	}
+	if span.Status == "" {
+		span.Status = models.SpanStatusUnset
+		v.normalized["default_status"]++
+	}
+
+	if v.cfg.MaxTags > 0 && len(span.Tags) > v.cfg.MaxTags {
+		// Map order is random, so drop the keys that sort last to keep
+		// the result deterministic
+		keys := make([]string, 0, len(span.Tags))
+		for k := range span.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys[v.cfg.MaxTags:] {
+			delete(span.Tags, k)
+		}
+		v.normalized["tags_dropped"]++
+	}
+	if v.cfg.MaxTagValueLength > 0 {
+		for k, val := range span.Tags {
+			if len(val) > v.cfg.MaxTagValueLength {
+				span.Tags[k] = val[:v.cfg.MaxTagValueLength] + truncatedSuffix
+				v.normalized["tag_truncated"]++
+			}
+		}
+	}
+}
+
+// Stats returns a snapshot of the validator counters
+func (v *Validator) Stats() ValidationStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stats := ValidationStats{
+		Accepted:   v.accepted,
+		Rejected:   make(map[string]uint64, len(v.rejected)),
+		Normalized: make(map[string]uint64, len(v.normalized)),
+	}
+	for reason, n := range v.rejected {
+		stats.Rejected[reason] = n
+	}
+	for reason, n := range v.normalized {
+		stats.Normalized[reason] = n
+	}
+	return stats
+}
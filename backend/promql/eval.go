@@ -0,0 +1,129 @@
+package promql
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Series is a query result: one labeled series of samples in time order
+type Series struct {
+	Labels  map[string]string
+	Samples []Sample
+}
+
+// Sample is one value of a series
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// Plan turns the query into a metric query over [start, end] in steps of
+// step. Series are selected with Match on their Prometheus labels; a
+// service equality is also pushed down to the store.
+func (q *Query) Plan(start, end time.Time, step time.Duration) models.MetricQuery {
+	query := models.MetricQuery{
+		StartTime: start,
+		EndTime:   end,
+		Step:      step,
+		Function:  q.Function,
+		Window:    q.Range,
+	}
+	for _, m := range q.Selector.Matchers {
+		if m.Label == ServiceLabel && m.Op == "=" {
+			query.Service = m.Value
+		}
+	}
+	selector := q.Selector
+	query.Match = func(m models.Metric) bool {
+		return selector.Matches(MetricLabels(m))
+	}
+	return query
+}
+
+// Evaluate turns the buckets of the planned query into series, summing
+// them if the query aggregates. A bucket's sample is its average, or the
+// function's result, at the bucket's start.
+func (q *Query) Evaluate(buckets []models.AggregatedMetric) []Series {
+	type timeline map[int64]float64 // Unix nanoseconds -> value
+	series := make(map[string]timeline)
+	labelSets := make(map[string]map[string]string)
+
+	for _, b := range buckets {
+		labels := Labels(b.Name, b.Service, b.Labels)
+		if q.Function != "" || q.Sum {
+			// Functions and aggregations drop the metric name
+			delete(labels, MetricNameLabel)
+		}
+		if q.Sum {
+			labels = q.groupLabels(labels)
+		}
+		key := labelsKey(labels)
+		if series[key] == nil {
+			series[key] = make(timeline)
+			labelSets[key] = labels
+		}
+		value := b.Avg
+		if q.Function != "" {
+			value = b.Value
+		}
+		series[key][b.StartTime.UnixNano()] += value
+	}
+
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		s := Series{Labels: labelSets[key]}
+		for t, v := range series[key] {
+			s.Samples = append(s.Samples, Sample{Time: time.Unix(0, t), Value: v})
+		}
+		sort.Slice(s.Samples, func(i, j int) bool { return s.Samples[i].Time.Before(s.Samples[j].Time) })
+		result = append(result, s)
+	}
+	return result
+}
+
+// groupLabels keeps the labels a sum groups by
+func (q *Query) groupLabels(labels map[string]string) map[string]string {
+	grouped := make(map[string]string)
+	if q.Without != nil {
+		for k, v := range labels {
+			grouped[k] = v
+		}
+		for _, name := range q.Without {
+			delete(grouped, name)
+		}
+		return grouped
+	}
+	for _, name := range q.By {
+		if v, ok := labels[name]; ok {
+			grouped[name] = v
+		}
+	}
+	return grouped
+}
+
+// labelsKey identifies a label set
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,345 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// SyntaxError reports an invalid query and where it went wrong
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+// Parse parses a query. Errors are *SyntaxError.
+func Parse(input string) (*Query, error) {
+	p := &parser{input: input}
+	q, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return q, nil
+}
+
+// ParseSelector parses a series selector such as the match[] parameters
+// of the series API
+func ParseSelector(input string) (Selector, error) {
+	p := &parser{input: input}
+	sel, err := p.selector()
+	if err != nil {
+		return Selector{}, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return Selector{}, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return sel, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume skips space and s, reporting whether s was next
+func (p *parser) consume(s string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.input[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.consume(s) {
+		return p.errorf("expected %q", s)
+	}
+	return nil
+}
+
+func isNameRune(r byte, first bool) bool {
+	return r == '_' || r == ':' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || (!first && '0' <= r && r <= '9')
+}
+
+// ident reads a metric, label or function name, or returns ""
+func (p *parser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && isNameRune(p.input[p.pos], p.pos == start) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// peekIdent returns the next name without consuming it
+func (p *parser) peekIdent() string {
+	pos := p.pos
+	name := p.ident()
+	p.pos = pos
+	return name
+}
+
+// expr parses an aggregation, function call or selector
+func (p *parser) expr() (*Query, error) {
+	switch p.peekIdent() {
+	case "sum":
+		return p.sum()
+	case models.MetricFunctionRate, models.MetricFunctionIncrease:
+		return p.call()
+	}
+	sel, err := p.selector()
+	if err != nil {
+		return nil, err
+	}
+	if p.consume("[") {
+		return nil, p.errorf("range vectors are only supported inside rate() and increase()")
+	}
+	return &Query{Selector: sel}, nil
+}
+
+// sum parses sum [by|without (labels)] (expr) [by|without (labels)]
+func (p *parser) sum() (*Query, error) {
+	p.ident()
+	by, without, err := p.grouping()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	inner, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if inner.Sum {
+		return nil, p.errorf("nested aggregations are not supported")
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if by == nil && without == nil {
+		if by, without, err = p.grouping(); err != nil {
+			return nil, err
+		}
+	}
+	inner.Sum, inner.By, inner.Without = true, by, without
+	return inner, nil
+}
+
+// grouping parses an optional by (labels) or without (labels) clause
+func (p *parser) grouping() (by, without []string, err error) {
+	kind := p.peekIdent()
+	if kind != "by" && kind != "without" {
+		return nil, nil, nil
+	}
+	p.ident()
+	if err := p.expect("("); err != nil {
+		return nil, nil, err
+	}
+	labels := []string{}
+	for !p.consume(")") {
+		if len(labels) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, nil, err
+			}
+			if p.consume(")") {
+				break
+			}
+		}
+		name := p.ident()
+		if name == "" {
+			return nil, nil, p.errorf("expected a label name")
+		}
+		labels = append(labels, name)
+	}
+	if kind == "by" {
+		return labels, nil, nil
+	}
+	return nil, labels, nil
+}
+
+// call parses rate(selector[range]) or increase(selector[range])
+func (p *parser) call() (*Query, error) {
+	function := p.ident()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	sel, err := p.selector()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && p.input[p.pos] != ']' {
+		p.pos++
+	}
+	text := strings.TrimSpace(p.input[start:p.pos])
+	window, err := ParseDuration(text)
+	if err != nil || window <= 0 {
+		p.pos = start
+		return nil, p.errorf("invalid range %q", text)
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &Query{Selector: sel, Function: function, Range: window}, nil
+}
+
+// selector parses name, name{matchers} or {matchers}
+func (p *parser) selector() (Selector, error) {
+	var sel Selector
+	if name := p.ident(); name != "" {
+		sel.Matchers = append(sel.Matchers, Matcher{Label: MetricNameLabel, Op: "=", Value: name})
+	}
+	if p.consume("{") {
+		for first := true; !p.consume("}"); first = false {
+			if !first {
+				if err := p.expect(","); err != nil {
+					return sel, err
+				}
+				if p.consume("}") {
+					break
+				}
+			}
+			m, err := p.matcher()
+			if err != nil {
+				return sel, err
+			}
+			sel.Matchers = append(sel.Matchers, m)
+		}
+	}
+	if len(sel.Matchers) == 0 {
+		return sel, p.errorf("expected a metric name or label matchers")
+	}
+	return sel, nil
+}
+
+// matcher parses label op "value"
+func (p *parser) matcher() (Matcher, error) {
+	label := p.ident()
+	if label == "" {
+		return Matcher{}, p.errorf("expected a label name")
+	}
+	var op string
+	for _, candidate := range []string{"=~", "!~", "!=", "="} {
+		if p.consume(candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return Matcher{}, p.errorf("expected a matcher operator")
+	}
+	value, err := p.str()
+	if err != nil {
+		return Matcher{}, err
+	}
+	m, err := NewMatcher(label, op, value)
+	if err != nil {
+		return Matcher{}, p.errorf("%v", err)
+	}
+	return m, nil
+}
+
+// str parses a double, single or back quoted string
+func (p *parser) str() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return "", p.errorf("expected a string")
+	}
+	quote := p.input[p.pos]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.errorf("expected a string")
+	}
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.input) && p.input[p.pos] != quote {
+		if p.input[p.pos] == '\\' && quote != '`' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.input) {
+		p.pos = start
+		return "", p.errorf("unterminated string")
+	}
+	p.pos++
+	literal := p.input[start:p.pos]
+	if quote == '`' {
+		return literal[1 : len(literal)-1], nil
+	}
+	if quote == '\'' {
+		literal = `"` + strings.ReplaceAll(strings.ReplaceAll(literal[1:len(literal)-1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	value, err := strconv.Unquote(literal)
+	if err != nil {
+		p.pos = start
+		return "", p.errorf("invalid string %s", literal)
+	}
+	return value, nil
+}
+
+// ParseDuration parses a Prometheus duration such as 5m, 1h30m, 2d or 1w
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+	var total time.Duration
+	for rest := s; rest != ""; {
+		i := 0
+		for i < len(rest) && '0' <= rest[i] && rest[i] <= '9' {
+			i++
+		}
+		j := i
+		for j < len(rest) && 'a' <= rest[j] && rest[j] <= 'z' {
+			j++
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		unit, ok := units[rest[i:j]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	return total, nil
+}
@@ -0,0 +1,131 @@
+// Package promql implements the subset of PromQL that the Prometheus query
+// API serves over OmniTrace metrics:
+//
+//	span_calls{service="checkout", status!="error"}
+//	rate(span_calls{service="checkout"}[5m])
+//	sum by (operation) (increase(span_errors[1h]))
+//
+// Selectors take the =, !=, =~ and !~ label matchers. rate and increase
+// apply to counters, and sum aggregates the series, optionally by or
+// without some labels. Metric and label names are exposed in Prometheus
+// form, with invalid characters such as dots replaced by underscores, and
+// a metric's service is its "service" label.
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Label names with special meaning
+const (
+	MetricNameLabel = "__name__"
+	ServiceLabel    = "service"
+)
+
+// Query is a parsed query
+type Query struct {
+	Selector Selector
+	// Function is "", models.MetricFunctionRate or
+	// models.MetricFunctionIncrease, over Range
+	Function string
+	Range    time.Duration
+	// Sum aggregates the series by the By labels, or by all labels but
+	// the Without labels
+	Sum     bool
+	By      []string
+	Without []string
+}
+
+// Selector selects series by their labels
+type Selector struct {
+	Matchers []Matcher
+}
+
+// Matcher compares one label with a value or regular expression
+type Matcher struct {
+	Label string
+	Op    string // =, !=, =~ or !~
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher creates a matcher, compiling regular expressions anchored at
+// both ends as Prometheus does
+func NewMatcher(label, op, value string) (Matcher, error) {
+	m := Matcher{Label: label, Op: op, Value: value}
+	switch op {
+	case "=", "!=":
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, fmt.Errorf("invalid regular expression %q: %v", value, err)
+		}
+		m.re = re
+	default:
+		return m, fmt.Errorf("unknown matcher operator %q", op)
+	}
+	return m, nil
+}
+
+// Matches reports whether a label value satisfies the matcher. A missing
+// label has the empty value.
+func (m Matcher) Matches(value string) bool {
+	switch m.Op {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// Matches reports whether a series with the labels is selected
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, m := range s.Matchers {
+		if !m.Matches(labels[m.Label]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SanitizeName replaces the characters that Prometheus doesn't allow in
+// metric and label names with underscores
+func SanitizeName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		valid := r == '_' || r == ':' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || (i > 0 && '0' <= r && r <= '9')
+		if valid {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// Labels returns the Prometheus labels of a metric series
+func Labels(name, service string, labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels)+2)
+	for k, v := range labels {
+		out[SanitizeName(k)] = v
+	}
+	if service != "" {
+		out[ServiceLabel] = service
+	}
+	out[MetricNameLabel] = SanitizeName(name)
+	return out
+}
+
+// MetricLabels returns the Prometheus labels of a metric point's series
+func MetricLabels(m models.Metric) map[string]string {
+	return Labels(m.Name, m.Service, m.Labels)
+}
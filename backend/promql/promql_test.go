@@ -0,0 +1,224 @@
+package promql
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// matcherStrings renders matchers as label, operator and quoted value, since
+// Matcher holds a compiled regular expression
+func matcherStrings(matchers []Matcher) []string {
+	out := make([]string, len(matchers))
+	for i, m := range matchers {
+		out[i] = m.Label + m.Op + `"` + m.Value + `"`
+	}
+	return out
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query    string
+		matchers []string
+		function string
+		window   time.Duration
+		sum      bool
+		by       []string
+		without  []string
+	}{
+		{query: `span_calls`, matchers: []string{`__name__="span_calls"`}},
+		{query: ` span_calls `, matchers: []string{`__name__="span_calls"`}},
+		{query: `span_calls{}`, matchers: []string{`__name__="span_calls"`}},
+		{query: `{service="checkout"}`, matchers: []string{`service="checkout"`}},
+		{
+			query:    `span_calls{service="checkout", status!="error",}`,
+			matchers: []string{`__name__="span_calls"`, `service="checkout"`, `status!="error"`},
+		},
+		{
+			query:    `span_calls{operation=~"GET .*", status!~'err.*'}`,
+			matchers: []string{`__name__="span_calls"`, `operation=~"GET .*"`, `status!~"err.*"`},
+		},
+		{query: `m{a="say \"hi\""}`, matchers: []string{`__name__="m"`, `a="say "hi""`}},
+		{query: `m{a='it\'s'}`, matchers: []string{`__name__="m"`, `a="it's"`}},
+		{query: "m{a=`C:\\path`}", matchers: []string{`__name__="m"`, `a="C:\path"`}},
+		{
+			query:    `rate(span_calls{service="checkout"}[5m])`,
+			matchers: []string{`__name__="span_calls"`, `service="checkout"`},
+			function: "rate", window: 5 * time.Minute,
+		},
+		{
+			query:    `increase( span_errors [ 1h30m ] )`,
+			matchers: []string{`__name__="span_errors"`},
+			function: "increase", window: 90 * time.Minute,
+		},
+		{query: `sum(span_calls)`, matchers: []string{`__name__="span_calls"`}, sum: true},
+		{
+			query:    `sum by (operation) (increase(span_errors[1h]))`,
+			matchers: []string{`__name__="span_errors"`},
+			function: "increase", window: time.Hour,
+			sum: true, by: []string{"operation"},
+		},
+		{
+			query:    `sum(rate(span_calls[1m])) by (service, operation,)`,
+			matchers: []string{`__name__="span_calls"`},
+			function: "rate", window: time.Minute,
+			sum: true, by: []string{"service", "operation"},
+		},
+		{
+			query:    `sum without (instance) (span_calls)`,
+			matchers: []string{`__name__="span_calls"`},
+			sum:      true, without: []string{"instance"},
+		},
+		{query: `sum by () (span_calls)`, matchers: []string{`__name__="span_calls"`}, sum: true, by: []string{}},
+		{query: `summary_metric`, matchers: []string{`__name__="summary_metric"`}},
+		{query: `rate_total`, matchers: []string{`__name__="rate_total"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := matcherStrings(q.Selector.Matchers); !reflect.DeepEqual(got, tt.matchers) {
+				t.Errorf("matchers = %q, want %q", got, tt.matchers)
+			}
+			if q.Function != tt.function || q.Range != tt.window {
+				t.Errorf("function = %q over %v, want %q over %v", q.Function, q.Range, tt.function, tt.window)
+			}
+			if q.Sum != tt.sum || !reflect.DeepEqual(q.By, tt.by) || !reflect.DeepEqual(q.Without, tt.without) {
+				t.Errorf("sum = %v by %q without %q, want %v by %q without %q", q.Sum, q.By, q.Without, tt.sum, tt.by, tt.without)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{``, 0, "expected a metric name or label matchers"},
+		{`{}`, 2, "expected a metric name or label matchers"},
+		{`span_calls extra`, 11, `unexpected "extra"`},
+		{`span_calls[5m]`, 11, "range vectors are only supported inside rate() and increase()"},
+		{`span_calls{service}`, 18, "expected a matcher operator"},
+		{`span_calls{="x"}`, 11, "expected a label name"},
+		{`span_calls{service=checkout}`, 19, "expected a string"},
+		{`span_calls{service="checkout"`, 29, `expected ","`},
+		{`span_calls{a="x" b="y"}`, 17, `expected ","`},
+		{`span_calls{service="checkout}`, 19, "unterminated string"},
+		{`span_calls{a="\q"}`, 13, "invalid string"},
+		{`span_calls{a=~"("}`, 17, "invalid regular expression"},
+		{`rate(span_calls)`, 15, `expected "["`},
+		{`rate(span_calls[])`, 16, `invalid range ""`},
+		{`rate(span_calls[5x])`, 16, `invalid range "5x"`},
+		{`rate(span_calls[0s])`, 16, `invalid range "0s"`},
+		{`rate(span_calls[5m`, 18, `expected "]"`},
+		{`rate(span_calls[5m]`, 19, `expected ")"`},
+		{`rate span_calls[5m]`, 5, `expected "("`},
+		{`sum(sum(span_calls))`, 19, "nested aggregations are not supported"},
+		{`sum(span_calls`, 14, `expected ")"`},
+		{`sum by operation (span_calls)`, 7, `expected "("`},
+		{`sum by (1) (span_calls)`, 8, "expected a label name"},
+		{`sum by (a b) (span_calls)`, 10, `expected ","`},
+		{`sum by (a) (span_calls) by (b)`, 24, `unexpected "by (b)"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Parse error = %v, want a *SyntaxError", err)
+			}
+			if syntaxErr.Pos != tt.pos || !strings.Contains(syntaxErr.Msg, tt.msg) {
+				t.Errorf("Parse error = %v, want position %d: ...%s...", err, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{"__name__": "span_calls", "service": "checkout", "status": "ok"}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{`span_calls`, true},
+		{`span_errors`, false},
+		{`{service="checkout"}`, true},
+		{`{service!="checkout"}`, false},
+		{`{service=~"check.*"}`, true},
+		{`{service=~"check"}`, false},
+		{`{service!~"front.*"}`, true},
+		{`span_calls{status="ok", service="checkout"}`, true},
+		{`span_calls{status="ok", service="frontend"}`, false},
+		{`{missing=""}`, true},
+		{`{missing!=""}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatalf("ParseSelector: %v", err)
+			}
+			if got := sel.Matches(labels); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, input := range []string{`rate(span_calls[5m])`, `sum(span_calls)`, `span_calls[5m]`, `{}`} {
+		if _, err := ParseSelector(input); err == nil {
+			t.Errorf("ParseSelector(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Duration
+	}{
+		{"500ms", 500 * time.Millisecond},
+		{"30s", 30 * time.Second},
+		{"5m", 5 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"2d", 48 * time.Hour},
+		{"1w", 7 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+		{"0s", 0},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v", tt.input, got, err, tt.want)
+		}
+	}
+
+	for _, input := range []string{"", "5", "m", "5x", "1.5h", "-5m", "5M", "5m "} {
+		if got, err := ParseDuration(input); err == nil {
+			t.Errorf("ParseDuration(%q) = %v, want an error", input, got)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"span_calls", "span_calls"},
+		{"http.server.duration", "http_server_duration"},
+		{"job:rate5m", "job:rate5m"},
+		{"5xx", "_xx"},
+		{"héllo-world", "h_llo_world"},
+	}
+	for _, tt := range tests {
+		if got := SanitizeName(tt.name); got != tt.want {
+			t.Errorf("SanitizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
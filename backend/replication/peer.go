@@ -0,0 +1,253 @@
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// initialBackoff is the wait before the first retry of a failed batch
+const initialBackoff = 500 * time.Millisecond
+
+// batch is a run of one tenant's spans stored at the same time
+type batch struct {
+	tenant   string
+	spans    []models.Span
+	accepted time.Time
+}
+
+// peer sends spans to one peer, one batch at a time and in order, so its
+// lag is the age of the oldest batch not yet sent
+type peer struct {
+	url    string
+	config Config
+	client *http.Client
+
+	mu      sync.Mutex
+	queue   []batch
+	sending *batch
+	// queued counts the spans in the queue and the batch being sent
+	queued  int
+	counts  Stats
+	lastErr error
+
+	wake   chan struct{}
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPeer(url string, config Config) *peer {
+	p := &peer{
+		url:    url,
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		wake:   make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.loop()
+	return p
+}
+
+// enqueue queues spans as batches of one tenant each, dropping those
+// beyond the queue size
+func (p *peer) enqueue(spans []models.Span, accepted time.Time) {
+	byTenant := make(map[string][]models.Span)
+	var tenants []string
+	for _, span := range spans {
+		if _, ok := byTenant[span.TenantID]; !ok {
+			tenants = append(tenants, span.TenantID)
+		}
+		byTenant[span.TenantID] = append(byTenant[span.TenantID], span)
+	}
+
+	p.mu.Lock()
+	for _, tenant := range tenants {
+		tenantSpans := byTenant[tenant]
+		if room := p.config.QueueSize - p.queued; len(tenantSpans) > room {
+			p.counts.Dropped += int64(len(tenantSpans) - max(room, 0))
+			tenantSpans = tenantSpans[:max(room, 0)]
+		}
+		if len(tenantSpans) == 0 {
+			continue
+		}
+		p.queue = append(p.queue, batch{tenant: tenant, spans: tenantSpans, accepted: accepted})
+		p.queued += len(tenantSpans)
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stats returns the peer's counters
+func (p *peer) stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.counts
+	stats.Queued = p.queued
+	switch {
+	case p.sending != nil:
+		stats.Lag = time.Since(p.sending.accepted)
+	case len(p.queue) > 0:
+		stats.Lag = time.Since(p.queue[0].accepted)
+	}
+	if p.lastErr != nil {
+		stats.LastError = p.lastErr.Error()
+	}
+	return stats
+}
+
+func (p *peer) loop() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.wake:
+		case <-p.stopCh:
+			return
+		}
+		for b := p.take(); b != nil; b = p.take() {
+			if !p.sendRetrying(b) {
+				return
+			}
+		}
+	}
+}
+
+// take removes the next batch from the queue, joined with the batches of
+// the same tenant after it up to the batch size, and marks it as being
+// sent. It returns nil when the queue is empty.
+func (p *peer) take() *batch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) == 0 {
+		return nil
+	}
+	b := p.queue[0]
+	p.queue = p.queue[1:]
+	for len(p.queue) > 0 && p.queue[0].tenant == b.tenant && len(b.spans)+len(p.queue[0].spans) <= p.config.BatchSize {
+		b.spans = append(b.spans[:len(b.spans):len(b.spans)], p.queue[0].spans...)
+		p.queue = p.queue[1:]
+	}
+	p.sending = &b
+	return &b
+}
+
+// sendRetrying sends a batch until the peer accepts or rejects it, backing
+// off between attempts. It returns false if the peer was closed first,
+// leaving the batch to be sent by close.
+func (p *peer) sendRetrying(b *batch) bool {
+	backoff := initialBackoff
+	for {
+		retryable, err := p.send(b)
+		if err == nil || !retryable {
+			if err != nil {
+				log.Printf("Replication: peer %s rejected %d spans: %v", p.url, len(b.spans), err)
+			}
+			p.done(b, err)
+			return true
+		}
+
+		p.mu.Lock()
+		p.counts.Failures++
+		p.lastErr = err
+		p.mu.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-p.stopCh:
+			return false
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// done records the outcome of the batch being sent
+func (p *peer) done(b *batch, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sending = nil
+	p.queued -= len(b.spans)
+	p.lastErr = err
+	if err != nil {
+		p.counts.Failures++
+		p.counts.Dropped += int64(len(b.spans))
+		return
+	}
+	p.counts.Replicated += int64(len(b.spans))
+	p.counts.LastReplicated = time.Now()
+}
+
+// send posts a batch to the peer's replicate endpoint, reporting whether a
+// failure is worth retrying
+func (p *peer) send(b *batch) (bool, error) {
+	data, err := json.Marshal(models.SpanBatch{Spans: b.spans})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url+"/api/v1/replicate", bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(models.TenantHeader, b.tenant)
+	if p.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.Token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
+
+// close stops the send loop and makes one attempt to send the spans still
+// queued, giving up on the rest at the first failure so that shutdown
+// isn't held up by a peer that is down
+func (p *peer) close() error {
+	close(p.stopCh)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	var batches []batch
+	if p.sending != nil {
+		batches = append(batches, *p.sending)
+	}
+	batches = append(batches, p.queue...)
+	p.queue = nil
+	p.mu.Unlock()
+
+	for i := range batches {
+		if _, err := p.send(&batches[i]); err != nil {
+			lost := 0
+			for _, b := range batches[i:] {
+				lost += len(b.spans)
+			}
+			return fmt.Errorf("peer %s: %d spans not replicated: %w", p.url, lost, err)
+		}
+		p.done(&batches[i], nil)
+	}
+	return nil
+}
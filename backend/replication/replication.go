@@ -0,0 +1,113 @@
+// Package replication copies the spans a collector stores to its peers, so
+// that each peer holds the recent traces of the others and can take over
+// their queries when one fails, instead of the in-memory window of the
+// failed collector being lost. Spans are sent in the background, in the
+// order they were stored, through the peers' /api/v1/replicate endpoint,
+// which stores them without replicating them again.
+package replication
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Default replication settings
+const (
+	DefaultBatchSize = 500
+	DefaultQueueSize = 100000
+	DefaultTimeout   = 10 * time.Second
+	// maxBackoff caps the wait between attempts to reach a peer that is
+	// down
+	maxBackoff = 30 * time.Second
+)
+
+// Config configures replication
+type Config struct {
+	// Peers are the base URLs of the collectors to replicate to
+	Peers []string
+	// Token authenticates the collector to its peers when they require
+	// auth
+	Token     string
+	BatchSize int
+	// QueueSize is the number of spans each peer queues while it can't be
+	// reached; spans beyond it are dropped
+	QueueSize int
+	Timeout   time.Duration
+}
+
+// Stats reports the replication counters of a peer
+type Stats struct {
+	Replicated int64 `json:"replicated"`
+	// Dropped counts spans dropped because the queue was full or the
+	// peer rejected them
+	Dropped int64 `json:"dropped"`
+	// Failures counts failed attempts to send a batch. Batches are
+	// retried until they succeed, unless the peer rejects them.
+	Failures int64 `json:"failures"`
+	Queued   int   `json:"queued"`
+	// Lag is how long the oldest span not yet acknowledged by the peer
+	// has waited, or zero when it is caught up
+	Lag            time.Duration `json:"lag"`
+	LastReplicated time.Time     `json:"last_replicated"`
+	LastError      string        `json:"last_error,omitempty"`
+}
+
+// Replicator replicates spans to each of its peers
+type Replicator struct {
+	peers []*peer
+}
+
+// New creates a replicator and starts sending to its peers
+func New(config Config) *Replicator {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	r := &Replicator{}
+	for _, url := range config.Peers {
+		r.peers = append(r.peers, newPeer(strings.TrimRight(url, "/"), config))
+	}
+	return r
+}
+
+// Replicate queues spans for every peer. It never blocks: spans beyond a
+// peer's queue size are dropped.
+func (r *Replicator) Replicate(spans []models.Span) {
+	if len(spans) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, p := range r.peers {
+		p.enqueue(spans, now)
+	}
+}
+
+// Stats returns the counters of each peer
+func (r *Replicator) Stats() map[string]Stats {
+	stats := make(map[string]Stats, len(r.peers))
+	for _, p := range r.peers {
+		stats[p.url] = p.stats()
+	}
+	return stats
+}
+
+// Close stops replicating after one last attempt to send the queued
+// spans. It returns the errors of the peers that couldn't be caught up.
+func (r *Replicator) Close() error {
+	var errs []error
+	for _, p := range r.peers {
+		if err := p.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
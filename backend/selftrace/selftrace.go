@@ -0,0 +1,86 @@
+// Package selftrace traces the collector's own request handling with the
+// SDK, so slow queries and storage stalls show up as traces of the
+// collector itself.
+//
+// Tracing a collector's requests produces spans that are ingested by a
+// collector, whose ingestion is traced in turn. To keep that from feeding
+// itself, exports carry the Header marker and requests bearing it are
+// never traced, by this collector or by a self-tracing peer. Live tail
+// streams and the collector's own telemetry endpoints are skipped as
+// well, and only a sample of requests is traced.
+package selftrace
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/omnitrace/omnitrace/sdk"
+)
+
+// Header marks export requests of self-traces
+const Header = "X-OmniTrace-Self-Trace"
+
+// skipPaths are never traced: long-lived streams and telemetry scrapes
+var skipPaths = []string{"/api/traces/stream", "/api/status"}
+
+// Config configures self-tracing
+type Config struct {
+	// Endpoint is the collector the traces are exported to
+	Endpoint    string
+	Token       string
+	ServiceName string
+	SampleRate  float64
+}
+
+// Tracer traces the requests handled by a mux
+type Tracer struct {
+	tracer   *sdk.Tracer
+	exporter *sdk.Exporter
+}
+
+// New creates a tracer exporting to the configured collector
+func New(config Config) *Tracer {
+	exporterConfig := sdk.DefaultExporterConfig()
+	exporterConfig.CollectorURL = strings.TrimSuffix(config.Endpoint, "/")
+	exporterConfig.AuthToken = config.Token
+	exporterConfig.Headers = map[string]string{Header: "1"}
+	exporterConfig.OnError = func(err error) {
+		log.Printf("Self-trace export failed: %v", err)
+	}
+	exporter := sdk.NewExporter(exporterConfig)
+
+	return &Tracer{
+		tracer: sdk.NewTracer(config.ServiceName,
+			sdk.WithExporter(exporter),
+			sdk.WithSampler(sdk.NewProbabilitySampler(config.SampleRate)),
+		),
+		exporter: exporter,
+	}
+}
+
+// Handler traces the requests mux serves, named by the pattern that
+// matches them so that IDs in paths don't each make an operation
+func (t *Tracer) Handler(mux *http.ServeMux) http.Handler {
+	return sdk.NewMiddleware(t.tracer, sdk.MiddlewareConfig{
+		SkipPaths: skipPaths,
+		OperationNamer: func(r *http.Request) string {
+			_, pattern := mux.Handler(r)
+			if pattern == "" {
+				pattern = r.URL.Path
+			}
+			if strings.Contains(pattern, " ") {
+				return pattern
+			}
+			return r.Method + " " + pattern
+		},
+		SpanFilter: func(r *http.Request) bool {
+			return r.Header.Get(Header) == ""
+		},
+	}).Handler(mux)
+}
+
+// Close exports the remaining spans
+func (t *Tracer) Close() error {
+	return t.exporter.Close()
+}
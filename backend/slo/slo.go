@@ -0,0 +1,444 @@
+// Package slo tracks service level objectives. It counts the good and total
+// requests of each SLO per minute as spans are stored, and reports the
+// SLI, remaining error budget and burn rates over its rolling window.
+package slo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Window limits
+const (
+	DefaultWindow = 30 * 24 * time.Hour
+	MaxWindow     = 90 * 24 * time.Hour
+	// saveInterval is how often counts are written to the tracker's file
+	saveInterval = time.Minute
+)
+
+// BurnRateWindows are the windows burn rates are reported over, as used by
+// multiwindow burn rate alerts
+var BurnRateWindows = []time.Duration{
+	5 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	72 * time.Hour,
+}
+
+// Errors returned when changing SLOs
+var (
+	ErrSLONotFound = errors.New("SLO not found")
+	ErrSLOExists   = errors.New("SLO already exists")
+)
+
+// bucket counts the requests of one minute
+type bucket struct {
+	Minute int64  `json:"minute"` // Unix minutes
+	Good   uint64 `json:"good"`
+	Total  uint64 `json:"total"`
+}
+
+// tracked is an SLO and its ring of per-minute counts, one bucket per
+// minute of its window
+type tracked struct {
+	slo     models.SLO
+	buckets []bucket
+}
+
+func newTracked(slo models.SLO) *tracked {
+	return &tracked{slo: slo, buckets: make([]bucket, time.Duration(slo.Window)/time.Minute)}
+}
+
+// matches reports whether a span is one of the SLO's requests
+func (t *tracked) matches(span *models.Span) bool {
+	if span.ServiceName != t.slo.Service || (t.slo.Operation != "" && span.OperationName != t.slo.Operation) {
+		return false
+	}
+	return span.ParentSpanID.IsZero() || span.Kind == models.SpanKindServer || span.Kind == models.SpanKindConsumer
+}
+
+func (t *tracked) good(span *models.Span) bool {
+	if t.slo.Type == models.SLOTypeLatency {
+		return span.Duration <= time.Duration(t.slo.Threshold)
+	}
+	return span.Status != models.SpanStatusError
+}
+
+// record counts a request in its minute's bucket. Requests older than the
+// bucket's minute have fallen out of the window.
+func (t *tracked) record(minute int64, good bool) {
+	b := &t.buckets[mod(minute, int64(len(t.buckets)))]
+	if b.Minute > minute {
+		return
+	}
+	if b.Minute < minute {
+		*b = bucket{Minute: minute}
+	}
+	b.Total++
+	if good {
+		b.Good++
+	}
+}
+
+// count sums the requests of the window ending at now
+func (t *tracked) count(now time.Time, window time.Duration) (good, total uint64) {
+	last := unixMinute(now)
+	first := last - int64(window/time.Minute)
+	for _, b := range t.buckets {
+		if b.Minute > first && b.Minute <= last {
+			good += b.Good
+			total += b.Total
+		}
+	}
+	return good, total
+}
+
+// burnRate is how many times faster than the window allows the error
+// budget was spent over a window
+func (t *tracked) burnRate(now time.Time, window time.Duration) float64 {
+	good, total := t.count(now, window)
+	if total == 0 {
+		return 0
+	}
+	return (1 - float64(good)/float64(total)) / (1 - t.slo.Objective)
+}
+
+func (t *tracked) status(now time.Time) models.SLOStatus {
+	good, total := t.count(now, time.Duration(t.slo.Window))
+	status := models.SLOStatus{
+		SLO:         t.slo,
+		Total:       total,
+		Good:        good,
+		SLI:         1,
+		ErrorBudget: 1 - t.slo.Objective,
+		BurnRates:   make(map[string]float64),
+	}
+	if total > 0 {
+		status.SLI = float64(good) / float64(total)
+	}
+	status.BudgetRemaining = 1 - (1-status.SLI)/status.ErrorBudget
+	for _, window := range BurnRateWindows {
+		if window <= time.Duration(t.slo.Window) {
+			status.BurnRates[formatWindow(window)] = t.burnRate(now, window)
+		}
+	}
+	return status
+}
+
+// Tracker tracks the SLOs of every tenant. It is a span observer of the
+// ingestion processor. With a file, SLOs and their counts are loaded from
+// it and saved to it every minute and on Close.
+type Tracker struct {
+	mu    sync.RWMutex
+	slos  map[string]map[string]*tracked // Tenant -> name -> SLO
+	path  string
+	dirty bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// savedSLO is the file format of an SLO and its non-empty buckets
+type savedSLO struct {
+	SLO     models.SLO `json:"slo"`
+	Buckets []bucket   `json:"buckets,omitempty"`
+}
+
+// NewTracker creates a tracker. With a path, SLOs are loaded from and saved
+// to that file.
+func NewTracker(path string) (*Tracker, error) {
+	t := &Tracker{
+		slos:   make(map[string]map[string]*tracked),
+		path:   path,
+		stopCh: make(chan struct{}),
+	}
+	if path != "" {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	t.wg.Add(1)
+	go t.loop()
+	return t, nil
+}
+
+func (t *Tracker) load() error {
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedSLO
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("load SLOs: %w", err)
+	}
+	for _, s := range saved {
+		if err := Validate(&s.SLO); err != nil {
+			return fmt.Errorf("load SLO %s: %w", s.SLO.Name, err)
+		}
+		tr := newTracked(s.SLO)
+		for _, b := range s.Buckets {
+			tr.buckets[mod(b.Minute, int64(len(tr.buckets)))] = b
+		}
+		if t.slos[s.SLO.Tenant] == nil {
+			t.slos[s.SLO.Tenant] = make(map[string]*tracked)
+		}
+		t.slos[s.SLO.Tenant][s.SLO.Name] = tr
+	}
+	return nil
+}
+
+func (t *Tracker) loop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+// flush saves counts that changed since the last save
+func (t *Tracker) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.dirty {
+		return
+	}
+	if err := t.save(); err != nil {
+		log.Printf("Failed to save SLOs: %v", err)
+	}
+}
+
+// Close stops the save loop and saves the counts
+func (t *Tracker) Close() {
+	close(t.stopCh)
+	t.wg.Wait()
+	t.flush()
+}
+
+// Validate checks an SLO and fills in its defaults
+func Validate(slo *models.SLO) error {
+	if slo.Name == "" {
+		return errors.New("missing name")
+	}
+	if strings.Contains(slo.Name, "/") {
+		return fmt.Errorf("invalid name %q: must not contain /", slo.Name)
+	}
+	if slo.Tenant == "" {
+		slo.Tenant = models.DefaultTenant
+	}
+	if slo.Service == "" {
+		return errors.New("missing service")
+	}
+	switch slo.Type {
+	case "":
+		slo.Type = models.SLOTypeAvailability
+	case models.SLOTypeAvailability:
+	case models.SLOTypeLatency:
+		if slo.Threshold <= 0 {
+			return errors.New("latency SLOs need a positive threshold")
+		}
+	default:
+		return fmt.Errorf("invalid type %q: want availability or latency", slo.Type)
+	}
+	if slo.Objective <= 0 || slo.Objective >= 1 {
+		return fmt.Errorf("invalid objective %g: want a fraction between 0 and 1, e.g. 0.999", slo.Objective)
+	}
+	if slo.Window == 0 {
+		slo.Window = models.Duration(DefaultWindow)
+	}
+	window := time.Duration(slo.Window)
+	if window < time.Minute || window > MaxWindow || window%time.Minute != 0 {
+		return fmt.Errorf("invalid window %s: want whole minutes up to 90 days", window)
+	}
+	return nil
+}
+
+// Observe counts the requests among newly stored spans
+func (t *Tracker) Observe(tenant string, spans []models.Span) {
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	slos := t.slos[tenant]
+	if len(slos) == 0 {
+		return
+	}
+	for i := range spans {
+		span := &spans[i]
+		for _, tr := range slos {
+			if tr.matches(span) {
+				tr.record(unixMinute(span.StartTime), tr.good(span))
+				t.dirty = true
+			}
+		}
+	}
+}
+
+// Add validates and starts tracking an SLO. It fails with ErrSLOExists if
+// the tenant has an SLO of the same name.
+func (t *Tracker) Add(slo models.SLO) (models.SLO, error) {
+	if err := Validate(&slo); err != nil {
+		return models.SLO{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.slos[slo.Tenant][slo.Name]; ok {
+		return models.SLO{}, ErrSLOExists
+	}
+	if t.slos[slo.Tenant] == nil {
+		t.slos[slo.Tenant] = make(map[string]*tracked)
+	}
+	t.slos[slo.Tenant][slo.Name] = newTracked(slo)
+	if err := t.save(); err != nil {
+		delete(t.slos[slo.Tenant], slo.Name)
+		return models.SLO{}, err
+	}
+	return slo, nil
+}
+
+// Delete stops tracking a tenant's SLO
+func (t *Tracker) Delete(tenant, name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, ok := t.slos[tenant][name]
+	if !ok {
+		return ErrSLONotFound
+	}
+	delete(t.slos[tenant], name)
+	if err := t.save(); err != nil {
+		t.slos[tenant][name] = tr
+		return err
+	}
+	return nil
+}
+
+// List returns the status of a tenant's SLOs, by name
+func (t *Tracker) List(tenant string, now time.Time) []models.SLOStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	statuses := make([]models.SLOStatus, 0, len(t.slos[tenant]))
+	for _, tr := range t.slos[tenant] {
+		statuses = append(statuses, tr.status(now))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].SLO.Name < statuses[j].SLO.Name })
+	return statuses
+}
+
+// Get returns the status of a tenant's SLO
+func (t *Tracker) Get(tenant, name string, now time.Time) (models.SLOStatus, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tr, ok := t.slos[tenant][name]
+	if !ok {
+		return models.SLOStatus{}, ErrSLONotFound
+	}
+	return tr.status(now), nil
+}
+
+// Stat returns a statistic of a tenant's SLO at a time. Burn rates and SLIs
+// are over window; the remaining budget is over the SLO's own window.
+func (t *Tracker) Stat(tenant, name, stat string, window time.Duration, now time.Time) (float64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tr, ok := t.slos[tenant][name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrSLONotFound, name)
+	}
+	switch stat {
+	case models.SLOStatBurnRate:
+		return tr.burnRate(now, window), nil
+	case models.SLOStatSLI:
+		good, total := tr.count(now, window)
+		if total == 0 {
+			return 1, nil
+		}
+		return float64(good) / float64(total), nil
+	case models.SLOStatBudgetRemaining:
+		return tr.status(now).BudgetRemaining, nil
+	}
+	return 0, fmt.Errorf("invalid SLO stat %q", stat)
+}
+
+// save writes the SLOs to the tracker's file, if any. Callers hold t.mu
+// for writing.
+func (t *Tracker) save() error {
+	if t.path == "" {
+		t.dirty = false
+		return nil
+	}
+	var saved []savedSLO
+	for _, slos := range t.slos {
+		for _, tr := range slos {
+			s := savedSLO{SLO: tr.slo}
+			for _, b := range tr.buckets {
+				if b.Total > 0 {
+					s.Buckets = append(s.Buckets, b)
+				}
+			}
+			saved = append(saved, s)
+		}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+func unixMinute(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+func mod(a, b int64) int64 {
+	return ((a % b) + b) % b
+}
+
+// formatWindow writes a window the way users write it, e.g. "1h" rather
+// than "1h0m0s"
+func formatWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
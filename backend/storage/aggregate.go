@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// operationCounter accumulates per-operation span and error counts
+type operationCounter map[string]*models.OperationStats
+
+func (c operationCounter) add(span models.Span) {
+	op, ok := c[span.OperationName]
+	if !ok {
+		op = &models.OperationStats{Name: span.OperationName}
+		c[span.OperationName] = op
+	}
+	op.SpanCount++
+	if span.Status == models.SpanStatusError {
+		op.ErrorCount++
+	}
+}
+
+// result returns the counts sorted by operation name
+func (c operationCounter) result() []models.OperationStats {
+	operations := make([]models.OperationStats, 0, len(c))
+	for _, op := range c {
+		op.ErrorRate = float64(op.ErrorCount) / float64(op.SpanCount)
+		operations = append(operations, *op)
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].Name < operations[j].Name })
+	return operations
+}
+
+// latencyAggregator accumulates span latencies into per-bucket histograms.
+// Latencies are recorded in microseconds and reported in milliseconds.
+type latencyAggregator struct {
+	query      models.LatencyQuery
+	histograms map[int64]*Histogram
+	errors     map[int64]uint64
+}
+
+func newLatencyAggregator(query models.LatencyQuery) *latencyAggregator {
+	return &latencyAggregator{
+		query:      query,
+		histograms: make(map[int64]*Histogram),
+		errors:     make(map[int64]uint64),
+	}
+}
+
+func (a *latencyAggregator) add(span models.Span) {
+	q := a.query
+	if q.Service != "" && span.ServiceName != q.Service {
+		return
+	}
+	if q.Operation != "" && span.OperationName != q.Operation {
+		return
+	}
+	if span.StartTime.Before(q.StartTime) || span.StartTime.After(q.EndTime) {
+		return
+	}
+
+	bucket := span.StartTime.Truncate(q.Step).Unix()
+	h, ok := a.histograms[bucket]
+	if !ok {
+		h = NewHistogram()
+		a.histograms[bucket] = h
+	}
+	h.Record(float64(span.Duration.Microseconds()))
+	if span.Status == models.SpanStatusError {
+		a.errors[bucket]++
+	}
+}
+
+// result returns the percentiles of each bucket in time order
+func (a *latencyAggregator) result() []models.LatencyBucket {
+	buckets := make([]models.LatencyBucket, 0, len(a.histograms))
+	for start, h := range a.histograms {
+		q := h.Quantiles(0.5, 0.9, 0.95, 0.99)
+		buckets = append(buckets, models.LatencyBucket{
+			StartTime: time.Unix(start, 0),
+			Count:     h.Count(),
+			Errors:    a.errors[start],
+			P50:       q[0] / 1000,
+			P90:       q[1] / 1000,
+			P95:       q[2] / 1000,
+			P99:       q[3] / 1000,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].StartTime.Before(buckets[j].StartTime) })
+	return buckets
+}
+
+// operationAggregator accumulates the span latencies and errors of each
+// operation of a service
+type operationAggregator struct {
+	query      models.OperationSummaryQuery
+	histograms map[string]*Histogram
+	errors     map[string]uint64
+}
+
+func newOperationAggregator(query models.OperationSummaryQuery) *operationAggregator {
+	return &operationAggregator{
+		query:      query,
+		histograms: make(map[string]*Histogram),
+		errors:     make(map[string]uint64),
+	}
+}
+
+func (a *operationAggregator) add(span models.Span) {
+	q := a.query
+	if span.ServiceName != q.Service {
+		return
+	}
+	if span.StartTime.Before(q.StartTime) || span.StartTime.After(q.EndTime) {
+		return
+	}
+
+	h, ok := a.histograms[span.OperationName]
+	if !ok {
+		h = NewHistogram()
+		a.histograms[span.OperationName] = h
+	}
+	h.Record(float64(span.Duration.Microseconds()))
+	if span.Status == models.SpanStatusError {
+		a.errors[span.OperationName]++
+	}
+}
+
+// result returns the summary of each operation sorted by name
+func (a *operationAggregator) result() []models.OperationSummary {
+	operations := make([]models.OperationSummary, 0, len(a.histograms))
+	for name, h := range a.histograms {
+		q := h.Quantiles(0.5, 0.9, 0.95, 0.99)
+		op := models.OperationSummary{
+			Name:   name,
+			Count:  h.Count(),
+			Errors: a.errors[name],
+			P50:    q[0] / 1000,
+			P90:    q[1] / 1000,
+			P95:    q[2] / 1000,
+			P99:    q[3] / 1000,
+		}
+		op.SetRates(a.query)
+		operations = append(operations, op)
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].Name < operations[j].Name })
+	return operations
+}
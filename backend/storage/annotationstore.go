@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// maxAnnotationText caps the length of an annotation's text
+const maxAnnotationText = 16 << 10
+
+// ErrInvalidAnnotation is returned when adding an annotation without text
+// or with too much of it
+var ErrInvalidAnnotation = errors.New("invalid annotation")
+
+// AnnotationStore keeps the notes users attach to a tenant's traces, in
+// the order they were added. When full, the oldest are dropped.
+// Annotations are written to a file when the tenant's storage is
+// persistent, and outlive the traces they annotate so that they are still
+// there when a trace is found in the archive.
+type AnnotationStore struct {
+	annotations []models.TraceAnnotation // Oldest first
+	mu          sync.RWMutex
+	max         int
+	path        string
+}
+
+// NewAnnotationStore creates an annotation store keeping up to max
+// annotations (0 = no limit). With a path, annotations are loaded from and
+// saved to that file.
+func NewAnnotationStore(max int, path string) (*AnnotationStore, error) {
+	store := &AnnotationStore{max: max, path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.annotations); err != nil {
+		return nil, fmt.Errorf("load annotations: %w", err)
+	}
+	return store, nil
+}
+
+// Add annotates a trace, assigning the annotation's ID and time
+func (s *AnnotationStore) Add(a models.TraceAnnotation) (models.TraceAnnotation, error) {
+	if a.Text == "" {
+		return a, fmt.Errorf("%w: text is required", ErrInvalidAnnotation)
+	}
+	if len(a.Text) > maxAnnotationText {
+		return a, fmt.Errorf("%w: text is longer than %d bytes", ErrInvalidAnnotation, maxAnnotationText)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return a, err
+	}
+	a.ID = hex.EncodeToString(id)
+	a.CreatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.annotations
+	annotations := append(previous[:len(previous):len(previous)], a)
+	if s.max > 0 && len(annotations) > s.max {
+		annotations = annotations[len(annotations)-s.max:]
+	}
+	s.annotations = annotations
+	if err := s.save(); err != nil {
+		// Keep memory and disk in step
+		s.annotations = previous
+		return a, err
+	}
+	return a, nil
+}
+
+// Trace returns the annotations of a trace, oldest first
+func (s *AnnotationStore) Trace(traceID models.TraceID) []models.TraceAnnotation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	annotations := []models.TraceAnnotation{}
+	for _, a := range s.annotations {
+		if a.TraceID == traceID {
+			annotations = append(annotations, a)
+		}
+	}
+	return annotations
+}
+
+// save writes the annotations to the store's file, if any. Callers hold
+// s.mu.
+func (s *AnnotationStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.annotations)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
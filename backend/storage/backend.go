@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// MemoryBackend is the name of the built-in in-memory storage backend
+const MemoryBackend = "memory"
+
+// SpanWriter writes spans
+type SpanWriter interface {
+	// Store writes one span
+	Store(span models.Span) error
+	// StoreBatch writes spans and returns the ones that weren't already
+	// stored under the same trace and span ID
+	StoreBatch(spans []models.Span) ([]models.Span, error)
+}
+
+// SpanReader reads traces and span statistics
+type SpanReader interface {
+	// GetTrace returns a trace, or nil if it isn't stored
+	GetTrace(traceID models.TraceID) (*models.Trace, error)
+	QueryTraces(query models.TraceQuery) ([]models.TraceSummary, error)
+	// CountTraces counts the traces matching a query's filters, whatever
+	// its cursor, offset and limit
+	CountTraces(query models.TraceQuery) (int, error)
+	FindSpan(traceID models.TraceID, spanID models.SpanID) (models.Span, bool)
+	ChildSpans(traceID models.TraceID, parentID models.SpanID) []models.Span
+	Services() []string
+	Operations(service string) []models.OperationStats
+	LatencyPercentiles(query models.LatencyQuery) ([]models.LatencyBucket, error)
+	// OperationSummaries returns the request rate, errors and latency
+	// percentiles of each operation of a service
+	OperationSummaries(query models.OperationSummaryQuery) ([]models.OperationSummary, error)
+	// TagKeys and TagValues return the most common tag keys of a service,
+	// and values of a tag key, with the number of traces carrying them
+	TagKeys(query models.TagQuery) ([]models.TagCount, error)
+	TagValues(query models.TagQuery) ([]models.TagCount, error)
+}
+
+// SpanBackend is a tenant's span storage
+type SpanBackend interface {
+	SpanReader
+	SpanWriter
+	// Stats reports the backend's size
+	Stats() SpanStoreStats
+	// ServiceStats counts the stored traces and spans of each service
+	ServiceStats() (map[string]SpanStoreStats, error)
+	// DeleteTrace removes a trace and reports whether it was stored
+	DeleteTrace(traceID models.TraceID) (bool, error)
+	// DeleteService removes the spans of a service and returns how many
+	// were stored
+	DeleteService(service string) (int, error)
+	// GC removes expired data
+	GC()
+	// Compact removes expired data and reclaims the space it used
+	Compact() error
+	Close() error
+}
+
+// MetricBackend is a tenant's metric storage
+type MetricBackend interface {
+	Store(metric models.Metric) error
+	QueryMetrics(query models.MetricQuery) ([]models.AggregatedMetric, error)
+	// Series lists the series matching the query's name (if set), service
+	// and labels, with points in its time range (if set)
+	Series(query models.MetricQuery) ([]models.MetricSeries, error)
+	// Points returns the stored points of the series matching the query,
+	// in its time range (if set), for export
+	Points(query models.MetricQuery) ([]models.Metric, error)
+	// Cardinality reports the metrics and services with the most series
+	Cardinality(top int) models.CardinalityReport
+	// Stats reports the backend's size
+	Stats() MetricStoreStats
+	// DeleteService removes the series of a service and returns how many
+	// were stored
+	DeleteService(service string) (int, error)
+	// GC removes expired data
+	GC()
+	// Compact removes expired data and reclaims the space it used
+	Compact() error
+	Close() error
+}
+
+// SpanStoreStats reports the size of a span backend. Disk-based backends
+// may only report Bytes.
+type SpanStoreStats struct {
+	Traces int   `json:"traces"`
+	Spans  int   `json:"spans"`
+	Bytes  int64 `json:"bytes,omitempty"`
+	// Compressed counts the traces held compressed
+	Compressed int `json:"compressed_traces,omitempty"`
+	// DroppedSpans counts the spans dropped because their trace held the
+	// most spans allowed
+	DroppedSpans uint64 `json:"dropped_spans"`
+}
+
+// MetricStoreStats reports the size of a metric backend
+type MetricStoreStats struct {
+	Series int `json:"series"`
+	Points int `json:"points"`
+	// Overflowed counts points of series beyond the series limits
+	Overflowed uint64 `json:"overflowed"`
+}
+
+// SpanBackendFactory creates the span backend of a tenant
+type SpanBackendFactory func(tenant string, cfg TenantConfig) (SpanBackend, error)
+
+// MetricBackendFactory creates the metric backend of a tenant
+type MetricBackendFactory func(tenant string, cfg TenantConfig) (MetricBackend, error)
+
+var (
+	backendsMu     sync.RWMutex
+	spanBackends   = map[string]SpanBackendFactory{}
+	metricBackends = map[string]MetricBackendFactory{}
+	// remoteBackends are the span backends that read another collector's
+	// storage rather than holding any here
+	remoteBackends = map[string]bool{}
+)
+
+func init() {
+	RegisterSpanBackend(MemoryBackend, func(tenant string, cfg TenantConfig) (SpanBackend, error) {
+		opts := []SpanStoreOption{
+			WithAssemblyDelay(cfg.AssemblyDelay),
+			WithCompression(cfg.SpanCompression),
+			WithMaxSpansPerTrace(cfg.MaxSpansPerTrace),
+		}
+		if cfg.WAL {
+			w, err := openTenantWAL(tenant, cfg, "spans")
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, WithSpanWAL(w, cfg.SnapshotInterval))
+		}
+		return NewSpanStore(cfg.MaxSpans, cfg.SpanTTL, opts...), nil
+	})
+	RegisterMetricBackend(MemoryBackend, func(tenant string, cfg TenantConfig) (MetricBackend, error) {
+		opts := []MetricStoreOption{WithSeriesLimits(cfg.SeriesLimits)}
+		if cfg.WAL {
+			w, err := openTenantWAL(tenant, cfg, "metrics")
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, WithMetricWAL(w, cfg.SnapshotInterval))
+		}
+		return NewMetricStore(cfg.MaxMetrics, cfg.MetricTTL, opts...), nil
+	})
+}
+
+// openTenantWAL opens a tenant's WAL for one kind of data
+func openTenantWAL(tenant string, cfg TenantConfig, kind string) (*WAL, error) {
+	if cfg.DataDir == "" {
+		return nil, errors.New("wal requires a data directory")
+	}
+	return OpenWAL(filepath.Join(tenantDir(cfg.DataDir, tenant), kind+"-wal"), tenant+"/"+kind)
+}
+
+// RegisterSpanBackend makes a span backend selectable by name
+func RegisterSpanBackend(name string, factory SpanBackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	spanBackends[name] = factory
+}
+
+// RegisterRemoteSpanBackend makes a span backend that reads another
+// collector's storage selectable by name. Such a backend holds nothing
+// here, so tenants this collector hasn't opened are read through it too.
+func RegisterRemoteSpanBackend(name string, factory SpanBackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	spanBackends[name] = factory
+	remoteBackends[name] = true
+}
+
+// remoteSpanBackend reports whether a span backend was registered with
+// RegisterRemoteSpanBackend
+func remoteSpanBackend(name string) bool {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	return remoteBackends[name]
+}
+
+// RegisterMetricBackend makes a metric backend selectable by name
+func RegisterMetricBackend(name string, factory MetricBackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	metricBackends[name] = factory
+}
+
+// Backends returns the names of the registered span backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(spanBackends))
+	for name := range spanBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func spanBackendFactory(name string) (SpanBackendFactory, error) {
+	if name == "" {
+		name = MemoryBackend
+	}
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	factory, ok := spanBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown span storage backend %q", name)
+	}
+	return factory, nil
+}
+
+func metricBackendFactory(name string) (MetricBackendFactory, error) {
+	if name == "" {
+		name = MemoryBackend
+	}
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	factory, ok := metricBackends[name]
+	if !ok {
+		// Backends that only store spans keep metrics in memory
+		return metricBackends[MemoryBackend], nil
+	}
+	return factory, nil
+}
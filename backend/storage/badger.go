@@ -0,0 +1,655 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// BadgerBackend is the name of the embedded BadgerDB storage backend
+const BadgerBackend = "badger"
+
+// Key prefixes. Keys are prefix, then 0-separated parts:
+//
+//	t <traceID> <spanID>            -> span JSON
+//	s <service> <traceID>           -> service index, empty value
+//	w <traceID>                     -> last write, Unix nanoseconds
+//	x <traceID>                     -> trace truncated, empty value
+//
+// Every key expires with the span TTL, so Badger drops expired traces and
+// their index entries itself and GC only reclaims value log space.
+const (
+	badgerSpanPrefix      = 't'
+	badgerServicePrefix   = 's'
+	badgerWritePrefix     = 'w'
+	badgerTruncatedPrefix = 'x'
+)
+
+// badgerTagSampleTraces is how many traces tag completions are counted over
+const badgerTagSampleTraces = 1000
+
+func init() {
+	RegisterSpanBackend(BadgerBackend, func(tenant string, cfg TenantConfig) (SpanBackend, error) {
+		if cfg.DataDir == "" {
+			return nil, errors.New("badger backend requires a data directory")
+		}
+		return OpenBadgerSpanStore(tenantDir(cfg.DataDir, tenant), cfg.SpanTTL, cfg.AssemblyDelay, cfg.MaxSpansPerTrace)
+	})
+}
+
+// BadgerSpanStore persists spans in an embedded BadgerDB so that traces
+// survive restarts. Spans are keyed by trace ID, so a trace is read with one
+// prefix scan; a service index serves service-filtered queries.
+type BadgerSpanStore struct {
+	db               *badger.DB
+	ttl              time.Duration
+	assemblyDelay    time.Duration
+	maxSpansPerTrace int
+	dropped          atomic.Uint64
+	done             chan struct{}
+}
+
+// OpenBadgerSpanStore opens or creates a Badger span store in dir. With
+// maxSpansPerTrace, further new spans of a trace are dropped and the trace
+// is marked truncated.
+func OpenBadgerSpanStore(dir string, ttl, assemblyDelay time.Duration, maxSpansPerTrace int) (*BadgerSpanStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	opts := badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("open badger: %w", err)
+	}
+
+	store := &BadgerSpanStore{
+		db:               db,
+		ttl:              ttl,
+		assemblyDelay:    assemblyDelay,
+		maxSpansPerTrace: maxSpansPerTrace,
+		done:             make(chan struct{}),
+	}
+	go store.gcLoop()
+	return store, nil
+}
+
+func badgerKey(prefix byte, parts ...string) []byte {
+	var b bytes.Buffer
+	b.WriteByte(prefix)
+	for _, part := range parts {
+		b.WriteByte(0)
+		b.WriteString(part)
+	}
+	return b.Bytes()
+}
+
+// splitBadgerKey returns the parts of a key after its prefix
+func splitBadgerKey(key []byte) []string {
+	var parts []string
+	for _, part := range bytes.Split(key[1:], []byte{0})[1:] {
+		parts = append(parts, string(part))
+	}
+	return parts
+}
+
+// entry returns a write of key that expires the TTL after start, or after
+// now if start is zero. Spans expire by their start rather than when they
+// were stored, so that a late span doesn't outlive the rest of its trace.
+func (s *BadgerSpanStore) entry(key, value []byte, start time.Time) *badger.Entry {
+	e := badger.NewEntry(key, value)
+	if s.ttl > 0 {
+		if start.IsZero() {
+			start = time.Now()
+		}
+		// 0 would never expire
+		e.ExpiresAt = uint64(max(start.Add(s.ttl).Unix(), 1))
+	}
+	return e
+}
+
+// Store adds a span to storage
+func (s *BadgerSpanStore) Store(span models.Span) error {
+	_, err := s.StoreBatch([]models.Span{span})
+	return err
+}
+
+// StoreBatch writes spans in one transaction. A span already stored under
+// the same trace and span ID is replaced (unless it is complete and the new
+// one isn't) and not returned. New spans of a trace that holds the most
+// spans allowed are dropped.
+func (s *BadgerSpanStore) StoreBatch(spans []models.Span) ([]models.Span, error) {
+	stored := make([]models.Span, 0, len(spans))
+	now := make([]byte, 8)
+	binary.BigEndian.PutUint64(now, uint64(time.Now().UnixNano()))
+
+	txn := s.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	// counts holds the span count of the batch's traces once read
+	counts := make(map[models.TraceID]int)
+
+	set := func(e *badger.Entry) error {
+		err := txn.SetEntry(e)
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			if err := txn.Commit(); err != nil {
+				return err
+			}
+			txn = s.db.NewTransaction(true)
+			err = txn.SetEntry(e)
+		}
+		return err
+	}
+
+	for _, span := range spans {
+		key := badgerKey(badgerSpanPrefix, span.TraceID.String(), span.SpanID.String())
+
+		duplicate := false
+		if item, err := txn.Get(key); err == nil {
+			duplicate = true
+			var existing models.Span
+			if err := item.Value(func(v []byte) error { return json.Unmarshal(v, &existing) }); err == nil {
+				if span.EndTime.IsZero() && !existing.EndTime.IsZero() {
+					continue
+				}
+			}
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return stored, err
+		}
+		if !duplicate && s.maxSpansPerTrace > 0 {
+			count, ok := counts[span.TraceID]
+			if !ok {
+				count = s.countSpans(txn, span.TraceID)
+			}
+			if count >= s.maxSpansPerTrace {
+				s.dropped.Add(1)
+				if err := set(s.entry(badgerKey(badgerTruncatedPrefix, span.TraceID.String()), nil, time.Time{})); err != nil {
+					return stored, err
+				}
+				continue
+			}
+			counts[span.TraceID] = count + 1
+		}
+
+		value, err := json.Marshal(span)
+		if err != nil {
+			return stored, err
+		}
+		if err := set(s.entry(key, value, span.StartTime)); err != nil {
+			return stored, err
+		}
+		if err := set(s.entry(badgerKey(badgerServicePrefix, span.ServiceName, span.TraceID.String()), nil, span.StartTime)); err != nil {
+			return stored, err
+		}
+		if err := set(s.entry(badgerKey(badgerWritePrefix, span.TraceID.String()), now, time.Time{})); err != nil {
+			return stored, err
+		}
+		if !duplicate {
+			stored = append(stored, span)
+		}
+	}
+
+	return stored, txn.Commit()
+}
+
+// countSpans counts the stored spans of a trace, up to the span limit
+func (s *BadgerSpanStore) countSpans(txn *badger.Txn, traceID models.TraceID) int {
+	prefix := append(badgerKey(badgerSpanPrefix, traceID.String()), 0)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+
+	count := 0
+	for it.Rewind(); it.Valid() && count < s.maxSpansPerTrace; it.Next() {
+		count++
+	}
+	return count
+}
+
+// truncated reports whether spans of a trace were dropped
+func (s *BadgerSpanStore) truncated(txn *badger.Txn, traceID models.TraceID) bool {
+	_, err := txn.Get(badgerKey(badgerTruncatedPrefix, traceID.String()))
+	return err == nil
+}
+
+// traceSpans reads the spans of a trace
+func (s *BadgerSpanStore) traceSpans(txn *badger.Txn, traceID models.TraceID) ([]models.Span, error) {
+	prefix := append(badgerKey(badgerSpanPrefix, traceID.String()), 0)
+	it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: 100, Prefix: prefix})
+	defer it.Close()
+
+	var spans []models.Span
+	for it.Rewind(); it.Valid(); it.Next() {
+		var span models.Span
+		if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &span) }); err != nil {
+			return nil, err
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+// lastWrite returns when a span of the trace was last stored
+func (s *BadgerSpanStore) lastWrite(txn *badger.Txn, traceID models.TraceID) time.Time {
+	item, err := txn.Get(badgerKey(badgerWritePrefix, traceID.String()))
+	if err != nil {
+		return time.Time{}
+	}
+	var at time.Time
+	item.Value(func(v []byte) error {
+		if len(v) == 8 {
+			at = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		}
+		return nil
+	})
+	return at
+}
+
+// GetTrace retrieves a full trace by ID, with cross-service clock skew
+// corrected
+func (s *BadgerSpanStore) GetTrace(traceID models.TraceID) (*models.Trace, error) {
+	var trace *models.Trace
+	err := s.db.View(func(txn *badger.Txn) error {
+		spans, err := s.traceSpans(txn, traceID)
+		if err != nil || len(spans) == 0 {
+			return err
+		}
+		trace = models.BuildTrace(models.CorrectClockSkew(spans))
+		trace.Partial = !traceComplete(trace, s.lastWrite(txn, traceID), s.assemblyDelay, time.Now())
+		trace.Truncated = s.truncated(txn, traceID)
+		return nil
+	})
+	return trace, err
+}
+
+// QueryTraces searches for traces matching criteria. Service-filtered
+// queries walk the service index; others scan all traces. Every match is
+// read so that results can be ordered before the page is cut out.
+func (s *BadgerSpanStore) QueryTraces(query models.TraceQuery) ([]models.TraceSummary, error) {
+	summaries, err := s.matchTraces(query)
+	if err != nil {
+		return nil, err
+	}
+	return pageTraceSummaries(summaries, query), nil
+}
+
+// CountTraces counts the traces matching a query's filters, whatever its
+// cursor, offset and limit
+func (s *BadgerSpanStore) CountTraces(query models.TraceQuery) (int, error) {
+	summaries, err := s.matchTraces(query)
+	return len(summaries), err
+}
+
+// matchTraces returns the summaries of every trace matching a query's
+// filters, unordered
+func (s *BadgerSpanStore) matchTraces(query models.TraceQuery) ([]models.TraceSummary, error) {
+	var summaries []models.TraceSummary
+	err := s.db.View(func(txn *badger.Txn) error {
+		now := time.Now()
+		return s.eachTraceID(txn, query.Service, func(traceID models.TraceID) (bool, error) {
+			lastWrite := s.lastWrite(txn, traceID)
+			if !query.WrittenAfter.IsZero() && !lastWrite.After(query.WrittenAfter) {
+				return true, nil
+			}
+			spans, err := s.traceSpans(txn, traceID)
+			if err != nil {
+				return false, err
+			}
+			trace := models.BuildTrace(spans)
+			if trace == nil {
+				return true, nil
+			}
+			trace.Partial = !traceComplete(trace, lastWrite, s.assemblyDelay, now)
+			trace.Truncated = s.truncated(txn, traceID)
+			if matchTrace(trace, query) {
+				summaries = append(summaries, trace.ToSummary())
+			}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// eachTraceID calls fn with each stored trace ID, or with the trace IDs of
+// one service, until fn returns false
+func (s *BadgerSpanStore) eachTraceID(txn *badger.Txn, service string, fn func(traceID models.TraceID) (bool, error)) error {
+	opts := badger.IteratorOptions{PrefetchValues: false}
+	var prefix []byte
+	if service != "" {
+		prefix = append(badgerKey(badgerServicePrefix, service), 0)
+	} else {
+		prefix = []byte{badgerWritePrefix, 0}
+	}
+	opts.Prefix = prefix
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		parts := splitBadgerKey(it.Item().Key())
+		traceID, err := models.ParseTraceID(parts[len(parts)-1])
+		if err != nil {
+			continue
+		}
+		more, err := fn(traceID)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindSpan returns a stored span by trace and span ID
+func (s *BadgerSpanStore) FindSpan(traceID models.TraceID, spanID models.SpanID) (models.Span, bool) {
+	var span models.Span
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(badgerKey(badgerSpanPrefix, traceID.String(), spanID.String()))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error { return json.Unmarshal(v, &span) })
+	})
+	return span, err == nil
+}
+
+// ChildSpans returns the stored children of a span
+func (s *BadgerSpanStore) ChildSpans(traceID models.TraceID, parentID models.SpanID) []models.Span {
+	var children []models.Span
+	s.db.View(func(txn *badger.Txn) error {
+		spans, err := s.traceSpans(txn, traceID)
+		for _, span := range spans {
+			if span.ParentSpanID == parentID {
+				children = append(children, span)
+			}
+		}
+		return err
+	})
+	return children
+}
+
+// Services returns the sorted names of services with stored spans
+func (s *BadgerSpanStore) Services() []string {
+	var services []string
+	s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{badgerServicePrefix, 0}})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); {
+			service := splitBadgerKey(it.Item().Key())[0]
+			services = append(services, service)
+			// Skip the rest of this service's index entries
+			it.Seek(append(badgerKey(badgerServicePrefix, service), 1))
+		}
+		return nil
+	})
+	return services
+}
+
+// Operations returns span and error counts per operation of a service,
+// sorted by operation name
+func (s *BadgerSpanStore) Operations(service string) []models.OperationStats {
+	counter := make(operationCounter)
+	s.db.View(func(txn *badger.Txn) error {
+		return s.eachTraceID(txn, service, func(traceID models.TraceID) (bool, error) {
+			spans, err := s.traceSpans(txn, traceID)
+			for _, span := range spans {
+				if span.ServiceName == service {
+					counter.add(span)
+				}
+			}
+			return err == nil, err
+		})
+	})
+	return counter.result()
+}
+
+// LatencyPercentiles computes span latency percentiles per time bucket
+func (s *BadgerSpanStore) LatencyPercentiles(query models.LatencyQuery) ([]models.LatencyBucket, error) {
+	if query.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+
+	agg := newLatencyAggregator(query)
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: 100, Prefix: []byte{badgerSpanPrefix, 0}})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var span models.Span
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &span) }); err != nil {
+				return err
+			}
+			agg.add(span)
+		}
+		return nil
+	})
+	return agg.result(), err
+}
+
+// OperationSummaries computes the request rate, errors and latency
+// percentiles of each operation of a service, walking the service index
+func (s *BadgerSpanStore) OperationSummaries(query models.OperationSummaryQuery) ([]models.OperationSummary, error) {
+	agg := newOperationAggregator(query)
+	err := s.db.View(func(txn *badger.Txn) error {
+		return s.eachTraceID(txn, query.Service, func(traceID models.TraceID) (bool, error) {
+			spans, err := s.traceSpans(txn, traceID)
+			if err != nil {
+				return false, err
+			}
+			for _, span := range spans {
+				agg.add(span)
+			}
+			return true, nil
+		})
+	})
+	return agg.result(), err
+}
+
+// TagKeys counts the tag keys of a service's spans. Badger keeps no tag
+// index, so the counts come from a sample of the stored traces.
+func (s *BadgerSpanStore) TagKeys(query models.TagQuery) ([]models.TagCount, error) {
+	counts := make(map[string]int)
+	err := s.sampleTraceSpans(query.Service, func(spans []models.Span) {
+		keys := make(map[string]bool)
+		for _, span := range spans {
+			if query.Service != "" && span.ServiceName != query.Service {
+				continue
+			}
+			for key := range span.Tags {
+				keys[key] = true
+			}
+		}
+		for key := range keys {
+			counts[key]++
+		}
+	})
+	return topTagCounts(counts, query.Limit), err
+}
+
+// TagValues counts the values of a tag key over a sample of the stored
+// traces
+func (s *BadgerSpanStore) TagValues(query models.TagQuery) ([]models.TagCount, error) {
+	counts := make(map[string]int)
+	err := s.sampleTraceSpans("", func(spans []models.Span) {
+		values := make(map[string]bool)
+		for _, span := range spans {
+			if value := span.Tags[query.Key]; value != "" && len(value) <= maxIndexedTagValueLength {
+				values[value] = true
+			}
+		}
+		for value := range values {
+			counts[value]++
+		}
+	})
+	return topTagCounts(counts, query.Limit), err
+}
+
+// sampleTraceSpans calls fn with the spans of up to badgerTagSampleTraces
+// traces of a service, or of all services
+func (s *BadgerSpanStore) sampleTraceSpans(service string, fn func(spans []models.Span)) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		sampled := 0
+		return s.eachTraceID(txn, service, func(traceID models.TraceID) (bool, error) {
+			spans, err := s.traceSpans(txn, traceID)
+			if err != nil {
+				return false, err
+			}
+			fn(spans)
+			sampled++
+			return sampled < badgerTagSampleTraces, nil
+		})
+	})
+}
+
+// Stats reports the database's size on disk and the spans dropped by the
+// span limit. Counting traces and spans would mean reading every key, so
+// they are left out.
+func (s *BadgerSpanStore) Stats() SpanStoreStats {
+	lsm, vlog := s.db.Size()
+	return SpanStoreStats{Bytes: lsm + vlog, DroppedSpans: s.dropped.Load()}
+}
+
+// ServiceStats counts the stored traces and spans of each service. It
+// reads every stored span.
+func (s *BadgerSpanStore) ServiceStats() (map[string]SpanStoreStats, error) {
+	stats := make(map[string]SpanStoreStats)
+	err := s.db.View(func(txn *badger.Txn) error {
+		// Service index keys count traces per service
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{badgerServicePrefix, 0}})
+		for it.Rewind(); it.Valid(); it.Next() {
+			service := splitBadgerKey(it.Item().Key())[0]
+			st := stats[service]
+			st.Traces++
+			stats[service] = st
+		}
+		it.Close()
+
+		it = txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: 100, Prefix: []byte{badgerSpanPrefix, 0}})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var span struct {
+				ServiceName string `json:"service_name"`
+			}
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &span) }); err != nil {
+				return err
+			}
+			st := stats[span.ServiceName]
+			st.Spans++
+			stats[span.ServiceName] = st
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// DeleteTrace removes a trace and its index entries
+func (s *BadgerSpanStore) DeleteTrace(traceID models.TraceID) (bool, error) {
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		spans, err := s.traceSpans(txn, traceID)
+		if err != nil || len(spans) == 0 {
+			return err
+		}
+		for _, span := range spans {
+			keys = append(keys,
+				badgerKey(badgerSpanPrefix, traceID.String(), span.SpanID.String()),
+				badgerKey(badgerServicePrefix, span.ServiceName, traceID.String()))
+		}
+		keys = append(keys, badgerKey(badgerWritePrefix, traceID.String()), badgerKey(badgerTruncatedPrefix, traceID.String()))
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return false, err
+	}
+	return true, s.deleteKeys(keys)
+}
+
+// DeleteService removes the spans of a service, and the traces left empty
+func (s *BadgerSpanStore) DeleteService(service string) (int, error) {
+	var keys [][]byte
+	deleted := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		return s.eachTraceID(txn, service, func(traceID models.TraceID) (bool, error) {
+			spans, err := s.traceSpans(txn, traceID)
+			if err != nil {
+				return false, err
+			}
+			kept := 0
+			for _, span := range spans {
+				if span.ServiceName != service {
+					kept++
+					continue
+				}
+				keys = append(keys, badgerKey(badgerSpanPrefix, traceID.String(), span.SpanID.String()))
+				deleted++
+			}
+			keys = append(keys, badgerKey(badgerServicePrefix, service, traceID.String()))
+			if kept == 0 {
+				keys = append(keys, badgerKey(badgerWritePrefix, traceID.String()), badgerKey(badgerTruncatedPrefix, traceID.String()))
+			}
+			return true, nil
+		})
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	return deleted, s.deleteKeys(keys)
+}
+
+// deleteKeys deletes keys in as many transactions as they need
+func (s *BadgerSpanStore) deleteKeys(keys [][]byte) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// Compact merges the LSM tree into one level, dropping expired and deleted
+// keys, then reclaims value log space
+func (s *BadgerSpanStore) Compact() error {
+	if err := s.db.Flatten(1); err != nil {
+		return err
+	}
+	s.GC()
+	return nil
+}
+
+// GC reclaims value log space left by expired and replaced spans. Expiry
+// itself is handled by key TTLs.
+func (s *BadgerSpanStore) GC() {
+	for s.db.RunValueLogGC(0.5) == nil {
+	}
+}
+
+func (s *BadgerSpanStore) gcLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.GC()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops garbage collection and closes the database
+func (s *BadgerSpanStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// unknownDependency names calls whose remote service isn't known
+const unknownDependency = "unknown"
+
+// BuildLatencyBreakdown attributes the latency of a service's requests in
+// up to query.MaxTraces traces to the services it calls. A request is an
+// entry span of the service (or a span of the operation, if set). Its
+// downstream calls are the client spans below it in the same service,
+// named by their peer.service tag or else the service that served them,
+// and direct children from other services. While calls overlap, the time
+// is split evenly between the dependencies being waited on; time without
+// calls is the service's own.
+func BuildLatencyBreakdown(reader SpanReader, query models.LatencyBreakdownQuery) (*models.LatencyBreakdown, error) {
+	if query.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+
+	summaries, err := reader.QueryTraces(models.TraceQuery{
+		Service:   query.Service,
+		StartTime: query.StartTime,
+		EndTime:   query.EndTime,
+		Limit:     query.MaxTraces,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &breakdownBuilder{query: query, buckets: make(map[int64]*breakdownBucket), totals: make(map[string]time.Duration)}
+	traces := 0
+	for _, summary := range summaries {
+		trace, err := reader.GetTrace(summary.TraceID)
+		if err != nil {
+			return nil, err
+		}
+		if trace != nil && b.addTrace(trace) {
+			traces++
+		}
+	}
+	return b.result(traces), nil
+}
+
+// breakdownBucket sums the latency of one time bucket's requests
+type breakdownBucket struct {
+	count        uint64
+	total, self  time.Duration
+	dependencies map[string]time.Duration
+}
+
+type breakdownBuilder struct {
+	query   models.LatencyBreakdownQuery
+	buckets map[int64]*breakdownBucket
+	totals  map[string]time.Duration // Dependency -> time over all buckets
+}
+
+// dependencyCall is a downstream call made while serving a request
+type dependencyCall struct {
+	dependency string
+	start, end time.Time
+}
+
+// addTrace adds the trace's requests and reports whether it had any
+func (b *breakdownBuilder) addTrace(trace *models.Trace) bool {
+	byID := make(map[models.SpanID]*models.Span, len(trace.Spans))
+	children := make(map[models.SpanID][]*models.Span)
+	for i := range trace.Spans {
+		span := &trace.Spans[i]
+		byID[span.SpanID] = span
+		children[span.ParentSpanID] = append(children[span.ParentSpanID], span)
+	}
+
+	found := false
+	for i := range trace.Spans {
+		span := &trace.Spans[i]
+		if span.ServiceName != b.query.Service {
+			continue
+		}
+		if b.query.Operation != "" {
+			if span.OperationName != b.query.Operation {
+				continue
+			}
+		} else if parent, ok := byID[span.ParentSpanID]; ok && parent.ServiceName == span.ServiceName {
+			// Not an entry span
+			continue
+		}
+		if span.StartTime.Before(b.query.StartTime) || span.StartTime.After(b.query.EndTime) {
+			continue
+		}
+
+		var calls []dependencyCall
+		collectCalls(span, span, children, &calls, 0)
+		b.add(span, calls)
+		found = true
+	}
+	return found
+}
+
+// collectCalls gathers the downstream calls below span that are made by
+// the request's service
+func collectCalls(request, span *models.Span, children map[models.SpanID][]*models.Span, calls *[]dependencyCall, depth int) {
+	if depth >= maxSpanTreeDepth {
+		return
+	}
+	for _, child := range children[span.SpanID] {
+		switch {
+		case child.ServiceName != request.ServiceName:
+			*calls = append(*calls, dependencyCall{child.ServiceName, child.StartTime, child.EndTime})
+		case child.Kind == models.SpanKindClient || child.Kind == models.SpanKindProducer:
+			*calls = append(*calls, dependencyCall{callee(child, children), child.StartTime, child.EndTime})
+		default:
+			collectCalls(request, child, children, calls, depth+1)
+		}
+	}
+}
+
+// callee names the service a client span called
+func callee(client *models.Span, children map[models.SpanID][]*models.Span) string {
+	if peer := client.PeerService(); peer != "" {
+		return peer
+	}
+	for _, child := range children[client.SpanID] {
+		if child.ServiceName != client.ServiceName {
+			return child.ServiceName
+		}
+	}
+	return unknownDependency
+}
+
+// add splits a request's duration between the service and its calls
+func (b *breakdownBuilder) add(request *models.Span, calls []dependencyCall) {
+	key := request.StartTime.Truncate(b.query.Step).Unix()
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &breakdownBucket{dependencies: make(map[string]time.Duration)}
+		b.buckets[key] = bucket
+	}
+
+	// Sweep the request's time from one call boundary to the next
+	start, end := request.StartTime, request.EndTime
+	if !end.After(start) {
+		bucket.count++
+		return
+	}
+	boundaries := []time.Time{start, end}
+	for i := range calls {
+		c := &calls[i]
+		if c.start.Before(start) {
+			c.start = start
+		}
+		if c.end.After(end) {
+			c.end = end
+		}
+		if c.end.After(c.start) {
+			boundaries = append(boundaries, c.start, c.end)
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+
+	var self time.Duration
+	for i := 1; i < len(boundaries); i++ {
+		from, to := boundaries[i-1], boundaries[i]
+		if !to.After(from) {
+			continue
+		}
+		active := make(map[string]bool)
+		for _, c := range calls {
+			if !c.start.After(from) && !c.end.Before(to) && c.end.After(c.start) {
+				active[c.dependency] = true
+			}
+		}
+		if len(active) == 0 {
+			self += to.Sub(from)
+			continue
+		}
+		share := to.Sub(from) / time.Duration(len(active))
+		for dependency := range active {
+			bucket.dependencies[dependency] += share
+			b.totals[dependency] += share
+		}
+	}
+
+	bucket.count++
+	bucket.total += end.Sub(start)
+	bucket.self += self
+}
+
+// result averages each bucket per request, in time order
+func (b *breakdownBuilder) result(traces int) *models.LatencyBreakdown {
+	breakdown := &models.LatencyBreakdown{
+		Service:      b.query.Service,
+		Dependencies: make([]string, 0, len(b.totals)),
+		Buckets:      make([]models.LatencyBreakdownBucket, 0, len(b.buckets)),
+		Traces:       traces,
+	}
+	for dependency := range b.totals {
+		breakdown.Dependencies = append(breakdown.Dependencies, dependency)
+	}
+	sort.Slice(breakdown.Dependencies, func(i, j int) bool {
+		a, c := breakdown.Dependencies[i], breakdown.Dependencies[j]
+		if b.totals[a] != b.totals[c] {
+			return b.totals[a] > b.totals[c]
+		}
+		return a < c
+	})
+
+	avg := func(d time.Duration, n uint64) float64 {
+		return float64(d) / float64(n) / float64(time.Millisecond)
+	}
+	for start, bucket := range b.buckets {
+		out := models.LatencyBreakdownBucket{
+			StartTime:    time.Unix(start, 0),
+			Count:        bucket.count,
+			Total:        avg(bucket.total, bucket.count),
+			Self:         avg(bucket.self, bucket.count),
+			Dependencies: make(map[string]float64, len(bucket.dependencies)),
+		}
+		for dependency, d := range bucket.dependencies {
+			out.Dependencies[dependency] = avg(d, bucket.count)
+		}
+		breakdown.Buckets = append(breakdown.Buckets, out)
+	}
+	sort.Slice(breakdown.Buckets, func(i, j int) bool { return breakdown.Buckets[i].StartTime.Before(breakdown.Buckets[j].StartTime) })
+	return breakdown
+}
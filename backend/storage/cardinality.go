@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// SeriesOverflow selects what happens to points of new series beyond the
+// series limits
+type SeriesOverflow string
+
+const (
+	// SeriesOverflowDrop discards the points
+	SeriesOverflowDrop SeriesOverflow = "drop"
+	// SeriesOverflowAggregate folds the points into one overflow series
+	// per metric and service, labeled with OverflowLabel
+	SeriesOverflowAggregate SeriesOverflow = "aggregate"
+)
+
+// OverflowLabel marks the series that collects points of series beyond
+// the limits
+const OverflowLabel = "otel.metric.overflow"
+
+// SeriesLimits caps the active series of a metric store. Zero limits are
+// unlimited.
+type SeriesLimits struct {
+	PerMetric  int
+	PerService int
+	Overflow   SeriesOverflow
+}
+
+// WithSeriesLimits caps the series per metric name and per service, so a
+// label with unbounded values can't exhaust memory
+func WithSeriesLimits(limits SeriesLimits) MetricStoreOption {
+	return func(s *MetricStore) {
+		s.limits = limits
+	}
+}
+
+// admit applies the series limits to a point of a new series. It returns
+// the point to store, relabeled into the overflow series if needed, or
+// false if the point is dropped. Callers hold s.mu.
+func (s *MetricStore) admit(metric models.Metric) (models.Metric, bool) {
+	if _, ok := s.metrics[generateMetricKey(metric)]; ok {
+		return metric, true
+	}
+	if metric.Labels[OverflowLabel] == "true" {
+		return metric, true
+	}
+	overMetric := s.limits.PerMetric > 0 && s.seriesByMetric[metric.Name] >= s.limits.PerMetric
+	overService := s.limits.PerService > 0 && s.seriesByService[metric.Service] >= s.limits.PerService
+	if !overMetric && !overService {
+		return metric, true
+	}
+
+	s.overflowed[metric.Name]++
+	if s.limits.Overflow != SeriesOverflowAggregate {
+		return metric, false
+	}
+	metric.Labels = map[string]string{OverflowLabel: "true"}
+	return metric, true
+}
+
+// countSeries tracks a series being added (delta 1) or removed (delta -1).
+// Callers hold s.mu.
+func (s *MetricStore) countSeries(metric models.Metric, delta int) {
+	s.seriesByMetric[metric.Name] += delta
+	if s.seriesByMetric[metric.Name] <= 0 {
+		delete(s.seriesByMetric, metric.Name)
+	}
+	s.seriesByService[metric.Service] += delta
+	if s.seriesByService[metric.Service] <= 0 {
+		delete(s.seriesByService, metric.Service)
+	}
+}
+
+// Cardinality reports the metrics and services with the most series, up to
+// top of each, along with each metric's labels with the most values
+func (s *MetricStore) Cardinality(top int) models.CardinalityReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report := models.CardinalityReport{
+		Series:              len(s.metrics),
+		MaxSeriesPerMetric:  s.limits.PerMetric,
+		MaxSeriesPerService: s.limits.PerService,
+		Overflow:            string(s.limits.Overflow),
+	}
+
+	values := make(map[string]map[string]map[string]struct{}) // Metric -> label -> values
+	for _, metrics := range s.metrics {
+		m := metrics[0]
+		labels := values[m.Name]
+		if labels == nil {
+			labels = make(map[string]map[string]struct{})
+			values[m.Name] = labels
+		}
+		for k, v := range m.Labels {
+			if labels[k] == nil {
+				labels[k] = make(map[string]struct{})
+			}
+			labels[k][v] = struct{}{}
+		}
+	}
+
+	for name, series := range s.seriesByMetric {
+		entry := models.MetricCardinality{Name: name, Series: series, Overflowed: s.overflowed[name]}
+		for label, vals := range values[name] {
+			entry.Labels = append(entry.Labels, models.LabelCardinality{Label: label, Values: len(vals)})
+		}
+		sort.Slice(entry.Labels, func(i, j int) bool {
+			if entry.Labels[i].Values != entry.Labels[j].Values {
+				return entry.Labels[i].Values > entry.Labels[j].Values
+			}
+			return entry.Labels[i].Label < entry.Labels[j].Label
+		})
+		report.Metrics = append(report.Metrics, entry)
+	}
+	// Metrics that only overflowed have no series
+	for name, n := range s.overflowed {
+		if _, ok := s.seriesByMetric[name]; !ok {
+			report.Metrics = append(report.Metrics, models.MetricCardinality{Name: name, Overflowed: n})
+		}
+	}
+	sort.Slice(report.Metrics, func(i, j int) bool {
+		a, b := report.Metrics[i], report.Metrics[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		if a.Overflowed != b.Overflowed {
+			return a.Overflowed > b.Overflowed
+		}
+		return a.Name < b.Name
+	})
+
+	for service, series := range s.seriesByService {
+		report.Services = append(report.Services, models.ServiceCardinality{Service: service, Series: series})
+	}
+	sort.Slice(report.Services, func(i, j int) bool {
+		a, b := report.Services[i], report.Services[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		return a.Service < b.Service
+	})
+
+	if top > 0 {
+		report.Metrics = report.Metrics[:min(top, len(report.Metrics))]
+		report.Services = report.Services[:min(top, len(report.Services))]
+		for i := range report.Metrics {
+			labels := report.Metrics[i].Labels
+			report.Metrics[i].Labels = labels[:min(top, len(labels))]
+		}
+	}
+	return report
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// SpanCompression selects how the memory backend compresses the spans of
+// traces that have gone quiet
+type SpanCompression string
+
+const (
+	// CompressionNone keeps every span uncompressed
+	CompressionNone SpanCompression = "none"
+	// CompressionZstd compresses best, at the most CPU per read
+	CompressionZstd SpanCompression = "zstd"
+	// CompressionSnappy compresses less than zstd but decodes faster
+	CompressionSnappy SpanCompression = "snappy"
+)
+
+// sealInterval is how often a compressing store looks for quiet traces
+const sealInterval = 10 * time.Second
+
+// The zstd coders are shared by every store; both are safe for concurrent
+// use and costly to create
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		return dec
+	})
+)
+
+// compress compresses data, into scratch's array if it is large enough
+func (c SpanCompression) compress(scratch, data []byte) []byte {
+	switch c {
+	case CompressionZstd:
+		return zstdEncoder().EncodeAll(data, scratch[:0])
+	case CompressionSnappy:
+		return snappy.Encode(scratch[:cap(scratch)], data)
+	}
+	return data
+}
+
+// decompress returns the data of a block compressed with c
+func (c SpanCompression) decompress(block []byte) ([]byte, error) {
+	switch c {
+	case CompressionZstd:
+		return zstdDecoder().DecodeAll(block, nil)
+	case CompressionSnappy:
+		return snappy.Decode(nil, block)
+	}
+	return block, nil
+}
+
+// WithCompression makes the store compress the spans of each trace into
+// one block once no span has arrived for the assembly delay, and decode
+// the block when the trace is read. A span arriving late for a compressed
+// trace decodes it again until it next goes quiet.
+func WithCompression(c SpanCompression) SpanStoreOption {
+	return func(s *SpanStore) {
+		if c != "" && c != CompressionNone {
+			s.compression = c
+		}
+	}
+}
+
+// sealedTrace is a trace whose spans are compressed into one block, as
+// the JSON array they are snapshotted as
+type sealedTrace struct {
+	block []byte
+	spans int
+}
+
+// traceSpans returns the spans of a trace, decoding them if the trace is
+// sealed. Callers hold s.mu.
+func (s *SpanStore) traceSpans(traceID models.TraceID) ([]storedSpan, bool) {
+	if spans, ok := s.spans[traceID]; ok {
+		return spans, true
+	}
+	sealed, ok := s.sealed[traceID]
+	if !ok {
+		return nil, false
+	}
+	spans, err := s.decodeTrace(sealed, nil)
+	if err != nil {
+		log.Printf("Failed to decode compressed trace %s: %v", traceID, err)
+		return nil, false
+	}
+	return spans, true
+}
+
+// eachTrace calls fn with the spans of every trace. Callers hold s.mu.
+func (s *SpanStore) eachTrace(fn func(traceID models.TraceID, spans []storedSpan)) {
+	for traceID, spans := range s.spans {
+		fn(traceID, spans)
+	}
+	for traceID := range s.sealed {
+		if spans, ok := s.traceSpans(traceID); ok {
+			fn(traceID, spans)
+		}
+	}
+}
+
+// hasTrace reports whether a trace is stored. Callers hold s.mu.
+func (s *SpanStore) hasTrace(traceID models.TraceID) bool {
+	if _, ok := s.spans[traceID]; ok {
+		return true
+	}
+	_, ok := s.sealed[traceID]
+	return ok
+}
+
+// decodeTrace decompresses the spans of a sealed trace, interning their
+// strings in strs. Readers pass nil, as they only hold s.mu for reading.
+func (s *SpanStore) decodeTrace(sealed sealedTrace, strs *internTable) ([]storedSpan, error) {
+	data, err := s.compression.decompress(sealed.block)
+	if err != nil {
+		return nil, err
+	}
+	var spans []models.Span
+	if err := json.Unmarshal(data, &spans); err != nil {
+		return nil, err
+	}
+	stored := make([]storedSpan, len(spans))
+	for i, span := range spans {
+		stored[i] = newStoredSpan(span, strs)
+	}
+	return stored, nil
+}
+
+// unseal decodes a sealed trace back into plain spans before it is
+// written to. Callers hold s.mu for writing.
+func (s *SpanStore) unseal(traceID models.TraceID) {
+	sealed, ok := s.sealed[traceID]
+	if !ok {
+		return
+	}
+	delete(s.sealed, traceID)
+	spans, err := s.decodeTrace(sealed, s.strings)
+	if err != nil {
+		log.Printf("Failed to decode compressed trace %s: %v", traceID, err)
+		return
+	}
+	s.spans[traceID] = spans
+}
+
+func (s *SpanStore) sealLoop() {
+	ticker := time.NewTicker(sealInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.seal(time.Now()); err != nil {
+				log.Printf("Span compression failed: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// seal compresses the traces no span has arrived for in the assembly
+// delay. They are encoded without holding the lock, and a trace written
+// meanwhile is left for the next pass.
+func (s *SpanStore) seal(now time.Time) error {
+	type candidate struct {
+		traceID   models.TraceID
+		spans     []storedSpan
+		lastWrite time.Time
+	}
+
+	s.mu.RLock()
+	var candidates []candidate
+	for traceID, spans := range s.spans {
+		if lastWrite := s.lastWrite[traceID]; now.Sub(lastWrite) >= s.assemblyDelay {
+			candidates = append(candidates, candidate{traceID, slices.Clone(spans), lastWrite})
+		}
+	}
+	s.mu.RUnlock()
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	blocks := make([][]byte, len(candidates))
+	var scratch []byte
+	for i, c := range candidates {
+		data, err := json.Marshal(c.spans)
+		if err != nil {
+			return fmt.Errorf("encode trace %s: %w", c.traceID, err)
+		}
+		// Compress into scratch so the block is allocated at its size
+		scratch = s.compression.compress(scratch, data)
+		blocks[i] = bytes.Clone(scratch)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range candidates {
+		spans, ok := s.spans[c.traceID]
+		if !ok || len(spans) != len(c.spans) || !s.lastWrite[c.traceID].Equal(c.lastWrite) {
+			continue
+		}
+		delete(s.spans, c.traceID)
+		s.sealed[c.traceID] = sealedTrace{block: blocks[i], spans: len(c.spans)}
+	}
+	return nil
+}
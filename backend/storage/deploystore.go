@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// ErrInvalidDeployment is returned when recording a deployment without a
+// service or version
+var ErrInvalidDeployment = errors.New("invalid deployment")
+
+// DeploymentStore keeps a tenant's deployment markers in time order. When
+// full, the oldest are dropped. Deployments are written to a file when the
+// tenant's storage is persistent.
+type DeploymentStore struct {
+	deployments []models.Deployment // Oldest first
+	mu          sync.RWMutex
+	max         int
+	path        string
+}
+
+// NewDeploymentStore creates a deployment store keeping up to max
+// deployments (0 = no limit). With a path, deployments are loaded from and
+// saved to that file.
+func NewDeploymentStore(max int, path string) (*DeploymentStore, error) {
+	store := &DeploymentStore{max: max, path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.deployments); err != nil {
+		return nil, fmt.Errorf("load deployments: %w", err)
+	}
+	return store, nil
+}
+
+// Record stores a deployment, timestamped now if it has no timestamp.
+// Deployments may be recorded late, so each is inserted at its time.
+func (s *DeploymentStore) Record(d models.Deployment) (models.Deployment, error) {
+	if d.Service == "" {
+		return d, fmt.Errorf("%w: service is required", ErrInvalidDeployment)
+	}
+	if d.Version == "" {
+		return d, fmt.Errorf("%w: version is required", ErrInvalidDeployment)
+	}
+	if d.Timestamp.IsZero() {
+		d.Timestamp = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.deployments
+	i := sort.Search(len(s.deployments), func(i int) bool { return s.deployments[i].Timestamp.After(d.Timestamp) })
+	deployments := slices.Insert(slices.Clone(s.deployments), i, d)
+	if s.max > 0 && len(deployments) > s.max {
+		deployments = deployments[len(deployments)-s.max:]
+	}
+	s.deployments = deployments
+	if err := s.save(); err != nil {
+		// Keep memory and disk in step
+		s.deployments = previous
+		return d, err
+	}
+	return d, nil
+}
+
+// List returns the deployments matching a query, newest first
+func (s *DeploymentStore) List(query models.DeploymentQuery) []models.Deployment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deployments := []models.Deployment{}
+	for i := len(s.deployments) - 1; i >= 0; i-- {
+		d := s.deployments[i]
+		if !query.EndTime.IsZero() && d.Timestamp.After(query.EndTime) {
+			continue
+		}
+		if !query.StartTime.IsZero() && d.Timestamp.Before(query.StartTime) {
+			break
+		}
+		if query.Service != "" && d.Service != query.Service {
+			continue
+		}
+		deployments = append(deployments, d)
+		if query.Limit > 0 && len(deployments) == query.Limit {
+			break
+		}
+	}
+	return deployments
+}
+
+// save writes the deployments to the store's file, if any. Callers hold
+// s.mu.
+func (s *DeploymentStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.deployments)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
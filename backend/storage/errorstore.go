@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// ErrorStore implements in-memory storage for standalone error events
+type ErrorStore struct {
+	events    []models.ErrorEvent
+	groups    map[string]*models.ErrorGroup // Fingerprint -> Group
+	mu        sync.RWMutex
+	maxEvents int
+	ttl       time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewErrorStore creates a new error event store
+func NewErrorStore(maxEvents int, ttl time.Duration) *ErrorStore {
+	store := &ErrorStore{
+		events:    make([]models.ErrorEvent, 0),
+		groups:    make(map[string]*models.ErrorGroup),
+		maxEvents: maxEvents,
+		ttl:       ttl,
+		done:      make(chan struct{}),
+	}
+
+	go store.cleanupLoop()
+
+	return store
+}
+
+// Store adds an error event to storage, evicting the oldest event when the
+// store is full
+func (s *ErrorStore) Store(event models.ErrorEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxEvents > 0 && len(s.events) >= s.maxEvents {
+		s.events = s.events[1:]
+	}
+	s.events = append(s.events, event)
+
+	return nil
+}
+
+// QueryErrors returns the most recent error events matching the query
+func (s *ErrorStore) QueryErrors(query models.ErrorEventQuery) ([]models.ErrorEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var results []models.ErrorEvent
+
+	// Walk newest first
+	for i := len(s.events) - 1; i >= 0; i-- {
+		event := s.events[i]
+
+		if query.Service != "" && event.Service != query.Service {
+			continue
+		}
+		if query.Severity != "" && event.Severity != query.Severity {
+			continue
+		}
+		if !query.StartTime.IsZero() && event.Timestamp.Before(query.StartTime) {
+			continue
+		}
+		if !query.EndTime.IsZero() && event.Timestamp.After(query.EndTime) {
+			continue
+		}
+
+		results = append(results, event)
+
+		if query.Limit > 0 && len(results) >= query.Limit {
+			break
+		}
+	}
+
+	return results, nil
+}
+
+// maxSampleTraceIDs caps the sample trace IDs kept per error group
+const maxSampleTraceIDs = 5
+
+// RecordOccurrence counts an occurrence of the error group identified by
+// group.Fingerprint, creating the group on first sight. The group keeps
+// the most recent distinct trace IDs as samples, so that they point at
+// traces still stored.
+func (s *ErrorStore) RecordOccurrence(group models.ErrorGroup, traceID string, seen time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+
+	existing, ok := s.groups[group.Fingerprint]
+	if !ok {
+		group.FirstSeen = seen
+		group.LastSeen = seen
+		existing = &group
+		s.groups[group.Fingerprint] = existing
+	}
+
+	existing.Count++
+	if seen.Before(existing.FirstSeen) {
+		existing.FirstSeen = seen
+	}
+	if seen.After(existing.LastSeen) {
+		existing.LastSeen = seen
+		existing.SampleMessage = group.SampleMessage
+	}
+	if traceID != "" && !slices.Contains(existing.SampleTraceIDs, traceID) {
+		if len(existing.SampleTraceIDs) >= maxSampleTraceIDs {
+			existing.SampleTraceIDs = slices.Delete(existing.SampleTraceIDs, 0, 1)
+		}
+		existing.SampleTraceIDs = append(existing.SampleTraceIDs, traceID)
+	}
+}
+
+// QueryGroups returns error groups matching the query
+func (s *ErrorStore) QueryGroups(query models.ErrorGroupQuery) ([]models.ErrorGroup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([]models.ErrorGroup, 0, len(s.groups))
+	for _, group := range s.groups {
+		if query.Service != "" && group.Service != query.Service {
+			continue
+		}
+		g := *group
+		g.SampleTraceIDs = append([]string(nil), group.SampleTraceIDs...)
+		results = append(results, g)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if query.SortBy == "count" && results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].LastSeen.After(results[j].LastSeen)
+	})
+
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+
+	return results, nil
+}
+
+// DeleteService removes the error events and groups of a service and
+// returns how many events were stored
+func (s *ErrorStore) DeleteService(service string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.events[:0]
+	for _, event := range s.events {
+		if event.Service != service {
+			kept = append(kept, event)
+		}
+	}
+	deleted := len(s.events) - len(kept)
+	clear(s.events[len(kept):])
+	s.events = kept
+
+	for fingerprint, group := range s.groups {
+		if group.Service == service {
+			delete(s.groups, fingerprint)
+		}
+	}
+	return deleted
+}
+
+func (s *ErrorStore) cleanupLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Cleanup()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops the cleanup loop
+func (s *ErrorStore) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// Cleanup removes events and groups older than the TTL
+func (s *ErrorStore) Cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.ttl)
+
+	// Events are appended in arrival order, so expired ones form a prefix
+	n := 0
+	for n < len(s.events) && s.events[n].Timestamp.Before(cutoff) {
+		n++
+	}
+	s.events = s.events[n:]
+
+	for fingerprint, group := range s.groups {
+		if group.LastSeen.Before(cutoff) {
+			delete(s.groups, fingerprint)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// flameRootName names the root frame that the sampled spans hang off
+const flameRootName = "all"
+
+// BuildFlamegraph merges the call trees below the matching spans of up to
+// query.MaxTraces traces into one tree, with frames named
+// "service:operation" and weighted by time spent
+func BuildFlamegraph(reader SpanReader, query models.FlamegraphQuery) (*models.Flamegraph, error) {
+	summaries, err := reader.QueryTraces(models.TraceQuery{
+		Service:   query.Service,
+		StartTime: query.StartTime,
+		EndTime:   query.EndTime,
+		Limit:     query.MaxTraces,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := newFlameBuilder()
+	traces := 0
+	for _, summary := range summaries {
+		trace, err := reader.GetTrace(summary.TraceID)
+		if err != nil {
+			return nil, err
+		}
+		if trace != nil && b.addTrace(trace, query) {
+			traces++
+		}
+	}
+	return &models.Flamegraph{Root: b.result(), Traces: traces}, nil
+}
+
+// flameFrame is a FlameNode under construction
+type flameFrame struct {
+	node     *models.FlameNode
+	children map[string]*flameFrame
+}
+
+func newFlameFrame(name string) *flameFrame {
+	return &flameFrame{node: &models.FlameNode{Name: name}, children: make(map[string]*flameFrame)}
+}
+
+type flameBuilder struct {
+	root *flameFrame
+}
+
+func newFlameBuilder() *flameBuilder {
+	return &flameBuilder{root: newFlameFrame(flameRootName)}
+}
+
+// addTrace merges the subtrees of a trace's matching spans and reports
+// whether it had any. Matching spans nested in another matching span are
+// merged as part of the outer one.
+func (b *flameBuilder) addTrace(trace *models.Trace, query models.FlamegraphQuery) bool {
+	byID := make(map[models.SpanID]*models.Span, len(trace.Spans))
+	children := make(map[models.SpanID][]*models.Span)
+	for i := range trace.Spans {
+		span := &trace.Spans[i]
+		byID[span.SpanID] = span
+		children[span.ParentSpanID] = append(children[span.ParentSpanID], span)
+	}
+
+	matches := func(span *models.Span) bool {
+		if span.ServiceName != query.Service {
+			return false
+		}
+		if query.Operation != "" {
+			return span.OperationName == query.Operation
+		}
+		// Entry spans: called from another service or the trace root
+		parent, ok := byID[span.ParentSpanID]
+		return !ok || parent.ServiceName != span.ServiceName
+	}
+	nested := func(span *models.Span) bool {
+		for parent := byID[span.ParentSpanID]; parent != nil; parent = byID[parent.ParentSpanID] {
+			if matches(parent) {
+				return true
+			}
+		}
+		return false
+	}
+
+	found := false
+	for i := range trace.Spans {
+		span := &trace.Spans[i]
+		if matches(span) && !nested(span) {
+			found = true
+			d := b.add(b.root, span, children, 0)
+			b.root.node.Value += d
+			b.root.node.Count++
+		}
+	}
+	return found
+}
+
+// maxSpanTreeDepth bounds recursion on malformed, cyclic span trees
+const maxSpanTreeDepth = 256
+
+// add merges a span and its descendants below parent and returns the span's
+// duration in microseconds
+func (b *flameBuilder) add(parent *flameFrame, span *models.Span, children map[models.SpanID][]*models.Span, depth int) int64 {
+	name := span.ServiceName + ":" + span.OperationName
+	frame, ok := parent.children[name]
+	if !ok {
+		frame = newFlameFrame(name)
+		parent.children[name] = frame
+	}
+
+	duration := spanMicros(span.StartTime, span.EndTime)
+	frame.node.Value += duration
+	frame.node.Count++
+
+	kids := children[span.SpanID]
+	if depth < maxSpanTreeDepth {
+		for _, child := range kids {
+			b.add(frame, child, children, depth+1)
+		}
+	}
+	frame.node.Self += duration - coveredMicros(span, kids)
+	return duration
+}
+
+func spanMicros(start, end time.Time) int64 {
+	if end.Before(start) {
+		return 0
+	}
+	return end.Sub(start).Microseconds()
+}
+
+// coveredMicros returns how much of a span its children cover, counting
+// overlapping children once and ignoring time outside the span
+func coveredMicros(span *models.Span, kids []*models.Span) int64 {
+	type interval struct{ start, end time.Time }
+	intervals := make([]interval, 0, len(kids))
+	for _, kid := range kids {
+		start, end := kid.StartTime, kid.EndTime
+		if start.Before(span.StartTime) {
+			start = span.StartTime
+		}
+		if end.After(span.EndTime) {
+			end = span.EndTime
+		}
+		if end.After(start) {
+			intervals = append(intervals, interval{start, end})
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+
+	var covered int64
+	var cur interval
+	for i, iv := range intervals {
+		switch {
+		case i == 0:
+			cur = iv
+		case iv.start.After(cur.end):
+			covered += spanMicros(cur.start, cur.end)
+			cur = iv
+		case iv.end.After(cur.end):
+			cur.end = iv.end
+		}
+	}
+	if len(intervals) > 0 {
+		covered += spanMicros(cur.start, cur.end)
+	}
+	return covered
+}
+
+// result converts the frames to FlameNodes with children sorted by name
+func (b *flameBuilder) result() *models.FlameNode {
+	var convert func(f *flameFrame) *models.FlameNode
+	convert = func(f *flameFrame) *models.FlameNode {
+		names := make([]string, 0, len(f.children))
+		for name := range f.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f.node.Children = append(f.node.Children, convert(f.children[name]))
+		}
+		return f.node
+	}
+	return convert(b.root)
+}
+
+// WriteFolded writes a flamegraph in folded stack format, one
+// "frame;frame;frame self-time" line per frame with self time, as read by
+// flamegraph.pl and speedscope. The root frame is left out.
+func WriteFolded(w io.Writer, graph *models.Flamegraph) error {
+	var walk func(node *models.FlameNode, stack []string) error
+	walk = func(node *models.FlameNode, stack []string) error {
+		stack = append(stack, strings.ReplaceAll(node.Name, ";", "_"))
+		if node.Self > 0 {
+			if _, err := fmt.Fprintf(w, "%s %d\n", strings.Join(stack, ";"), node.Self); err != nil {
+				return err
+			}
+		}
+		for _, child := range node.Children {
+			if err := walk(child, stack); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, child := range graph.Root.Children {
+		if err := walk(child, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// histogramGrowth is the ratio between bucket bounds, bounding the relative
+// error of reported quantiles to about 1%
+const histogramGrowth = 1.02
+
+var logHistogramGrowth = math.Log(histogramGrowth)
+
+// Histogram is a sparse log-bucketed histogram in the style of HDR
+// histograms, usable as a streaming quantile sketch. Memory grows with the
+// range of recorded values rather than their count.
+type Histogram struct {
+	buckets map[int]uint64
+	zeros   uint64
+	count   uint64
+}
+
+// NewHistogram creates an empty histogram
+func NewHistogram() *Histogram {
+	return &Histogram{buckets: make(map[int]uint64)}
+}
+
+// Record adds a value. Zero and negative values share one bucket,
+// reported as zero.
+func (h *Histogram) Record(v float64) {
+	h.count++
+	if v <= 0 || math.IsNaN(v) {
+		h.zeros++
+		return
+	}
+	h.buckets[int(math.Floor(math.Log(v)/logHistogramGrowth))]++
+}
+
+// Count returns the number of recorded values
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+// Quantiles returns the values at each quantile q in [0, 1]
+func (h *Histogram) Quantiles(qs ...float64) []float64 {
+	result := make([]float64, len(qs))
+	if h.count == 0 {
+		return result
+	}
+
+	indexes := make([]int, 0, len(h.buckets))
+	for i := range h.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	for n, q := range qs {
+		rank := uint64(math.Ceil(q * float64(h.count)))
+		if rank == 0 {
+			rank = 1
+		}
+		if rank <= h.zeros {
+			continue
+		}
+		seen := h.zeros
+		for _, i := range indexes {
+			seen += h.buckets[i]
+			if seen >= rank {
+				// Midpoint of the bucket's bounds
+				result[n] = math.Pow(histogramGrowth, float64(i)+0.5)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Merge adds the values recorded by other
+func (h *Histogram) Merge(other *Histogram) {
+	for i, n := range other.buckets {
+		h.buckets[i] += n
+	}
+	h.zeros += other.zeros
+	h.count += other.count
+}
+
+// histogramJSON is the serialized form of a Histogram
+type histogramJSON struct {
+	Buckets map[int]uint64 `json:"buckets,omitempty"`
+	Zeros   uint64         `json:"zeros,omitempty"`
+}
+
+// MarshalJSON serializes the histogram's buckets, so that it can be
+// stored and merged with others later
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(histogramJSON{Buckets: h.buckets, Zeros: h.zeros})
+}
+
+// UnmarshalJSON restores a histogram serialized by MarshalJSON
+func (h *Histogram) UnmarshalJSON(data []byte) error {
+	var v histogramJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*h = Histogram{buckets: v.Buckets, zeros: v.Zeros}
+	if h.buckets == nil {
+		h.buckets = make(map[int]uint64)
+	}
+	h.count = h.zeros
+	for _, n := range h.buckets {
+		h.count += n
+	}
+	return nil
+}
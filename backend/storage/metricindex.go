@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// metricNameLabel is the index term label of a series' metric name
+const metricNameLabel = "__name__"
+
+// seriesKey identifies a series by service and sorted labels
+func seriesKey(service string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(service)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+	return b.String()
+}
+
+// generateMetricKey identifies the series of a metric point by name,
+// service and sorted labels
+func generateMetricKey(m models.Metric) string {
+	return m.Name + "\x00" + seriesKey(m.Service, m.Labels)
+}
+
+// seriesTerm is a label pair that series are indexed by
+type seriesTerm struct {
+	label, value string
+}
+
+// seriesIndex is an inverted index from metric names and label pairs to
+// series keys, so queries only visit the series they select
+type seriesIndex struct {
+	postings map[seriesTerm]map[string]struct{} // Term -> series keys
+}
+
+func newSeriesIndex() *seriesIndex {
+	return &seriesIndex{postings: make(map[seriesTerm]map[string]struct{})}
+}
+
+// seriesTerms calls fn with each term of a series
+func seriesTerms(m models.Metric, fn func(term seriesTerm)) {
+	fn(seriesTerm{metricNameLabel, m.Name})
+	for k, v := range m.Labels {
+		fn(seriesTerm{k, v})
+	}
+}
+
+// add indexes a series by a point of it
+func (x *seriesIndex) add(key string, m models.Metric) {
+	seriesTerms(m, func(term seriesTerm) {
+		keys := x.postings[term]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			x.postings[term] = keys
+		}
+		keys[key] = struct{}{}
+	})
+}
+
+// remove drops a series, given a point of it
+func (x *seriesIndex) remove(key string, m models.Metric) {
+	seriesTerms(m, func(term seriesTerm) {
+		delete(x.postings[term], key)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	})
+}
+
+// lookup returns the keys of the series with the metric name, if set, and
+// every label in labels
+func (x *seriesIndex) lookup(name string, labels map[string]string) map[string]struct{} {
+	terms := make([]seriesTerm, 0, len(labels)+1)
+	if name != "" {
+		terms = append(terms, seriesTerm{metricNameLabel, name})
+	}
+	for k, v := range labels {
+		terms = append(terms, seriesTerm{k, v})
+	}
+	if len(terms) == 0 {
+		// Every series has a name
+		result := make(map[string]struct{})
+		for term, keys := range x.postings {
+			if term.label == metricNameLabel {
+				for key := range keys {
+					result[key] = struct{}{}
+				}
+			}
+		}
+		return result
+	}
+
+	// Intersect starting from the rarest term
+	var smallest map[string]struct{}
+	for _, term := range terms {
+		keys := x.postings[term]
+		if len(keys) == 0 {
+			return nil
+		}
+		if smallest == nil || len(keys) < len(smallest) {
+			smallest = keys
+		}
+	}
+	result := make(map[string]struct{}, len(smallest))
+	for key := range smallest {
+		matched := true
+		for _, term := range terms {
+			if _, ok := x.postings[term][key]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
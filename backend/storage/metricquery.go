@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// metricSeries is the points of one metric with one service and label set,
+// in time order
+type metricSeries struct {
+	name    string
+	service string
+	labels  map[string]string
+	points  []models.Metric
+}
+
+// evaluateMetricQuery applies a query's function and grouping to the
+// points of the series it selects
+func evaluateMetricQuery(selected [][]models.Metric, query models.MetricQuery) ([]models.AggregatedMetric, error) {
+	switch query.Function {
+	case "", models.MetricFunctionRate, models.MetricFunctionIncrease:
+	default:
+		return nil, fmt.Errorf("unknown function %q", query.Function)
+	}
+	if query.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	window := query.Window
+	if window <= 0 {
+		window = query.Step
+	}
+
+	// A function's first window reaches back before the query's start
+	from := query.StartTime
+	if query.Function != "" {
+		from = query.StartTime.Truncate(query.Step).Add(query.Step - window)
+	}
+
+	var series []*metricSeries
+	for _, metrics := range selected {
+		s := &metricSeries{name: metrics[0].Name, service: metrics[0].Service, labels: metrics[0].Labels}
+		for _, m := range metrics {
+			if query.Function != "" && m.Type != models.MetricTypeCounter {
+				continue
+			}
+			// Keep the points before the window of a running total, as
+			// the baseline of its first increase
+			if m.Timestamp.After(query.EndTime) || (m.Timestamp.Before(from) && !m.Cumulative) {
+				continue
+			}
+			s.points = append(s.points, m)
+		}
+		if len(s.points) > 0 {
+			series = append(series, s)
+		}
+	}
+
+	// Groups of series, and each group's buckets
+	type group struct {
+		name    string
+		service string
+		labels  map[string]string
+		buckets map[int64]*models.AggregatedMetric
+	}
+	groups := make(map[string]*group)
+	for _, s := range series {
+		sort.Slice(s.points, func(i, j int) bool { return s.points[i].Timestamp.Before(s.points[j].Timestamp) })
+
+		service, labels := s.service, s.labels
+		if len(query.GroupBy) > 0 {
+			service, labels = "", make(map[string]string)
+			for _, name := range query.GroupBy {
+				if name == "service" {
+					service = s.service
+				} else if v, ok := s.labels[name]; ok {
+					labels[name] = v
+				}
+			}
+		}
+		key := s.name + "\x00" + seriesKey(service, labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{name: s.name, service: service, labels: labels, buckets: make(map[int64]*models.AggregatedMetric)}
+			groups[key] = g
+		}
+
+		bucket := func(start time.Time) *models.AggregatedMetric {
+			agg, ok := g.buckets[start.Unix()]
+			if !ok {
+				agg = &models.AggregatedMetric{
+					Name:      g.name,
+					Labels:    g.labels,
+					Service:   g.service,
+					StartTime: start,
+					EndTime:   start.Add(query.Step),
+				}
+				g.buckets[start.Unix()] = agg
+			}
+			return agg
+		}
+
+		if query.Function == "" {
+			for _, m := range s.points {
+				if m.Timestamp.Before(query.StartTime) {
+					continue
+				}
+				agg := bucket(m.Timestamp.Truncate(query.Step))
+				if agg.Count == 0 || m.Value < agg.Min {
+					agg.Min = m.Value
+				}
+				if agg.Count == 0 || m.Value > agg.Max {
+					agg.Max = m.Value
+				}
+				agg.Count++
+				agg.Sum += m.Value
+			}
+			continue
+		}
+
+		for start := query.StartTime.Truncate(query.Step); !start.After(query.EndTime); start = start.Add(query.Step) {
+			end := start.Add(query.Step)
+			increase, n := seriesIncrease(s.points, end.Add(-window), end)
+			if n == 0 {
+				continue
+			}
+			value := increase
+			if query.Function == models.MetricFunctionRate {
+				value = increase / window.Seconds()
+			}
+			agg := bucket(start)
+			agg.Count += int64(n)
+			agg.Value += value
+		}
+	}
+
+	var results []models.AggregatedMetric
+	for _, g := range groups {
+		for _, agg := range g.buckets {
+			if agg.Count > 0 && query.Function == "" {
+				agg.Avg = agg.Sum / float64(agg.Count)
+			}
+			if query.Function != "" {
+				agg.Sum, agg.Min, agg.Max, agg.Avg = agg.Value, agg.Value, agg.Value, agg.Value
+			}
+			results = append(results, *agg)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if ka, kb := a.Name+"\x00"+seriesKey(a.Service, a.Labels), b.Name+"\x00"+seriesKey(b.Service, b.Labels); ka != kb {
+			return ka < kb
+		}
+		return a.StartTime.Before(b.StartTime)
+	})
+	return results, nil
+}
+
+// seriesIncrease returns how much a counter series grew in [from, to), and
+// the number of its points in that window. Increments are summed; running
+// totals are differenced from the last point before the window, with a
+// drop read as a counter reset.
+func seriesIncrease(points []models.Metric, from, to time.Time) (float64, int) {
+	i := sort.Search(len(points), func(i int) bool { return !points[i].Timestamp.Before(from) })
+	j := sort.Search(len(points), func(j int) bool { return !points[j].Timestamp.Before(to) })
+	if i == j {
+		return 0, 0
+	}
+
+	var increase float64
+	for k := i; k < j; k++ {
+		p := points[k]
+		if !p.Cumulative {
+			increase += p.Value
+			continue
+		}
+		if k == 0 || !points[k-1].Cumulative {
+			// No baseline: the first point of a running total only sets it
+			continue
+		}
+		if prev := points[k-1].Value; p.Value >= prev {
+			increase += p.Value - prev
+		} else {
+			increase += p.Value
+		}
+	}
+	return increase, j - i
+}
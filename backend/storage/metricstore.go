@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"encoding/json"
+	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,18 +12,58 @@ import (
 
 // MetricStore implements in-memory storage for metrics
 type MetricStore struct {
-	metrics   map[string][]models.Metric // Key (Name+Tags) -> Metrics
+	metrics   map[string][]models.Metric // Key (Name+Service+Labels) -> Metrics
+	index     *seriesIndex
 	mu        sync.RWMutex
+	done      chan struct{}
+	closeOnce sync.Once
 	maxPoints int
 	ttl       time.Duration
+
+	wal              *WAL
+	snapshotInterval time.Duration
+
+	limits          SeriesLimits
+	seriesByMetric  map[string]int
+	seriesByService map[string]int
+	overflowed      map[string]uint64 // Metric name -> points beyond the limits
+}
+
+// MetricStoreOption is a function that configures a MetricStore
+type MetricStoreOption func(*MetricStore)
+
+// WithMetricWAL logs every write to w and snapshots the store every
+// interval. The store owns w and closes it.
+func WithMetricWAL(w *WAL, interval time.Duration) MetricStoreOption {
+	return func(s *MetricStore) {
+		s.wal = w
+		s.snapshotInterval = interval
+	}
 }
 
-// NewMetricStore creates a new metric store
-func NewMetricStore(maxPoints int, ttl time.Duration) *MetricStore {
+// NewMetricStore creates a new metric store. With a WAL, the store is
+// restored from it before NewMetricStore returns.
+func NewMetricStore(maxPoints int, ttl time.Duration, opts ...MetricStoreOption) *MetricStore {
 	store := &MetricStore{
-		metrics:   make(map[string][]models.Metric),
-		maxPoints: maxPoints,
-		ttl:       ttl,
+		metrics: make(map[string][]models.Metric),
+		index:   newSeriesIndex(),
+
+		seriesByMetric:  make(map[string]int),
+		seriesByService: make(map[string]int),
+		overflowed:      make(map[string]uint64),
+		done:            make(chan struct{}),
+		maxPoints:       maxPoints,
+		ttl:             ttl,
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+
+	if store.wal != nil {
+		store.replayWAL()
+		if store.snapshotInterval > 0 {
+			go store.snapshotLoop()
+		}
 	}
 
 	go store.cleanupLoop()
@@ -33,45 +76,57 @@ func (s *MetricStore) Store(metric models.Metric) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	key := generateMetricKey(metric)
-	s.metrics[key] = append(s.metrics[key], metric)
+	metric, ok := s.admit(metric)
+	if !ok {
+		return nil
+	}
+	if s.wal != nil {
+		if err := s.wal.Append(metric); err != nil {
+			return err
+		}
+	}
 
+	s.add(metric)
 	return nil
 }
 
+// add appends a point to its series. Callers hold s.mu.
+func (s *MetricStore) add(metric models.Metric) {
+	key := generateMetricKey(metric)
+	if _, ok := s.metrics[key]; !ok {
+		s.index.add(key, metric)
+		s.countSeries(metric, 1)
+	}
+	s.metrics[key] = append(s.metrics[key], metric)
+}
+
 // QueryMetrics retrieves aggregated metrics
 func (s *MetricStore) QueryMetrics(query models.MetricQuery) ([]models.AggregatedMetric, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var results []models.AggregatedMetric
-
-	// Filter by name and labels
-	for _, metrics := range s.metrics {
-		if len(metrics) == 0 {
+	var selected [][]models.Metric
+	for key := range s.index.lookup(query.Name, query.Labels) {
+		metrics := s.metrics[key]
+		if query.Service != "" && metrics[0].Service != query.Service {
 			continue
 		}
-
-		// Check name match
-		if metrics[0].Name != query.Name {
+		if query.Match != nil && !query.Match(metrics[0]) {
 			continue
 		}
+		selected = append(selected, metrics)
+	}
 
-		// Check label match
-		match := true
-		for k, v := range query.Labels {
-			if metrics[0].Labels[k] != v {
-				match = false
-				break
-			}
-		}
-		if !match {
-			continue
-		}
+	if query.Function != "" || len(query.GroupBy) > 0 {
+		return evaluateMetricQuery(selected, query)
+	}
 
+	var results []models.AggregatedMetric
+	for _, metrics := range selected {
 		// Aggregate buckets
 		// This is a simplification. We align to steps.
 		buckets := make(map[int64]*models.AggregatedMetric)
+		quantiles := make(map[int64]*Histogram)
 
 		for _, m := range metrics {
 			if m.Timestamp.Before(query.StartTime) || m.Timestamp.After(query.EndTime) {
@@ -95,6 +150,15 @@ func (s *MetricStore) QueryMetrics(query models.MetricQuery) ([]models.Aggregate
 				buckets[bucketTime] = agg
 			}
 
+			if m.Type == models.MetricTypeHistogram {
+				h, ok := quantiles[bucketTime]
+				if !ok {
+					h = NewHistogram()
+					quantiles[bucketTime] = h
+				}
+				h.Record(m.Value)
+			}
+
 			agg.Count++
 			agg.Sum += m.Value
 			if m.Value < agg.Min {
@@ -105,8 +169,16 @@ func (s *MetricStore) QueryMetrics(query models.MetricQuery) ([]models.Aggregate
 			}
 		}
 
-		for _, agg := range buckets {
+		for bucketTime, agg := range buckets {
 			agg.Avg = agg.Sum / float64(agg.Count)
+			if h, ok := quantiles[bucketTime]; ok {
+				q := h.Quantiles(0.5, 0.95, 0.99)
+				// Bucket midpoints may fall just outside the observed values
+				for i := range q {
+					q[i] = min(max(q[i], agg.Min), agg.Max)
+				}
+				agg.P50, agg.P95, agg.P99 = q[0], q[1], q[2]
+			}
 			results = append(results, *agg)
 		}
 	}
@@ -114,20 +186,186 @@ func (s *MetricStore) QueryMetrics(query models.MetricQuery) ([]models.Aggregate
 	return results, nil
 }
 
-func generateMetricKey(m models.Metric) string {
-	// composite key: name|service|sorted_labels
-	// implementation simplified for prototype
-	return m.Name + "|" + m.Service
+// Stats reports the number of stored series and points
+func (s *MetricStore) Stats() MetricStoreStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := MetricStoreStats{Series: len(s.metrics)}
+	for _, metrics := range s.metrics {
+		stats.Points += len(metrics)
+	}
+	for _, n := range s.overflowed {
+		stats.Overflowed += n
+	}
+	return stats
+}
+
+// Series lists the stored series matching a query, sorted by name and
+// key
+func (s *MetricStore) Series(query models.MetricQuery) ([]models.MetricSeries, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0)
+	for key := range s.index.lookup(query.Name, query.Labels) {
+		if query.Service != "" && s.metrics[key][0].Service != query.Service {
+			continue
+		}
+		if query.Match != nil && !query.Match(s.metrics[key][0]) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]models.MetricSeries, 0, len(keys))
+	for _, key := range keys {
+		metrics := s.metrics[key]
+		entry := models.MetricSeries{
+			Name:    metrics[0].Name,
+			Type:    metrics[0].Type,
+			Service: metrics[0].Service,
+			Labels:  metrics[0].Labels,
+		}
+		for _, m := range metrics {
+			if !query.StartTime.IsZero() && m.Timestamp.Before(query.StartTime) {
+				continue
+			}
+			if !query.EndTime.IsZero() && m.Timestamp.After(query.EndTime) {
+				continue
+			}
+			entry.Points++
+			if m.Timestamp.After(entry.LastSeen) {
+				entry.LastSeen = m.Timestamp
+			}
+		}
+		if entry.Points > 0 {
+			series = append(series, entry)
+		}
+	}
+	return series, nil
+}
+
+// Points returns the stored points of the series matching a query, sorted
+// by series key, then time
+func (s *MetricStore) Points(query models.MetricQuery) ([]models.Metric, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0)
+	for key := range s.index.lookup(query.Name, query.Labels) {
+		if query.Service != "" && s.metrics[key][0].Service != query.Service {
+			continue
+		}
+		if query.Match != nil && !query.Match(s.metrics[key][0]) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var points []models.Metric
+	for _, key := range keys {
+		for _, m := range s.metrics[key] {
+			if !query.StartTime.IsZero() && m.Timestamp.Before(query.StartTime) {
+				continue
+			}
+			if !query.EndTime.IsZero() && m.Timestamp.After(query.EndTime) {
+				continue
+			}
+			points = append(points, m)
+		}
+	}
+	return points, nil
 }
 
 func (s *MetricStore) cleanupLoop() {
 	ticker := time.NewTicker(10 * time.Minute)
-	for range ticker.C {
-		s.cleanup()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.GC()
+		case <-s.done:
+			return
+		}
 	}
 }
 
-func (s *MetricStore) cleanup() {
+// Close stops the cleanup loop. With a WAL, it takes a final snapshot so the
+// next start has little to replay.
+func (s *MetricStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.wal != nil {
+			if err = s.Snapshot(); err != nil {
+				log.Printf("Metric snapshot failed: %v", err)
+			}
+			err = s.wal.Close()
+		}
+	})
+	return err
+}
+
+func (s *MetricStore) replayWAL() {
+	err := s.wal.Replay(func(dec *json.Decoder) error {
+		// Re-key the series, in case the snapshot was keyed differently
+		var snapshot map[string][]models.Metric
+		if err := dec.Decode(&snapshot); err != nil {
+			return err
+		}
+		for _, metrics := range snapshot {
+			for _, metric := range metrics {
+				s.add(metric)
+			}
+		}
+		return nil
+	}, func(record []byte) error {
+		var metric models.Metric
+		if err := json.Unmarshal(record, &metric); err != nil {
+			return err
+		}
+		s.add(metric)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Metric WAL replay failed: %v", err)
+	}
+	s.GC()
+}
+
+func (s *MetricStore) snapshotLoop() {
+	ticker := time.NewTicker(s.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				log.Printf("Metric snapshot failed: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Snapshot writes the store's metrics to its WAL and compacts the log.
+// Writes wait while the snapshot is taken.
+func (s *MetricStore) Snapshot() error {
+	if s.wal == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.wal.Snapshot(func(enc *json.Encoder) error {
+		return enc.Encode(s.metrics)
+	})
+}
+
+// GC removes metric points older than the TTL
+func (s *MetricStore) GC() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -146,7 +384,38 @@ func (s *MetricStore) cleanup() {
 		s.metrics[key] = metrics[:n]
 
 		if n == 0 {
+			s.index.remove(key, metrics[0])
+			s.countSeries(metrics[0], -1)
 			delete(s.metrics, key)
 		}
 	}
 }
+
+// DeleteService removes the series of a service. With a WAL, the store is
+// snapshotted so they aren't replayed on restart.
+func (s *MetricStore) DeleteService(service string) (int, error) {
+	s.mu.Lock()
+	deleted := 0
+	for key, metrics := range s.metrics {
+		if len(metrics) == 0 || metrics[0].Service != service {
+			continue
+		}
+		s.index.remove(key, metrics[0])
+		s.countSeries(metrics[0], -1)
+		delete(s.metrics, key)
+		deleted++
+	}
+	s.mu.Unlock()
+
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, s.Snapshot()
+}
+
+// Compact removes expired points and, with a WAL, snapshots the store so
+// the log no longer holds them
+func (s *MetricStore) Compact() error {
+	s.GC()
+	return s.Snapshot()
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// ErrPinLimit is returned when pinning a trace would exceed the pin limits
+var ErrPinLimit = errors.New("pinned trace limit reached")
+
+// pinnedTrace is a pinned copy of a trace
+type pinnedTrace struct {
+	Spans    []models.Span `json:"spans"`
+	PinnedAt time.Time     `json:"pinned_at"`
+	Note     string        `json:"note,omitempty"`
+}
+
+// PinStore keeps copies of pinned traces outside the span backend, so that
+// they survive TTL cleanup and retention. Pins are capped by trace and span
+// count, and written to a file when the tenant's storage is persistent.
+type PinStore struct {
+	traces    map[models.TraceID]pinnedTrace // TraceID -> pinned copy
+	spanCount int
+	mu        sync.RWMutex
+	maxTraces int
+	maxSpans  int
+	path      string
+}
+
+// NewPinStore creates a pin store. With a path, pins are loaded from and
+// saved to that file.
+func NewPinStore(maxTraces, maxSpans int, path string) (*PinStore, error) {
+	store := &PinStore{
+		traces:    make(map[models.TraceID]pinnedTrace),
+		maxTraces: maxTraces,
+		maxSpans:  maxSpans,
+		path:      path,
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.traces); err != nil {
+		return nil, fmt.Errorf("load pins: %w", err)
+	}
+	for _, pinned := range store.traces {
+		store.spanCount += len(pinned.Spans)
+	}
+	return store, nil
+}
+
+// Pin stores a copy of a trace, replacing an earlier pin of it. It fails
+// with ErrPinLimit when the store is full.
+func (s *PinStore) Pin(trace *models.Trace, note string) (models.PinnedTrace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, repinned := s.traces[trace.TraceID]
+	traces, spans := len(s.traces)+1, s.spanCount+len(trace.Spans)
+	if repinned {
+		traces--
+		spans -= len(previous.Spans)
+	}
+	if (s.maxTraces > 0 && traces > s.maxTraces) || (s.maxSpans > 0 && spans > s.maxSpans) {
+		return models.PinnedTrace{}, ErrPinLimit
+	}
+
+	pinned := pinnedTrace{
+		Spans:    append([]models.Span(nil), trace.Spans...),
+		PinnedAt: time.Now(),
+		Note:     note,
+	}
+	s.traces[trace.TraceID] = pinned
+	spanCount := s.spanCount
+	s.spanCount = spans
+	if err := s.save(); err != nil {
+		// Keep memory and disk in step
+		if repinned {
+			s.traces[trace.TraceID] = previous
+		} else {
+			delete(s.traces, trace.TraceID)
+		}
+		s.spanCount = spanCount
+		return models.PinnedTrace{}, err
+	}
+	return summarizePin(pinned), nil
+}
+
+// Unpin removes a pinned trace and reports whether it was pinned
+func (s *PinStore) Unpin(traceID models.TraceID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pinned, ok := s.traces[traceID]
+	if !ok {
+		return false, nil
+	}
+	delete(s.traces, traceID)
+	s.spanCount -= len(pinned.Spans)
+	return true, s.save()
+}
+
+// GetTrace returns a pinned trace, or nil if it isn't pinned
+func (s *PinStore) GetTrace(traceID models.TraceID) *models.Trace {
+	s.mu.RLock()
+	pinned, ok := s.traces[traceID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	spans := append([]models.Span(nil), pinned.Spans...)
+	return models.BuildTrace(models.CorrectClockSkew(spans))
+}
+
+// List returns the pinned traces, most recently pinned first
+func (s *PinStore) List() []models.PinnedTrace {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pins := make([]models.PinnedTrace, 0, len(s.traces))
+	for _, pinned := range s.traces {
+		pins = append(pins, summarizePin(pinned))
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].PinnedAt.After(pins[j].PinnedAt) })
+	return pins
+}
+
+func summarizePin(pinned pinnedTrace) models.PinnedTrace {
+	spans := append([]models.Span(nil), pinned.Spans...)
+	return models.PinnedTrace{
+		TraceSummary: models.BuildTrace(spans).ToSummary(),
+		PinnedAt:     pinned.PinnedAt,
+		Note:         pinned.Note,
+	}
+}
+
+// save writes the pins to the store's file, if any. Callers hold s.mu.
+func (s *PinStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.traces)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
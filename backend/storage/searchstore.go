@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Saved searches and short links kept per tenant. Saving beyond the limit
+// fails; the oldest links are dropped.
+const (
+	maxSavedSearches = 1000
+	maxSearchLinks   = 10000
+)
+
+var (
+	// ErrInvalidSearch is returned when saving a search without a name or
+	// query
+	ErrInvalidSearch = errors.New("invalid search")
+	// ErrSearchLimit is returned when saving a search would exceed the
+	// limit
+	ErrSearchLimit = errors.New("saved search limit reached")
+)
+
+// searchFile is the content of a search store's file
+type searchFile struct {
+	Searches []models.SavedSearch `json:"searches"`
+	Links    []models.SearchLink  `json:"links"` // Oldest first
+}
+
+// SearchStore keeps a tenant's saved searches and short links. They are
+// written to a file when the tenant's storage is persistent.
+type SearchStore struct {
+	data searchFile
+	mu   sync.RWMutex
+	path string
+}
+
+// NewSearchStore creates a search store. With a path, searches and links
+// are loaded from and saved to that file.
+func NewSearchStore(path string) (*SearchStore, error) {
+	store := &SearchStore{path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.data); err != nil {
+		return nil, fmt.Errorf("load saved searches: %w", err)
+	}
+	return store, nil
+}
+
+// Save stores a search, assigning its ID, time and short link
+func (s *SearchStore) Save(search models.SavedSearch) (models.SavedSearch, error) {
+	if search.Name == "" {
+		return search, fmt.Errorf("%w: name is required", ErrInvalidSearch)
+	}
+	if search.Query == "" {
+		return search, fmt.Errorf("%w: query is required", ErrInvalidSearch)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return search, err
+	}
+	search.ID = hex.EncodeToString(id)
+	search.CreatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.data.Searches) >= maxSavedSearches {
+		return search, ErrSearchLimit
+	}
+	previous := s.data
+	link, _ := s.link(search.Query, search.CreatedAt)
+	search.Link = link.ID
+	s.data.Searches = append(slices.Clip(s.data.Searches), search)
+	if err := s.save(); err != nil {
+		// Keep memory and disk in step
+		s.data = previous
+		return search, err
+	}
+	return search, nil
+}
+
+// Get returns a saved search
+func (s *SearchStore) Get(id string) (models.SavedSearch, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := slices.IndexFunc(s.data.Searches, func(search models.SavedSearch) bool { return search.ID == id })
+	if i < 0 {
+		return models.SavedSearch{}, false
+	}
+	return s.data.Searches[i], true
+}
+
+// List returns the saved searches of an owner and of a team, or all of
+// them if both are empty, by name
+func (s *SearchStore) List(owner, team string) []models.SavedSearch {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	searches := []models.SavedSearch{}
+	for _, search := range s.data.Searches {
+		if owner == "" && team == "" ||
+			owner != "" && search.Owner == owner ||
+			team != "" && search.Team == team {
+			searches = append(searches, search)
+		}
+	}
+	sort.SliceStable(searches, func(i, j int) bool { return searches[i].Name < searches[j].Name })
+	return searches
+}
+
+// Delete removes a saved search, reporting whether it existed. Its short
+// link keeps working.
+func (s *SearchStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.data.Searches, func(search models.SavedSearch) bool { return search.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	previous := s.data
+	s.data.Searches = slices.Delete(slices.Clone(s.data.Searches), i, i+1)
+	if err := s.save(); err != nil {
+		s.data = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// Link returns the short link of a query, creating it if needed
+func (s *SearchStore) Link(query string) (models.SearchLink, error) {
+	if query == "" {
+		return models.SearchLink{}, fmt.Errorf("%w: query is required", ErrInvalidSearch)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.data
+	link, created := s.link(query, time.Now())
+	if !created {
+		return link, nil
+	}
+	if err := s.save(); err != nil {
+		s.data = previous
+		return link, err
+	}
+	return link, nil
+}
+
+// ResolveLink returns a short link by ID
+func (s *SearchStore) ResolveLink(id string) (models.SearchLink, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := slices.IndexFunc(s.data.Links, func(link models.SearchLink) bool { return link.ID == id })
+	if i < 0 {
+		return models.SearchLink{}, false
+	}
+	return s.data.Links[i], true
+}
+
+// link returns the short link of a query, adding it at now if there is
+// none, and whether it was added. Callers hold s.mu for writing.
+func (s *SearchStore) link(query string, now time.Time) (models.SearchLink, bool) {
+	sum := sha256.Sum256([]byte(query))
+	id := hex.EncodeToString(sum[:6])
+	if i := slices.IndexFunc(s.data.Links, func(link models.SearchLink) bool { return link.ID == id }); i >= 0 {
+		return s.data.Links[i], false
+	}
+
+	link := models.SearchLink{ID: id, Query: query, CreatedAt: now}
+	links := append(slices.Clip(s.data.Links), link)
+	if len(links) > maxSearchLinks {
+		links = links[len(links)-maxSearchLinks:]
+	}
+	s.data.Links = links
+	return link, true
+}
+
+// save writes the searches and links to the store's file, if any. Callers
+// hold s.mu.
+func (s *SearchStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
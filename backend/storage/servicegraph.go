@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// serviceGraphBucket is the resolution of the rolling service graph
+const serviceGraphBucket = time.Minute
+
+type edgeKey struct{ source, target string }
+
+type callStats struct {
+	calls   int
+	errors  int
+	latency time.Duration
+}
+
+func (c *callStats) add(d time.Duration, isError bool) {
+	c.calls++
+	c.latency += d
+	if isError {
+		c.errors++
+	}
+}
+
+// graphBucket holds the calls observed in one time bucket
+type graphBucket struct {
+	nodes map[string]*callStats
+	edges map[edgeKey]*callStats
+}
+
+// ServiceGraphStore keeps rolling per-minute call statistics for services
+// and the calls between them
+type ServiceGraphStore struct {
+	buckets map[int64]*graphBucket // Bucket start (Unix seconds) -> stats
+	mu      sync.RWMutex
+	ttl     time.Duration
+}
+
+// NewServiceGraphStore creates a service graph store that keeps buckets for
+// ttl
+func NewServiceGraphStore(ttl time.Duration) *ServiceGraphStore {
+	store := &ServiceGraphStore{
+		buckets: make(map[int64]*graphBucket),
+		ttl:     ttl,
+	}
+
+	go store.cleanupLoop()
+
+	return store
+}
+
+func (s *ServiceGraphStore) bucket(at time.Time) *graphBucket {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	key := at.Truncate(serviceGraphBucket).Unix()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &graphBucket{
+			nodes: make(map[string]*callStats),
+			edges: make(map[edgeKey]*callStats),
+		}
+		s.buckets[key] = b
+	}
+	return b
+}
+
+// RecordSpan counts a span towards its service's node statistics
+func (s *ServiceGraphStore) RecordSpan(span models.Span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.bucket(span.StartTime)
+	stats, ok := b.nodes[span.ServiceName]
+	if !ok {
+		stats = &callStats{}
+		b.nodes[span.ServiceName] = stats
+	}
+	stats.add(span.Duration, span.Status == models.SpanStatusError)
+}
+
+// RecordCall counts a call from source to target service
+func (s *ServiceGraphStore) RecordCall(source, target string, at time.Time, latency time.Duration, isError bool) {
+	if source == "" || target == "" || source == target {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.bucket(at)
+	key := edgeKey{source, target}
+	stats, ok := b.edges[key]
+	if !ok {
+		stats = &callStats{}
+		b.edges[key] = stats
+	}
+	stats.add(latency, isError)
+}
+
+// Graph aggregates the buckets between start and end (zero values are
+// unbounded) into a service graph
+func (s *ServiceGraphStore) Graph(start, end time.Time) models.ServiceGraph {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nodes := make(map[string]*callStats)
+	edges := make(map[edgeKey]*callStats)
+	for key, b := range s.buckets {
+		at := time.Unix(key, 0)
+		if !start.IsZero() && at.Add(serviceGraphBucket).Before(start) {
+			continue
+		}
+		if !end.IsZero() && at.After(end) {
+			continue
+		}
+		for name, stats := range b.nodes {
+			mergeCallStats(nodes, name, stats)
+		}
+		for key, stats := range b.edges {
+			mergeCallStats(edges, key, stats)
+			// Services only seen as call targets still get a node
+			if _, ok := nodes[key.target]; !ok {
+				nodes[key.target] = &callStats{}
+			}
+			if _, ok := nodes[key.source]; !ok {
+				nodes[key.source] = &callStats{}
+			}
+		}
+	}
+
+	graph := models.ServiceGraph{
+		Nodes: make([]models.ServiceNode, 0, len(nodes)),
+		Edges: make([]models.ServiceEdge, 0, len(edges)),
+	}
+	connections := make(map[string][]string)
+	for key, stats := range edges {
+		graph.Edges = append(graph.Edges, models.ServiceEdge{
+			Source:     key.source,
+			Target:     key.target,
+			CallCount:  stats.calls,
+			ErrorRate:  ratio(stats.errors, stats.calls),
+			AvgLatency: avgMillis(stats.latency, stats.calls),
+		})
+		connections[key.source] = append(connections[key.source], key.target)
+	}
+	for name, stats := range nodes {
+		conns := connections[name]
+		sort.Strings(conns)
+		graph.Nodes = append(graph.Nodes, models.ServiceNode{
+			Name:        name,
+			SpanCount:   stats.calls,
+			ErrorCount:  stats.errors,
+			AvgDuration: avgMillis(stats.latency, stats.calls),
+			Connections: conns,
+		})
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].Name < graph.Nodes[j].Name })
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].Source != graph.Edges[j].Source {
+			return graph.Edges[i].Source < graph.Edges[j].Source
+		}
+		return graph.Edges[i].Target < graph.Edges[j].Target
+	})
+
+	return graph
+}
+
+func mergeCallStats[K comparable](into map[K]*callStats, key K, stats *callStats) {
+	total, ok := into[key]
+	if !ok {
+		total = &callStats{}
+		into[key] = total
+	}
+	total.calls += stats.calls
+	total.errors += stats.errors
+	total.latency += stats.latency
+}
+
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func avgMillis(total time.Duration, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(total) / float64(n) / float64(time.Millisecond)
+}
+
+func (s *ServiceGraphStore) cleanupLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	for range ticker.C {
+		s.cleanup()
+	}
+}
+
+func (s *ServiceGraphStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.ttl).Unix()
+	for key := range s.buckets {
+		if key < cutoff {
+			delete(s.buckets, key)
+		}
+	}
+}
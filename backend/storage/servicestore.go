@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// ErrInvalidServiceMetadata is returned when registering metadata without
+// a service name
+var ErrInvalidServiceMetadata = errors.New("invalid service metadata")
+
+// ServiceRegistry keeps the metadata teams attach to a tenant's services.
+// Entries are written to a file when the tenant's storage is persistent.
+type ServiceRegistry struct {
+	services map[string]models.ServiceMetadata
+	mu       sync.RWMutex
+	path     string
+}
+
+// NewServiceRegistry creates a service registry. With a path, entries are
+// loaded from and saved to that file.
+func NewServiceRegistry(path string) (*ServiceRegistry, error) {
+	registry := &ServiceRegistry{services: make(map[string]models.ServiceMetadata), path: path}
+	if path == "" {
+		return registry, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var services []models.ServiceMetadata
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("load service registry: %w", err)
+	}
+	for _, m := range services {
+		registry.services[m.Service] = m
+	}
+	return registry, nil
+}
+
+// Set registers a service's metadata, replacing any earlier entry
+func (r *ServiceRegistry) Set(m models.ServiceMetadata) (models.ServiceMetadata, error) {
+	if m.Service == "" {
+		return m, fmt.Errorf("%w: service is required", ErrInvalidServiceMetadata)
+	}
+	m.UpdatedAt = time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, existed := r.services[m.Service]
+	r.services[m.Service] = m
+	if err := r.save(); err != nil {
+		// Keep memory and disk in step
+		if existed {
+			r.services[m.Service] = previous
+		} else {
+			delete(r.services, m.Service)
+		}
+		return m, err
+	}
+	return m, nil
+}
+
+// Get returns a service's metadata
+func (r *ServiceRegistry) Get(service string) (models.ServiceMetadata, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.services[service]
+	return m, ok
+}
+
+// Delete removes a service's metadata, reporting whether it was registered
+func (r *ServiceRegistry) Delete(service string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous, ok := r.services[service]
+	if !ok {
+		return false, nil
+	}
+	delete(r.services, service)
+	if err := r.save(); err != nil {
+		r.services[service] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// List returns every registered service's metadata, by service name
+func (r *ServiceRegistry) List() []models.ServiceMetadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.list()
+}
+
+// list returns the entries by service name. Callers hold r.mu.
+func (r *ServiceRegistry) list() []models.ServiceMetadata {
+	services := make([]models.ServiceMetadata, 0, len(r.services))
+	for _, service := range slices.Sorted(maps.Keys(r.services)) {
+		services = append(services, r.services[service])
+	}
+	return services
+}
+
+// save writes the registry to its file, if any. Callers hold r.mu.
+func (r *ServiceRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.list())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
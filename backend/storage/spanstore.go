@@ -1,172 +1,735 @@
 package storage
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 
 	"github.com/omnitrace/omnitrace/internal/models"
 )
 
-// SpanStore implements in-memory storage for spans
+// SpanStore implements in-memory storage for spans. Spans are held in a
+// compact form, with their service and operation names and tag keys
+// interned, and converted back when read. With compression, the spans of
+// quiet traces are held compressed instead.
 type SpanStore struct {
-	spans        map[string][]models.Span // TraceID -> Spans
-	serviceSpans map[string][]string      // Service -> TraceIDs
-	mu           sync.RWMutex
-	maxSpans     int
-	ttl          time.Duration
+	spans         map[models.TraceID][]storedSpan // TraceID -> Spans
+	sealed        map[models.TraceID]sealedTrace  // TraceID -> compressed Spans
+	lastWrite     map[models.TraceID]time.Time    // TraceID -> last span arrival
+	truncated     map[models.TraceID]bool         // Traces that reached the span limit
+	strings       *internTable
+	index         *traceIndex
+	text          *textIndex
+	tags          *tagIndex
+	mu            sync.RWMutex
+	done          chan struct{}
+	closeOnce     sync.Once
+	maxSpans      int
+	ttl           time.Duration
+	assemblyDelay time.Duration
+	compression   SpanCompression
+	// maxSpansPerTrace caps the spans stored per trace; dropped counts
+	// the spans beyond it
+	maxSpansPerTrace int
+	dropped          uint64
+
+	wal              *WAL
+	snapshotInterval time.Duration
 }
 
-// NewSpanStore creates a new span store
-func NewSpanStore(maxSpans int, ttl time.Duration) *SpanStore {
+// walSpanRecord is the WAL record of one span write
+type walSpanRecord struct {
+	Spans []models.Span `json:"spans"`
+}
+
+// SpanStoreOption is a function that configures a SpanStore
+type SpanStoreOption func(*SpanStore)
+
+// WithAssemblyDelay sets how long a trace must go without new spans before
+// it is considered complete
+func WithAssemblyDelay(d time.Duration) SpanStoreOption {
+	return func(s *SpanStore) {
+		if d >= 0 {
+			s.assemblyDelay = d
+		}
+	}
+}
+
+// WithMaxSpansPerTrace caps the spans stored per trace, so that a runaway
+// trace can't stall queries. Further spans of a trace are dropped and the
+// trace is marked truncated. Zero means no limit.
+func WithMaxSpansPerTrace(n int) SpanStoreOption {
+	return func(s *SpanStore) {
+		if n >= 0 {
+			s.maxSpansPerTrace = n
+		}
+	}
+}
+
+// WithSpanWAL logs every write to w and snapshots the store every interval,
+// so that a restart replays recent spans instead of starting empty. The
+// store owns w and closes it.
+func WithSpanWAL(w *WAL, interval time.Duration) SpanStoreOption {
+	return func(s *SpanStore) {
+		s.wal = w
+		s.snapshotInterval = interval
+	}
+}
+
+// NewSpanStore creates a new span store. With a WAL, the store is restored
+// from it before NewSpanStore returns.
+func NewSpanStore(maxSpans int, ttl time.Duration, opts ...SpanStoreOption) *SpanStore {
 	store := &SpanStore{
-		spans:        make(map[string][]models.Span),
-		serviceSpans: make(map[string][]string),
-		maxSpans:     maxSpans,
-		ttl:          ttl,
+		spans:     make(map[models.TraceID][]storedSpan),
+		sealed:    make(map[models.TraceID]sealedTrace),
+		lastWrite: make(map[models.TraceID]time.Time),
+		truncated: make(map[models.TraceID]bool),
+		strings:   newInternTable(),
+		index:     newTraceIndex(),
+		text:      newTextIndex(),
+		tags:      newTagIndex(),
+		done:      make(chan struct{}),
+		maxSpans:  maxSpans,
+		ttl:       ttl,
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+
+	if store.wal != nil {
+		store.replayWAL()
+		if store.snapshotInterval > 0 {
+			go store.snapshotLoop()
+		}
 	}
 
 	// Start cleanup loop
 	go store.cleanupLoop()
+	if store.compression != "" {
+		go store.sealLoop()
+	}
 
 	return store
 }
 
-// Store adds a span to storage
+func (s *SpanStore) replayWAL() {
+	now := time.Now()
+	err := s.wal.Replay(func(dec *json.Decoder) error {
+		var spans map[models.TraceID][]models.Span
+		if err := dec.Decode(&spans); err != nil {
+			return err
+		}
+		for _, traceSpans := range spans {
+			s.storeSpans(traceSpans, now)
+		}
+		return nil
+	}, func(record []byte) error {
+		var rec walSpanRecord
+		if err := json.Unmarshal(record, &rec); err != nil {
+			return err
+		}
+		s.storeSpans(rec.Spans, now)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Span WAL replay failed: %v", err)
+	}
+	// Spans dropped again on replay were counted before the restart
+	s.dropped = 0
+	// The log may still hold traces that expired while we were down
+	s.GC()
+}
+
+func (s *SpanStore) snapshotLoop() {
+	ticker := time.NewTicker(s.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				log.Printf("Span snapshot failed: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Snapshot writes the store's spans to its WAL and compacts the log. Writes
+// wait while the snapshot is taken.
+func (s *SpanStore) Snapshot() error {
+	if s.wal == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.wal.Snapshot(func(enc *json.Encoder) error {
+		if len(s.sealed) == 0 {
+			return enc.Encode(s.spans)
+		}
+		// Sealed traces decompress to the JSON of their spans
+		traces := make(map[models.TraceID]any, len(s.spans)+len(s.sealed))
+		for traceID, spans := range s.spans {
+			traces[traceID] = spans
+		}
+		for traceID, sealed := range s.sealed {
+			data, err := s.compression.decompress(sealed.block)
+			if err != nil {
+				return fmt.Errorf("decode trace %s: %w", traceID, err)
+			}
+			traces[traceID] = json.RawMessage(data)
+		}
+		return enc.Encode(traces)
+	})
+}
+
+// Store adds a span to storage. A span already stored under the same trace
+// and span ID is replaced instead of duplicated.
 func (s *SpanStore) Store(span models.Span) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Store by TraceID
-	s.spans[span.TraceID] = append(s.spans[span.TraceID], span)
-
-	// Index by Service (if root span or just simpler indexing)
-	// For simplicity, we just track trace IDs per service here
-	// In a real DB, this would be an index
-	s.serviceSpans[span.ServiceName] = append(s.serviceSpans[span.ServiceName], span.TraceID)
+	if s.wal != nil {
+		if err := s.wal.Append(walSpanRecord{Spans: []models.Span{span}}); err != nil {
+			return err
+		}
+	}
 
+	s.storeSpans([]models.Span{span}, time.Now())
 	return nil
 }
 
-// GetTrace retrieves a full trace by ID
-func (s *SpanStore) GetTrace(traceID string) (*models.Trace, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// StoreBatch adds spans to storage under a single lock acquisition. Spans
+// already stored under the same trace and span ID, e.g. from an SDK retry,
+// replace the stored copy instead of being appended; the spans that were
+// new are returned.
+func (s *SpanStore) StoreBatch(spans []models.Span) ([]models.Span, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	spans, ok := s.spans[traceID]
-	if !ok {
-		return nil, nil
+	if s.wal != nil {
+		if err := s.wal.Append(walSpanRecord{Spans: spans}); err != nil {
+			return nil, err
+		}
+	}
+	return s.storeSpans(spans, time.Now()), nil
+}
+
+// storeSpans applies a batch write. Callers hold s.mu.
+func (s *SpanStore) storeSpans(spans []models.Span, now time.Time) []models.Span {
+	written := make(map[models.TraceID]bool)
+	stored := make([]models.Span, 0, len(spans))
+	for _, span := range spans {
+		// Dropped spans don't count as writes, so that a runaway trace
+		// still completes and shows up in queries
+		if s.traceFull(span) {
+			s.truncated[span.TraceID] = true
+			s.dropped++
+			continue
+		}
+		s.unseal(span.TraceID)
+		s.lastWrite[span.TraceID] = now
+		written[span.TraceID] = true
+		s.text.add(span)
+		compact := newStoredSpan(span, s.strings)
+		s.tags.add(&compact)
+		if s.replaceDuplicate(compact) {
+			continue
+		}
+		s.spans[span.TraceID] = append(s.spans[span.TraceID], compact)
+		stored = append(stored, span)
 	}
 
-	// Return a copy to avoid race conditions
-	spansCopy := make([]models.Span, len(spans))
-	copy(spansCopy, spans)
+	// Replaced spans can change a trace's timing too, so re-index every
+	// trace the batch wrote to
+	for traceID := range written {
+		s.index.update(traceID, s.spans[traceID])
+	}
 
-	return models.BuildTrace(spansCopy), nil
+	return stored
 }
 
-// QueryTraces searches for traces matching criteria
-func (s *SpanStore) QueryTraces(query models.TraceQuery) ([]models.TraceSummary, error) {
+// traceFull reports whether span's trace holds the most spans allowed.
+// Spans of a full trace are dropped without looking for a stored copy to
+// replace, which would cost a scan of the trace per span of a runaway
+// trace. Callers hold s.mu.
+func (s *SpanStore) traceFull(span models.Span) bool {
+	if s.maxSpansPerTrace == 0 {
+		return false
+	}
+	count := len(s.spans[span.TraceID])
+	if sealed, ok := s.sealed[span.TraceID]; ok {
+		count = sealed.spans
+	}
+	return count >= s.maxSpansPerTrace
+}
+
+// replaceDuplicate reports whether span is already stored. The stored copy
+// is replaced unless it is complete and span isn't, so a late retry of a
+// finished span wins over an earlier partial one. Callers hold s.mu.
+func (s *SpanStore) replaceDuplicate(span storedSpan) bool {
+	spans := s.spans[span.traceID]
+	for i := range spans {
+		if spans[i].spanID != span.spanID {
+			continue
+		}
+		if !span.endTime.IsZero() || spans[i].endTime.IsZero() {
+			spans[i] = span
+		}
+		return true
+	}
+	return false
+}
+
+// Stats reports the number of stored traces and spans
+func (s *SpanStore) Stats() SpanStoreStats {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var summaries []models.TraceSummary
-
-	// This is a naive O(N) scan.
-	// In production, we would use proper indexes (B-Trees, Inverted Index).
-	// Since we grouped by TraceID, we iterate over traces.
+	stats := SpanStoreStats{Traces: len(s.spans) + len(s.sealed), Compressed: len(s.sealed), DroppedSpans: s.dropped}
+	for _, spans := range s.spans {
+		stats.Spans += len(spans)
+	}
+	for _, sealed := range s.sealed {
+		stats.Spans += sealed.spans
+	}
+	return stats
+}
 
-	count := 0
-	skipped := 0
+// ServiceStats counts the stored traces and spans of each service
+func (s *SpanStore) ServiceStats() (map[string]SpanStoreStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for _, spans := range s.spans {
-		// Fast check: service filter
-		if query.Service != "" {
-			found := false
-			for _, span := range spans {
-				if span.ServiceName == query.Service {
-					found = true
-					break
-				}
-			}
-			if !found {
-				continue
+	stats := make(map[string]SpanStoreStats)
+	s.eachTrace(func(_ models.TraceID, spans []storedSpan) {
+		seen := make(map[string]bool)
+		for _, span := range spans {
+			st := stats[span.serviceName]
+			st.Spans++
+			if !seen[span.serviceName] {
+				seen[span.serviceName] = true
+				st.Traces++
 			}
+			stats[span.serviceName] = st
 		}
+	})
+	return stats, nil
+}
+
+// DeleteTrace removes a trace. With a WAL, the store is snapshotted so the
+// trace isn't replayed on restart.
+func (s *SpanStore) DeleteTrace(traceID models.TraceID) (bool, error) {
+	s.mu.Lock()
+	ok := s.hasTrace(traceID)
+	if ok {
+		s.removeTrace(traceID)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, s.Snapshot()
+}
 
-		trace := models.BuildTrace(spans)
-		if trace == nil {
+// DeleteService removes the spans of a service, and the traces left empty.
+// With a WAL, the store is snapshotted so they aren't replayed on restart.
+func (s *SpanStore) DeleteService(service string) (int, error) {
+	s.mu.Lock()
+	deleted := 0
+	for _, traceID := range s.index.traceIDs(service) {
+		s.unseal(traceID)
+		spans, ok := s.spans[traceID]
+		if !ok {
 			continue
 		}
-
-		// Time range filter
-		if !query.StartTime.IsZero() && trace.StartTime.Before(query.StartTime) {
+		kept := make([]storedSpan, 0, len(spans))
+		for _, span := range spans {
+			if span.serviceName != service {
+				kept = append(kept, span)
+			}
+		}
+		if len(kept) == len(spans) {
 			continue
 		}
-		if !query.EndTime.IsZero() && trace.EndTime.After(query.EndTime) {
+		deleted += len(spans) - len(kept)
+		if len(kept) == 0 {
+			s.removeTrace(traceID)
 			continue
 		}
+		s.spans[traceID] = kept
+		s.index.update(traceID, kept)
+		s.text.remove(traceID)
+		s.tags.remove(traceID)
+		for i := range kept {
+			s.text.add(kept[i].span())
+			s.tags.add(&kept[i])
+		}
+	}
+	s.mu.Unlock()
 
-		// Duration filter
-		if query.MinDuration > 0 && trace.Duration < query.MinDuration {
-			continue
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, s.Snapshot()
+}
+
+// removeTrace drops a trace and its index entries. Callers hold s.mu.
+func (s *SpanStore) removeTrace(traceID models.TraceID) {
+	delete(s.spans, traceID)
+	delete(s.sealed, traceID)
+	delete(s.lastWrite, traceID)
+	delete(s.truncated, traceID)
+	s.index.remove(traceID)
+	s.text.remove(traceID)
+	s.tags.remove(traceID)
+}
+
+// GetTrace retrieves a full trace by ID, with cross-service clock skew
+// corrected
+func (s *SpanStore) GetTrace(traceID models.TraceID) (*models.Trace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	spans, ok := s.traceSpans(traceID)
+	if !ok {
+		return nil, nil
+	}
+
+	trace := models.BuildTrace(models.CorrectClockSkew(modelSpans(spans)))
+	trace.Partial = !traceComplete(trace, s.lastWrite[traceID], s.assemblyDelay, time.Now())
+	trace.Truncated = s.truncated[traceID]
+	return trace, nil
+}
+
+// traceComplete reports whether a trace is likely complete: it has a root
+// span, every parent it references is present, and no span has arrived
+// for the assembly delay
+func traceComplete(trace *models.Trace, lastWrite time.Time, assemblyDelay time.Duration, now time.Time) bool {
+	if trace.RootSpan == nil {
+		return false
+	}
+	if now.Sub(lastWrite) < assemblyDelay {
+		return false
+	}
+
+	ids := make(map[models.SpanID]bool, len(trace.Spans))
+	for _, span := range trace.Spans {
+		ids[span.SpanID] = true
+	}
+	for _, span := range trace.Spans {
+		if !span.ParentSpanID.IsZero() && !ids[span.ParentSpanID] {
+			return false
 		}
-		if query.MaxDuration > 0 && trace.Duration > query.MaxDuration {
-			continue
+	}
+	return true
+}
+
+// FindSpan returns a stored span by trace and span ID
+func (s *SpanStore) FindSpan(traceID models.TraceID, spanID models.SpanID) (models.Span, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	spans, _ := s.traceSpans(traceID)
+	for i := range spans {
+		if spans[i].spanID == spanID {
+			return spans[i].span(), true
 		}
+	}
+	return models.Span{}, false
+}
+
+// ChildSpans returns the stored children of a span
+func (s *SpanStore) ChildSpans(traceID models.TraceID, parentID models.SpanID) []models.Span {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var children []models.Span
+	spans, _ := s.traceSpans(traceID)
+	for i := range spans {
+		if spans[i].parentSpanID == parentID {
+			children = append(children, spans[i].span())
+		}
+	}
+	return children
+}
+
+// Services returns the sorted names of services with stored spans
+func (s *SpanStore) Services() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.index.serviceNames()
+}
 
-		// Error filter
-		if query.HasError != nil {
-			if *query.HasError != trace.HasError {
-				continue
+// Operations returns span and error counts per operation of a service,
+// sorted by operation name
+func (s *SpanStore) Operations(service string) []models.OperationStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counter := make(operationCounter)
+	for _, traceID := range s.index.traceIDs(service) {
+		spans, _ := s.traceSpans(traceID)
+		for i := range spans {
+			if spans[i].serviceName == service {
+				counter.add(spans[i].summary())
 			}
 		}
+	}
+	return counter.result()
+}
+
+// LatencyPercentiles computes span latency percentiles per time bucket
+func (s *SpanStore) LatencyPercentiles(query models.LatencyQuery) ([]models.LatencyBucket, error) {
+	if query.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agg := newLatencyAggregator(query)
+	s.eachTrace(func(_ models.TraceID, spans []storedSpan) {
+		for i := range spans {
+			agg.add(spans[i].summary())
+		}
+	})
+	return agg.result(), nil
+}
 
-		// Operation filter (root span)
-		if query.Operation != "" && trace.RootSpan != nil {
-			if trace.RootSpan.OperationName != query.Operation {
-				continue
+// OperationSummaries computes the request rate, errors and latency
+// percentiles of each operation of a service, from the traces the index
+// lists for it
+func (s *SpanStore) OperationSummaries(query models.OperationSummaryQuery) ([]models.OperationSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agg := newOperationAggregator(query)
+	for _, traceID := range s.index.traceIDs(query.Service) {
+		spans, _ := s.traceSpans(traceID)
+		for i := range spans {
+			if spans[i].serviceName == query.Service {
+				agg.add(spans[i].summary())
 			}
 		}
+	}
+	return agg.result(), nil
+}
+
+// TagKeys returns the tag keys of a service's spans from the tag index
+func (s *SpanStore) TagKeys(query models.TagQuery) ([]models.TagCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tags.tagKeys(query.Service, query.Limit), nil
+}
+
+// TagValues returns the values of a tag key from the tag index
+func (s *SpanStore) TagValues(query models.TagQuery) ([]models.TagCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tags.tagValues(query.Key, query.Limit), nil
+}
+
+// QueryTraces searches for traces matching criteria. The trace index
+// narrows the candidates to the query's service, time range and duration
+// bounds, so only those are assembled and filtered. For orders the index
+// doesn't keep, every match is collected and ordered before the page is
+// cut out.
+func (s *SpanStore) QueryTraces(query models.TraceQuery) ([]models.TraceSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
+	var summaries []models.TraceSummary
+	if !s.index.ordered(query.TraceOrder) {
+		s.eachMatch(query, func(summary models.TraceSummary) bool {
+			summaries = append(summaries, summary)
+			return true
+		})
+		return pageTraceSummaries(summaries, query), nil
+	}
+
+	skipped := 0
+	s.eachMatch(query, func(summary models.TraceSummary) bool {
 		// Apply offset/limit
 		if skipped < query.Offset {
 			skipped++
-			continue
+			return true
 		}
+		summaries = append(summaries, summary)
+		return query.Limit <= 0 || len(summaries) < query.Limit
+	})
+	return summaries, nil
+}
 
-		summaries = append(summaries, trace.ToSummary())
+// CountTraces counts the traces matching a query's filters, whatever its
+// cursor, offset and limit
+func (s *SpanStore) CountTraces(query models.TraceQuery) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query.TraceOrder, query.After = models.TraceOrder{}, nil
+	count := 0
+	s.eachMatch(query, func(models.TraceSummary) bool {
 		count++
+		return true
+	})
+	return count, nil
+}
+
+// eachMatch calls fn with the summary of each trace matching a query, in
+// the order of the index scan, until fn returns false. Callers hold s.mu.
+func (s *SpanStore) eachMatch(query models.TraceQuery, fn func(summary models.TraceSummary) bool) {
+	now := time.Now()
 
-		if query.Limit > 0 && count >= query.Limit {
-			break
+	var matches map[models.TraceID]struct{}
+	if tokens := tokenize(query.Text); len(tokens) > 0 {
+		if matches = s.text.lookup(tokens); len(matches) == 0 {
+			return
 		}
 	}
 
-	return summaries, nil
+	// Only the text and Match filters read spans. Other queries are answered
+	// from the index's summaries, so they cost the same however large the
+	// traces are and never decode a compressed one.
+	readSpans := query.Text != "" || query.Match != nil
+
+	s.index.scan(query, func(traceID models.TraceID) bool {
+		if matches != nil {
+			if _, ok := matches[traceID]; !ok {
+				return true
+			}
+		}
+		if !query.WrittenAfter.IsZero() && !s.lastWrite[traceID].After(query.WrittenAfter) {
+			return true
+		}
+
+		// Completeness gate: half-assembled traces have no root span and
+		// a wrong duration
+		var trace *models.Trace
+		if readSpans {
+			spans, _ := s.traceSpans(traceID)
+			if trace = models.BuildTrace(modelSpans(spans)); trace == nil {
+				return true
+			}
+			trace.Partial = !traceComplete(trace, s.lastWrite[traceID], s.assemblyDelay, now)
+		} else {
+			indexed, ok := s.index.summary(traceID)
+			if !ok {
+				return true
+			}
+			trace = indexed.trace()
+			trace.Partial = !indexed.complete(s.lastWrite[traceID], s.assemblyDelay, now)
+		}
+		trace.Truncated = s.truncated[traceID]
+		if !matchTrace(trace, query) {
+			return true
+		}
+		return fn(trace.ToSummary())
+	})
+}
+
+// matchTrace reports whether an assembled trace passes the filters of a
+// query. Backends share it so that queries behave the same everywhere.
+func matchTrace(trace *models.Trace, query models.TraceQuery) bool {
+	if trace.Partial && !query.IncludePartial {
+		return false
+	}
+
+	// Time range filter
+	if !query.StartTime.IsZero() && trace.StartTime.Before(query.StartTime) {
+		return false
+	}
+	if !query.EndTime.IsZero() && trace.EndTime.After(query.EndTime) {
+		return false
+	}
+
+	// Duration filter
+	if query.MinDuration > 0 && trace.Duration < query.MinDuration {
+		return false
+	}
+	if query.MaxDuration > 0 && trace.Duration > query.MaxDuration {
+		return false
+	}
+
+	// Error filter
+	if query.HasError != nil && *query.HasError != trace.HasError {
+		return false
+	}
+
+	// Operation filter (root span)
+	if query.Operation != "" && trace.RootSpan != nil {
+		if trace.RootSpan.OperationName != query.Operation {
+			return false
+		}
+	}
+
+	// Text filter, last as it reads every span
+	if query.Text != "" && !traceHasTokens(trace, tokenize(query.Text)) {
+		return false
+	}
+
+	if query.Match != nil && !query.Match(trace) {
+		return false
+	}
+
+	return true
 }
 
 // cleanupLoop periodically removes old traces
 func (s *SpanStore) cleanupLoop() {
 	ticker := time.NewTicker(5 * time.Minute)
-	for range ticker.C {
-		s.cleanup()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.GC()
+		case <-s.done:
+			return
+		}
 	}
 }
 
-func (s *SpanStore) cleanup() {
+// Close stops the cleanup loop. With a WAL, it takes a final snapshot so the
+// next start has little to replay.
+func (s *SpanStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.wal != nil {
+			if err = s.Snapshot(); err != nil {
+				log.Printf("Span snapshot failed: %v", err)
+			}
+			err = s.wal.Close()
+		}
+	})
+	return err
+}
+
+// GC removes traces older than the TTL
+func (s *SpanStore) GC() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	now := time.Now()
 	cutoff := now.Add(-s.ttl)
 
-	for traceID, spans := range s.spans {
-		if len(spans) > 0 {
-			// Check if the trace is too old
-			// We check the first span's start time (simplification)
-			if spans[0].StartTime.Before(cutoff) {
-				delete(s.spans, traceID)
-			}
+	// Traces expire by their earliest span's start, which a late span may
+	// have moved before that of the spans stored first. The index holds it
+	// for sealed traces too.
+	for traceID, indexed := range s.index.traces {
+		if indexed.entry.StartTime.Before(cutoff) {
+			s.removeTrace(traceID)
 		}
 	}
 }
+
+// Compact removes expired traces and, with a WAL, snapshots the store so
+// the log no longer holds them
+func (s *SpanStore) Compact() error {
+	s.GC()
+	return s.Snapshot()
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// maxInternedStrings caps the strings an intern table holds, so that
+// high-cardinality operation names or tag keys can't grow it without
+// bound. Strings beyond it are stored as they are.
+const maxInternedStrings = 1 << 16
+
+// internTable deduplicates the strings spans repeat, such as service and
+// operation names and tag keys, so that every span holding one shares a
+// single copy instead of the one its batch was decoded into
+type internTable struct {
+	strings map[string]string
+}
+
+func newInternTable() *internTable {
+	return &internTable{strings: make(map[string]string)}
+}
+
+// intern returns the table's copy of str, adding it if there is room. A
+// nil table returns str.
+func (t *internTable) intern(str string) string {
+	if t == nil {
+		return str
+	}
+	if interned, ok := t.strings[str]; ok {
+		return interned
+	}
+	if len(t.strings) >= maxInternedStrings {
+		return str
+	}
+	t.strings[str] = str
+	return str
+}
+
+// spanTag is one tag of a stored span
+type spanTag struct {
+	key   string
+	value string
+}
+
+// storedSpan is how SpanStore holds a span: its repeated strings interned
+// and its tags in a slice sorted by key rather than a map, which costs a
+// map header and buckets per span
+type storedSpan struct {
+	tenantID      string
+	traceID       models.TraceID
+	spanID        models.SpanID
+	parentSpanID  models.SpanID
+	operationName string
+	serviceName   string
+	kind          models.SpanKind
+	status        models.SpanStatus
+	statusMessage string
+	startTime     time.Time
+	endTime       time.Time
+	duration      time.Duration
+	tags          []spanTag
+	logs          []models.SpanLog
+	links         []models.SpanLink
+	errorInfo     *models.ErrorInfo
+}
+
+// newStoredSpan converts a span for storage, interning its strings in strs
+func newStoredSpan(span models.Span, strs *internTable) storedSpan {
+	stored := storedSpan{
+		tenantID:      strs.intern(span.TenantID),
+		traceID:       span.TraceID,
+		spanID:        span.SpanID,
+		parentSpanID:  span.ParentSpanID,
+		operationName: strs.intern(span.OperationName),
+		serviceName:   strs.intern(span.ServiceName),
+		kind:          models.SpanKind(strs.intern(string(span.Kind))),
+		status:        models.SpanStatus(strs.intern(string(span.Status))),
+		statusMessage: span.StatusMessage,
+		startTime:     span.StartTime,
+		endTime:       span.EndTime,
+		duration:      span.Duration,
+		logs:          span.Logs,
+		links:         span.Links,
+		errorInfo:     span.ErrorInfo,
+	}
+	if len(span.Tags) > 0 {
+		stored.tags = make([]spanTag, 0, len(span.Tags))
+		for key, value := range span.Tags {
+			stored.tags = append(stored.tags, spanTag{strs.intern(key), value})
+		}
+		sort.Slice(stored.tags, func(i, j int) bool { return stored.tags[i].key < stored.tags[j].key })
+	}
+	return stored
+}
+
+// span returns the stored span as a models.Span
+func (s *storedSpan) span() models.Span {
+	span := s.summary()
+	span.StatusMessage = s.statusMessage
+	span.Logs = s.logs
+	span.Links = s.links
+	span.ErrorInfo = s.errorInfo
+	if len(s.tags) > 0 {
+		span.Tags = make(map[string]string, len(s.tags))
+		for _, tag := range s.tags {
+			span.Tags[tag.key] = tag.value
+		}
+	}
+	return span
+}
+
+// summary returns the stored span without its tags, logs and messages,
+// for aggregations that don't read them and shouldn't pay for a tag map
+func (s *storedSpan) summary() models.Span {
+	return models.Span{
+		TenantID:      s.tenantID,
+		TraceID:       s.traceID,
+		SpanID:        s.spanID,
+		ParentSpanID:  s.parentSpanID,
+		OperationName: s.operationName,
+		ServiceName:   s.serviceName,
+		Kind:          s.kind,
+		StartTime:     s.startTime,
+		EndTime:       s.endTime,
+		Duration:      s.duration,
+		Status:        s.status,
+	}
+}
+
+// MarshalJSON encodes the span as a models.Span, so that WAL snapshots
+// keep their format
+func (s storedSpan) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.span())
+}
+
+// modelSpans converts stored spans into a new slice of models.Span
+func modelSpans(stored []storedSpan) []models.Span {
+	spans := make([]models.Span, len(stored))
+	for i := range stored {
+		spans[i] = stored[i].span()
+	}
+	return spans
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Tag index limits: distinct keys per service and values per key, beyond
+// which new ones aren't indexed, and the longest value indexed, as longer
+// values are payloads rather than something to complete
+const (
+	maxIndexedTagKeys        = 1000
+	maxIndexedTagValues      = 1000
+	maxIndexedTagValueLength = 256
+)
+
+// tagRef is a tag key of a service, or a value of a tag key
+type tagRef struct {
+	service string
+	key     string
+	value   string
+	isValue bool
+}
+
+// tagIndex counts the traces carrying each tag key, per service and over
+// all services (""), and each value of a key, for autocompletion. Like
+// textIndex, it only grows as spans are replaced.
+type tagIndex struct {
+	keys   map[string]map[string]int // Service -> key -> traces
+	values map[string]map[string]int // Key -> value -> traces
+	traces map[models.TraceID]map[tagRef]struct{}
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys:   make(map[string]map[string]int),
+		values: make(map[string]map[string]int),
+		traces: make(map[models.TraceID]map[tagRef]struct{}),
+	}
+}
+
+// add indexes the tags of a span
+func (x *tagIndex) add(span *storedSpan) {
+	for _, tag := range span.tags {
+		x.addRef(span.traceID, tagRef{service: span.serviceName, key: tag.key})
+		x.addRef(span.traceID, tagRef{key: tag.key})
+		if tag.value != "" && len(tag.value) <= maxIndexedTagValueLength {
+			x.addRef(span.traceID, tagRef{key: tag.key, value: tag.value, isValue: true})
+		}
+	}
+}
+
+func (x *tagIndex) addRef(traceID models.TraceID, ref tagRef) {
+	refs := x.traces[traceID]
+	if _, ok := refs[ref]; ok {
+		return
+	}
+
+	counts, name, limit := x.keys[ref.service], ref.key, maxIndexedTagKeys
+	if ref.isValue {
+		counts, name, limit = x.values[ref.key], ref.value, maxIndexedTagValues
+	}
+	if _, ok := counts[name]; !ok && len(counts) >= limit {
+		return
+	}
+	if counts == nil {
+		counts = make(map[string]int)
+		if ref.isValue {
+			x.values[ref.key] = counts
+		} else {
+			x.keys[ref.service] = counts
+		}
+	}
+	counts[name]++
+
+	if refs == nil {
+		refs = make(map[tagRef]struct{})
+		x.traces[traceID] = refs
+	}
+	refs[ref] = struct{}{}
+}
+
+// remove drops a trace from the index
+func (x *tagIndex) remove(traceID models.TraceID) {
+	for ref := range x.traces[traceID] {
+		parent, counts, name := x.keys, x.keys[ref.service], ref.key
+		group := ref.service
+		if ref.isValue {
+			parent, counts, name, group = x.values, x.values[ref.key], ref.value, ref.key
+		}
+		if counts[name]--; counts[name] <= 0 {
+			delete(counts, name)
+			if len(counts) == 0 {
+				delete(parent, group)
+			}
+		}
+	}
+	delete(x.traces, traceID)
+}
+
+// tagKeys returns the tag keys of a service's spans, or of all spans, by
+// descending trace count
+func (x *tagIndex) tagKeys(service string, limit int) []models.TagCount {
+	return topTagCounts(x.keys[service], limit)
+}
+
+// tagValues returns the values of a tag key by descending trace count
+func (x *tagIndex) tagValues(key string, limit int) []models.TagCount {
+	return topTagCounts(x.values[key], limit)
+}
+
+// topTagCounts returns the most frequent names of counts, ties in name
+// order, up to limit (0 = all)
+func topTagCounts(counts map[string]int, limit int) []models.TagCount {
+	result := make([]models.TagCount, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, models.TagCount{Name: name, Count: count})
+	}
+	sortTagCounts(result)
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+func sortTagCounts(counts []models.TagCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+}
@@ -0,0 +1,503 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// TenantConfig holds the storage backend, limits and retention of a tenant
+type TenantConfig struct {
+	// Backend names the registered storage backend (default "memory")
+	Backend string
+	// DataDir is the root directory of persistent backends; each tenant
+	// gets a subdirectory
+	DataDir  string
+	MaxSpans int
+	// MaxSpansPerTrace caps the spans stored per trace (0 = no limit)
+	MaxSpansPerTrace int
+	SpanTTL          time.Duration
+	// AssemblyDelay is how long a trace must go without new spans before
+	// queries treat it as complete
+	AssemblyDelay time.Duration
+	MaxMetrics    int
+	MetricTTL     time.Duration
+	// SeriesLimits caps the metric series per metric name and service
+	SeriesLimits SeriesLimits
+	MaxErrors    int
+	ErrorTTL     time.Duration
+	// WAL makes the memory backend log writes under DataDir and snapshot
+	// every SnapshotInterval
+	WAL              bool
+	SnapshotInterval time.Duration
+	// SpanCompression compresses the memory backend's quiet traces
+	SpanCompression SpanCompression
+	// MaxPinnedTraces and MaxPinnedSpans cap the traces pinned beyond
+	// their TTL
+	MaxPinnedTraces int
+	MaxPinnedSpans  int
+	// MaxDeployments caps the deployment markers kept
+	MaxDeployments int
+	// MaxAnnotations caps the trace annotations kept
+	MaxAnnotations int
+}
+
+// tenantDir returns the directory of a tenant's data under dataDir. Only
+// valid tenant IDs are persisted, and those are a single path element.
+func tenantDir(dataDir, tenant string) string {
+	return filepath.Join(dataDir, tenant)
+}
+
+// persistent reports whether the tenant's data lives under DataDir
+func (c TenantConfig) persistent() bool {
+	return c.DataDir != "" && (c.WAL || c.Backend == BadgerBackend)
+}
+
+// tenantStores holds one tenant's isolated stores
+type tenantStores struct {
+	spans    SpanBackend
+	metrics  MetricBackend
+	errors   *ErrorStore
+	graph    *ServiceGraphStore
+	pins     *PinStore
+	deploys  *DeploymentStore
+	registry *ServiceRegistry
+	notes    *AnnotationStore
+	searches *SearchStore
+}
+
+// TenantStores partitions storage by tenant. Each tenant gets its own span
+// and metric backends, ErrorStore, ServiceGraphStore, PinStore and
+// DeploymentStore, created by Open with the tenant's configured backend,
+// limits and TTLs. Tenants that weren't opened read as empty, so queries
+// naming arbitrary tenants don't create stores for them.
+type TenantStores struct {
+	defaults  TenantConfig
+	overrides map[string]TenantConfig
+	tenants   map[string]*tenantStores
+	// empty is what tenants that weren't opened read. Nothing writes to
+	// it: writers Open their tenant first.
+	empty  *tenantStores
+	closed bool
+	mu     sync.RWMutex
+}
+
+// NewTenantStores creates a tenant-partitioned store. overrides replace the
+// defaults for specific tenants. It fails if a configured backend isn't
+// registered.
+func NewTenantStores(defaults TenantConfig, overrides map[string]TenantConfig) (*TenantStores, error) {
+	if overrides == nil {
+		overrides = make(map[string]TenantConfig)
+	}
+	for _, cfg := range append([]TenantConfig{defaults}, mapValues(overrides)...) {
+		if _, err := spanBackendFactory(cfg.Backend); err != nil {
+			return nil, err
+		}
+	}
+	t := &TenantStores{
+		defaults:  defaults,
+		overrides: overrides,
+		tenants:   make(map[string]*tenantStores),
+	}
+	empty := defaults
+	empty.Backend, empty.WAL, empty.DataDir = MemoryBackend, false, ""
+	t.empty = t.newStores("", empty)
+	t.openPersisted()
+	return t, nil
+}
+
+// openPersisted opens the stores of every tenant with data on disk, so it
+// is restored at startup rather than on the tenant's first request
+func (t *TenantStores) openPersisted() {
+	if !t.defaults.persistent() {
+		return
+	}
+	entries, err := os.ReadDir(t.defaults.DataDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if !models.ValidTenant(e.Name()) {
+			continue
+		}
+		t.Open(e.Name())
+	}
+}
+
+func mapValues(m map[string]TenantConfig) []TenantConfig {
+	values := make([]TenantConfig, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// Spans returns the span backend of a tenant
+func (t *TenantStores) Spans(tenant string) SpanBackend {
+	return t.get(tenant).spans
+}
+
+// Metrics returns the metric backend of a tenant
+func (t *TenantStores) Metrics(tenant string) MetricBackend {
+	return t.get(tenant).metrics
+}
+
+// Errors returns the error store of a tenant
+func (t *TenantStores) Errors(tenant string) *ErrorStore {
+	return t.get(tenant).errors
+}
+
+// ServiceGraph returns the service graph store of a tenant
+func (t *TenantStores) ServiceGraph(tenant string) *ServiceGraphStore {
+	return t.get(tenant).graph
+}
+
+// Pins returns the pinned traces of a tenant
+func (t *TenantStores) Pins(tenant string) *PinStore {
+	return t.get(tenant).pins
+}
+
+// Deployments returns the deployment markers of a tenant
+func (t *TenantStores) Deployments(tenant string) *DeploymentStore {
+	return t.get(tenant).deploys
+}
+
+// Annotations returns the trace annotations of a tenant
+func (t *TenantStores) Annotations(tenant string) *AnnotationStore {
+	return t.get(tenant).notes
+}
+
+// Searches returns the saved searches and short links of a tenant
+func (t *TenantStores) Searches(tenant string) *SearchStore {
+	return t.get(tenant).searches
+}
+
+// ServiceRegistry returns the service metadata registry of a tenant
+func (t *TenantStores) ServiceRegistry(tenant string) *ServiceRegistry {
+	return t.get(tenant).registry
+}
+
+// Tenants returns the IDs of all tenants that have stored data
+func (t *TenantStores) Tenants() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tenants := make([]string, 0, len(t.tenants))
+	for tenant := range t.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// TenantStats reports the size of a tenant's stores
+type TenantStats struct {
+	Spans        SpanStoreStats   `json:"spans"`
+	Metrics      MetricStoreStats `json:"metrics"`
+	PinnedTraces int              `json:"pinned_traces"`
+}
+
+// Stats reports the size of each tenant's stores
+func (t *TenantStores) Stats() map[string]TenantStats {
+	stats := make(map[string]TenantStats)
+	for _, tenant := range t.Tenants() {
+		stores := t.get(tenant)
+		stats[tenant] = TenantStats{
+			Spans:        stores.spans.Stats(),
+			Metrics:      stores.metrics.Stats(),
+			PinnedTraces: len(stores.pins.List()),
+		}
+	}
+	return stats
+}
+
+// ServiceDeletion reports what purging a service removed
+type ServiceDeletion struct {
+	Spans       int `json:"spans"`
+	Series      int `json:"series"`
+	ErrorEvents int `json:"error_events"`
+}
+
+// DeleteService removes a tenant's spans, metric series and errors of a
+// service. Pinned traces are kept.
+func (t *TenantStores) DeleteService(tenant, service string) (ServiceDeletion, error) {
+	stores := t.get(tenant)
+	var deleted ServiceDeletion
+	var err error
+	if deleted.Spans, err = stores.spans.DeleteService(service); err != nil {
+		return deleted, fmt.Errorf("delete spans: %w", err)
+	}
+	if deleted.Series, err = stores.metrics.DeleteService(service); err != nil {
+		return deleted, fmt.Errorf("delete metrics: %w", err)
+	}
+	deleted.ErrorEvents = stores.errors.DeleteService(service)
+	return deleted, nil
+}
+
+// Compact removes expired data from every tenant's stores and reclaims the
+// space it used
+func (t *TenantStores) Compact() error {
+	for _, tenant := range t.Tenants() {
+		if err := t.CompactTenant(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactTenant removes expired data from one tenant's stores and reclaims
+// the space it used
+func (t *TenantStores) CompactTenant(tenant string) error {
+	stores := t.get(tenant)
+	if err := stores.spans.Compact(); err != nil {
+		return fmt.Errorf("compact spans of tenant %s: %w", tenant, err)
+	}
+	if err := stores.metrics.Compact(); err != nil {
+		return fmt.Errorf("compact metrics of tenant %s: %w", tenant, err)
+	}
+	stores.errors.Cleanup()
+	return nil
+}
+
+// Config returns the effective configuration of a tenant
+func (t *TenantStores) Config(tenant string) TenantConfig {
+	if cfg, ok := t.overrides[tenant]; ok {
+		return cfg
+	}
+	return t.defaults
+}
+
+// Open creates a tenant's stores unless they exist. Ingestion opens the
+// tenants it writes to; readers of a tenant that wasn't opened get empty
+// results instead.
+func (t *TenantStores) Open(tenant string) {
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+
+	t.mu.RLock()
+	_, ok := t.tenants[tenant]
+	t.mu.RUnlock()
+	if ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.tenants[tenant]; ok {
+		return
+	}
+	cfg := t.Config(tenant)
+	if !models.ValidTenant(tenant) {
+		// Requests with such IDs are rejected, so this is a bug, but it
+		// mustn't write outside the data directory
+		log.Printf("Invalid tenant ID %q, keeping its data in memory", tenant)
+		cfg.Backend, cfg.WAL, cfg.DataDir = MemoryBackend, false, ""
+	}
+	t.tenants[tenant] = t.newStores(tenant, cfg)
+}
+
+// Exists reports whether a tenant's stores were opened
+func (t *TenantStores) Exists(tenant string) bool {
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.tenants[tenant]
+	return ok
+}
+
+// get returns a tenant's stores, or the empty stores if it wasn't opened.
+// A remote span backend holds nothing here, so a tenant that wasn't opened
+// still reads its spans through it.
+func (t *TenantStores) get(tenant string) *tenantStores {
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+
+	t.mu.RLock()
+	stores, ok := t.tenants[tenant]
+	t.mu.RUnlock()
+	if ok {
+		return stores
+	}
+
+	cfg := t.Config(tenant)
+	if !remoteSpanBackend(cfg.Backend) {
+		return t.empty
+	}
+	factory, err := spanBackendFactory(cfg.Backend)
+	if err != nil {
+		return t.empty
+	}
+	spans, err := factory(tenant, cfg)
+	if err != nil {
+		return t.empty
+	}
+	remote := *t.empty
+	remote.spans = spans
+	return &remote
+}
+
+// newStores creates the stores of a tenant
+func (t *TenantStores) newStores(tenant string, cfg TenantConfig) *tenantStores {
+	return &tenantStores{
+		spans:    t.newSpanBackend(tenant, cfg),
+		metrics:  t.newMetricBackend(tenant, cfg),
+		errors:   NewErrorStore(cfg.MaxErrors, cfg.ErrorTTL),
+		graph:    NewServiceGraphStore(cfg.SpanTTL),
+		pins:     t.newPinStore(tenant, cfg),
+		deploys:  t.newDeploymentStore(tenant, cfg),
+		registry: t.newServiceRegistry(tenant, cfg),
+		notes:    t.newAnnotationStore(tenant, cfg),
+		searches: t.newSearchStore(tenant, cfg),
+	}
+}
+
+// newSpanBackend creates a tenant's span backend, falling back to memory
+// when the configured backend fails to open so ingestion keeps working
+func (t *TenantStores) newSpanBackend(tenant string, cfg TenantConfig) SpanBackend {
+	factory, err := spanBackendFactory(cfg.Backend)
+	if err == nil {
+		var backend SpanBackend
+		if backend, err = factory(tenant, cfg); err == nil {
+			return backend
+		}
+	}
+	log.Printf("Span backend %q for tenant %s failed, using memory without a WAL: %v", cfg.Backend, tenant, err)
+	return NewSpanStore(cfg.MaxSpans, cfg.SpanTTL, WithAssemblyDelay(cfg.AssemblyDelay), WithMaxSpansPerTrace(cfg.MaxSpansPerTrace))
+}
+
+// newMetricBackend creates a tenant's metric backend, falling back to
+// memory when the configured backend fails to open
+func (t *TenantStores) newMetricBackend(tenant string, cfg TenantConfig) MetricBackend {
+	factory, err := metricBackendFactory(cfg.Backend)
+	if err == nil {
+		var backend MetricBackend
+		if backend, err = factory(tenant, cfg); err == nil {
+			return backend
+		}
+	}
+	log.Printf("Metric backend %q for tenant %s failed, using memory without a WAL: %v", cfg.Backend, tenant, err)
+	return NewMetricStore(cfg.MaxMetrics, cfg.MetricTTL, WithSeriesLimits(cfg.SeriesLimits))
+}
+
+// newPinStore creates a tenant's pin store, saved under the data directory
+// when the tenant's storage is persistent. Pins that fail to load are
+// logged and the tenant starts without them.
+func (t *TenantStores) newPinStore(tenant string, cfg TenantConfig) *PinStore {
+	path := ""
+	if cfg.persistent() {
+		path = filepath.Join(tenantDir(cfg.DataDir, tenant), "pins.json")
+	}
+	pins, err := NewPinStore(cfg.MaxPinnedTraces, cfg.MaxPinnedSpans, path)
+	if err != nil {
+		log.Printf("Pinned traces of tenant %s failed to load: %v", tenant, err)
+		pins, _ = NewPinStore(cfg.MaxPinnedTraces, cfg.MaxPinnedSpans, "")
+	}
+	return pins
+}
+
+// newDeploymentStore creates a tenant's deployment store, saved under the
+// data directory like pins
+func (t *TenantStores) newDeploymentStore(tenant string, cfg TenantConfig) *DeploymentStore {
+	path := ""
+	if cfg.persistent() {
+		path = filepath.Join(tenantDir(cfg.DataDir, tenant), "deployments.json")
+	}
+	deploys, err := NewDeploymentStore(cfg.MaxDeployments, path)
+	if err != nil {
+		log.Printf("Deployments of tenant %s failed to load: %v", tenant, err)
+		deploys, _ = NewDeploymentStore(cfg.MaxDeployments, "")
+	}
+	return deploys
+}
+
+// newAnnotationStore creates a tenant's annotation store, saved under the
+// data directory like pins
+func (t *TenantStores) newAnnotationStore(tenant string, cfg TenantConfig) *AnnotationStore {
+	path := ""
+	if cfg.persistent() {
+		path = filepath.Join(tenantDir(cfg.DataDir, tenant), "annotations.json")
+	}
+	notes, err := NewAnnotationStore(cfg.MaxAnnotations, path)
+	if err != nil {
+		log.Printf("Annotations of tenant %s failed to load: %v", tenant, err)
+		notes, _ = NewAnnotationStore(cfg.MaxAnnotations, "")
+	}
+	return notes
+}
+
+// newSearchStore creates a tenant's search store, saved under the data
+// directory like pins
+func (t *TenantStores) newSearchStore(tenant string, cfg TenantConfig) *SearchStore {
+	path := ""
+	if cfg.persistent() {
+		path = filepath.Join(tenantDir(cfg.DataDir, tenant), "searches.json")
+	}
+	searches, err := NewSearchStore(path)
+	if err != nil {
+		log.Printf("Saved searches of tenant %s failed to load: %v", tenant, err)
+		searches, _ = NewSearchStore("")
+	}
+	return searches
+}
+
+// newServiceRegistry creates a tenant's service registry, saved under the
+// data directory like pins
+func (t *TenantStores) newServiceRegistry(tenant string, cfg TenantConfig) *ServiceRegistry {
+	path := ""
+	if cfg.persistent() {
+		path = filepath.Join(tenantDir(cfg.DataDir, tenant), "services.json")
+	}
+	registry, err := NewServiceRegistry(path)
+	if err != nil {
+		log.Printf("Service registry of tenant %s failed to load: %v", tenant, err)
+		registry, _ = NewServiceRegistry("")
+	}
+	return registry
+}
+
+// Ready returns an error once the stores are closed
+func (t *TenantStores) Ready() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return fmt.Errorf("storage is closed")
+	}
+	return nil
+}
+
+// Close closes the backends of every tenant
+func (t *TenantStores) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	var firstErr error
+	all := maps.Clone(t.tenants)
+	all["(empty)"] = t.empty
+	for tenant, stores := range all {
+		for _, closer := range []interface{ Close() error }{stores.spans, stores.metrics, stores.errors} {
+			if err := closer.Close(); err != nil {
+				log.Printf("Failed to close storage of tenant %s: %v", tenant, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
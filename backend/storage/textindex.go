@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// maxTokenLength truncates long tokens such as encoded blobs so they don't
+// bloat the index
+const maxTokenLength = 64
+
+// tokenize splits text into lowercase tokens of letters and digits
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, field := range fields {
+		if len(field) > maxTokenLength {
+			fields[i] = field[:maxTokenLength]
+		}
+	}
+	return fields
+}
+
+// spanText calls fn with each searchable text of a span: tag values, log
+// field values, and status and error messages
+func spanText(span models.Span, fn func(text string)) {
+	for _, value := range span.Tags {
+		fn(value)
+	}
+	for _, l := range span.Logs {
+		for _, value := range l.Fields {
+			fn(value)
+		}
+	}
+	if span.StatusMessage != "" {
+		fn(span.StatusMessage)
+	}
+	if span.ErrorInfo != nil {
+		fn(span.ErrorInfo.Message)
+	}
+}
+
+// traceHasTokens reports whether the spans of a trace contain every token
+func traceHasTokens(trace *models.Trace, tokens []string) bool {
+	missing := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		missing[token] = true
+	}
+	for _, span := range trace.Spans {
+		spanText(span, func(text string) {
+			for _, token := range tokenize(text) {
+				delete(missing, token)
+			}
+		})
+		if len(missing) == 0 {
+			return true
+		}
+	}
+	return len(missing) == 0
+}
+
+// textIndex is an inverted index from span text tokens to trace IDs. It
+// only grows as spans are replaced, so matches are checked against the
+// trace itself.
+type textIndex struct {
+	postings map[string]map[models.TraceID]struct{} // Token -> TraceIDs
+	traces   map[models.TraceID]map[string]struct{} // TraceID -> Tokens
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{
+		postings: make(map[string]map[models.TraceID]struct{}),
+		traces:   make(map[models.TraceID]map[string]struct{}),
+	}
+}
+
+// add indexes the text of a span
+func (x *textIndex) add(span models.Span) {
+	spanText(span, func(text string) {
+		for _, token := range tokenize(text) {
+			tokens := x.traces[span.TraceID]
+			if tokens == nil {
+				tokens = make(map[string]struct{})
+				x.traces[span.TraceID] = tokens
+			}
+			if _, ok := tokens[token]; ok {
+				continue
+			}
+			tokens[token] = struct{}{}
+
+			traceIDs := x.postings[token]
+			if traceIDs == nil {
+				traceIDs = make(map[models.TraceID]struct{})
+				x.postings[token] = traceIDs
+			}
+			traceIDs[span.TraceID] = struct{}{}
+		}
+	})
+}
+
+// remove drops a trace from the index
+func (x *textIndex) remove(traceID models.TraceID) {
+	for token := range x.traces[traceID] {
+		delete(x.postings[token], traceID)
+		if len(x.postings[token]) == 0 {
+			delete(x.postings, token)
+		}
+	}
+	delete(x.traces, traceID)
+}
+
+// lookup returns the IDs of traces containing every token
+func (x *textIndex) lookup(tokens []string) map[models.TraceID]struct{} {
+	// Intersect starting from the rarest token
+	var smallest map[models.TraceID]struct{}
+	for _, token := range tokens {
+		traceIDs := x.postings[token]
+		if len(traceIDs) == 0 {
+			return nil
+		}
+		if smallest == nil || len(traceIDs) < len(smallest) {
+			smallest = traceIDs
+		}
+	}
+
+	result := make(map[models.TraceID]struct{}, len(smallest))
+	for traceID := range smallest {
+		matched := true
+		for _, token := range tokens {
+			if _, ok := x.postings[token][traceID]; !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result[traceID] = struct{}{}
+		}
+	}
+	return result
+}
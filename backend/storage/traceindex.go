@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// traceIndexBucketWidth is the start time range covered by one index bucket
+const traceIndexBucketWidth = time.Minute
+
+// durationOrder is the order of the entries of a bucket
+var durationOrder = models.TraceOrder{SortBy: models.TraceSortDuration}
+
+// durationBucket holds the traces that started within one bucket, in
+// duration order
+type durationBucket []models.TraceCursor
+
+// search returns the position of the first entry not slower than d
+func (b durationBucket) search(d time.Duration) int {
+	return sort.Search(len(b), func(i int) bool { return b[i].Duration <= d })
+}
+
+// position returns where entry is or belongs in the bucket
+func (b durationBucket) position(entry models.TraceCursor) int {
+	return sort.Search(len(b), func(i int) bool { return !b[i].Before(entry, durationOrder) })
+}
+
+// indexedTrace is what the index last recorded for a trace: its position
+// in the buckets and the summary queries filter and return without reading
+// the trace's spans
+type indexedTrace struct {
+	entry         models.TraceCursor
+	services      []string
+	spans         int
+	errors        int
+	hasRoot       bool
+	rootOperation string
+	rootService   string
+	linked        bool // Every parent span is in the trace
+}
+
+// trace returns the span-less trace the summary describes, for matchTrace
+// and ToSummary
+func (t indexedTrace) trace() *models.Trace {
+	trace := &models.Trace{
+		TraceID:    t.entry.TraceID,
+		Services:   t.services,
+		StartTime:  t.entry.StartTime,
+		EndTime:    t.entry.StartTime.Add(t.entry.Duration),
+		Duration:   t.entry.Duration,
+		SpanCount:  t.spans,
+		HasError:   t.errors > 0,
+		ErrorCount: t.errors,
+	}
+	if t.hasRoot {
+		trace.RootSpan = &models.Span{OperationName: t.rootOperation, ServiceName: t.rootService}
+	}
+	return trace
+}
+
+// complete is traceComplete for the summarized trace
+func (t indexedTrace) complete(lastWrite time.Time, assemblyDelay time.Duration, now time.Time) bool {
+	return t.hasRoot && t.linked && now.Sub(lastWrite) >= assemblyDelay
+}
+
+// traceIndex indexes traces per service by start time bucket, with each
+// bucket sorted by trace duration, so that queries visit only the buckets
+// in their time range and duration-ordered queries read the slowest traces
+// first instead of assembling every stored trace. The "" service indexes
+// all traces.
+type traceIndex struct {
+	services map[string]map[int64]durationBucket
+	traces   map[models.TraceID]indexedTrace
+}
+
+func newTraceIndex() *traceIndex {
+	return &traceIndex{
+		services: make(map[string]map[int64]durationBucket),
+		traces:   make(map[models.TraceID]indexedTrace),
+	}
+}
+
+func traceIndexBucket(t time.Time) int64 {
+	return t.UnixNano() / int64(traceIndexBucketWidth)
+}
+
+// update re-indexes a trace from its spans, timed the way BuildTrace does
+func (x *traceIndex) update(traceID models.TraceID, spans []storedSpan) {
+	if len(spans) == 0 {
+		x.remove(traceID)
+		return
+	}
+
+	start, end := spans[0].startTime, spans[0].endTime
+	serviceSet := make(map[string]bool)
+	spanIDs := make(map[models.SpanID]bool, len(spans))
+	next := indexedTrace{spans: len(spans), linked: true}
+	var root *storedSpan
+	for i := range spans {
+		span := &spans[i]
+		if span.startTime.Before(start) {
+			start = span.startTime
+		}
+		if span.endTime.After(end) {
+			end = span.endTime
+		}
+		serviceSet[span.serviceName] = true
+		spanIDs[span.spanID] = true
+		if span.status == models.SpanStatusError {
+			next.errors++
+		}
+		// BuildTrace takes the last root in start order
+		if span.parentSpanID.IsZero() && (root == nil || !span.startTime.Before(root.startTime)) {
+			root = span
+		}
+	}
+	for i := range spans {
+		if !spans[i].parentSpanID.IsZero() && !spanIDs[spans[i].parentSpanID] {
+			next.linked = false
+			break
+		}
+	}
+	if root != nil {
+		next.hasRoot, next.rootOperation, next.rootService = true, root.operationName, root.serviceName
+	}
+	services := make([]string, 0, len(serviceSet))
+	for service := range serviceSet {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	next.entry = models.TraceCursor{StartTime: start, Duration: end.Sub(start), TraceID: traceID}
+	next.services = services
+
+	if prev, ok := x.traces[traceID]; ok {
+		if prev.entry == next.entry && equalStrings(prev.services, next.services) {
+			// Still filed in the same buckets
+			x.traces[traceID] = next
+			return
+		}
+		x.remove(traceID)
+	}
+
+	x.traces[traceID] = next
+	bucket := traceIndexBucket(start)
+	for _, service := range append([]string{""}, services...) {
+		buckets := x.services[service]
+		if buckets == nil {
+			buckets = make(map[int64]durationBucket)
+			x.services[service] = buckets
+		}
+		b := buckets[bucket]
+		i := b.position(next.entry)
+		b = append(b, models.TraceCursor{})
+		copy(b[i+1:], b[i:])
+		b[i] = next.entry
+		buckets[bucket] = b
+	}
+}
+
+// summary returns what the index recorded for a trace
+func (x *traceIndex) summary(traceID models.TraceID) (indexedTrace, bool) {
+	t, ok := x.traces[traceID]
+	return t, ok
+}
+
+// remove drops a trace from the index
+func (x *traceIndex) remove(traceID models.TraceID) {
+	prev, ok := x.traces[traceID]
+	if !ok {
+		return
+	}
+	delete(x.traces, traceID)
+
+	bucket := traceIndexBucket(prev.entry.StartTime)
+	for _, service := range append([]string{""}, prev.services...) {
+		buckets := x.services[service]
+		b := buckets[bucket]
+		if i := b.position(prev.entry); i < len(b) && b[i].TraceID == traceID {
+			b = append(b[:i], b[i+1:]...)
+		}
+		if len(b) == 0 {
+			delete(buckets, bucket)
+			if len(buckets) == 0 {
+				delete(x.services, service)
+			}
+		} else {
+			buckets[bucket] = b
+		}
+	}
+}
+
+// serviceNames returns the sorted names of the services with indexed
+// traces
+func (x *traceIndex) serviceNames() []string {
+	names := make([]string, 0, len(x.services))
+	for service := range x.services {
+		if service != "" {
+			names = append(names, service)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// traceIDs returns the IDs of a service's traces, oldest bucket first
+func (x *traceIndex) traceIDs(service string) []models.TraceID {
+	buckets := x.services[service]
+	keys := make([]int64, 0, len(buckets))
+	count := 0
+	for key, b := range buckets {
+		keys = append(keys, key)
+		count += len(b)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	traceIDs := make([]models.TraceID, 0, count)
+	for _, key := range keys {
+		for _, entry := range buckets[key] {
+			traceIDs = append(traceIDs, entry.TraceID)
+		}
+	}
+	return traceIDs
+}
+
+// ordered reports whether scan visits traces in the given result order,
+// which it does for start time orders and slowest first
+func (x *traceIndex) ordered(order models.TraceOrder) bool {
+	switch order.SortBy {
+	case models.TraceSortDuration:
+		return !order.Ascending
+	case models.TraceSortSpanCount, models.TraceSortErrorCount:
+		return false
+	}
+	return true
+}
+
+// scan calls fn with the IDs of the traces that may match the service,
+// time range and duration bounds of a query, in the query's result order
+// and after its cursor, until fn returns false. Callers still check each
+// trace against the query. For orders the index doesn't keep, every
+// candidate is visited newest first and callers order and page them.
+func (x *traceIndex) scan(query models.TraceQuery, fn func(traceID models.TraceID) bool) {
+	if !x.ordered(query.TraceOrder) {
+		query.TraceOrder, query.After = models.TraceOrder{}, nil
+	}
+	buckets := x.services[query.Service]
+	after := query.After
+	byDuration := query.SortBy == models.TraceSortDuration
+
+	var keys []int64
+	for key := range buckets {
+		if !query.StartTime.IsZero() && key < traceIndexBucket(query.StartTime) {
+			continue
+		}
+		// A trace ending by EndTime also started by it
+		if !query.EndTime.IsZero() && key > traceIndexBucket(query.EndTime) {
+			continue
+		}
+		// By start time, every trace in a bucket on the near side of the
+		// cursor's precedes it
+		if after != nil && !byDuration {
+			if afterKey := traceIndexBucket(after.StartTime); key > afterKey && !query.Ascending || key < afterKey && query.Ascending {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] > keys[j] != query.Ascending })
+
+	// Each bucket's entries between the duration bounds
+	cursors := make(cursorHeap, 0, len(keys))
+	for _, key := range keys {
+		b := buckets[key]
+		if query.MinDuration > 0 {
+			b = b[:b.search(query.MinDuration-1)]
+		}
+		c := &bucketCursor{bucket: b}
+		if query.MaxDuration > 0 {
+			c.pos = b.search(query.MaxDuration)
+		}
+		if after != nil && byDuration {
+			i := b.position(*after)
+			if i < len(b) && b[i].TraceID == after.TraceID {
+				i++
+			}
+			c.pos = max(c.pos, i)
+		}
+		if c.pos < len(c.bucket) {
+			cursors = append(cursors, c)
+		}
+	}
+
+	if !byDuration {
+		// Buckets are disjoint in time, so sort each and walk them in turn
+		for _, c := range cursors {
+			entries := append(durationBucket(nil), c.bucket[c.pos:]...)
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Before(entries[j], query.TraceOrder) })
+			for _, entry := range entries {
+				if after != nil && !after.Before(entry, query.TraceOrder) {
+					continue
+				}
+				if !fn(entry.TraceID) {
+					return
+				}
+			}
+		}
+		return
+	}
+
+	// Merge the buckets in duration order
+	heap.Init(&cursors)
+	for cursors.Len() > 0 {
+		c := cursors[0]
+		if !fn(c.bucket[c.pos].TraceID) {
+			return
+		}
+		c.pos++
+		if c.pos < len(c.bucket) {
+			heap.Fix(&cursors, 0)
+		} else {
+			heap.Pop(&cursors)
+		}
+	}
+}
+
+// bucketCursor is a read position in a duration bucket
+type bucketCursor struct {
+	bucket durationBucket
+	pos    int
+}
+
+// cursorHeap orders cursors by the entry at their position, in duration
+// order
+type cursorHeap []*bucketCursor
+
+func (h cursorHeap) Len() int { return len(h) }
+func (h cursorHeap) Less(i, j int) bool {
+	return h[i].bucket[h[i].pos].Before(h[j].bucket[h[j].pos], durationOrder)
+}
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(*bucketCursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pageTraceSummaries orders all of a query's results and cuts out the
+// requested page, for backends without a trace index
+func pageTraceSummaries(summaries []models.TraceSummary, query models.TraceQuery) []models.TraceSummary {
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Cursor().Before(summaries[j].Cursor(), query.TraceOrder)
+	})
+	if query.After != nil {
+		after := *query.After
+		summaries = summaries[sort.Search(len(summaries), func(i int) bool {
+			return after.Before(summaries[i].Cursor(), query.TraceOrder)
+		}):]
+	}
+	if query.Offset >= len(summaries) {
+		return nil
+	}
+	summaries = summaries[query.Offset:]
+	if query.Limit > 0 && len(summaries) > query.Limit {
+		summaries = summaries[:query.Limit]
+	}
+	return summaries
+}
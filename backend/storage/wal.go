@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAL file naming: segments and snapshots carry the sequence number of the
+// first segment not included in them
+const (
+	walSegmentPrefix  = "wal-"
+	walSegmentSuffix  = ".log"
+	walSnapshotPrefix = "snapshot-"
+	walSnapshotSuffix = ".json.gz"
+	// walProgressEvery is how many replayed records between progress logs
+	walProgressEvery = 100000
+)
+
+// WAL is a write-ahead log of JSON records with snapshot-based compaction.
+// Records are appended to numbered segment files. A snapshot written for
+// sequence n holds the state of all segments before n, which are then
+// deleted, so the log never grows beyond one snapshot interval.
+type WAL struct {
+	dir  string
+	name string // used in log messages
+
+	mu  sync.Mutex
+	seq uint64
+	f   *os.File
+}
+
+// OpenWAL opens the WAL in dir, creating it if needed. Appends go to a new
+// segment after the existing ones.
+func OpenWAL(dir, name string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create wal dir: %w", err)
+	}
+	w := &WAL{dir: dir, name: name}
+
+	segments, err := w.files(walSegmentPrefix, walSegmentSuffix)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := w.files(walSnapshotPrefix, walSnapshotSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range append(segments, snapshots...) {
+		if f.seq > w.seq {
+			w.seq = f.seq
+		}
+	}
+	if err := w.openSegment(w.seq + 1); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+type walFile struct {
+	path string
+	seq  uint64
+}
+
+// files returns the files with a prefix and suffix, by sequence number
+func (w *WAL) files(prefix, suffix string) ([]walFile, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []walFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		var seq uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), "%d", &seq); err != nil {
+			continue
+		}
+		files = append(files, walFile{path: filepath.Join(w.dir, name), seq: seq})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].seq < files[j].seq })
+	return files, nil
+}
+
+// openSegment makes seq the active segment. Callers hold w.mu.
+func (w *WAL) openSegment(seq uint64) error {
+	if w.f != nil {
+		w.f.Sync()
+		w.f.Close()
+	}
+	f, err := os.OpenFile(filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, seq, walSegmentSuffix)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.seq = seq
+	return nil
+}
+
+// Append writes one record
+func (w *WAL) Append(record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return errors.New("wal closed")
+	}
+	_, err = w.f.Write(line)
+	return err
+}
+
+// Snapshot starts a new segment and writes a snapshot of everything
+// appended before it, then deletes the segments and snapshots it replaces.
+// Callers must keep the state from changing until write returns.
+func (w *WAL) Snapshot(write func(enc *json.Encoder) error) error {
+	w.mu.Lock()
+	seq := w.seq + 1
+	err := w.openSegment(seq)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walSnapshotPrefix, seq, walSnapshotSuffix))
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	if err := write(json.NewEncoder(zw)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Compact: the snapshot covers every older segment and snapshot
+	segments, _ := w.files(walSegmentPrefix, walSegmentSuffix)
+	snapshots, _ := w.files(walSnapshotPrefix, walSnapshotSuffix)
+	for _, f := range append(segments, snapshots...) {
+		if f.seq < seq {
+			os.Remove(f.path)
+		}
+	}
+	return nil
+}
+
+// Replay restores state from the latest snapshot and the segments written
+// after it. load decodes the snapshot; apply applies one record.
+func (w *WAL) Replay(load func(dec *json.Decoder) error, apply func(record []byte) error) error {
+	started := time.Now()
+
+	snapshots, err := w.files(walSnapshotPrefix, walSnapshotSuffix)
+	if err != nil {
+		return err
+	}
+	var from uint64
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		if err := w.loadSnapshot(latest.path, load); err != nil {
+			return fmt.Errorf("load snapshot %s: %w", latest.path, err)
+		}
+		from = latest.seq
+		log.Printf("WAL %s: loaded snapshot %d", w.name, latest.seq)
+	}
+
+	segments, err := w.files(walSegmentPrefix, walSegmentSuffix)
+	if err != nil {
+		return err
+	}
+	records, replayed := 0, 0
+	for _, seg := range segments {
+		if seg.seq < from {
+			continue
+		}
+		n, err := w.replaySegment(seg.path, apply, &records)
+		if err != nil {
+			return fmt.Errorf("replay %s: %w", seg.path, err)
+		}
+		if n > 0 {
+			replayed++
+		}
+	}
+
+	if records > 0 || from > 0 {
+		log.Printf("WAL %s: replayed %d records from %d segments in %s", w.name, records, replayed, time.Since(started).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func (w *WAL) loadSnapshot(path string, load func(dec *json.Decoder) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return load(json.NewDecoder(zr))
+}
+
+// replaySegment applies the records of one segment. A torn final record
+// from a crash mid-write is skipped.
+func (w *WAL) replaySegment(path string, apply func(record []byte) error, total *int) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReaderSize(f, 1<<20)
+	n := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if applyErr := apply(line); applyErr != nil {
+				log.Printf("WAL %s: skipping bad record in %s: %v", w.name, filepath.Base(path), applyErr)
+			} else {
+				n++
+				*total++
+				if *total%walProgressEvery == 0 {
+					log.Printf("WAL %s: replayed %d records...", w.name, *total)
+				}
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close syncs and closes the active segment
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	w.f.Sync()
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
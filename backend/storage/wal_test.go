@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+type walTestRecord struct {
+	N int `json:"n"`
+}
+
+// replayAll replays w, returning the snapshot state and the records
+// applied after it
+func replayAll(t *testing.T, w *WAL) (snapshot []int, records []int) {
+	t.Helper()
+	err := w.Replay(func(dec *json.Decoder) error {
+		return dec.Decode(&snapshot)
+	}, func(record []byte) error {
+		var rec walTestRecord
+		if err := json.Unmarshal(record, &rec); err != nil {
+			return err
+		}
+		records = append(records, rec.N)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	return snapshot, records
+}
+
+func openTestWAL(t *testing.T, dir string) *WAL {
+	t.Helper()
+	w, err := OpenWAL(dir, "test")
+	if err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	return w
+}
+
+func appendRecords(t *testing.T, w *WAL, from, to int) {
+	t.Helper()
+	for n := from; n <= to; n++ {
+		if err := w.Append(walTestRecord{N: n}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	w := openTestWAL(t, dir)
+	appendRecords(t, w, 1, 3)
+	w.Close()
+
+	// A reopened WAL appends to a new segment after the existing ones
+	w = openTestWAL(t, dir)
+	appendRecords(t, w, 4, 5)
+	w.Close()
+
+	w = openTestWAL(t, dir)
+	defer w.Close()
+	snapshot, records := replayAll(t, w)
+	if snapshot != nil {
+		t.Errorf("loaded snapshot %v from a WAL without one", snapshot)
+	}
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v, want %v", records, want)
+	}
+}
+
+func TestWALSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	w := openTestWAL(t, dir)
+	appendRecords(t, w, 1, 3)
+	if err := w.Snapshot(func(enc *json.Encoder) error {
+		return enc.Encode([]int{1, 2, 3})
+	}); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	appendRecords(t, w, 4, 4)
+	w.Close()
+
+	segments, _ := w.files(walSegmentPrefix, walSegmentSuffix)
+	snapshots, _ := w.files(walSnapshotPrefix, walSnapshotSuffix)
+	if len(segments) != 1 || len(snapshots) != 1 || segments[0].seq != snapshots[0].seq {
+		t.Errorf("after compaction: segments %v, snapshots %v, want one of each with the same sequence", segments, snapshots)
+	}
+
+	w = openTestWAL(t, dir)
+	defer w.Close()
+	snapshot, records := replayAll(t, w)
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(snapshot, want) {
+		t.Errorf("loaded snapshot %v, want %v", snapshot, want)
+	}
+	if want := []int{4}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v after the snapshot, want %v", records, want)
+	}
+}
+
+// TestWALFailedSnapshot checks that a snapshot whose write fails leaves the
+// log to be replayed in full
+func TestWALFailedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	w := openTestWAL(t, dir)
+	appendRecords(t, w, 1, 2)
+	if err := w.Snapshot(func(enc *json.Encoder) error {
+		return os.ErrInvalid
+	}); err == nil {
+		t.Fatal("Snapshot succeeded with a failing write")
+	}
+	appendRecords(t, w, 3, 3)
+	w.Close()
+
+	w = openTestWAL(t, dir)
+	defer w.Close()
+	snapshot, records := replayAll(t, w)
+	if snapshot != nil {
+		t.Errorf("loaded snapshot %v, want none", snapshot)
+	}
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v, want %v", records, want)
+	}
+}
+
+// TestWALTornRecord checks that a bad record and a final record torn by a
+// crash mid-write are skipped, and the rest replayed
+func TestWALTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	w := openTestWAL(t, dir)
+	appendRecords(t, w, 1, 1)
+	w.Close()
+	segments, _ := w.files(walSegmentPrefix, walSegmentSuffix)
+	f, err := os.OpenFile(segments[0].path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n{\"n\":2}\n{\"n\":3")
+	f.Close()
+
+	w = openTestWAL(t, dir)
+	defer w.Close()
+	_, records := replayAll(t, w)
+	if want := []int{1, 2}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %v, want %v", records, want)
+	}
+}
+
+func TestWALAppendAfterClose(t *testing.T) {
+	w := openTestWAL(t, t.TempDir())
+	w.Close()
+	if err := w.Append(walTestRecord{N: 1}); err == nil {
+		t.Error("Append after Close succeeded")
+	}
+}
+
+func testSpan(traceID models.TraceID, spanID models.SpanID, service string, start time.Time) models.Span {
+	return models.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: "GET /" + service,
+		ServiceName:   service,
+		Kind:          models.SpanKindServer,
+		StartTime:     start,
+		EndTime:       start.Add(time.Millisecond),
+		Duration:      time.Millisecond,
+		Tags:          map[string]string{"http.method": "GET"},
+	}
+}
+
+func TestSpanStoreWALRestore(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	kept := models.TraceID{1}
+	deleted := models.TraceID{2}
+
+	w := openTestWAL(t, dir)
+	store := NewSpanStore(1000, time.Hour, WithSpanWAL(w, 0))
+	if err := store.Store(testSpan(kept, models.SpanID{1}, "checkout", start)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.StoreBatch([]models.Span{testSpan(deleted, models.SpanID{2}, "billing", start)}); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting snapshots the store, so the trace isn't replayed
+	if _, err := store.DeleteTrace(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store(testSpan(kept, models.SpanID{3}, "payments", start)); err != nil {
+		t.Fatal(err)
+	}
+	// Crash: the last span is only in the log, not in a snapshot
+	close(store.done)
+	w.Close()
+
+	store = NewSpanStore(1000, time.Hour, WithSpanWAL(openTestWAL(t, dir), 0))
+	defer store.Close()
+	trace, err := store.GetTrace(kept)
+	if err != nil || trace == nil {
+		t.Fatalf("GetTrace(kept) = %v, %v after restart", trace, err)
+	}
+	if len(trace.Spans) != 2 {
+		t.Fatalf("restored %d spans, want 2", len(trace.Spans))
+	}
+	for _, id := range []models.SpanID{{1}, {3}} {
+		span, ok := store.FindSpan(kept, id)
+		if !ok {
+			t.Errorf("span %v not restored", id)
+			continue
+		}
+		if !span.StartTime.Equal(start) || span.Tags["http.method"] != "GET" {
+			t.Errorf("span %v restored as %+v", id, span)
+		}
+	}
+	if trace, _ := store.GetTrace(deleted); trace != nil {
+		t.Error("deleted trace was replayed")
+	}
+}
+
+func TestMetricStoreWALRestore(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	point := func(value float64, ago time.Duration) models.Metric {
+		return models.Metric{
+			Name:      "requests",
+			Type:      models.MetricTypeCounter,
+			Value:     value,
+			Timestamp: now.Add(-ago),
+			Labels:    map[string]string{"route": "/checkout"},
+			Service:   "checkout",
+		}
+	}
+
+	store := NewMetricStore(1000, time.Hour, WithMetricWAL(openTestWAL(t, dir), 0))
+	store.Store(point(1, 2*time.Minute))
+	// Close snapshots the first point; the second is replayed from the log
+	store.Close()
+	w := openTestWAL(t, dir)
+	store = NewMetricStore(1000, time.Hour, WithMetricWAL(w, 0))
+	store.Store(point(2, time.Minute))
+	close(store.done)
+	w.Close()
+
+	store = NewMetricStore(1000, time.Hour, WithMetricWAL(openTestWAL(t, dir), 0))
+	defer store.Close()
+	points, err := store.Points(models.MetricQuery{Name: "requests"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("restored %d points, want 2: %+v", len(points), points)
+	}
+	for i, want := range []models.Metric{point(1, 2*time.Minute), point(2, time.Minute)} {
+		got := points[i]
+		if got.Value != want.Value || !got.Timestamp.Equal(want.Timestamp) || !reflect.DeepEqual(got.Labels, want.Labels) || got.Service != want.Service {
+			t.Errorf("point %d restored as %+v, want %+v", i, got, want)
+		}
+	}
+	if stats := store.Stats(); stats.Series != 1 {
+		t.Errorf("restored %d series, want 1", stats.Series)
+	}
+}
+
+func TestOpenWALCreatesDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tenant", "spans")
+	w := openTestWAL(t, dir)
+	defer w.Close()
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("OpenWAL didn't create its directory: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package tail fans newly stored traces out to live tail subscribers, such
+// as dashboard clients watching traces arrive during a deploy.
+package tail
+
+import (
+	"sync"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Hub tracks live tail subscriptions per tenant and notifies them of the
+// traces that received new spans. It only passes trace IDs along;
+// subscribers read the traces from storage when they are ready to send,
+// so a trace that keeps receiving spans is sent with its latest state.
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[string]map[*Subscription]struct{} // Tenant -> subscriptions
+}
+
+// NewHub creates a hub without subscribers
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Observe notifies a tenant's subscribers of the traces of newly stored
+// spans. It never blocks on slow subscribers.
+func (h *Hub) Observe(tenant string, spans []models.Span) {
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	subs := h.subs[tenant]
+	if len(subs) == 0 || len(spans) == 0 {
+		return
+	}
+	for sub := range subs {
+		sub.notify(spans)
+	}
+}
+
+// Subscribe starts a subscription to a tenant's new traces. At most
+// maxPending traces wait to be taken; notifications of further ones are
+// dropped and counted.
+func (h *Hub) Subscribe(tenant string, maxPending int) *Subscription {
+	if tenant == "" {
+		tenant = models.DefaultTenant
+	}
+	sub := &Subscription{
+		tenant:     tenant,
+		maxPending: maxPending,
+		pending:    make(map[models.TraceID]struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[tenant] == nil {
+		h.subs[tenant] = make(map[*Subscription]struct{})
+	}
+	h.subs[tenant][sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe ends a subscription
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[sub.tenant], sub)
+	if len(h.subs[sub.tenant]) == 0 {
+		delete(h.subs, sub.tenant)
+	}
+}
+
+// Subscribers returns the number of active subscriptions
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for _, subs := range h.subs {
+		n += len(subs)
+	}
+	return n
+}
+
+// Subscription is one subscriber's queue of traces with new spans
+type Subscription struct {
+	tenant     string
+	maxPending int
+
+	mu      sync.Mutex
+	pending map[models.TraceID]struct{}
+	order   []models.TraceID // Pending trace IDs, oldest first
+	dropped int
+}
+
+func (s *Subscription) notify(spans []models.Span) {
+	s.mu.Lock()
+	for _, span := range spans {
+		if _, ok := s.pending[span.TraceID]; ok {
+			continue
+		}
+		if s.maxPending > 0 && len(s.order) >= s.maxPending {
+			s.dropped++
+			continue
+		}
+		s.pending[span.TraceID] = struct{}{}
+		s.order = append(s.order, span.TraceID)
+	}
+	s.mu.Unlock()
+}
+
+// Take removes and returns up to n pending trace IDs, oldest first, and
+// the number of notifications dropped since the last call
+func (s *Subscription) Take(n int) ([]models.TraceID, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n <= 0 || n > len(s.order) {
+		n = len(s.order)
+	}
+	traceIDs := append([]models.TraceID(nil), s.order[:n]...)
+	s.order = s.order[n:]
+	for _, traceID := range traceIDs {
+		delete(s.pending, traceID)
+	}
+
+	dropped := s.dropped
+	s.dropped = 0
+	return traceIDs, dropped
+}
@@ -0,0 +1,127 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/omnitrace/omnitrace/backend/forwarder"
+	"github.com/omnitrace/omnitrace/backend/ingestion"
+	"github.com/omnitrace/omnitrace/backend/storage"
+)
+
+// QueueSaturation is the fraction of the ingestion queue's capacity above
+// which the collector stops reporting ready
+const QueueSaturation = 0.9
+
+// Check returns why a component can't take traffic, or nil if it can
+type Check func() error
+
+// Health serves the liveness and readiness probes of the collector
+type Health struct {
+	mu           sync.RWMutex
+	checks       map[string]Check
+	names        []string
+	shuttingDown atomic.Bool
+}
+
+// ReadinessStatus is the JSON body of the readiness probe. Checks maps
+// each check to "ok" or the reason it failed.
+type ReadinessStatus struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewHealth creates a health reporter without checks
+func NewHealth() *Health {
+	return &Health{checks: make(map[string]Check)}
+}
+
+// AddCheck adds a readiness check under a name. Adding a name again
+// replaces the check.
+func (h *Health) AddCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// ShutDown makes the collector report not ready from now on, so load
+// balancers stop routing to it before it stops serving
+func (h *Health) ShutDown() {
+	h.shuttingDown.Store(true)
+}
+
+// Readiness runs the checks
+func (h *Health) Readiness() ReadinessStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	status := ReadinessStatus{Ready: true, Checks: make(map[string]string, len(h.names)+1)}
+	if h.shuttingDown.Load() {
+		status.Ready = false
+		status.Checks["shutdown"] = "shutting down"
+	}
+	for _, name := range h.names {
+		if err := h.checks[name](); err != nil {
+			status.Ready = false
+			status.Checks[name] = err.Error()
+		} else {
+			status.Checks[name] = "ok"
+		}
+	}
+	return status
+}
+
+// LivenessHandler serves /healthz, which succeeds while the process can
+// serve requests at all
+func (h *Health) LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// ReadinessHandler serves /readyz, which fails with 503 while a check
+// fails or the collector is shutting down
+func (h *Health) ReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := h.Readiness()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// StoresReady checks that storage is open
+func StoresReady(stores *storage.TenantStores) Check {
+	return stores.Ready
+}
+
+// QueueReady checks that the ingestion queue is below QueueSaturation
+func QueueReady(q *ingestion.Queue) Check {
+	return func() error {
+		stats := q.Stats()
+		if stats.Capacity > 0 && float64(stats.Depth) >= QueueSaturation*float64(stats.Capacity) {
+			return fmt.Errorf("ingestion queue saturated: %d of %d requests waiting", stats.Depth, stats.Capacity)
+		}
+		return nil
+	}
+}
+
+// ForwarderReady checks that the downstream collector answered the
+// forwarder's last request
+func ForwarderReady(f *forwarder.Forwarder) Check {
+	return func() error {
+		if err := f.Reachable(); err != nil {
+			return fmt.Errorf("downstream unreachable: %w", err)
+		}
+		return nil
+	}
+}
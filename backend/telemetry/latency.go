@@ -0,0 +1,169 @@
+package telemetry
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the query latency
+// histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencyHistogram counts request latencies in latencyBuckets
+type latencyHistogram struct {
+	counts []uint64 // Per bucket, not cumulative; the last is +Inf
+	count  uint64
+	sum    float64
+}
+
+// latencyVec keeps a latency histogram per route
+type latencyVec struct {
+	mu     sync.Mutex
+	routes map[string]*latencyHistogram
+}
+
+func newLatencyVec() *latencyVec {
+	return &latencyVec{routes: make(map[string]*latencyHistogram)}
+}
+
+func (v *latencyVec) observe(route string, d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h := v.routes[route]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		v.routes[route] = h
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += seconds
+}
+
+func (v *latencyVec) family(name, help string) Family {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	f := Family{Name: name, Help: help, Type: Histogram}
+	for _, route := range v.sortedRoutes() {
+		h := v.routes[route]
+		var cumulative uint64
+		for i, n := range h.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			f.Samples = append(f.Samples, Sample{
+				Suffix: "_bucket",
+				Labels: map[string]string{"route": route, "le": le},
+				Value:  float64(cumulative),
+			})
+		}
+		f.Samples = append(f.Samples,
+			Sample{Suffix: "_sum", Labels: map[string]string{"route": route}, Value: h.sum},
+			Sample{Suffix: "_count", Labels: map[string]string{"route": route}, Value: float64(h.count)},
+		)
+	}
+	return f
+}
+
+// summary reports each route's request count, mean latency and the upper
+// bound of the bucket holding the 95th percentile
+func (v *latencyVec) summary() map[string]QueryLatency {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	summary := make(map[string]QueryLatency, len(v.routes))
+	for route, h := range v.routes {
+		q := QueryLatency{Count: h.count}
+		if h.count > 0 {
+			q.MeanMs = h.sum / float64(h.count) * 1000
+			rank := uint64(float64(h.count) * 0.95)
+			var cumulative uint64
+			for i, n := range h.counts {
+				cumulative += n
+				if cumulative > rank || i == len(h.counts)-1 {
+					// Past the last bucket, the slowest bound is all we know
+					q.P95Ms = latencyBuckets[min(i, len(latencyBuckets)-1)] * 1000
+					break
+				}
+			}
+		}
+		summary[route] = q
+	}
+	return summary
+}
+
+func (v *latencyVec) sortedRoutes() []string {
+	routes := make([]string, 0, len(v.routes))
+	for route := range v.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// meterWindow is the period over which a meter averages its rate
+const meterWindow = 60
+
+// Meter measures the rate of stored spans over the last minute, in
+// one-second slots. It implements the processor's span observer.
+type Meter struct {
+	mu    sync.Mutex
+	slots [meterWindow]uint64
+	last  int64 // Unix second of the most recent slot
+}
+
+// NewMeter creates a meter with no recorded spans
+func NewMeter() *Meter {
+	return &Meter{}
+}
+
+// Observe counts a batch of stored spans
+func (m *Meter) Observe(tenant string, spans []models.Span) {
+	m.Mark(len(spans))
+}
+
+// Mark counts n events
+func (m *Meter) Mark(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sec := m.advance()
+	m.slots[sec%meterWindow] += uint64(n)
+}
+
+// Rate returns the events per second over the last minute
+func (m *Meter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance()
+	var total uint64
+	for _, n := range m.slots {
+		total += n
+	}
+	return float64(total) / meterWindow
+}
+
+// advance clears the slots of the seconds since the last call and returns
+// the current second. Callers hold m.mu.
+func (m *Meter) advance() int64 {
+	sec := time.Now().Unix()
+	if sec-m.last >= meterWindow {
+		m.slots = [meterWindow]uint64{}
+	} else {
+		for s := m.last + 1; s <= sec; s++ {
+			m.slots[s%meterWindow] = 0
+		}
+	}
+	if sec > m.last {
+		m.last = sec
+	}
+	return m.last
+}
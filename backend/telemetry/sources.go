@@ -0,0 +1,308 @@
+package telemetry
+
+import (
+	"sort"
+
+	"github.com/omnitrace/omnitrace/backend/archive"
+	"github.com/omnitrace/omnitrace/backend/cluster"
+	"github.com/omnitrace/omnitrace/backend/forwarder"
+	"github.com/omnitrace/omnitrace/backend/history"
+	"github.com/omnitrace/omnitrace/backend/ingestion"
+	"github.com/omnitrace/omnitrace/backend/replication"
+	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/backend/tail"
+)
+
+// processorSource reports span writes, validation and disk spill
+type processorSource struct {
+	p *ingestion.Processor
+}
+
+// Processor reports the span processor's writes, validation results and
+// disk spill
+func Processor(p *ingestion.Processor) Source {
+	return processorSource{p}
+}
+
+func (s processorSource) Families() []Family {
+	stats := s.p.Stats()
+	validation := s.p.ValidationStats()
+	families := []Family{
+		counter("omnitrace_spans_stored_total", "Spans written to storage.", float64(stats.Stored)),
+		counter("omnitrace_spans_routed_total", "Spans routed to cluster shards.", float64(stats.Routed)),
+		counter("omnitrace_spans_replicas_stored_total", "Spans replicated by peers and stored.", float64(stats.Replicas)),
+		counter("omnitrace_spans_duplicate_total", "Spans dropped as duplicates of stored spans.", float64(stats.Duplicates)),
+		gauge("omnitrace_span_write_queue_batches", "Span batches waiting for a write worker.", float64(stats.Queued)),
+		counter("omnitrace_spans_accepted_total", "Spans that passed validation.", float64(validation.Accepted)),
+		byReason("omnitrace_spans_rejected_total", "Spans dropped by validation, by reason.", validation.Rejected),
+		byReason("omnitrace_spans_normalized_total", "Spans fixed up by validation, by reason.", validation.Normalized),
+	}
+	if stats.Spill != nil {
+		families = append(families,
+			gauge("omnitrace_spill_pending_bytes", "Bytes of spilled span batches not yet replayed.", float64(stats.Spill.PendingBytes)),
+			counter("omnitrace_spill_batches_total", "Span batches spilled to disk.", float64(stats.Spill.Spilled)),
+			counter("omnitrace_spill_replayed_total", "Spilled span batches replayed into storage.", float64(stats.Spill.Replayed)),
+			counter("omnitrace_spill_dropped_total", "Spilled span batches dropped.", float64(stats.Spill.Dropped)),
+		)
+	}
+	return families
+}
+
+func (s processorSource) Status() any {
+	return struct {
+		ingestion.ProcessorStats
+		Validation ingestion.ValidationStats `json:"validation"`
+	}{s.p.Stats(), s.p.ValidationStats()}
+}
+
+func byReason(name, help string, counts map[string]uint64) Family {
+	f := Family{Name: name, Help: help, Type: Counter}
+	for _, reason := range sortedKeys(counts) {
+		f.Samples = append(f.Samples, Sample{Labels: map[string]string{"reason": reason}, Value: float64(counts[reason])})
+	}
+	return f
+}
+
+// queueSource reports the ingestion queue
+type queueSource struct {
+	q *ingestion.Queue
+}
+
+// Queue reports the ingestion queue's depth and counters
+func Queue(q *ingestion.Queue) Source {
+	return queueSource{q}
+}
+
+func (s queueSource) Families() []Family {
+	stats := s.q.Stats()
+	return []Family{
+		gauge("omnitrace_ingest_queue_depth", "Ingestion requests waiting for a worker.", float64(stats.Depth)),
+		gauge("omnitrace_ingest_queue_capacity", "Capacity of the ingestion queue.", float64(stats.Capacity)),
+		counter("omnitrace_ingest_requests_total", "Ingestion requests submitted to the queue.", float64(stats.Submitted)),
+		counter("omnitrace_ingest_requests_rejected_total", "Ingestion requests rejected because the queue was full.", float64(stats.Rejected)),
+		counter("omnitrace_ingest_requests_processed_total", "Ingestion requests processed.", float64(stats.Processed)),
+	}
+}
+
+func (s queueSource) Status() any {
+	return s.q.Stats()
+}
+
+// forwarderSource reports span forwarding
+type forwarderSource struct {
+	f *forwarder.Forwarder
+}
+
+// Forwarder reports the span forwarder's counters
+func Forwarder(f *forwarder.Forwarder) Source {
+	return forwarderSource{f}
+}
+
+func (s forwarderSource) Families() []Family {
+	stats := s.f.Stats()
+	return []Family{
+		counter("omnitrace_forwarder_spans_total", "Spans forwarded downstream.", float64(stats.Forwarded)),
+		counter("omnitrace_forwarder_failed_total", "Spans that failed to forward after retries.", float64(stats.Failed)),
+		counter("omnitrace_forwarder_dropped_total", "Spans dropped because the forward queue was full.", float64(stats.Dropped)),
+		counter("omnitrace_forwarder_retries_total", "Forward request retries.", float64(stats.Retries)),
+		gauge("omnitrace_forwarder_queue_spans", "Spans waiting to be forwarded.", float64(stats.Queued)),
+	}
+}
+
+func (s forwarderSource) Status() any {
+	return s.f.Stats()
+}
+
+// clusterSource reports span routing to the shards of a cluster
+type clusterSource struct {
+	r *cluster.Router
+}
+
+// Cluster reports the forwarding counters of each shard of a cluster
+func Cluster(r *cluster.Router) Source {
+	return clusterSource{r}
+}
+
+func (s clusterSource) Families() []Family {
+	forwarded := Family{Name: "omnitrace_cluster_spans_total", Help: "Spans sent to each shard.", Type: Counter}
+	failed := Family{Name: "omnitrace_cluster_failed_total", Help: "Spans that failed to reach each shard after retries.", Type: Counter}
+	dropped := Family{Name: "omnitrace_cluster_dropped_total", Help: "Spans dropped because a shard's queue was full.", Type: Counter}
+	queued := Family{Name: "omnitrace_cluster_queue_spans", Help: "Spans waiting to be sent to each shard.", Type: Gauge}
+
+	shards := s.r.Stats()
+	for _, shard := range sortedKeys(shards) {
+		stats := shards[shard]
+		labels := map[string]string{"shard": shard}
+		forwarded.Samples = append(forwarded.Samples, Sample{Labels: labels, Value: float64(stats.Forwarded)})
+		failed.Samples = append(failed.Samples, Sample{Labels: labels, Value: float64(stats.Failed)})
+		dropped.Samples = append(dropped.Samples, Sample{Labels: labels, Value: float64(stats.Dropped)})
+		queued.Samples = append(queued.Samples, Sample{Labels: labels, Value: float64(stats.Queued)})
+	}
+	return []Family{forwarded, failed, dropped, queued}
+}
+
+func (s clusterSource) Status() any {
+	return s.r.Stats()
+}
+
+// replicationSource reports span replication to peer collectors
+type replicationSource struct {
+	r *replication.Replicator
+}
+
+// Replication reports the replication counters and lag of each peer
+func Replication(r *replication.Replicator) Source {
+	return replicationSource{r}
+}
+
+func (s replicationSource) Families() []Family {
+	replicated := Family{Name: "omnitrace_replication_spans_total", Help: "Spans replicated to each peer.", Type: Counter}
+	dropped := Family{Name: "omnitrace_replication_dropped_total", Help: "Spans dropped because a peer's queue was full or the peer rejected them.", Type: Counter}
+	failures := Family{Name: "omnitrace_replication_failures_total", Help: "Failed attempts to send spans to each peer.", Type: Counter}
+	queued := Family{Name: "omnitrace_replication_queue_spans", Help: "Spans waiting to be replicated to each peer.", Type: Gauge}
+	lag := Family{Name: "omnitrace_replication_lag_seconds", Help: "Age of the oldest span not yet replicated to each peer.", Type: Gauge}
+
+	peers := s.r.Stats()
+	for _, peer := range sortedKeys(peers) {
+		stats := peers[peer]
+		labels := map[string]string{"peer": peer}
+		replicated.Samples = append(replicated.Samples, Sample{Labels: labels, Value: float64(stats.Replicated)})
+		dropped.Samples = append(dropped.Samples, Sample{Labels: labels, Value: float64(stats.Dropped)})
+		failures.Samples = append(failures.Samples, Sample{Labels: labels, Value: float64(stats.Failures)})
+		queued.Samples = append(queued.Samples, Sample{Labels: labels, Value: float64(stats.Queued)})
+		lag.Samples = append(lag.Samples, Sample{Labels: labels, Value: stats.Lag.Seconds()})
+	}
+	return []Family{replicated, dropped, failures, queued, lag}
+}
+
+func (s replicationSource) Status() any {
+	return s.r.Stats()
+}
+
+// archiveSource reports trace archiving
+type archiveSource struct {
+	a *archive.Archiver
+}
+
+// Archive reports the archiver's counters
+func Archive(a *archive.Archiver) Source {
+	return archiveSource{a}
+}
+
+func (s archiveSource) Families() []Family {
+	stats := s.a.Stats()
+	families := []Family{
+		counter("omnitrace_archive_traces_total", "Traces archived.", float64(stats.Archived)),
+		counter("omnitrace_archive_rearchived_total", "Traces archived again because late spans arrived for them.", float64(stats.Rearchived)),
+		counter("omnitrace_archive_failed_total", "Traces that failed to archive.", float64(stats.Failed)),
+	}
+	if !stats.LastRun.IsZero() {
+		families = append(families, gauge("omnitrace_archive_last_run_timestamp_seconds", "Time of the last archive run.", float64(stats.LastRun.UnixNano())/1e9))
+	}
+	return families
+}
+
+func (s archiveSource) Status() any {
+	return s.a.Stats()
+}
+
+// historySource reports trace history compaction
+type historySource struct {
+	h *history.History
+}
+
+// History reports trace history compaction
+func History(h *history.History) Source {
+	return historySource{h}
+}
+
+func (s historySource) Families() []Family {
+	stats := s.h.Stats()
+	families := []Family{
+		counter("omnitrace_history_traces_total", "Traces compacted into the history.", float64(stats.Compacted)),
+		counter("omnitrace_history_failures_total", "Failed compactions of a tenant's traces.", float64(stats.Failed)),
+	}
+	if !stats.LastRun.IsZero() {
+		families = append(families, gauge("omnitrace_history_last_run_timestamp_seconds", "Time of the last history compaction run.", float64(stats.LastRun.UnixNano())/1e9))
+	}
+	return families
+}
+
+func (s historySource) Status() any {
+	return s.h.Stats()
+}
+
+// storesSource reports the size of each tenant's stores
+type storesSource struct {
+	stores *storage.TenantStores
+}
+
+// Stores reports the size of each tenant's span, metric and pin stores
+func Stores(stores *storage.TenantStores) Source {
+	return storesSource{stores}
+}
+
+func (s storesSource) Families() []Family {
+	traces := Family{Name: "omnitrace_store_traces", Help: "Traces in hot storage.", Type: Gauge}
+	spans := Family{Name: "omnitrace_store_spans", Help: "Spans in hot storage.", Type: Gauge}
+	bytes := Family{Name: "omnitrace_store_bytes", Help: "Bytes of span storage on disk.", Type: Gauge}
+	compressed := Family{Name: "omnitrace_store_compressed_traces", Help: "Traces held compressed in hot storage.", Type: Gauge}
+	dropped := Family{Name: "omnitrace_store_spans_dropped_total", Help: "Spans dropped because their trace reached the span limit.", Type: Counter}
+	series := Family{Name: "omnitrace_store_metric_series", Help: "Stored metric series.", Type: Gauge}
+	points := Family{Name: "omnitrace_store_metric_points", Help: "Stored metric points.", Type: Gauge}
+	overflowed := Family{Name: "omnitrace_metric_points_overflowed_total", Help: "Metric points beyond the series limits.", Type: Counter}
+	pinned := Family{Name: "omnitrace_store_pinned_traces", Help: "Pinned traces.", Type: Gauge}
+
+	tenants := s.stores.Stats()
+	for _, tenant := range sortedKeys(tenants) {
+		stats := tenants[tenant]
+		labels := map[string]string{"tenant": tenant}
+		traces.Samples = append(traces.Samples, Sample{Labels: labels, Value: float64(stats.Spans.Traces)})
+		spans.Samples = append(spans.Samples, Sample{Labels: labels, Value: float64(stats.Spans.Spans)})
+		if stats.Spans.Bytes > 0 {
+			bytes.Samples = append(bytes.Samples, Sample{Labels: labels, Value: float64(stats.Spans.Bytes)})
+		}
+		dropped.Samples = append(dropped.Samples, Sample{Labels: labels, Value: float64(stats.Spans.DroppedSpans)})
+		if stats.Spans.Compressed > 0 {
+			compressed.Samples = append(compressed.Samples, Sample{Labels: labels, Value: float64(stats.Spans.Compressed)})
+		}
+		series.Samples = append(series.Samples, Sample{Labels: labels, Value: float64(stats.Metrics.Series)})
+		points.Samples = append(points.Samples, Sample{Labels: labels, Value: float64(stats.Metrics.Points)})
+		overflowed.Samples = append(overflowed.Samples, Sample{Labels: labels, Value: float64(stats.Metrics.Overflowed)})
+		pinned.Samples = append(pinned.Samples, Sample{Labels: labels, Value: float64(stats.PinnedTraces)})
+	}
+	return []Family{traces, spans, bytes, compressed, dropped, series, points, overflowed, pinned}
+}
+
+func (s storesSource) Status() any {
+	return s.stores.Stats()
+}
+
+// tailSource reports live tail subscriptions
+type tailSource struct {
+	h *tail.Hub
+}
+
+// LiveTail reports the number of live tail subscribers
+func LiveTail(h *tail.Hub) Source {
+	return tailSource{h}
+}
+
+func (s tailSource) Families() []Family {
+	return []Family{gauge("omnitrace_live_tail_subscribers", "Active live tail connections.", float64(s.h.Subscribers()))}
+}
+
+func (s tailSource) Status() any {
+	return struct {
+		Subscribers int `json:"subscribers"`
+	}{s.h.Subscribers()}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,248 @@
+// Package telemetry instruments OmniTrace itself: ingest rates, queue
+// depths, store sizes, query latencies and dropped spans. It serves them in
+// the Prometheus text format at /metrics and as a JSON summary at
+// /api/status.
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricType is the Prometheus type of a metric family
+type MetricType string
+
+// Metric family types
+const (
+	Counter   MetricType = "counter"
+	Gauge     MetricType = "gauge"
+	Histogram MetricType = "histogram"
+)
+
+// Sample is one value of a metric family. Suffix is appended to the
+// family name, e.g. "_bucket" for histogram buckets.
+type Sample struct {
+	Suffix string
+	Labels map[string]string
+	Value  float64
+}
+
+// Family is a named group of samples of one type
+type Family struct {
+	Name    string
+	Help    string
+	Type    MetricType
+	Samples []Sample
+}
+
+// Source is a component that reports its own telemetry
+type Source interface {
+	// Families returns the component's current metrics
+	Families() []Family
+	// Status returns the component's JSON status summary
+	Status() any
+}
+
+// Registry collects the telemetry of registered sources
+type Registry struct {
+	mu      sync.RWMutex
+	sources map[string]Source
+	names   []string
+
+	started  time.Time
+	requests *latencyVec
+	ingest   *Meter
+}
+
+// NewRegistry creates a registry without sources
+func NewRegistry() *Registry {
+	return &Registry{
+		sources:  make(map[string]Source),
+		started:  time.Now(),
+		requests: newLatencyVec(),
+		ingest:   NewMeter(),
+	}
+}
+
+// Register adds a source under a name, which keys its status summary.
+// Registering a name again replaces the source.
+func (r *Registry) Register(name string, src Source) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sources[name]; !ok {
+		r.names = append(r.names, name)
+		sort.Strings(r.names)
+	}
+	r.sources[name] = src
+}
+
+// IngestMeter returns the meter of the ingest rate, to be fed every batch
+// of stored spans
+func (r *Registry) IngestMeter() *Meter {
+	return r.ingest
+}
+
+// Instrument records the latency of h's requests under a route name
+func (r *Registry) Instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		h(w, req)
+		r.requests.observe(route, time.Since(start))
+	}
+}
+
+// Gather returns the metrics of the process and every source, sorted by
+// family name
+func (r *Registry) Gather() []Family {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	families := []Family{
+		gauge("omnitrace_uptime_seconds", "Seconds since the server started.", time.Since(r.started).Seconds()),
+		gauge("omnitrace_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine())),
+		gauge("omnitrace_heap_bytes", "Bytes of allocated heap objects.", float64(mem.HeapAlloc)),
+		gauge("omnitrace_ingest_spans_per_second", "Spans stored per second over the last minute.", r.ingest.Rate()),
+		r.requests.family("omnitrace_query_duration_seconds", "Latency of dashboard API requests by route."),
+	}
+
+	r.mu.RLock()
+	for _, name := range r.names {
+		families = append(families, r.sources[name].Families()...)
+	}
+	r.mu.RUnlock()
+
+	sort.SliceStable(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+	return families
+}
+
+// Status is the JSON summary served at /api/status
+type Status struct {
+	StartedAt      time.Time               `json:"started_at"`
+	UptimeSeconds  float64                 `json:"uptime_seconds"`
+	Goroutines     int                     `json:"goroutines"`
+	HeapBytes      uint64                  `json:"heap_bytes"`
+	SpansPerSecond float64                 `json:"spans_per_second"`
+	Queries        map[string]QueryLatency `json:"queries"`
+	Components     map[string]any          `json:"components"`
+}
+
+// QueryLatency summarizes the latency of one route's requests
+type QueryLatency struct {
+	Count  uint64  `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+}
+
+// Status returns the JSON summary of the process and every source
+func (r *Registry) Status() Status {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status := Status{
+		StartedAt:      r.started,
+		UptimeSeconds:  time.Since(r.started).Seconds(),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapBytes:      mem.HeapAlloc,
+		SpansPerSecond: r.ingest.Rate(),
+		Queries:        r.requests.summary(),
+		Components:     make(map[string]any),
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name, src := range r.sources {
+		status.Components[name] = src.Status()
+	}
+	return status
+}
+
+// MetricsHandler serves the registry's metrics in the Prometheus text
+// format
+func (r *Registry) MetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w, r.Gather())
+	}
+}
+
+// StatusHandler serves the registry's JSON status summary
+func (r *Registry) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Status())
+	}
+}
+
+// WritePrometheus writes metric families in the Prometheus text
+// exposition format
+func WritePrometheus(w io.Writer, families []Family) error {
+	for _, f := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.Name, escapeHelp(f.Help), f.Name, f.Type); err != nil {
+			return err
+		}
+		for _, s := range f.Samples {
+			if _, err := fmt.Fprintf(w, "%s%s%s %s\n", f.Name, s.Suffix, formatLabels(s.Labels), formatValue(s.Value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func gauge(name, help string, v float64) Family {
+	return Family{Name: name, Help: help, Type: Gauge, Samples: []Sample{{Value: v}}}
+}
+
+func counter(name, help string, v float64) Family {
+	return Family{Name: name, Help: help, Type: Counter, Samples: []Sample{{Value: v}}}
+}
@@ -0,0 +1,165 @@
+package traceql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// tokenKind identifies a lexical token
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenLBrace
+	tokenRBrace
+	tokenLParen
+	tokenRParen
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOp
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenDuration
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of query"
+	case tokenLBrace:
+		return "'{'"
+	case tokenRBrace:
+		return "'}'"
+	case tokenLParen:
+		return "'('"
+	case tokenRParen:
+		return "')'"
+	case tokenAnd:
+		return "'&&'"
+	case tokenOr:
+		return "'||'"
+	case tokenNot:
+		return "'!'"
+	case tokenOp:
+		return "operator"
+	case tokenIdent:
+		return "identifier"
+	case tokenString:
+		return "string"
+	case tokenNumber:
+		return "number"
+	default:
+		return "duration"
+	}
+}
+
+type token struct {
+	kind tokenKind
+	text string // Unquoted for strings
+	pos  int
+}
+
+// SyntaxError reports an invalid query and where it went wrong
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+}
+
+// lex splits a query into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '{':
+			tokens = append(tokens, token{tokenLBrace, "{", i})
+			i++
+		case r == '}':
+			tokens = append(tokens, token{tokenRBrace, "}", i})
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case r == '&' || r == '|':
+			if i+1 >= len(runes) || runes[i+1] != r {
+				return nil, &SyntaxError{i, fmt.Sprintf("expected %c%c", r, r)}
+			}
+			kind := tokenAnd
+			if r == '|' {
+				kind = tokenOr
+			}
+			tokens = append(tokens, token{kind, string([]rune{r, r}), i})
+			i += 2
+		case r == '=' || r == '!' || r == '<' || r == '>':
+			op := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '=' || (runes[i+1] == '~' && (r == '=' || r == '!'))) {
+				op += string(runes[i+1])
+			}
+			kind := tokenOp
+			if op == "!" {
+				kind = tokenNot
+			}
+			tokens = append(tokens, token{kind, op, i})
+			i += len(op)
+		case r == '"':
+			start := i
+			var b strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, &SyntaxError{start, "unterminated string"}
+			}
+			tokens = append(tokens, token{tokenString, b.String(), start})
+			i++
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			kind := tokenNumber
+			if i < len(runes) && unicode.IsLetter(runes[i]) {
+				for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '.') {
+					i++
+				}
+				if _, err := time.ParseDuration(string(runes[start:i])); err != nil {
+					return nil, &SyntaxError{start, fmt.Sprintf("invalid duration %q", string(runes[start:i]))}
+				}
+				kind = tokenDuration
+			}
+			tokens = append(tokens, token{kind, string(runes[start:i]), start})
+		case isIdentRune(r):
+			start := i
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i]), start})
+		default:
+			return nil, &SyntaxError{i, fmt.Sprintf("unexpected %q", r)}
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(runes)}), nil
+}
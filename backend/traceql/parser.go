@@ -0,0 +1,253 @@
+package traceql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parser is a recursive descent parser over the query's tokens:
+//
+//	query     = traceOr
+//	traceOr   = traceAnd { "||" traceAnd }
+//	traceAnd  = traceTerm { "&&" traceTerm }
+//	traceTerm = "{" [ spanOr ] "}" | "(" traceOr ")"
+//	spanOr    = spanAnd { "||" spanAnd }
+//	spanAnd   = spanUnary { "&&" spanUnary }
+//	spanUnary = "!" spanUnary | "(" spanOr ")" | attribute op value
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.unexpected(t, kind.String())
+	}
+	return t, nil
+}
+
+func (p *parser) unexpected(t token, want string) error {
+	got := t.kind.String()
+	if t.kind != tokenEOF {
+		got = fmt.Sprintf("%q", t.text)
+	}
+	return &SyntaxError{t.pos, fmt.Sprintf("expected %s, got %s", want, got)}
+}
+
+func (p *parser) traceOr() (traceExpr, error) {
+	left, err := p.traceAnd()
+	for err == nil && p.peek().kind == tokenOr {
+		p.next()
+		var right traceExpr
+		if right, err = p.traceAnd(); err == nil {
+			left = traceOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) traceAnd() (traceExpr, error) {
+	left, err := p.traceTerm()
+	for err == nil && p.peek().kind == tokenAnd {
+		p.next()
+		var right traceExpr
+		if right, err = p.traceTerm(); err == nil {
+			left = traceAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) traceTerm() (traceExpr, error) {
+	switch t := p.next(); t.kind {
+	case tokenLBrace:
+		if p.peek().kind == tokenRBrace {
+			p.next()
+			return spanset{}, nil
+		}
+		cond, err := p.spanOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRBrace); err != nil {
+			return nil, err
+		}
+		return spanset{cond}, nil
+	case tokenLParen:
+		expr, err := p.traceOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	default:
+		return nil, p.unexpected(t, "'{' or '('")
+	}
+}
+
+func (p *parser) spanOr() (spanCond, error) {
+	left, err := p.spanAnd()
+	for err == nil && p.peek().kind == tokenOr {
+		p.next()
+		var right spanCond
+		if right, err = p.spanAnd(); err == nil {
+			left = condOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) spanAnd() (spanCond, error) {
+	left, err := p.spanUnary()
+	for err == nil && p.peek().kind == tokenAnd {
+		p.next()
+		var right spanCond
+		if right, err = p.spanUnary(); err == nil {
+			left = condAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) spanUnary() (spanCond, error) {
+	switch p.peek().kind {
+	case tokenNot:
+		p.next()
+		cond, err := p.spanUnary()
+		return condNot{cond}, err
+	case tokenLParen:
+		p.next()
+		cond, err := p.spanOr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect(tokenRParen)
+		return cond, err
+	default:
+		return p.comparison()
+	}
+}
+
+func (p *parser) comparison() (spanCond, error) {
+	attrTok, err := p.expect(tokenIdent)
+	if err != nil {
+		return nil, err
+	}
+	attr, err := parseAttribute(attrTok)
+	if err != nil {
+		return nil, err
+	}
+	opTok, err := p.expect(tokenOp)
+	if err != nil {
+		return nil, err
+	}
+	valTok := p.next()
+
+	c := comparison{attr: attr, op: opTok.text}
+	if c.op == "==" {
+		c.op = "="
+	}
+	switch valTok.kind {
+	case tokenString, tokenIdent:
+		c.str = valTok.text
+	case tokenNumber:
+		n, err := strconv.ParseFloat(valTok.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{valTok.pos, fmt.Sprintf("invalid number %q", valTok.text)}
+		}
+		c.num, c.numeric = n, true
+	case tokenDuration:
+		c.dur, _ = time.ParseDuration(valTok.text)
+	default:
+		return nil, p.unexpected(valTok, "value")
+	}
+
+	if err := c.check(valTok); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseAttribute resolves an attribute name. Tags are addressed as
+// tag.key, span.key or .key.
+func parseAttribute(t token) (attribute, error) {
+	switch name := t.text; {
+	case name == "service" || name == "resource.service.name":
+		return attribute{kind: attrService}, nil
+	case name == "name":
+		return attribute{kind: attrName}, nil
+	case name == "kind":
+		return attribute{kind: attrKind}, nil
+	case name == "status":
+		return attribute{kind: attrStatus}, nil
+	case name == "duration":
+		return attribute{kind: attrDuration}, nil
+	case strings.HasPrefix(name, "tag.") && len(name) > len("tag."):
+		return attribute{kind: attrTag, tag: strings.TrimPrefix(name, "tag.")}, nil
+	case strings.HasPrefix(name, "span.") && len(name) > len("span."):
+		return attribute{kind: attrTag, tag: strings.TrimPrefix(name, "span.")}, nil
+	case strings.HasPrefix(name, ".") && len(name) > 1:
+		return attribute{kind: attrTag, tag: name[1:]}, nil
+	default:
+		return attribute{}, &SyntaxError{t.pos, fmt.Sprintf("unknown attribute %q", name)}
+	}
+}
+
+// check validates the operator and value type of a comparison and compiles
+// regular expressions
+func (c *comparison) check(value token) error {
+	fail := func(msg string) error { return &SyntaxError{value.pos, msg} }
+
+	switch c.attr.kind {
+	case attrDuration:
+		if value.kind != tokenDuration {
+			return fail("duration must be compared with a duration such as 500ms")
+		}
+		if c.op == "=~" || c.op == "!~" {
+			return fail("duration can't be matched with a regular expression")
+		}
+		return nil
+	case attrTag:
+		if value.kind == tokenDuration {
+			return fail("tags can't be compared with durations")
+		}
+	default:
+		if value.kind != tokenString && value.kind != tokenIdent {
+			return fail(fmt.Sprintf("%s must be compared with a string", c.attr))
+		}
+	}
+
+	switch c.op {
+	case "=", "!=":
+	case "=~", "!~":
+		if c.numeric {
+			return fail("regular expressions must be strings")
+		}
+		re, err := regexp.Compile("^(?:" + c.str + ")$")
+		if err != nil {
+			return fail(fmt.Sprintf("invalid regular expression: %v", err))
+		}
+		c.re = re
+	default:
+		if !c.numeric {
+			return fail(fmt.Sprintf("operator %s needs a number or duration", c.op))
+		}
+	}
+	return nil
+}
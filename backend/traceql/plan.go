@@ -0,0 +1,67 @@
+package traceql
+
+import "github.com/omnitrace/omnitrace/internal/models"
+
+// Plan turns the query into a trace query for the span stores. Conditions
+// that every match must satisfy are pushed down to the store's indexes:
+// a service equality selects the service index, a minimum span duration
+// bounds the trace duration (a trace lasts at least as long as its spans),
+// an error status requires an erroring trace, and tag string equality
+// narrows by text search. The full query is then checked on each
+// candidate trace.
+func (q *Query) Plan(base models.TraceQuery) models.TraceQuery {
+	query := base
+	for _, c := range requiredComparisons(q.root) {
+		switch c.attr.kind {
+		case attrService:
+			if c.op == "=" && query.Service == "" {
+				query.Service = c.str
+			}
+		case attrDuration:
+			minDuration := c.dur
+			if c.op == ">" {
+				minDuration++
+			}
+			if (c.op == ">" || c.op == ">=" || c.op == "=") && minDuration > query.MinDuration {
+				query.MinDuration = minDuration
+			}
+		case attrStatus:
+			if c.op == "=" && c.str == string(models.SpanStatusError) {
+				hasError := true
+				query.HasError = &hasError
+			}
+		case attrTag:
+			if c.op == "=" && !c.numeric {
+				if query.Text != "" {
+					query.Text += " "
+				}
+				query.Text += c.str
+			}
+		}
+	}
+	query.Match = q.Match
+	return query
+}
+
+// requiredComparisons returns the comparisons that some span of every
+// matching trace satisfies: those joined by && at the top of the
+// spansets that are themselves joined by &&
+func requiredComparisons(expr traceExpr) []comparison {
+	switch e := expr.(type) {
+	case traceAnd:
+		return append(requiredComparisons(e.left), requiredComparisons(e.right)...)
+	case spanset:
+		return conjuncts(e.cond)
+	}
+	return nil
+}
+
+func conjuncts(cond spanCond) []comparison {
+	switch c := cond.(type) {
+	case condAnd:
+		return append(conjuncts(c.left), conjuncts(c.right)...)
+	case comparison:
+		return []comparison{c}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Package traceql implements a small TraceQL-style query language for
+// searching traces, such as
+//
+//	{service="checkout" && duration>500ms && tag.http.status_code=500}
+//
+// A spanset selector in braces matches traces with at least one span that
+// satisfies its condition; selectors combine with && and ||. Conditions
+// compare span attributes (service, name, kind, status, duration) and tags
+// (tag.key, span.key or .key) with =, !=, <, <=, >, >=, and the regular
+// expression operators =~ and !~.
+package traceql
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Query is a parsed query
+type Query struct {
+	root traceExpr
+}
+
+// Parse parses a query. Errors are *SyntaxError.
+func Parse(input string) (*Query, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.traceOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t, "'&&', '||' or end of query")
+	}
+	return &Query{root: root}, nil
+}
+
+// Match reports whether a trace satisfies the query
+func (q *Query) Match(trace *models.Trace) bool {
+	return q.root.match(trace)
+}
+
+// traceExpr is a trace-level expression
+type traceExpr interface {
+	match(trace *models.Trace) bool
+}
+
+type traceAnd struct{ left, right traceExpr }
+
+func (e traceAnd) match(trace *models.Trace) bool {
+	return e.left.match(trace) && e.right.match(trace)
+}
+
+type traceOr struct{ left, right traceExpr }
+
+func (e traceOr) match(trace *models.Trace) bool {
+	return e.left.match(trace) || e.right.match(trace)
+}
+
+// spanset matches traces with a span satisfying its condition, or any span
+// when the condition is nil
+type spanset struct {
+	cond spanCond
+}
+
+func (e spanset) match(trace *models.Trace) bool {
+	for i := range trace.Spans {
+		if e.cond == nil || e.cond.eval(&trace.Spans[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// spanCond is a span-level condition
+type spanCond interface {
+	eval(span *models.Span) bool
+}
+
+type condAnd struct{ left, right spanCond }
+
+func (c condAnd) eval(span *models.Span) bool { return c.left.eval(span) && c.right.eval(span) }
+
+type condOr struct{ left, right spanCond }
+
+func (c condOr) eval(span *models.Span) bool { return c.left.eval(span) || c.right.eval(span) }
+
+type condNot struct{ cond spanCond }
+
+func (c condNot) eval(span *models.Span) bool { return !c.cond.eval(span) }
+
+type attributeKind int
+
+const (
+	attrService attributeKind = iota
+	attrName
+	attrKind
+	attrStatus
+	attrDuration
+	attrTag
+)
+
+type attribute struct {
+	kind attributeKind
+	tag  string
+}
+
+func (a attribute) String() string {
+	switch a.kind {
+	case attrService:
+		return "service"
+	case attrName:
+		return "name"
+	case attrKind:
+		return "kind"
+	case attrStatus:
+		return "status"
+	case attrDuration:
+		return "duration"
+	default:
+		return "tag." + a.tag
+	}
+}
+
+// comparison compares an attribute with a literal. Comparisons on a missing
+// tag are false.
+type comparison struct {
+	attr    attribute
+	op      string
+	str     string
+	num     float64
+	numeric bool
+	dur     time.Duration
+	re      *regexp.Regexp
+}
+
+func (c comparison) eval(span *models.Span) bool {
+	var value string
+	switch c.attr.kind {
+	case attrService:
+		value = span.ServiceName
+	case attrName:
+		value = span.OperationName
+	case attrKind:
+		value = string(span.Kind)
+	case attrStatus:
+		value = string(span.Status)
+	case attrDuration:
+		return compareOrdered(span.EndTime.Sub(span.StartTime), c.dur, c.op)
+	case attrTag:
+		v, ok := span.Tags[c.attr.tag]
+		if !ok {
+			return false
+		}
+		if c.numeric {
+			n, err := strconv.ParseFloat(v, 64)
+			return err == nil && compareOrdered(n, c.num, c.op)
+		}
+		value = v
+	}
+
+	switch c.op {
+	case "=":
+		return value == c.str
+	case "!=":
+		return value != c.str
+	case "=~":
+		return c.re.MatchString(value)
+	case "!~":
+		return !c.re.MatchString(value)
+	}
+	return false
+}
+
+func compareOrdered[T time.Duration | float64](a, b T, op string) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
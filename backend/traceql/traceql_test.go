@@ -0,0 +1,173 @@
+package traceql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+func testTrace() *models.Trace {
+	start := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	return &models.Trace{Spans: []models.Span{
+		{
+			ServiceName:   "frontend",
+			OperationName: "GET /checkout",
+			Kind:          models.SpanKindServer,
+			Status:        models.SpanStatusOK,
+			StartTime:     start,
+			EndTime:       start.Add(800 * time.Millisecond),
+			Tags:          map[string]string{"http.method": "GET", "http.status_code": "200"},
+		},
+		{
+			ServiceName:   "checkout",
+			OperationName: "charge card",
+			Kind:          models.SpanKindClient,
+			Status:        models.SpanStatusError,
+			StartTime:     start.Add(100 * time.Millisecond),
+			EndTime:       start.Add(700 * time.Millisecond),
+			Tags:          map[string]string{"http.status_code": "502", "retry": "true"},
+		},
+	}}
+}
+
+func TestParseMatch(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{`{}`, true},
+		{`{service="checkout"}`, true},
+		{`{service="billing"}`, false},
+		{`{resource.service.name=frontend}`, true},
+		{`{service!="frontend"}`, true},
+		{`{name="charge card"}`, true},
+		{`{name=~"GET .*"}`, true},
+		{`{name=~"GET"}`, false},
+		{`{name!~"GET .*" && service="frontend"}`, false},
+		{`{kind="client" && status="error"}`, true},
+		{`{kind="client" && status="ok"}`, false},
+		{`{duration>500ms}`, true},
+		{`{duration>800ms}`, false},
+		{`{duration>=800ms}`, true},
+		{`{duration<1s && duration!=800ms}`, true},
+		{`{duration=600ms}`, true},
+		{`{tag.http.status_code=502}`, true},
+		{`{span.http.status_code>=500}`, true},
+		{`{.http.status_code>=500 && service="frontend"}`, false},
+		{`{.http.status_code<300}`, true},
+		{`{tag.http.status_code="502"}`, true},
+		{`{tag.missing!="x"}`, false},
+		{`{.retry=true}`, true},
+		{`{service="frontend"} && {status="error"}`, true},
+		{`{service="frontend"} && {service="billing"}`, false},
+		{`{service="billing"} || {status="error"}`, true},
+		{`({service="billing"} || {service="frontend"}) && {kind="client"}`, true},
+		{`{service="billing" || service="checkout" && status="error"}`, true},
+		{`{(service="billing" || service="checkout") && status="ok"}`, false},
+		{`{!service="frontend"}`, true},
+		{`{!(service="frontend" || service="checkout")}`, false},
+		{`{ service == "checkout" }`, true},
+		{`{name="say \"hi\""}`, false},
+	}
+	trace := testTrace()
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := q.Match(trace); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{``, 0, "expected '{' or '(', got end of query"},
+		{`service="x"`, 0, `expected '{' or '(', got "service"`},
+		{`{service="x"`, 12, "expected '}', got end of query"},
+		{`{service="x"} {}`, 14, "expected '&&', '||' or end of query"},
+		{`({}`, 3, "expected ')', got end of query"},
+		{`{service}`, 8, "expected operator"},
+		{`{service=}`, 9, "expected value"},
+		{`{="x"}`, 1, "expected identifier"},
+		{`{service="x" & name="y"}`, 13, "expected &&"},
+		{`{service="x" | name="y"}`, 13, "expected ||"},
+		{`{service="x}`, 9, "unterminated string"},
+		{`{service="x" @}`, 13, `unexpected '@'`},
+		{`{foo="x"}`, 1, `unknown attribute "foo"`},
+		{`{tag.="x"}`, 1, `unknown attribute "tag."`},
+		{`{duration>5}`, 10, "duration must be compared with a duration"},
+		{`{duration=~1s}`, 11, "can't be matched with a regular expression"},
+		{`{duration>5parsecs}`, 10, `invalid duration "5parsecs"`},
+		{`{tag.latency>1s}`, 13, "tags can't be compared with durations"},
+		{`{service=5}`, 9, "service must be compared with a string"},
+		{`{status=1ms}`, 8, "status must be compared with a string"},
+		{`{tag.code=~5}`, 11, "regular expressions must be strings"},
+		{`{name=~"("}`, 7, "invalid regular expression"},
+		{`{name>"a"}`, 6, "operator > needs a number or duration"},
+		{`{tag.code<"x"}`, 10, "operator < needs a number or duration"},
+		{`{tag.v=1.2.3}`, 7, `invalid number "1.2.3"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Parse error = %v, want a *SyntaxError", err)
+			}
+			if syntaxErr.Pos != tt.pos || !strings.Contains(syntaxErr.Msg, tt.msg) {
+				t.Errorf("Parse error = %v, want position %d: ...%s...", err, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	hasError := true
+	tests := []struct {
+		query string
+		want  models.TraceQuery
+	}{
+		{`{}`, models.TraceQuery{}},
+		{`{service="checkout"}`, models.TraceQuery{Service: "checkout"}},
+		{`{service="a"} && {service="b"}`, models.TraceQuery{Service: "a"}},
+		{`{service=~"check.*"}`, models.TraceQuery{}},
+		{`{duration>500ms}`, models.TraceQuery{MinDuration: 500*time.Millisecond + 1}},
+		{`{duration>=500ms && duration>=1s}`, models.TraceQuery{MinDuration: time.Second}},
+		{`{duration<500ms}`, models.TraceQuery{}},
+		{`{status="error"}`, models.TraceQuery{HasError: &hasError}},
+		{`{tag.region="eu" && tag.zone="b"}`, models.TraceQuery{Text: "eu b"}},
+		{`{tag.code=500}`, models.TraceQuery{}},
+		{`{service="a" || service="b"}`, models.TraceQuery{}},
+		{`{service="a"} || {service="b"}`, models.TraceQuery{}},
+		{`{!service="a"}`, models.TraceQuery{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			got := q.Plan(models.TraceQuery{})
+			if got.Match == nil {
+				t.Error("Plan didn't set Match")
+			}
+			if got.Service != tt.want.Service || got.MinDuration != tt.want.MinDuration || got.Text != tt.want.Text ||
+				(got.HasError == nil) != (tt.want.HasError == nil) || (got.HasError != nil && *got.HasError != *tt.want.HasError) {
+				t.Errorf("Plan = {Service:%q MinDuration:%v HasError:%v Text:%q}, want {Service:%q MinDuration:%v HasError:%v Text:%q}",
+					got.Service, got.MinDuration, got.HasError, got.Text,
+					tt.want.Service, tt.want.MinDuration, tt.want.HasError, tt.want.Text)
+			}
+		})
+	}
+}
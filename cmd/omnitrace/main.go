@@ -1,52 +1,544 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
 
+	"google.golang.org/grpc"
+
+	"github.com/omnitrace/omnitrace/backend/alerting"
+	"github.com/omnitrace/omnitrace/backend/archive"
+	"github.com/omnitrace/omnitrace/backend/auth"
+	"github.com/omnitrace/omnitrace/backend/certs"
+	"github.com/omnitrace/omnitrace/backend/cluster"
 	"github.com/omnitrace/omnitrace/backend/dashboard"
+	"github.com/omnitrace/omnitrace/backend/forwarder"
+	"github.com/omnitrace/omnitrace/backend/history"
 	"github.com/omnitrace/omnitrace/backend/ingestion"
+	"github.com/omnitrace/omnitrace/backend/replication"
+	"github.com/omnitrace/omnitrace/backend/selftrace"
+	"github.com/omnitrace/omnitrace/backend/slo"
 	"github.com/omnitrace/omnitrace/backend/storage"
+	"github.com/omnitrace/omnitrace/backend/tail"
+	"github.com/omnitrace/omnitrace/backend/telemetry"
+	"github.com/omnitrace/omnitrace/internal/cli"
 	"github.com/omnitrace/omnitrace/internal/config"
+	"github.com/omnitrace/omnitrace/internal/models"
 )
 
 func main() {
-	// Load configuration
-	cfg := config.LoadFromEnv()
+	// Subcommands talk to a running collector, check the configuration or
+	// run the local agent rather than start a collector
+	if len(os.Args) > 1 && slices.Contains(cli.Commands, os.Args[1]) {
+		os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	// Load configuration: defaults, then the config file, then the
+	// environment
+	configFile := flag.String("config", os.Getenv("OMNITRACE_CONFIG"), "YAML or TOML configuration file")
+	roles := flag.String("role", "", "Roles to run, comma-separated: ingest, query or both (default both)")
+	flag.Parse()
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if *roles != "" {
+		cfg.Server.Roles = strings.Split(*roles, ",")
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	// A process can run only the ingestion or the query side of the
+	// collector, so that each scales on its own
+	ingest := cfg.Server.HasRole(config.RoleIngest)
+	query := cfg.Server.HasRole(config.RoleQuery)
+	if !ingest || !query {
+		log.Printf("Running the %s role", strings.Join(cfg.Server.Roles, ", "))
+	}
+
+	// Initialize storage, partitioned by tenant
+	tenantDefaults := storage.TenantConfig{
+		Backend:          cfg.Storage.Backend,
+		DataDir:          cfg.Storage.DataDir,
+		MaxSpans:         cfg.Storage.MaxSpans,
+		MaxSpansPerTrace: cfg.Storage.MaxSpansPerTrace,
+		SpanTTL:          cfg.Storage.SpanTTL,
+		AssemblyDelay:    cfg.Storage.TraceAssemblyDelay,
+		MaxMetrics:       cfg.Storage.MaxMetrics,
+		MetricTTL:        cfg.Storage.MetricTTL,
+		SeriesLimits: storage.SeriesLimits{
+			PerMetric:  cfg.Storage.MaxSeriesPerMetric,
+			PerService: cfg.Storage.MaxSeriesPerService,
+			Overflow:   storage.SeriesOverflow(cfg.Storage.SeriesOverflow),
+		},
+		MaxErrors:        cfg.Storage.MaxErrors,
+		ErrorTTL:         cfg.Storage.ErrorTTL,
+		WAL:              cfg.Storage.WAL,
+		SnapshotInterval: cfg.Storage.SnapshotInterval,
+		SpanCompression:  storage.SpanCompression(cfg.Storage.SpanCompression),
+		MaxPinnedTraces:  cfg.Storage.MaxPinnedTraces,
+		MaxPinnedSpans:   cfg.Storage.MaxPinnedSpans,
+		MaxDeployments:   cfg.Storage.MaxDeployments,
+		MaxAnnotations:   cfg.Storage.MaxAnnotations,
+	}
+	// A cluster frontend stores no spans: it routes them to the shards
+	// owning their traces and reads them back from all shards
+	var membership *cluster.Membership
+	var shards *cluster.Client
+	if cfg.Cluster.Enabled() {
+		membership, err = cluster.NewMembership(cfg.Cluster.Shards, cfg.Cluster.MembersFile, cluster.DefaultReloadInterval)
+		if err != nil {
+			log.Fatalf("Failed to load cluster members: %v", err)
+		}
+		shards = cluster.NewClient(membership, cfg.Cluster.Token, cfg.Cluster.Timeout)
+		storage.RegisterRemoteSpanBackend(cluster.Backend, shards.SpanBackend())
+		tenantDefaults.Backend = cluster.Backend
+	}
+	tenantOverrides := make(map[string]storage.TenantConfig)
+	for tenant, ttl := range cfg.Tenancy.SpanTTLs {
+		override := tenantDefaults
+		override.SpanTTL = ttl
+		tenantOverrides[tenant] = override
+	}
+	stores, err := storage.NewTenantStores(tenantDefaults, tenantOverrides)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v (available: %v)", err, storage.Backends())
+	}
+
+	// Initialize forwarding to a downstream collector, if configured
+	var processorOpts []ingestion.ProcessorOption
+	var fwd *forwarder.Forwarder
+	if cfg.Forwarder.Endpoint != "" {
+		fwd = forwarder.New(forwarder.Config{
+			Endpoint:      cfg.Forwarder.Endpoint,
+			Protocol:      forwarder.Protocol(cfg.Forwarder.Protocol),
+			BatchSize:     cfg.Forwarder.BatchSize,
+			FlushInterval: cfg.Forwarder.FlushInterval,
+			MaxRetries:    cfg.Forwarder.MaxRetries,
+		})
+		processorOpts = append(processorOpts, ingestion.WithForwarder(fwd))
+		log.Printf("Forwarding spans to %s (%s)", cfg.Forwarder.Endpoint, cfg.Forwarder.Protocol)
+	}
 
-	// Initialize storage
-	spanStore := storage.NewSpanStore(cfg.Storage.MaxSpans, cfg.Storage.SpanTTL)
-	metricStore := storage.NewMetricStore(cfg.Storage.MaxMetrics, cfg.Storage.MetricTTL)
+	var router *cluster.Router
+	if membership != nil && ingest {
+		router = cluster.NewRouter(membership, cluster.RouterConfig{
+			Token:         cfg.Cluster.Token,
+			FlushInterval: cfg.Cluster.FlushInterval,
+			Timeout:       cfg.Cluster.Timeout,
+		})
+		processorOpts = append(processorOpts, ingestion.WithRouter(router))
+		log.Printf("Cluster frontend routing spans to %d shards", len(membership.Ring().Members()))
+	}
+
+	var replicator *replication.Replicator
+	if len(cfg.Replication.Peers) > 0 {
+		replicator = replication.New(replication.Config{
+			Peers:     cfg.Replication.Peers,
+			Token:     cfg.Replication.Token,
+			QueueSize: cfg.Replication.QueueSize,
+			Timeout:   cfg.Replication.Timeout,
+		})
+		processorOpts = append(processorOpts, ingestion.WithReplicator(replicator))
+		log.Printf("Replicating spans to %s", strings.Join(cfg.Replication.Peers, ", "))
+	}
 
 	// Initialize ingestion
-	processor := ingestion.NewProcessor(spanStore, metricStore)
-	ingestionServer := ingestion.NewServer(processor)
+	processorOpts = append(processorOpts, ingestion.WithValidator(ingestion.NewValidator(ingestion.ValidatorConfig{
+		MaxFutureSkew:     cfg.Ingestion.MaxFutureSkew,
+		MaxSpanAge:        cfg.Ingestion.MaxSpanAge,
+		LateThreshold:     cfg.Ingestion.LateSpanThreshold,
+		MaxTagValueLength: cfg.Ingestion.MaxTagValueLength,
+		MaxTags:           cfg.Ingestion.MaxTags,
+	})))
+	processorOpts = append(processorOpts, ingestion.WithWriteQueueSize(cfg.Ingestion.WriteQueueSize))
+	if ingest && cfg.Ingestion.SpillDir != "" {
+		spill, err := ingestion.NewSpill(cfg.Ingestion.SpillDir, cfg.Ingestion.SpillMaxBytes)
+		if err != nil {
+			log.Fatalf("Failed to open spill directory: %v", err)
+		}
+		processorOpts = append(processorOpts, ingestion.WithSpill(spill))
+		log.Printf("Spilling span batches to %s when write queues are full", cfg.Ingestion.SpillDir)
+	}
+	if cfg.Ingestion.SpanMetrics {
+		processorOpts = append(processorOpts, ingestion.WithSpanMetrics(ingestion.NewSpanMetrics()))
+	}
+	if len(cfg.Redaction.Keys) > 0 || len(cfg.Redaction.Patterns) > 0 {
+		redactor, err := ingestion.NewRedactor(ingestion.RedactorConfig{
+			Keys:     cfg.Redaction.Keys,
+			Patterns: cfg.Redaction.Patterns,
+			Mode:     ingestion.RedactMode(cfg.Redaction.Mode),
+			Salt:     cfg.Redaction.Salt,
+		})
+		if err != nil {
+			log.Fatalf("Invalid redaction config: %v", err)
+		}
+		processorOpts = append(processorOpts, ingestion.WithRedactor(redactor))
+	}
+	tailHub := tail.NewHub()
+	processorOpts = append(processorOpts, ingestion.WithObserver(tailHub))
+	reg := telemetry.NewRegistry()
+	processorOpts = append(processorOpts, ingestion.WithObserver(reg.IngestMeter()))
+	// SLOs and their counts are kept with the data when storage is
+	// persistent
+	persistent := cfg.Storage.DataDir != "" && (cfg.Storage.WAL || cfg.Storage.Backend == storage.BadgerBackend)
+	slosPath := ""
+	if persistent {
+		slosPath = filepath.Join(cfg.Storage.DataDir, "slos.json")
+	}
+	slos, err := slo.NewTracker(slosPath)
+	if err != nil {
+		log.Printf("SLOs failed to load: %v", err)
+		slos, _ = slo.NewTracker("")
+	}
+	processorOpts = append(processorOpts, ingestion.WithObserver(slos))
+	processor := ingestion.NewProcessor(stores, processorOpts...)
+	// Managed API tokens come with dashboard authentication, whose admins
+	// create them
+	authEnabled := cfg.Auth.UsersFile != "" || cfg.Auth.OIDCIssuer != ""
+	var apiTokens *auth.TokenStore
+	if authEnabled {
+		tokensPath := ""
+		if persistent {
+			tokensPath = filepath.Join(cfg.Storage.DataDir, "tokens.json")
+		}
+		apiTokens, err = auth.NewTokenStore(tokensPath)
+		if err != nil {
+			log.Fatalf("Failed to load API tokens: %v", err)
+		}
+	}
+	var ingestAuth *ingestion.TokenAuthenticator
+	if len(cfg.Ingestion.Tokens) > 0 || cfg.Ingestion.RequireToken {
+		tokens := make(map[string]ingestion.Identity, len(cfg.Ingestion.Tokens))
+		for _, t := range cfg.Ingestion.Tokens {
+			sources, err := ingestion.ParseSources(t.Sources)
+			if err != nil {
+				log.Fatalf("Invalid ingestion token sources: %v", err)
+			}
+			tokens[t.Token] = ingestion.Identity{Service: t.Service, Tenant: t.Tenant, Sources: sources, Replicate: t.Replicate}
+		}
+		var lookups []ingestion.TokenLookup
+		if apiTokens != nil {
+			lookups = append(lookups, func(token string) (ingestion.Identity, bool) {
+				if t, ok := apiTokens.Authenticate(token, models.TokenScopeReplicate); ok {
+					return ingestion.Identity{Service: t.Service, Tenant: t.Tenant, Replicate: true}, true
+				}
+				t, ok := apiTokens.Authenticate(token, models.TokenScopeIngest)
+				return ingestion.Identity{Service: t.Service, Tenant: t.Tenant}, ok
+			})
+		}
+		ingestAuth = ingestion.NewTokenAuthenticator(tokens, lookups...)
+	}
+	allowedSources, err := ingestion.ParseSources(cfg.Ingestion.AllowedSources)
+	if err != nil {
+		log.Fatalf("Invalid ingestion allowed sources: %v", err)
+	}
+	sourceFilter := ingestion.NewSourceFilter(allowedSources)
+	ingestQueue := ingestion.NewQueue(cfg.Ingestion.QueueSize, cfg.Ingestion.Workers)
+	tenantQuotas := make(map[string]ingestion.Quota, len(cfg.Ingestion.TenantQuotas))
+	for tenant, q := range cfg.Ingestion.TenantQuotas {
+		tenantQuotas[tenant] = ingestion.Quota(q)
+	}
+	quotas := ingestion.NewQuotas(ingestion.Quota(cfg.Ingestion.Quota), tenantQuotas)
+	var idempotency *ingestion.Idempotency
+	if cfg.Ingestion.IdempotencyTTL > 0 {
+		idempotency = ingestion.NewIdempotency(cfg.Ingestion.IdempotencyTTL, cfg.Ingestion.IdempotencyMaxKeys)
+	}
+	ingestionServer := ingestion.NewServer(processor,
+		ingestion.WithMaxBodyBytes(cfg.Ingestion.MaxBodyBytes),
+		ingestion.WithTokenAuth(ingestAuth),
+		ingestion.WithQueue(ingestQueue),
+		ingestion.WithQuotas(quotas),
+		ingestion.WithSourceFilter(sourceFilter),
+		ingestion.WithIdempotency(idempotency),
+	)
+
+	// Initialize the cold archive, if configured
+	var archiver *archive.Archiver
+	if cfg.Archive.Target != "" {
+		objects, err := archive.OpenObjectStore(cfg.Archive.Target, archive.S3Config{
+			Region:          cfg.Archive.S3Region,
+			Endpoint:        cfg.Archive.S3Endpoint,
+			AccessKeyID:     cfg.Archive.AccessKeyID,
+			SecretAccessKey: cfg.Archive.SecretAccessKey,
+			SessionToken:    cfg.Archive.SessionToken,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open archive: %v", err)
+		}
+		if cfg.Archive.After >= cfg.Storage.SpanTTL {
+			log.Printf("Warning: archive age %s is not below the span TTL %s; traces may expire unarchived", cfg.Archive.After, cfg.Storage.SpanTTL)
+		}
+		archiver = archive.New(stores, objects, archive.Config{
+			After:    cfg.Archive.After,
+			Interval: cfg.Archive.Interval,
+		})
+		log.Printf("Archiving traces older than %s to %s", cfg.Archive.After, cfg.Archive.Target)
+	}
+
+	// Initialize the trace history, if configured
+	var traceHistory *history.History
+	if cfg.History.Retention > 0 {
+		if cfg.History.After >= cfg.Storage.SpanTTL {
+			log.Printf("Warning: history compaction age %s is not below the span TTL %s; traces may expire uncompacted", cfg.History.After, cfg.Storage.SpanTTL)
+		}
+		traceHistory, err = history.New(stores, history.Config{
+			Dir:       filepath.Join(cfg.Storage.DataDir, "history"),
+			After:     cfg.History.After,
+			Interval:  cfg.History.Interval,
+			Retention: cfg.History.Retention,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open trace history: %v", err)
+		}
+		log.Printf("Keeping trace history for %s", cfg.History.Retention)
+	}
+
+	var alerts *alerting.Engine
+	if cfg.Alerting.RulesFile != "" {
+		rules, err := alerting.LoadRules(cfg.Alerting.RulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load alert rules: %v", err)
+		}
+		// Silences are kept with the data when storage is persistent
+		silencesPath := ""
+		if persistent {
+			silencesPath = filepath.Join(cfg.Storage.DataDir, "silences.json")
+		}
+		silences, err := alerting.NewSilences(silencesPath)
+		if err != nil {
+			log.Printf("Alert silences failed to load: %v", err)
+			silences, _ = alerting.NewSilences("")
+		}
+		alertConfig := alerting.Config{
+			Interval:       cfg.Alerting.Interval,
+			GroupBy:        cfg.Alerting.GroupBy,
+			RepeatInterval: cfg.Alerting.RepeatInterval,
+			Silences:       silences,
+			SLOs:           slos,
+		}
+		if cfg.Alerting.Webhook != "" {
+			alertConfig.Notifier = alerting.NewWebhookNotifier(cfg.Alerting.Webhook)
+		}
+		alerts = alerting.New(stores, rules, alertConfig)
+		log.Printf("Evaluating %d alert rules every %s", len(rules), cfg.Alerting.Interval)
+	}
+
+	// Initialize dashboard authentication, if configured
+	var authenticator *auth.Authenticator
+	if authEnabled {
+		authConfig := auth.Config{
+			SessionTTL:    cfg.Auth.SessionTTL,
+			SecureCookies: cfg.Auth.SecureCookies,
+			Tokens:        apiTokens,
+			Admins:        cfg.Auth.Admins,
+		}
+		if cfg.Auth.UsersFile != "" {
+			users, err := auth.LoadUsers(cfg.Auth.UsersFile)
+			if err != nil {
+				log.Fatalf("Failed to load users: %v", err)
+			}
+			authConfig.Users = users
+			log.Printf("Dashboard login enabled for %d users", users.Len())
+		}
+		if cfg.Auth.OIDCIssuer != "" {
+			oidc, err := auth.NewOIDC(context.Background(), auth.OIDCConfig{
+				Issuer:         cfg.Auth.OIDCIssuer,
+				ClientID:       cfg.Auth.OIDCClientID,
+				ClientSecret:   cfg.Auth.OIDCClientSecret,
+				RedirectURL:    cfg.Auth.OIDCRedirectURL,
+				AllowedUsers:   cfg.Auth.OIDCAllowedUsers,
+				AllowedDomains: cfg.Auth.OIDCAllowedDomains,
+			})
+			if err != nil {
+				log.Fatalf("Failed to set up SSO: %v", err)
+			}
+			authConfig.OIDC = oidc
+			log.Printf("Dashboard SSO enabled with %s", cfg.Auth.OIDCIssuer)
+		}
+		authenticator = auth.New(authConfig)
+	}
 
 	// Initialize dashboard
 	// Assuming static files are in ./backend/dashboard/static
-	dashboardServer := dashboard.NewServer(spanStore, metricStore, "./backend/dashboard/static")
+	dashboardServer := dashboard.NewServer(stores, "./backend/dashboard/static",
+		dashboard.WithRequireTenant(cfg.Tenancy.RequireTenant),
+		dashboard.WithArchive(archiver),
+		dashboard.WithHistory(traceHistory),
+		dashboard.WithLiveTail(tailHub, cfg.Dashboard.TailMaxRate),
+		dashboard.WithTelemetry(reg),
+		dashboard.WithAlerts(alerts),
+		dashboard.WithSLOs(slos),
+		dashboard.WithAuth(authenticator),
+		dashboard.WithCluster(shards),
+		dashboard.WithQuotas(quotas),
+	)
+
+	// Self-telemetry
+	reg.Register("processor", telemetry.Processor(processor))
+	reg.Register("queue", telemetry.Queue(ingestQueue))
+	reg.Register("stores", telemetry.Stores(stores))
+	reg.Register("live_tail", telemetry.LiveTail(tailHub))
+	if fwd != nil {
+		reg.Register("forwarder", telemetry.Forwarder(fwd))
+	}
+	if router != nil {
+		reg.Register("cluster", telemetry.Cluster(router))
+	}
+	if replicator != nil {
+		reg.Register("replication", telemetry.Replication(replicator))
+	}
+	if archiver != nil {
+		reg.Register("archive", telemetry.Archive(archiver))
+	}
+	if traceHistory != nil {
+		reg.Register("history", telemetry.History(traceHistory))
+	}
 
 	// Setup HTTP server
 	mux := http.NewServeMux()
 
 	// Register routes
-	ingestionServer.RegisterRoutes(mux)
-	dashboardServer.RegisterRoutes(mux)
+	if ingest {
+		ingestionServer.RegisterRoutes(mux)
+		dashboardServer.RegisterShardRoutes(mux)
+		dashboardServer.RegisterIngestRoutes(mux, ingestionServer)
+	}
+	if query {
+		dashboardServer.RegisterRoutes(mux)
+	}
+	mux.HandleFunc("GET /metrics", reg.MetricsHandler())
+	statusHandler := reg.StatusHandler()
+	if authenticator != nil {
+		statusHandler = authenticator.RequireFunc(statusHandler)
+	}
+	mux.HandleFunc("GET /api/status", statusHandler)
+
+	// Kubernetes probes, open like /metrics
+	health := telemetry.NewHealth()
+	health.AddCheck("storage", telemetry.StoresReady(stores))
+	if ingest {
+		health.AddCheck("ingestion_queue", telemetry.QueueReady(ingestQueue))
+	}
+	if fwd != nil {
+		health.AddCheck("forwarder", telemetry.ForwarderReady(fwd))
+	}
+	mux.HandleFunc("GET /healthz", health.LivenessHandler())
+	mux.HandleFunc("GET /readyz", health.ReadinessHandler())
+
+	var handler http.Handler = mux
+	var selfTracer *selftrace.Tracer
+	if cfg.SelfTrace.Enabled {
+		endpoint := cfg.SelfTrace.Endpoint
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("http://127.0.0.1:%d", cfg.Server.Port)
+			if cfg.Server.TLS.Enabled() {
+				// The certificate has to cover localhost
+				endpoint = fmt.Sprintf("https://localhost:%d", cfg.Server.Port)
+			}
+		}
+		selfTracer = selftrace.New(selftrace.Config{
+			Endpoint:    endpoint,
+			Token:       cfg.SelfTrace.Token,
+			ServiceName: cfg.SelfTrace.ServiceName,
+			SampleRate:  cfg.SelfTrace.SampleRate,
+		})
+		handler = selfTracer.Handler(mux)
+		log.Printf("Tracing %.0f%% of requests to %s", cfg.SelfTrace.SampleRate*100, endpoint)
+	}
+
+	handler = dashboard.Headers(handler, dashboard.CORSConfig{
+		AllowedOrigins: cfg.Server.CORS.AllowedOrigins,
+		AllowedMethods: cfg.Server.CORS.AllowedMethods,
+		AllowedHeaders: cfg.Server.CORS.AllowedHeaders,
+	})
 
 	server := &http.Server{
 		Addr:         cfg.GetServerAddr(),
-		Handler:      mux,
+		Handler:      handler,
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 	}
+	// Live tail streams end on shutdown rather than holding the server
+	// open, while other requests drain
+	server.RegisterOnShutdown(dashboardServer.Shutdown)
+
+	// Serve TLS with certificates from files or an ACME CA, if configured
+	var certFiles *certs.FileSource
+	var acmeServer *http.Server
+	switch tlsCfg := cfg.Server.TLS; {
+	case tlsCfg.CertFile != "":
+		certFiles, err = certs.NewFileSource(tlsCfg.CertFile, tlsCfg.KeyFile, certs.DefaultReloadInterval)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certFiles.GetCertificate, MinVersion: tls.VersionTLS12}
+	case len(tlsCfg.ACMEDomains) > 0:
+		cacheDir := tlsCfg.ACMECacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(cfg.Storage.DataDir, "acme")
+		}
+		acme, err := certs.NewACME(certs.ACMEConfig{
+			Domains:      tlsCfg.ACMEDomains,
+			Email:        tlsCfg.ACMEEmail,
+			DirectoryURL: tlsCfg.ACMEDirectory,
+			CacheDir:     cacheDir,
+			AcceptTOS:    tlsCfg.ACMEAcceptTOS,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up ACME: %v", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: acme.GetCertificate, MinVersion: tls.VersionTLS12}
+		acmeServer = &http.Server{Addr: tlsCfg.ACMEHTTPAddr, Handler: acme.HTTPHandler(nil), ReadTimeout: 10 * time.Second}
+		go func() {
+			log.Printf("ACME challenge server listening on %s", tlsCfg.ACMEHTTPAddr)
+			if err := acmeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("ACME challenge server failed: %v", err)
+			}
+		}()
+	}
+
+	// Start OTLP/gRPC receiver
+	var grpcServer *grpc.Server
+	if ingest && cfg.OTLP.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.OTLP.GRPCAddr)
+		if err != nil {
+			log.Fatalf("OTLP gRPC listen failed: %v", err)
+		}
+		grpcServer = grpc.NewServer(ingestion.ServerOptions(ingestAuth, sourceFilter)...)
+		ingestion.NewOTLPGRPCServer(processor, ingestQueue, quotas).Register(grpcServer)
+		go func() {
+			log.Printf("OTLP gRPC receiver listening on %s", cfg.OTLP.GRPCAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatalf("OTLP gRPC server failed: %v", err)
+			}
+		}()
+	}
 
 	// Start server
 	go func() {
-		log.Printf("OmniTrace server starting on %s", cfg.GetServerAddr())
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("OmniTrace server starting on %s with TLS", cfg.GetServerAddr())
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("OmniTrace server starting on %s", cfg.GetServerAddr())
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed: %v", err)
 		}
 	}()
@@ -57,5 +549,78 @@ func main() {
 	<-stop
 
 	log.Println("Shutting down server...")
-	server.Close()
+	health.ShutDown()
+	if cfg.Server.ShutdownDelay > 0 {
+		log.Printf("Draining for %s before closing connections", cfg.Server.ShutdownDelay)
+		time.Sleep(cfg.Server.ShutdownDelay)
+	}
+	if selfTracer != nil {
+		selfTracer.Close()
+	}
+
+	// Stop taking requests and let in-flight ones, then the ingestion
+	// they queued, finish within the shutdown timeout
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown incomplete: %v", err)
+		server.Close()
+	}
+	if acmeServer != nil {
+		acmeServer.Close()
+	}
+	if certFiles != nil {
+		certFiles.Close()
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
+	if err := ingestQueue.Shutdown(ctx); err != nil {
+		log.Printf("Ingestion queue not drained: %v", err)
+	}
+	processor.Close()
+
+	if router != nil {
+		if err := router.Close(); err != nil {
+			log.Printf("Cluster routing flush failed: %v", err)
+		}
+		membership.Close()
+	}
+	if replicator != nil {
+		if err := replicator.Close(); err != nil {
+			log.Printf("Replication flush failed: %v", err)
+		}
+	}
+	if fwd != nil {
+		if err := fwd.Close(); err != nil {
+			log.Printf("Forwarder flush failed: %v", err)
+		}
+	}
+	if archiver != nil {
+		archiver.Close()
+	}
+	if traceHistory != nil {
+		traceHistory.Close()
+	}
+	if alerts != nil {
+		alerts.Close()
+	}
+	slos.Close()
+	if apiTokens != nil {
+		apiTokens.Close()
+	}
+	// Closing the stores writes their final snapshots
+	if err := stores.Close(); err != nil {
+		log.Printf("Storage close failed: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
@@ -23,6 +23,7 @@ func main() {
 		CollectorURL:  collectorURL,
 		BatchSize:     10,
 		FlushInterval: 1 * time.Second,
+		Encoding:      sdk.Encoding(os.Getenv("OMNITRACE_EXPORT_ENCODING")),
 		OnError:       func(err error) { log.Printf("Exporter error: %v", err) },
 	})
 
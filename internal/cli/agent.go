@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/omnitrace/omnitrace/backend/agent"
+)
+
+// agentShutdownTimeout bounds how long the agent keeps sending queued data
+// once interrupted
+const agentShutdownTimeout = 30 * time.Second
+
+// runAgent receives spans, metrics and errors from local SDKs and forwards
+// them to the collector given by --server until interrupted
+func runAgent(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("agent", stderr)
+	socket := fs.String("socket", filepath.Join(os.TempDir(), "omnitrace-agent.sock"), `Unix socket serving the ingestion API to SDKs ("" to disable)`)
+	udpAddr := fs.String("udp", "127.0.0.1:10002", `address receiving UDP datagrams from SDKs ("" to disable)`)
+	batchSize := fs.Int("batch-size", 500, "maximum spans, metrics or errors per request to the collector")
+	flushInterval := fs.Duration("flush-interval", time.Second, "maximum time data waits to be sent")
+	maxRetries := fs.Int("max-retries", 3, "retries of a failed request before its data waits for the next flush")
+	queueSize := fs.Int("queue-size", 50000, "spans, metrics or errors each held while the collector is unreachable")
+	compress := fs.Bool("compress", true, "gzip requests to the collector")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace agent [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	a := agent.New(agent.Config{
+		Collector:     c.server,
+		Token:         c.token,
+		Tenant:        c.tenant,
+		Socket:        *socket,
+		UDPAddr:       *udpAddr,
+		BatchSize:     *batchSize,
+		FlushInterval: *flushInterval,
+		MaxRetries:    *maxRetries,
+		QueueSize:     *queueSize,
+		Compress:      *compress,
+	})
+	if err := a.Start(); err != nil {
+		return err
+	}
+	log.Printf("Agent listening on %s", a)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Printf("Agent shutting down, sending queued data...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), agentShutdownTimeout)
+	defer cancel()
+	if err := a.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	log.Printf("Agent stopped")
+	return nil
+}
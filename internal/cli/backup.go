@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// importResult is the response of the import API
+type importResult struct {
+	Spans       int `json:"spans"`
+	StoredSpans int `json:"stored_spans"`
+	Metrics     int `json:"metrics"`
+}
+
+// runExport writes a tenant's recent spans and metrics to a backup file of
+// newline-delimited JSON records, gzipped when the file name ends in .gz
+func runExport(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("export", stderr)
+	since := fs.Duration("since", 24*time.Hour, "how far back to export")
+	out := fs.String("out", "-", "backup file, gzipped if it ends in .gz, or - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace export [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 || *since <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	params := url.Values{}
+	params.Set("lookback", since.String())
+	req, err := c.newRequest(context.Background(), http.MethodGet, "/api/export", params, nil)
+	if err != nil {
+		return err
+	}
+	// Exports have no overall timeout, unlike other requests
+	resp, err := (&http.Client{Transport: c.http.Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &apiError{status: resp.Status, code: resp.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+
+	w := stdout
+	var file *os.File
+	if *out != "-" {
+		if file, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	var zw *gzip.Writer
+	if strings.HasSuffix(*out, ".gz") {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+
+	records := &lineCounter{w: w}
+	if _, err := io.Copy(records, resp.Body); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "Exported %d records to %s\n", records.lines, *out)
+	}
+	return nil
+}
+
+// runImport restores a backup written by export into the collector
+func runImport(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("import", stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace import [flags] <file>")
+		fmt.Fprintln(stderr, "The file may be gzipped, or - to read standard input.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	// Gzipped backups are sent as they are, for the collector to decompress
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(len(gzipMagic))
+
+	req, err := c.newRequest(context.Background(), http.MethodPost, "/api/v1/import", nil, br)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if bytes.Equal(magic, gzipMagic) {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := (&http.Client{Transport: c.http.Transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &apiError{status: resp.Status, code: resp.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+
+	var result importResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	_, err = fmt.Fprintf(stdout, "Imported %d spans (%d new) and %d metric points\n", result.Spans, result.StoredSpans, result.Metrics)
+	return err
+}
+
+// lineCounter counts the lines written through it
+type lineCounter struct {
+	w     io.Writer
+	lines int
+}
+
+func (l *lineCounter) Write(p []byte) (int, error) {
+	l.lines += bytes.Count(p, []byte{'\n'})
+	return l.w.Write(p)
+}
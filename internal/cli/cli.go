@@ -0,0 +1,185 @@
+// Package cli implements the omnitrace subcommands that search and fetch
+// traces from a running collector's query API and render them in the
+// terminal, as tables and waterfalls or as JSON, generate load, back up
+// and restore a collector's data, check its configuration, and run the
+// local agent that forwards SDK data to it.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// defaultServer is the collector the commands query when neither --server
+// nor OMNITRACE_URL is set
+const defaultServer = "http://localhost:10001"
+
+// Commands are the names of the subcommands Run handles
+var Commands = []string{"query", "get", "tail", "tracegen", "export", "import", "config", "agent"}
+
+// errUsage is returned for invalid arguments, once they are reported
+var errUsage = errors.New("usage")
+
+// apiError is an error response of the collector
+type apiError struct {
+	status  string
+	code    int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.status + ": " + e.message
+}
+
+// client calls the query API of a collector
+type client struct {
+	server string
+	token  string
+	tenant string
+	http   *http.Client
+}
+
+// Run runs the subcommand named by args[0] with the rest of args and
+// returns the process exit code
+func Run(args []string, stdout, stderr io.Writer) int {
+	var err error
+	switch args[0] {
+	case "query":
+		err = runQuery(args[1:], stdout, stderr)
+	case "get":
+		err = runGet(args[1:], stdout, stderr)
+	case "tail":
+		err = runTail(args[1:], stdout, stderr)
+	case "tracegen":
+		err = runTracegen(args[1:], stdout, stderr)
+	case "export":
+		err = runExport(args[1:], stdout, stderr)
+	case "import":
+		err = runImport(args[1:], stdout, stderr)
+	case "config":
+		err = runConfig(args[1:], stdout, stderr)
+	case "agent":
+		err = runAgent(args[1:], stdout, stderr)
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		fmt.Fprintf(stderr, "omnitrace %s: %v\n", args[0], err)
+		return 1
+	}
+}
+
+// newFlagSet returns the flags of a subcommand, including those shared by
+// all of them
+func newFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *client) {
+	fs := flag.NewFlagSet("omnitrace "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	c := &client{http: &http.Client{Timeout: 30 * time.Second}}
+	server := os.Getenv("OMNITRACE_URL")
+	if server == "" {
+		server = defaultServer
+	}
+	fs.StringVar(&c.server, "server", server, "collector URL (env OMNITRACE_URL)")
+	fs.StringVar(&c.token, "token", os.Getenv("OMNITRACE_TOKEN"), "API token, when the collector requires auth (env OMNITRACE_TOKEN)")
+	fs.StringVar(&c.tenant, "tenant", os.Getenv("OMNITRACE_TENANT"), "tenant to query (env OMNITRACE_TENANT)")
+	return fs, c
+}
+
+// outputFlag adds the --output flag of the commands that print API data
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "table", "output format: table or json")
+}
+
+// get fetches path from the query API. A non-nil out receives the decoded
+// JSON response; otherwise the body is returned as is.
+func (c *client) get(path string, params url.Values, out any) ([]byte, error) {
+	req, err := c.newRequest(context.Background(), http.MethodGet, path, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &apiError{status: resp.Status, code: resp.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return nil, fmt.Errorf("invalid response: %w", err)
+		}
+	}
+	return body, nil
+}
+
+func (c *client) newRequest(ctx context.Context, method, path string, params url.Values, body io.Reader) (*http.Request, error) {
+	u := strings.TrimRight(c.server, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.tenant != "" {
+		req.Header.Set(models.TenantHeader, c.tenant)
+	}
+	return req, nil
+}
+
+// writeJSON writes a response body indented
+func writeJSON(w io.Writer, body []byte) error {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// checkOutput validates the --output flag
+func checkOutput(output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("invalid output %q: want table or json", output)
+	}
+	return nil
+}
+
+// formatDuration rounds a duration for display
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/omnitrace/omnitrace/internal/config"
+)
+
+// runConfig checks or prints the configuration a collector would start
+// with, from the same config file and environment
+func runConfig(args []string, stdout, stderr io.Writer) error {
+	usage := func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace config validate|print [flags]")
+	}
+	if len(args) == 0 {
+		usage()
+		return errUsage
+	}
+
+	fs := flag.NewFlagSet("omnitrace config "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("config", os.Getenv("OMNITRACE_CONFIG"), "YAML or TOML configuration file (env OMNITRACE_CONFIG)")
+	var showSecrets *bool
+	switch args[0] {
+	case "validate":
+	case "print":
+		showSecrets = fs.Bool("show-secrets", false, "print tokens, keys and salts instead of masking them")
+	default:
+		usage()
+		return errUsage
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: omnitrace config %s [flags]\n", args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	cfg, err := config.Load(*file)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	if showSecrets == nil {
+		source := "defaults and environment"
+		if *file != "" {
+			source = *file
+		}
+		_, err := fmt.Fprintf(stdout, "Configuration is valid (%s)\n", source)
+		return err
+	}
+	if !*showSecrets {
+		cfg = cfg.Redacted()
+	}
+	enc := yaml.NewEncoder(stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// waterfallWidth is the width of the timeline column, in characters
+const waterfallWidth = 40
+
+// runGet prints one trace as a waterfall of its spans
+func runGet(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("get", stderr)
+	output := outputFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace get [flags] <trace-id>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	if err := checkOutput(*output); err != nil {
+		return err
+	}
+
+	var trace models.Trace
+	body, err := c.get("/api/traces/"+url.PathEscape(fs.Arg(0)), nil, &trace)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(stdout, body)
+	}
+	return writeWaterfall(stdout, &trace)
+}
+
+// writeWaterfall prints a trace's summary line, then its spans in tree
+// order with their offset, duration and position on the trace's timeline
+func writeWaterfall(w io.Writer, trace *models.Trace) error {
+	status := "ok"
+	if trace.HasError {
+		status = "error"
+	}
+	if trace.Partial {
+		status += ", partial"
+	}
+	if trace.Truncated {
+		status += ", truncated"
+	}
+	fmt.Fprintf(w, "Trace %s  %s  %s  %d spans  %s  (%s)\n\n",
+		trace.TraceID, trace.StartTime.Local().Format(time.DateTime), formatDuration(trace.Duration),
+		trace.SpanCount, strings.Join(trace.Services, ", "), status)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SPAN\tSERVICE\tOFFSET\tDURATION\tTIMELINE")
+	for _, row := range spanTree(trace.Spans) {
+		span := row.span
+		name := strings.Repeat("  ", row.depth) + span.OperationName
+		if span.Status == models.SpanStatusError {
+			name += " !"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			name, span.ServiceName, formatDuration(span.StartTime.Sub(trace.StartTime)),
+			formatDuration(span.Duration), timelineBar(trace, span))
+	}
+	return tw.Flush()
+}
+
+type spanRow struct {
+	span  *models.Span
+	depth int
+}
+
+// spanTree orders spans depth first, children by start time. Spans whose
+// parent is missing are shown as roots.
+func spanTree(spans []models.Span) []spanRow {
+	ids := make(map[models.SpanID]bool, len(spans))
+	for i := range spans {
+		ids[spans[i].SpanID] = true
+	}
+	children := make(map[models.SpanID][]*models.Span)
+	for i := range spans {
+		parent := spans[i].ParentSpanID
+		if !ids[parent] {
+			parent = models.SpanID{}
+		}
+		children[parent] = append(children[parent], &spans[i])
+	}
+	for _, list := range children {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].StartTime.Before(list[j].StartTime) })
+	}
+
+	rows := make([]spanRow, 0, len(spans))
+	var walk func(parent models.SpanID, depth int)
+	walk = func(parent models.SpanID, depth int) {
+		for _, span := range children[parent] {
+			rows = append(rows, spanRow{span: span, depth: depth})
+			walk(span.SpanID, depth+1)
+		}
+	}
+	walk(models.SpanID{}, 0)
+	return rows
+}
+
+// timelineBar draws a span's extent within the trace
+func timelineBar(trace *models.Trace, span *models.Span) string {
+	if trace.Duration <= 0 {
+		return strings.Repeat("=", waterfallWidth)
+	}
+	scale := float64(waterfallWidth) / float64(trace.Duration)
+	start := int(float64(span.StartTime.Sub(trace.StartTime)) * scale)
+	start = min(max(start, 0), waterfallWidth-1)
+	length := max(int(float64(span.Duration)*scale), 1)
+	length = min(length, waterfallWidth-start)
+	return strings.Repeat(" ", start) + strings.Repeat("=", length) + strings.Repeat(" ", waterfallWidth-start-length) + "|"
+}
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+type traceList struct {
+	Traces     []models.TraceSummary `json:"traces"`
+	NextCursor string                `json:"next_cursor"`
+}
+
+// runQuery lists the traces matching its flags, newest first
+func runQuery(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("query", stderr)
+	output := outputFlag(fs)
+	service := fs.String("service", "", "root service")
+	operation := fs.String("operation", "", "root operation")
+	errorsOnly := fs.Bool("error", false, "only traces with an error")
+	since := fs.Duration("since", 15*time.Minute, "how far back to search")
+	minDuration := fs.Duration("min-duration", 0, "minimum trace duration")
+	limit := fs.Int("limit", 20, "maximum number of traces")
+	traceQL := fs.String("q", "", `TraceQL query, e.g. {duration>500ms}, combined with the other flags`)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace query [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+	if err := checkOutput(*output); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("lookback", since.String())
+	params.Set("limit", strconv.Itoa(*limit))
+	if *service != "" {
+		params.Set("service", *service)
+	}
+	if *operation != "" {
+		params.Set("operation", *operation)
+	}
+	if *errorsOnly {
+		params.Set("error", "true")
+	}
+	if *minDuration > 0 {
+		params.Set("minDuration", minDuration.String())
+	}
+	path := "/api/traces"
+	if *traceQL != "" {
+		path = "/api/query"
+		params.Set("q", *traceQL)
+	}
+
+	var list traceList
+	body, err := c.get(path, params, &list)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(stdout, body)
+	}
+	return writeTraceTable(stdout, list.Traces)
+}
+
+func writeTraceTable(w io.Writer, traces []models.TraceSummary) error {
+	if len(traces) == 0 {
+		_, err := fmt.Fprintln(w, "No traces found")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TRACE ID\tSTART\tSERVICE\tOPERATION\tDURATION\tSPANS\tSTATUS")
+	for _, t := range traces {
+		status := "ok"
+		if t.HasError {
+			status = "error"
+		}
+		if t.Partial {
+			status += " (partial)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			t.TraceID, t.StartTime.Local().Format("15:04:05.000"), t.RootService, t.RootOperation,
+			formatDuration(t.Duration), t.SpanCount, status)
+	}
+	return tw.Flush()
+}
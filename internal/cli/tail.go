@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// tailMaxRate asks for as many traces per second as the collector allows
+// when following one trace, which the client filters for itself
+const tailMaxRate = 1000
+
+// streamEvent is one server-sent event
+type streamEvent struct {
+	name string
+	data string
+}
+
+// runTail prints traces as they receive new spans until interrupted, or
+// with --follow-trace, the new spans of one trace
+func runTail(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("tail", stderr)
+	output := outputFlag(fs)
+	service := fs.String("service", "", "only traces through this service")
+	errorsOnly := fs.Bool("errors-only", false, "only traces with an error")
+	minDuration := fs.Duration("min-duration", 0, "minimum trace duration")
+	rate := fs.Int("rate", 0, "maximum traces per second (default: the collector's default)")
+	followTrace := fs.String("follow-trace", "", "print the spans of this trace as they arrive instead of trace summaries")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace tail [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+	if err := checkOutput(*output); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	params := url.Values{}
+	if *followTrace != "" {
+		params.Set("rate", strconv.Itoa(tailMaxRate))
+		f := &traceFollower{client: c, traceID: *followTrace, seen: make(map[models.SpanID]bool), out: stdout, json: *output == "json"}
+		// Spans that arrived before the stream started
+		if err := f.update(); err != nil {
+			return err
+		}
+		return c.stream(ctx, params, func(event streamEvent) error {
+			switch event.name {
+			case "trace":
+				var summary models.TraceSummary
+				if err := json.Unmarshal([]byte(event.data), &summary); err != nil || summary.TraceID.String() != f.traceID {
+					return nil
+				}
+			case "dropped":
+				// The trace may have been among the dropped notifications
+			default:
+				return nil
+			}
+			return f.update()
+		})
+	}
+
+	if *service != "" {
+		params.Set("service", *service)
+	}
+	if *errorsOnly {
+		params.Set("error", "true")
+	}
+	if *minDuration > 0 {
+		params.Set("minDuration", minDuration.String())
+	}
+	if *rate > 0 {
+		params.Set("rate", strconv.Itoa(*rate))
+	}
+	return c.stream(ctx, params, func(event streamEvent) error {
+		switch {
+		case *output == "json":
+			if event.name == "trace" {
+				_, err := fmt.Fprintln(stdout, event.data)
+				return err
+			}
+		case event.name == "trace":
+			var summary models.TraceSummary
+			if err := json.Unmarshal([]byte(event.data), &summary); err != nil {
+				return fmt.Errorf("invalid trace event: %w", err)
+			}
+			status := "ok"
+			if summary.HasError {
+				status = "error"
+			}
+			_, err := fmt.Fprintf(stdout, "%s  %s  %-5s  %8s  %3d spans  %s %s\n",
+				summary.StartTime.Local().Format("15:04:05.000"), summary.TraceID, status,
+				formatDuration(summary.Duration), summary.SpanCount, summary.RootService, summary.RootOperation)
+			return err
+		case event.name == "dropped":
+			fmt.Fprintf(stderr, "(dropped traces: %s)\n", event.data)
+		}
+		return nil
+	})
+}
+
+// traceFollower prints the spans of a trace it hasn't printed yet
+type traceFollower struct {
+	client  *client
+	traceID string
+	seen    map[models.SpanID]bool
+	out     io.Writer
+	json    bool
+}
+
+func (f *traceFollower) update() error {
+	var trace models.Trace
+	_, err := f.client.get("/api/traces/"+url.PathEscape(f.traceID), nil, &trace)
+	if err != nil {
+		// The trace may not have arrived yet
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.code == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	for i := range trace.Spans {
+		span := &trace.Spans[i]
+		if f.seen[span.SpanID] {
+			continue
+		}
+		f.seen[span.SpanID] = true
+		if f.json {
+			data, err := json.Marshal(span)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(f.out, string(data))
+			continue
+		}
+		status := "ok"
+		if span.Status == models.SpanStatusError {
+			status = "error"
+		}
+		fmt.Fprintf(f.out, "%s  %s  %-5s  %8s  %s %s\n",
+			span.StartTime.Local().Format("15:04:05.000"), span.SpanID, status,
+			formatDuration(span.Duration), span.ServiceName, span.OperationName)
+	}
+	return nil
+}
+
+// stream reads the live tail stream, calling handle with each event, until
+// ctx is canceled or the collector closes the stream
+func (c *client) stream(ctx context.Context, params url.Values, handle func(streamEvent) error) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/traces/stream", params, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// Streams have no overall timeout, unlike other requests
+	resp, err := (&http.Client{Transport: c.http.Transport}).Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &apiError{status: resp.Status, code: resp.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var event streamEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event.name != "" || event.data != "" {
+				if event.name == "" {
+					event.name = "message"
+				}
+				if err := handle(event); err != nil {
+					return err
+				}
+			}
+			event = streamEvent{}
+		case strings.HasPrefix(line, ":"):
+			// Comment, such as a keepalive
+		case strings.HasPrefix(line, "event:"):
+			event.name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if event.data != "" {
+				event.data += "\n"
+			}
+			event.data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("stream closed by the collector")
+	}
+	return nil
+}
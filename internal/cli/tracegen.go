@@ -0,0 +1,393 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Load generation pacing: traces are generated and sent once per tick
+const (
+	tracegenTick           = 100 * time.Millisecond
+	tracegenReportInterval = 10 * time.Second
+)
+
+// tracegenServices are the services of the synthetic system, each with the
+// routes it serves. Calls go from a service to ones later in the list, so
+// the call graph has no cycles.
+var tracegenServices = []struct {
+	name   string
+	routes []string
+}{
+	{"frontend", []string{"GET /", "GET /product/{id}", "POST /cart", "POST /checkout"}},
+	{"checkout", []string{"PlaceOrder", "GetQuote"}},
+	{"cart", []string{"GetCart", "AddItem", "EmptyCart"}},
+	{"catalog", []string{"ListProducts", "GetProduct", "SearchProducts"}},
+	{"payments", []string{"Charge", "Refund"}},
+	{"shipping", []string{"GetQuote", "ShipOrder"}},
+	{"inventory", []string{"Reserve", "Release"}},
+	{"pricing", []string{"Convert", "GetPrice"}},
+	{"users", []string{"GetUser", "Authenticate"}},
+	{"notifications", []string{"SendEmail", "SendSMS"}},
+}
+
+// tracegenErrors are the failures of erroring spans
+var tracegenErrors = []models.ErrorInfo{
+	{Type: "TimeoutError", Message: "context deadline exceeded"},
+	{Type: "ConnectionError", Message: "connection refused"},
+	{Type: "ValidationError", Message: "invalid argument"},
+	{Type: "DatabaseError", Message: "deadlock detected"},
+}
+
+// tracegenConfig shapes the synthetic traffic
+type tracegenConfig struct {
+	services   int
+	depth      int
+	fanout     int
+	errorRatio float64
+}
+
+// tracegenStats counts what the generator sent, for its reports
+type tracegenStats struct {
+	traces   atomic.Int64
+	spans    atomic.Int64
+	metrics  atomic.Int64
+	rejected atomic.Int64 // Batches the collector rejected
+	failed   atomic.Int64 // Batches that couldn't be sent
+	skipped  atomic.Int64 // Traces not generated because sending fell behind
+}
+
+// runTracegen sends synthetic multi-service traces, and the request metrics
+// of their services, to the ingestion API at a steady rate
+func runTracegen(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("tracegen", stderr)
+	rate := fs.Float64("rate", 10, "traces per second")
+	duration := fs.Duration("duration", 0, "how long to run (default: until interrupted)")
+	services := fs.Int("services", 6, "number of services, up to "+strconv.Itoa(len(tracegenServices)))
+	depth := fs.Int("depth", 4, "maximum span depth")
+	fanout := fs.Int("fanout", 3, "maximum calls a span makes")
+	errorRatio := fs.Float64("error-ratio", 0.05, "fraction of traces with an error")
+	metrics := fs.Bool("metrics", true, "also send request metrics of each service")
+	workers := fs.Int("workers", 4, "concurrent ingestion requests")
+	seed := fs.Uint64("seed", 0, "random seed, for reproducible traffic (default: random)")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: omnitrace tracegen [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	switch {
+	case fs.NArg() > 0:
+		fs.Usage()
+		return errUsage
+	case *rate <= 0:
+		return fmt.Errorf("invalid rate %g: want a positive number", *rate)
+	case *services < 1 || *services > len(tracegenServices):
+		return fmt.Errorf("invalid services %d: want 1 to %d", *services, len(tracegenServices))
+	case *depth < 1:
+		return fmt.Errorf("invalid depth %d: want at least 1", *depth)
+	case *fanout < 1:
+		return fmt.Errorf("invalid fanout %d: want at least 1", *fanout)
+	case *errorRatio < 0 || *errorRatio > 1:
+		return fmt.Errorf("invalid error ratio %g: want 0 to 1", *errorRatio)
+	case *workers < 1:
+		return fmt.Errorf("invalid workers %d: want at least 1", *workers)
+	}
+	if *seed == 0 {
+		*seed = rand.Uint64()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	gen := &traceGenerator{
+		config: tracegenConfig{services: *services, depth: *depth, fanout: *fanout, errorRatio: *errorRatio},
+		rand:   rand.New(rand.NewPCG(*seed, *seed)),
+	}
+	var stats tracegenStats
+	batches := make(chan func(), *workers)
+	var wg sync.WaitGroup
+	for range *workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for send := range batches {
+				send()
+			}
+		}()
+	}
+
+	fmt.Fprintf(stderr, "Sending %g traces/s across %d services to %s (seed %d)\n", *rate, *services, c.server, *seed)
+	started := time.Now()
+	ticker := time.NewTicker(tracegenTick)
+	defer ticker.Stop()
+	report := time.NewTicker(tracegenReportInterval)
+	defer report.Stop()
+
+	var due float64
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-report.C:
+			stats.report(stderr, time.Since(started))
+		case now := <-ticker.C:
+			due += *rate * tracegenTick.Seconds()
+			n := int(due)
+			due -= float64(n)
+			if n == 0 {
+				continue
+			}
+
+			var spans []models.Span
+			for range n {
+				spans = append(spans, gen.trace(now)...)
+			}
+			var points []models.Metric
+			if *metrics {
+				points = requestMetrics(spans, now)
+			}
+			send := func() {
+				if !c.ingest("/api/v1/spans", models.SpanBatch{Spans: spans}, &stats) {
+					return
+				}
+				stats.traces.Add(int64(n))
+				stats.spans.Add(int64(len(spans)))
+				if len(points) > 0 && c.ingest("/api/v1/metrics", models.MetricBatch{Metrics: points}, &stats) {
+					stats.metrics.Add(int64(len(points)))
+				}
+			}
+			select {
+			case batches <- send:
+			default:
+				stats.skipped.Add(int64(n))
+			}
+		}
+	}
+	close(batches)
+	wg.Wait()
+	stats.report(stdout, time.Since(started))
+	return nil
+}
+
+// ingest posts a batch to the ingestion API, counting failures
+func (c *client) ingest(path string, batch any, stats *tracegenStats) bool {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		stats.failed.Add(1)
+		return false
+	}
+	req, err := c.newRequest(context.Background(), http.MethodPost, path, nil, bytes.NewReader(body))
+	if err != nil {
+		stats.failed.Add(1)
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		stats.failed.Add(1)
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		stats.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+func (s *tracegenStats) report(w io.Writer, elapsed time.Duration) {
+	traces := s.traces.Load()
+	fmt.Fprintf(w, "%s: %d traces (%.1f/s), %d spans, %d metric points sent; %d batches rejected, %d failed; %d traces skipped\n",
+		elapsed.Round(time.Second), traces, float64(traces)/elapsed.Seconds(), s.spans.Load(), s.metrics.Load(),
+		s.rejected.Load(), s.failed.Load(), s.skipped.Load())
+}
+
+// traceGenerator synthesizes traces through the services of the synthetic
+// system
+type traceGenerator struct {
+	config tracegenConfig
+	rand   *rand.Rand
+}
+
+// trace returns the spans of a trace ending at now
+func (g *traceGenerator) trace(now time.Time) []models.Span {
+	traceID := g.traceID()
+	root := g.rand.IntN(len(tracegenServices[0].routes))
+	var spans []models.Span
+	end := g.span(&spans, traceID, models.SpanID{}, 0, root, 1, now)
+
+	// Shift the trace back to end now
+	shift := now.Sub(end)
+	for i := range spans {
+		spans[i].StartTime = spans[i].StartTime.Add(shift)
+		spans[i].EndTime = spans[i].EndTime.Add(shift)
+	}
+
+	if g.rand.Float64() < g.config.errorRatio {
+		g.fail(spans)
+	}
+	return spans
+}
+
+// span appends a server span of service at depth, starting at start, with
+// the client spans of the calls it makes and their server spans, and
+// returns its end
+func (g *traceGenerator) span(spans *[]models.Span, traceID models.TraceID, parentID models.SpanID, service, route, depth int, start time.Time) time.Time {
+	svc := tracegenServices[service]
+	op := svc.routes[route]
+	s := models.Span{
+		TraceID:       traceID,
+		SpanID:        g.spanID(),
+		ParentSpanID:  parentID,
+		OperationName: op,
+		ServiceName:   svc.name,
+		Kind:          models.SpanKindServer,
+		StartTime:     start,
+		Status:        models.SpanStatusOK,
+		Tags:          map[string]string{"rpc.system": "grpc", "rpc.service": svc.name},
+	}
+	if service == 0 {
+		method, path, _ := strings.Cut(op, " ")
+		s.Tags = map[string]string{"http.method": method, "http.route": path, "http.status_code": "200"}
+	}
+	index := len(*spans)
+	*spans = append(*spans, s)
+
+	// Own work before, between and after calls, log-normally distributed
+	at := start.Add(g.latency(2 * time.Millisecond))
+	if depth < g.config.depth && service < g.config.services-1 {
+		// Entry points always call something; other services may not
+		calls := g.rand.IntN(g.config.fanout + 1)
+		if depth == 1 {
+			calls = 1 + g.rand.IntN(g.config.fanout)
+		}
+		for range calls {
+			callee := service + 1 + g.rand.IntN(g.config.services-service-1)
+			calleeRoute := g.rand.IntN(len(tracegenServices[callee].routes))
+			client := models.Span{
+				TraceID:       traceID,
+				SpanID:        g.spanID(),
+				ParentSpanID:  s.SpanID,
+				OperationName: tracegenServices[callee].routes[calleeRoute],
+				ServiceName:   svc.name,
+				Kind:          models.SpanKindClient,
+				StartTime:     at,
+				Status:        models.SpanStatusOK,
+				Tags:          map[string]string{"peer.service": tracegenServices[callee].name},
+			}
+			clientIndex := len(*spans)
+			*spans = append(*spans, client)
+			// Network time on each side of the call
+			calleeEnd := g.span(spans, traceID, client.SpanID, callee, calleeRoute, depth+1, at.Add(g.latency(200*time.Microsecond)))
+			at = calleeEnd.Add(g.latency(200 * time.Microsecond))
+			(*spans)[clientIndex].EndTime = at
+			(*spans)[clientIndex].Duration = at.Sub(client.StartTime)
+			at = at.Add(g.latency(500 * time.Microsecond))
+		}
+	}
+	end := at.Add(g.latency(time.Millisecond))
+	(*spans)[index].EndTime = end
+	(*spans)[index].Duration = end.Sub(start)
+	return end
+}
+
+// fail makes a random span fail, and the spans it was called by
+func (g *traceGenerator) fail(spans []models.Span) {
+	failure := tracegenErrors[g.rand.IntN(len(tracegenErrors))]
+	byID := make(map[models.SpanID]int, len(spans))
+	for i := range spans {
+		byID[spans[i].SpanID] = i
+	}
+	i := g.rand.IntN(len(spans))
+	spans[i].ErrorInfo = &failure
+	for ok := true; ok; i, ok = byID[spans[i].ParentSpanID] {
+		spans[i].Status = models.SpanStatusError
+		spans[i].StatusMessage = failure.Message
+		if spans[i].Tags["http.status_code"] != "" {
+			spans[i].Tags["http.status_code"] = "500"
+		}
+	}
+}
+
+// latency returns a log-normal duration with the given median
+func (g *traceGenerator) latency(median time.Duration) time.Duration {
+	return time.Duration(float64(median) * math.Exp(g.rand.NormFloat64()*0.5))
+}
+
+// traceID returns a random trace ID
+func (g *traceGenerator) traceID() models.TraceID {
+	var id models.TraceID
+	binary.BigEndian.PutUint64(id[:8], g.rand.Uint64())
+	binary.BigEndian.PutUint64(id[8:], g.rand.Uint64())
+	return id
+}
+
+// spanID returns a random span ID
+func (g *traceGenerator) spanID() models.SpanID {
+	var id models.SpanID
+	binary.BigEndian.PutUint64(id[:], g.rand.Uint64())
+	return id
+}
+
+// requestMetrics returns the request count and mean latency of each
+// service's server spans
+func requestMetrics(spans []models.Span, now time.Time) []models.Metric {
+	type totals struct {
+		count, errors int
+		duration      time.Duration
+	}
+	byService := make(map[string]*totals)
+	var order []string
+	for i := range spans {
+		span := &spans[i]
+		if span.Kind != models.SpanKindServer {
+			continue
+		}
+		t := byService[span.ServiceName]
+		if t == nil {
+			t = &totals{}
+			byService[span.ServiceName] = t
+			order = append(order, span.ServiceName)
+		}
+		t.count++
+		t.duration += span.Duration
+		if span.Status == models.SpanStatusError {
+			t.errors++
+		}
+	}
+
+	var metrics []models.Metric
+	for _, service := range order {
+		t := byService[service]
+		metrics = append(metrics,
+			models.Metric{Name: "tracegen_requests_total", Type: models.MetricTypeCounter, Value: float64(t.count), Timestamp: now, Service: service},
+			models.Metric{Name: "tracegen_errors_total", Type: models.MetricTypeCounter, Value: float64(t.errors), Timestamp: now, Service: service},
+			models.Metric{Name: "tracegen_request_duration_ms", Type: models.MetricTypeGauge, Value: float64(t.duration.Microseconds()) / 1000 / float64(t.count), Timestamp: now, Service: service},
+		)
+	}
+	return metrics
+}
@@ -2,60 +2,420 @@ package config
 
 import (
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds the application configuration
 type Config struct {
-	Server  ServerConfig
-	Storage StorageConfig
-	SDK     SDKConfig
+	Server      ServerConfig      `yaml:"server" toml:"server"`
+	Storage     StorageConfig     `yaml:"storage" toml:"storage"`
+	SDK         SDKConfig         `yaml:"sdk" toml:"sdk"`
+	Forwarder   ForwarderConfig   `yaml:"forwarder" toml:"forwarder"`
+	Cluster     ClusterConfig     `yaml:"cluster" toml:"cluster"`
+	Replication ReplicationConfig `yaml:"replication" toml:"replication"`
+	OTLP        OTLPConfig        `yaml:"otlp" toml:"otlp"`
+	Ingestion   IngestionConfig   `yaml:"ingestion" toml:"ingestion"`
+	Tenancy     TenancyConfig     `yaml:"tenancy" toml:"tenancy"`
+	Redaction   RedactionConfig   `yaml:"redaction" toml:"redaction"`
+	Archive     ArchiveConfig     `yaml:"archive" toml:"archive"`
+	History     HistoryConfig     `yaml:"history" toml:"history"`
+	Dashboard   DashboardConfig   `yaml:"dashboard" toml:"dashboard"`
+	SelfTrace   SelfTraceConfig   `yaml:"self_trace" toml:"self_trace"`
+	Alerting    AlertingConfig    `yaml:"alerting" toml:"alerting"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
 }
 
 // ServerConfig holds server-related configuration
 type ServerConfig struct {
-	Host         string
-	Port         int
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	Host         string        `yaml:"host" toml:"host"`
+	Port         int           `yaml:"port" toml:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	// ShutdownDelay is how long the server keeps serving after a
+	// shutdown signal while /readyz reports not ready
+	ShutdownDelay time.Duration `yaml:"shutdown_delay" toml:"shutdown_delay"`
+	// ShutdownTimeout bounds how long shutdown waits for in-flight
+	// requests and queued ingestion to finish
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	TLS             TLSConfig     `yaml:"tls" toml:"tls"`
+	CORS            CORSConfig    `yaml:"cors" toml:"cors"`
+	// Roles are the parts of the collector this process runs: "ingest"
+	// accepts data, "query" serves the dashboard and query APIs
+	Roles []string `yaml:"roles" toml:"roles"`
+}
+
+// Collector roles
+const (
+	RoleIngest = "ingest"
+	RoleQuery  = "query"
+)
+
+// HasRole reports whether the process runs the given role
+func (c ServerConfig) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
+}
+
+// CORSConfig holds which browser origins may call the API. CORS is
+// disabled when AllowedOrigins is empty.
+type CORSConfig struct {
+	// AllowedOrigins may include "*" to allow any origin
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins"`
+	AllowedMethods []string `yaml:"allowed_methods" toml:"allowed_methods"`
+	AllowedHeaders []string `yaml:"allowed_headers" toml:"allowed_headers"`
+}
+
+// TLSConfig holds TLS configuration for the main server. TLS is enabled by
+// a certificate and key file, reloaded when they change, or by ACME
+// domains, whose certificates are obtained and renewed automatically.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// ACMEDomains are validated over HTTP by the CA on ACMEHTTPAddr,
+	// which must be reachable on port 80
+	ACMEDomains   []string `yaml:"acme_domains" toml:"acme_domains"`
+	ACMEEmail     string   `yaml:"acme_email" toml:"acme_email"`
+	ACMEDirectory string   `yaml:"acme_directory" toml:"acme_directory"`
+	ACMEHTTPAddr  string   `yaml:"acme_http_addr" toml:"acme_http_addr"`
+	// ACMECacheDir keeps the ACME account key and certificates (default:
+	// acme under the data directory)
+	ACMECacheDir string `yaml:"acme_cache_dir" toml:"acme_cache_dir"`
+	// ACMEAcceptTOS agrees to the ACME CA's terms of service, without
+	// which it issues no certificates
+	ACMEAcceptTOS bool `yaml:"acme_accept_tos" toml:"acme_accept_tos"`
+}
+
+// Enabled reports whether the main server serves TLS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || len(c.ACMEDomains) > 0
 }
 
 // StorageConfig holds storage-related configuration
 type StorageConfig struct {
-	SpanTTL         time.Duration
-	MetricTTL       time.Duration
-	MaxSpans        int
-	MaxMetrics      int
-	CleanupInterval time.Duration
+	// Backend names the storage backend: "memory" (default) or "badger"
+	Backend string `yaml:"backend" toml:"backend"`
+	// DataDir is where persistent backends keep their data
+	DataDir   string        `yaml:"data_dir" toml:"data_dir"`
+	SpanTTL   time.Duration `yaml:"span_ttl" toml:"span_ttl"`
+	MetricTTL time.Duration `yaml:"metric_ttl" toml:"metric_ttl"`
+	MaxSpans  int           `yaml:"max_spans" toml:"max_spans"`
+	// MaxSpansPerTrace caps the spans stored per trace, so that a runaway
+	// trace can't stall queries; further spans are dropped (0 = no limit)
+	MaxSpansPerTrace int           `yaml:"max_spans_per_trace" toml:"max_spans_per_trace"`
+	MaxMetrics       int           `yaml:"max_metrics" toml:"max_metrics"`
+	ErrorTTL         time.Duration `yaml:"error_ttl" toml:"error_ttl"`
+	MaxErrors        int           `yaml:"max_errors" toml:"max_errors"`
+	CleanupInterval  time.Duration `yaml:"cleanup_interval" toml:"cleanup_interval"`
+	// TraceAssemblyDelay is how long a trace must go without new spans
+	// before queries treat it as complete
+	TraceAssemblyDelay time.Duration `yaml:"trace_assembly_delay" toml:"trace_assembly_delay"`
+	// WAL makes the memory backend log writes under DataDir and snapshot
+	// every SnapshotInterval, so its data survives restarts
+	WAL              bool          `yaml:"wal" toml:"wal"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" toml:"snapshot_interval"`
+	// SpanCompression compresses the spans of the memory backend's quiet
+	// traces: "none" (default), "zstd" or "snappy"
+	SpanCompression string `yaml:"span_compression" toml:"span_compression"`
+	// MaxPinnedTraces and MaxPinnedSpans cap the traces each tenant may
+	// pin beyond the span TTL
+	MaxPinnedTraces int `yaml:"max_pinned_traces" toml:"max_pinned_traces"`
+	MaxPinnedSpans  int `yaml:"max_pinned_spans" toml:"max_pinned_spans"`
+	// MaxDeployments caps the deployment markers each tenant keeps
+	MaxDeployments int `yaml:"max_deployments" toml:"max_deployments"`
+	// MaxAnnotations caps the trace annotations each tenant keeps
+	MaxAnnotations int `yaml:"max_annotations" toml:"max_annotations"`
+	// MaxSeriesPerMetric and MaxSeriesPerService cap each tenant's active
+	// metric series; SeriesOverflow is "aggregate" to fold points of
+	// further series into an overflow series, or "drop"
+	MaxSeriesPerMetric  int    `yaml:"max_series_per_metric" toml:"max_series_per_metric"`
+	MaxSeriesPerService int    `yaml:"max_series_per_service" toml:"max_series_per_service"`
+	SeriesOverflow      string `yaml:"series_overflow" toml:"series_overflow"`
+}
+
+// ForwarderConfig holds configuration for forwarding ingested spans to a
+// downstream collector. Forwarding is disabled when Endpoint is empty.
+type ForwarderConfig struct {
+	Endpoint      string        `yaml:"endpoint" toml:"endpoint"`
+	Protocol      string        `yaml:"protocol" toml:"protocol"`
+	BatchSize     int           `yaml:"batch_size" toml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"`
+	MaxRetries    int           `yaml:"max_retries" toml:"max_retries"`
+}
+
+// ClusterConfig makes the collector the frontend of a cluster: it routes
+// spans to shards, collectors storing the traces whose ID hashes to them,
+// and queries traces across the shards. Cluster mode is disabled when no
+// shards are configured.
+type ClusterConfig struct {
+	// Shards are the base URLs of the shards
+	Shards []string `yaml:"shards" toml:"shards"`
+	// MembersFile lists further shard URLs, one per line, and is reloaded
+	// when it changes
+	MembersFile string `yaml:"members_file" toml:"members_file"`
+	// Token authenticates the frontend to the shards when they require
+	// auth
+	Token string `yaml:"token" toml:"token"`
+	// FlushInterval bounds how long spans wait to be routed
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"`
+	// Timeout bounds each request to a shard
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// Enabled reports whether cluster mode is configured
+func (c ClusterConfig) Enabled() bool {
+	return len(c.Shards) > 0 || c.MembersFile != ""
+}
+
+// ReplicationConfig replicates stored spans to peer collectors, which store
+// them as replicas so they can answer queries for this collector's traces
+// if it fails. Replication is disabled when no peers are configured.
+type ReplicationConfig struct {
+	// Peers are the base URLs of the peer collectors
+	Peers []string `yaml:"peers" toml:"peers"`
+	// Token authenticates the collector to its peers when they require
+	// auth
+	Token string `yaml:"token" toml:"token"`
+	// QueueSize is the number of spans queued for each peer while it
+	// can't be reached
+	QueueSize int `yaml:"queue_size" toml:"queue_size"`
+	// Timeout bounds each request to a peer
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// TenancyConfig holds multi-tenancy configuration. Data is always
+// partitioned by tenant; requests without a tenant use the default tenant
+// unless RequireTenant is set.
+type TenancyConfig struct {
+	RequireTenant bool `yaml:"require_tenant" toml:"require_tenant"`
+	// SpanTTLs overrides the span TTL of individual tenants
+	SpanTTLs map[string]time.Duration `yaml:"span_ttls" toml:"span_ttls"`
+}
+
+// ArchiveConfig holds cold archive configuration. Archiving is disabled
+// when Target is empty.
+type ArchiveConfig struct {
+	// Target is file:///path or s3://bucket/prefix
+	Target   string        `yaml:"target" toml:"target"`
+	After    time.Duration `yaml:"after" toml:"after"`
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+	// S3 settings; credentials come from the standard AWS_* variables
+	S3Region        string `yaml:"s3_region" toml:"s3_region"`
+	S3Endpoint      string `yaml:"s3_endpoint" toml:"s3_endpoint"`
+	AccessKeyID     string `yaml:"access_key_id" toml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key" toml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token" toml:"session_token"`
+}
+
+// HistoryConfig keeps summaries of traces and per-operation statistics
+// after the traces expire, under the data directory. History is disabled
+// when Retention is zero.
+type HistoryConfig struct {
+	// Retention is how long the summaries and statistics are kept
+	Retention time.Duration `yaml:"retention" toml:"retention"`
+	// After is the age at which traces are compacted into summaries
+	After    time.Duration `yaml:"after" toml:"after"`
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+}
+
+// RedactionConfig holds collector-side PII scrubbing configuration.
+// Redaction is disabled when both Keys and Patterns are empty.
+type RedactionConfig struct {
+	// Keys are tag keys whose values are always redacted
+	Keys []string `yaml:"keys" toml:"keys"`
+	// Patterns are built-in pattern names (email, credit_card,
+	// bearer_token, jwt, ssn) or regular expressions
+	Patterns []string `yaml:"patterns" toml:"patterns"`
+	// Mode is "hash" or "remove"
+	Mode string `yaml:"mode" toml:"mode"`
+	Salt string `yaml:"salt" toml:"salt"`
+}
+
+// IngestionConfig holds ingestion endpoint configuration
+type IngestionConfig struct {
+	MaxBodyBytes int64 `yaml:"max_body_bytes" toml:"max_body_bytes"`
+	// QueueSize bounds the number of batches waiting to be processed;
+	// requests beyond it are rejected with 429
+	QueueSize int `yaml:"queue_size" toml:"queue_size"`
+	// Workers is the number of goroutines draining the queue (0 = NumCPU)
+	Workers int `yaml:"workers" toml:"workers"`
+	// Tokens enables bearer-token auth on ingestion when non-empty
+	Tokens []IngestToken `yaml:"tokens" toml:"tokens"`
+	// RequireToken enables bearer-token auth on ingestion without static
+	// tokens, for collectors that only accept managed API tokens
+	RequireToken bool `yaml:"require_token" toml:"require_token"`
+	// MaxFutureSkew is how far ahead of the collector clock a span may
+	// start before its timestamps are clamped
+	MaxFutureSkew time.Duration `yaml:"max_future_skew" toml:"max_future_skew"`
+	// MaxSpanAge rejects spans that ended longer ago than this
+	// (0 = no limit)
+	MaxSpanAge time.Duration `yaml:"max_span_age" toml:"max_span_age"`
+	// LateSpanThreshold tags spans that arrive longer than this after
+	// they ended as late (0 = never)
+	LateSpanThreshold time.Duration `yaml:"late_span_threshold" toml:"late_span_threshold"`
+	// MaxTagValueLength truncates longer span tag values (0 = no limit)
+	MaxTagValueLength int `yaml:"max_tag_value_length" toml:"max_tag_value_length"`
+	// MaxTags drops span tags beyond this count (0 = no limit)
+	MaxTags int `yaml:"max_tags" toml:"max_tags"`
+	// WriteQueueSize is the number of span batches each storage writer
+	// buffers before spilling or applying backpressure
+	WriteQueueSize int `yaml:"write_queue_size" toml:"write_queue_size"`
+	// SpillDir enables spilling span batches to disk when the write
+	// queues are full
+	SpillDir string `yaml:"spill_dir" toml:"spill_dir"`
+	// SpillMaxBytes caps the size of the spill directory
+	SpillMaxBytes int64 `yaml:"spill_max_bytes" toml:"spill_max_bytes"`
+	// SpanMetrics derives request, error and duration metrics per service
+	// and operation from ingested spans
+	SpanMetrics bool `yaml:"span_metrics" toml:"span_metrics"`
+	// Quota limits what each tenant may ingest; batches beyond it are
+	// rejected with 429
+	Quota IngestQuota `yaml:"quota" toml:"quota"`
+	// TenantQuotas overrides the quota of individual tenants
+	TenantQuotas map[string]IngestQuota `yaml:"tenant_quotas" toml:"tenant_quotas"`
+	// AllowedSources, when set, restricts ingestion to these CIDR
+	// prefixes or addresses; other sources are rejected with 403
+	AllowedSources []string `yaml:"allowed_sources" toml:"allowed_sources"`
+	// IdempotencyTTL is how long the response to a batch sent with an
+	// Idempotency-Key header is replayed to retries of it (0 = disabled)
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl" toml:"idempotency_ttl"`
+	// IdempotencyMaxKeys caps the idempotency keys remembered
+	IdempotencyMaxKeys int `yaml:"idempotency_max_keys" toml:"idempotency_max_keys"`
+}
+
+// IngestQuota limits a tenant's ingestion per UTC day and per second
+// (0 = no limit)
+type IngestQuota struct {
+	SpansPerDay      int64 `yaml:"spans_per_day" toml:"spans_per_day"`
+	SpansPerSecond   int64 `yaml:"spans_per_second" toml:"spans_per_second"`
+	MetricsPerDay    int64 `yaml:"metrics_per_day" toml:"metrics_per_day"`
+	MetricsPerSecond int64 `yaml:"metrics_per_second" toml:"metrics_per_second"`
+}
+
+// IngestToken maps an ingestion bearer token to the identity it writes as
+type IngestToken struct {
+	Token   string `yaml:"token" toml:"token"`
+	Service string `yaml:"service" toml:"service"`
+	Tenant  string `yaml:"tenant" toml:"tenant"`
+	// Sources, if set, restricts the token to these CIDR prefixes or
+	// addresses
+	Sources []string `yaml:"sources" toml:"sources"`
+	// Replicate lets the token write peer replicas and backup imports
+	Replicate bool `yaml:"replicate" toml:"replicate"`
+}
+
+// DashboardConfig holds dashboard API configuration
+type DashboardConfig struct {
+	// TailMaxRate caps the traces per second sent to each live tail
+	// connection
+	TailMaxRate int `yaml:"tail_max_rate" toml:"tail_max_rate"`
+}
+
+// SelfTraceConfig holds configuration for tracing the collector's own
+// request handling. Self-tracing is disabled unless Enabled is set.
+type SelfTraceConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Endpoint is the collector the traces are exported to; empty exports
+	// them to this collector
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// Token authenticates the exports when the target requires auth
+	Token       string  `yaml:"token" toml:"token"`
+	ServiceName string  `yaml:"service_name" toml:"service_name"`
+	SampleRate  float64 `yaml:"sample_rate" toml:"sample_rate"`
+}
+
+// AlertingConfig holds alerting configuration. Alerting is disabled when
+// RulesFile is empty.
+type AlertingConfig struct {
+	// RulesFile is a JSON file of alert rules
+	RulesFile string        `yaml:"rules_file" toml:"rules_file"`
+	Interval  time.Duration `yaml:"interval" toml:"interval"`
+	// Webhook receives firing and resolved alerts when set
+	Webhook string `yaml:"webhook" toml:"webhook"`
+	// GroupBy are the labels whose values group notifications, and
+	// RepeatInterval how often a group that keeps firing is notified again
+	GroupBy        []string      `yaml:"group_by" toml:"group_by"`
+	RepeatInterval time.Duration `yaml:"repeat_interval" toml:"repeat_interval"`
+}
+
+// AuthConfig holds dashboard and query API authentication configuration.
+// Authentication is enabled when UsersFile or OIDCIssuer is set.
+type AuthConfig struct {
+	// UsersFile holds user:bcrypt-hash lines, as written by htpasswd -B
+	UsersFile     string        `yaml:"users_file" toml:"users_file"`
+	SessionTTL    time.Duration `yaml:"session_ttl" toml:"session_ttl"`
+	SecureCookies bool          `yaml:"secure_cookies" toml:"secure_cookies"`
+	// OIDC single sign-on
+	OIDCIssuer       string `yaml:"oidc_issuer" toml:"oidc_issuer"`
+	OIDCClientID     string `yaml:"oidc_client_id" toml:"oidc_client_id"`
+	OIDCClientSecret string `yaml:"oidc_client_secret" toml:"oidc_client_secret"`
+	OIDCRedirectURL  string `yaml:"oidc_redirect_url" toml:"oidc_redirect_url"`
+	// OIDCAllowedUsers and OIDCAllowedDomains are who may sign in with
+	// OIDC, by verified email or subject and by email domain
+	OIDCAllowedUsers   []string `yaml:"oidc_allowed_users" toml:"oidc_allowed_users"`
+	OIDCAllowedDomains []string `yaml:"oidc_allowed_domains" toml:"oidc_allowed_domains"`
+	// Admins are the users who may manage API tokens, with OIDC users
+	// named oidc:<email>
+	Admins []string `yaml:"admins" toml:"admins"`
+}
+
+// OTLPConfig holds configuration for the OTLP receivers. OTLP/HTTP is
+// always served on the main port; OTLP/gRPC is enabled when GRPCAddr is set.
+type OTLPConfig struct {
+	GRPCAddr string `yaml:"grpc_addr" toml:"grpc_addr"`
 }
 
 // SDKConfig holds SDK-related configuration
 type SDKConfig struct {
-	ServiceName   string
-	CollectorURL  string
-	BatchSize     int
-	FlushInterval time.Duration
-	SampleRate    float64
-	EnableTracing bool
-	EnableMetrics bool
+	ServiceName   string        `yaml:"service_name" toml:"service_name"`
+	CollectorURL  string        `yaml:"collector_url" toml:"collector_url"`
+	BatchSize     int           `yaml:"batch_size" toml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"`
+	SampleRate    float64       `yaml:"sample_rate" toml:"sample_rate"`
+	EnableTracing bool          `yaml:"enable_tracing" toml:"enable_tracing"`
+	EnableMetrics bool          `yaml:"enable_metrics" toml:"enable_metrics"`
 }
 
 // DefaultConfig returns the default configuration
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Host:         "0.0.0.0",
-			Port:         10001,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
+			Host:            "0.0.0.0",
+			Port:            10001,
+			ReadTimeout:     30 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+			TLS: TLSConfig{
+				ACMEHTTPAddr: ":80",
+			},
+			Roles: []string{RoleIngest, RoleQuery},
+			CORS: CORSConfig{
+				AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
+				AllowedHeaders: []string{"Authorization", "Content-Type", "X-OmniTrace-Tenant"},
+			},
 		},
 		Storage: StorageConfig{
-			SpanTTL:         24 * time.Hour,
-			MetricTTL:       7 * 24 * time.Hour,
-			MaxSpans:        1000000,
-			MaxMetrics:      10000000,
-			CleanupInterval: 5 * time.Minute,
+			Backend:             "memory",
+			SpanTTL:             24 * time.Hour,
+			MetricTTL:           7 * 24 * time.Hour,
+			MaxSpans:            1000000,
+			MaxSpansPerTrace:    10000,
+			MaxMetrics:          10000000,
+			ErrorTTL:            7 * 24 * time.Hour,
+			MaxErrors:           100000,
+			CleanupInterval:     5 * time.Minute,
+			TraceAssemblyDelay:  5 * time.Second,
+			DataDir:             "./data",
+			SnapshotInterval:    5 * time.Minute,
+			SpanCompression:     "none",
+			MaxPinnedTraces:     1000,
+			MaxPinnedSpans:      100000,
+			MaxDeployments:      10000,
+			MaxAnnotations:      10000,
+			MaxSeriesPerMetric:  10000,
+			MaxSeriesPerService: 50000,
+			SeriesOverflow:      "aggregate",
 		},
 		SDK: SDKConfig{
 			ServiceName:   "unknown-service",
@@ -66,13 +426,72 @@ func DefaultConfig() *Config {
 			EnableTracing: true,
 			EnableMetrics: true,
 		},
+		Ingestion: IngestionConfig{
+			MaxBodyBytes:       10 << 20,
+			QueueSize:          1000,
+			MaxFutureSkew:      5 * time.Minute,
+			LateSpanThreshold:  5 * time.Minute,
+			MaxTagValueLength:  4096,
+			MaxTags:            128,
+			SpanMetrics:        true,
+			WriteQueueSize:     256,
+			SpillMaxBytes:      1 << 30,
+			IdempotencyTTL:     10 * time.Minute,
+			IdempotencyMaxKeys: 100000,
+		},
+		Archive: ArchiveConfig{
+			After:    time.Hour,
+			Interval: 10 * time.Minute,
+			S3Region: "us-east-1",
+		},
+		History: HistoryConfig{
+			After:    15 * time.Minute,
+			Interval: 5 * time.Minute,
+		},
+		Redaction: RedactionConfig{
+			Mode: "hash",
+		},
+		Forwarder: ForwarderConfig{
+			Protocol:      "omnitrace",
+			BatchSize:     500,
+			FlushInterval: 5 * time.Second,
+			MaxRetries:    3,
+		},
+		Cluster: ClusterConfig{
+			FlushInterval: time.Second,
+			Timeout:       10 * time.Second,
+		},
+		Replication: ReplicationConfig{
+			QueueSize: 100000,
+			Timeout:   10 * time.Second,
+		},
+		Dashboard: DashboardConfig{
+			TailMaxRate: 50,
+		},
+		SelfTrace: SelfTraceConfig{
+			ServiceName: "omnitrace",
+			SampleRate:  0.1,
+		},
+		Alerting: AlertingConfig{
+			Interval:       time.Minute,
+			GroupBy:        []string{"alertname"},
+			RepeatInterval: 4 * time.Hour,
+		},
+		Auth: AuthConfig{
+			SessionTTL: 12 * time.Hour,
+		},
 	}
 }
 
 // LoadFromEnv loads configuration from environment variables
 func LoadFromEnv() *Config {
 	cfg := DefaultConfig()
+	applyEnv(cfg)
+	return cfg
+}
 
+// applyEnv overrides cfg with the environment variables that are set
+func applyEnv(cfg *Config) {
 	// Server config
 	if host := os.Getenv("OMNITRACE_HOST"); host != "" {
 		cfg.Server.Host = host
@@ -82,8 +501,62 @@ func LoadFromEnv() *Config {
 			cfg.Server.Port = p
 		}
 	}
+	if roles := os.Getenv("OMNITRACE_ROLE"); roles != "" {
+		cfg.Server.Roles = splitList(roles)
+	}
+	if certFile := os.Getenv("OMNITRACE_TLS_CERT"); certFile != "" {
+		cfg.Server.TLS.CertFile = certFile
+	}
+	if keyFile := os.Getenv("OMNITRACE_TLS_KEY"); keyFile != "" {
+		cfg.Server.TLS.KeyFile = keyFile
+	}
+	if domains := os.Getenv("OMNITRACE_ACME_DOMAINS"); domains != "" {
+		cfg.Server.TLS.ACMEDomains = splitList(domains)
+	}
+	if email := os.Getenv("OMNITRACE_ACME_EMAIL"); email != "" {
+		cfg.Server.TLS.ACMEEmail = email
+	}
+	if directory := os.Getenv("OMNITRACE_ACME_DIRECTORY"); directory != "" {
+		cfg.Server.TLS.ACMEDirectory = directory
+	}
+	if addr := os.Getenv("OMNITRACE_ACME_HTTP_ADDR"); addr != "" {
+		cfg.Server.TLS.ACMEHTTPAddr = addr
+	}
+	if cacheDir := os.Getenv("OMNITRACE_ACME_CACHE_DIR"); cacheDir != "" {
+		cfg.Server.TLS.ACMECacheDir = cacheDir
+	}
+	if acceptTOS := os.Getenv("OMNITRACE_ACME_ACCEPT_TOS"); acceptTOS != "" {
+		if b, err := strconv.ParseBool(acceptTOS); err == nil {
+			cfg.Server.TLS.ACMEAcceptTOS = b
+		}
+	}
+	if origins := os.Getenv("OMNITRACE_CORS_ALLOWED_ORIGINS"); origins != "" {
+		cfg.Server.CORS.AllowedOrigins = splitList(origins)
+	}
+	if methods := os.Getenv("OMNITRACE_CORS_ALLOWED_METHODS"); methods != "" {
+		cfg.Server.CORS.AllowedMethods = splitList(methods)
+	}
+	if headers := os.Getenv("OMNITRACE_CORS_ALLOWED_HEADERS"); headers != "" {
+		cfg.Server.CORS.AllowedHeaders = splitList(headers)
+	}
+	if delay := os.Getenv("OMNITRACE_SHUTDOWN_DELAY"); delay != "" {
+		if d, err := time.ParseDuration(delay); err == nil {
+			cfg.Server.ShutdownDelay = d
+		}
+	}
+	if timeout := os.Getenv("OMNITRACE_SHUTDOWN_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			cfg.Server.ShutdownTimeout = d
+		}
+	}
 
 	// Storage config
+	if backend := os.Getenv("OMNITRACE_STORAGE_BACKEND"); backend != "" {
+		cfg.Storage.Backend = backend
+	}
+	if dir := os.Getenv("OMNITRACE_DATA_DIR"); dir != "" {
+		cfg.Storage.DataDir = dir
+	}
 	if ttl := os.Getenv("OMNITRACE_SPAN_TTL"); ttl != "" {
 		if d, err := time.ParseDuration(ttl); err == nil {
 			cfg.Storage.SpanTTL = d
@@ -94,6 +567,63 @@ func LoadFromEnv() *Config {
 			cfg.Storage.MaxSpans = m
 		}
 	}
+	if maxSpans := os.Getenv("OMNITRACE_MAX_SPANS_PER_TRACE"); maxSpans != "" {
+		if m, err := strconv.Atoi(maxSpans); err == nil {
+			cfg.Storage.MaxSpansPerTrace = m
+		}
+	}
+
+	if delay := os.Getenv("OMNITRACE_TRACE_ASSEMBLY_DELAY"); delay != "" {
+		if d, err := time.ParseDuration(delay); err == nil {
+			cfg.Storage.TraceAssemblyDelay = d
+		}
+	}
+	if wal := os.Getenv("OMNITRACE_WAL"); wal != "" {
+		if b, err := strconv.ParseBool(wal); err == nil {
+			cfg.Storage.WAL = b
+		}
+	}
+	if interval := os.Getenv("OMNITRACE_SNAPSHOT_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.Storage.SnapshotInterval = d
+		}
+	}
+	if compression := os.Getenv("OMNITRACE_SPAN_COMPRESSION"); compression != "" {
+		cfg.Storage.SpanCompression = compression
+	}
+	if maxPinned := os.Getenv("OMNITRACE_MAX_PINNED_TRACES"); maxPinned != "" {
+		if m, err := strconv.Atoi(maxPinned); err == nil {
+			cfg.Storage.MaxPinnedTraces = m
+		}
+	}
+	if maxPinned := os.Getenv("OMNITRACE_MAX_PINNED_SPANS"); maxPinned != "" {
+		if m, err := strconv.Atoi(maxPinned); err == nil {
+			cfg.Storage.MaxPinnedSpans = m
+		}
+	}
+	if maxDeployments := os.Getenv("OMNITRACE_MAX_DEPLOYMENTS"); maxDeployments != "" {
+		if m, err := strconv.Atoi(maxDeployments); err == nil {
+			cfg.Storage.MaxDeployments = m
+		}
+	}
+	if maxAnnotations := os.Getenv("OMNITRACE_MAX_ANNOTATIONS"); maxAnnotations != "" {
+		if m, err := strconv.Atoi(maxAnnotations); err == nil {
+			cfg.Storage.MaxAnnotations = m
+		}
+	}
+	if maxSeries := os.Getenv("OMNITRACE_MAX_SERIES_PER_METRIC"); maxSeries != "" {
+		if m, err := strconv.Atoi(maxSeries); err == nil {
+			cfg.Storage.MaxSeriesPerMetric = m
+		}
+	}
+	if maxSeries := os.Getenv("OMNITRACE_MAX_SERIES_PER_SERVICE"); maxSeries != "" {
+		if m, err := strconv.Atoi(maxSeries); err == nil {
+			cfg.Storage.MaxSeriesPerService = m
+		}
+	}
+	if overflow := os.Getenv("OMNITRACE_SERIES_OVERFLOW"); overflow == "aggregate" || overflow == "drop" {
+		cfg.Storage.SeriesOverflow = overflow
+	}
 
 	// SDK config
 	if service := os.Getenv("OMNITRACE_SERVICE_NAME"); service != "" {
@@ -113,10 +643,361 @@ func LoadFromEnv() *Config {
 		}
 	}
 
-	return cfg
+	// Ingestion config
+	if maxBody := os.Getenv("OMNITRACE_MAX_BODY_BYTES"); maxBody != "" {
+		if m, err := strconv.ParseInt(maxBody, 10, 64); err == nil {
+			cfg.Ingestion.MaxBodyBytes = m
+		}
+	}
+
+	if size := os.Getenv("OMNITRACE_INGEST_QUEUE_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			cfg.Ingestion.QueueSize = n
+		}
+	}
+	if workers := os.Getenv("OMNITRACE_INGEST_WORKERS"); workers != "" {
+		if n, err := strconv.Atoi(workers); err == nil {
+			cfg.Ingestion.Workers = n
+		}
+	}
+
+	if skew := os.Getenv("OMNITRACE_MAX_FUTURE_SKEW"); skew != "" {
+		if d, err := time.ParseDuration(skew); err == nil {
+			cfg.Ingestion.MaxFutureSkew = d
+		}
+	}
+	if age := os.Getenv("OMNITRACE_MAX_SPAN_AGE"); age != "" {
+		if d, err := time.ParseDuration(age); err == nil {
+			cfg.Ingestion.MaxSpanAge = d
+		}
+	}
+	if threshold := os.Getenv("OMNITRACE_LATE_SPAN_THRESHOLD"); threshold != "" {
+		if d, err := time.ParseDuration(threshold); err == nil {
+			cfg.Ingestion.LateSpanThreshold = d
+		}
+	}
+	if maxLen := os.Getenv("OMNITRACE_MAX_TAG_VALUE_LENGTH"); maxLen != "" {
+		if n, err := strconv.Atoi(maxLen); err == nil {
+			cfg.Ingestion.MaxTagValueLength = n
+		}
+	}
+	if maxTags := os.Getenv("OMNITRACE_MAX_TAGS"); maxTags != "" {
+		if n, err := strconv.Atoi(maxTags); err == nil {
+			cfg.Ingestion.MaxTags = n
+		}
+	}
+
+	if size := os.Getenv("OMNITRACE_WRITE_QUEUE_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			cfg.Ingestion.WriteQueueSize = n
+		}
+	}
+	if dir := os.Getenv("OMNITRACE_SPILL_DIR"); dir != "" {
+		cfg.Ingestion.SpillDir = dir
+	}
+	if maxBytes := os.Getenv("OMNITRACE_SPILL_MAX_BYTES"); maxBytes != "" {
+		if m, err := strconv.ParseInt(maxBytes, 10, 64); err == nil {
+			cfg.Ingestion.SpillMaxBytes = m
+		}
+	}
+
+	if ttl := os.Getenv("OMNITRACE_IDEMPOTENCY_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil {
+			cfg.Ingestion.IdempotencyTTL = d
+		}
+	}
+	if maxKeys := os.Getenv("OMNITRACE_IDEMPOTENCY_MAX_KEYS"); maxKeys != "" {
+		if n, err := strconv.Atoi(maxKeys); err == nil {
+			cfg.Ingestion.IdempotencyMaxKeys = n
+		}
+	}
+
+	if spanMetrics := os.Getenv("OMNITRACE_SPAN_METRICS"); spanMetrics != "" {
+		if b, err := strconv.ParseBool(spanMetrics); err == nil {
+			cfg.Ingestion.SpanMetrics = b
+		}
+	}
+
+	for name, limit := range map[string]*int64{
+		"OMNITRACE_QUOTA_SPANS_PER_DAY":      &cfg.Ingestion.Quota.SpansPerDay,
+		"OMNITRACE_QUOTA_SPANS_PER_SECOND":   &cfg.Ingestion.Quota.SpansPerSecond,
+		"OMNITRACE_QUOTA_METRICS_PER_DAY":    &cfg.Ingestion.Quota.MetricsPerDay,
+		"OMNITRACE_QUOTA_METRICS_PER_SECOND": &cfg.Ingestion.Quota.MetricsPerSecond,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				*limit = n
+			}
+		}
+	}
+
+	if sources := os.Getenv("OMNITRACE_INGEST_ALLOWED_SOURCES"); sources != "" {
+		cfg.Ingestion.AllowedSources = splitList(sources)
+	}
+
+	if tokens := os.Getenv("OMNITRACE_INGEST_TOKENS"); tokens != "" {
+		cfg.Ingestion.Tokens = parseIngestTokens(tokens)
+	}
+	if require := os.Getenv("OMNITRACE_INGEST_REQUIRE_TOKEN"); require != "" {
+		if b, err := strconv.ParseBool(require); err == nil {
+			cfg.Ingestion.RequireToken = b
+		}
+	}
+
+	// Tenancy config
+	if require := os.Getenv("OMNITRACE_REQUIRE_TENANT"); require != "" {
+		if b, err := strconv.ParseBool(require); err == nil {
+			cfg.Tenancy.RequireTenant = b
+		}
+	}
+	if ttls := os.Getenv("OMNITRACE_TENANT_SPAN_TTLS"); ttls != "" {
+		cfg.Tenancy.SpanTTLs = parseDurationMap(ttls)
+	}
+
+	// Redaction config
+	if keys := os.Getenv("OMNITRACE_REDACT_KEYS"); keys != "" {
+		cfg.Redaction.Keys = splitList(keys)
+	}
+	if patterns := os.Getenv("OMNITRACE_REDACT_PATTERNS"); patterns != "" {
+		cfg.Redaction.Patterns = splitList(patterns)
+	}
+	if mode := os.Getenv("OMNITRACE_REDACT_MODE"); mode != "" {
+		cfg.Redaction.Mode = mode
+	}
+	if salt := os.Getenv("OMNITRACE_REDACT_SALT"); salt != "" {
+		cfg.Redaction.Salt = salt
+	}
+
+	// Archive config
+	if target := os.Getenv("OMNITRACE_ARCHIVE_TARGET"); target != "" {
+		cfg.Archive.Target = target
+	}
+	if after := os.Getenv("OMNITRACE_ARCHIVE_AFTER"); after != "" {
+		if d, err := time.ParseDuration(after); err == nil {
+			cfg.Archive.After = d
+		}
+	}
+	if interval := os.Getenv("OMNITRACE_ARCHIVE_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.Archive.Interval = d
+		}
+	}
+	if endpoint := os.Getenv("OMNITRACE_ARCHIVE_S3_ENDPOINT"); endpoint != "" {
+		cfg.Archive.S3Endpoint = endpoint
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		cfg.Archive.S3Region = region
+	}
+	if keyID := os.Getenv("AWS_ACCESS_KEY_ID"); keyID != "" {
+		cfg.Archive.AccessKeyID = keyID
+	}
+	if secret := os.Getenv("AWS_SECRET_ACCESS_KEY"); secret != "" {
+		cfg.Archive.SecretAccessKey = secret
+	}
+	if sessionToken := os.Getenv("AWS_SESSION_TOKEN"); sessionToken != "" {
+		cfg.Archive.SessionToken = sessionToken
+	}
+
+	// History config
+	if retention := os.Getenv("OMNITRACE_HISTORY_RETENTION"); retention != "" {
+		if d, err := time.ParseDuration(retention); err == nil {
+			cfg.History.Retention = d
+		}
+	}
+	if after := os.Getenv("OMNITRACE_HISTORY_AFTER"); after != "" {
+		if d, err := time.ParseDuration(after); err == nil {
+			cfg.History.After = d
+		}
+	}
+
+	// OTLP config
+	if addr := os.Getenv("OMNITRACE_OTLP_GRPC_ADDR"); addr != "" {
+		cfg.OTLP.GRPCAddr = addr
+	}
+
+	// Dashboard config
+	if rate := os.Getenv("OMNITRACE_TAIL_MAX_RATE"); rate != "" {
+		if n, err := strconv.Atoi(rate); err == nil {
+			cfg.Dashboard.TailMaxRate = n
+		}
+	}
+
+	// Self-tracing config
+	if enabled := os.Getenv("OMNITRACE_SELF_TRACE"); enabled != "" {
+		if b, err := strconv.ParseBool(enabled); err == nil {
+			cfg.SelfTrace.Enabled = b
+		}
+	}
+	if endpoint := os.Getenv("OMNITRACE_SELF_TRACE_ENDPOINT"); endpoint != "" {
+		cfg.SelfTrace.Endpoint = endpoint
+	}
+	if token := os.Getenv("OMNITRACE_SELF_TRACE_TOKEN"); token != "" {
+		cfg.SelfTrace.Token = token
+	}
+	if rate := os.Getenv("OMNITRACE_SELF_TRACE_SAMPLE_RATE"); rate != "" {
+		if r, err := strconv.ParseFloat(rate, 64); err == nil {
+			cfg.SelfTrace.SampleRate = r
+		}
+	}
+
+	// Alerting config
+	if rules := os.Getenv("OMNITRACE_ALERT_RULES"); rules != "" {
+		cfg.Alerting.RulesFile = rules
+	}
+	if interval := os.Getenv("OMNITRACE_ALERT_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			cfg.Alerting.Interval = d
+		}
+	}
+	if webhook := os.Getenv("OMNITRACE_ALERT_WEBHOOK"); webhook != "" {
+		cfg.Alerting.Webhook = webhook
+	}
+	if groupBy := os.Getenv("OMNITRACE_ALERT_GROUP_BY"); groupBy != "" {
+		cfg.Alerting.GroupBy = splitList(groupBy)
+	}
+	if repeat := os.Getenv("OMNITRACE_ALERT_REPEAT_INTERVAL"); repeat != "" {
+		if d, err := time.ParseDuration(repeat); err == nil {
+			cfg.Alerting.RepeatInterval = d
+		}
+	}
+
+	// Auth config
+	if usersFile := os.Getenv("OMNITRACE_AUTH_USERS_FILE"); usersFile != "" {
+		cfg.Auth.UsersFile = usersFile
+	}
+	if ttl := os.Getenv("OMNITRACE_AUTH_SESSION_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil {
+			cfg.Auth.SessionTTL = d
+		}
+	}
+	if secure := os.Getenv("OMNITRACE_AUTH_SECURE_COOKIES"); secure != "" {
+		if b, err := strconv.ParseBool(secure); err == nil {
+			cfg.Auth.SecureCookies = b
+		}
+	}
+	if issuer := os.Getenv("OMNITRACE_OIDC_ISSUER"); issuer != "" {
+		cfg.Auth.OIDCIssuer = issuer
+	}
+	if clientID := os.Getenv("OMNITRACE_OIDC_CLIENT_ID"); clientID != "" {
+		cfg.Auth.OIDCClientID = clientID
+	}
+	if secret := os.Getenv("OMNITRACE_OIDC_CLIENT_SECRET"); secret != "" {
+		cfg.Auth.OIDCClientSecret = secret
+	}
+	if redirectURL := os.Getenv("OMNITRACE_OIDC_REDIRECT_URL"); redirectURL != "" {
+		cfg.Auth.OIDCRedirectURL = redirectURL
+	}
+	if users := os.Getenv("OMNITRACE_OIDC_ALLOWED_USERS"); users != "" {
+		cfg.Auth.OIDCAllowedUsers = splitList(users)
+	}
+	if domains := os.Getenv("OMNITRACE_OIDC_ALLOWED_DOMAINS"); domains != "" {
+		cfg.Auth.OIDCAllowedDomains = splitList(domains)
+	}
+	if admins := os.Getenv("OMNITRACE_AUTH_ADMINS"); admins != "" {
+		cfg.Auth.Admins = splitList(admins)
+	}
+
+	// Forwarder config
+	if endpoint := os.Getenv("OMNITRACE_FORWARD_ENDPOINT"); endpoint != "" {
+		cfg.Forwarder.Endpoint = endpoint
+	}
+	if protocol := os.Getenv("OMNITRACE_FORWARD_PROTOCOL"); protocol != "" {
+		cfg.Forwarder.Protocol = protocol
+	}
+
+	// Cluster config
+	if shards := os.Getenv("OMNITRACE_CLUSTER_SHARDS"); shards != "" {
+		cfg.Cluster.Shards = splitList(shards)
+	}
+	if file := os.Getenv("OMNITRACE_CLUSTER_MEMBERS_FILE"); file != "" {
+		cfg.Cluster.MembersFile = file
+	}
+	if token := os.Getenv("OMNITRACE_CLUSTER_TOKEN"); token != "" {
+		cfg.Cluster.Token = token
+	}
+
+	// Replication config
+	if peers := os.Getenv("OMNITRACE_REPLICATION_PEERS"); peers != "" {
+		cfg.Replication.Peers = splitList(peers)
+	}
+	if token := os.Getenv("OMNITRACE_REPLICATION_TOKEN"); token != "" {
+		cfg.Replication.Token = token
+	}
 }
 
 // GetServerAddr returns the server address string
 func (c *Config) GetServerAddr() string {
 	return c.Server.Host + ":" + strconv.Itoa(c.Server.Port)
 }
+
+// Redacted returns a copy of the configuration with its secrets masked,
+// for display
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	mask := func(secret *string) {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+	mask(&redacted.Archive.SecretAccessKey)
+	mask(&redacted.Archive.SessionToken)
+	mask(&redacted.Auth.OIDCClientSecret)
+	mask(&redacted.SelfTrace.Token)
+	mask(&redacted.Cluster.Token)
+	mask(&redacted.Replication.Token)
+	mask(&redacted.Redaction.Salt)
+	redacted.Ingestion.Tokens = make([]IngestToken, len(c.Ingestion.Tokens))
+	for i, token := range c.Ingestion.Tokens {
+		mask(&token.Token)
+		redacted.Ingestion.Tokens[i] = token
+	}
+	return &redacted
+}
+
+// parseIngestTokens parses a comma-separated list of token[:service[:tenant]]
+// entries. An empty or "*" service allows writing any service.
+func parseIngestTokens(value string) []IngestToken {
+	var tokens []IngestToken
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if parts[0] == "" {
+			continue
+		}
+		token := IngestToken{Token: parts[0]}
+		if len(parts) > 1 && parts[1] != "*" {
+			token.Service = parts[1]
+		}
+		if len(parts) > 2 {
+			token.Tenant = parts[2]
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseDurationMap parses a comma-separated list of key=duration entries,
+// skipping malformed entries
+func parseDurationMap(value string) map[string]time.Duration {
+	result := make(map[string]time.Duration)
+	for _, entry := range strings.Split(value, ",") {
+		key, raw, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || key == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(raw); err == nil {
+			result[key] = d
+		}
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Load loads the configuration file at path, if any, over the defaults and
+// then the environment variables over it, so a variable overrides the file.
+// The file is YAML, or TOML if its name ends in .toml; keys are the
+// snake_case field names, e.g. storage.span_ttl, and unknown keys are an
+// error.
+func Load(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		if err := loadFile(path, cfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	applyEnv(cfg)
+	return cfg, nil
+}
+
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = decodeTOML(data, cfg)
+	} else {
+		err = decodeYAML(data, cfg)
+	}
+	if err != nil {
+		return withLineContext(err, data)
+	}
+	return nil
+}
+
+func decodeYAML(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// decodeTOML decodes TOML into the same fields as YAML, which are tagged
+// with the same keys
+func decodeTOML(data []byte, cfg *Config) error {
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = "unknown key " + key.String()
+		}
+		return &yaml.TypeError{Errors: keys}
+	}
+	return nil
+}
+
+// lineRef matches a line number in a YAML or TOML error message
+var lineRef = regexp.MustCompile(`\bline (\d+)\b`)
+
+// errorMessages splits the messages of YAML type errors, which are
+// reported together
+func errorMessages(err error) []string {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Errors
+	}
+	msg := strings.TrimPrefix(err.Error(), "yaml: ")
+	return []string{strings.TrimPrefix(msg, "toml: ")}
+}
+
+// withLineContext follows each message of err with the line of the file
+// it refers to
+func withLineContext(err error, data []byte) error {
+	source := strings.Split(string(data), "\n")
+	var b strings.Builder
+	for i, msg := range errorMessages(err) {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(msg)
+		if m := lineRef.FindStringSubmatch(msg); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n >= 1 && n <= len(source) {
+				fmt.Fprintf(&b, "\n  %4d | %s", n, strings.TrimRight(source[n-1], " \t\r"))
+			}
+		}
+	}
+	return errors.New(b.String())
+}
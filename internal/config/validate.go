@@ -0,0 +1,239 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Validate reports settings that can't be right, such as a negative TTL or
+// a misspelled storage backend, all at once rather than one per restart.
+// Each error names the setting by its file key, e.g. storage.span_ttl.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		if !slices.Contains(allowed, value) {
+			fail(key, "must be %s, got %q", strings.Join(allowed, " or "), value)
+		}
+	}
+	notNegative := func(key string, value int64) {
+		if value < 0 {
+			fail(key, "must not be negative, got %d", value)
+		}
+	}
+	notNegativeDuration := func(key string, d time.Duration) {
+		if d < 0 {
+			fail(key, "must not be negative, got %s", d)
+		}
+	}
+	ratio := func(key string, value float64) {
+		if value < 0 || value > 1 {
+			fail(key, "must be between 0 and 1, got %g", value)
+		}
+	}
+	validTenant := func(key, tenant string) {
+		if !models.ValidTenant(tenant) {
+			fail(key, "tenant ID must be 1 to %d letters, digits, '-' or '_', got %q", models.MaxTenantLength, tenant)
+		}
+	}
+	absoluteURL := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			fail(key, "must be an absolute URL, got %q", value)
+		}
+	}
+
+	// Server
+	if c.Server.Port < 0 || c.Server.Port > 65535 {
+		fail("server.port", "must be between 0 and 65535, got %d", c.Server.Port)
+	}
+	notNegativeDuration("server.read_timeout", c.Server.ReadTimeout)
+	notNegativeDuration("server.write_timeout", c.Server.WriteTimeout)
+	notNegativeDuration("server.shutdown_delay", c.Server.ShutdownDelay)
+	notNegativeDuration("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	if (c.Server.TLS.CertFile == "") != (c.Server.TLS.KeyFile == "") {
+		fail("server.tls", "cert_file and key_file must be set together")
+	}
+	if len(c.Server.TLS.ACMEDomains) > 0 && !c.Server.TLS.ACMEAcceptTOS {
+		fail("server.tls.acme_accept_tos", "must be true to obtain certificates for acme_domains; it agrees to the CA's terms of service")
+	}
+	if len(c.Server.Roles) == 0 {
+		fail("server.roles", "must include %q, %q or both", RoleIngest, RoleQuery)
+	}
+	for i, role := range c.Server.Roles {
+		oneOf(fmt.Sprintf("server.roles[%d]", i), role, RoleIngest, RoleQuery)
+	}
+
+	// Storage
+	oneOf("storage.backend", c.Storage.Backend, "memory", "badger")
+	notNegativeDuration("storage.span_ttl", c.Storage.SpanTTL)
+	notNegativeDuration("storage.metric_ttl", c.Storage.MetricTTL)
+	notNegativeDuration("storage.error_ttl", c.Storage.ErrorTTL)
+	notNegativeDuration("storage.cleanup_interval", c.Storage.CleanupInterval)
+	notNegativeDuration("storage.trace_assembly_delay", c.Storage.TraceAssemblyDelay)
+	notNegative("storage.max_spans", int64(c.Storage.MaxSpans))
+	notNegative("storage.max_spans_per_trace", int64(c.Storage.MaxSpansPerTrace))
+	notNegative("storage.max_metrics", int64(c.Storage.MaxMetrics))
+	notNegative("storage.max_errors", int64(c.Storage.MaxErrors))
+	notNegativeDuration("storage.snapshot_interval", c.Storage.SnapshotInterval)
+	oneOf("storage.span_compression", c.Storage.SpanCompression, "none", "zstd", "snappy")
+	notNegative("storage.max_deployments", int64(c.Storage.MaxDeployments))
+	notNegative("storage.max_annotations", int64(c.Storage.MaxAnnotations))
+	notNegative("storage.max_series_per_metric", int64(c.Storage.MaxSeriesPerMetric))
+	notNegative("storage.max_series_per_service", int64(c.Storage.MaxSeriesPerService))
+	oneOf("storage.series_overflow", c.Storage.SeriesOverflow, "aggregate", "drop")
+	for tenant, ttl := range c.Tenancy.SpanTTLs {
+		validTenant("tenancy.span_ttls", tenant)
+		notNegativeDuration("tenancy.span_ttls."+tenant, ttl)
+	}
+
+	// Ingestion
+	notNegative("ingestion.max_body_bytes", c.Ingestion.MaxBodyBytes)
+	notNegative("ingestion.queue_size", int64(c.Ingestion.QueueSize))
+	notNegative("ingestion.workers", int64(c.Ingestion.Workers))
+	notNegative("ingestion.write_queue_size", int64(c.Ingestion.WriteQueueSize))
+	notNegative("ingestion.max_tag_value_length", int64(c.Ingestion.MaxTagValueLength))
+	notNegative("ingestion.max_tags", int64(c.Ingestion.MaxTags))
+	notNegativeDuration("ingestion.max_span_age", c.Ingestion.MaxSpanAge)
+	notNegativeDuration("ingestion.late_span_threshold", c.Ingestion.LateSpanThreshold)
+	notNegativeDuration("ingestion.idempotency_ttl", c.Ingestion.IdempotencyTTL)
+	notNegative("ingestion.idempotency_max_keys", int64(c.Ingestion.IdempotencyMaxKeys))
+	validateQuota := func(path string, q IngestQuota) {
+		notNegative(path+".spans_per_day", q.SpansPerDay)
+		notNegative(path+".spans_per_second", q.SpansPerSecond)
+		notNegative(path+".metrics_per_day", q.MetricsPerDay)
+		notNegative(path+".metrics_per_second", q.MetricsPerSecond)
+	}
+	validateQuota("ingestion.quota", c.Ingestion.Quota)
+	for tenant, q := range c.Ingestion.TenantQuotas {
+		validTenant("ingestion.tenant_quotas", tenant)
+		validateQuota("ingestion.tenant_quotas."+tenant, q)
+	}
+	validSources := func(key string, sources []string) {
+		for i, source := range sources {
+			if _, err := netip.ParsePrefix(source); err == nil {
+				continue
+			}
+			if _, err := netip.ParseAddr(source); err != nil {
+				fail(fmt.Sprintf("%s[%d]", key, i), "want a CIDR prefix or an IP address, got %q", source)
+			}
+		}
+	}
+	validSources("ingestion.allowed_sources", c.Ingestion.AllowedSources)
+	for i, token := range c.Ingestion.Tokens {
+		if token.Token == "" {
+			fail(fmt.Sprintf("ingestion.tokens[%d]", i), "token is empty")
+		}
+		if token.Tenant != "" {
+			validTenant(fmt.Sprintf("ingestion.tokens[%d].tenant", i), token.Tenant)
+		}
+		validSources(fmt.Sprintf("ingestion.tokens[%d].sources", i), token.Sources)
+	}
+
+	// Forwarder
+	if c.Forwarder.Endpoint != "" {
+		absoluteURL("forwarder.endpoint", c.Forwarder.Endpoint)
+		oneOf("forwarder.protocol", c.Forwarder.Protocol, "omnitrace", "otlp")
+		notNegative("forwarder.batch_size", int64(c.Forwarder.BatchSize))
+		notNegativeDuration("forwarder.flush_interval", c.Forwarder.FlushInterval)
+		notNegative("forwarder.max_retries", int64(c.Forwarder.MaxRetries))
+	}
+
+	// Cluster
+	for i, shard := range c.Cluster.Shards {
+		absoluteURL(fmt.Sprintf("cluster.shards[%d]", i), shard)
+	}
+	notNegativeDuration("cluster.flush_interval", c.Cluster.FlushInterval)
+	notNegativeDuration("cluster.timeout", c.Cluster.Timeout)
+	if c.Cluster.Enabled() && c.Archive.Target != "" {
+		fail("archive.target", "must be set on the shards of a cluster rather than its frontend")
+	}
+
+	if !c.Server.HasRole(RoleIngest) {
+		if c.Forwarder.Endpoint != "" {
+			fail("forwarder.endpoint", "requires the %q role", RoleIngest)
+		}
+		if len(c.Replication.Peers) > 0 {
+			fail("replication.peers", "requires the %q role", RoleIngest)
+		}
+	}
+
+	// Replication
+	for i, peer := range c.Replication.Peers {
+		absoluteURL(fmt.Sprintf("replication.peers[%d]", i), peer)
+	}
+	notNegative("replication.queue_size", int64(c.Replication.QueueSize))
+	notNegativeDuration("replication.timeout", c.Replication.Timeout)
+	if c.Cluster.Enabled() && len(c.Replication.Peers) > 0 {
+		fail("replication.peers", "a cluster frontend stores no spans to replicate")
+	}
+
+	// Redaction
+	if len(c.Redaction.Keys) > 0 || len(c.Redaction.Patterns) > 0 {
+		oneOf("redaction.mode", c.Redaction.Mode, "hash", "remove")
+	}
+
+	// Archive
+	if c.Archive.Target != "" {
+		if !strings.HasPrefix(c.Archive.Target, "file://") && !strings.HasPrefix(c.Archive.Target, "s3://") {
+			fail("archive.target", "must be file:///path or s3://bucket/prefix, got %q", c.Archive.Target)
+		}
+		notNegativeDuration("archive.after", c.Archive.After)
+		notNegativeDuration("archive.interval", c.Archive.Interval)
+	}
+
+	// History
+	notNegativeDuration("history.retention", c.History.Retention)
+	if c.History.Retention > 0 {
+		if c.Storage.DataDir == "" {
+			fail("history.retention", "requires storage.data_dir to keep the history in")
+		}
+		if c.Cluster.Enabled() {
+			fail("history.retention", "must be set on the shards of a cluster rather than its frontend")
+		}
+		notNegativeDuration("history.after", c.History.After)
+		notNegativeDuration("history.interval", c.History.Interval)
+	}
+
+	// Dashboard, self-tracing and alerting
+	notNegative("dashboard.tail_max_rate", int64(c.Dashboard.TailMaxRate))
+	if c.SelfTrace.Enabled {
+		absoluteURL("self_trace.endpoint", c.SelfTrace.Endpoint)
+		ratio("self_trace.sample_rate", c.SelfTrace.SampleRate)
+	}
+	if c.Alerting.RulesFile != "" {
+		notNegativeDuration("alerting.interval", c.Alerting.Interval)
+		notNegativeDuration("alerting.repeat_interval", c.Alerting.RepeatInterval)
+		absoluteURL("alerting.webhook", c.Alerting.Webhook)
+	}
+
+	// Auth
+	notNegativeDuration("auth.session_ttl", c.Auth.SessionTTL)
+	if c.Auth.OIDCIssuer != "" {
+		absoluteURL("auth.oidc_issuer", c.Auth.OIDCIssuer)
+		if c.Auth.OIDCClientID == "" {
+			fail("auth.oidc_client_id", "is required with oidc_issuer")
+		}
+		if len(c.Auth.OIDCAllowedUsers) == 0 && len(c.Auth.OIDCAllowedDomains) == 0 {
+			fail("auth.oidc_allowed_users", "oidc_allowed_users or oidc_allowed_domains is required with oidc_issuer")
+		}
+		if c.Auth.OIDCRedirectURL == "" {
+			fail("auth.oidc_redirect_url", "is required with oidc_issuer")
+		}
+	}
+
+	ratio("sdk.sample_rate", c.SDK.SampleRate)
+
+	return errors.Join(errs...)
+}
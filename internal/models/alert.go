@@ -0,0 +1,153 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration written in JSON as a string such as "5m",
+// for hand-written configuration
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// AlertState is the state of an alert
+type AlertState string
+
+// Alert states. An alert is pending while its condition holds for less
+// than its rule's For duration, then firing until the condition stops
+// holding, when it is resolved.
+const (
+	AlertStatePending  AlertState = "pending"
+	AlertStateFiring   AlertState = "firing"
+	AlertStateResolved AlertState = "resolved"
+)
+
+// Span statistics alert rules can be defined over. Latencies are in
+// milliseconds, the error rate is a fraction of spans, and the rate is in
+// spans per second.
+const (
+	SpanStatErrorRate = "error_rate"
+	SpanStatRate      = "rate"
+	SpanStatCount     = "count"
+	SpanStatP50       = "p50"
+	SpanStatP90       = "p90"
+	SpanStatP95       = "p95"
+	SpanStatP99       = "p99"
+)
+
+// SpanStatQuery selects a statistic of a service's spans over a window
+type SpanStatQuery struct {
+	Service   string   `json:"service"`
+	Operation string   `json:"operation,omitempty"`
+	Stat      string   `json:"stat"`
+	Window    Duration `json:"window,omitempty"`
+}
+
+// SLOCondition selects a statistic of one of the tenant's SLOs. Burn rates
+// and SLIs are over Window; the remaining budget is over the SLO's window.
+type SLOCondition struct {
+	Name   string   `json:"name"`
+	Stat   string   `json:"stat"`
+	Window Duration `json:"window,omitempty"`
+}
+
+// AlertRule defines a condition over a metric query, span statistic or SLO.
+// Exactly one of Query, a PromQL expression, Spans and SLO is set. Every
+// series of a metric query is alerted on separately.
+type AlertRule struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant,omitempty"`
+
+	Query string         `json:"query,omitempty"`
+	Spans *SpanStatQuery `json:"spans,omitempty"`
+	SLO   *SLOCondition  `json:"slo,omitempty"`
+
+	// Op compares the value to Threshold: >, >=, <, <=, == or !=
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+	// For is how long the condition must hold before the alert fires
+	For Duration `json:"for,omitempty"`
+
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Alert is an instance of a rule whose condition holds, or recently held
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Tenant      string            `json:"tenant"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	State       AlertState        `json:"state"`
+	Value       float64           `json:"value"`
+	// ActiveAt is when the condition started holding
+	ActiveAt   time.Time `json:"active_at"`
+	FiredAt    time.Time `json:"fired_at,omitempty"`
+	ResolvedAt time.Time `json:"resolved_at,omitempty"`
+	// SilencedBy lists the IDs of the silences muting the alert's
+	// notifications
+	SilencedBy []string `json:"silenced_by,omitempty"`
+}
+
+// AlertGroup is one notification: the alerts sharing a tenant and the
+// values of the grouping labels. It is firing while any of its alerts is.
+type AlertGroup struct {
+	Tenant string            `json:"tenant"`
+	Labels map[string]string `json:"labels"`
+	Status AlertState        `json:"status"`
+	Alerts []Alert           `json:"alerts"`
+	// Services holds the registry entries of the services named by the
+	// alerts' service labels
+	Services []ServiceMetadata `json:"services,omitempty"`
+}
+
+// Silence states
+const (
+	SilenceStatePending = "pending"
+	SilenceStateActive  = "active"
+	SilenceStateExpired = "expired"
+)
+
+// Silence mutes the notifications of the alerts whose labels match its
+// matchers, a series selector such as {service="checkout"}, between
+// StartsAt and EndsAt
+type Silence struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Matchers  string    `json:"matchers"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	State     string    `json:"state"`
+}
+
+// AlertRuleStatus reports a rule's last evaluation and its alerts
+type AlertRuleStatus struct {
+	Rule           AlertRule     `json:"rule"`
+	Health         string        `json:"health"`
+	LastError      string        `json:"last_error,omitempty"`
+	LastEvaluation time.Time     `json:"last_evaluation"`
+	EvaluationTime time.Duration `json:"evaluation_time"`
+	Alerts         []Alert       `json:"alerts"`
+}
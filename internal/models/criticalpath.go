@@ -0,0 +1,123 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// maxCriticalPathDepth bounds recursion on malformed, cyclic span trees
+const maxCriticalPathDepth = 256
+
+// CriticalPath computes the chain of spans that determines the trace's
+// end-to-end latency. Walking back from the root span's end, the path
+// enters the child that finished last, then continues in the parent
+// before that child started; time in which no child was running belongs
+// to the parent. Returns nil for a trace without spans.
+func (t *Trace) CriticalPath() *CriticalPath {
+	if t == nil || len(t.Spans) == 0 {
+		return nil
+	}
+
+	byID := make(map[SpanID]*Span, len(t.Spans))
+	for i := range t.Spans {
+		byID[t.Spans[i].SpanID] = &t.Spans[i]
+	}
+	children := make(map[SpanID][]*Span)
+	for i := range t.Spans {
+		span := &t.Spans[i]
+		if _, ok := byID[span.ParentSpanID]; ok && span.ParentSpanID != span.SpanID {
+			children[span.ParentSpanID] = append(children[span.ParentSpanID], span)
+		}
+	}
+	for _, kids := range children {
+		sort.Slice(kids, func(i, j int) bool { return kids[i].EndTime.After(kids[j].EndTime) })
+	}
+
+	root := t.RootSpan
+	if root == nil {
+		// Without a root, start from the span that ended last among those
+		// whose parent is missing
+		for i := range t.Spans {
+			span := &t.Spans[i]
+			if _, ok := byID[span.ParentSpanID]; ok {
+				continue
+			}
+			if root == nil || span.EndTime.After(root.EndTime) {
+				root = span
+			}
+		}
+		if root == nil {
+			root = &t.Spans[0]
+		}
+	}
+
+	// Segments are collected newest first
+	var segments []CriticalPathSegment
+	var walk func(span *Span, end time.Time, depth int)
+	walk = func(span *Span, end time.Time, depth int) {
+		cursor := span.EndTime
+		if end.Before(cursor) {
+			cursor = end
+		}
+		if depth < maxCriticalPathDepth {
+			for _, child := range children[span.SpanID] {
+				if !cursor.After(span.StartTime) {
+					break
+				}
+				// Skip children that ran entirely after the cursor or
+				// before the span
+				if !child.StartTime.Before(cursor) || !child.EndTime.After(span.StartTime) {
+					continue
+				}
+				childEnd := child.EndTime
+				if cursor.Before(childEnd) {
+					childEnd = cursor
+				}
+				if cursor.After(childEnd) {
+					segments = append(segments, CriticalPathSegment{SpanID: span.SpanID, StartTime: childEnd, EndTime: cursor})
+				}
+				walk(child, childEnd, depth+1)
+				cursor = child.StartTime
+				if cursor.Before(span.StartTime) {
+					cursor = span.StartTime
+				}
+			}
+		}
+		if cursor.After(span.StartTime) {
+			segments = append(segments, CriticalPathSegment{SpanID: span.SpanID, StartTime: span.StartTime, EndTime: cursor})
+		}
+	}
+	walk(root, root.EndTime, 0)
+
+	path := &CriticalPath{
+		TraceID:  t.TraceID,
+		Duration: root.EndTime.Sub(root.StartTime),
+		Segments: make([]CriticalPathSegment, 0, len(segments)),
+	}
+	contributions := make(map[SpanID]time.Duration)
+	var order []SpanID
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		path.Segments = append(path.Segments, segment)
+		if _, ok := contributions[segment.SpanID]; !ok {
+			order = append(order, segment.SpanID)
+		}
+		contributions[segment.SpanID] += segment.EndTime.Sub(segment.StartTime)
+	}
+
+	for _, spanID := range order {
+		span := byID[spanID]
+		entry := CriticalPathSpan{
+			SpanID:        spanID,
+			ServiceName:   span.ServiceName,
+			OperationName: span.OperationName,
+			Contribution:  contributions[spanID],
+		}
+		if path.Duration > 0 {
+			entry.Percent = float64(entry.Contribution) / float64(path.Duration) * 100
+		}
+		path.Spans = append(path.Spans, entry)
+	}
+	sort.SliceStable(path.Spans, func(i, j int) bool { return path.Spans[i].Contribution > path.Spans[j].Contribution })
+	return path
+}
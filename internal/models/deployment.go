@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Deployment records a service version going live, e.g. from a CI
+// pipeline, so charts and trace lists can mark where the version changed
+type Deployment struct {
+	Service   string            `json:"service"`
+	Version   string            `json:"version"`
+	Timestamp time.Time         `json:"timestamp"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// DeploymentQuery selects deployments of a service (or of all services)
+// within a time range
+type DeploymentQuery struct {
+	Service   string
+	StartTime time.Time
+	EndTime   time.Time
+	Limit     int
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+)
+
+// ErrorEvent represents a standalone error reported outside of a span
+type ErrorEvent struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	Service    string            `json:"service"`
+	Message    string            `json:"message"`
+	Type       string            `json:"type"`
+	Severity   string            `json:"severity"`
+	StackTrace []string          `json:"stack_trace,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	TraceID    string            `json:"trace_id,omitempty"`
+	SpanID     string            `json:"span_id,omitempty"`
+	TenantID   string            `json:"tenant_id,omitempty"`
+}
+
+// ErrorEventBatch represents a batch of error events for ingestion
+type ErrorEventBatch struct {
+	Errors []ErrorEvent `json:"errors"`
+}
+
+// ErrorEventQuery represents a query for error events
+type ErrorEventQuery struct {
+	Service   string    `json:"service,omitempty"`
+	Severity  string    `json:"severity,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Limit     int       `json:"limit"`
+}
+
+// ErrorGroup aggregates errors sharing the same fingerprint
+type ErrorGroup struct {
+	Fingerprint     string    `json:"fingerprint"`
+	Service         string    `json:"service"`
+	Type            string    `json:"type"`
+	MessageTemplate string    `json:"message_template"`
+	TopFrame        string    `json:"top_frame,omitempty"`
+	SampleMessage   string    `json:"sample_message"`
+	Count           int64     `json:"count"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+	SampleTraceIDs  []string  `json:"sample_trace_ids,omitempty"`
+}
+
+// ErrorGroupQuery represents a query for error groups
+type ErrorGroupQuery struct {
+	Service string `json:"service,omitempty"`
+	SortBy  string `json:"sort_by,omitempty"` // "last_seen" (default) or "count"
+	Limit   int    `json:"limit"`
+}
@@ -0,0 +1,9 @@
+package models
+
+// ExportRecord is one line of a backup: a span or a metric point. Backups
+// are newline-delimited JSON records, as served by /api/export and read by
+// /api/v1/import.
+type ExportRecord struct {
+	Span   *Span   `json:"span,omitempty"`
+	Metric *Metric `json:"metric,omitempty"`
+}
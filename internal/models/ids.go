@@ -0,0 +1,103 @@
+package models
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// TraceID is a 128-bit trace ID. It is written as 32 lowercase hex digits,
+// in JSON and by String.
+type TraceID [16]byte
+
+// SpanID is a 64-bit span ID. It is written as 16 lowercase hex digits,
+// in JSON and by String. The zero SpanID, written as "", stands for no
+// span, e.g. the parent of a root span.
+type SpanID [8]byte
+
+// ParseTraceID parses a trace ID from 32 hex digits of either case
+func ParseTraceID(s string) (TraceID, error) {
+	var id TraceID
+	err := parseHexID(id[:], s, "trace")
+	return id, err
+}
+
+// ParseSpanID parses a span ID from 16 hex digits of either case. The
+// empty string is the zero SpanID.
+func ParseSpanID(s string) (SpanID, error) {
+	var id SpanID
+	if s == "" {
+		return id, nil
+	}
+	err := parseHexID(id[:], s, "span")
+	return id, err
+}
+
+func parseHexID(dst []byte, s, kind string) error {
+	if len(s) != hex.EncodedLen(len(dst)) {
+		return fmt.Errorf("invalid %s ID %q: want %d hex digits", kind, s, hex.EncodedLen(len(dst)))
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return fmt.Errorf("invalid %s ID %q: %w", kind, s, err)
+	}
+	return nil
+}
+
+// IsZero reports whether the ID is all zeros, which is never a valid
+// trace ID
+func (id TraceID) IsZero() bool {
+	return id == TraceID{}
+}
+
+// String returns the ID as 32 lowercase hex digits
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Compare orders trace IDs the way their hex strings sort
+func (id TraceID) Compare(other TraceID) int {
+	return bytes.Compare(id[:], other[:])
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (id TraceID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (id *TraceID) UnmarshalText(text []byte) error {
+	parsed, err := ParseTraceID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// IsZero reports whether the ID is all zeros, i.e. no span
+func (id SpanID) IsZero() bool {
+	return id == SpanID{}
+}
+
+// String returns the ID as 16 lowercase hex digits, or "" for the zero ID
+func (id SpanID) String() string {
+	if id.IsZero() {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (id SpanID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (id *SpanID) UnmarshalText(text []byte) error {
+	parsed, err := ParseSpanID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
@@ -0,0 +1,41 @@
+package models
+
+// IdempotencyHeader carries the key an exporter attaches to a batch, the
+// same on every retry of it
+const IdempotencyHeader = "Idempotency-Key"
+
+// LateArrivalTag records how long after it ended a span arrived, on spans
+// that arrived past the collector's late threshold
+const LateArrivalTag = "omnitrace.late_arrival"
+
+// Reasons a span of a batch is rejected, beside the validator's
+const (
+	// IngestRejectMalformed is a span that couldn't be decoded, such as
+	// one with an ID that isn't hex
+	IngestRejectMalformed = "malformed_span"
+)
+
+// Statuses of an IngestResult
+const (
+	IngestStatusAccepted = "accepted"
+	IngestStatusPartial  = "partial"
+	IngestStatusRejected = "rejected"
+)
+
+// IngestResult is the response of a span batch ingestion request. The
+// accepted spans are queued for storage; the rejected ones are dropped,
+// and sending them again unchanged won't help.
+type IngestResult struct {
+	Status   string        `json:"status"`
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Errors   []IngestError `json:"errors,omitempty"`
+}
+
+// IngestError is why one span of a batch was rejected
+type IngestError struct {
+	// Index is the span's position in the batch
+	Index   int    `json:"index"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+}
@@ -21,6 +21,10 @@ type Metric struct {
 	Timestamp time.Time         `json:"timestamp"`
 	Labels    map[string]string `json:"labels,omitempty"`
 	Service   string            `json:"service"`
+	TenantID  string            `json:"tenant_id,omitempty"`
+	// Cumulative is set on counters whose value is a running total rather
+	// than the increment since the previous point
+	Cumulative bool `json:"cumulative,omitempty"`
 }
 
 // HistogramBucket represents a histogram bucket
@@ -54,6 +58,12 @@ type AggregatedMetric struct {
 	Min       float64           `json:"min"`
 	Max       float64           `json:"max"`
 	Avg       float64           `json:"avg"`
+	// Value is the result of the query's function
+	Value float64 `json:"value,omitempty"`
+	// Quantiles of the bucket's values, set for histogram metrics
+	P50 float64 `json:"p50,omitempty"`
+	P95 float64 `json:"p95,omitempty"`
+	P99 float64 `json:"p99,omitempty"`
 }
 
 // MetricQuery represents a query for metrics
@@ -64,8 +74,36 @@ type MetricQuery struct {
 	StartTime time.Time         `json:"start_time"`
 	EndTime   time.Time         `json:"end_time"`
 	Step      time.Duration     `json:"step"`
+	// Function, if set, turns counters into a per-bucket increase or
+	// per-second rate over Window (default Step). Other metric types are
+	// left out.
+	Function string        `json:"function,omitempty"`
+	Window   time.Duration `json:"window,omitempty"`
+	// GroupBy sums series across all labels but these; "service" groups
+	// by the metric's service
+	GroupBy []string `json:"group_by,omitempty"`
+	// Match, if set, selects series by a point of them, after the
+	// filters above
+	Match func(Metric) bool `json:"-"`
 }
 
+// MetricSeries describes one stored series: the points of a metric with
+// one service and label set
+type MetricSeries struct {
+	Name     string            `json:"name"`
+	Type     MetricType        `json:"type"`
+	Service  string            `json:"service"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Points   int               `json:"points"`
+	LastSeen time.Time         `json:"last_seen"`
+}
+
+// Metric query functions
+const (
+	MetricFunctionRate     = "rate"
+	MetricFunctionIncrease = "increase"
+)
+
 // WithLabel adds a label to the metric
 func (m *Metric) WithLabel(key, value string) *Metric {
 	if m.Labels == nil {
@@ -96,3 +134,36 @@ func NewGauge(name string, value float64, service string) *Metric {
 		Service:   service,
 	}
 }
+
+// LabelCardinality counts the distinct values of a label
+type LabelCardinality struct {
+	Label  string `json:"label"`
+	Values int    `json:"values"`
+}
+
+// MetricCardinality counts the series of a metric
+type MetricCardinality struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+	// Overflowed counts points of new series rejected by the series
+	// limits, whether dropped or folded into the overflow series
+	Overflowed uint64             `json:"overflowed"`
+	Labels     []LabelCardinality `json:"labels,omitempty"`
+}
+
+// ServiceCardinality counts the series of a service
+type ServiceCardinality struct {
+	Service string `json:"service"`
+	Series  int    `json:"series"`
+}
+
+// CardinalityReport shows where a metric store's series come from, to
+// find the labels that blow up cardinality
+type CardinalityReport struct {
+	Series              int                  `json:"series"`
+	MaxSeriesPerMetric  int                  `json:"max_series_per_metric"`
+	MaxSeriesPerService int                  `json:"max_series_per_service"`
+	Overflow            string               `json:"overflow,omitempty"`
+	Metrics             []MetricCardinality  `json:"metrics"`
+	Services            []ServiceCardinality `json:"services"`
+}
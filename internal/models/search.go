@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// SavedSearch is a named trace search saved by a user, for themselves or
+// their team. Query holds the parameters of /api/traces, or of /api/query
+// when it has a q parameter, e.g. "service=payments&error=true&minDuration=2s".
+type SavedSearch struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	Owner string `json:"owner"`
+	Team  string `json:"team,omitempty"`
+	// Link is the ID of the search's short link
+	Link      string    `json:"link"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SearchLink is a short link to a trace search. Its ID is derived from
+// the query, so a query always gets the same link.
+type SearchLink struct {
+	ID        string    `json:"id"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+}
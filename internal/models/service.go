@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// ServiceMetadata is what the team owning a service records about it, for
+// service lists, the service graph and alert notifications
+type ServiceMetadata struct {
+	Service   string    `json:"service"`
+	Team      string    `json:"team,omitempty"`
+	Repo      string    `json:"repo,omitempty"`
+	Runbook   string    `json:"runbook,omitempty"`
+	Tier      string    `json:"tier,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ServiceInfo is a service seen in spans and its registered metadata, if
+// any
+type ServiceInfo struct {
+	Name     string           `json:"name"`
+	Metadata *ServiceMetadata `json:"metadata,omitempty"`
+}
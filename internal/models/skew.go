@@ -0,0 +1,98 @@
+package models
+
+import (
+	"time"
+)
+
+// ClockSkewTag records the offset applied to a span by CorrectClockSkew
+const ClockSkewTag = "omnitrace.clock_skew_adjustment"
+
+// CorrectClockSkew shifts the spans of each service so that child spans
+// from another service fit inside their parent. Spans of one service share
+// a host clock, so every span of a service gets the same offset, chosen
+// the first time one of its spans is found outside a parent from a
+// different service. A child that doesn't fit is centered in its parent,
+// assuming network latency is split evenly between request and response.
+// Adjusted spans are tagged with ClockSkewTag. Spans are modified in place;
+// their Tags maps are copied before being written.
+func CorrectClockSkew(spans []Span) []Span {
+	byID := make(map[SpanID]int, len(spans))
+	children := make(map[SpanID][]int)
+	for i, span := range spans {
+		byID[span.SpanID] = i
+	}
+	var roots []int
+	for i, span := range spans {
+		if _, ok := byID[span.ParentSpanID]; ok && span.ParentSpanID != span.SpanID {
+			children[span.ParentSpanID] = append(children[span.ParentSpanID], i)
+		} else {
+			roots = append(roots, i)
+		}
+	}
+
+	// Services of root spans are the reference clocks
+	shifts := make(map[string]time.Duration)
+	for _, i := range roots {
+		if _, ok := shifts[spans[i].ServiceName]; !ok {
+			shifts[spans[i].ServiceName] = 0
+		}
+	}
+
+	// Walk top-down so a parent's offset is known before its children
+	queue := append([]int(nil), roots...)
+	visited := make(map[int]bool, len(spans))
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if visited[i] {
+			continue
+		}
+		visited[i] = true
+
+		parent := spans[i]
+		parentShift := shifts[parent.ServiceName]
+		for _, c := range children[parent.SpanID] {
+			child := spans[c]
+			if _, ok := shifts[child.ServiceName]; !ok && child.ServiceName != parent.ServiceName {
+				shifts[child.ServiceName] = skewShift(
+					parent.StartTime.Add(parentShift), parent.EndTime.Add(parentShift),
+					child.StartTime, child.EndTime,
+				)
+			}
+			queue = append(queue, c)
+		}
+	}
+
+	for i := range spans {
+		shift := shifts[spans[i].ServiceName]
+		if shift == 0 {
+			continue
+		}
+		span := &spans[i]
+		span.StartTime = span.StartTime.Add(shift)
+		span.EndTime = span.EndTime.Add(shift)
+
+		tags := make(map[string]string, len(span.Tags)+1)
+		for k, v := range span.Tags {
+			tags[k] = v
+		}
+		tags[ClockSkewTag] = shift.String()
+		span.Tags = tags
+	}
+
+	return spans
+}
+
+// skewShift returns the offset that places a child span inside its parent,
+// or zero if it already fits
+func skewShift(parentStart, parentEnd, childStart, childEnd time.Time) time.Duration {
+	if !childStart.Before(parentStart) && !childEnd.After(parentEnd) {
+		return 0
+	}
+	parentDur := parentEnd.Sub(parentStart)
+	childDur := childEnd.Sub(childStart)
+	if childDur >= parentDur {
+		return parentStart.Sub(childStart)
+	}
+	return parentStart.Add((parentDur - childDur) / 2).Sub(childStart)
+}
@@ -0,0 +1,49 @@
+package models
+
+// SLO types. An availability SLO counts spans without an error status as
+// good; a latency SLO counts spans no slower than its threshold as good.
+const (
+	SLOTypeAvailability = "availability"
+	SLOTypeLatency      = "latency"
+)
+
+// SLO statistics alert rules can be defined over
+const (
+	SLOStatBurnRate        = "burn_rate"
+	SLOStatBudgetRemaining = "budget_remaining"
+	SLOStatSLI             = "sli"
+)
+
+// SLO is a service level objective over the requests a service serves: its
+// server and consumer spans, and root spans of any kind, optionally of
+// one operation
+type SLO struct {
+	Name      string `json:"name"`
+	Tenant    string `json:"tenant,omitempty"`
+	Service   string `json:"service"`
+	Operation string `json:"operation,omitempty"`
+	Type      string `json:"type"`
+	// Objective is the fraction of good requests aimed for, e.g. 0.999
+	Objective float64 `json:"objective"`
+	// Threshold is the slowest good request of latency SLOs
+	Threshold Duration `json:"threshold,omitempty"`
+	// Window is the rolling period the objective applies to
+	Window Duration `json:"window,omitempty"`
+}
+
+// SLOStatus reports how an SLO is doing over its window. The error budget
+// is the fraction of requests allowed to be bad; a burn rate of 1 spends
+// it exactly over the window, and higher rates spend it faster.
+type SLOStatus struct {
+	SLO   SLO    `json:"slo"`
+	Total uint64 `json:"total"`
+	Good  uint64 `json:"good"`
+	// SLI is the fraction of good requests, 1 without requests
+	SLI         float64 `json:"sli"`
+	ErrorBudget float64 `json:"error_budget"`
+	// BudgetRemaining is the fraction of the error budget left; it is
+	// negative once the budget is spent
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// BurnRates maps windows such as "1h" to the burn rate over them
+	BurnRates map[string]float64 `json:"burn_rates"`
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 )
 
@@ -24,11 +25,15 @@ const (
 	SpanStatusError SpanStatus = "error"
 )
 
+// PeerServiceTag names the remote service of a client span
+const PeerServiceTag = "peer.service"
+
 // Span represents a single unit of work in a distributed trace
 type Span struct {
-	TraceID      string            `json:"trace_id"`
-	SpanID       string            `json:"span_id"`
-	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	TenantID     string            `json:"tenant_id,omitempty"`
+	TraceID      TraceID           `json:"trace_id"`
+	SpanID       SpanID            `json:"span_id"`
+	ParentSpanID SpanID            `json:"parent_span_id,omitzero"`
 	OperationName string           `json:"operation_name"`
 	ServiceName  string            `json:"service_name"`
 	Kind         SpanKind          `json:"kind"`
@@ -39,6 +44,7 @@ type Span struct {
 	StatusMessage string           `json:"status_message,omitempty"`
 	Tags         map[string]string `json:"tags,omitempty"`
 	Logs         []SpanLog         `json:"logs,omitempty"`
+	Links        []SpanLink        `json:"links,omitempty"`
 	ErrorInfo    *ErrorInfo        `json:"error_info,omitempty"`
 }
 
@@ -48,11 +54,27 @@ type SpanLog struct {
 	Fields    map[string]string `json:"fields"`
 }
 
+// SpanLink relates a span to a span other than its parent, in the same
+// trace or another, such as a message a consumer span processed
+type SpanLink struct {
+	TraceID TraceID           `json:"trace_id"`
+	SpanID  SpanID            `json:"span_id"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
 // ErrorInfo contains detailed error information
 type ErrorInfo struct {
-	Message    string   `json:"message"`
-	Type       string   `json:"type"`
-	StackTrace []string `json:"stack_trace,omitempty"`
+	Message    string       `json:"message"`
+	Type       string       `json:"type"`
+	Category   string       `json:"category,omitempty"`
+	StackTrace []string     `json:"stack_trace,omitempty"`
+	Causes     []ErrorCause `json:"causes,omitempty"`
+}
+
+// ErrorCause is one link in a wrapped error chain, outermost first
+type ErrorCause struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
 }
 
 // SpanBatch represents a batch of spans for ingestion
@@ -65,6 +87,14 @@ func (s *Span) CalculateDuration() {
 	s.Duration = s.EndTime.Sub(s.StartTime)
 }
 
+// PeerService returns the peer.service tag of a client or producer span
+func (s *Span) PeerService() string {
+	if s.Kind != SpanKindClient && s.Kind != SpanKindProducer {
+		return ""
+	}
+	return s.Tags[PeerServiceTag]
+}
+
 // AddTag adds a tag to the span
 func (s *Span) AddTag(key, value string) {
 	if s.Tags == nil {
@@ -81,6 +111,31 @@ func (s *Span) AddLog(fields map[string]string) {
 	})
 }
 
+// ExceptionEvent names the span event that records an exception
+const ExceptionEvent = "exception"
+
+// AddEvent records a named event as a log entry whose "event" field holds
+// the name. An exception event also sets the span's error info from its
+// exception.* fields.
+func (s *Span) AddEvent(name string, timestamp time.Time, fields map[string]string) {
+	if fields == nil {
+		fields = make(map[string]string, 1)
+	}
+	fields["event"] = name
+	s.Logs = append(s.Logs, SpanLog{Timestamp: timestamp, Fields: fields})
+
+	if name == ExceptionEvent {
+		info := &ErrorInfo{
+			Type:    fields["exception.type"],
+			Message: fields["exception.message"],
+		}
+		if stack := fields["exception.stacktrace"]; stack != "" {
+			info.StackTrace = strings.Split(strings.TrimRight(stack, "\n"), "\n")
+		}
+		s.ErrorInfo = info
+	}
+}
+
 // SetError marks the span as errored with details
 func (s *Span) SetError(err error, stackTrace []string) {
 	s.Status = SpanStatusError
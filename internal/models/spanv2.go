@@ -0,0 +1,292 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// ServiceNameAttribute is the resource attribute naming a batch's service
+const ServiceNameAttribute = "service.name"
+
+// SpanBatchV2 is the body of the /api/v2/spans endpoint. Unlike SpanBatch,
+// spans are grouped under the resource that produced them, so that its
+// attributes are sent once per group rather than once per span.
+type SpanBatchV2 struct {
+	ResourceSpans []ResourceSpansV2 `json:"resource_spans"`
+}
+
+// ResourceSpansV2 is a group of spans sharing one resource
+type ResourceSpansV2 struct {
+	Resource Attributes `json:"resource"`
+	Spans    []SpanV2   `json:"spans"`
+}
+
+// SpanV2 is a span as sent to the /api/v2/spans endpoint
+type SpanV2 struct {
+	TraceID       TraceID       `json:"trace_id"`
+	SpanID        SpanID        `json:"span_id"`
+	ParentSpanID  SpanID        `json:"parent_span_id,omitzero"`
+	Name          string        `json:"name"`
+	Kind          SpanKind      `json:"kind,omitempty"`
+	StartTime     time.Time     `json:"start_time"`
+	EndTime       time.Time     `json:"end_time"`
+	Status        SpanStatus    `json:"status,omitempty"`
+	StatusMessage string        `json:"status_message,omitempty"`
+	Attributes    Attributes    `json:"attributes,omitempty"`
+	Events        []SpanEventV2 `json:"events,omitempty"`
+	Links         []SpanLinkV2  `json:"links,omitempty"`
+}
+
+// SpanEventV2 is a named, timestamped event within a span
+type SpanEventV2 struct {
+	Name       string     `json:"name"`
+	Time       time.Time  `json:"time"`
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
+// SpanLinkV2 relates a span to a span other than its parent
+type SpanLinkV2 struct {
+	TraceID    TraceID    `json:"trace_id"`
+	SpanID     SpanID     `json:"span_id"`
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
+// Attributes maps attribute names to typed values
+type Attributes map[string]AttributeValue
+
+// Tags renders the attributes as span tags
+func (a Attributes) Tags() map[string]string {
+	if len(a) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(a))
+	for key, value := range a {
+		tags[key] = value.String()
+	}
+	return tags
+}
+
+// AttributeType is the type of an attribute value
+type AttributeType string
+
+const (
+	AttributeString AttributeType = "string"
+	AttributeInt    AttributeType = "int"
+	AttributeFloat  AttributeType = "float"
+	AttributeBool   AttributeType = "bool"
+	AttributeArray  AttributeType = "array"
+)
+
+// AttributeValue is a typed attribute value. In JSON it is a plain
+// string, number, boolean or array of those; a number without a fraction
+// or exponent is an int.
+type AttributeValue struct {
+	Type   AttributeType
+	Str    string
+	Int    int64
+	Float  float64
+	Bool   bool
+	Values []AttributeValue
+}
+
+// String renders the value as a tag string. Arrays render as a JSON
+// array of their values' strings, as OTLP array attributes do.
+func (v AttributeValue) String() string {
+	switch v.Type {
+	case AttributeInt:
+		return strconv.FormatInt(v.Int, 10)
+	case AttributeFloat:
+		return strconv.FormatFloat(v.Float, 'g', -1, 64)
+	case AttributeBool:
+		return strconv.FormatBool(v.Bool)
+	case AttributeArray:
+		values := make([]string, len(v.Values))
+		for i, item := range v.Values {
+			values[i] = item.String()
+		}
+		data, _ := json.Marshal(values)
+		return string(data)
+	}
+	return v.Str
+}
+
+// MarshalJSON implements json.Marshaler
+func (v AttributeValue) MarshalJSON() ([]byte, error) {
+	switch v.Type {
+	case AttributeInt:
+		return json.Marshal(v.Int)
+	case AttributeFloat:
+		return json.Marshal(v.Float)
+	case AttributeBool:
+		return json.Marshal(v.Bool)
+	case AttributeArray:
+		if v.Values == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(v.Values)
+	}
+	return json.Marshal(v.Str)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (v *AttributeValue) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return fmt.Errorf("empty attribute value")
+	}
+	*v = AttributeValue{}
+	switch data[0] {
+	case '"':
+		v.Type = AttributeString
+		return json.Unmarshal(data, &v.Str)
+	case 't', 'f':
+		v.Type = AttributeBool
+		return json.Unmarshal(data, &v.Bool)
+	case '[':
+		v.Type = AttributeArray
+		return json.Unmarshal(data, &v.Values)
+	case 'n', '{':
+		return fmt.Errorf("unsupported attribute value %s", data)
+	}
+	if bytes.ContainsAny(data, ".eE") {
+		v.Type = AttributeFloat
+		return json.Unmarshal(data, &v.Float)
+	}
+	v.Type = AttributeInt
+	return json.Unmarshal(data, &v.Int)
+}
+
+// EncodeMsgpack encodes the value as its plain string, number, boolean
+// or array, as in JSON
+func (v AttributeValue) EncodeMsgpack(enc *msgpack.Encoder) error {
+	switch v.Type {
+	case AttributeInt:
+		return enc.EncodeInt(v.Int)
+	case AttributeFloat:
+		return enc.EncodeFloat64(v.Float)
+	case AttributeBool:
+		return enc.EncodeBool(v.Bool)
+	case AttributeArray:
+		if err := enc.EncodeArrayLen(len(v.Values)); err != nil {
+			return err
+		}
+		for _, item := range v.Values {
+			if err := item.EncodeMsgpack(enc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return enc.EncodeString(v.Str)
+}
+
+// DecodeMsgpack decodes a value encoded by EncodeMsgpack. Unlike in JSON,
+// integers and floats are told apart by their encoding.
+func (v *AttributeValue) DecodeMsgpack(dec *msgpack.Decoder) error {
+	*v = AttributeValue{}
+	code, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+	if msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32 {
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		v.Type = AttributeArray
+		v.Values = []AttributeValue{}
+		for range n {
+			var item AttributeValue
+			if err := item.DecodeMsgpack(dec); err != nil {
+				return err
+			}
+			v.Values = append(v.Values, item)
+		}
+		return nil
+	}
+	value, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case string:
+		v.Type, v.Str = AttributeString, value
+	case bool:
+		v.Type, v.Bool = AttributeBool, value
+	case int64:
+		v.Type, v.Int = AttributeInt, value
+	case uint64:
+		if value > math.MaxInt64 {
+			return fmt.Errorf("attribute value %d overflows int64", value)
+		}
+		v.Type, v.Int = AttributeInt, int64(value)
+	case float64:
+		v.Type, v.Float = AttributeFloat, value
+	default:
+		return fmt.Errorf("unsupported attribute value %v", value)
+	}
+	return nil
+}
+
+// ToSpans translates the batch into spans. Each span takes its service
+// from its resource's service.name attribute, and the resource's other
+// attributes as tags unless the span sets the same key. Events become
+// span logs, as AddEvent records them.
+func (b *SpanBatchV2) ToSpans(spans []Span) []Span {
+	for _, rs := range b.ResourceSpans {
+		service := ""
+		if name, ok := rs.Resource[ServiceNameAttribute]; ok {
+			service = name.String()
+		}
+		for i := range rs.Spans {
+			span := rs.Spans[i].toSpan(service)
+			for key, value := range rs.Resource {
+				if key == ServiceNameAttribute {
+					continue
+				}
+				if _, ok := span.Tags[key]; !ok {
+					span.AddTag(key, value.String())
+				}
+			}
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// toSpan translates the span into the internal model
+func (s *SpanV2) toSpan(service string) Span {
+	span := Span{
+		TraceID:       s.TraceID,
+		SpanID:        s.SpanID,
+		ParentSpanID:  s.ParentSpanID,
+		OperationName: s.Name,
+		ServiceName:   service,
+		Kind:          s.Kind,
+		StartTime:     s.StartTime,
+		EndTime:       s.EndTime,
+		Status:        s.Status,
+		StatusMessage: s.StatusMessage,
+		Tags:          s.Attributes.Tags(),
+	}
+	span.CalculateDuration()
+
+	for _, event := range s.Events {
+		span.AddEvent(event.Name, event.Time, event.Attributes.Tags())
+	}
+	for _, link := range s.Links {
+		span.Links = append(span.Links, SpanLink{
+			TraceID: link.TraceID,
+			SpanID:  link.SpanID,
+			Tags:    link.Attributes.Tags(),
+		})
+	}
+	return span
+}
@@ -0,0 +1,29 @@
+package models
+
+// DefaultTenant is the tenant used when a request doesn't identify one
+const DefaultTenant = "default"
+
+// TenantHeader is the HTTP header carrying the tenant ID
+const TenantHeader = "X-OmniTrace-Tenant"
+
+// MaxTenantLength caps the length of a tenant ID
+const MaxTenantLength = 64
+
+// ValidTenant reports whether tenant is a valid tenant ID: 1 to 64 ASCII
+// letters, digits, '-' and '_'. Tenant IDs name directories and object
+// keys, so anything that could be a path separator or "." or ".." is
+// ruled out.
+func ValidTenant(tenant string) bool {
+	if tenant == "" || len(tenant) > MaxTenantLength {
+		return false
+	}
+	for i := 0; i < len(tenant); i++ {
+		c := tenant[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
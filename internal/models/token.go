@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// API token scopes. Ingest tokens write telemetry, replicate tokens also
+// write peer replicas and backup imports, which skip quotas and the span
+// age window, read tokens query telemetry through the dashboard and
+// Prometheus APIs, and admin tokens also manage tokens.
+const (
+	TokenScopeIngest    = "ingest"
+	TokenScopeReplicate = "replicate"
+	TokenScopeRead      = "read"
+	TokenScopeAdmin     = "admin"
+)
+
+// APIToken describes a managed API token. The secret itself is only shown
+// once, when the token is created; Prefix identifies it afterwards.
+type APIToken struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	// Service, if set, is the service ingest requests write as
+	Service string `json:"service,omitempty"`
+	// Tenant, if set, is the only tenant the token writes to and reads
+	Tenant     string    `json:"tenant,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreatedAPIToken is a newly created token with its secret
+type CreatedAPIToken struct {
+	APIToken
+	Token string `json:"token"`
+}
@@ -1,13 +1,14 @@
 package models
 
 import (
+	"cmp"
 	"sort"
 	"time"
 )
 
 // Trace represents a complete distributed trace
 type Trace struct {
-	TraceID   string        `json:"trace_id"`
+	TraceID   TraceID       `json:"trace_id"`
 	RootSpan  *Span         `json:"root_span"`
 	Spans     []Span        `json:"spans"`
 	Services  []string      `json:"services"`
@@ -16,6 +17,16 @@ type Trace struct {
 	Duration  time.Duration `json:"duration"`
 	SpanCount int           `json:"span_count"`
 	HasError  bool          `json:"has_error"`
+	// ErrorCount counts the spans with an error status
+	ErrorCount int `json:"error_count"`
+	// Partial is set while the trace is likely still missing spans
+	Partial bool `json:"partial"`
+	// Truncated is set when spans beyond the per-trace span limit were
+	// dropped
+	Truncated bool `json:"truncated"`
+	// Annotations are the notes users attached to the trace, oldest
+	// first. Only trace detail responses carry them.
+	Annotations []TraceAnnotation `json:"annotations,omitempty"`
 }
 
 // ServiceNode represents a node in the service dependency graph
@@ -25,6 +36,16 @@ type ServiceNode struct {
 	ErrorCount  int      `json:"error_count"`
 	AvgDuration float64  `json:"avg_duration_ms"`
 	Connections []string `json:"connections"`
+	// Metadata is the service's entry in the service registry
+	Metadata *ServiceMetadata `json:"metadata,omitempty"`
+}
+
+// OperationStats summarizes the spans of one operation of a service
+type OperationStats struct {
+	Name       string  `json:"name"`
+	SpanCount  int     `json:"span_count"`
+	ErrorCount int     `json:"error_count"`
+	ErrorRate  float64 `json:"error_rate"`
 }
 
 // ServiceGraph represents the service dependency graph
@@ -44,7 +65,7 @@ type ServiceEdge struct {
 
 // TraceSummary provides a summary of a trace
 type TraceSummary struct {
-	TraceID       string        `json:"trace_id"`
+	TraceID       TraceID       `json:"trace_id"`
 	RootOperation string        `json:"root_operation"`
 	RootService   string        `json:"root_service"`
 	StartTime     time.Time     `json:"start_time"`
@@ -52,6 +73,80 @@ type TraceSummary struct {
 	SpanCount     int           `json:"span_count"`
 	ServiceCount  int           `json:"service_count"`
 	HasError      bool          `json:"has_error"`
+	ErrorCount    int           `json:"error_count,omitempty"`
+	Partial       bool          `json:"partial"`
+	Truncated     bool          `json:"truncated"`
+}
+
+// PinnedTrace describes a trace pinned to be kept beyond its TTL
+type PinnedTrace struct {
+	TraceSummary
+	PinnedAt time.Time `json:"pinned_at"`
+	Note     string    `json:"note,omitempty"`
+}
+
+// TraceAnnotation is a note a user attached to a trace, e.g. during an
+// incident investigation
+type TraceAnnotation struct {
+	ID        string    `json:"id"`
+	TraceID   TraceID   `json:"trace_id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Sort keys of trace query results. Results are ordered by the key
+// descending (newest, slowest, largest or most errored first) unless the
+// query asks for ascending order.
+const (
+	TraceSortStartTime  = "start_time"
+	TraceSortDuration   = "duration"
+	TraceSortSpanCount  = "span_count"
+	TraceSortErrorCount = "error_count"
+)
+
+// TraceOrder is the result order of a trace query
+type TraceOrder struct {
+	// SortBy is "" or "start_time", "duration", "span_count" or
+	// "error_count"
+	SortBy string `json:"sort_by,omitempty"`
+	// Ascending orders results oldest, fastest or smallest first
+	Ascending bool `json:"ascending,omitempty"`
+}
+
+// TraceCursor is the position of a trace in the ordering of query results.
+// Results are ordered by the sort key, with ties broken by trace ID.
+type TraceCursor struct {
+	StartTime  time.Time     `json:"start_time"`
+	Duration   time.Duration `json:"duration"`
+	SpanCount  int           `json:"span_count,omitempty"`
+	ErrorCount int           `json:"error_count,omitempty"`
+	TraceID    TraceID       `json:"trace_id"`
+}
+
+// Before reports whether the trace at c comes before the one at other in
+// the result order
+func (c TraceCursor) Before(other TraceCursor, order TraceOrder) bool {
+	var diff int
+	switch order.SortBy {
+	case TraceSortDuration:
+		diff = cmp.Compare(c.Duration, other.Duration)
+	case TraceSortSpanCount:
+		diff = cmp.Compare(c.SpanCount, other.SpanCount)
+	case TraceSortErrorCount:
+		diff = cmp.Compare(c.ErrorCount, other.ErrorCount)
+	default:
+		diff = c.StartTime.Compare(other.StartTime)
+	}
+	if diff != 0 {
+		return (diff > 0) != order.Ascending
+	}
+	return c.TraceID.Compare(other.TraceID) < 0
+}
+
+// Cursor returns the position of the trace in query results
+func (t TraceSummary) Cursor() TraceCursor {
+	return TraceCursor{StartTime: t.StartTime, Duration: t.Duration, SpanCount: t.SpanCount, ErrorCount: t.ErrorCount, TraceID: t.TraceID}
 }
 
 // TraceQuery represents a query for traces
@@ -65,6 +160,92 @@ type TraceQuery struct {
 	HasError    *bool         `json:"has_error,omitempty"`
 	Limit       int           `json:"limit"`
 	Offset      int           `json:"offset"`
+	// Text matches traces whose tag values, log fields or error messages
+	// contain every word of it
+	Text string `json:"q,omitempty"`
+	TraceOrder
+	// After continues a previous query from the given position
+	After *TraceCursor `json:"after,omitempty"`
+	// IncludePartial also returns traces that are likely still incomplete
+	IncludePartial bool `json:"include_partial,omitempty"`
+	// WrittenAfter, if set, only returns traces a span was stored for
+	// after it, however long ago they started, e.g. to find traces that
+	// late spans changed
+	WrittenAfter time.Time `json:"written_after,omitzero"`
+	// Match, if set, is checked last on each candidate trace, e.g. to
+	// evaluate a parsed query
+	Match func(trace *Trace) bool `json:"-"`
+}
+
+// LatencyQuery selects the spans whose latency percentiles are computed
+type LatencyQuery struct {
+	Service   string        `json:"service,omitempty"`
+	Operation string        `json:"operation,omitempty"`
+	StartTime time.Time     `json:"start_time"`
+	EndTime   time.Time     `json:"end_time"`
+	Step      time.Duration `json:"step"`
+}
+
+// LatencyBucket holds span latency percentiles for one time bucket, in
+// milliseconds
+type LatencyBucket struct {
+	StartTime time.Time `json:"start_time"`
+	Count     uint64    `json:"count"`
+	Errors    uint64    `json:"errors"`
+	P50       float64   `json:"p50_ms"`
+	P90       float64   `json:"p90_ms"`
+	P95       float64   `json:"p95_ms"`
+	P99       float64   `json:"p99_ms"`
+}
+
+// ErrorRateBucket is the span count, errors and error rate of one time
+// bucket
+type ErrorRateBucket struct {
+	StartTime time.Time `json:"start_time"`
+	Count     uint64    `json:"count"`
+	Errors    uint64    `json:"errors"`
+	ErrorRate float64   `json:"error_rate"`
+}
+
+// OperationSummaryQuery selects the spans of a service whose request
+// rate, errors and latency are summarized per operation
+type OperationSummaryQuery struct {
+	Service   string    `json:"service"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// OperationSummary is the request rate (per second), errors and latency
+// percentiles (in milliseconds) of one operation over a time range
+type OperationSummary struct {
+	Name      string  `json:"name"`
+	Count     uint64  `json:"count"`
+	Errors    uint64  `json:"errors"`
+	Rate      float64 `json:"rate"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P95       float64 `json:"p95_ms"`
+	P99       float64 `json:"p99_ms"`
+}
+
+// SetRates derives the request and error rates from the counts, for
+// spans over the query's time range
+func (o *OperationSummary) SetRates(query OperationSummaryQuery) {
+	if seconds := query.EndTime.Sub(query.StartTime).Seconds(); seconds > 0 {
+		o.Rate = float64(o.Count) / seconds
+	}
+	if o.Count > 0 {
+		o.ErrorRate = float64(o.Errors) / float64(o.Count)
+	}
+}
+
+// OperationHistory is the span count, errors and latency of an operation
+// over time, kept after its traces expire
+type OperationHistory struct {
+	Service   string          `json:"service"`
+	Operation string          `json:"operation"`
+	Buckets   []LatencyBucket `json:"buckets"`
 }
 
 // BuildTrace constructs a Trace from a slice of spans
@@ -90,12 +271,13 @@ func BuildTrace(spans []Span) *Trace {
 		span := &trace.Spans[i]
 		serviceMap[span.ServiceName] = true
 
-		if span.ParentSpanID == "" {
+		if span.ParentSpanID.IsZero() {
 			trace.RootSpan = span
 		}
 
 		if span.Status == SpanStatusError {
 			trace.HasError = true
+			trace.ErrorCount++
 		}
 	}
 
@@ -133,6 +315,9 @@ func (t *Trace) ToSummary() TraceSummary {
 		SpanCount:    t.SpanCount,
 		ServiceCount: len(t.Services),
 		HasError:     t.HasError,
+		ErrorCount:   t.ErrorCount,
+		Partial:      t.Partial,
+		Truncated:    t.Truncated,
 	}
 
 	if t.RootSpan != nil {
@@ -142,3 +327,107 @@ func (t *Trace) ToSummary() TraceSummary {
 
 	return summary
 }
+
+// FlamegraphQuery selects the spans merged into a flamegraph: spans of a
+// service and operation (or the service's entry spans when Operation is
+// empty) in traces that started within the time range
+type FlamegraphQuery struct {
+	Service   string    `json:"service"`
+	Operation string    `json:"operation,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// MaxTraces caps the number of traces sampled, newest first
+	MaxTraces int `json:"max_traces"`
+}
+
+// FlameNode is a frame of an aggregated call tree. Times are in
+// microseconds: Value is the total time spent in the frame and Self the
+// part not covered by its children.
+type FlameNode struct {
+	Name     string       `json:"name"`
+	Value    int64        `json:"value"`
+	Self     int64        `json:"self"`
+	Count    int          `json:"count"`
+	Children []*FlameNode `json:"children,omitempty"`
+}
+
+// Flamegraph is a call tree merged from many traces
+type Flamegraph struct {
+	Root   *FlameNode `json:"root"`
+	Traces int        `json:"traces"`
+}
+
+// CriticalPathSegment is a stretch of time on a trace's critical path
+// spent in one span, outside of its children
+type CriticalPathSegment struct {
+	SpanID    SpanID    `json:"span_id"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// CriticalPathSpan is a span's share of a trace's critical path
+type CriticalPathSpan struct {
+	SpanID        SpanID        `json:"span_id"`
+	ServiceName   string        `json:"service_name"`
+	OperationName string        `json:"operation_name"`
+	Contribution  time.Duration `json:"contribution"`
+	// Percent is the contribution as a share of the root span's duration
+	Percent float64 `json:"percent"`
+}
+
+// CriticalPath is the chain of spans that determines a trace's latency
+type CriticalPath struct {
+	TraceID  TraceID       `json:"trace_id"`
+	Duration time.Duration `json:"duration"`
+	// Segments cover the root span in time order
+	Segments []CriticalPathSegment `json:"segments"`
+	// Spans are the spans on the path, largest contribution first
+	Spans []CriticalPathSpan `json:"spans"`
+}
+
+// LatencyBreakdownQuery selects the requests of a service whose latency is
+// attributed to its dependencies
+type LatencyBreakdownQuery struct {
+	Service   string        `json:"service"`
+	Operation string        `json:"operation,omitempty"`
+	StartTime time.Time     `json:"start_time"`
+	EndTime   time.Time     `json:"end_time"`
+	Step      time.Duration `json:"step"`
+	// MaxTraces caps the number of traces sampled
+	MaxTraces int `json:"max_traces"`
+}
+
+// LatencyBreakdownBucket splits the average request latency of one time
+// bucket between the service itself and its dependencies, in milliseconds.
+// Self and the dependencies add up to Total.
+type LatencyBreakdownBucket struct {
+	StartTime    time.Time          `json:"start_time"`
+	Count        uint64             `json:"count"`
+	Total        float64            `json:"total_ms"`
+	Self         float64            `json:"self_ms"`
+	Dependencies map[string]float64 `json:"dependencies_ms"`
+}
+
+// LatencyBreakdown attributes a service's request latency to the
+// downstream services it calls
+type LatencyBreakdown struct {
+	Service string `json:"service"`
+	// Dependencies are the called services, most time first
+	Dependencies []string                 `json:"dependencies"`
+	Buckets      []LatencyBreakdownBucket `json:"buckets"`
+	Traces       int                      `json:"traces"`
+}
+
+// TagQuery selects the tag keys of a service's spans (all spans if
+// Service is empty), or the values of a tag key, to complete
+type TagQuery struct {
+	Service string `json:"service,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// TagCount is a tag key or value and the number of traces carrying it
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
@@ -0,0 +1,73 @@
+// Package msgpack adapts github.com/vmihailenco/msgpack/v5 to the
+// ingestion API, whose MessagePack bodies are the binary counterpart of
+// its JSON ones: structs are maps keyed by their json tag names, types
+// implementing encoding.TextMarshaler are strings, and time.Time uses the
+// MessagePack timestamp extension.
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ContentType is the media type of MessagePack request bodies
+const ContentType = "application/msgpack"
+
+// IsContentType reports whether a Content-Type header names MessagePack,
+// under its registered or its older x- name
+func IsContentType(header string) bool {
+	mediaType, _, _ := strings.Cut(header, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case ContentType, "application/x-msgpack":
+		return true
+	}
+	return false
+}
+
+// Timestamps carry no location, so decode them in UTC as encoding/json
+// decodes the ones the SDK sends, rather than in the local time zone
+func init() {
+	msgpack.Register(time.Time{}, nil, func(dec *msgpack.Decoder, v reflect.Value) error {
+		t, err := dec.DecodeTime()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t.UTC()))
+		return nil
+	})
+}
+
+// Marshal returns the MessagePack encoding of v
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the MessagePack encoding in data into the value v
+// points to. Bytes left after the value are an error, as in encoding/json.
+func Unmarshal(data []byte, v any) error {
+	// The decoder allocates the length an array claims before decoding its
+	// elements, so skip over the value first to check that they are there
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+	if err := dec.Skip(); err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("msgpack: %d bytes after the value", r.Len())
+	}
+	r.Reset(data)
+	dec.Reset(r)
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
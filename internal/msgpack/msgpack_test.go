@@ -0,0 +1,237 @@
+package msgpack
+
+import (
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+func testSpan(t *testing.T) models.Span {
+	t.Helper()
+	traceID, err := models.ParseTraceID("4bf92f3577b34da6a3ce929d0e0e4736")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spanID, err := models.ParseSpanID("00f067aa0ba902b7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentID, err := models.ParseSpanID("53995c3f42cd8ad8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	return models.Span{
+		TenantID:      "acme",
+		TraceID:       traceID,
+		SpanID:        spanID,
+		ParentSpanID:  parentID,
+		OperationName: "GET /checkout",
+		ServiceName:   "checkout",
+		Kind:          models.SpanKindServer,
+		StartTime:     start,
+		EndTime:       start.Add(1500 * time.Millisecond),
+		Duration:      1500 * time.Millisecond,
+		Status:        models.SpanStatusError,
+		StatusMessage: "HTTP 502",
+		Tags:          map[string]string{"http.method": "GET", "http.status_code": "502", "unicode": "héllo ✓"},
+		Logs: []models.SpanLog{
+			{Timestamp: start.Add(time.Millisecond), Fields: map[string]string{"event": "retry"}},
+		},
+		Links: []models.SpanLink{
+			{TraceID: traceID, SpanID: parentID, Tags: map[string]string{"link.kind": "follows_from"}},
+		},
+		ErrorInfo: &models.ErrorInfo{
+			Message:    "upstream failed",
+			Type:       "*net.OpError",
+			StackTrace: []string{"main.handler", "net/http.HandlerFunc.ServeHTTP"},
+			Causes:     []models.ErrorCause{{Type: "*net.OpError", Message: "connection refused"}},
+		},
+	}
+}
+
+func TestRoundTripSpanBatch(t *testing.T) {
+	span := testSpan(t)
+	minimal := models.Span{TraceID: span.TraceID, SpanID: span.SpanID, OperationName: "op", StartTime: span.StartTime}
+	want := models.SpanBatch{Spans: []models.Span{span, minimal}}
+
+	data, err := Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got models.SpanBatch
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip mismatch\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+// TestMatchesJSON checks that a value decodes from MessagePack as it does
+// from the JSON the ingestion API also takes
+func TestMatchesJSON(t *testing.T) {
+	batch := models.SpanBatch{Spans: []models.Span{testSpan(t)}}
+
+	jsonData, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON models.SpanBatch
+	if err := json.Unmarshal(jsonData, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromMsgpack models.SpanBatch
+	if err := Unmarshal(data, &fromMsgpack); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromMsgpack, fromJSON) {
+		t.Errorf("MessagePack and JSON decode differently\nmsgpack: %+v\n   json: %+v", fromMsgpack, fromJSON)
+	}
+}
+
+// TestSpanBatchV2MatchesJSON checks that typed attribute values, which
+// encode themselves, decode from MessagePack as they do from JSON
+func TestSpanBatchV2MatchesJSON(t *testing.T) {
+	span := testSpan(t)
+	batch := models.SpanBatchV2{ResourceSpans: []models.ResourceSpansV2{{
+		Resource: models.Attributes{"service.name": {Type: models.AttributeString, Str: "checkout"}},
+		Spans: []models.SpanV2{{
+			TraceID:   span.TraceID,
+			SpanID:    span.SpanID,
+			Name:      "GET /checkout",
+			StartTime: span.StartTime,
+			EndTime:   span.EndTime,
+			Attributes: models.Attributes{
+				"http.status_code": {Type: models.AttributeInt, Int: 502},
+				"ratio":            {Type: models.AttributeFloat, Float: 0.25},
+				"retried":          {Type: models.AttributeBool, Bool: true},
+				"hosts": {Type: models.AttributeArray, Values: []models.AttributeValue{
+					{Type: models.AttributeString, Str: "a"},
+					{Type: models.AttributeInt, Int: -7},
+				}},
+				"empty": {Type: models.AttributeArray, Values: []models.AttributeValue{}},
+			},
+		}},
+	}}}
+
+	jsonData, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON models.SpanBatchV2
+	if err := json.Unmarshal(jsonData, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromMsgpack models.SpanBatchV2
+	if err := Unmarshal(data, &fromMsgpack); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(fromMsgpack, fromJSON) {
+		t.Errorf("MessagePack and JSON decode differently\nmsgpack: %+v\n   json: %+v", fromMsgpack, fromJSON)
+	}
+	if !reflect.DeepEqual(fromMsgpack, batch) {
+		t.Errorf("round trip mismatch\n got: %+v\nwant: %+v", fromMsgpack, batch)
+	}
+}
+
+// TestTruncated checks that every strict prefix of a valid encoding is
+// rejected rather than decoded partially or panicking
+func TestTruncated(t *testing.T) {
+	data, err := Marshal(models.SpanBatch{Spans: []models.Span{testSpan(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range len(data) {
+		var batch models.SpanBatch
+		if err := Unmarshal(data[:n], &batch); err == nil {
+			t.Fatalf("%d of %d bytes decoded without error", n, len(data))
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		into any
+		want string
+	}{
+		{"trailing bytes", []byte{0x80, 0xc0}, new(models.SpanBatch), "bytes after the value"},
+		{"array32 longer than data", []byte{0x81, 0xa5, 's', 'p', 'a', 'n', 's', 0xdd, 0xff, 0xff, 0xff, 0xff}, new(models.SpanBatch), "EOF"},
+		{"invalid trace ID", []byte{0x81, 0xa8, 't', 'r', 'a', 'c', 'e', '_', 'i', 'd', 0xa3, 'x', 'y', 'z'}, new(models.Span), "invalid trace ID"},
+		{"attribute value overflows int64", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, new(models.AttributeValue), "overflows int64"},
+		{"map attribute value", []byte{0x80}, new(models.AttributeValue), "unsupported attribute value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal(tt.data, tt.into)
+			if err == nil {
+				t.Fatalf("Unmarshal(% x) succeeded, want an error containing %q", tt.data, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Unmarshal(% x) = %v, want an error containing %q", tt.data, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestOversizedLengthDoesNotAllocate checks that an array claiming far
+// more elements than follow doesn't have them allocated up front
+func TestOversizedLengthDoesNotAllocate(t *testing.T) {
+	data := []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0x80} // 2^32-1 elements, then one
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var spans []models.Span
+	if err := Unmarshal(data, &spans); err == nil {
+		t.Fatal("decoded an array missing its elements")
+	}
+	runtime.ReadMemStats(&after)
+
+	// Allocating the claimed spans would take over a terabyte
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes decoding a 6 byte body", allocated)
+	}
+}
+
+func TestUnmarshalNeedsPointer(t *testing.T) {
+	var batch models.SpanBatch
+	if err := Unmarshal([]byte{0x80}, batch); err == nil {
+		t.Error("Unmarshal into a non-pointer succeeded")
+	}
+	if err := Unmarshal([]byte{0x80}, (*models.SpanBatch)(nil)); err == nil {
+		t.Error("Unmarshal into a nil pointer succeeded")
+	}
+}
+
+func TestIsContentType(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"application/msgpack", true},
+		{"application/x-msgpack", true},
+		{"Application/MsgPack; charset=binary", true},
+		{"application/json", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsContentType(tt.header); got != tt.want {
+			t.Errorf("IsContentType(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
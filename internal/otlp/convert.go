@@ -0,0 +1,114 @@
+package otlp
+
+import (
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// DefaultServiceName is used when a resource has no service.name attribute
+const DefaultServiceName = "unknown_service"
+
+// ToSpans maps OTLP resource/scope/span structures onto OmniTrace spans.
+// Resource attributes are copied onto each span's tags unless the span
+// already sets the same key; span events become span logs, and an
+// "exception" event populates ErrorInfo.
+func ToSpans(data TracesData) []models.Span {
+	var spans []models.Span
+	for _, rs := range data.ResourceSpans {
+		service := DefaultServiceName
+		for _, attr := range rs.Resource.Attributes {
+			if attr.Key == ServiceNameKey {
+				service = attr.Value.String()
+			}
+		}
+
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				span := toSpan(s, service)
+				for _, attr := range rs.Resource.Attributes {
+					if attr.Key == ServiceNameKey {
+						continue
+					}
+					if _, ok := span.Tags[attr.Key]; !ok {
+						span.Tags[attr.Key] = attr.Value.String()
+					}
+				}
+				if ss.Scope.Name != "" {
+					span.Tags["otel.scope.name"] = ss.Scope.Name
+				}
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans
+}
+
+func toSpan(s Span, service string) models.Span {
+	span := models.Span{
+		OperationName: s.Name,
+		ServiceName:   service,
+		Kind:          kindFromOTLP(s.Kind),
+		StartTime:     fromUnixNano(s.StartTimeUnixNano),
+		EndTime:       fromUnixNano(s.EndTimeUnixNano),
+		Status:        statusFromOTLP(s.Status.Code),
+		StatusMessage: s.Status.Message,
+		Tags:          make(map[string]string, len(s.Attributes)),
+	}
+	span.CalculateDuration()
+
+	// IDs that don't parse are left zero, which the validator rejects. A
+	// span with a malformed parent is rejected too, rather than being taken
+	// for a root.
+	span.TraceID, _ = models.ParseTraceID(s.TraceID)
+	span.SpanID, _ = models.ParseSpanID(s.SpanID)
+	var err error
+	if span.ParentSpanID, err = models.ParseSpanID(s.ParentSpanID); err != nil {
+		span.SpanID = models.SpanID{}
+	}
+
+	for _, attr := range s.Attributes {
+		span.Tags[attr.Key] = attr.Value.String()
+	}
+
+	for _, event := range s.Events {
+		fields := make(map[string]string, len(event.Attributes)+1)
+		for _, attr := range event.Attributes {
+			fields[attr.Key] = attr.Value.String()
+		}
+		span.AddEvent(event.Name, fromUnixNano(event.TimeUnixNano), fields)
+	}
+
+	return span
+}
+
+func fromUnixNano(ns Uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns)).UTC()
+}
+
+func kindFromOTLP(kind int) models.SpanKind {
+	switch kind {
+	case SpanKindServer:
+		return models.SpanKindServer
+	case SpanKindClient:
+		return models.SpanKindClient
+	case SpanKindProducer:
+		return models.SpanKindProducer
+	case SpanKindConsumer:
+		return models.SpanKindConsumer
+	}
+	return models.SpanKindInternal
+}
+
+func statusFromOTLP(code int) models.SpanStatus {
+	switch code {
+	case StatusCodeOK:
+		return models.SpanStatusOK
+	case StatusCodeError:
+		return models.SpanStatusError
+	}
+	return models.SpanStatusUnset
+}
@@ -0,0 +1,317 @@
+// Package otlp defines the OTLP/HTTP JSON trace payload and its mapping to
+// and from OmniTrace models.
+package otlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// TracesData is the body of an OTLP /v1/traces export request
+type TracesData struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+// ResourceSpans groups spans emitted by a single resource
+type ResourceSpans struct {
+	Resource   Resource     `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+// Resource describes the entity producing telemetry
+type Resource struct {
+	Attributes []KeyValue `json:"attributes,omitempty"`
+}
+
+// ScopeSpans groups spans emitted by a single instrumentation scope
+type ScopeSpans struct {
+	Scope Scope  `json:"scope"`
+	Spans []Span `json:"spans"`
+}
+
+// Scope identifies an instrumentation library
+type Scope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Span is an OTLP span
+type Span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   Uint64     `json:"endTimeUnixNano"`
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	Events            []Event    `json:"events,omitempty"`
+	Status            Status     `json:"status"`
+}
+
+// Event is a timestamped annotation on a span
+type Event struct {
+	TimeUnixNano Uint64     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []KeyValue `json:"attributes,omitempty"`
+}
+
+// Status is the OTLP span status
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// KeyValue is an OTLP attribute
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue is an OTLP attribute value. Exactly one field is set.
+type AnyValue struct {
+	StringValue *string       `json:"stringValue,omitempty"`
+	BoolValue   *bool         `json:"boolValue,omitempty"`
+	IntValue    *Int64        `json:"intValue,omitempty"`
+	DoubleValue *float64      `json:"doubleValue,omitempty"`
+	ArrayValue  *ArrayValue   `json:"arrayValue,omitempty"`
+	KvlistValue *KeyValueList `json:"kvlistValue,omitempty"`
+	BytesValue  *string       `json:"bytesValue,omitempty"`
+}
+
+// ArrayValue is a list of values
+type ArrayValue struct {
+	Values []AnyValue `json:"values"`
+}
+
+// KeyValueList is a nested attribute map
+type KeyValueList struct {
+	Values []KeyValue `json:"values"`
+}
+
+// Span kinds
+const (
+	SpanKindUnspecified = 0
+	SpanKindInternal    = 1
+	SpanKindServer      = 2
+	SpanKindClient      = 3
+	SpanKindProducer    = 4
+	SpanKindConsumer    = 5
+)
+
+// Status codes
+const (
+	StatusCodeUnset = 0
+	StatusCodeOK    = 1
+	StatusCodeError = 2
+)
+
+// ServiceNameKey is the resource attribute carrying the service name
+const ServiceNameKey = "service.name"
+
+// Uint64 is a uint64 encoded as a JSON string, as OTLP/JSON requires, that
+// also accepts plain JSON numbers when decoding
+type Uint64 uint64
+
+// MarshalJSON implements json.Marshaler
+func (u Uint64) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(strconv.FormatUint(uint64(u), 10))), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (u *Uint64) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if s == "" || s == "null" {
+		*u = 0
+		return nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid uint64 %q: %w", s, err)
+	}
+	*u = Uint64(v)
+	return nil
+}
+
+// Int64 is an int64 encoded as a JSON string that also accepts numbers
+type Int64 int64
+
+// MarshalJSON implements json.Marshaler
+func (i Int64) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(strconv.FormatInt(int64(i), 10))), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (i *Int64) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %q: %w", s, err)
+	}
+	*i = Int64(v)
+	return nil
+}
+
+// StringValue wraps s in an AnyValue
+func StringValue(s string) AnyValue {
+	return AnyValue{StringValue: &s}
+}
+
+// String renders the value as a tag string
+func (v AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	case v.ArrayValue != nil:
+		values := make([]string, len(v.ArrayValue.Values))
+		for i, item := range v.ArrayValue.Values {
+			values[i] = item.String()
+		}
+		data, _ := json.Marshal(values)
+		return string(data)
+	case v.KvlistValue != nil:
+		values := make(map[string]string, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.String()
+		}
+		data, _ := json.Marshal(values)
+		return string(data)
+	}
+	return ""
+}
+
+// FromSpans converts OmniTrace spans into an OTLP export request, grouping
+// them into one resource per service
+func FromSpans(spans []models.Span) TracesData {
+	byService := make(map[string][]Span)
+	for _, s := range spans {
+		byService[s.ServiceName] = append(byService[s.ServiceName], fromSpan(s))
+	}
+
+	services := make([]string, 0, len(byService))
+	for service := range byService {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	data := TracesData{ResourceSpans: make([]ResourceSpans, 0, len(services))}
+	for _, service := range services {
+		data.ResourceSpans = append(data.ResourceSpans, ResourceSpans{
+			Resource: Resource{
+				Attributes: []KeyValue{{Key: ServiceNameKey, Value: StringValue(service)}},
+			},
+			ScopeSpans: []ScopeSpans{{
+				Scope: Scope{Name: "omnitrace"},
+				Spans: byService[service],
+			}},
+		})
+	}
+	return data
+}
+
+func fromSpan(s models.Span) Span {
+	out := Span{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		ParentSpanID:      s.ParentSpanID.String(),
+		Name:              s.OperationName,
+		Kind:              kindToOTLP(s.Kind),
+		StartTimeUnixNano: unixNano(s.StartTime),
+		EndTimeUnixNano:   unixNano(s.EndTime),
+		Status:            Status{Code: statusToOTLP(s.Status), Message: s.StatusMessage},
+	}
+
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out.Attributes = append(out.Attributes, KeyValue{Key: k, Value: StringValue(s.Tags[k])})
+	}
+
+	for _, log := range s.Logs {
+		event := Event{TimeUnixNano: unixNano(log.Timestamp), Name: log.Fields["event"]}
+		if event.Name == "" {
+			event.Name = "log"
+		}
+		for k, v := range log.Fields {
+			if k == "event" {
+				continue
+			}
+			event.Attributes = append(event.Attributes, KeyValue{Key: k, Value: StringValue(v)})
+		}
+		out.Events = append(out.Events, event)
+	}
+
+	if s.ErrorInfo != nil {
+		event := Event{
+			TimeUnixNano: unixNano(s.EndTime),
+			Name:         "exception",
+			Attributes: []KeyValue{
+				{Key: "exception.type", Value: StringValue(s.ErrorInfo.Type)},
+				{Key: "exception.message", Value: StringValue(s.ErrorInfo.Message)},
+			},
+		}
+		if len(s.ErrorInfo.StackTrace) > 0 {
+			stack := strings.Join(s.ErrorInfo.StackTrace, "\n")
+			event.Attributes = append(event.Attributes, KeyValue{Key: "exception.stacktrace", Value: StringValue(stack)})
+		}
+		out.Events = append(out.Events, event)
+	}
+
+	return out
+}
+
+func unixNano(t time.Time) Uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return Uint64(t.UnixNano())
+}
+
+func kindToOTLP(kind models.SpanKind) int {
+	switch kind {
+	case models.SpanKindInternal:
+		return SpanKindInternal
+	case models.SpanKindServer:
+		return SpanKindServer
+	case models.SpanKindClient:
+		return SpanKindClient
+	case models.SpanKindProducer:
+		return SpanKindProducer
+	case models.SpanKindConsumer:
+		return SpanKindConsumer
+	}
+	return SpanKindUnspecified
+}
+
+func statusToOTLP(status models.SpanStatus) int {
+	switch status {
+	case models.SpanStatusOK:
+		return StatusCodeOK
+	case models.SpanStatusError:
+		return StatusCodeError
+	}
+	return StatusCodeUnset
+}
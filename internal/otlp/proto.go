@@ -0,0 +1,292 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// FromProtoTraces converts a protobuf export request (OTLP/gRPC or
+// OTLP/HTTP protobuf) into the JSON payload representation
+func FromProtoTraces(req *coltracepb.ExportTraceServiceRequest) TracesData {
+	data := TracesData{ResourceSpans: make([]ResourceSpans, 0, len(req.GetResourceSpans()))}
+	for _, rs := range req.GetResourceSpans() {
+		out := ResourceSpans{
+			Resource: Resource{Attributes: fromProtoAttributes(rs.GetResource().GetAttributes())},
+		}
+		for _, ss := range rs.GetScopeSpans() {
+			scope := ScopeSpans{
+				Scope: Scope{Name: ss.GetScope().GetName(), Version: ss.GetScope().GetVersion()},
+			}
+			for _, s := range ss.GetSpans() {
+				span := Span{
+					TraceID:           hex.EncodeToString(s.GetTraceId()),
+					SpanID:            hex.EncodeToString(s.GetSpanId()),
+					ParentSpanID:      hex.EncodeToString(s.GetParentSpanId()),
+					Name:              s.GetName(),
+					Kind:              int(s.GetKind()),
+					StartTimeUnixNano: Uint64(s.GetStartTimeUnixNano()),
+					EndTimeUnixNano:   Uint64(s.GetEndTimeUnixNano()),
+					Attributes:        fromProtoAttributes(s.GetAttributes()),
+					Status: Status{
+						Code:    int(s.GetStatus().GetCode()),
+						Message: s.GetStatus().GetMessage(),
+					},
+				}
+				for _, e := range s.GetEvents() {
+					span.Events = append(span.Events, Event{
+						TimeUnixNano: Uint64(e.GetTimeUnixNano()),
+						Name:         e.GetName(),
+						Attributes:   fromProtoAttributes(e.GetAttributes()),
+					})
+				}
+				scope.Spans = append(scope.Spans, span)
+			}
+			out.ScopeSpans = append(out.ScopeSpans, scope)
+		}
+		data.ResourceSpans = append(data.ResourceSpans, out)
+	}
+	return data
+}
+
+func fromProtoAttributes(attrs []*commonpb.KeyValue) []KeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make([]KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		out = append(out, KeyValue{Key: kv.GetKey(), Value: fromProtoValue(kv.GetValue())})
+	}
+	return out
+}
+
+func fromProtoValue(v *commonpb.AnyValue) AnyValue {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return StringValue(val.StringValue)
+	case *commonpb.AnyValue_BoolValue:
+		b := val.BoolValue
+		return AnyValue{BoolValue: &b}
+	case *commonpb.AnyValue_IntValue:
+		i := Int64(val.IntValue)
+		return AnyValue{IntValue: &i}
+	case *commonpb.AnyValue_DoubleValue:
+		d := val.DoubleValue
+		return AnyValue{DoubleValue: &d}
+	case *commonpb.AnyValue_BytesValue:
+		s := base64.StdEncoding.EncodeToString(val.BytesValue)
+		return AnyValue{BytesValue: &s}
+	case *commonpb.AnyValue_ArrayValue:
+		arr := &ArrayValue{}
+		for _, item := range val.ArrayValue.GetValues() {
+			arr.Values = append(arr.Values, fromProtoValue(item))
+		}
+		return AnyValue{ArrayValue: arr}
+	case *commonpb.AnyValue_KvlistValue:
+		return AnyValue{KvlistValue: &KeyValueList{Values: fromProtoAttributes(val.KvlistValue.GetValues())}}
+	}
+	return AnyValue{}
+}
+
+// ToProtoTraces converts the JSON payload representation into a protobuf
+// export request. IDs that aren't valid hex are left empty.
+func ToProtoTraces(data TracesData) *coltracepb.ExportTraceServiceRequest {
+	req := &coltracepb.ExportTraceServiceRequest{ResourceSpans: make([]*tracepb.ResourceSpans, 0, len(data.ResourceSpans))}
+	for _, rs := range data.ResourceSpans {
+		out := &tracepb.ResourceSpans{
+			Resource: &resourcepb.Resource{Attributes: toProtoAttributes(rs.Resource.Attributes)},
+		}
+		for _, ss := range rs.ScopeSpans {
+			scope := &tracepb.ScopeSpans{
+				Scope: &commonpb.InstrumentationScope{Name: ss.Scope.Name, Version: ss.Scope.Version},
+			}
+			for _, s := range ss.Spans {
+				span := &tracepb.Span{
+					TraceId:           decodeID(s.TraceID),
+					SpanId:            decodeID(s.SpanID),
+					ParentSpanId:      decodeID(s.ParentSpanID),
+					Name:              s.Name,
+					Kind:              tracepb.Span_SpanKind(s.Kind),
+					StartTimeUnixNano: uint64(s.StartTimeUnixNano),
+					EndTimeUnixNano:   uint64(s.EndTimeUnixNano),
+					Attributes:        toProtoAttributes(s.Attributes),
+					Status: &tracepb.Status{
+						Code:    tracepb.Status_StatusCode(s.Status.Code),
+						Message: s.Status.Message,
+					},
+				}
+				for _, e := range s.Events {
+					span.Events = append(span.Events, &tracepb.Span_Event{
+						TimeUnixNano: uint64(e.TimeUnixNano),
+						Name:         e.Name,
+						Attributes:   toProtoAttributes(e.Attributes),
+					})
+				}
+				scope.Spans = append(scope.Spans, span)
+			}
+			out.ScopeSpans = append(out.ScopeSpans, scope)
+		}
+		req.ResourceSpans = append(req.ResourceSpans, out)
+	}
+	return req
+}
+
+func decodeID(id string) []byte {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func toProtoAttributes(attrs []KeyValue) []*commonpb.KeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		out = append(out, &commonpb.KeyValue{Key: kv.Key, Value: toProtoValue(kv.Value)})
+	}
+	return out
+}
+
+func toProtoValue(v AnyValue) *commonpb.AnyValue {
+	switch {
+	case v.StringValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: *v.StringValue}}
+	case v.BoolValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: *v.BoolValue}}
+	case v.IntValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(*v.IntValue)}}
+	case v.DoubleValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: *v.DoubleValue}}
+	case v.BytesValue != nil:
+		b, _ := base64.StdEncoding.DecodeString(*v.BytesValue)
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: b}}
+	case v.ArrayValue != nil:
+		arr := &commonpb.ArrayValue{}
+		for _, item := range v.ArrayValue.Values {
+			arr.Values = append(arr.Values, toProtoValue(item))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: arr}}
+	case v.KvlistValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: toProtoAttributes(v.KvlistValue.Values)}}}
+	}
+	return &commonpb.AnyValue{}
+}
+
+// ToMetrics maps an OTLP metrics export request onto OmniTrace metrics.
+// Gauges become gauges and sums become counters. Histograms and summaries
+// are flattened Prometheus-style into <name>_count and <name>_sum counters,
+// and summaries additionally emit one gauge per quantile. Counters from
+// cumulative data points are marked Cumulative.
+func ToMetrics(req *colmetricspb.ExportMetricsServiceRequest) []models.Metric {
+	var metrics []models.Metric
+	for _, rm := range req.GetResourceMetrics() {
+		service := resourceServiceName(rm.GetResource())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				metrics = append(metrics, toMetrics(m, service)...)
+			}
+		}
+	}
+	return metrics
+}
+
+func resourceServiceName(r *resourcepb.Resource) string {
+	for _, kv := range r.GetAttributes() {
+		if kv.GetKey() == ServiceNameKey {
+			return fromProtoValue(kv.GetValue()).String()
+		}
+	}
+	return DefaultServiceName
+}
+
+func toMetrics(m *metricspb.Metric, service string) []models.Metric {
+	var out []models.Metric
+
+	newMetric := func(name string, typ models.MetricType, value float64, ts uint64, attrs []*commonpb.KeyValue) models.Metric {
+		metric := models.Metric{
+			Name:      name,
+			Type:      typ,
+			Value:     value,
+			Timestamp: fromUnixNano(Uint64(ts)),
+			Service:   service,
+		}
+		for _, kv := range attrs {
+			metric.WithLabel(kv.GetKey(), fromProtoValue(kv.GetValue()).String())
+		}
+		return metric
+	}
+	newCounter := func(name string, value float64, ts uint64, attrs []*commonpb.KeyValue, cumulative bool) models.Metric {
+		metric := newMetric(name, models.MetricTypeCounter, value, ts, attrs)
+		metric.Cumulative = cumulative
+		return metric
+	}
+
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			out = append(out, newMetric(m.GetName(), models.MetricTypeGauge, numberValue(dp), dp.GetTimeUnixNano(), dp.GetAttributes()))
+		}
+	case *metricspb.Metric_Sum:
+		cumulative := isCumulative(data.Sum.GetAggregationTemporality())
+		for _, dp := range data.Sum.GetDataPoints() {
+			out = append(out, newCounter(m.GetName(), numberValue(dp), dp.GetTimeUnixNano(), dp.GetAttributes(), cumulative))
+		}
+	case *metricspb.Metric_Histogram:
+		cumulative := isCumulative(data.Histogram.GetAggregationTemporality())
+		for _, dp := range data.Histogram.GetDataPoints() {
+			out = append(out,
+				newCounter(m.GetName()+"_count", float64(dp.GetCount()), dp.GetTimeUnixNano(), dp.GetAttributes(), cumulative),
+				newCounter(m.GetName()+"_sum", dp.GetSum(), dp.GetTimeUnixNano(), dp.GetAttributes(), cumulative),
+			)
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		cumulative := isCumulative(data.ExponentialHistogram.GetAggregationTemporality())
+		for _, dp := range data.ExponentialHistogram.GetDataPoints() {
+			out = append(out,
+				newCounter(m.GetName()+"_count", float64(dp.GetCount()), dp.GetTimeUnixNano(), dp.GetAttributes(), cumulative),
+				newCounter(m.GetName()+"_sum", dp.GetSum(), dp.GetTimeUnixNano(), dp.GetAttributes(), cumulative),
+			)
+		}
+	case *metricspb.Metric_Summary:
+		// Summary counts and sums are always running totals
+		for _, dp := range data.Summary.GetDataPoints() {
+			out = append(out,
+				newCounter(m.GetName()+"_count", float64(dp.GetCount()), dp.GetTimeUnixNano(), dp.GetAttributes(), true),
+				newCounter(m.GetName()+"_sum", dp.GetSum(), dp.GetTimeUnixNano(), dp.GetAttributes(), true),
+			)
+			for _, q := range dp.GetQuantileValues() {
+				metric := newMetric(m.GetName(), models.MetricTypeGauge, q.GetValue(), dp.GetTimeUnixNano(), dp.GetAttributes())
+				metric.WithLabel("quantile", fmt.Sprintf("%g", q.GetQuantile()))
+				out = append(out, metric)
+			}
+		}
+	}
+
+	return out
+}
+
+func isCumulative(t metricspb.AggregationTemporality) bool {
+	return t == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+}
+
+func numberValue(dp *metricspb.NumberDataPoint) float64 {
+	switch v := dp.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		return v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		return float64(v.AsInt)
+	}
+	return 0
+}
@@ -12,25 +12,59 @@ import (
 
 // HTTPClient is an instrumented HTTP client
 type HTTPClient struct {
-	client *http.Client
-	tracer *Tracer
+	client  *http.Client
+	tracer  *Tracer
+	options clientOptions
+}
+
+// clientOptions holds settings shared by HTTPClient and RoundTripper
+type clientOptions struct {
+	urlSanitizer func(string) string
+}
+
+// ClientOption is a function that configures an instrumented client
+type ClientOption func(*clientOptions)
+
+// WithURLSanitizer applies fn to outgoing request URLs before they are
+// recorded as the http.url tag (e.g. SanitizeURL)
+func WithURLSanitizer(fn func(string) string) ClientOption {
+	return func(o *clientOptions) {
+		o.urlSanitizer = fn
+	}
+}
+
+func newClientOptions(opts []ClientOption) clientOptions {
+	var o clientOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o clientOptions) requestURL(req *http.Request) string {
+	if o.urlSanitizer != nil {
+		return o.urlSanitizer(req.URL.String())
+	}
+	return req.URL.String()
 }
 
 // NewHTTPClient creates a new instrumented HTTP client
-func NewHTTPClient(tracer *Tracer, timeout time.Duration) *HTTPClient {
+func NewHTTPClient(tracer *Tracer, timeout time.Duration, opts ...ClientOption) *HTTPClient {
 	return &HTTPClient{
 		client: &http.Client{
 			Timeout: timeout,
 		},
-		tracer: tracer,
+		tracer:  tracer,
+		options: newClientOptions(opts),
 	}
 }
 
 // NewHTTPClientWithClient wraps an existing http.Client
-func NewHTTPClientWithClient(tracer *Tracer, client *http.Client) *HTTPClient {
+func NewHTTPClientWithClient(tracer *Tracer, client *http.Client, opts ...ClientOption) *HTTPClient {
 	return &HTTPClient{
-		client: client,
-		tracer: tracer,
+		client:  client,
+		tracer:  tracer,
+		options: newClientOptions(opts),
 	}
 }
 
@@ -41,7 +75,7 @@ func (c *HTTPClient) Do(ctx context.Context, req *http.Request) (*http.Response,
 	span, ctx := StartSpanFromContext(ctx, operationName,
 		WithKind(models.SpanKindClient),
 		WithTag("http.method", req.Method),
-		WithTag("http.url", req.URL.String()),
+		WithTag("http.url", c.options.requestURL(req)),
 		WithTag("http.host", req.URL.Host),
 		WithTag("peer.service", req.URL.Host),
 	)
@@ -102,16 +136,18 @@ func (c *HTTPClient) Post(ctx context.Context, url string, contentType string, b
 type RoundTripper struct {
 	transport http.RoundTripper
 	tracer    *Tracer
+	options   clientOptions
 }
 
 // NewRoundTripper creates a new tracing RoundTripper
-func NewRoundTripper(tracer *Tracer, transport http.RoundTripper) *RoundTripper {
+func NewRoundTripper(tracer *Tracer, transport http.RoundTripper, opts ...ClientOption) *RoundTripper {
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
 	return &RoundTripper{
 		transport: transport,
 		tracer:    tracer,
+		options:   newClientOptions(opts),
 	}
 }
 
@@ -123,7 +159,7 @@ func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	span, ctx := StartSpanFromContext(ctx, operationName,
 		WithKind(models.SpanKindClient),
 		WithTag("http.method", req.Method),
-		WithTag("http.url", req.URL.String()),
+		WithTag("http.url", rt.options.requestURL(req)),
 		WithTag("http.host", req.URL.Host),
 	)
 	defer span.Finish()
@@ -157,9 +193,9 @@ func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // InstrumentedClient returns an http.Client with tracing instrumentation
-func InstrumentedClient(tracer *Tracer, timeout time.Duration) *http.Client {
+func InstrumentedClient(tracer *Tracer, timeout time.Duration, opts ...ClientOption) *http.Client {
 	return &http.Client{
 		Timeout:   timeout,
-		Transport: NewRoundTripper(tracer, nil),
+		Transport: NewRoundTripper(tracer, nil, opts...),
 	}
 }
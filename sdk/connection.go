@@ -0,0 +1,145 @@
+package sdk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection types recorded on long-lived connection spans
+const (
+	ConnectionTypeWebSocket = "websocket"
+	ConnectionTypeSSE       = "sse"
+)
+
+// connectionType detects long-lived connection requests (WebSocket upgrades
+// and Server-Sent Events streams). It returns "" for regular requests.
+func connectionType(r *http.Request) string {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return ConnectionTypeWebSocket
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return ConnectionTypeSSE
+	}
+	return ""
+}
+
+// connTracker records the lifecycle of a long-lived connection on its span.
+// Message counts are approximations: each Write/Read call on the connection
+// (or each Write on an SSE stream) is counted as one message.
+type connTracker struct {
+	span        *SpanBuilder
+	kind        string
+	connectedAt time.Time
+	sent        int64
+	received    int64
+	onClose     func()
+
+	// mu serializes the handler's and the closing goroutine's writes to
+	// the span, which is finished once closed is set
+	mu     sync.Mutex
+	closed bool
+}
+
+func newConnTracker(span *SpanBuilder, kind string) *connTracker {
+	ct := &connTracker{
+		span:        span,
+		kind:        kind,
+		connectedAt: time.Now(),
+	}
+	span.SetTag("connection.type", kind)
+	span.LogFields(map[string]string{
+		"event":           "connect",
+		"connection.type": kind,
+	})
+	return ct
+}
+
+// disconnect logs the disconnect event with the message counts and calls
+// onClose, unless the connection was already disconnected or aborted
+func (ct *connTracker) disconnect() {
+	ct.abort(func() {
+		sent := atomic.LoadInt64(&ct.sent)
+		received := atomic.LoadInt64(&ct.received)
+		ct.span.SetTag("connection.messages_sent", fmt.Sprintf("%d", sent))
+		ct.span.SetTag("connection.messages_received", fmt.Sprintf("%d", received))
+		ct.span.LogFields(map[string]string{
+			"event":             "disconnect",
+			"connection.type":   ct.kind,
+			"messages_sent":     fmt.Sprintf("%d", sent),
+			"messages_received": fmt.Sprintf("%d", received),
+			"duration_ms":       fmt.Sprintf("%d", time.Since(ct.connectedAt).Milliseconds()),
+		})
+		if ct.onClose != nil {
+			ct.onClose()
+		}
+	})
+}
+
+// whileOpen runs f unless the connection has been closed, holding off a
+// concurrent disconnect until f returns
+func (ct *connTracker) whileOpen(f func()) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if !ct.closed {
+		f()
+	}
+}
+
+// abort closes the tracker with f in place of the disconnect, so that a
+// later disconnect doesn't touch the span f finished. It does nothing if
+// the tracker is already closed.
+func (ct *connTracker) abort(f func()) {
+	ct.whileOpen(func() {
+		ct.closed = true
+		f()
+	})
+}
+
+// wrap returns a net.Conn and bufio.ReadWriter that count messages flowing
+// through a hijacked connection
+func (ct *connTracker) wrap(conn net.Conn, brw *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter) {
+	tc := &trackedConn{Conn: conn, tracker: ct}
+
+	// Preserve any bytes already buffered by the server before the hijack
+	var r io.Reader = tc
+	if brw != nil && brw.Reader.Buffered() > 0 {
+		r = io.MultiReader(io.LimitReader(brw.Reader, int64(brw.Reader.Buffered())), tc)
+	}
+	return tc, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(tc))
+}
+
+// trackedConn is a net.Conn that counts reads/writes and finishes the
+// connection span when closed
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.tracker.received, 1)
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&c.tracker.sent, 1)
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.tracker.disconnect()
+	return err
+}
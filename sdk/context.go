@@ -2,6 +2,7 @@ package sdk
 
 import (
 	"context"
+	"fmt"
 	"sync"
 )
 
@@ -15,11 +16,11 @@ type SpanContext struct {
 }
 
 // contextKey is a private type for context keys
-type contextKey struct{}
+type contextKey int
 
-var (
-	spanContextKey = contextKey{}
-	spanBuilderKey = contextKey{}
+const (
+	spanContextKey contextKey = iota
+	spanBuilderKey
 )
 
 // ContextWithSpan returns a new context with the span attached
@@ -27,12 +28,22 @@ func ContextWithSpan(ctx context.Context, span *SpanBuilder) context.Context {
 	return context.WithValue(ctx, spanBuilderKey, span)
 }
 
-// SpanFromContext returns the span from the context, or nil if not present
+// SpanFromContext returns the span from the context, or a no-op span if not
+// present, so callers can use the result without nil checks
 func SpanFromContext(ctx context.Context) *SpanBuilder {
-	if span, ok := ctx.Value(spanBuilderKey).(*SpanBuilder); ok {
+	if span, ok := spanFromContext(ctx); ok {
 		return span
 	}
-	return nil
+	return noopSpan
+}
+
+// spanFromContext returns the span from the context and whether one was set
+func spanFromContext(ctx context.Context) (*SpanBuilder, bool) {
+	span, ok := ctx.Value(spanBuilderKey).(*SpanBuilder)
+	if !ok || span.isNoop() {
+		return nil, false
+	}
+	return span, true
 }
 
 // ContextWithSpanContext returns a new context with the span context attached
@@ -48,18 +59,24 @@ func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
 	return SpanContext{}, false
 }
 
-// StartSpanFromContext creates a new span as a child of the span in the context
+// StartSpanFromContext creates a new span as a child of the span in the
+// context, using the global tracer
 func StartSpanFromContext(ctx context.Context, operationName string, opts ...SpanOption) (*SpanBuilder, context.Context) {
-	tracer := GlobalTracer()
+	return GlobalTracer().StartSpanFromContext(ctx, operationName, opts...)
+}
+
+// StartSpanFromContext creates a new span as a child of the span in the context
+func (t *Tracer) StartSpanFromContext(ctx context.Context, operationName string, opts ...SpanOption) (*SpanBuilder, context.Context) {
+	opts = append([]SpanOption{WithContext(ctx)}, opts...)
 
 	// Check for existing span in context
-	if parentSpan := SpanFromContext(ctx); parentSpan != nil {
+	if parentSpan, ok := spanFromContext(ctx); ok {
 		opts = append([]SpanOption{WithParent(parentSpan)}, opts...)
 	} else if sc, ok := SpanContextFromContext(ctx); ok {
 		opts = append([]SpanOption{WithParentContext(sc)}, opts...)
 	}
 
-	span := tracer.StartSpan(operationName, opts...)
+	span := t.StartSpan(operationName, opts...)
 	newCtx := ContextWithSpan(ctx, span)
 	newCtx = ContextWithSpanContext(newCtx, span.Context())
 
@@ -69,6 +86,7 @@ func StartSpanFromContext(ctx context.Context, operationName string, opts ...Spa
 // AsyncContext maintains trace context across goroutines
 type AsyncContext struct {
 	mu      sync.RWMutex
+	span    *SpanBuilder
 	spanCtx SpanContext
 	baggage map[string]string
 }
@@ -76,6 +94,7 @@ type AsyncContext struct {
 // NewAsyncContext creates a new async context from a span
 func NewAsyncContext(span *SpanBuilder) *AsyncContext {
 	return &AsyncContext{
+		span:    span,
 		spanCtx: span.Context(),
 		baggage: make(map[string]string),
 	}
@@ -95,6 +114,15 @@ func NewAsyncContextFromSpanContext(sc SpanContext) *AsyncContext {
 	return ac
 }
 
+// tracer returns the tracer of the span the context was created from, so
+// that child spans are exported alongside it, or the global tracer
+func (ac *AsyncContext) tracer() *Tracer {
+	if !ac.span.isNoop() {
+		return ac.span.tracer
+	}
+	return GlobalTracer()
+}
+
 // SpanContext returns the span context
 func (ac *AsyncContext) SpanContext() SpanContext {
 	ac.mu.RLock()
@@ -135,12 +163,89 @@ func (ac *AsyncContext) Go(fn func(ctx context.Context)) {
 func (ac *AsyncContext) GoWithSpan(operationName string, fn func(ctx context.Context, span *SpanBuilder)) {
 	go func() {
 		ctx := ac.ToContext(context.Background())
-		span, ctx := StartSpanFromContext(ctx, operationName)
+		span, ctx := ac.tracer().StartSpanFromContext(ctx, operationName)
 		defer span.Finish()
 		fn(ctx, span)
 	}()
 }
 
+// SpanGroup runs a set of goroutines, each in its own child span, and waits
+// for them errgroup-style. The aggregate outcome is recorded on the parent
+// span when the AsyncContext was created from one.
+type SpanGroup struct {
+	ac     *AsyncContext
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	err     error
+	started int
+	failed  int
+}
+
+// SpanGroup creates a span group whose goroutines inherit ctx. The returned
+// context is cancelled when the first goroutine returns an error or Wait
+// returns.
+func (ac *AsyncContext) SpanGroup(ctx context.Context) (*SpanGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ac.ToContext(ctx))
+	return &SpanGroup{
+		ac:     ac,
+		ctx:    ctx,
+		cancel: cancel,
+	}, ctx
+}
+
+// Go runs fn in a new goroutine inside a child span named operationName.
+// A returned error marks the child span as errored.
+func (g *SpanGroup) Go(operationName string, fn func(ctx context.Context, span *SpanBuilder) error) {
+	g.mu.Lock()
+	g.started++
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		span, ctx := g.ac.tracer().StartSpanFromContext(g.ctx, operationName)
+		err := fn(ctx, span)
+		if err != nil {
+			span.SetError(err)
+		}
+		span.Finish()
+
+		if err != nil {
+			g.mu.Lock()
+			g.failed++
+			if g.err == nil {
+				g.err = err
+				g.cancel()
+			}
+			g.mu.Unlock()
+		}
+	}()
+}
+
+// Wait blocks until all goroutines have finished, records the aggregate
+// outcome on the parent span and returns the first error, if any
+func (g *SpanGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if parent := g.ac.span; !parent.isNoop() {
+		parent.SetTag("group.spans", fmt.Sprintf("%d", g.started))
+		parent.SetTag("group.errors", fmt.Sprintf("%d", g.failed))
+		if g.err != nil {
+			parent.SetError(g.err)
+		}
+	}
+
+	return g.err
+}
+
 // WrapAsync wraps a function to preserve trace context
 func WrapAsync(ctx context.Context, fn func(ctx context.Context)) func() {
 	sc, _ := SpanContextFromContext(ctx)
@@ -1,9 +1,15 @@
 package sdk
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
 )
 
 // ErrorSeverity represents the severity level of an error
@@ -24,6 +30,9 @@ type ErrorRecord struct {
 	Severity   ErrorSeverity
 	StackTrace []StackFrame
 	Tags       map[string]string
+	Causes     []models.ErrorCause
+
+	err error
 }
 
 // StackFrame represents a single frame in a stack trace
@@ -33,6 +42,70 @@ type StackFrame struct {
 	Line     int    `json:"line"`
 }
 
+// Well-known error categories tagged as error.category
+const (
+	ErrorCategoryDeadlineExceeded = "deadline_exceeded"
+	ErrorCategoryCancelled        = "cancelled"
+	ErrorCategoryTimeout          = "timeout"
+	ErrorCategoryDNS              = "dns"
+	ErrorCategoryNetwork          = "network"
+)
+
+// maxErrorCauses bounds the recorded cause chain
+const maxErrorCauses = 16
+
+// ErrorCauses walks the wrapped error chain (including errors.Join trees,
+// depth first) and returns each cause's type and message, outermost first
+func ErrorCauses(err error) []models.ErrorCause {
+	var causes []models.ErrorCause
+	queue := []error{err}
+	for len(queue) > 0 && len(causes) < maxErrorCauses {
+		e := queue[0]
+		queue = queue[1:]
+		if e == nil {
+			continue
+		}
+		causes = append(causes, models.ErrorCause{
+			Type:    fmt.Sprintf("%T", e),
+			Message: e.Error(),
+		})
+		switch u := e.(type) {
+		case interface{ Unwrap() error }:
+			queue = append([]error{u.Unwrap()}, queue...)
+		case interface{ Unwrap() []error }:
+			queue = append(u.Unwrap(), queue...)
+		}
+	}
+	return causes
+}
+
+// ErrorCategory classifies err into a well-known category so the backend
+// can aggregate by error class. It returns "" for unclassified errors.
+func ErrorCategory(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorCategoryDeadlineExceeded
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorCategoryCancelled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorCategoryTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrorCategoryDNS
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return ErrorCategoryNetwork
+	}
+	return ""
+}
+
 // CaptureError captures an error with stack trace
 func CaptureError(err error) *ErrorRecord {
 	return &ErrorRecord{
@@ -41,6 +114,8 @@ func CaptureError(err error) *ErrorRecord {
 		Severity:   SeverityError,
 		StackTrace: captureStackTrace(2),
 		Tags:       make(map[string]string),
+		Causes:     ErrorCauses(err),
+		err:        err,
 	}
 }
 
@@ -59,7 +134,7 @@ func (e *ErrorRecord) WithTag(key, value string) *ErrorRecord {
 
 // AttachToSpan attaches the error to a span
 func (e *ErrorRecord) AttachToSpan(span *SpanBuilder) {
-	if span == nil {
+	if span.isNoop() {
 		return
 	}
 
@@ -69,7 +144,12 @@ func (e *ErrorRecord) AttachToSpan(span *SpanBuilder) {
 		stackStrings[i] = fmt.Sprintf("%s (%s:%d)", frame.Function, frame.File, frame.Line)
 	}
 
-	span.SetErrorWithStack(fmt.Errorf("%s", e.Message), stackStrings)
+	err := e.err
+	if err == nil {
+		err = fmt.Errorf("%s", e.Message)
+	}
+	span.SetErrorWithStack(err, stackStrings)
+	span.span.ErrorInfo.Type = e.Type
 	span.SetTag("error.type", e.Type)
 	span.SetTag("error.severity", string(e.Severity))
 
@@ -131,18 +211,76 @@ func GetCurrentStackTrace(skip int) []string {
 	return result
 }
 
-// RecoverWithSpan recovers from a panic and records it on the span
-func RecoverWithSpan(span *SpanBuilder) {
+// RecoverOption configures panic handling in RecoverWithSpan
+type RecoverOption func(*recoverConfig)
+
+type recoverConfig struct {
+	repanic  bool
+	callback func(recovered interface{}, record *ErrorRecord)
+}
+
+// WithoutRepanic suppresses the re-panic after the panic has been recorded,
+// letting long-running workers continue
+func WithoutRepanic() RecoverOption {
+	return func(c *recoverConfig) {
+		c.repanic = false
+	}
+}
+
+// WithPanicCallback invokes fn with the recovered value and the error record
+// after the panic has been recorded on the span
+func WithPanicCallback(fn func(recovered interface{}, record *ErrorRecord)) RecoverOption {
+	return func(c *recoverConfig) {
+		c.callback = fn
+	}
+}
+
+// RecoverWithSpan recovers from a panic and records it on the span. By
+// default the panic is re-raised after recording; see WithoutRepanic.
+func RecoverWithSpan(span *SpanBuilder, opts ...RecoverOption) {
 	if r := recover(); r != nil {
-		err := fmt.Errorf("panic: %v", r)
-		record := &ErrorRecord{
-			Message:    err.Error(),
-			Type:       "panic",
-			Severity:   SeverityCritical,
-			StackTrace: captureStackTrace(2),
-		}
-		record.AttachToSpan(span)
-		span.Finish()
+		handlePanic(span, r, opts)
+	}
+}
+
+// RecoverAndContinue recovers from a panic, records it on the span and
+// returns normally instead of re-panicking
+func RecoverAndContinue(span *SpanBuilder, opts ...RecoverOption) {
+	if r := recover(); r != nil {
+		handlePanic(span, r, append([]RecoverOption{WithoutRepanic()}, opts...))
+	}
+}
+
+// handlePanic records a recovered value as a typed panic event on the span
+func handlePanic(span *SpanBuilder, r interface{}, opts []RecoverOption) {
+	cfg := recoverConfig{repanic: true}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	err := fmt.Errorf("panic: %v", r)
+	record := &ErrorRecord{
+		Message:    err.Error(),
+		Type:       "panic",
+		Severity:   SeverityCritical,
+		StackTrace: captureStackTrace(3),
+		Tags: map[string]string{
+			"panic.value_type": fmt.Sprintf("%T", r),
+		},
+	}
+	record.AttachToSpan(span)
+	span.LogFields(map[string]string{
+		"event":       "panic",
+		"panic.type":  fmt.Sprintf("%T", r),
+		"panic.value": fmt.Sprintf("%v", r),
+	})
+	span.Finish()
+
+	if cfg.callback != nil {
+		cfg.callback(r, record)
+	}
+
+	if cfg.repanic {
 		panic(r) // Re-panic after recording
 	}
 }
@@ -181,10 +319,7 @@ func (l *ErrorLogger) LogError(err error, tags map[string]string) {
 	for k, v := range tags {
 		record.Tags[k] = v
 	}
-	record.Tags["service"] = l.service
-
-	// Could be sent as a special error event
-	// For now, we just capture it with the stack
+	l.export(record)
 }
 
 // LogErrorWithSeverity logs an error with a specific severity
@@ -193,5 +328,28 @@ func (l *ErrorLogger) LogErrorWithSeverity(err error, severity ErrorSeverity, ta
 	for k, v := range tags {
 		record.Tags[k] = v
 	}
+	l.export(record)
+}
+
+// export ships the record to the collector as a standalone error event
+func (l *ErrorLogger) export(record *ErrorRecord) {
 	record.Tags["service"] = l.service
+
+	if l.exporter == nil {
+		return
+	}
+	l.exporter.ExportError(record.ToEvent(l.service))
+}
+
+// ToEvent converts the record into an error event payload for export
+func (e *ErrorRecord) ToEvent(service string) models.ErrorEvent {
+	return models.ErrorEvent{
+		Timestamp:  time.Now(),
+		Service:    service,
+		Message:    e.Message,
+		Type:       e.Type,
+		Severity:   string(e.Severity),
+		StackTrace: e.StackTraceStrings(),
+		Tags:       e.Tags,
+	}
 }
@@ -2,13 +2,17 @@ package sdk
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/omnitrace/omnitrace/internal/models"
+	"github.com/omnitrace/omnitrace/internal/msgpack"
 )
 
 // Exporter handles exporting spans and metrics to the collector
@@ -17,23 +21,48 @@ type Exporter struct {
 	client        *http.Client
 	spanBuffer    []models.Span
 	metricBuffer  []models.Metric
+	errorBuffer   []models.ErrorEvent
 	batchSize     int
 	flushInterval time.Duration
 	mu            sync.Mutex
 	stopCh        chan struct{}
 	wg            sync.WaitGroup
 	onError       func(error)
+	authToken     string
+	headers       map[string]string
+	encoding      Encoding
+	// datagrams is set when exporting to a local agent over UDP
+	datagrams *datagramSender
+	// sending tracks the batches being sent in the background
+	sending sync.WaitGroup
 }
 
 // ExporterConfig configures the exporter
 type ExporterConfig struct {
+	// CollectorURL is the collector's base URL, or a local agent's
+	// unix:///path/to/socket or udp://host:port
 	CollectorURL  string
 	BatchSize     int
 	FlushInterval time.Duration
 	Timeout       time.Duration
 	OnError       func(error)
+	// AuthToken is sent as a bearer token when the collector requires auth
+	AuthToken string
+	// Headers are added to every export request
+	Headers map[string]string
+	// Encoding is the body format of export requests, JSON by default.
+	// Datagrams to a udp:// agent are always JSON.
+	Encoding Encoding
 }
 
+// Encoding is a body format of export requests
+type Encoding string
+
+const (
+	EncodingJSON    Encoding = "json"
+	EncodingMsgpack Encoding = "msgpack"
+)
+
 // DefaultExporterConfig returns default exporter configuration
 func DefaultExporterConfig() ExporterConfig {
 	return ExporterConfig{
@@ -51,10 +80,23 @@ func NewExporter(config ExporterConfig) *Exporter {
 		client:        &http.Client{Timeout: config.Timeout},
 		spanBuffer:    make([]models.Span, 0, config.BatchSize),
 		metricBuffer:  make([]models.Metric, 0, config.BatchSize),
+		errorBuffer:   make([]models.ErrorEvent, 0),
 		batchSize:     config.BatchSize,
 		flushInterval: config.FlushInterval,
 		stopCh:        make(chan struct{}),
 		onError:       config.OnError,
+		authToken:     config.AuthToken,
+		headers:       config.Headers,
+		encoding:      config.Encoding,
+	}
+
+	switch {
+	case strings.HasPrefix(config.CollectorURL, "unix://"):
+		// The ingestion API over the agent's socket; the host is unused
+		e.client.Transport = unixTransport(strings.TrimPrefix(config.CollectorURL, "unix://"))
+		e.collectorURL = "http://omnitrace-agent"
+	case strings.HasPrefix(config.CollectorURL, "udp://"):
+		e.datagrams = &datagramSender{addr: strings.TrimPrefix(config.CollectorURL, "udp://")}
 	}
 
 	e.wg.Add(1)
@@ -87,6 +129,18 @@ func (e *Exporter) ExportMetric(metric models.Metric) {
 	}
 }
 
+// ExportError adds a standalone error event to the export buffer
+func (e *Exporter) ExportError(event models.ErrorEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.errorBuffer = append(e.errorBuffer, event)
+
+	if len(e.errorBuffer) >= e.batchSize {
+		e.flushErrorsLocked()
+	}
+}
+
 // Flush forces an immediate flush of all buffers
 func (e *Exporter) Flush() error {
 	e.mu.Lock()
@@ -99,14 +153,23 @@ func (e *Exporter) Flush() error {
 	if err := e.flushMetricsLocked(); err != nil {
 		lastErr = err
 	}
+	if err := e.flushErrorsLocked(); err != nil {
+		lastErr = err
+	}
 	return lastErr
 }
 
-// Close stops the exporter and flushes remaining data
+// Close stops the exporter and flushes remaining data, waiting for it to
+// be sent
 func (e *Exporter) Close() error {
 	close(e.stopCh)
 	e.wg.Wait()
-	return e.Flush()
+	err := e.Flush()
+	e.sending.Wait()
+	if e.datagrams != nil {
+		e.datagrams.Close()
+	}
+	return err
 }
 
 func (e *Exporter) flushLoop() {
@@ -135,7 +198,9 @@ func (e *Exporter) flushSpansLocked() error {
 	e.spanBuffer = e.spanBuffer[:0]
 
 	// Send in background
+	e.sending.Add(1)
 	go func() {
+		defer e.sending.Done()
 		if err := e.sendSpans(spans); err != nil {
 			if e.onError != nil {
 				e.onError(err)
@@ -156,7 +221,9 @@ func (e *Exporter) flushMetricsLocked() error {
 	e.metricBuffer = e.metricBuffer[:0]
 
 	// Send in background
+	e.sending.Add(1)
 	go func() {
+		defer e.sending.Done()
 		if err := e.sendMetrics(metrics); err != nil {
 			if e.onError != nil {
 				e.onError(err)
@@ -167,49 +234,134 @@ func (e *Exporter) flushMetricsLocked() error {
 	return nil
 }
 
+func (e *Exporter) flushErrorsLocked() error {
+	if len(e.errorBuffer) == 0 {
+		return nil
+	}
+
+	events := make([]models.ErrorEvent, len(e.errorBuffer))
+	copy(events, e.errorBuffer)
+	e.errorBuffer = e.errorBuffer[:0]
+
+	// Send in background
+	e.sending.Add(1)
+	go func() {
+		defer e.sending.Done()
+		if err := e.sendErrors(events); err != nil {
+			if e.onError != nil {
+				e.onError(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
 func (e *Exporter) sendSpans(spans []models.Span) error {
+	if e.datagrams != nil {
+		return sendDatagrams(e.datagrams, spans, func(spans []models.Span) any { return models.SpanBatch{Spans: spans} })
+	}
+
 	batch := models.SpanBatch{Spans: spans}
 
-	data, err := json.Marshal(batch)
+	data, err := e.marshal(batch)
 	if err != nil {
 		return fmt.Errorf("failed to marshal spans: %w", err)
 	}
 
-	resp, err := e.client.Post(
-		e.collectorURL+"/api/v1/spans",
-		"application/json",
-		bytes.NewReader(data),
-	)
+	var result models.IngestResult
+	err = e.post("/api/v1/spans", data, &result)
+	if result.Rejected > 0 {
+		return &RejectedSpansError{Result: result}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to send spans: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("collector returned status %d", resp.StatusCode)
-	}
 
 	return nil
 }
 
 func (e *Exporter) sendMetrics(metrics []models.Metric) error {
+	if e.datagrams != nil {
+		return sendDatagrams(e.datagrams, metrics, func(metrics []models.Metric) any { return models.MetricBatch{Metrics: metrics} })
+	}
+
 	batch := models.MetricBatch{Metrics: metrics}
 
-	data, err := json.Marshal(batch)
+	data, err := e.marshal(batch)
 	if err != nil {
 		return fmt.Errorf("failed to marshal metrics: %w", err)
 	}
 
-	resp, err := e.client.Post(
-		e.collectorURL+"/api/v1/metrics",
-		"application/json",
-		bytes.NewReader(data),
-	)
-	if err != nil {
+	if err := e.post("/api/v1/metrics", data, nil); err != nil {
 		return fmt.Errorf("failed to send metrics: %w", err)
 	}
+
+	return nil
+}
+
+func (e *Exporter) sendErrors(events []models.ErrorEvent) error {
+	if e.datagrams != nil {
+		return sendDatagrams(e.datagrams, events, func(events []models.ErrorEvent) any { return models.ErrorEventBatch{Errors: events} })
+	}
+
+	batch := models.ErrorEventBatch{Errors: events}
+
+	data, err := e.marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal error events: %w", err)
+	}
+
+	if err := e.post("/api/v1/errors", data, nil); err != nil {
+		return fmt.Errorf("failed to send error events: %w", err)
+	}
+
+	return nil
+}
+
+// marshal encodes a batch in the exporter's encoding
+func (e *Exporter) marshal(batch any) ([]byte, error) {
+	if e.encoding == EncodingMsgpack {
+		return msgpack.Marshal(batch)
+	}
+	return json.Marshal(batch)
+}
+
+// post sends a payload encoded by marshal to the collector. The JSON
+// response of a request accepted or rejected as a bad request is decoded
+// into result unless it is nil.
+func (e *Exporter) post(path string, data []byte, result any) error {
+	req, err := http.NewRequest(http.MethodPost, e.collectorURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if e.encoding == EncodingMsgpack {
+		req.Header.Set("Content-Type", msgpack.ContentType)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// A collector that has seen the key, because a proxy retried the
+	// request, replies as before rather than storing the batch again
+	req.Header.Set(models.IdempotencyHeader, rand.Text())
+	if e.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.authToken)
+	}
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 
+	if result != nil {
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusAccepted, http.StatusBadRequest:
+			json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result)
+		}
+	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		return fmt.Errorf("collector returned status %d", resp.StatusCode)
 	}
@@ -217,10 +369,26 @@ func (e *Exporter) sendMetrics(metrics []models.Metric) error {
 	return nil
 }
 
+// RejectedSpansError is passed to OnError when the collector rejects
+// spans of a batch. The batch's other spans were accepted.
+type RejectedSpansError struct {
+	Result models.IngestResult
+}
+
+func (e *RejectedSpansError) Error() string {
+	msg := fmt.Sprintf("collector rejected %d of %d spans", e.Result.Rejected, e.Result.Accepted+e.Result.Rejected)
+	if len(e.Result.Errors) > 0 {
+		first := e.Result.Errors[0]
+		msg += fmt.Sprintf(" (span %d: %s)", first.Index, first.Reason)
+	}
+	return msg
+}
+
 // NoopExporter is an exporter that does nothing (for testing)
 type NoopExporter struct{}
 
-func (NoopExporter) Export(span models.Span)           {}
-func (NoopExporter) ExportMetric(metric models.Metric) {}
-func (NoopExporter) Flush() error                      { return nil }
-func (NoopExporter) Close() error                      { return nil }
+func (NoopExporter) Export(span models.Span)             {}
+func (NoopExporter) ExportMetric(metric models.Metric)   {}
+func (NoopExporter) ExportError(event models.ErrorEvent) {}
+func (NoopExporter) Flush() error                        { return nil }
+func (NoopExporter) Close() error                        { return nil }
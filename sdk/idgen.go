@@ -0,0 +1,116 @@
+package sdk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	mathrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+// IDGenerator generates trace and span IDs as lowercase hex strings
+// (32 characters for trace IDs, 16 for span IDs)
+type IDGenerator interface {
+	NewTraceID() string
+	NewSpanID() string
+}
+
+// RandomIDGenerator generates fully random IDs. It is the default.
+type RandomIDGenerator struct{}
+
+// NewTraceID generates a random 128-bit trace ID
+func (RandomIDGenerator) NewTraceID() string {
+	b := make([]byte, 16)
+	randomBytes(b)
+	return hex.EncodeToString(b)
+}
+
+// NewSpanID generates a random 64-bit span ID
+func (RandomIDGenerator) NewSpanID() string {
+	b := make([]byte, 8)
+	randomBytes(b)
+	return hex.EncodeToString(b)
+}
+
+// TimePrefixedIDGenerator generates trace IDs whose first 48 bits are the
+// Unix time in milliseconds, so IDs sort roughly by creation time and
+// storage keyed by trace ID gets better locality
+type TimePrefixedIDGenerator struct{}
+
+// NewTraceID generates a millisecond-prefixed 128-bit trace ID
+func (TimePrefixedIDGenerator) NewTraceID() string {
+	b := make([]byte, 16)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixMilli()))
+	copy(b[:6], ts[2:])
+	randomBytes(b[6:])
+	return hex.EncodeToString(b)
+}
+
+// NewSpanID generates a random 64-bit span ID
+func (TimePrefixedIDGenerator) NewSpanID() string {
+	return RandomIDGenerator{}.NewSpanID()
+}
+
+// XRayIDGenerator generates AWS X-Ray compatible trace IDs: the first 32
+// bits are the Unix time in seconds, followed by 96 random bits
+type XRayIDGenerator struct{}
+
+// NewTraceID generates an X-Ray compatible 128-bit trace ID
+func (XRayIDGenerator) NewTraceID() string {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b[:4], uint32(time.Now().Unix()))
+	randomBytes(b[4:])
+	return hex.EncodeToString(b)
+}
+
+// NewSpanID generates a random 64-bit span ID
+func (XRayIDGenerator) NewSpanID() string {
+	return RandomIDGenerator{}.NewSpanID()
+}
+
+// SequentialIDGenerator generates deterministic, increasing IDs for tests
+type SequentialIDGenerator struct {
+	mu        sync.Mutex
+	nextTrace uint64
+	nextSpan  uint64
+}
+
+// NewSequentialIDGenerator creates a generator whose first IDs are 1
+func NewSequentialIDGenerator() *SequentialIDGenerator {
+	return &SequentialIDGenerator{nextTrace: 1, nextSpan: 1}
+}
+
+// NewTraceID returns the next trace ID in sequence
+func (g *SequentialIDGenerator) NewTraceID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[8:], g.nextTrace)
+	g.nextTrace++
+	return hex.EncodeToString(b)
+}
+
+// NewSpanID returns the next span ID in sequence
+func (g *SequentialIDGenerator) NewSpanID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, g.nextSpan)
+	g.nextSpan++
+	return hex.EncodeToString(b)
+}
+
+// randomBytes fills b from crypto/rand, falling back to the math/rand/v2
+// generator if the system entropy source fails, so IDs are never all zero
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err == nil {
+		return
+	}
+	for i := 0; i < len(b); i += 8 {
+		var chunk [8]byte
+		binary.LittleEndian.PutUint64(chunk[:], mathrand.Uint64())
+		copy(b[i:], chunk[:])
+	}
+}
@@ -0,0 +1,133 @@
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/omnitrace/omnitrace/internal/models"
+)
+
+// Job status values recorded on job spans and metrics
+const (
+	JobStatusSuccess = "success"
+	JobStatusFailure = "failure"
+)
+
+// Job tracks a single execution of a background job or queue message
+type Job struct {
+	name      string
+	tracer    *Tracer
+	span      *SpanBuilder
+	startTime time.Time
+	ended     bool
+}
+
+// StartJob starts a root span for a background job using the global tracer.
+// Jobs begin a new trace unless a parent is supplied via WithParentContext
+// (e.g. a trace context carried on a queue message).
+func StartJob(ctx context.Context, name string, opts ...SpanOption) (*Job, context.Context) {
+	return GlobalTracer().StartJob(ctx, name, opts...)
+}
+
+// StartJob starts a root span for a background job
+func (t *Tracer) StartJob(ctx context.Context, name string, opts ...SpanOption) (*Job, context.Context) {
+	opts = append([]SpanOption{
+		WithContext(ctx),
+		WithKind(models.SpanKindConsumer),
+		WithTag("job.name", name),
+	}, opts...)
+
+	span := t.StartSpan(name, opts...)
+	newCtx := ContextWithSpan(ctx, span)
+	newCtx = ContextWithSpanContext(newCtx, span.Context())
+
+	return &Job{
+		name:      name,
+		tracer:    t,
+		span:      span,
+		startTime: time.Now(),
+	}, newCtx
+}
+
+// Span returns the job's span
+func (j *Job) Span() *SpanBuilder {
+	return j.span
+}
+
+// End finishes the job span, recording success or failure, and emits a
+// job_duration_ms metric through the tracer's exporter
+func (j *Job) End(err error) {
+	if j.ended {
+		return
+	}
+	j.ended = true
+
+	status := JobStatusSuccess
+	if err != nil {
+		status = JobStatusFailure
+		j.span.SetError(err)
+	}
+	j.span.SetTag("job.status", status)
+	j.span.Finish()
+
+	if j.tracer.exporter != nil && j.tracer.enabled {
+		metric := models.NewGauge(
+			"job_duration_ms",
+			float64(time.Since(j.startTime).Milliseconds()),
+			j.tracer.serviceName,
+		)
+		metric.WithLabel("job", j.name)
+		metric.WithLabel("status", status)
+		j.tracer.exporter.ExportMetric(*metric)
+	}
+}
+
+// JobRunner runs cron jobs and queue workers inside job spans
+type JobRunner struct {
+	tracer *Tracer
+	kind   models.SpanKind
+}
+
+// NewJobRunner creates a job runner. Jobs are recorded as consumer spans by
+// default; use NewProducerJobRunner for jobs that enqueue work.
+func NewJobRunner(tracer *Tracer) *JobRunner {
+	return &JobRunner{
+		tracer: tracer,
+		kind:   models.SpanKindConsumer,
+	}
+}
+
+// NewProducerJobRunner creates a job runner that records producer spans
+func NewProducerJobRunner(tracer *Tracer) *JobRunner {
+	return &JobRunner{
+		tracer: tracer,
+		kind:   models.SpanKindProducer,
+	}
+}
+
+// Run executes fn inside a job span. Returned errors and panics mark the job
+// as failed; panics are re-raised after being recorded.
+func (jr *JobRunner) Run(ctx context.Context, name string, fn func(ctx context.Context) error, opts ...SpanOption) (err error) {
+	opts = append([]SpanOption{WithKind(jr.kind)}, opts...)
+	job, ctx := jr.tracer.StartJob(ctx, name, opts...)
+
+	defer func() {
+		if r := recover(); r != nil {
+			job.Span().SetTag("error.type", "panic")
+			job.End(fmt.Errorf("panic: %v", r))
+			panic(r)
+		}
+		job.End(err)
+	}()
+
+	return fn(ctx)
+}
+
+// Wrap returns fn instrumented as a job, suitable for cron schedulers and
+// queue consumer callbacks
+func (jr *JobRunner) Wrap(name string, fn func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return jr.Run(ctx, name, fn)
+	}
+}
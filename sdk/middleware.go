@@ -1,9 +1,14 @@
 package sdk
 
 import (
+	"bufio"
 	"fmt"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/omnitrace/omnitrace/internal/models"
@@ -17,7 +22,21 @@ type Middleware struct {
 
 // MiddlewareConfig configures the middleware behavior
 type MiddlewareConfig struct {
-	SkipPaths      []string
+	// SkipPaths are path prefixes that are never traced
+	SkipPaths []string
+	// SkipPatterns are glob patterns (path.Match syntax) that are never traced
+	SkipPatterns []string
+	// SkipRegexps are regular expressions matched against the request path
+	SkipRegexps []*regexp.Regexp
+	// DisableDefaultSkips turns off the built-in DefaultSkipPaths set
+	DisableDefaultSkips bool
+	// TrackConnections keeps WebSocket and SSE spans open for the lifetime of
+	// the connection, recording connect/disconnect events and message counts
+	TrackConnections bool
+	// URLSanitizer, when set, is applied to the request URL before it is
+	// recorded as the http.url tag (e.g. SanitizeURL)
+	URLSanitizer func(string) string
+
 	OperationNamer func(r *http.Request) string
 	SpanFilter     func(r *http.Request) bool
 	ErrorHandler   func(w http.ResponseWriter, r *http.Request, span *SpanBuilder, err interface{})
@@ -41,9 +60,36 @@ func NewMiddleware(tracer *Tracer, config ...MiddlewareConfig) *Middleware {
 			m.config.SpanFilter = func(r *http.Request) bool { return true }
 		}
 	}
+	if !m.config.DisableDefaultSkips {
+		m.config.SkipPatterns = append(append([]string{}, DefaultSkipPaths...), m.config.SkipPatterns...)
+	}
 	return m
 }
 
+// DefaultSkipPaths are probe and asset paths that are skipped unless
+// DisableDefaultSkips is set, so health checks don't dominate trace volume
+var DefaultSkipPaths = []string{"/healthz", "/readyz", "/metrics", "/favicon.ico"}
+
+// shouldSkip reports whether the request path matches any skip rule
+func (m *Middleware) shouldSkip(p string) bool {
+	for _, prefix := range m.config.SkipPaths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	for _, pattern := range m.config.SkipPatterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	for _, re := range m.config.SkipRegexps {
+		if re != nil && re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
 func defaultOperationNamer(r *http.Request) string {
 	return fmt.Sprintf("%s %s", r.Method, r.URL.Path)
 }
@@ -52,11 +98,9 @@ func defaultOperationNamer(r *http.Request) string {
 func (m *Middleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check skip paths
-		for _, path := range m.config.SkipPaths {
-			if strings.HasPrefix(r.URL.Path, path) {
-				next.ServeHTTP(w, r)
-				return
-			}
+		if m.shouldSkip(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
 		}
 
 		// Check span filter
@@ -68,11 +112,17 @@ func (m *Middleware) Handler(next http.Handler) http.Handler {
 		// Extract trace context from headers
 		spanCtx := extractSpanContext(r)
 
+		requestURL := r.URL.String()
+		if m.config.URLSanitizer != nil {
+			requestURL = m.config.URLSanitizer(requestURL)
+		}
+
 		// Create span options
 		opts := []SpanOption{
+			WithContext(r.Context()),
 			WithKind(models.SpanKindServer),
 			WithTag("http.method", r.Method),
-			WithTag("http.url", r.URL.String()),
+			WithTag("http.url", requestURL),
 			WithTag("http.host", r.Host),
 			WithTag("http.user_agent", r.UserAgent()),
 		}
@@ -92,19 +142,46 @@ func (m *Middleware) Handler(next http.Handler) http.Handler {
 
 		// Wrap response writer to capture status code
 		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		if m.config.TrackConnections {
+			if kind := connectionType(r); kind != "" {
+				rw.conn = newConnTracker(span, kind)
+			}
+		}
+
+		finish := func() {
+			// Record response
+			span.SetTag("http.status_code", fmt.Sprintf("%d", rw.statusCode))
+
+			if rw.statusCode >= 400 {
+				span.SetTag("error", "true")
+				span.span.Status = models.SpanStatusError
+				span.span.StatusMessage = fmt.Sprintf("HTTP %d", rw.statusCode)
+			}
+
+			span.Finish()
+		}
 
 		// Handle panics
 		defer func() {
 			if err := recover(); err != nil {
-				span.SetTag("error", "true")
-				span.SetTag("error.type", "panic")
-				span.LogFields(map[string]string{
-					"event":   "panic",
-					"message": fmt.Sprintf("%v", err),
-				})
-				span.span.Status = models.SpanStatusError
-				span.span.StatusMessage = fmt.Sprintf("panic: %v", err)
-				span.Finish()
+				finishPanic := func() {
+					span.SetTag("error", "true")
+					span.SetTag("error.type", "panic")
+					span.LogFields(map[string]string{
+						"event":   "panic",
+						"message": fmt.Sprintf("%v", err),
+					})
+					span.span.Status = models.SpanStatusError
+					span.span.StatusMessage = fmt.Sprintf("panic: %v", err)
+					span.Finish()
+				}
+				// A tracked connection that already disconnected has
+				// finished its span; otherwise it mustn't finish it again
+				if rw.conn != nil {
+					rw.conn.abort(finishPanic)
+				} else {
+					finishPanic()
+				}
 
 				if m.config.ErrorHandler != nil {
 					m.config.ErrorHandler(w, r, span, err)
@@ -114,19 +191,27 @@ func (m *Middleware) Handler(next http.Handler) http.Handler {
 			}
 		}()
 
+		// Tracked connections finish their span on disconnect
+		if rw.conn != nil {
+			rw.conn.onClose = finish
+		}
+
 		// Execute handler
 		next.ServeHTTP(rw, r)
 
-		// Record response
-		span.SetTag("http.status_code", fmt.Sprintf("%d", rw.statusCode))
-
-		if rw.statusCode >= 400 {
-			span.SetTag("error", "true")
-			span.span.Status = models.SpanStatusError
-			span.span.StatusMessage = fmt.Sprintf("HTTP %d", rw.statusCode)
+		if rw.conn != nil {
+			// A hijacked connection outlives the handler and disconnects
+			// when it is closed, after the request context is cancelled,
+			// so the context's status is taken now
+			if rw.hijacked {
+				rw.conn.whileOpen(span.detachContext)
+			} else {
+				rw.conn.disconnect()
+			}
+			return
 		}
 
-		span.Finish()
+		finish()
 	})
 }
 
@@ -135,11 +220,15 @@ func (m *Middleware) HandlerFunc(next http.HandlerFunc) http.HandlerFunc {
 	return m.Handler(next).ServeHTTP
 }
 
-// responseWriter wraps http.ResponseWriter to capture status code
+// responseWriter wraps http.ResponseWriter to capture status code. It passes
+// through http.Flusher, http.Hijacker and http.Pusher so streaming responses
+// and WebSocket upgrades keep working behind the middleware.
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
 	written    bool
+	hijacked   bool
+	conn       *connTracker
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -154,9 +243,54 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	if !rw.written {
 		rw.WriteHeader(http.StatusOK)
 	}
+	if rw.conn != nil {
+		atomic.AddInt64(&rw.conn.sent, 1)
+	}
 	return rw.ResponseWriter.Write(b)
 }
 
+// Flush implements http.Flusher
+func (rw *responseWriter) Flush() {
+	if !rw.written {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.hijacked = true
+	rw.written = true
+	rw.statusCode = http.StatusSwitchingProtocols
+	if rw.conn != nil {
+		conn, brw = rw.conn.wrap(conn, brw)
+	}
+	return conn, brw, nil
+}
+
+// Push implements http.Pusher
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := rw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // W3C Trace Context header names
 const (
 	TraceparentHeader = "traceparent"
@@ -0,0 +1,199 @@
+package sdk
+
+import (
+	"net/url"
+	"strings"
+)
+
+// SQLOption configures SanitizeSQL
+type SQLOption func(*sqlConfig)
+
+type sqlConfig struct {
+	ansiQuotes bool
+}
+
+// WithANSIQuotes keeps double-quoted text, treating it as identifiers as
+// PostgreSQL, SQLite and MySQL's ANSI_QUOTES mode do. By default it is
+// replaced like a string literal, which it is in MySQL.
+func WithANSIQuotes() SQLOption {
+	return func(c *sqlConfig) {
+		c.ansiQuotes = true
+	}
+}
+
+// SanitizeSQL replaces string, dollar-quoted, numeric and hex literals in a
+// SQL query with "?" and strips comments, so that values never end up in
+// span tags. Identifiers such as table1 or `column_2` are left untouched.
+// Single-quoted strings end at the first quote that isn't doubled, as in
+// standard SQL; only E'...' strings take backslash escapes.
+func SanitizeSQL(query string, opts ...SQLOption) string {
+	var cfg sqlConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var b strings.Builder
+	b.Grow(len(query))
+
+	n := len(query)
+	for i := 0; i < n; {
+		c := query[i]
+		switch {
+		// Single-quoted string literal, and PostgreSQL's escape string
+		// literal E'...' in which backslashes escape
+		case c == '\'':
+			i = skipQuoted(query, i, '\'', false)
+			b.WriteByte('?')
+		case (c == 'E' || c == 'e') && i+1 < n && query[i+1] == '\'':
+			i = skipQuoted(query, i+1, '\'', true)
+			b.WriteByte('?')
+
+		// Double-quoted text is an identifier with ANSI quotes and a
+		// string literal otherwise
+		case c == '"' && !cfg.ansiQuotes:
+			i = skipQuoted(query, i, '"', false)
+			b.WriteByte('?')
+
+		// Dollar-quoted string literal: $$...$$ or $tag$...$tag$
+		case c == '$' && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = n
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			b.WriteByte('?')
+
+		// Line comment
+		case c == '-' && i+1 < n && query[i+1] == '-':
+			for i < n && query[i] != '\n' {
+				i++
+			}
+
+		// Block comment
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = n
+			} else {
+				i += end + 4
+			}
+
+		// Quoted identifiers are copied verbatim
+		case c == '"' || c == '`':
+			j := skipQuoted(query, i, c, false)
+			b.WriteString(query[i:j])
+			i = j
+
+		// Identifiers and keywords may contain digits
+		case isIdentStart(c):
+			j := i
+			for j < n && isIdentPart(query[j]) {
+				j++
+			}
+			b.WriteString(query[i:j])
+			i = j
+
+		// Numeric and hex literals
+		case isDigit(c) || (c == '.' && i+1 < n && isDigit(query[i+1])):
+			j := i
+			if c == '0' && i+1 < n && (query[i+1] == 'x' || query[i+1] == 'X') {
+				j += 2
+				for j < n && isHexDigit(query[j]) {
+					j++
+				}
+			} else {
+				for j < n && (isDigit(query[j]) || query[j] == '.' || query[j] == 'e' || query[j] == 'E') {
+					j++
+				}
+			}
+			b.WriteByte('?')
+			i = j
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// skipQuoted returns the index after the text quoted by q that starts at
+// query[i], or len(query) if it isn't closed. A doubled quote is part of
+// the text, and so is a quote after a backslash when backslashes escape.
+func skipQuoted(query string, i int, q byte, backslashes bool) int {
+	n := len(query)
+	for i++; i < n; i++ {
+		switch {
+		case backslashes && query[i] == '\\' && i+1 < n:
+			i++
+		case query[i] == q && i+1 < n && query[i+1] == q:
+			i++
+		case query[i] == q:
+			return i + 1
+		}
+	}
+	return n
+}
+
+// dollarTag returns the opening delimiter of a dollar-quoted string at the
+// start of s, such as "$$" or "$body$", or "" if there is none. Tags can't
+// start with a digit, so positional parameters such as $1 aren't tags.
+func dollarTag(s string) string {
+	if len(s) < 2 || s[0] != '$' {
+		return ""
+	}
+	j := 1
+	if s[j] != '$' {
+		if s[j] != '_' && !(s[j] >= 'a' && s[j] <= 'z') && !(s[j] >= 'A' && s[j] <= 'Z') {
+			return ""
+		}
+		for j < len(s) && (s[j] == '_' || isDigit(s[j]) || (s[j] >= 'a' && s[j] <= 'z') || (s[j] >= 'A' && s[j] <= 'Z')) {
+			j++
+		}
+		if j == len(s) || s[j] != '$' {
+			return ""
+		}
+	}
+	return s[:j+1]
+}
+
+// SanitizeURL removes userinfo, query parameters and fragments from a URL.
+// Unparseable input yields an empty string rather than leaking the raw value.
+func SanitizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+// WithDBStatement records a statement sanitized by SanitizeSQL on the span
+func WithDBStatement(query string, opts ...SQLOption) SpanOption {
+	return func(sb *SpanBuilder) {
+		sb.span.Tags["db.statement"] = SanitizeSQL(query, opts...)
+	}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || c == '@' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,35 @@
+package sdk
+
+import "testing"
+
+func TestSanitizeSQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		opts  []SQLOption
+		want  string
+	}{
+		{name: "literals", query: `SELECT * FROM users WHERE id = 42 AND name = 'bob' AND mask = 0xFF`, want: `SELECT * FROM users WHERE id = ? AND name = ? AND mask = ?`},
+		{name: "identifiers with digits", query: `SELECT col1 FROM table2`, want: `SELECT col1 FROM table2`},
+		{name: "positional parameters", query: `SELECT * FROM t WHERE a = $1 AND b = ?`, want: `SELECT * FROM t WHERE a = $1 AND b = ?`},
+		{name: "comments", query: "SELECT 1 -- secret\nFROM t /* hunter2 */", want: "SELECT ? \nFROM t"},
+		{name: "doubled quote", query: `WHERE pw = 'it''s hunter2'`, want: `WHERE pw = ?`},
+		{name: "backslash before quote ends the literal", query: `WHERE p = 'C:\' AND pw = 'hunter2'`, want: `WHERE p = ? AND pw = ?`},
+		{name: "escape string", query: `WHERE pw = E'it\'s hunter2' AND a = 1`, want: `WHERE pw = ? AND a = ?`},
+		{name: "unterminated literal", query: `WHERE pw = 'hunter2`, want: `WHERE pw = ?`},
+		{name: "double-quoted string", query: `SELECT * FROM t WHERE pw = "hunter2"`, want: `SELECT * FROM t WHERE pw = ?`},
+		{name: "ANSI quotes keep identifiers", query: `SELECT "column_2" FROM t WHERE pw = 'x'`, opts: []SQLOption{WithANSIQuotes()}, want: `SELECT "column_2" FROM t WHERE pw = ?`},
+		{name: "backtick identifiers", query: "SELECT `column_2` FROM t", want: "SELECT `column_2` FROM t"},
+		{name: "dollar quoted", query: `SELECT $$hunter2 'x'$$, 1`, want: `SELECT ?, ?`},
+		{name: "tagged dollar quoted", query: `DO $body$ BEGIN PERFORM 'hunter2'; END $body$`, want: `DO ?`},
+		{name: "tagged dollar quoted containing $$", query: `SELECT $a$ $$ hunter2 $a$ FROM t`, want: `SELECT ? FROM t`},
+		{name: "unterminated dollar quoted", query: `SELECT $$hunter2`, want: `SELECT ?`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeSQL(tt.query, tt.opts...); got != tt.want {
+				t.Errorf("SanitizeSQL(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
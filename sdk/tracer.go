@@ -1,8 +1,10 @@
 package sdk
 
 import (
-	"crypto/rand"
+	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -14,6 +16,7 @@ type Tracer struct {
 	serviceName string
 	exporter    *Exporter
 	sampler     Sampler
+	idGenerator IDGenerator
 	mu          sync.RWMutex
 	enabled     bool
 }
@@ -73,6 +76,7 @@ func NewTracer(serviceName string, opts ...TracerOption) *Tracer {
 	t := &Tracer{
 		serviceName: serviceName,
 		sampler:     AlwaysSample{},
+		idGenerator: RandomIDGenerator{},
 		enabled:     true,
 	}
 	for _, opt := range opts {
@@ -95,6 +99,15 @@ func WithSampler(s Sampler) TracerOption {
 	}
 }
 
+// WithIDGenerator sets the trace and span ID generator for the tracer
+func WithIDGenerator(gen IDGenerator) TracerOption {
+	return func(t *Tracer) {
+		if gen != nil {
+			t.idGenerator = gen
+		}
+	}
+}
+
 // InitGlobalTracer initializes the global tracer
 func InitGlobalTracer(serviceName string, opts ...TracerOption) {
 	globalTracerOnce.Do(func() {
@@ -112,29 +125,58 @@ func GlobalTracer() *Tracer {
 
 // StartSpan creates a new span with the given operation name
 func (t *Tracer) StartSpan(operationName string, opts ...SpanOption) *SpanBuilder {
+	now := time.Now()
 	sb := &SpanBuilder{
 		tracer: t,
+		start:  now,
 		span: models.Span{
-			TraceID:       generateTraceID(),
-			SpanID:        generateSpanID(),
 			OperationName: operationName,
 			ServiceName:   t.serviceName,
 			Kind:          models.SpanKindInternal,
-			StartTime:     time.Now(),
+			StartTime:     now.Round(0), // wall clock only, for display
 			Status:        models.SpanStatusUnset,
 			Tags:          make(map[string]string),
 		},
 	}
+	// Generated IDs that don't parse are left zero, and the collector
+	// rejects the span
+	sb.span.TraceID, _ = models.ParseTraceID(t.idGenerator.NewTraceID())
+	sb.span.SpanID, _ = models.ParseSpanID(t.idGenerator.NewSpanID())
 	for _, opt := range opts {
 		opt(sb)
 	}
+	sb.sampled = t.sampler.ShouldSample(sb.span.TraceID.String())
 	return sb
 }
 
-// SpanBuilder helps construct spans
+// SpanBuilder helps construct spans. All methods are safe to call on a nil
+// or no-op SpanBuilder, in which case they do nothing.
 type SpanBuilder struct {
-	tracer *Tracer
-	span   models.Span
+	tracer  *Tracer
+	span    models.Span
+	ctx     context.Context
+	sampled bool
+
+	// start keeps the monotonic clock reading used to measure duration,
+	// so NTP steps during the span don't skew it
+	start time.Time
+}
+
+// noopSpan is returned by SpanFromContext when the context carries no span
+var noopSpan = &SpanBuilder{}
+
+// isNoop reports whether the builder is nil or the shared no-op span
+func (sb *SpanBuilder) isNoop() bool {
+	return sb == nil || sb.tracer == nil
+}
+
+// IsRecording reports whether the span will be exported. Hot paths can use
+// it to skip building expensive tags for unsampled or no-op spans.
+func (sb *SpanBuilder) IsRecording() bool {
+	if sb.isNoop() {
+		return false
+	}
+	return sb.sampled && sb.tracer.enabled && sb.tracer.exporter != nil
 }
 
 // SpanOption is a function that configures a SpanBuilder
@@ -143,7 +185,7 @@ type SpanOption func(*SpanBuilder)
 // WithParent sets the parent span
 func WithParent(parent *SpanBuilder) SpanOption {
 	return func(sb *SpanBuilder) {
-		if parent != nil {
+		if !parent.isNoop() {
 			sb.span.TraceID = parent.span.TraceID
 			sb.span.ParentSpanID = parent.span.SpanID
 		}
@@ -153,11 +195,26 @@ func WithParent(parent *SpanBuilder) SpanOption {
 // WithParentContext sets the parent from a SpanContext
 func WithParentContext(ctx SpanContext) SpanOption {
 	return func(sb *SpanBuilder) {
-		if ctx.TraceID != "" {
-			sb.span.TraceID = ctx.TraceID
+		if traceID, err := models.ParseTraceID(ctx.TraceID); err == nil {
+			sb.span.TraceID = traceID
 		}
-		if ctx.SpanID != "" {
-			sb.span.ParentSpanID = ctx.SpanID
+		if spanID, err := models.ParseSpanID(ctx.SpanID); err == nil {
+			sb.span.ParentSpanID = spanID
+		}
+	}
+}
+
+// WithContext associates ctx with the span. If ctx has a deadline, the
+// remaining budget is recorded as a tag; if ctx is done when the span
+// finishes, the cancellation reason is recorded.
+func WithContext(ctx context.Context) SpanOption {
+	return func(sb *SpanBuilder) {
+		if ctx == nil {
+			return
+		}
+		sb.ctx = ctx
+		if deadline, ok := ctx.Deadline(); ok {
+			sb.span.Tags["context.deadline_remaining_ms"] = fmt.Sprintf("%d", time.Until(deadline).Milliseconds())
 		}
 	}
 }
@@ -178,86 +235,124 @@ func WithTag(key, value string) SpanOption {
 
 // SetTag adds a tag to the span
 func (sb *SpanBuilder) SetTag(key, value string) *SpanBuilder {
+	if sb.isNoop() {
+		return sb
+	}
 	sb.span.Tags[key] = value
 	return sb
 }
 
 // SetOperationName changes the operation name
 func (sb *SpanBuilder) SetOperationName(name string) *SpanBuilder {
+	if sb.isNoop() {
+		return sb
+	}
 	sb.span.OperationName = name
 	return sb
 }
 
 // LogFields adds a log entry to the span
 func (sb *SpanBuilder) LogFields(fields map[string]string) *SpanBuilder {
+	if sb.isNoop() {
+		return sb
+	}
 	sb.span.AddLog(fields)
 	return sb
 }
 
-// SetError marks the span as errored
+// SetError marks the span as errored, recording the full cause chain
 func (sb *SpanBuilder) SetError(err error) *SpanBuilder {
-	sb.span.Status = models.SpanStatusError
-	sb.span.StatusMessage = err.Error()
-	sb.span.ErrorInfo = &models.ErrorInfo{
-		Message: err.Error(),
-		Type:    "error",
+	if err == nil {
+		return sb
 	}
-	return sb
+	return sb.SetErrorWithStack(err, nil)
 }
 
 // SetErrorWithStack marks the span as errored with stack trace
 func (sb *SpanBuilder) SetErrorWithStack(err error, stack []string) *SpanBuilder {
+	if sb.isNoop() || err == nil {
+		return sb
+	}
 	sb.span.Status = models.SpanStatusError
 	sb.span.StatusMessage = err.Error()
 	sb.span.ErrorInfo = &models.ErrorInfo{
 		Message:    err.Error(),
-		Type:       "error",
+		Type:       fmt.Sprintf("%T", err),
+		Category:   ErrorCategory(err),
 		StackTrace: stack,
+		Causes:     ErrorCauses(err),
+	}
+	if sb.span.ErrorInfo.Category != "" {
+		sb.span.Tags["error.category"] = sb.span.ErrorInfo.Category
 	}
 	return sb
 }
 
 // Finish completes the span
 func (sb *SpanBuilder) Finish() {
-	sb.span.EndTime = time.Now()
-	sb.span.CalculateDuration()
+	if sb.isNoop() {
+		return
+	}
+
+	sb.span.Duration = time.Since(sb.start)
+	sb.span.EndTime = sb.span.StartTime.Add(sb.span.Duration)
+	sb.detachContext()
 
 	if sb.span.Status == models.SpanStatusUnset {
 		sb.span.Status = models.SpanStatusOK
 	}
 
 	// Export the span
-	if sb.tracer.exporter != nil && sb.tracer.enabled {
-		if sb.tracer.sampler.ShouldSample(sb.span.TraceID) {
-			sb.tracer.exporter.Export(sb.span)
+	if sb.IsRecording() {
+		sb.tracer.exporter.Export(sb.span)
+	}
+}
+
+// detachContext records why the span's context is done, if it is, and
+// stops Finish from checking it again. Spans that outlive their context,
+// such as those of hijacked connections, detach when it ends.
+func (sb *SpanBuilder) detachContext() {
+	if sb.ctx == nil {
+		return
+	}
+	if reason := contextStatusReason(sb.ctx.Err()); reason != "" {
+		sb.span.Tags["status.reason"] = reason
+		if sb.span.StatusMessage == "" {
+			sb.span.StatusMessage = reason
 		}
 	}
+	sb.ctx = nil
 }
 
 // Context returns the span context
 func (sb *SpanBuilder) Context() SpanContext {
+	if sb.isNoop() {
+		return SpanContext{}
+	}
 	return SpanContext{
-		TraceID: sb.span.TraceID,
-		SpanID:  sb.span.SpanID,
-		Sampled: true,
+		TraceID: sb.span.TraceID.String(),
+		SpanID:  sb.span.SpanID.String(),
+		Sampled: sb.sampled,
 	}
 }
 
 // Span returns the underlying span (for testing)
 func (sb *SpanBuilder) Span() models.Span {
+	if sb == nil {
+		return models.Span{}
+	}
 	return sb.span
 }
 
-// generateTraceID generates a random 128-bit trace ID
-func generateTraceID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return hex.EncodeToString(b)
-}
-
-// generateSpanID generates a random 64-bit span ID
-func generateSpanID() string {
-	b := make([]byte, 8)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+// contextStatusReason maps a context error to a span status reason
+func contextStatusReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorCategoryDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return ErrorCategoryCancelled
+	}
+	return ""
 }
@@ -0,0 +1,97 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxDatagramSize is the largest UDP payload
+const maxDatagramSize = 65507
+
+// unixTransport sends HTTP requests over the Unix socket at path, such as
+// a local agent's, whatever their host
+func unixTransport(path string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+}
+
+// datagramSender sends batches to a local agent over UDP, fire and forget:
+// nothing confirms delivery or tells the exporter to retry, so a batch
+// sent while the agent is down is lost. The socket is dialed on first use
+// and again after a failed write.
+type datagramSender struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (d *datagramSender) dial() (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		conn, err := net.Dial("udp", d.addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach agent: %w", err)
+		}
+		d.conn = conn
+	}
+	return d.conn, nil
+}
+
+// write sends one datagram
+func (d *datagramSender) write(data []byte) error {
+	conn, err := d.dial()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		// Such as the refusal reported for an earlier datagram when no
+		// agent is listening
+		d.mu.Lock()
+		if d.conn == conn {
+			conn.Close()
+			d.conn = nil
+		}
+		d.mu.Unlock()
+		return fmt.Errorf("failed to send to agent: %w", err)
+	}
+	return nil
+}
+
+// Close closes the socket
+func (d *datagramSender) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.Close()
+	d.conn = nil
+	return err
+}
+
+// sendDatagrams sends items as batches in the JSON of the ingestion API,
+// one batch per datagram, splitting batches too large for a datagram
+func sendDatagrams[T any](d *datagramSender, items []T, wrap func([]T) any) error {
+	data, err := json.Marshal(wrap(items))
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	if len(data) <= maxDatagramSize {
+		return d.write(data)
+	}
+	if len(items) == 1 {
+		return fmt.Errorf("item of %d bytes is too large for a datagram", len(data))
+	}
+	half := len(items) / 2
+	return errors.Join(sendDatagrams(d, items[:half], wrap), sendDatagrams(d, items[half:], wrap))
+}